@@ -18,21 +18,17 @@ package cmd
 
 import (
 	"bytes"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"math/rand"
-	"net/http"
 	_ "net/http/pprof"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
@@ -41,7 +37,6 @@ import (
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
 	osync "github.com/juicedata/juicefs/pkg/sync"
-	"github.com/juicedata/juicefs/pkg/version"
 	"github.com/urfave/cli/v2"
 )
 
@@ -189,23 +184,30 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 	if err := format.Decrypt(); err != nil {
 		return nil, fmt.Errorf("format decrypt: %s", err)
 	}
-	object.UserAgent = "JuiceFS-" + version.Version()
 	var blob object.ObjectStorage
 	var err error
 
-	if u, err := url.Parse(format.Bucket); err == nil {
-		values := u.Query()
-		if values.Get("tls-insecure-skip-verify") != "" {
-			var tlsSkipVerify bool
-			if tlsSkipVerify, err = strconv.ParseBool(values.Get("tls-insecure-skip-verify")); err != nil {
-				return nil, err
-			}
-			object.GetHttpClient().Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: tlsSkipVerify}
-			values.Del("tls-insecure-skip-verify")
-			u.RawQuery = values.Encode()
-			format.Bucket = u.String()
+	bucket, tlsOpts, err := object.ParseTLSOptions(format.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsOpts.Config()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		object.SetTLSConfig(tlsConfig)
+	}
+	bucket, socksProxy, err := object.ParseSOCKS5Proxy(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if socksProxy != nil {
+		if err = object.SetSOCKS5Proxy(socksProxy); err != nil {
+			return nil, err
 		}
 	}
+	format.Bucket = bucket
 
 	if format.Shards > 1 {
 		blob, err = object.NewSharded(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.SessionToken, format.Shards)
@@ -17,6 +17,7 @@
 package cmd
 
 import (
+	"context"
 	"os"
 	"strconv"
 	"strings"
@@ -53,7 +54,10 @@ $ juicefs gc redis://localhost
 $ juicefs gc redis://localhost --compact
 
 # Delete leaked objects
-$ juicefs gc redis://localhost --delete`,
+$ juicefs gc redis://localhost --delete
+
+# Resume the scan of objects interrupted last time
+$ juicefs gc redis://localhost --delete --resume /var/lib/jfs/gc.cursor`,
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:  "compact",
@@ -69,6 +73,10 @@ $ juicefs gc redis://localhost --delete`,
 				Value:   10,
 				Usage:   "number threads to delete leaked objects",
 			},
+			&cli.StringFlag{
+				Name:  "resume",
+				Usage: "keep the position of the scan of objects in the file, to continue from there when interrupted",
+			},
 		},
 	}
 }
@@ -187,7 +195,12 @@ func gc(ctx *cli.Context) error {
 
 	// Scan all objects to find leaked ones
 	blob = object.WithPrefix(blob, "chunks/")
-	objs, err := osync.ListAll(blob, "", "")
+	var objs <-chan object.Object
+	if cursor := ctx.String("resume"); cursor != "" {
+		objs, err = object.ListAllResumable(context.Background(), blob, "", object.FileCursor(cursor))
+	} else {
+		objs, err = osync.ListAll(blob, "", "")
+	}
 	if err != nil {
 		logger.Fatalf("list all blocks: %s", err)
 	}
@@ -293,6 +306,14 @@ func gc(ctx *cli.Context) error {
 	}
 	close(leakedObj)
 	wg.Wait()
+	if delete {
+		// the parts of the uploads never completed take the space too
+		if n, err := object.AbortStaleUploads(blob, maxMtime); err != nil {
+			logger.Warnf("abort stale uploads: %s", err)
+		} else if n > 0 {
+			logger.Infof("Aborted %d stale uploads", n)
+		}
+	}
 	progress.Done()
 
 	vc, _ := valid.Current()
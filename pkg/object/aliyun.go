@@ -1,38 +1,560 @@
 package object
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/K265/aliyundrive-go/pkg/aliyun/drive"
 	"github.com/google/uuid"
+	"github.com/juju/ratelimit"
+	"golang.org/x/sync/singleflight"
 )
 
+// aliyunDirMarker is the name of the file keeping a key ending with `/`, since
+// the name of a folder can't be an object. It's reserved for the markers.
+const aliyunDirMarker = ".jfs-dir-marker"
+
+// aliyunOptions are the tunables of AliyunStorage, passed as query
+// parameters of the endpoint, e.g. `/juicefs?list-concurrency=8`.
+type aliyunOptions struct {
+	// number of directories fetched in parallel by ListAll
+	listConcurrency int
+	// number of objects deleted in parallel by DeleteAllConcurrently
+	deleteConcurrency int
+	// number of folders created at the same time, apart from the uploads
+	mkdirConcurrency int
+	// spread the objects of a directory into this many buckets, 0 to disable
+	fanout int
+	// spread the keys into this many top directories, 0 to disable (see
+	// WithKeyHashing)
+	keyBuckets int
+	// split the objects larger than this many bytes into parts (see
+	// WithSplitting), 0 to disable
+	splitSize int64
+	// download the files up to this many bytes by the URL found with their
+	// nodes, which saves the call for the URL, 0 to disable
+	inlineReadSize int64
+	// times to reopen a broken download
+	getRetries int
+	// max number of objects returned by a List call
+	maxKeys int64
+	// size of the buffer to coalesce the small reads of downloads in
+	// bytes, 0 to disable
+	readBuffer int
+	// idle connections kept for each host, 0 for the default of Go
+	maxIdleConns int
+	// use HTTP/2 if possible (true) or HTTP/1.1 only (false)
+	http2 bool
+	// interval of TCP keep-alive probes
+	keepAlive time.Duration
+	// close the connections idle for this long, which are likely dropped
+	// by the drive already, 0 for the default of Go
+	idleTimeout time.Duration
+	// keep the temp dir at startup for other clients sharing the workdir
+	keepTemp bool
+	// with keepTemp, the temp files older than this are still removed,
+	// 0 to keep all of them
+	tempTTL time.Duration
+	// base URL of a CDN or mirror to read the objects from first
+	mirror string
+	// times to retry a failed refresh of the token
+	tokenRetries int
+	// calls to the drive per second and the burst of them, 0 for no limit
+	maxRPS   float64
+	rpsBurst int64
+	// retries of the downloads and the refreshes of the token shared by
+	// all of them, nil for no limit
+	retryBudget *RetryBudget
+	// limit of the temp dir cleanup at startup and by Close, it's left to
+	// be cleaned later when exceeded, 0 for no limit
+	cleanupTimeout time.Duration
+	// use the album (true) or the personal drive (false) of the account,
+	// it's detected when empty
+	album string
+	// read from both the album and the personal drive, and write into the
+	// one of album (the personal drive when empty)
+	bothSpaces bool
+	// spread the objects across the accounts by their free space, instead
+	// of using the next one only once the previous one fails
+	poolAccounts bool
+	// keep the metadata of objects in sidecars (see WithMetadataSidecar)
+	metadataSidecar bool
+	// check the size and SHA1 of an object after moved into place
+	verifyMove bool
+	// how to store the keys ending with `/`: "escape" as a file named
+	// aliyunDirMarker in the folder, or "reject" them
+	dirMarkers string
+	// list the folders as the objects of zero bytes ending with `/`, or only
+	// the files (false)
+	listDirs bool
+	// the deepest level of directories walked by the listings, 0 for no
+	// limit
+	maxDepth int
+	// wait up to this long after a Put until the object is found by its
+	// path, 0 to return once it's moved into place
+	visibleTimeout time.Duration
+	// file to keep the listings of directories across the scans, and the
+	// initial interval to revalidate them (see listCache)
+	listCache    string
+	listCacheTTL time.Duration
+	// extra headers of the requests, those of "" are sent with all the
+	// requests and the others with the calls of an API (in aliyunAPIs)
+	headers map[string]http.Header
+	// User-Agent of the requests, UserAgent when empty
+	userAgent string
+}
+
+var defaultAliyunOptions = aliyunOptions{
+	listConcurrency:   4,
+	deleteConcurrency: 4,
+	mkdirConcurrency:  2,
+	getRetries:        3,
+	maxKeys:           1000,
+	readBuffer:        1 << 20,
+	maxIdleConns:      16,
+	http2:             true,
+	keepAlive:         30 * time.Second,
+	idleTimeout:       30 * time.Second,
+	cleanupTimeout:    time.Minute,
+	tokenRetries:      3,
+	listCacheTTL:      time.Hour,
+	dirMarkers:        "escape",
+	maxDepth:          defaultTreeDepth,
+}
+
+// aliyunEndpoint is the spec of the endpoints `aliyun:///<workdir>?<options>`.
+var aliyunEndpoint = EndpointSpec{
+	Scheme: "aliyun",
+	Path:   "workdir",
+	Options: []string{"album", "both-spaces", "cleanup-timeout", "delete-concurrency", "dir-markers", "fanout", "get-retries",
+		"header", "header.", "http2", "idle-timeout", "inline-read-size", "keep-alive", "keep-temp", "key-buckets", "list-cache", "list-cache-ttl",
+		"list-concurrency", "list-dirs", "max-depth", "max-idle-conns", "max-keys", "max-rps", "metadata-sidecar", "mirror",
+		"mkdir-concurrency", "pool-accounts", "read-buffer", "retry-budget", "rps-burst", "temp-ttl", "token-retries",
+		"split-size", "user-agent", "verify-move", "visible-timeout"},
+	Example: "aliyun:///jfs?list-concurrency=8",
+}
+
+func parseAliyunEndpoint(endpoint string) (string, aliyunOptions, error) {
+	opts := defaultAliyunOptions
+	ep, err := ParseEndpoint(endpoint, aliyunEndpoint)
+	if err != nil {
+		return "", opts, err
+	}
+	q := ep.Query
+	if v := q.Get("list-concurrency"); v != "" {
+		if opts.listConcurrency, err = strconv.Atoi(v); err != nil || opts.listConcurrency <= 0 {
+			return "", opts, fmt.Errorf("invalid list-concurrency: %s", v)
+		}
+	}
+	if v := q.Get("delete-concurrency"); v != "" {
+		if opts.deleteConcurrency, err = strconv.Atoi(v); err != nil || opts.deleteConcurrency <= 0 {
+			return "", opts, fmt.Errorf("invalid delete-concurrency: %s", v)
+		}
+	}
+	if v := q.Get("mkdir-concurrency"); v != "" {
+		if opts.mkdirConcurrency, err = strconv.Atoi(v); err != nil || opts.mkdirConcurrency <= 0 {
+			return "", opts, fmt.Errorf("invalid mkdir-concurrency: %s", v)
+		}
+	}
+	if v := q.Get("get-retries"); v != "" {
+		if opts.getRetries, err = strconv.Atoi(v); err != nil || opts.getRetries < 0 {
+			return "", opts, fmt.Errorf("invalid get-retries: %s", v)
+		}
+	}
+	if v := q.Get("max-keys"); v != "" {
+		if opts.maxKeys, err = strconv.ParseInt(v, 10, 64); err != nil || opts.maxKeys <= 0 {
+			return "", opts, fmt.Errorf("invalid max-keys: %s", v)
+		}
+	}
+	if v := q.Get("read-buffer"); v != "" {
+		if opts.readBuffer, err = strconv.Atoi(v); err != nil || opts.readBuffer < 0 {
+			return "", opts, fmt.Errorf("invalid read-buffer: %s", v)
+		}
+	}
+	if v := q.Get("max-idle-conns"); v != "" {
+		if opts.maxIdleConns, err = strconv.Atoi(v); err != nil || opts.maxIdleConns < 0 {
+			return "", opts, fmt.Errorf("invalid max-idle-conns: %s", v)
+		}
+	}
+	if v := q.Get("http2"); v != "" {
+		if opts.http2, err = strconv.ParseBool(v); err != nil {
+			return "", opts, fmt.Errorf("invalid http2: %s", v)
+		}
+	}
+	if v := q.Get("keep-alive"); v != "" {
+		if opts.keepAlive, err = time.ParseDuration(v); err != nil {
+			return "", opts, fmt.Errorf("invalid keep-alive: %s", v)
+		}
+	}
+	if v := q.Get("idle-timeout"); v != "" {
+		if opts.idleTimeout, err = time.ParseDuration(v); err != nil || opts.idleTimeout < 0 {
+			return "", opts, fmt.Errorf("invalid idle-timeout: %s", v)
+		}
+	}
+	if v := q.Get("keep-temp"); v != "" {
+		if opts.keepTemp, err = strconv.ParseBool(v); err != nil {
+			return "", opts, fmt.Errorf("invalid keep-temp: %s", v)
+		}
+	}
+	if v := q.Get("temp-ttl"); v != "" {
+		if opts.tempTTL, err = time.ParseDuration(v); err != nil || opts.tempTTL < 0 {
+			return "", opts, fmt.Errorf("invalid temp-ttl: %s", v)
+		}
+	}
+	if v := q.Get("token-retries"); v != "" {
+		if opts.tokenRetries, err = strconv.Atoi(v); err != nil || opts.tokenRetries < 0 {
+			return "", opts, fmt.Errorf("invalid token-retries: %s", v)
+		}
+	}
+	if v := q.Get("retry-budget"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return "", opts, fmt.Errorf("invalid retry-budget: %s", v)
+		}
+		if n > 0 {
+			opts.retryBudget = NewRetryBudget(n, time.Minute)
+		}
+	}
+	if v := q.Get("dir-markers"); v != "" {
+		if v != "escape" && v != "reject" {
+			return "", opts, fmt.Errorf("invalid dir-markers: %s", v)
+		}
+		opts.dirMarkers = v
+	}
+	if v := q.Get("max-rps"); v != "" {
+		if opts.maxRPS, err = strconv.ParseFloat(v, 64); err != nil || opts.maxRPS < 0 {
+			return "", opts, fmt.Errorf("invalid max-rps: %s", v)
+		}
+	}
+	if v := q.Get("rps-burst"); v != "" {
+		if opts.rpsBurst, err = strconv.ParseInt(v, 10, 64); err != nil || opts.rpsBurst <= 0 {
+			return "", opts, fmt.Errorf("invalid rps-burst: %s", v)
+		}
+	}
+	if v := q.Get("verify-move"); v != "" {
+		if opts.verifyMove, err = strconv.ParseBool(v); err != nil {
+			return "", opts, fmt.Errorf("invalid verify-move: %s", v)
+		}
+	}
+	opts.listCache = q.Get("list-cache")
+	if v := q.Get("list-cache-ttl"); v != "" {
+		if opts.listCacheTTL, err = time.ParseDuration(v); err != nil || opts.listCacheTTL <= 0 {
+			return "", opts, fmt.Errorf("invalid list-cache-ttl: %s", v)
+		}
+	}
+	if v := q.Get("mirror"); v != "" {
+		if _, err = newReadMirror(v); err != nil {
+			return "", opts, err
+		}
+		opts.mirror = v
+	}
+	opts.userAgent = q.Get("user-agent")
+	if v := q.Get("cleanup-timeout"); v != "" {
+		if opts.cleanupTimeout, err = time.ParseDuration(v); err != nil || opts.cleanupTimeout < 0 {
+			return "", opts, fmt.Errorf("invalid cleanup-timeout: %s", v)
+		}
+	}
+	if v := q.Get("album"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", opts, fmt.Errorf("invalid album: %s", v)
+		}
+		opts.album = strconv.FormatBool(b)
+	}
+	if v := q.Get("metadata-sidecar"); v != "" {
+		if opts.metadataSidecar, err = strconv.ParseBool(v); err != nil {
+			return "", opts, fmt.Errorf("invalid metadata-sidecar: %s", v)
+		}
+	}
+	if v := q.Get("pool-accounts"); v != "" {
+		if opts.poolAccounts, err = strconv.ParseBool(v); err != nil {
+			return "", opts, fmt.Errorf("invalid pool-accounts: %s", v)
+		}
+	}
+	if v := q.Get("both-spaces"); v != "" {
+		if opts.bothSpaces, err = strconv.ParseBool(v); err != nil {
+			return "", opts, fmt.Errorf("invalid both-spaces: %s", v)
+		}
+	}
+	if v := q.Get("fanout"); v != "" {
+		if opts.fanout, err = strconv.Atoi(v); err != nil || opts.fanout < 0 {
+			return "", opts, fmt.Errorf("invalid fanout: %s", v)
+		}
+	}
+	if v := q.Get("list-dirs"); v != "" {
+		if opts.listDirs, err = strconv.ParseBool(v); err != nil {
+			return "", opts, fmt.Errorf("invalid list-dirs: %s", v)
+		}
+	}
+	if v := q.Get("max-depth"); v != "" {
+		if opts.maxDepth, err = strconv.Atoi(v); err != nil || opts.maxDepth < 0 {
+			return "", opts, fmt.Errorf("invalid max-depth: %s", v)
+		}
+	}
+	if v := q.Get("visible-timeout"); v != "" {
+		if opts.visibleTimeout, err = time.ParseDuration(v); err != nil || opts.visibleTimeout < 0 {
+			return "", opts, fmt.Errorf("invalid visible-timeout: %s", v)
+		}
+	}
+	if v := q.Get("key-buckets"); v != "" {
+		if opts.keyBuckets, err = strconv.Atoi(v); err != nil || opts.keyBuckets < 0 {
+			return "", opts, fmt.Errorf("invalid key-buckets: %s", v)
+		}
+	}
+	if v := q.Get("inline-read-size"); v != "" {
+		if opts.inlineReadSize, err = strconv.ParseInt(v, 10, 64); err != nil || opts.inlineReadSize < 0 {
+			return "", opts, fmt.Errorf("invalid inline-read-size: %s", v)
+		}
+	}
+	if v := q.Get("split-size"); v != "" {
+		if opts.splitSize, err = strconv.ParseInt(v, 10, 64); err != nil || opts.splitSize < 0 {
+			return "", opts, fmt.Errorf("invalid split-size: %s", v)
+		}
+	}
+	if opts.headers, err = parseAliyunHeaders(q); err != nil {
+		return "", opts, err
+	}
+	return ep.Path, opts, nil
+}
+
+// parseAliyunHeaders parses `header=Name:Value` for all the requests, and
+// `header.<API>=Name:Value` for the calls of an API, e.g. `header.Open`.
+func parseAliyunHeaders(q url.Values) (map[string]http.Header, error) {
+	var headers map[string]http.Header
+	for k, vs := range q {
+		if k != "header" && !strings.HasPrefix(k, "header.") {
+			continue
+		}
+		api := strings.TrimPrefix(strings.TrimPrefix(k, "header"), ".")
+		if api != "" {
+			var valid bool
+			for _, a := range aliyunAPIs {
+				valid = valid || a == api
+			}
+			if !valid {
+				return nil, fmt.Errorf("invalid %s: unknown API %s, it should be one of %s", k, api, strings.Join(aliyunAPIs, ", "))
+			}
+		}
+		for _, v := range vs {
+			parts := strings.SplitN(v, ":", 2)
+			name := strings.TrimSpace(parts[0])
+			if len(parts) != 2 || name == "" {
+				return nil, fmt.Errorf("invalid %s: %s, it should be like Name:Value", k, v)
+			}
+			if headers == nil {
+				headers = make(map[string]http.Header)
+			}
+			if headers[api] == nil {
+				headers[api] = make(http.Header)
+			}
+			headers[api].Add(name, strings.TrimSpace(parts[1]))
+		}
+	}
+	return headers, nil
+}
+
+// aliyunLayout decides where the objects are placed under workdir. A layout
+// could group the objects of a directory into bucket directories, which are
+// transparent to the keys, so List can recover the keys by merging the
+// buckets into their parent.
+type aliyunLayout interface {
+	// objectPath returns the path of key relative to workdir
+	objectPath(key string) string
+	// isBucket tells whether a directory is a bucket of its parent
+	isBucket(name string) bool
+}
+
+type flatLayout struct{}
+
+func (flatLayout) objectPath(key string) string { return key }
+func (flatLayout) isBucket(name string) bool    { return false }
+
+// hashLayout stores `dir/name` as `dir/.<hash of name>/name`, so a directory
+// with millions of objects is split into n smaller ones.
+type hashLayout struct {
+	n uint32
+}
+
+func (l hashLayout) objectPath(key string) string {
+	dir, name := path.Split(key)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return fmt.Sprintf("%s.%x/%s", dir, h.Sum32()%l.n, name)
+}
+
+func (l hashLayout) isBucket(name string) bool {
+	if len(name) < 2 || name[0] != '.' {
+		return false
+	}
+	b, err := strconv.ParseUint(name[1:], 16, 32)
+	return err == nil && uint32(b) < l.n && fmt.Sprintf(".%x", b) == name
+}
+
 type AliyunStorage struct {
+	*aliyunState
+	// the context of the calls to the drive (see WithContext), nil for the
+	// background
+	ctx context.Context
+}
+
+// aliyunState is shared by an AliyunStorage and its views in contexts.
+type aliyunState struct {
 	DefaultObjectStorage
 	fs          drive.Fs
 	workdir     string
+	tempMu      sync.RWMutex
 	tempdirID   string
 	nodeIDCache sync.Map
-	getLock     chan struct{}
-	putLock     chan struct{}
+	// the directories being created, shared by the concurrent Puts
+	creating singleflight.Group
+	// the concurrency of Gets and Puts, foreground ones first
+	getLock    *fairSemaphore
+	putLock    *fairSemaphore
+	walker     *treeWalker
+	layout     aliyunLayout
+	getRetries int
+	maxKeys    int64
+	readBuffer int
+	deletes    int
+	locker     KeyLocker
+	counter    *countingDrive
+	mirror     *readMirror
+	headers    map[string]http.Header
+	verifyMove bool
+	visible    time.Duration
+	budget     *RetryBudget
+	swaps      swapGuard
+	rejectDirs bool
+	failover   *failoverDrive
+	// bounds the folders created by the Puts into distinct new directories,
+	// which are throttled by the drive long before the uploads
+	mkdirLock chan struct{}
+	// the uploads in progress by the path and SHA1 of contents
+	uploads singleflight.Group
+	// the temp files of the uploads in progress by name, they are canceled
+	// and removed by Close
+	tempsMu        sync.Mutex
+	temps          map[string]context.CancelFunc
+	putting        sync.WaitGroup
+	closed         bool
+	cleanupTimeout time.Duration
+	inlineReadSize int64
+}
+
+func (s *AliyunStorage) context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// logCall prints an operation on path, with the request id of the context.
+func (s *AliyunStorage) logCall(op, path string) {
+	if id := RequestID(s.context()); id != "" {
+		log.Println(op, path, "request id", id)
+	} else {
+		log.Println(op, path)
+	}
+}
+
+// WithContext returns a view of the storage calling the drive in ctx, which
+// shares everything else with it. The request id of ctx (see WithRequestID)
+// is sent with the requests, and found in their errors and the logs.
+func (s *AliyunStorage) WithContext(ctx context.Context) ObjectStorage {
+	return &AliyunStorage{s.aliyunState, ctx}
+}
+
+// tempdir returns the node of the temp dir, which is changed with the account.
+func (s *AliyunStorage) tempdir() string {
+	s.tempMu.RLock()
+	defer s.tempMu.RUnlock()
+	return s.tempdirID
+}
+
+// switchAccount drops the nodes of the previous account, which are unknown
+// to the next one, and finds the temp dir of it.
+func (s *AliyunStorage) switchAccount() {
+	s.nodeIDCache.Range(func(k, v interface{}) bool {
+		s.nodeIDCache.Delete(k)
+		return true
+	})
+	if s.walker.cache != nil {
+		s.walker.cache.reset()
+	}
+	id, err := s.getNode(filepath.Join(s.workdir, driveTempDir), true)
+	if err != nil {
+		logger.Errorf("Find the temp dir of the account %d: %s", s.ActiveAccount(), err)
+		return
+	}
+	s.tempMu.Lock()
+	s.tempdirID = id
+	s.tempMu.Unlock()
+}
+
+// ActiveAccount returns the index of the account in use among the refresh
+// tokens configured, it's 0 unless failed over.
+func (s *AliyunStorage) ActiveAccount() int {
+	if s.failover == nil {
+		return 0
+	}
+	return s.failover.Active()
 }
 
 func (s *AliyunStorage) getNode(path string, createDir bool) (string, error) {
 	if v, ok := s.nodeIDCache.Load(path); ok {
 		return v.(string), nil
 	}
-	node, err := s.fs.GetByPath(context.Background(), path, drive.AnyKind)
+	if createDir {
+		// a burst of Puts into a new directory creates it only once
+		id, err, _ := s.creating.Do(path, func() (interface{}, error) {
+			return s.lookupNode(path, true)
+		})
+		if err != nil {
+			return "", err
+		}
+		return id.(string), nil
+	}
+	return s.lookupNode(path, false)
+}
+
+func (s *AliyunStorage) lookupNode(path string, createDir bool) (string, error) {
+	if v, ok := s.nodeIDCache.Load(path); ok {
+		return v.(string), nil
+	}
+	node, err := s.fs.GetByPath(s.context(), path, drive.AnyKind)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) && createDir {
-			nodeID, err := s.fs.CreateFolderRecursively(context.Background(), path)
+			s.mkdirLock <- struct{}{}
+			nodeID, err := s.fs.CreateFolderRecursively(s.context(), path)
+			<-s.mkdirLock
+			if err != nil && isAliyunExisted(err) {
+				// created by another client after the lookup
+				var n *drive.Node
+				if n, err = s.fs.GetByPath(s.context(), path, drive.FolderKind); err == nil {
+					nodeID = n.NodeId
+				}
+			}
 			if err != nil {
 				return "", err
 			}
@@ -45,137 +567,2075 @@ func (s *AliyunStorage) getNode(path string, createDir bool) (string, error) {
 	return node.NodeId, nil
 }
 
+// isAliyunExisted tells whether the drive refused to create a node for the
+// name is taken, e.g. a folder in check_name_mode=refuse.
+func isAliyunExisted(err error) bool {
+	return errors.Is(err, drive.ErrorAlreadyExisted) || strings.Contains(err.Error(), "AlreadyExist")
+}
+
+// Prefetch resolves the node ids of the keys with the same parallelism as
+// ListAll, so the following Gets don't need to look them up one by one.
+// The keys not existed are ignored.
+func (s *AliyunStorage) Prefetch(keys []string) {
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		s.walker.lock <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-s.walker.lock
+				wg.Done()
+			}()
+			if _, err := s.getNode(s.path(key), false); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Warnf("prefetch node of %s: %s", key, err)
+			}
+		}(key)
+	}
+	wg.Wait()
+}
+
 func (s *AliyunStorage) path(key string) string {
-	return filepath.Join(s.workdir, key)
+	if strings.HasSuffix(key, "/") {
+		// the markers are not spread into the buckets
+		return filepath.Join(s.workdir, key, aliyunDirMarker)
+	}
+	return filepath.Join(s.workdir, s.layout.objectPath(key))
 }
 
-func (s *AliyunStorage) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
-	s.getLock <- struct{}{}
-	defer func() {
-		<-s.getLock
-	}()
+// checkKey refuses the keys ending with `/` with dir-markers=reject, and the
+// ones clashing with the markers.
+func (s *AliyunStorage) checkKey(key string) error {
+	if strings.HasSuffix(key, "/") {
+		if s.rejectDirs {
+			return fmt.Errorf("key %s: a directory marker is not supported with dir-markers=reject", key)
+		}
+		return nil
+	}
+	if path.Base(key) == aliyunDirMarker {
+		return fmt.Errorf("key %s: the name %s is reserved for directory markers", key, aliyunDirMarker)
+	}
+	return nil
+}
+
+// Head returns the size, mtime and SHA1 of a file, as List does. The drive
+// keeps no ETag, storage class or user metadata of files, see ObjectInfo.
+func (s *AliyunStorage) Head(key string) (Object, error) {
+	if err := s.checkKey(key); err != nil {
+		return nil, err
+	}
 	path := s.path(key)
-	log.Println("Get", path)
-	nodeID, err := s.getNode(path, false)
+	unlock := s.swaps.rlock(path)
+	node, err := s.fs.GetByPath(s.context(), path, drive.FileKind)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted or moved out of band
+			s.nodeIDCache.Delete(path)
+		}
+		unlock()
 		return nil, err
 	}
-	header := map[string]string{}
-	if offset > 0 && length == 0 {
-		header["Range"] = fmt.Sprintf("bytes=%d", offset)
+	s.nodeIDCache.Store(path, node.NodeId)
+	unlock()
+	mtime, _ := node.GetTime()
+	o := obj{key, node.Size, mtime, strings.HasSuffix(key, "/")}
+	if node.Hash != "" {
+		// content_hash of the drive is SHA1 in upper case
+		return &hashedObj{o, HashSHA1, strings.ToLower(node.Hash)}, nil
 	}
-	if length > 0 {
-		header["Range"] = fmt.Sprintf("bytes=%d-%d", offset, offset+length)
+	return &o, nil
+}
+
+func (s *AliyunStorage) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if s.mirror != nil && offset >= 0 {
+		r, err := s.mirror.get(key, offset, length)
+		if err == nil {
+			return r, nil
+		}
+		logger.Debugf("Read %s from the drive: %s", key, err)
+	}
+	if err := s.getLock.acquire(s.context()); err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	defer s.getLock.release()
+	if offset < 0 {
+		return nil, fmt.Errorf("get %s: invalid offset %d", key, offset)
+	}
+	if err := s.checkKey(key); err != nil {
+		return nil, err
 	}
-	r, err := s.fs.Open(context.Background(), nodeID, header)
+	path := s.path(key)
+	s.logCall("Get", path)
+	// the node opened keeps its content even if it's swapped later
+	unlock := s.swaps.rlock(path)
+	_, cached := s.nodeIDCache.Load(path)
+	nodeID, url, err := s.findFile(path, offset)
+	unlock()
 	if err != nil {
 		return nil, err
 	}
-	return r, nil
+	var r io.ReadCloser
+	if url != "" {
+		if r, err = s.fs.(urlDownloader).Download(s.context(), url, s.openHeaders(offset, length)); err != nil {
+			logger.Debugf("Download %s by the URL of its node: %s", key, err)
+		}
+	}
+	if r == nil {
+		r, err = s.open(nodeID, offset, length)
+	}
+	if errors.Is(err, errAccountSwitched) {
+		// the node of the next account
+		if nodeID, err = s.getNode(path, false); err != nil {
+			return nil, err
+		}
+		r, err = s.open(nodeID, offset, length)
+	}
+	var re *rangeError
+	if err != nil && cached && !errors.As(err, &re) {
+		nodeID, r, err = s.reopenStale(path, nodeID, offset, length, err)
+	}
+	if errors.As(err, &re) && re.size == offset {
+		// reading from the end gets nothing
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	var rc io.ReadCloser = &aliyunReader{s: s, nodeID: nodeID, off: offset, limit: length, bounded: length > 0, r: r}
+	if s.readBuffer > 0 {
+		rc = &bufferedReader{bufio.NewReaderSize(rc, s.readBuffer), rc}
+	}
+	return rc, nil
 }
 
-func (s *AliyunStorage) Put(key string, in io.Reader) error {
-	s.putLock <- struct{}{}
-	defer func() {
-		<-s.putLock
+// GetInto reads the range of key from offset into buf, without the buffer
+// and reader of Get. A broken download is reopened as Get does.
+func (s *AliyunStorage) GetInto(key string, offset int64, buf []byte) (int, error) {
+	if s.mirror != nil || len(buf) == 0 {
+		return getInto(s, key, offset, buf)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("get %s: invalid offset %d", key, offset)
+	}
+	if err := s.checkKey(key); err != nil {
+		return 0, err
+	}
+	path := s.path(key)
+	var nodeID string
+	r, err := func() (io.ReadCloser, error) {
+		if err := s.getLock.acquire(s.context()); err != nil {
+			return nil, err
+		}
+		defer s.getLock.release()
+		unlock := s.swaps.rlock(path)
+		_, cached := s.nodeIDCache.Load(path)
+		var err error
+		nodeID, err = s.getNode(path, false)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+		r, err := s.open(nodeID, offset, int64(len(buf)))
+		var re *rangeError
+		if err != nil && cached && !errors.As(err, &re) {
+			nodeID, r, err = s.reopenStale(path, nodeID, offset, int64(len(buf)), err)
+		}
+		return r, err
 	}()
+	var re *rangeError
+	if errors.As(err, &re) && re.size == offset {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get %s: %w", key, err)
+	}
+	ar := aliyunReader{s: s, nodeID: nodeID, off: offset, limit: int64(len(buf)), bounded: true, r: r}
+	defer ar.Close()
+	return readFull(&ar, buf)
+}
+
+// aliyunVersion returns the version of a file, which is its SHA1 or the node
+// id if the drive has not computed it, since an overwrite is a new node.
+func aliyunVersion(node *drive.Node) string {
+	if node.Hash != "" {
+		return strings.ToLower(node.Hash)
+	}
+	return node.NodeId
+}
 
+// GetIfMatch reads the range of key only if its version is still version,
+// see aliyunVersion. The node is looked up again rather than from the cache
+// to find the overwrites by other clients, and the one checked is opened, of
+// which the content never changes. The mirror is not used.
+func (s *AliyunStorage) GetIfMatch(key string, offset, length int64, version string) (io.ReadCloser, string, error) {
+	if offset < 0 {
+		return nil, "", fmt.Errorf("get %s: invalid offset %d", key, offset)
+	}
+	if err := s.checkKey(key); err != nil {
+		return nil, "", err
+	}
+	if err := s.getLock.acquire(s.context()); err != nil {
+		return nil, "", fmt.Errorf("get %s: %w", key, err)
+	}
+	defer s.getLock.release()
 	path := s.path(key)
-	log.Println("Put", path)
-	dir, filename := filepath.Split(path)
-	dirNodeID, err := s.getNode(dir, true)
+	unlock := s.swaps.rlock(path)
+	node, err := s.fs.GetByPath(s.context(), path, drive.FileKind)
 	if err != nil {
-		return fmt.Errorf("get node: %w", err)
+		unlock()
+		return nil, "", err
 	}
-	nodeID, err := s.fs.CreateFile(context.Background(), drive.Node{ParentId: s.tempdirID, Name: uuid.NewString()}, in)
-	if err != nil {
-		return fmt.Errorf("create temp file: %w", err)
+	s.nodeIDCache.Store(path, node.NodeId)
+	unlock()
+	current := aliyunVersion(node)
+	if version != "" && current != version {
+		return nil, current, fmt.Errorf("get %s: %w", key, ErrObjectChanged)
+	}
+	r, err := s.open(node.NodeId, offset, length)
+	var re *rangeError
+	if errors.As(err, &re) && re.size == offset {
+		return io.NopCloser(bytes.NewReader(nil)), current, nil
+	}
+	if errors.Is(err, errAccountSwitched) {
+		// the same version is not in the next account
+		return nil, current, fmt.Errorf("get %s: %s: %w", key, err, ErrObjectChanged)
 	}
-	_, err = s.fs.Move(context.Background(), nodeID, dirNodeID, filename)
 	if err != nil {
-		err = s.delete(key)
-		if err != nil {
-			return fmt.Errorf("delete temp file: %w", err)
-		}
-		_, err = s.fs.Move(context.Background(), nodeID, dirNodeID, filename)
+		return nil, current, fmt.Errorf("get %s: %w", key, err)
+	}
+	var rc io.ReadCloser = &aliyunReader{s: s, nodeID: node.NodeId, off: offset, limit: length, bounded: length > 0, r: r}
+	if s.readBuffer > 0 {
+		rc = &bufferedReader{bufio.NewReaderSize(rc, s.readBuffer), rc}
+	}
+	return rc, current, nil
+}
+
+// bufferedReader reads the download through a buffer, so the tiny chunks
+// delivered by the stream are coalesced into larger reads.
+type bufferedReader struct {
+	r *bufio.Reader
+	io.Closer
+}
+
+// Read fills p unless the stream ends or fails.
+func (b *bufferedReader) Read(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		m, err := b.r.Read(p[n:])
+		n += m
 		if err != nil {
-			return fmt.Errorf("move temp file: %w", err)
+			return n, err
 		}
 	}
-	s.nodeIDCache.Store(path, nodeID)
-	return nil
+	return n, nil
 }
 
-func (s *AliyunStorage) delete(key string) error {
-	path := s.path(key)
-	nodeID, err := s.getNode(path, false)
+// findFile returns the node of a file to read from offset, with the URL to
+// download it if it's small enough (see inline-read-size). The URL is found
+// by the lookup of the node, so it's only returned if the node is not cached.
+func (s *AliyunStorage) findFile(path string, offset int64) (string, string, error) {
+	if s.inlineReadSize <= 0 {
+		id, err := s.getNode(path, false)
+		return id, "", err
+	}
+	if v, ok := s.nodeIDCache.Load(path); ok {
+		return v.(string), "", nil
+	}
+	node, err := s.fs.GetByPath(s.context(), path, drive.AnyKind)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil
-		}
-		return err
+		return "", "", err
 	}
-	s.nodeIDCache.Delete(path)
-	return s.fs.Remove(context.Background(), nodeID)
+	s.nodeIDCache.Store(path, node.NodeId)
+	if node.Type != drive.FileKind || node.Size > s.inlineReadSize || offset >= node.Size {
+		return node.NodeId, "", nil
+	}
+	return node.NodeId, node.DownloadUrl, nil
 }
 
-func (s *AliyunStorage) Delete(key string) error {
-	log.Println("Delete", s.path(key))
-	return s.delete(key)
+// reopenStale looks up the node of path again once the cached nodeID failed
+// to open with err, e.g. after the file is deleted, moved or overwritten by
+// the app of the drive, and opens the one found if it's another node.
+func (s *AliyunStorage) reopenStale(path, nodeID string, offset, length int64, err error) (string, io.ReadCloser, error) {
+	unlock := s.swaps.rlock(path)
+	if v, ok := s.nodeIDCache.Load(path); ok && v.(string) == nodeID {
+		s.nodeIDCache.Delete(path)
+	}
+	id, lerr := s.lookupNode(path, false)
+	unlock()
+	if errors.Is(lerr, os.ErrNotExist) {
+		return nodeID, nil, lerr
+	}
+	if lerr != nil || id == nodeID {
+		return nodeID, nil, err
+	}
+	logger.Infof("Node of %s is changed from %s to %s out of band, open it again", path, nodeID, id)
+	r, err := s.open(id, offset, length)
+	return id, r, err
 }
 
-func (s *AliyunStorage) String() string {
-	return fmt.Sprintf("aliyun://%s/", s.workdir)
+func (s *AliyunStorage) open(nodeID string, offset, length int64) (io.ReadCloser, error) {
+	return s.fs.Open(s.context(), nodeID, s.openHeaders(offset, length))
 }
 
-func newAliyun(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-	tokenData, err := os.ReadFile("refresh_token")
-	if err == nil {
-		secretKey = string(tokenData)
+// openHeaders returns the headers to download a range.
+func (s *AliyunStorage) openHeaders(offset, length int64) map[string]string {
+	header := map[string]string{}
+	// the ones of Open take precedence, but never the Range
+	for _, api := range []string{"", "Open"} {
+		for k, vs := range s.headers[api] {
+			header[k] = vs[0]
+		}
 	}
-	config := &drive.Config{
-		RefreshToken: secretKey,
-		IsAlbum:      false,
-		DeviceId:     accessKey,
-		HttpClient:   &http.Client{},
-		OnRefreshToken: func(refreshToken string) {
-			os.WriteFile("refresh_token", []byte(refreshToken), 0600)
-		},
+	if length > 0 {
+		header["Range"] = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	} else if offset > 0 {
+		header["Range"] = fmt.Sprintf("bytes=%d-", offset)
 	}
-	ctx := context.Background()
-	fs, err := drive.NewFs(ctx, config)
+	return header
+}
+
+// urlDownloader fetches a file by the download URL found with its node,
+// without the call for the URL in Open.
+type urlDownloader interface {
+	Download(ctx context.Context, url string, headers map[string]string) (io.ReadCloser, error)
+}
+
+// aliyunDrive is the drive of an account, which downloads by URL with the
+// client of it.
+type aliyunDrive struct {
+	drive.Fs
+	client *http.Client
+}
+
+func (d *aliyunDrive) Download(ctx context.Context, url string, headers map[string]string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
-	s := AliyunStorage{fs: fs}
-	_, err = s.getNode(endpoint, true)
+	// as Open of the drive
+	req.Header.Set("Referer", "https://www.aliyundrive.com/")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := d.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	s.workdir = endpoint
-	s.getLock = make(chan struct{}, 2)
-	s.putLock = make(chan struct{}, 2)
-
-	// clean temp dir
-	tempDir := filepath.Join(s.workdir, ".temp")
-	tmp, err := s.getNode(tempDir, false)
-	if err == nil {
-		s.nodeIDCache.Delete(tempDir)
-		err = s.fs.Remove(context.Background(), tmp)
-		if err != nil {
-			return nil, err
-		}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("download: %s", resp.Status)
 	}
-	tmp, err = s.getNode(tempDir, true)
-	if err != nil {
+	return resp.Body, nil
+}
+
+// aliyunReader re-opens the download from the bytes already delivered when
+// the stream is broken, at most getRetries times. An expired URL is renewed
+// without counting as a retry, as long as it delivered some bytes.
+type aliyunReader struct {
+	s      *AliyunStorage
+	nodeID string
+	off    int64
+	limit  int64 // bytes left to read of a bounded range
+	// bounded is false to read to the end, then limit is ignored
+	bounded bool
+	r       io.ReadCloser
+	retries int
+	// bytes read from the current download
+	delivered int64
+}
+
+func (r *aliyunReader) Read(p []byte) (int, error) {
+	if r.bounded {
+		if r.limit <= 0 {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > r.limit {
+			p = p[:r.limit]
+		}
+	}
+	n, err := r.r.Read(p)
+	r.off += int64(n)
+	r.delivered += int64(n)
+	if r.bounded {
+		r.limit -= int64(n)
+		if r.limit == 0 {
+			// the range is finished even if the stream breaks after it
+			return n, io.EOF
+		}
+	}
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if errors.Is(err, errURLExpired) && r.delivered > 0 {
+		// the download outlived its URL, which is not a failure to retry.
+		// The node is kept, since an overwrite is a new node.
+		logger.Infof("download URL of %s expired at %d, reopen it by a new one", r.nodeID, r.off)
+	} else {
+		if r.retries >= r.s.getRetries {
+			return n, fmt.Errorf("read %s after %d retries: %w", r.nodeID, r.retries, err)
+		}
+		if !r.s.budget.Allow() {
+			return n, fmt.Errorf("read %s: %w (out of retry budget)", r.nodeID, err)
+		}
+		r.retries++
+		logger.Warnf("read %s at %d: %s, reopen it (%d)", r.nodeID, r.off, err, r.retries)
+	}
+	_ = r.r.Close()
+	r.delivered = 0
+	nr, err2 := r.s.open(r.nodeID, r.off, r.limit)
+	var re *rangeError
+	if errors.As(err2, &re) && re.size == r.off {
+		// broken right at the end
+		r.r = io.NopCloser(bytes.NewReader(nil))
+		return n, io.EOF
+	}
+	if err2 != nil {
+		r.r = io.NopCloser(&errReader{err2})
+		return n, fmt.Errorf("reopen %s: %w", r.nodeID, err2)
+	}
+	r.r = nr
+	return n, nil
+}
+
+func (r *aliyunReader) Close() error {
+	return r.r.Close()
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// rangeChecker verifies that a ranged download returns exactly the requested
+// bytes, so a server ignoring or misreading the Range header can't misplace data.
+type rangeChecker struct {
+	http.RoundTripper
+}
+
+func parseRange(h string) (start, end int64, err error) {
+	end = -1
+	if _, err = fmt.Sscanf(h, "bytes=%d-%d", &start, &end); err != nil {
+		end = -1
+		if _, err = fmt.Sscanf(h, "bytes=%d-", &start); err != nil {
+			return 0, 0, fmt.Errorf("invalid range %q", h)
+		}
+	}
+	return start, end, nil
+}
+
+func parseContentRange(h string) (start, end, total int64, err error) {
+	total = -1
+	if _, err = fmt.Sscanf(h, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		total = -1
+		if _, err = fmt.Sscanf(h, "bytes %d-%d/*", &start, &end); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid content range %q", h)
+		}
+	}
+	return start, end, total, nil
+}
+
+// rangeError is returned when the requested range starts beyond the end of
+// the object, size is -1 if it's unknown.
+type rangeError struct {
+	rng  string
+	size int64
+}
+
+func (e *rangeError) Error() string {
+	return fmt.Sprintf("range %s is not satisfiable for object of %d bytes", e.rng, e.size)
+}
+
+func (t *rangeChecker) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil && req.Method == http.MethodGet && resp.StatusCode == http.StatusForbidden {
+		if err = checkURLExpired(resp); err != nil {
+			return nil, err
+		}
+	}
+	rng := req.Header.Get("Range")
+	if err == nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		_ = resp.Body.Close()
+		e := &rangeError{rng, -1}
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &e.size); err != nil {
+			e.size = -1
+		}
+		return nil, e
+	}
+	if err != nil || req.Method != http.MethodGet || rng == "" || resp.StatusCode >= 300 {
+		return resp, err
+	}
+	start, end, err := parseRange(rng)
+	if err != nil {
+		return resp, nil
+	}
+	if resp.StatusCode == http.StatusOK {
+		// the Range is ignored for some nodes, cut the slice out of the full body
+		return fullBodyRange(resp, rng, start, end)
+	}
+	check := func() (int64, error) {
+		if resp.StatusCode != http.StatusPartialContent {
+			return 0, fmt.Errorf("requested %s, but got status %d", rng, resp.StatusCode)
+		}
+		cr := resp.Header.Get("Content-Range")
+		s, e, total, err := parseContentRange(cr)
+		if err != nil {
+			return 0, err
+		}
+		// the end could be truncated at the end of object
+		if s != start || end >= 0 && e != end && !(e < end && e == total-1) || end < 0 && total >= 0 && e != total-1 {
+			return 0, fmt.Errorf("requested %s, but got content range %q", rng, cr)
+		}
+		return e - s + 1, nil
+	}
+	n, err := check()
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	resp.Body = &exactReader{resp.Body, n}
+	resp.ContentLength = n
+	return resp, nil
+}
+
+// errURLExpired is the failure of a download by an expired URL, which is
+// only valid for a while after returned by the drive.
+var errURLExpired = errors.New("download URL expired")
+
+// checkURLExpired returns errURLExpired if resp is the refusal of an expired
+// URL, as "Request has expired" of OSS, otherwise the body is kept for the
+// caller.
+func checkURLExpired(resp *http.Response) error {
+	head, err := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if err == nil && bytes.Contains(bytes.ToLower(head), []byte("expired")) {
+		_ = resp.Body.Close()
+		return fmt.Errorf("status %d: %w", resp.StatusCode, errURLExpired)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	return nil
+}
+
+// fullBodyRange skips the body of resp to start and limits it to end, as if
+// the range rng was served.
+func fullBodyRange(resp *http.Response, rng string, start, end int64) (*http.Response, error) {
+	size := resp.ContentLength
+	if size >= 0 && start >= size {
+		_ = resp.Body.Close()
+		return nil, &rangeError{rng, size}
+	}
+	if skipped, err := io.CopyN(io.Discard, resp.Body, start); err != nil {
+		_ = resp.Body.Close()
+		if err == io.EOF {
+			return nil, &rangeError{rng, skipped}
+		}
+		return nil, err
+	}
+	if size >= 0 && (end < 0 || end >= size) {
+		end = size - 1
+	}
+	if end >= 0 {
+		n := end - start + 1
+		if size >= 0 {
+			resp.Body = &exactReader{resp.Body, n}
+		} else {
+			// it could end before
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(resp.Body, n), resp.Body}
+		}
+		resp.ContentLength = n
+		if size >= 0 {
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		}
+	} else {
+		resp.ContentLength = -1
+	}
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = fmt.Sprintf("%d %s", http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
+	return resp, nil
+}
+
+// exactReader returns exactly n bytes, it fails if the body is shorter.
+type exactReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *exactReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *AliyunStorage) Put(key string, in io.Reader) error {
+	return s.put(key, in, true, nil)
+}
+
+// PutWithResult writes the object as Put, and returns its SHA1 as the drive
+// keeps, which is calculated from the content uploaded.
+func (s *AliyunStorage) PutWithResult(key string, in io.Reader) (*PutResult, error) {
+	var r PutResult
+	if err := s.put(key, in, true, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// PutIfAbsent creates the object only if it does not exist yet, otherwise
+// os.ErrExist is returned and nothing is written.
+func (s *AliyunStorage) PutIfAbsent(key string, in io.Reader) error {
+	return s.put(key, in, false, nil)
+}
+
+// put writes the object, and describes it in res if it's not nil.
+func (s *AliyunStorage) put(key string, in io.Reader, overwrite bool, res *PutResult) error {
+	if err := s.putLock.acquire(s.context()); err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	defer s.putLock.release()
+	defer s.walker.invalidate(key)
+
+	if err := s.checkKey(key); err != nil {
+		return err
+	}
+	path := s.path(key)
+	s.logCall("Put", path)
+	if !overwrite {
+		if _, err := s.getNode(path, false); err == nil {
+			return fmt.Errorf("put %s: %w", key, os.ErrExist)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("get node: %w", err)
+		}
+	}
+	dir, _ := filepath.Split(path)
+	dirNodeID, err := s.getNode(dir, true)
+	if err != nil {
+		return fmt.Errorf("get node: %w", err)
+	}
+	in, size, cleanup, err := aliyunContent(in)
+	if err != nil {
+		return fmt.Errorf("read content of %s: %w", key, err)
+	}
+	defer cleanup()
+	in, sum, err := aliyunSHA1(in)
+	if err != nil {
+		return fmt.Errorf("read content of %s: %w", key, err)
+	}
+	if overwrite {
+		// the identical Puts of a key at the same time (e.g. a retry while
+		// the previous try is still uploading) share one upload, the others
+		// are serialized by the lock of the key
+		_, err, _ = s.uploads.Do(path+"\x00"+sum, func() (interface{}, error) {
+			return nil, s.upload(key, path, dirNodeID, in, size, sum, overwrite)
+		})
+	} else {
+		err = s.upload(key, path, dirNodeID, in, size, sum, overwrite)
+	}
+	if err != nil {
+		return err
+	}
+	if res != nil {
+		*res = PutResult{Size: size, Algo: HashSHA1, Hash: strings.ToLower(sum)}
+	}
+	return nil
+}
+
+// upload creates the file of the content with its size and SHA1 in the temp
+// dir, then moves it to path in the directory dirNodeID.
+func (s *AliyunStorage) upload(key, path, dirNodeID string, in io.Reader, size int64, sum string, overwrite bool) error {
+	dir, filename := filepath.Split(path)
+	name := aliyunTempName(key)
+	ctx, done, err := s.track(name)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	defer done()
+	rewind := rewinder(in)
+	nodeID, err := s.fs.CreateFile(ctx, drive.Node{ParentId: s.tempdir(), Name: name, Size: size}, in)
+	if errors.Is(err, errAccountSwitched) && rewind() {
+		// upload again into the next account
+		if dirNodeID, err = s.getNode(dir, true); err != nil {
+			return fmt.Errorf("get node: %w", err)
+		}
+		nodeID, err = s.fs.CreateFile(ctx, drive.Node{ParentId: s.tempdir(), Name: name, Size: size}, in)
+	}
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	// replacing the file takes a few calls, which should not interleave
+	// with other writes of the key
+	unlock, err := s.locker.Lock(path)
+	if err != nil {
+		if e := s.fs.Remove(s.context(), nodeID); e != nil {
+			logger.Warnf("remove temp file %s: %s", nodeID, e)
+		}
+		return fmt.Errorf("lock %s: %w", key, err)
+	}
+	defer unlock()
+	_, err = s.fs.Move(ctx, nodeID, dirNodeID, filename)
+	if err != nil && !overwrite {
+		// created by someone else after the check
+		if e := s.fs.Remove(s.context(), nodeID); e != nil {
+			logger.Warnf("remove temp file %s: %s", nodeID, e)
+		}
+		if errors.Is(err, drive.ErrorAlreadyExisted) {
+			return fmt.Errorf("put %s: %w", key, os.ErrExist)
+		}
+		return fmt.Errorf("move temp file: %w", err)
+	}
+	if err != nil {
+		err = s.delete(key)
+		if err != nil {
+			return fmt.Errorf("delete temp file: %w", err)
+		}
+		_, err = s.fs.Move(ctx, nodeID, dirNodeID, filename)
+		if err != nil {
+			return fmt.Errorf("move temp file: %w", err)
+		}
+	}
+	if s.visible > 0 {
+		if err = s.waitVisible(path, nodeID); err != nil {
+			s.nodeIDCache.Delete(path)
+			return fmt.Errorf("put %s: %w", key, err)
+		}
+	}
+	if s.verifyMove {
+		if err = s.verify(path, nodeID, size, sum); err != nil {
+			s.nodeIDCache.Delete(path)
+			if e := s.fs.Remove(s.context(), nodeID); e != nil {
+				logger.Warnf("remove inconsistent file %s: %s", nodeID, e)
+			}
+			return fmt.Errorf("put %s: %w", key, err)
+		}
+	}
+	s.nodeIDCache.Store(path, nodeID)
+	return nil
+}
+
+var errAliyunClosed = errors.New("aliyun storage is closed")
+
+// track registers the temp file of an upload, whose calls are made in the
+// context returned to be canceled by Close. done should be called once the
+// temp file is moved into place or removed.
+func (s *AliyunStorage) track(name string) (context.Context, func(), error) {
+	s.tempsMu.Lock()
+	defer s.tempsMu.Unlock()
+	if s.closed {
+		return nil, nil, errAliyunClosed
+	}
+	ctx, cancel := context.WithCancel(s.context())
+	s.temps[name] = cancel
+	s.putting.Add(1)
+	return ctx, func() {
+		s.tempsMu.Lock()
+		delete(s.temps, name)
+		s.tempsMu.Unlock()
+		cancel()
+		s.putting.Done()
+	}, nil
+}
+
+// Close cancels the uploads in progress and removes their temp files, which
+// would take the quota until cleaned at the next startup, within the
+// cleanup-timeout. The storage can't be written after closed.
+func (s *AliyunStorage) Close() error {
+	s.tempsMu.Lock()
+	if s.closed {
+		s.tempsMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	names := make(map[string]bool, len(s.temps))
+	for name, cancel := range s.temps {
+		names[name] = true
+		cancel()
+	}
+	s.tempsMu.Unlock()
+	if len(names) == 0 {
+		return nil
+	}
+	logger.Infof("Cancel %d uploads in progress to %s", len(names), s)
+	ctx := context.Background()
+	if s.cleanupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cleanupTimeout)
+		defer cancel()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.putting.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return fmt.Errorf("wait for %d uploads canceled: %w", len(names), ctx.Err())
+	}
+	// the temp files could be created without their node ids returned
+	nodes, err := s.fs.ListAll(ctx, s.tempdir())
+	if err != nil {
+		return fmt.Errorf("list temp dir: %w", err)
+	}
+	for _, n := range nodes {
+		if !names[n.Name] {
+			continue
+		}
+		if err = s.fs.Remove(ctx, n.NodeId); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove temp file %s: %w", n.Name, err)
+		}
+	}
+	return nil
+}
+
+// rewinder returns a func seeking in back to where it is now, which returns
+// false if in can't seek.
+func rewinder(in io.Reader) func() bool {
+	r, ok := in.(io.Seeker)
+	if !ok {
+		return func() bool { return false }
+	}
+	cur, err := r.Seek(0, io.SeekCurrent)
+	return func() bool {
+		if err != nil {
+			return false
+		}
+		_, e := r.Seek(cur, io.SeekStart)
+		return e == nil
+	}
+}
+
+// aliyunSHA1 returns the SHA1 of the content in upper case as the drive,
+// and the content to be read again.
+func aliyunSHA1(in io.Reader) (io.Reader, string, error) {
+	h := sha1.New()
+	if r, ok := in.(io.ReadSeeker); ok {
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err == nil {
+			if _, err = io.Copy(h, r); err == nil {
+				_, err = r.Seek(cur, io.SeekStart)
+			}
+			return in, fmt.Sprintf("%X", h.Sum(nil)), err
+		}
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, "", err
+	}
+	h.Write(data)
+	return bytes.NewReader(data), fmt.Sprintf("%X", h.Sum(nil)), nil
+}
+
+// waitVisible waits until the file at path is found as nodeID, since the
+// drive indexes a file moved a while later, until which the lookups of other
+// clients miss it (or find the previous one).
+func (s *AliyunStorage) waitVisible(path, nodeID string) error {
+	deadline := time.Now().Add(s.visible)
+	interval := time.Millisecond * 20
+	for {
+		node, err := s.fs.GetByPath(s.context(), path, drive.FileKind)
+		if err == nil && node.NodeId == nodeID {
+			return nil
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("wait for visibility: %w", err)
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("%s is not visible in %s", path, s.visible)
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > time.Second {
+			interval = time.Second
+		}
+	}
+}
+
+// verify checks that the uploaded file is at path with the same content,
+// since a Move could succeed without placing the file on flaky drives.
+func (s *AliyunStorage) verify(path, nodeID string, size int64, sum string) error {
+	node, err := s.fs.GetByPath(s.context(), path, drive.FileKind)
+	if err != nil {
+		return fmt.Errorf("verify after move: %w", err)
+	}
+	switch {
+	case node.NodeId != nodeID:
+		return fmt.Errorf("verify after move: %s is node %s, but moved %s", path, node.NodeId, nodeID)
+	case node.Size != size:
+		return fmt.Errorf("verify after move: size of %s is %d, but uploaded %d bytes", path, node.Size, size)
+	case node.Hash != "" && !strings.EqualFold(node.Hash, sum):
+		return fmt.Errorf("verify after move: SHA1 of %s is %s, but uploaded %s", path, node.Hash, sum)
+	}
+	return nil
+}
+
+// aliyunContent returns the content with its size, which is required by the
+// drive before uploading. The content of unknown length (e.g. a pipe) is
+// spooled, cleanup should be called after used.
+func aliyunContent(in io.Reader) (io.Reader, int64, func(), error) {
+	if r, ok := in.(interface{ Len() int }); ok {
+		return in, int64(r.Len()), func() {}, nil
+	}
+	s, err := Spool(in, spoolMemory, "")
+	if err != nil {
+		return nil, 0, func() {}, err
+	}
+	return s.ReadSeeker, s.Size, func() { _ = s.Close() }, nil
+}
+
+// SetKeyLocker replaces the local lock used to serialize the writes of a key,
+// it should be called before any write.
+func (s *AliyunStorage) SetKeyLocker(l KeyLocker) {
+	s.locker = l
+}
+
+func (s *AliyunStorage) delete(key string) error {
+	path := s.path(key)
+	nodeID, err := s.getNode(path, false)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	s.nodeIDCache.Delete(path)
+	s.walker.invalidate(key)
+	return s.fs.Remove(s.context(), nodeID)
+}
+
+func (s *AliyunStorage) Delete(key string) error {
+	if err := s.checkKey(key); err != nil {
+		return err
+	}
+	s.logCall("Delete", s.path(key))
+	unlock, err := s.locker.Lock(s.path(key))
+	if err != nil {
+		return fmt.Errorf("lock %s: %w", key, err)
+	}
+	defer unlock()
+	err = s.delete(key)
+	if errors.Is(err, errAccountSwitched) {
+		// the node of the next account
+		err = s.delete(key)
+	}
+	return err
+}
+
+// Purge removes all the children of workdir except the temp dir, a folder is
+// removed with all its content in one call.
+func (s *AliyunStorage) Purge(confirm string) error {
+	if err := checkPurgeToken(s, confirm); err != nil {
+		return err
+	}
+	return s.removeAll()
+}
+
+func (s *AliyunStorage) removeAll() error {
+	rootID, err := s.getNode(s.workdir, false)
+	if err != nil {
+		return err
+	}
+	nodes, err := s.fs.ListAll(s.context(), rootID)
+	if err != nil {
+		return fmt.Errorf("list %s: %w", s.workdir, err)
+	}
+	tempDir := filepath.Join(s.workdir, driveTempDir)
+	if s.walker.cache != nil {
+		defer s.walker.cache.reset()
+	}
+	defer s.nodeIDCache.Range(func(k, v interface{}) bool {
+		if p := k.(string); p != s.workdir && p != tempDir {
+			s.nodeIDCache.Delete(p)
+		}
+		return true
+	})
+	for _, n := range nodes {
+		if n.NodeId == s.tempdir() {
+			continue
+		}
+		if err = s.fs.Remove(s.context(), n.NodeId); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove %s: %w", n.Name, err)
+		}
+	}
+	logger.Infof("Purged %d entries under %s", len(nodes), s.workdir)
+	return nil
+}
+
+// Swap exchanges the files of a and b by three moves through a temp name.
+// The Gets and Heads within the process wait for the moves, but the other
+// clients may see a missing in the middle. A failed swap is rolled back as
+// far as possible.
+func (s *AliyunStorage) Swap(a, b string) error {
+	pa, pb := s.path(a), s.path(b)
+	if pa == pb {
+		return nil
+	}
+	first, second := pa, pb
+	if first > second {
+		first, second = second, first
+	}
+	unlock1, err := s.locker.Lock(first)
+	if err != nil {
+		return fmt.Errorf("lock %s: %w", first, err)
+	}
+	defer unlock1()
+	unlock2, err := s.locker.Lock(second)
+	if err != nil {
+		return fmt.Errorf("lock %s: %w", second, err)
+	}
+	defer unlock2()
+	defer s.swaps.lock(pa, pb)()
+	defer s.walker.invalidate(a)
+	defer s.walker.invalidate(b)
+
+	idA, err := s.getNode(pa, false)
+	if err != nil {
+		return fmt.Errorf("swap %s: %w", a, err)
+	}
+	idB, err := s.getNode(pb, false)
+	if err != nil {
+		return fmt.Errorf("swap %s: %w", b, err)
+	}
+	dirA, nameA := filepath.Split(pa)
+	dirB, nameB := filepath.Split(pb)
+	dirIDA, err := s.getNode(dirA, false)
+	if err != nil {
+		return fmt.Errorf("get node: %w", err)
+	}
+	dirIDB, err := s.getNode(dirB, false)
+	if err != nil {
+		return fmt.Errorf("get node: %w", err)
+	}
+	s.nodeIDCache.Delete(pa)
+	s.nodeIDCache.Delete(pb)
+	ctx := s.context()
+	if _, err = s.fs.Move(ctx, idA, s.tempdir(), aliyunTempName(a)); err != nil {
+		return fmt.Errorf("move %s: %w", a, err)
+	}
+	if _, err = s.fs.Move(ctx, idB, dirIDA, nameA); err != nil {
+		if _, e := s.fs.Move(ctx, idA, dirIDA, nameA); e != nil {
+			logger.Errorf("Move %s back after a failed swap: %s", a, e)
+		}
+		return fmt.Errorf("move %s to %s: %w", b, a, err)
+	}
+	if _, err = s.fs.Move(ctx, idA, dirIDB, nameB); err != nil {
+		if _, e := s.fs.Move(ctx, idB, dirIDB, nameB); e != nil {
+			logger.Errorf("Move %s back after a failed swap: %s", b, e)
+		} else if _, e = s.fs.Move(ctx, idA, dirIDA, nameA); e != nil {
+			logger.Errorf("Move %s back after a failed swap: %s", a, e)
+		}
+		return fmt.Errorf("move %s to %s: %w", a, b, err)
+	}
+	s.nodeIDCache.Store(pa, idB)
+	s.nodeIDCache.Store(pb, idA)
+	return nil
+}
+
+// DeleteDir removes the folder of dir with all the objects inside in one
+// call. The whole workdir (an empty dir) is not removed but by Purge with its
+// confirmation, the objects are deleted one by one instead.
+func (s *AliyunStorage) DeleteDir(dir string) error {
+	if dir == "" {
+		return notSupported
+	}
+	if strings.HasPrefix(dir, driveTempDir+"/") {
+		// not listed as objects
+		return notSupported
+	}
+	p := filepath.Join(s.workdir, dir)
+	nodeID, err := s.getNode(p, false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer s.walker.invalidate(dir)
+	defer s.nodeIDCache.Range(func(k, v interface{}) bool {
+		if k := k.(string); k == p || strings.HasPrefix(k, p+"/") {
+			s.nodeIDCache.Delete(k)
+		}
+		return true
+	})
+	if err = s.fs.Remove(s.context(), nodeID); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", dir, err)
+	}
+	return nil
+}
+
+// DeleteConcurrency is the number of parallel deletes within the rate limit
+// of the drive, set by the delete-concurrency option.
+func (s *AliyunStorage) DeleteConcurrency() int {
+	return s.deletes
+}
+
+func (s *AliyunStorage) listNodes(ctx context.Context, nodeID string) ([]treeNode, error) {
+	nodes, err := s.fs.ListAll(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	children := make([]treeNode, 0, len(nodes))
+	for _, n := range nodes {
+		if n.IsDirectory() && s.layout.isBucket(n.Name) {
+			objs, err := s.listNodes(ctx, n.NodeId)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, objs...)
+			continue
+		}
+		mtime, _ := n.GetTime()
+		children = append(children, treeNode{n.NodeId, n.Name, n.IsDirectory(), n.Size, mtime, strings.ToLower(n.Hash)})
+	}
+	return children, nil
+}
+
+// listRoot resolves the deepest directory containing all the keys with
+// prefix, where the walk starts instead of workdir, so the directories above
+// it are not listed. It's workdir for a prefix of the top level, or one
+// through a directory not walked (the temp dir, buckets or too deep). found
+// is false if the directory doesn't exist, then there is nothing to list.
+func (s *AliyunStorage) listRoot(prefix string) (dir, id string, found bool, err error) {
+	dir = prefix[:strings.LastIndex(prefix, "/")+1]
+	if w := s.walker; w.maxDepth > 0 && strings.Count(dir, "/") > w.maxDepth {
+		dir = ""
+	}
+	for i := 0; i < len(dir); {
+		j := i + strings.IndexByte(dir[i:], '/') + 1
+		if s.layout.isBucket(dir[i:j-1]) || s.walker.skip != nil && s.walker.skip(dir[:j]) {
+			dir = ""
+			break
+		}
+		i = j
+	}
+	id, err = s.getNode(filepath.Join(s.workdir, dir), false)
+	if dir != "" && errors.Is(err, os.ErrNotExist) {
+		return dir, "", false, nil
+	}
+	return dir, id, err == nil, err
+}
+
+// listFrom walks from the directory resolved by listRoot.
+func (s *AliyunStorage) listFrom(w *treeWalker, prefix, marker string, since time.Time) (<-chan Object, error) {
+	dir, id, found, err := s.listRoot(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		ch := make(chan Object)
+		close(ch)
+		return ch, nil
+	}
+	return w.listFrom(s.context(), dir, id, prefix, marker, since), nil
+}
+
+// ListAll walks the tree under workdir with parallel directory fetches,
+// the objects are emitted in lexical order of their keys. The walk starts
+// from the directory of prefix, e.g. `chunks/1/` for `chunks/1/2_`.
+func (s *AliyunStorage) ListAll(prefix, marker string) (<-chan Object, error) {
+	return s.listFrom(s.walker, prefix, marker, time.Time{})
+}
+
+// ListAllTolerant is like ListAll, but the directories failed to be listed,
+// e.g. damaged or not permitted, are skipped and reported to onError, so the
+// rest of the objects could still be listed (by gc). onError could be called
+// from another goroutine before the channel is closed.
+func (s *AliyunStorage) ListAllTolerant(prefix, marker string, onError func(dir string, err error)) (<-chan Object, error) {
+	return s.listFrom(s.walker.tolerant(onError), prefix, marker, time.Time{})
+}
+
+// ListSince filters the files by their mtime during the walk.
+func (s *AliyunStorage) ListSince(prefix string, since time.Time) (<-chan Object, error) {
+	return s.listFrom(s.walker, prefix, "", since)
+}
+
+// List returns at most max-keys objects no matter how many are asked, the
+// caller should continue with the key of the last object as marker.
+func (s *AliyunStorage) List(prefix, marker string, limit int64) ([]Object, error) {
+	if limit <= 0 || limit > s.maxKeys {
+		limit = s.maxKeys
+	}
+	dir, id, found, err := s.listRoot(prefix)
+	if err != nil || !found {
+		return nil, err
+	}
+	return s.walker.listNFrom(s.context(), dir, id, prefix, marker, limit)
+}
+
+func (s *AliyunStorage) String() string {
+	return fmt.Sprintf("aliyun://%s/", s.workdir)
+}
+
+func newAliyun(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	return NewAliyunWithContext(context.Background(), endpoint, accessKey, secretKey, token)
+}
+
+// NewAliyunWithContext creates the storage as `aliyun://` does, it stops
+// waiting for the drive at startup once ctx is done.
+func NewAliyunWithContext(ctx context.Context, endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	workdir, opts, err := parseAliyunEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// a backup account is used once the previous one fails
+	accounts, err := aliyunAccounts(accessKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	openSpace := func(album string) (ObjectStorage, error) {
+		open := func(a aliyunAccount) (drive.Fs, error) {
+			config := aliyunConfig(a.deviceID, a.refreshToken, a.tokenFile, opts)
+			fs, err := openAliyunDrive(config, workdir, album)
+			if err != nil {
+				return nil, err
+			}
+			return &aliyunDrive{fs, config.HttpClient}, nil
+		}
+		if opts.poolAccounts && len(accounts) > 1 {
+			stores := make([]ObjectStorage, len(accounts))
+			for i, a := range accounts {
+				fs, err := open(a)
+				if err != nil {
+					return nil, fmt.Errorf("open the account %d: %w", i, err)
+				}
+				if stores[i], err = newAliyunStorage(ctx, fs, workdir, opts); err != nil {
+					return nil, fmt.Errorf("open the account %d: %w", i, err)
+				}
+			}
+			return NewPool(stores), nil
+		}
+		var fs drive.Fs
+		var err error
+		if len(accounts) == 1 {
+			fs, err = open(accounts[0])
+		} else {
+			fs, err = newFailoverDrive(accounts, open)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return newAliyunStorage(ctx, fs, workdir, opts)
+	}
+	var s ObjectStorage
+	if opts.bothSpaces {
+		isAlbum := opts.album == "true"
+		write, err := openSpace(strconv.FormatBool(isAlbum))
+		if err != nil {
+			return nil, err
+		}
+		other, err := openSpace(strconv.FormatBool(!isAlbum))
+		if err != nil {
+			return nil, fmt.Errorf("open the other space: %w", err)
+		}
+		s = newAliyunSpaces(write, other, aliyunSpace(!isAlbum))
+	} else if s, err = openSpace(opts.album); err != nil {
+		return nil, err
+	}
+	if opts.splitSize > 0 {
+		if s, err = WithSplitting(s, opts.splitSize); err != nil {
+			return nil, err
+		}
+	}
+	s = WithKeyHashing(s, opts.keyBuckets)
+	if opts.metadataSidecar {
+		s = WithMetadataSidecar(s)
+	}
+	return s, nil
+}
+
+// aliyunTokenFile keeps the latest refresh token, since the old one is
+// expired once it's used.
+const aliyunTokenFile = "refresh_token"
+
+func aliyunConfig(deviceID, refreshToken, tokenFile string, opts aliyunOptions) *drive.Config {
+	save := func(refreshToken string) {
+		if err := saveRefreshToken(tokenFile, refreshToken); err != nil {
+			logger.Errorf("Save the refresh token into %s: %s", tokenFile, err)
+		}
+	}
+	var transport http.RoundTripper = &rangeChecker{&tokenRetrier{
+		RoundTripper: &requestIDTagger{&responseLimiter{&userAgentSetter{newIdleReaper(aliyunTransport(opts), opts.idleTimeout), opts.userAgent}, isAliyunAPICall}}, retries: opts.tokenRetries, backoff: time.Second, clock: SystemClock,
+		budget: opts.retryBudget, refresh: refreshToken, onRefresh: save}}
+	if len(opts.headers) > 0 {
+		transport = &aliyunHeaders{transport, opts.headers}
+	}
+	return &drive.Config{
+		RefreshToken:   refreshToken,
+		DeviceId:       deviceID,
+		HttpClient:     &http.Client{Transport: transport},
+		OnRefreshToken: save,
+	}
+}
+
+// saveRefreshToken replaces the token file atomically, so it's never left
+// empty or truncated.
+func saveRefreshToken(path, token string) error {
+	if token == "" {
+		return fmt.Errorf("empty refresh token")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(token), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// tokenRetrier retries the refresh of the token with exponential backoff
+// when it fails transiently. A refresh failed at last is tried again by the
+// drive in the next request, since the token is still expired.
+//
+// The drive only refreshes the access token by its own clock, so one expired
+// earlier (e.g. revoked, or a skewed clock) fails the calls until then. The
+// retrier refreshes it by itself once a call fails of an expired token, and
+// sends the call again with the new one.
+type tokenRetrier struct {
+	http.RoundTripper
+	retries int
+	backoff time.Duration
+	clock   Clock
+	budget  *RetryBudget
+
+	// serializes the refreshes, those by the drive and by the retrier
+	mu sync.Mutex
+	// the latest tokens, after refreshed by the retrier they replace the
+	// stale ones held by the drive
+	access  string
+	refresh string
+	// onRefresh is called with the refresh token renewed by the retrier
+	onRefresh func(refreshToken string)
+}
+
+// the API of the drive to refresh the token
+const aliyunTokenURL = "https://auth.aliyundrive.com/v2/account/token"
+
+func (t *tokenRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/account/token") {
+		if req.Body != nil && req.GetBody == nil {
+			return t.RoundTripper.RoundTrip(req)
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.refresh != "" {
+			var err error
+			if req, err = t.withRefreshToken(req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := t.retry(req)
+		if err == nil {
+			t.remember(resp)
+		}
+		return resp, err
+	}
+	used := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if used == "" || used == req.Header.Get("Authorization") {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	t.mu.Lock()
+	current := t.access
+	t.mu.Unlock()
+	if current != "" && current != used {
+		req = withBearer(req, current)
+		used = current
+	}
+	// a body can't be sent again unless nothing is read from it
+	var body *untouchedBody
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body = &untouchedBody{ReadCloser: req.Body}
+		defer body.ReadCloser.Close()
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || !isAliyunTokenExpired(resp) {
+		return resp, err
+	}
+	access, rerr := t.renew(req.Context(), used)
+	if rerr != nil {
+		logger.Warnf("Refresh the expired token of aliyun drive: %s", rerr)
+		return resp, nil
+	}
+	// the next calls have the new token anyway
+	if body != nil && atomic.LoadInt32(&body.touched) != 0 {
+		return resp, nil
+	}
+	if req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req = req.Clone(req.Context())
+		req.Body = b
+	}
+	_ = resp.Body.Close()
+	logger.Infof("Refreshed the expired token of aliyun drive, retry %s", req.URL.Path)
+	return t.RoundTripper.RoundTrip(withBearer(req, access))
+}
+
+// retry sends the refresh req until it succeeds, or not retryable.
+func (t *tokenRetrier) retry(req *http.Request) (*http.Response, error) {
+	backoff := t.backoff
+	for i := 0; ; i++ {
+		resp, err := t.RoundTripper.RoundTrip(req)
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 || i >= t.retries || !t.budget.Allow() {
+			return resp, err
+		}
+		if err == nil {
+			err = fmt.Errorf("status %s", resp.Status)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		logger.Warnf("Refresh the token of aliyun drive (attempt %d): %s, retry in %s", i+1, err, backoff)
+		select {
+		case <-t.clock.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// renew refreshes the access token used by a call failed of it, unless it's
+// already refreshed by another one.
+func (t *tokenRetrier) renew(ctx context.Context, used string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.access != "" && t.access != used {
+		return t.access, nil
+	}
+	data, _ := json.Marshal(map[string]string{"refresh_token": t.refresh, "grant_type": "refresh_token"})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, aliyunTokenURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
+	resp, err := t.retry(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	if !t.remember(resp) || t.access == used {
+		return "", fmt.Errorf("no new token")
+	}
+	if t.onRefresh != nil {
+		t.onRefresh(t.refresh)
+	}
+	return t.access, nil
+}
+
+// remember keeps the tokens of a successful refresh, the body is still
+// readable after that.
+func (t *tokenRetrier) remember(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if json.Unmarshal(data, &token) != nil || token.AccessToken == "" || token.RefreshToken == "" {
+		return false
+	}
+	t.access, t.refresh = token.AccessToken, token.RefreshToken
+	return true
+}
+
+// withRefreshToken replaces the refresh token in the refresh req, which is
+// stale in the drive once the retrier refreshed it.
+func (t *tokenRetrier) withRefreshToken(req *http.Request) (*http.Request, error) {
+	if req.Body == nil {
+		return req, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	if json.Unmarshal(data, &body) == nil && body["refresh_token"] != nil {
+		body["refresh_token"] = t.refresh
+		data, _ = json.Marshal(body)
+	}
+	req = req.Clone(req.Context())
+	req.Body, req.ContentLength = io.NopCloser(bytes.NewReader(data)), int64(len(data))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	return req, nil
+}
+
+func withBearer(req *http.Request, access string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+access)
+	return req
+}
+
+// isAliyunAPICall tells whether req is a call of the API, whose response is
+// parsed, rather than a download or an upload.
+func isAliyunAPICall(req *http.Request) bool {
+	return req.Method == http.MethodPost
+}
+
+// isAliyunTokenExpired tells whether resp is the failure of an expired (or
+// invalid) access token, its body is still readable after that.
+func isAliyunTokenExpired(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	if err != nil {
+		return false
+	}
+	var e struct {
+		Code string `json:"code"`
+	}
+	_ = json.Unmarshal(data, &e)
+	return e.Code == "AccessTokenExpired" || e.Code == "AccessTokenInvalid"
+}
+
+// untouchedBody tells whether anything is read from the body of a request,
+// which is closed after the last attempt instead of by the transport.
+type untouchedBody struct {
+	io.ReadCloser
+	touched int32
+}
+
+func (b *untouchedBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.touched, 1)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *untouchedBody) Close() error { return nil }
+
+// aliyunTransport builds the transport to the drive, some endpoints behave
+// badly over HTTP/2, which could be disabled.
+func aliyunTransport(opts aliyunOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: opts.keepAlive}).DialContext
+	if socksProxy != nil {
+		if dial, err := socksDialContext(socksProxy, t.DialContext); err == nil {
+			t.DialContext = dial
+		} else {
+			logger.Errorf("SOCKS5 proxy %s: %s", socksProxy.Redacted(), err)
+		}
+	}
+	if opts.maxIdleConns > 0 {
+		t.MaxIdleConnsPerHost = opts.maxIdleConns
+		if t.MaxIdleConns < opts.maxIdleConns {
+			t.MaxIdleConns = opts.maxIdleConns
+		}
+	}
+	if tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig.Clone()
+	}
+	if opts.idleTimeout > 0 {
+		t.IdleConnTimeout = opts.idleTimeout
+	}
+	t.ForceAttemptHTTP2 = opts.http2
+	if !opts.http2 {
+		// a non-nil empty map disables HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+// userAgentSetter puts agent (UserAgent if empty) in front of the User-Agent
+// of the requests, the SDK of the drive has its own one.
+type userAgentSetter struct {
+	http.RoundTripper
+	agent string
+}
+
+func (t *userAgentSetter) RoundTrip(req *http.Request) (*http.Response, error) {
+	agent := t.agent
+	if agent == "" {
+		agent = UserAgent
+	}
+	if ua := req.Header.Get("User-Agent"); !strings.HasPrefix(ua, agent) {
+		if ua != "" {
+			agent += " " + ua
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", agent)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// idleReaper closes all the idle connections of a transport idle for longer
+// than timeout before its next request. The transport does so by itself, but
+// by the monotonic clock, which stops while the machine is suspended, so the
+// connections dropped by the drive meanwhile fail the first requests after
+// that. It's checked with the wall clock.
+type idleReaper struct {
+	*http.Transport
+	timeout time.Duration
+	clock   Clock
+	// the wall time when a request is started or done last, in nanoseconds
+	last int64
+}
+
+func newIdleReaper(t *http.Transport, timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		return t
+	}
+	return &idleReaper{Transport: t, timeout: timeout, clock: SystemClock}
+}
+
+func (r *idleReaper) RoundTrip(req *http.Request) (*http.Response, error) {
+	now := r.clock.Now().Round(0).UnixNano()
+	if last := atomic.SwapInt64(&r.last, now); last != 0 && now-last > int64(r.timeout) {
+		logger.Debugf("Close the idle connections to aliyun drive after idle for %s", time.Duration(now-last))
+		r.Transport.CloseIdleConnections()
+	}
+	resp, err := r.Transport.RoundTrip(req)
+	atomic.StoreInt64(&r.last, r.clock.Now().Round(0).UnixNano())
+	return resp, err
+}
+
+var newAliyunDrive = drive.NewFs
+
+var aliyunAPIs = []string{"GetByPath", "CreateFolderRecursively", "CreateFile", "Move", "Remove", "Open", "ListAll", "Download"}
+
+// countingDrive counts the API calls to the drive, which are limited by the
+// quota of the account.
+type countingDrive struct {
+	drive.Fs
+	calls map[string]*int64
+	// paces the calls to the requests-per-second cap of the drive, which
+	// could be exceeded by the fast small calls even at low concurrency
+	limit *ratelimit.Bucket
+	turn  *fairSemaphore
+}
+
+func newCountingDrive(fs drive.Fs) *countingDrive {
+	d := &countingDrive{Fs: fs, calls: make(map[string]*int64), turn: newFairSemaphore(1)}
+	for _, api := range aliyunAPIs {
+		d.calls[api] = new(int64)
+	}
+	return d
+}
+
+type aliyunAPIKey struct{}
+
+// call counts a call to api, and tags ctx with it for the headers of api. It
+// waits for the rate limit if any, a canceled ctx fails the call then. The
+// calls take the tokens in turn, foreground ones first (see WithBackground).
+func (d *countingDrive) call(ctx context.Context, api string) context.Context {
+	if d.limit != nil && d.turn.acquire(ctx) == nil {
+		if wait := d.limit.Take(1); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+		d.turn.release()
+	}
+	atomic.AddInt64(d.calls[api], 1)
+	return context.WithValue(ctx, aliyunAPIKey{}, api)
+}
+
+// aliyunHeaders adds the configured headers to the requests to the drive,
+// unless they are already set by the client. The headers of an API are
+// added to all the requests of its calls (found in the context), including
+// the download or upload URLs.
+type aliyunHeaders struct {
+	http.RoundTripper
+	headers map[string]http.Header
+}
+
+func (h *aliyunHeaders) RoundTrip(req *http.Request) (*http.Response, error) {
+	api, _ := req.Context().Value(aliyunAPIKey{}).(string)
+	cloned := false
+	for _, hs := range []http.Header{h.headers[api], h.headers[""]} {
+		for k, vs := range hs {
+			if req.Header.Get(k) != "" {
+				continue
+			}
+			if !cloned {
+				req = req.Clone(req.Context())
+				cloned = true
+			}
+			req.Header[k] = vs
+		}
+	}
+	return h.RoundTripper.RoundTrip(req)
+}
+
+func (d *countingDrive) GetByPath(ctx context.Context, fullPath string, kind string) (*drive.Node, error) {
+	ctx = d.call(ctx, "GetByPath")
+	node, err := d.Fs.GetByPath(ctx, fullPath, kind)
+	return node, withRequestID(ctx, err)
+}
+
+func (d *countingDrive) CreateFolderRecursively(ctx context.Context, fullPath string) (string, error) {
+	ctx = d.call(ctx, "CreateFolderRecursively")
+	id, err := d.Fs.CreateFolderRecursively(ctx, fullPath)
+	return id, withRequestID(ctx, err)
+}
+
+func (d *countingDrive) CreateFile(ctx context.Context, node drive.Node, in io.Reader) (string, error) {
+	ctx = d.call(ctx, "CreateFile")
+	id, err := d.Fs.CreateFile(ctx, node, in)
+	return id, withRequestID(ctx, err)
+}
+
+func (d *countingDrive) Move(ctx context.Context, nodeId string, dstParentNodeId string, dstName string) (string, error) {
+	ctx = d.call(ctx, "Move")
+	id, err := d.Fs.Move(ctx, nodeId, dstParentNodeId, dstName)
+	return id, withRequestID(ctx, err)
+}
+
+func (d *countingDrive) Remove(ctx context.Context, nodeId string) error {
+	ctx = d.call(ctx, "Remove")
+	return withRequestID(ctx, d.Fs.Remove(ctx, nodeId))
+}
+
+func (d *countingDrive) Open(ctx context.Context, nodeId string, headers map[string]string) (io.ReadCloser, error) {
+	ctx = d.call(ctx, "Open")
+	r, err := d.Fs.Open(ctx, nodeId, headers)
+	return r, withRequestID(ctx, err)
+}
+
+func (d *countingDrive) Download(ctx context.Context, url string, headers map[string]string) (io.ReadCloser, error) {
+	dl, ok := d.Fs.(urlDownloader)
+	if !ok {
+		return nil, notSupported
+	}
+	ctx = d.call(ctx, "Download")
+	r, err := dl.Download(ctx, url, headers)
+	return r, withRequestID(ctx, err)
+}
+
+func (d *countingDrive) ListAll(ctx context.Context, nodeId string) ([]drive.Node, error) {
+	ctx = d.call(ctx, "ListAll")
+	nodes, err := d.Fs.ListAll(ctx, nodeId)
+	return nodes, withRequestID(ctx, err)
+}
+
+// Limits reports the space of the drive of the account in use.
+func (s *AliyunStorage) Limits() (Limits, error) {
+	info, err := s.fs.About(s.context())
+	if err != nil {
+		return Limits{}, err
+	}
+	return Limits{Used: info.Used, Total: info.Total}, nil
+}
+
+// APICalls returns the number of calls to every API of the drive since the
+// storage is created, including the failed ones and the reopens of broken
+// downloads. It helps to tell how the quota of the account is consumed.
+func (s *AliyunStorage) APICalls() map[string]int64 {
+	calls := make(map[string]int64, len(s.counter.calls))
+	for api, n := range s.counter.calls {
+		calls[api] = atomic.LoadInt64(n)
+	}
+	return calls
+}
+
+func aliyunSpace(isAlbum bool) string {
+	if isAlbum {
+		return "album"
+	}
+	return "personal drive"
+}
+
+// openAliyunDrive opens the album or the personal drive of the account. When
+// album is empty, the personal drive is preferred and the album is used if
+// the account has no usable personal drive. If the configured space is not
+// usable, the other one is checked to tell the user how to fix it.
+func openAliyunDrive(config *drive.Config, workdir, album string) (drive.Fs, error) {
+	open := func(isAlbum bool) (drive.Fs, error) {
+		c := *config
+		c.IsAlbum = isAlbum
+		fs, err := newAliyunDrive(context.Background(), &c)
+		if err != nil {
+			return nil, err
+		}
+		// the root is returned without any request, so check a path under workdir
+		_, err = fs.GetByPath(context.Background(), filepath.Join(workdir, driveTempDir), drive.AnyKind)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return fs, nil
+	}
+
+	if album == "" {
+		fs, err := open(false)
+		if err == nil {
+			return fs, nil
+		}
+		if fs, err2 := open(true); err2 == nil {
+			logger.Warnf("The personal drive is not usable (%s), use the album instead", err)
+			return fs, nil
+		}
+		return nil, fmt.Errorf("neither the personal drive nor the album of the account is usable: %s", err)
+	}
+	isAlbum := album == "true"
+	fs, err := open(isAlbum)
+	if err == nil {
+		return fs, nil
+	}
+	if _, err2 := open(!isAlbum); err2 == nil {
+		return nil, fmt.Errorf("the %s of the account is not usable: %s; the account has a %s, please set album=%t in the endpoint or remove it to detect automatically",
+			aliyunSpace(isAlbum), err, aliyunSpace(!isAlbum), !isAlbum)
+	}
+	return nil, fmt.Errorf("open the %s: %w", aliyunSpace(isAlbum), err)
+}
+
+// withContext runs fn until it returns or ctx is done, since the drive may
+// not abort a request in flight promptly.
+func withContext(ctx context.Context, fn func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newAliyunStorage(ctx context.Context, fs drive.Fs, workdir string, opts aliyunOptions) (*AliyunStorage, error) {
+	counter := newCountingDrive(fs)
+	if opts.maxRPS > 0 {
+		burst := opts.rpsBurst
+		if burst <= 0 {
+			if burst = int64(opts.maxRPS); burst < 1 {
+				burst = 1
+			}
+		}
+		counter.limit = ratelimit.NewBucketWithRate(opts.maxRPS, burst)
+	}
+	s := AliyunStorage{aliyunState: &aliyunState{fs: counter, counter: counter, layout: flatLayout{}, getRetries: opts.getRetries, maxKeys: opts.maxKeys,
+		readBuffer: opts.readBuffer, locker: NewLocalKeyLocker(), headers: opts.headers,
+		verifyMove: opts.verifyMove, visible: opts.visibleTimeout, budget: opts.retryBudget, deletes: opts.deleteConcurrency,
+		rejectDirs: opts.dirMarkers == "reject", temps: make(map[string]context.CancelFunc), cleanupTimeout: opts.cleanupTimeout,
+		inlineReadSize: opts.inlineReadSize}}
+	if s.maxKeys <= 0 {
+		s.maxKeys = defaultAliyunOptions.maxKeys
+	}
+	mkdirs := opts.mkdirConcurrency
+	if mkdirs <= 0 {
+		mkdirs = defaultAliyunOptions.mkdirConcurrency
+	}
+	s.mkdirLock = make(chan struct{}, mkdirs)
+	if f, ok := fs.(*failoverDrive); ok {
+		s.failover = f
+		f.onSwitch = s.switchAccount
+	}
+	if opts.fanout > 0 {
+		s.layout = hashLayout{uint32(opts.fanout)}
+	}
+	if opts.mirror != "" {
+		m, err := newReadMirror(opts.mirror)
+		if err != nil {
+			return nil, err
+		}
+		s.mirror = m
+	}
+	_, err := s.getNode(workdir, true)
+	if err != nil {
+		return nil, err
+	}
+	s.workdir = workdir
+	s.getLock = newFairSemaphore(2)
+	s.putLock = newFairSemaphore(2)
+	s.walker = newTreeWalker(opts.listConcurrency, s.listNodes)
+	// content_hash of the drive is SHA1 in upper case
+	s.walker.hashAlgo = HashSHA1
+	s.walker.skip = func(key string) bool { return key == driveTempDir+"/" }
+	s.walker.dirMarker = aliyunDirMarker
+	s.walker.dirs = opts.listDirs
+	s.walker.maxDepth = opts.maxDepth
+	if opts.listCache != "" {
+		s.walker.cache = openListCache(opts.listCache, opts.listCacheTTL)
+	}
+
+	// clean temp dir
+	tempDir := filepath.Join(s.workdir, driveTempDir)
+	cleanup := func(fn func(ctx context.Context) error) error {
+		cctx := ctx
+		if opts.cleanupTimeout > 0 {
+			var cancel context.CancelFunc
+			cctx, cancel = context.WithTimeout(ctx, opts.cleanupTimeout)
+			defer cancel()
+		}
+		err := withContext(cctx, fn)
+		if err != nil && ctx.Err() == nil && cctx.Err() == context.DeadlineExceeded {
+			logger.Warnf("Clean up the temp dir %s: not finished in %s, leave it to be cleaned later", tempDir, opts.cleanupTimeout)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("clean up the temp dir %s: %w", tempDir, err)
+		}
+		return nil
+	}
+	// the removal may be still running after the timeout
+	stale, err := s.getNode(tempDir, false)
+	if err == nil && !opts.keepTemp {
+		s.nodeIDCache.Delete(tempDir)
+		if err = cleanup(func(ctx context.Context) error { return s.fs.Remove(ctx, stale) }); err != nil {
+			return nil, err
+		}
+	}
+	tmp, err := s.getNode(tempDir, true)
+	if err != nil {
 		return nil, err
 	}
 	s.tempdirID = tmp
+	if opts.keepTemp && opts.tempTTL > 0 {
+		deadline := time.Now().Add(-opts.tempTTL)
+		if err = cleanup(func(ctx context.Context) error { return s.cleanTemp(ctx, deadline) }); err != nil {
+			return nil, err
+		}
+	}
 	return &s, nil
 }
 
+// cleanTemp removes the temp files not updated since the deadline, which
+// are left by the clients that crashed halfway through an upload.
+func (s *AliyunStorage) cleanTemp(ctx context.Context, deadline time.Time) error {
+	nodes, err := s.fs.ListAll(ctx, s.tempdir())
+	if err != nil {
+		return fmt.Errorf("list temp dir: %w", err)
+	}
+	for _, n := range nodes {
+		if mtime, err := n.GetTime(); err != nil || !mtime.Before(deadline) {
+			continue
+		}
+		if err = s.fs.Remove(ctx, n.NodeId); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove temp file %s: %w", n.Name, err)
+		}
+		logger.Infof("Removed the stale temp file %s of %s", n.Name, n.Updated)
+	}
+	return nil
+}
+
+// aliyunTempName is the name of the temp file uploading key, which is
+// unique and tells the key of a pending upload.
+func aliyunTempName(key string) string {
+	return uuid.NewString() + "_" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// ListUploads returns the temp files as the pending uploads, which are the
+// uploads in progress or left by the crashed clients. The upload id is the
+// name of the temp file, and the key is empty for those of old clients.
+func (s *AliyunStorage) ListUploads(marker string) ([]*PendingPart, string, error) {
+	nodes, err := s.fs.ListAll(s.context(), s.tempdir())
+	if err != nil {
+		return nil, "", fmt.Errorf("list temp dir: %w", err)
+	}
+	parts := make([]*PendingPart, 0, len(nodes))
+	for _, n := range nodes {
+		var key string
+		if i := strings.Index(n.Name, "_"); i > 0 {
+			if k, err := base64.RawURLEncoding.DecodeString(n.Name[i+1:]); err == nil {
+				key = string(k)
+			}
+		}
+		created, _ := n.GetTime()
+		parts = append(parts, &PendingPart{key, n.Name, created})
+	}
+	return parts, "", nil
+}
+
+// AbortUpload removes the temp file of the upload to reclaim the space, an
+// upload still in progress fails then.
+func (s *AliyunStorage) AbortUpload(key string, uploadID string) {
+	if uploadID == "" || strings.Contains(uploadID, "/") {
+		return
+	}
+	p := filepath.Join(s.workdir, driveTempDir, uploadID)
+	n, err := s.fs.GetByPath(s.context(), p, drive.FileKind)
+	if err == nil {
+		err = s.fs.Remove(s.context(), n.NodeId)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warnf("Abort the upload %s of %s: %s", uploadID, key, err)
+	}
+}
+
+// aliyunErrorClass classifies the errors of the drive. Unlike the default, an
+// expired token (401) is refreshed by the next request (see tokenRetrier),
+// and a name taken keeps failing whatever status it comes with.
+func aliyunErrorClass(err error) ErrorClass {
+	if isAliyunExisted(err) {
+		return ErrorPermanent
+	}
+	switch statusOf(err) {
+	case http.StatusUnauthorized, http.StatusTooManyRequests:
+		return ErrorRetryable
+	case http.StatusForbidden:
+		// denied, or out of quota
+		return ErrorPermanent
+	}
+	return DefaultErrorClassifier(err)
+}
+
 func init() {
-	Register("aliyun", newAliyun)
+	RegisterErrorClassifier("aliyun", aliyunErrorClass)
+	o := defaultAliyunOptions
+	RegisterWithDefaults("aliyun", newAliyun, Options{
+		"list-concurrency":   strconv.Itoa(o.listConcurrency),
+		"delete-concurrency": strconv.Itoa(o.deleteConcurrency),
+		"mkdir-concurrency":  strconv.Itoa(o.mkdirConcurrency),
+		"get-retries":        strconv.Itoa(o.getRetries),
+		"max-keys":           strconv.FormatInt(o.maxKeys, 10),
+		"read-buffer":        strconv.Itoa(o.readBuffer),
+		"max-idle-conns":     strconv.Itoa(o.maxIdleConns),
+		"http2":              strconv.FormatBool(o.http2),
+		"keep-alive":         o.keepAlive.String(),
+		"idle-timeout":       o.idleTimeout.String(),
+		"token-retries":      strconv.Itoa(o.tokenRetries),
+		"cleanup-timeout":    o.cleanupTimeout.String(),
+		"list-cache-ttl":     o.listCacheTTL.String(),
+		"dir-markers":        o.dirMarkers,
+		"max-rps":            strconv.FormatFloat(o.maxRPS, 'f', -1, 64),
+		"key-buckets":        strconv.Itoa(o.keyBuckets),
+		"list-dirs":          strconv.FormatBool(o.listDirs),
+		"visible-timeout":    o.visibleTimeout.String(),
+		"max-depth":          strconv.Itoa(o.maxDepth),
+		"split-size":         strconv.FormatInt(o.splitSize, 10),
+		"inline-read-size":   strconv.FormatInt(o.inlineReadSize, 10),
+		"both-spaces":        strconv.FormatBool(o.bothSpaces),
+		"pool-accounts":      strconv.FormatBool(o.poolAccounts),
+		"metadata-sidecar":   strconv.FormatBool(o.metadataSidecar),
+	})
 }
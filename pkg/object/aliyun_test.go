@@ -0,0 +1,3192 @@
+package object
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/K265/aliyundrive-go/pkg/aliyun/drive"
+)
+
+type fakeNode struct {
+	drive.Node
+	data []byte
+}
+
+// fakeDrive is an in-memory drive.Fs that records the API calls it receives.
+type fakeDrive struct {
+	drive.Fs
+	sync.Mutex
+	nodes      map[string]*fakeNode
+	calls      map[string]int
+	seq        int
+	listDelay  time.Duration
+	moveDelay  time.Duration
+	mkdirDelay time.Duration
+	// mkdirRefuse refuses to create an existing folder as check_name_mode=refuse
+	mkdirRefuse bool
+	// removeDelay slows down Remove, which ignores the context as a stuck request
+	removeDelay time.Duration
+	// fail injects an error into the operation on a node
+	fail func(op, nodeID string) error
+	// wrapOpen replaces the stream returned by Open
+	wrapOpen func(nodeID string, r io.ReadCloser) io.ReadCloser
+	// headers of the last Open
+	openHeaders map[string]string
+	// download fetches the node for Open over HTTP as the real drive does
+	download func(nodeID string, headers map[string]string) (io.ReadCloser, error)
+	// badMove breaks a node after a successful Move
+	badMove func(n *fakeNode)
+	// folderDelay is the time of a move into a folder, and the moves into a
+	// folder are serialized as into a hot folder of the drive
+	folderDelay time.Duration
+	folders     map[string]*sync.Mutex
+	// the most CreateFolderRecursively running at the same time
+	mkdirRunning, mkdirPeak int
+	// indexDelay hides a file moved from GetByPath for a while, as the drive
+	// indexes it later
+	indexDelay time.Duration
+	moved      map[string]time.Time
+	// quota is the total space reported by About
+	quota int64
+	// urls returns the download URLs with the files found by GetByPath,
+	// which are refused by Download once urlExpired
+	urls, urlExpired bool
+}
+
+func newFakeDrive() *fakeDrive {
+	d := &fakeDrive{nodes: make(map[string]*fakeNode), calls: make(map[string]int)}
+	d.nodes["root"] = &fakeNode{Node: drive.Node{NodeId: "root", Name: "", Type: drive.FolderKind}}
+	return d
+}
+
+func (d *fakeDrive) called(name string) int {
+	d.Lock()
+	defer d.Unlock()
+	return d.calls[name]
+}
+
+func (d *fakeDrive) inject(op, nodeID string) error {
+	if d.fail != nil {
+		return d.fail(op, nodeID)
+	}
+	return nil
+}
+
+func (d *fakeDrive) child(parent, name string) *fakeNode {
+	for _, n := range d.nodes {
+		if n.ParentId == parent && n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+func (d *fakeDrive) lookup(p string) *fakeNode {
+	n := d.nodes["root"]
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if n = d.child(n.NodeId, name); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (d *fakeDrive) add(parent, name, kind string, data []byte) *fakeNode {
+	d.seq++
+	n := &fakeNode{Node: drive.Node{
+		NodeId:   fmt.Sprintf("node%d", d.seq),
+		ParentId: parent,
+		Name:     name,
+		Type:     kind,
+		Size:     int64(len(data)),
+		Updated:  time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+	}, data: data}
+	d.nodes[n.NodeId] = n
+	return n
+}
+
+func (d *fakeDrive) mkdirAll(p string) *fakeNode {
+	n := d.nodes["root"]
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		c := d.child(n.NodeId, name)
+		if c == nil {
+			c = d.add(n.NodeId, name, drive.FolderKind, nil)
+		}
+		n = c
+	}
+	return n
+}
+
+// write creates a file at path p directly, bypassing the API accounting.
+func (d *fakeDrive) write(p string, data []byte) {
+	d.Lock()
+	defer d.Unlock()
+	dir, name := path.Split(p)
+	d.add(d.mkdirAll(dir).NodeId, name, drive.FileKind, data)
+}
+
+func (d *fakeDrive) GetByPath(ctx context.Context, fullPath string, kind string) (*drive.Node, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.calls["GetByPath"]++
+	if err := d.inject("GetByPath", fullPath); err != nil {
+		return nil, err
+	}
+	n := d.lookup(fullPath)
+	if n == nil || kind != drive.AnyKind && n.Type != kind || time.Since(d.moved[n.NodeId]) < d.indexDelay {
+		return nil, fmt.Errorf("find %s: %w", fullPath, os.ErrNotExist)
+	}
+	node := n.Node
+	if d.urls && node.Type == drive.FileKind {
+		node.DownloadUrl = "fake://" + node.NodeId
+	}
+	return &node, nil
+}
+
+func (d *fakeDrive) ListAll(ctx context.Context, nodeId string) ([]drive.Node, error) {
+	if d.listDelay > 0 {
+		time.Sleep(d.listDelay)
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.calls["ListAll"]++
+	if err := d.inject("ListAll", nodeId); err != nil {
+		return nil, err
+	}
+	if _, ok := d.nodes[nodeId]; !ok {
+		return nil, fmt.Errorf("list %s: %w", nodeId, os.ErrNotExist)
+	}
+	var nodes []drive.Node
+	for _, n := range d.nodes {
+		if n.ParentId == nodeId {
+			nodes = append(nodes, n.Node)
+		}
+	}
+	return nodes, nil
+}
+
+func (d *fakeDrive) CreateFolderRecursively(ctx context.Context, fullPath string) (string, error) {
+	d.Lock()
+	if d.mkdirRunning++; d.mkdirRunning > d.mkdirPeak {
+		d.mkdirPeak = d.mkdirRunning
+	}
+	d.Unlock()
+	if d.mkdirDelay > 0 {
+		time.Sleep(d.mkdirDelay)
+	}
+	d.Lock()
+	d.mkdirRunning--
+	defer d.Unlock()
+	d.calls["CreateFolderRecursively"]++
+	if d.mkdirRefuse && d.lookup(fullPath) != nil {
+		return "", fmt.Errorf(`got "409", {"code":"AlreadyExist.File","message":"The resource file has already existed. file with same name exists"}`)
+	}
+	return d.mkdirAll(fullPath).NodeId, nil
+}
+
+func (d *fakeDrive) CreateFile(ctx context.Context, node drive.Node, in io.Reader) (string, error) {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return "", err
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.calls["CreateFile"]++
+	if err := d.inject("CreateFile", node.ParentId); err != nil {
+		return "", err
+	}
+	if _, ok := d.nodes[node.ParentId]; !ok {
+		return "", fmt.Errorf("parent %s: %w", node.ParentId, os.ErrNotExist)
+	}
+	if node.Size != int64(len(data)) {
+		// only the parts planned for the size are uploaded
+		return "", fmt.Errorf("size of %s is %d, but got %d bytes", node.Name, node.Size, len(data))
+	}
+	n := d.add(node.ParentId, node.Name, drive.FileKind, data)
+	// the drive keeps the SHA1 of content
+	n.Hash = fmt.Sprintf("%X", sha1.Sum(data))
+	return n.NodeId, nil
+}
+
+func (d *fakeDrive) Move(ctx context.Context, nodeId string, dstParentNodeId string, dstName string) (string, error) {
+	if d.moveDelay > 0 {
+		time.Sleep(d.moveDelay)
+	}
+	if d.folderDelay > 0 {
+		d.Lock()
+		if d.folders == nil {
+			d.folders = make(map[string]*sync.Mutex)
+		}
+		if d.folders[dstParentNodeId] == nil {
+			d.folders[dstParentNodeId] = &sync.Mutex{}
+		}
+		folder := d.folders[dstParentNodeId]
+		d.Unlock()
+		folder.Lock()
+		time.Sleep(d.folderDelay)
+		folder.Unlock()
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.calls["Move"]++
+	n, ok := d.nodes[nodeId]
+	if !ok {
+		return "", fmt.Errorf("move %s: %w", nodeId, os.ErrNotExist)
+	}
+	if d.child(dstParentNodeId, dstName) != nil {
+		return "", drive.ErrorAlreadyExisted
+	}
+	n.ParentId, n.Name = dstParentNodeId, dstName
+	if d.indexDelay > 0 {
+		if d.moved == nil {
+			d.moved = make(map[string]time.Time)
+		}
+		d.moved[nodeId] = time.Now()
+	}
+	if d.badMove != nil {
+		d.badMove(n)
+	}
+	return nodeId, nil
+}
+
+func (d *fakeDrive) remove(nodeId string) {
+	for id, n := range d.nodes {
+		if n.ParentId == nodeId {
+			d.remove(id)
+		}
+	}
+	delete(d.nodes, nodeId)
+}
+
+func (d *fakeDrive) About(ctx context.Context) (*drive.PersonalSpaceInfo, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.calls["About"]++
+	info := &drive.PersonalSpaceInfo{Total: d.quota}
+	for _, n := range d.nodes {
+		info.Used += int64(len(n.data))
+	}
+	return info, nil
+}
+
+func (d *fakeDrive) Remove(ctx context.Context, nodeId string) error {
+	if d.removeDelay > 0 {
+		time.Sleep(d.removeDelay)
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.calls["Remove"]++
+	if _, ok := d.nodes[nodeId]; !ok {
+		return fmt.Errorf("remove %s: %w", nodeId, os.ErrNotExist)
+	}
+	d.remove(nodeId)
+	return nil
+}
+
+func (d *fakeDrive) Open(ctx context.Context, nodeId string, headers map[string]string) (io.ReadCloser, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.calls["Open"]++
+	d.openHeaders = headers
+	n, ok := d.nodes[nodeId]
+	if !ok {
+		return nil, fmt.Errorf("open %s: %w", nodeId, os.ErrNotExist)
+	}
+	if d.download != nil {
+		return d.download(nodeId, headers)
+	}
+	return d.serve(n, headers)
+}
+
+// serve returns the content of a node with the lock held.
+func (d *fakeDrive) serve(n *fakeNode, headers map[string]string) (io.ReadCloser, error) {
+	data := n.data
+	if r, ok := headers["Range"]; ok {
+		var start, end int64 = 0, int64(len(data)) - 1
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end); err != nil {
+			if _, err = fmt.Sscanf(r, "bytes=%d-", &start); err != nil {
+				return nil, fmt.Errorf("invalid range %q", r)
+			}
+		}
+		if start >= int64(len(data)) {
+			// as rangeChecker does for status 416
+			return nil, &rangeError{r, int64(len(data))}
+		}
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		data = data[start : end+1]
+	}
+	r := io.NopCloser(bytes.NewReader(data))
+	if d.wrapOpen != nil {
+		return d.wrapOpen(n.NodeId, r), nil
+	}
+	return r, nil
+}
+
+// Download serves the URLs returned with the nodes by GetByPath.
+func (d *fakeDrive) Download(ctx context.Context, url string, headers map[string]string) (io.ReadCloser, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.calls["Download"]++
+	if !strings.HasPrefix(url, "fake://") {
+		return nil, fmt.Errorf("download %s: unknown url", url)
+	}
+	n, ok := d.nodes[strings.TrimPrefix(url, "fake://")]
+	if !ok || d.urlExpired {
+		return nil, fmt.Errorf("download %s: 403 Forbidden", url)
+	}
+	return d.serve(n, headers)
+}
+
+func newTestAliyun(t testing.TB, d *fakeDrive, opts aliyunOptions) *AliyunStorage {
+	s, err := newAliyunStorage(context.Background(), d, "/jfs", opts)
+	if err != nil {
+		t.Fatalf("create aliyun storage: %s", err)
+	}
+	return s
+}
+
+func collect(t testing.TB, ch <-chan Object) []string {
+	var keys []string
+	for o := range ch {
+		if o == nil {
+			t.Fatalf("list failed")
+		}
+		keys = append(keys, o.Key())
+	}
+	return keys
+}
+
+func TestAliyunListAll(t *testing.T) {
+	d := newFakeDrive()
+	var expected []string
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			for k := 0; k < 3; k++ {
+				key := fmt.Sprintf("chunks/%d/%d/%d_0_4", i, j, k)
+				d.write("/jfs/"+key, []byte("data"))
+				expected = append(expected, key)
+			}
+		}
+	}
+	d.write("/jfs/chunks.bak", []byte("x"))
+	d.write("/jfs/chunks0", []byte("x"))
+	expected = append(expected, "chunks.bak", "chunks0")
+	sort.Strings(expected)
+
+	for _, c := range []int{1, 2, 8, 64} {
+		s := newTestAliyun(t, d, aliyunOptions{listConcurrency: c})
+		ch, err := s.ListAll("", "")
+		if err != nil {
+			t.Fatalf("list all: %s", err)
+		}
+		keys := collect(t, ch)
+		if strings.Join(keys, ",") != strings.Join(expected, ",") {
+			t.Fatalf("concurrency %d: expect %v, but got %v", c, expected, keys)
+		}
+	}
+
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	ch, err := s.ListAll("chunks/3/", "chunks/3/2/1_0_4")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	keys := collect(t, ch)
+	if len(keys) != 7 || keys[0] != "chunks/3/2/2_0_4" || keys[6] != "chunks/3/4/2_0_4" {
+		t.Fatalf("list with prefix and marker: %v", keys)
+	}
+}
+
+func TestAliyunListPrefix(t *testing.T) {
+	d := newFakeDrive()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			d.write(fmt.Sprintf("/jfs/chunks/%d/%d/%d_0_4", i, i, j), []byte("data"))
+		}
+	}
+	d.write("/jfs/chunks/1/2_0_4", []byte("data"))
+	d.write("/jfs/chunks/10/0_0_4", []byte("data"))
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	// warm up the node ids of the directories
+	for _, p := range []string{"/jfs", "/jfs/chunks", "/jfs/chunks/1", "/jfs/chunks/1/1"} {
+		if _, err := s.getNode(p, false); err != nil {
+			t.Fatalf("get node %s: %s", p, err)
+		}
+	}
+	above := map[string]bool{d.lookup("/jfs").NodeId: true, d.lookup("/jfs/chunks").NodeId: true}
+	var listed []string
+	d.fail = func(op, nodeID string) error {
+		if op != "ListAll" {
+			return nil
+		}
+		listed = append(listed, nodeID)
+		if above[nodeID] {
+			return errors.New("listed above the prefix")
+		}
+		return nil
+	}
+
+	ch, err := s.ListAll("chunks/1/1/", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if keys := collect(t, ch); strings.Join(keys, ",") != "chunks/1/1/0_0_4,chunks/1/1/1_0_4,chunks/1/1/2_0_4" {
+		t.Fatalf("list the directory: %v", keys)
+	}
+	if len(listed) != 1 {
+		t.Fatalf("expect only the directory listed, but got %v", listed)
+	}
+	objs, err := s.List("chunks/1/1/1", "chunks/1/1/0_0_4", 10)
+	if err != nil || len(objs) != 1 || objs[0].Key() != "chunks/1/1/1_0_4" {
+		t.Fatalf("list part of the directory: %v %v", objs, err)
+	}
+	// up to the directory of the prefix
+	listed = nil
+	if ch, err = s.ListAll("chunks/1/", ""); err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if keys := collect(t, ch); len(keys) != 4 || keys[3] != "chunks/1/2_0_4" {
+		t.Fatalf("list the subtree: %v", keys)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("expect the subtree listed, but got %v", listed)
+	}
+	if ch, err = s.ListSince("chunks/1/1/", time.Now().Add(-time.Hour)); err != nil || len(collect(t, ch)) != 3 {
+		t.Fatalf("list since: %v", err)
+	}
+	if ch, err = s.ListAll("chunks/5/", ""); err != nil || len(collect(t, ch)) != 0 {
+		t.Fatalf("list the missing directory: %v", err)
+	}
+
+	// a prefix across the directories falls back to the walk from above
+	d.fail = nil
+	if ch, err = s.ListAll("chunks/1", ""); err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if keys := collect(t, ch); len(keys) != 5 || keys[4] != "chunks/10/0_0_4" {
+		t.Fatalf("list across the directories: %v", keys)
+	}
+	// the temp dir is never listed
+	if ch, err = s.ListAll(driveTempDir+"/", ""); err != nil || len(collect(t, ch)) != 0 {
+		t.Fatalf("list the temp dir: %v", err)
+	}
+}
+
+func TestAliyunListAllError(t *testing.T) {
+	d := newFakeDrive()
+	d.write("/jfs/a/b/c", []byte("c"))
+	d.write("/jfs/d", []byte("d"))
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	broken := d.lookup("/jfs/a/b").NodeId
+	d.fail = func(op, nodeID string) error {
+		if op == "ListAll" && nodeID == broken {
+			return errors.New("internal error")
+		}
+		return nil
+	}
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	var last Object = &obj{}
+	for o := range ch {
+		last = o
+	}
+	if last != nil {
+		t.Fatalf("the error should be reported by a nil object")
+	}
+}
+
+func TestAliyunList(t *testing.T) {
+	d := newFakeDrive()
+	for i := 0; i < 25; i++ {
+		d.write(fmt.Sprintf("/jfs/chunks/%d/%02d_0_4", i%3, i), []byte("data"))
+	}
+	s := newTestAliyun(t, d, aliyunOptions{listConcurrency: 2, maxKeys: 10})
+	var keys []string
+	marker := ""
+	for _, limit := range []int64{1 << 30, -1, 0} {
+		objs, err := s.List("", marker, limit)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		if len(objs) != 10 && len(keys)+len(objs) != 25 {
+			t.Fatalf("limit %d should be capped to 10 objects, but got %d", limit, len(objs))
+		}
+		for _, o := range objs {
+			keys = append(keys, o.Key())
+		}
+		marker = keys[len(keys)-1]
+	}
+	if len(keys) != 25 || !sort.StringsAreSorted(keys) {
+		t.Fatalf("continue with the marker should list all the objects: %v", keys)
+	}
+	if objs, err := s.List("chunks/1/", "", 3); err != nil || len(objs) != 3 || objs[0].Key() != "chunks/1/01_0_4" {
+		t.Fatalf("list with prefix: %v %v", objs, err)
+	}
+	if objs, err := s.List("", marker, 10); err != nil || len(objs) != 0 {
+		t.Fatalf("list after the last key: %v %v", objs, err)
+	}
+}
+
+func TestAliyunListAllTolerant(t *testing.T) {
+	d := newFakeDrive()
+	for _, key := range []string{"a/b/c", "a/b/d/e", "a/f", "g/h", "i"} {
+		d.write("/jfs/"+key, []byte(key))
+	}
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	broken := d.lookup("/jfs/a/b").NodeId
+	d.fail = func(op, nodeID string) error {
+		if op == "ListAll" && nodeID == broken {
+			return errors.New("permission denied")
+		}
+		return nil
+	}
+	var failed []string
+	ch, err := s.ListAllTolerant("", "", func(dir string, err error) {
+		failed = append(failed, dir+": "+err.Error())
+	})
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	keys := collect(t, ch)
+	if strings.Join(keys, ",") != "a/f,g/h,i" {
+		t.Fatalf("the other objects should be listed: %v", keys)
+	}
+	if len(failed) != 1 || failed[0] != "a/b/: permission denied" {
+		t.Fatalf("the broken directory should be reported: %v", failed)
+	}
+}
+
+func TestAliyunListSince(t *testing.T) {
+	d := newFakeDrive()
+	old := time.Now().Add(-time.Hour).UTC().Format("2006-01-02T15:04:05.000Z")
+	cutoff := time.Now().Add(-time.Minute)
+	var expected []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("chunks/%d/%02d_0_4", i%4, i)
+		d.write("/jfs/"+key, []byte("data"))
+		if i%3 == 0 {
+			expected = append(expected, key)
+		} else {
+			d.lookup("/jfs/" + key).Updated = old
+		}
+	}
+	// a new file inside an old folder should be found
+	d.lookup("/jfs/chunks/0").Updated = old
+	sort.Strings(expected)
+
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	ch, err := ListSince(s, "chunks/", cutoff)
+	if err != nil {
+		t.Fatalf("list since: %s", err)
+	}
+	keys := collect(t, ch)
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expect %v, but got %v", expected, keys)
+	}
+	if ch, err = ListSince(s, "chunks/", time.Now().Add(time.Minute)); err != nil || len(collect(t, ch)) != 0 {
+		t.Fatalf("nothing is modified in the future: %v", err)
+	}
+}
+
+func BenchmarkAliyunListAll(b *testing.B) {
+	d := newFakeDrive()
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			d.write(fmt.Sprintf("/jfs/chunks/%d/%d/1_0_4", i, j), []byte("data"))
+		}
+	}
+	d.listDelay = time.Millisecond
+	for _, c := range []int{1, 16} {
+		b.Run(fmt.Sprintf("concurrency-%d", c), func(b *testing.B) {
+			s := newTestAliyun(b, d, aliyunOptions{listConcurrency: c})
+			for i := 0; i < b.N; i++ {
+				ch, _ := s.ListAll("", "")
+				collect(b, ch)
+			}
+		})
+	}
+}
+
+func TestAliyunPurge(t *testing.T) {
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	for _, key := range []string{"chunks/0/1_0_4", "chunks/1/2_0_4", "meta.json"} {
+		if err := s.Put(key, bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	d.write("/jfs/"+driveTempDir+"/uploading", []byte("data"))
+
+	for _, confirm := range []string{"", "yes", PurgeToken(s) + "x", PurgeToken(&AliyunStorage{aliyunState: &aliyunState{workdir: "/other"}})} {
+		if err := s.Purge(confirm); err == nil {
+			t.Fatalf("purge with confirmation %q should be rejected", confirm)
+		}
+	}
+	if d.lookup("/jfs/meta.json") == nil || d.called("Remove") != 0 {
+		t.Fatalf("nothing should be removed without confirmation")
+	}
+
+	if err := s.Purge(PurgeToken(s)); err != nil {
+		t.Fatalf("purge: %s", err)
+	}
+	if n := d.called("Remove"); n != 2 {
+		t.Fatalf("expect 2 removes for the top entries, but got %d", n)
+	}
+	ch, _ := s.ListAll("", "")
+	if keys := collect(t, ch); len(keys) != 0 {
+		t.Fatalf("everything should be purged: %v", keys)
+	}
+	if d.lookup("/jfs/"+driveTempDir+"/uploading") == nil {
+		t.Fatalf("the temp dir should be kept")
+	}
+	// the cached folders are gone
+	if err := s.Put("chunks/0/3_0_4", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatalf("put after purge: %s", err)
+	}
+	if d.lookup("/jfs/chunks/0/3_0_4") == nil {
+		t.Fatalf("the object is not written after purge")
+	}
+}
+
+func TestAliyunObjectInfo(t *testing.T) {
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	data := []byte("hello world")
+	start := time.Now().Add(-time.Second)
+	if err := s.Put("chunks/1_0_11", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	check := func(how string, o Object) {
+		i := InfoOf(o)
+		if i.Key != "chunks/1_0_11" || i.Size != int64(len(data)) || i.IsDir || i.IsSymlink {
+			t.Fatalf("%s: unexpected %+v", how, i)
+		}
+		if i.Mtime.Before(start) || i.Mtime.After(time.Now()) {
+			t.Fatalf("%s: mtime %s", how, i.Mtime)
+		}
+		if i.HashAlgo != HashSHA1 || i.Hash != fmt.Sprintf("%x", sha1.Sum(data)) {
+			t.Fatalf("%s: hash %s %s", how, i.HashAlgo, i.Hash)
+		}
+		if i.ETag != "" || i.StorageClass != "" || i.Metadata != nil {
+			t.Fatalf("%s: the drive should have no etag, storage class or metadata: %+v", how, i)
+		}
+	}
+	o, err := s.Head("chunks/1_0_11")
+	if err != nil {
+		t.Fatalf("head: %s", err)
+	}
+	check("head", o)
+	objs, err := s.List("", "", 10)
+	if err != nil || len(objs) != 1 {
+		t.Fatalf("list: %v %s", objs, err)
+	}
+	check("list", objs[0])
+}
+
+func TestAliyunListCache(t *testing.T) {
+	d := newFakeDrive()
+	var keys []string
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 5; j++ {
+			key := fmt.Sprintf("chunks/%d/%d_0_4", i, j)
+			d.write("/jfs/"+key, []byte("data"))
+			keys = append(keys, key)
+		}
+	}
+	opts := defaultAliyunOptions
+	opts.listCache = filepath.Join(t.TempDir(), "listing")
+	s := newTestAliyun(t, d, opts)
+	clock := NewFakeClock(time.Now())
+	s.walker.cache.clock = clock
+	list := func(s *AliyunStorage, expect []string) int {
+		calls := d.called("ListAll")
+		ch, err := s.ListAll("", "")
+		if err != nil {
+			t.Fatalf("list all: %s", err)
+		}
+		if got := collect(t, ch); strings.Join(got, ",") != strings.Join(expect, ",") {
+			t.Fatalf("expect %v, but got %v", expect, got)
+		}
+		return d.called("ListAll") - calls
+	}
+
+	// the root, chunks/ and 10 subdirectories
+	if n := list(s, keys); n != 12 {
+		t.Fatalf("expect 12 directories fetched, but got %d", n)
+	}
+	if n := list(s, keys); n != 0 {
+		t.Fatalf("expect all the listings cached, but fetched %d", n)
+	}
+	// the listings are saved after a complete walk
+	opts2 := opts
+	opts2.keepTemp = true
+	s2 := newTestAliyun(t, d, opts2)
+	if n := list(s2, keys); n != 0 {
+		t.Fatalf("expect the listings loaded from file, but fetched %d", n)
+	}
+
+	// the directories of a written key are fetched again
+	if err := s.Put("chunks/3/new", bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	keys = append(keys[:20], append([]string{"chunks/3/new"}, keys[20:]...)...)
+	if n := list(s, keys); n != 3 {
+		t.Fatalf("expect 3 directories fetched after put, but got %d", n)
+	}
+	if err := s.Delete("chunks/3/new"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	keys = append(keys[:20], keys[21:]...)
+	if n := list(s, keys); n != 3 {
+		t.Fatalf("expect 3 directories fetched after delete, but got %d", n)
+	}
+
+	// revalidated after the interval, which is doubled if not changed
+	clock.Advance(opts.listCacheTTL)
+	if n := list(s, keys); n != 12 {
+		t.Fatalf("expect 12 directories revalidated, but got %d", n)
+	}
+	for _, interval := range []time.Duration{2 * opts.listCacheTTL, 4 * opts.listCacheTTL} {
+		clock.Advance(interval / 2)
+		if n := list(s, keys); n != 0 {
+			t.Fatalf("expect the unchanged listings cached for %s, but fetched %d", interval, n)
+		}
+		clock.Advance(interval / 2)
+		if n := list(s, keys); n != 12 {
+			t.Fatalf("expect 12 directories revalidated after %s, but got %d", interval, n)
+		}
+	}
+}
+
+func TestAliyunHash(t *testing.T) {
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	data := []byte("hello world")
+	if err := s.Put("chunks/1_0_11", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	opens := d.called("Open")
+	algo, sum, err := HashOf(s, "chunks/1_0_11", HashSHA256)
+	if err != nil {
+		t.Fatalf("hash: %s", err)
+	}
+	if algo != HashSHA1 || sum != fmt.Sprintf("%x", sha1.Sum(data)) {
+		t.Fatalf("expect the native sha1, but got %s %s", algo, sum)
+	}
+	if d.called("Open") != opens {
+		t.Fatalf("the content should not be read to hash")
+	}
+
+	m, _ := newMem("mem", "", "", "")
+	_ = m.Put("a", bytes.NewReader(data))
+	if same, err := SameContent(s, "chunks/1_0_11", m, "a"); err != nil || !same {
+		t.Fatalf("same content: %v %s", same, err)
+	}
+	_ = m.Put("b", bytes.NewReader([]byte("hello")))
+	if same, err := SameContent(m, "b", s, "chunks/1_0_11"); err != nil || same {
+		t.Fatalf("different content: %v %s", same, err)
+	}
+	if d.called("Open") != opens {
+		t.Fatalf("the content in aliyun should not be read to compare")
+	}
+}
+
+func TestAliyunCleanupTimeout(t *testing.T) {
+	d := newFakeDrive()
+	d.write("/jfs/"+driveTempDir+"/left", []byte("data"))
+	d.removeDelay = time.Second
+	opts := defaultAliyunOptions
+	opts.cleanupTimeout = 50 * time.Millisecond
+	start := time.Now()
+	s, err := newAliyunStorage(context.Background(), d, "/jfs", opts)
+	if err != nil {
+		t.Fatalf("a slow cleanup should not fail the startup: %s", err)
+	}
+	if used := time.Since(start); used > 500*time.Millisecond {
+		t.Fatalf("the cleanup should stop after the timeout, but took %s", used)
+	}
+	if s.tempdirID == "" {
+		t.Fatalf("the temp dir should be ready")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	opts.cleanupTimeout = 0
+	start = time.Now()
+	if _, err = newAliyunStorage(ctx, d, "/jfs", opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled, but got %v", err)
+	}
+	if used := time.Since(start); used > 500*time.Millisecond {
+		t.Fatalf("a canceled startup should abort promptly, but took %s", used)
+	}
+
+	if _, opts, err := parseAliyunEndpoint("/jfs?cleanup-timeout=10s"); err != nil || opts.cleanupTimeout != 10*time.Second {
+		t.Fatalf("parse cleanup-timeout: %v %s", opts.cleanupTimeout, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?cleanup-timeout=-1s"); err == nil {
+		t.Fatalf("negative cleanup-timeout should be rejected")
+	}
+}
+
+func TestAliyunMirror(t *testing.T) {
+	ms := &mirrorServer{objects: map[string]string{"chunks/1_0_6": "mirror"}}
+	srv := httptest.NewServer(ms)
+	defer srv.Close()
+	d := newFakeDrive()
+	d.write("/jfs/chunks/1_0_6", []byte("origin"))
+	d.write("/jfs/chunks/2_0_6", []byte("origin"))
+	_, opts, err := parseAliyunEndpoint("/jfs?mirror=" + srv.URL + "/cdn")
+	if err != nil {
+		t.Fatalf("parse mirror: %s", err)
+	}
+	s := newTestAliyun(t, d, opts)
+	lookups := d.called("GetByPath")
+	if data, err := get(s, "chunks/1_0_6", 1, 3); err != nil || data != "irr" {
+		t.Fatalf("get from mirror: %q %v", data, err)
+	}
+	if d.called("Open") != 0 || d.called("GetByPath") != lookups {
+		t.Fatalf("the drive should not be used for the objects in mirror")
+	}
+	if data, err := get(s, "chunks/2_0_6", 0, -1); err != nil || data != "origin" {
+		t.Fatalf("get from the drive: %q %v", data, err)
+	}
+	if d.called("Open") != 1 {
+		t.Fatalf("the drive should be used when the mirror misses")
+	}
+	if _, _, err = parseAliyunEndpoint("/jfs?mirror=cdn"); err == nil {
+		t.Fatalf("invalid mirror should be rejected")
+	}
+}
+
+func TestAliyunKeepTemp(t *testing.T) {
+	d := newFakeDrive()
+	d.write("/jfs/"+driveTempDir+"/fresh", []byte("uploading"))
+	d.write("/jfs/"+driveTempDir+"/stale", []byte("crashed"))
+	d.lookup("/jfs/" + driveTempDir + "/stale").Updated = time.Now().Add(-2 * time.Hour).UTC().Format("2006-01-02T15:04:05.000Z")
+
+	opts := defaultAliyunOptions
+	opts.keepTemp = true
+	newTestAliyun(t, d, opts)
+	if d.lookup("/jfs/"+driveTempDir+"/fresh") == nil || d.lookup("/jfs/"+driveTempDir+"/stale") == nil {
+		t.Fatalf("the temp files should survive with keep-temp")
+	}
+	if d.called("Remove") != 0 {
+		t.Fatalf("nothing should be removed, but got %d removes", d.called("Remove"))
+	}
+
+	opts.tempTTL = time.Hour
+	newTestAliyun(t, d, opts)
+	if d.lookup("/jfs/"+driveTempDir+"/fresh") == nil {
+		t.Fatalf("the fresh temp file should survive")
+	}
+	if d.lookup("/jfs/"+driveTempDir+"/stale") != nil {
+		t.Fatalf("the stale temp file should be removed")
+	}
+
+	newTestAliyun(t, d, defaultAliyunOptions)
+	if d.lookup("/jfs/"+driveTempDir+"/fresh") != nil {
+		t.Fatalf("the temp dir should be wiped by default")
+	}
+
+	if _, opts, err := parseAliyunEndpoint("/jfs?keep-temp=1&temp-ttl=30m"); err != nil || !opts.keepTemp || opts.tempTTL != 30*time.Minute {
+		t.Fatalf("parse keep-temp: %+v %v", opts, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?temp-ttl=-1s"); err == nil {
+		t.Fatalf("negative temp-ttl should be invalid")
+	}
+}
+
+func TestAliyunUploads(t *testing.T) {
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	if err := s.Put("chunks/obj", bytes.NewReader([]byte("done"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	// one is being uploaded and another is left by a crashed client
+	uploading, crashed := aliyunTempName("chunks/a"), aliyunTempName("chunks/b")
+	d.write("/jfs/"+driveTempDir+"/"+uploading, []byte("uploading"))
+	d.write("/jfs/"+driveTempDir+"/"+crashed, []byte("crashed"))
+	d.lookup("/jfs/" + driveTempDir + "/" + crashed).Updated = time.Now().Add(-2 * time.Hour).UTC().Format("2006-01-02T15:04:05.000Z")
+
+	parts, next, err := s.ListUploads("")
+	if err != nil || next != "" || len(parts) != 2 {
+		t.Fatalf("list uploads: %+v %q %v", parts, next, err)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Key < parts[j].Key })
+	if parts[0].Key != "chunks/a" || parts[0].UploadID != uploading || parts[1].Key != "chunks/b" || parts[1].UploadID != crashed {
+		t.Fatalf("unexpected uploads: %+v %+v", parts[0], parts[1])
+	}
+	// through a prefix
+	parts, _, err = WithPrefix(s, "chunks/").ListUploads("")
+	if err != nil || len(parts) != 2 || parts[0].Key != "a" && parts[0].Key != "b" {
+		t.Fatalf("list uploads with prefix: %+v %v", parts, err)
+	}
+	if parts, _, _ = WithPrefix(s, "other/").ListUploads(""); len(parts) != 0 {
+		t.Fatalf("uploads of other prefix: %+v", parts)
+	}
+
+	if n, err := AbortStaleUploads(s, time.Now().Add(-time.Hour)); err != nil || n != 1 {
+		t.Fatalf("abort stale uploads: %d %v", n, err)
+	}
+	if d.lookup("/jfs/"+driveTempDir+"/"+crashed) != nil {
+		t.Fatalf("the stale upload should be aborted")
+	}
+	if d.lookup("/jfs/"+driveTempDir+"/"+uploading) == nil {
+		t.Fatalf("the upload in progress should be kept")
+	}
+	s.AbortUpload("chunks/a", uploading)
+	if parts, _, err = s.ListUploads(""); err != nil || len(parts) != 0 {
+		t.Fatalf("uploads left: %+v %v", parts, err)
+	}
+	// only the temp files could be aborted
+	s.AbortUpload("chunks/obj", "../chunks/obj")
+	if got, err := get(s, "chunks/obj", 0, -1); err != nil || got != "done" {
+		t.Fatalf("get chunks/obj: %q %v", got, err)
+	}
+}
+
+func TestAliyunGetRange(t *testing.T) {
+	d := newFakeDrive()
+	d.write("/jfs/obj", []byte("hello world"))
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	for _, c := range []struct {
+		off, limit int64
+		expected   string
+	}{{0, -1, "hello world"}, {0, 5, "hello"}, {6, 5, "world"}, {4, 3, "o w"}} {
+		if data, err := get(s, "obj", c.off, c.limit); err != nil || data != c.expected {
+			t.Fatalf("get %d-%d: expect %q, but got %q (%v)", c.off, c.limit, c.expected, data, err)
+		}
+	}
+}
+
+func TestAliyunContentRange(t *testing.T) {
+	data := []byte("0123456789")
+	var contentRange string
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentRange != "" {
+			w.Header().Set("Content-Range", contentRange)
+		}
+		w.WriteHeader(status)
+		var start, end int64 = 0, int64(len(data)) - 1
+		_, _ = fmt.Sscanf(contentRange, "bytes %d-%d", &start, &end)
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		_, _ = w.Write(data[start : end+1])
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &rangeChecker{http.DefaultTransport}}
+	fetch := func(rng string) (string, error) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set("Range", rng)
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		d, err := io.ReadAll(resp.Body)
+		return string(d), err
+	}
+
+	for _, c := range []struct {
+		rng, contentRange string
+		status            int
+		expected          string
+		fail              bool
+	}{
+		{"bytes=0-3", "bytes 0-3/10", http.StatusPartialContent, "0123", false},
+		{"bytes=2-20", "bytes 2-9/10", http.StatusPartialContent, "23456789", false},
+		{"bytes=2-", "bytes 2-9/10", http.StatusPartialContent, "23456789", false},
+		{"bytes=2-4", "bytes 3-5/10", http.StatusPartialContent, "", true},
+		{"bytes=2-4", "bytes 2-6/10", http.StatusPartialContent, "", true},
+		{"bytes=2-", "bytes 2-5/10", http.StatusPartialContent, "", true},
+		{"bytes=2-4", "", http.StatusOK, "234", false},
+		{"bytes=2-", "", http.StatusOK, "23456789", false},
+		{"bytes=8-20", "", http.StatusOK, "89", false},
+		{"bytes=0-19", "bytes 0-19/20", http.StatusPartialContent, "", true},
+		{"bytes=10-", "bytes */10", http.StatusRequestedRangeNotSatisfiable, "", true},
+	} {
+		contentRange, status = c.contentRange, c.status
+		got, err := fetch(c.rng)
+		if c.fail && err == nil || !c.fail && (err != nil || got != c.expected) {
+			t.Fatalf("range %s with %q: got %q, err %v", c.rng, c.contentRange, got, err)
+		}
+	}
+	contentRange, status = "bytes */10", http.StatusRequestedRangeNotSatisfiable
+	var re *rangeError
+	if _, err := fetch("bytes=12-"); !errors.As(err, &re) || re.size != 10 {
+		t.Fatalf("expect unsatisfiable range of 10 bytes, but got %v", err)
+	}
+	contentRange, status = "", http.StatusOK
+	if _, err := fetch("bytes=10-"); !errors.As(err, &re) || re.size != 10 {
+		t.Fatalf("expect unsatisfiable range of the full body, but got %v", err)
+	}
+}
+
+func TestAliyunIgnoredRange(t *testing.T) {
+	data := []byte("hello world")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the full body for any Range
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &rangeChecker{http.DefaultTransport}}
+	d := newFakeDrive()
+	d.write("/jfs/obj", data)
+	d.download = func(nodeID string, headers map[string]string) (io.ReadCloser, error) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/"+nodeID, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	for _, c := range []struct {
+		off, limit int64
+		expected   string
+	}{{0, -1, "hello world"}, {0, 5, "hello"}, {6, 5, "world"}, {6, -1, "world"}, {4, 3, "o w"}, {8, 10, "rld"}, {11, -1, ""}} {
+		if got, err := get(s, "obj", c.off, c.limit); err != nil || got != c.expected {
+			t.Fatalf("get %d-%d: expect %q, but got %q (%v)", c.off, c.limit, c.expected, got, err)
+		}
+	}
+	buf := make([]byte, 5)
+	if n, err := GetInto(s, "obj", 6, buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("get into: %q %v", buf[:n], err)
+	}
+}
+
+func TestAliyunFanout(t *testing.T) {
+	l := hashLayout{16}
+	p := l.objectPath("chunks/0/1/123_0_4")
+	if p != l.objectPath("chunks/0/1/123_0_4") || !strings.HasPrefix(p, "chunks/0/1/.") || !strings.HasSuffix(p, "/123_0_4") {
+		t.Fatalf("unexpected path %s", p)
+	}
+	if dir, _ := path.Split(p); !l.isBucket(path.Base(dir)) {
+		t.Fatalf("%s should be a bucket", dir)
+	}
+	for _, name := range []string{".temp", ".10", ".01", "a", "."} {
+		if l.isBucket(name) {
+			t.Fatalf("%s should not be a bucket", name)
+		}
+	}
+
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, aliyunOptions{listConcurrency: 4, fanout: 16})
+	var keys []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("chunks/0/%d/%d_0_4", i%2, i))
+	}
+	keys = append(keys, "juicefs_uuid")
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := s.Put(k, bytes.NewReader([]byte(k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	d.Lock()
+	buckets := 0
+	for _, n := range d.nodes {
+		if n.IsDirectory() && l.isBucket(n.Name) {
+			buckets++
+		}
+	}
+	if n := d.lookup("/jfs/" + l.objectPath(keys[0])); n == nil || string(n.data) != keys[0] {
+		t.Fatalf("%s is not stored at %s", keys[0], l.objectPath(keys[0]))
+	}
+	d.Unlock()
+	if buckets < 10 {
+		t.Fatalf("objects should be spread into buckets, but only got %d", buckets)
+	}
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %v, but got %v", keys, got)
+	}
+	if data, err := get(s, keys[7], 0, -1); err != nil || data != keys[7] {
+		t.Fatalf("get %s: %q %v", keys[7], data, err)
+	}
+}
+
+// the buckets of WithKeyHashing are not taken as those of the fanout
+func TestAliyunFanoutKeyBuckets(t *testing.T) {
+	s := WithKeyHashing(newTestAliyun(t, newFakeDrive(), aliyunOptions{listConcurrency: 4, fanout: 4}), 4)
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("chunks/0/%d/%d_0_4", i%2, i))
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := s.Put(k, bytes.NewReader([]byte(k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	objs, err := s.List("", "", 100)
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	var got []string
+	for _, o := range objs {
+		got = append(got, o.Key())
+	}
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %v, but got %v", keys, got)
+	}
+	ch, err := s.ListAll("chunks/0/1/", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got = collect(t, ch); len(got) != 10 || got[0] != "chunks/0/1/11_0_4" {
+		t.Fatalf("list all chunks/0/1/: %v", got)
+	}
+	if data, err := get(s, keys[3], 0, -1); err != nil || data != keys[3] {
+		t.Fatalf("get %s: %q %v", keys[3], data, err)
+	}
+}
+
+func TestAliyunPrefetch(t *testing.T) {
+	d := newFakeDrive()
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("chunks/0/%d/%d_0_4", i%3, i))
+		d.write("/jfs/"+keys[i], []byte(keys[i]))
+	}
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	s.Prefetch(append(keys, "not/exists"))
+	before := d.called("GetByPath")
+	for _, k := range keys {
+		if data, err := get(s, k, 0, -1); err != nil || data != k {
+			t.Fatalf("get %s: %q %v", k, data, err)
+		}
+	}
+	if n := d.called("GetByPath") - before; n != 0 {
+		t.Fatalf("expect no GetByPath after prefetch, but got %d", n)
+	}
+}
+
+func TestAliyunCreateDirConcurrently(t *testing.T) {
+	d := newFakeDrive()
+	s1 := newTestAliyun(t, d, defaultAliyunOptions)
+	opts := defaultAliyunOptions
+	opts.keepTemp = true
+	s2 := newTestAliyun(t, d, opts)
+	// both clients find the directory missing before it's created
+	d.mkdirDelay = 50 * time.Millisecond
+	d.mkdirRefuse = true
+	var wg sync.WaitGroup
+	for i, s := range []*AliyunStorage{s1, s2} {
+		wg.Add(1)
+		go func(i int, s *AliyunStorage) {
+			defer wg.Done()
+			key := fmt.Sprintf("chunks/new/%d_0_4", i)
+			if err := s.Put(key, bytes.NewReader([]byte("data"))); err != nil {
+				t.Errorf("put %s: %s", key, err)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	id1, err1 := s1.getNode("/jfs/chunks/new", false)
+	id2, err2 := s2.getNode("/jfs/chunks/new", false)
+	if err1 != nil || err2 != nil || id1 != id2 {
+		t.Fatalf("expect the same directory, but got %s (%v) and %s (%v)", id1, err1, id2, err2)
+	}
+	if keys, _ := s1.List("chunks/", "", 10); len(keys) != 2 {
+		t.Fatalf("expect 2 objects in the directory, but got %d", len(keys))
+	}
+}
+
+func TestAliyunPutCreatesDirOnce(t *testing.T) {
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	d.mkdirDelay = 50 * time.Millisecond
+	before := d.called("CreateFolderRecursively")
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("chunks/1/2/3/4/%d_0_4", i)
+			if err := s.Put(key, bytes.NewReader([]byte(key))); err != nil {
+				t.Errorf("put %s: %s", key, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := d.called("CreateFolderRecursively") - before; n != 1 {
+		t.Fatalf("expect the directory created once, but got %d", n)
+	}
+	ch, err := s.ListAll("chunks/", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if keys := collect(t, ch); len(keys) != 32 {
+		t.Fatalf("expect 32 objects in the directory, but got %d", len(keys))
+	}
+}
+
+// brokenReader fails after n bytes.
+type brokenReader struct {
+	io.ReadCloser
+	n int
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("connection reset by peer")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n -= n
+	return n, err
+}
+
+func TestAliyunGetReopen(t *testing.T) {
+	d := newFakeDrive()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	d.write("/jfs/obj", data)
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	broken, size := 1, 3333
+	d.wrapOpen = func(nodeID string, r io.ReadCloser) io.ReadCloser {
+		if broken > 0 {
+			broken--
+			return &brokenReader{r, size}
+		}
+		return r
+	}
+	if got, err := get(s, "obj", 0, -1); err != nil || got != string(data) {
+		t.Fatalf("get with a broken stream: %d bytes, %v", len(got), err)
+	}
+	broken = 1
+	if got, err := get(s, "obj", 100, 5000); err != nil || got != string(data[100:5100]) {
+		t.Fatalf("get range with a broken stream: %d bytes, %v", len(got), err)
+	}
+	if n := d.called("Open"); n != 4 {
+		t.Fatalf("expect 4 opens, but got %d", n)
+	}
+
+	// every stream breaks before the retries could finish the download
+	broken, size = 10, 1000
+	if _, err := get(s, "obj", 0, -1); err == nil {
+		t.Fatalf("get should fail after retries are exhausted")
+	}
+}
+
+// breakingReader returns an error with the last of its n bytes.
+type breakingReader struct {
+	io.ReadCloser
+	n int
+}
+
+func (r *breakingReader) Read(p []byte) (int, error) {
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if r.n -= n; r.n <= 0 && err == nil {
+		err = errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func TestAliyunGetBrokenAtEnd(t *testing.T) {
+	d := newFakeDrive()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	d.write("/jfs/obj", data)
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	// the stream breaks along with the last byte of the range
+	d.wrapOpen = func(nodeID string, r io.ReadCloser) io.ReadCloser {
+		return &breakingReader{r, 200}
+	}
+	if got, err := get(s, "obj", 100, 200); err != nil || got != string(data[100:300]) {
+		t.Fatalf("get range broken at the end: %d bytes, %v", len(got), err)
+	}
+	buf := make([]byte, 200)
+	if n, err := s.GetInto("obj", 1000, buf); err != nil || n != 200 || string(buf) != string(data[1000:1200]) {
+		t.Fatalf("get into broken at the end: %d bytes, %v", n, err)
+	}
+	if n := d.called("Open"); n != 2 {
+		t.Fatalf("a finished range should not be reopened: %d opens", n)
+	}
+}
+
+// expiringReader fails as its URL expired after n bytes.
+type expiringReader struct {
+	io.ReadCloser
+	n int
+}
+
+func (r *expiringReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, fmt.Errorf("read body: %w", errURLExpired)
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n -= n
+	return n, err
+}
+
+func TestAliyunURLExpired(t *testing.T) {
+	d := newFakeDrive()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	d.write("/jfs/obj", data)
+	opts := defaultAliyunOptions
+	opts.getRetries = 0
+	s := newTestAliyun(t, d, opts)
+	// every URL expires after 3000 bytes, which are not taken as retries
+	d.wrapOpen = func(nodeID string, r io.ReadCloser) io.ReadCloser {
+		return &expiringReader{r, 3000}
+	}
+	if got, err := get(s, "obj", 0, -1); err != nil || got != string(data) {
+		t.Fatalf("get with the expiring urls: %d bytes, %v", len(got), err)
+	}
+	if n := d.called("Open"); n != 4 {
+		t.Fatalf("expect 4 opens, but got %d", n)
+	}
+	if got, err := get(s, "obj", 100, 5000); err != nil || got != string(data[100:5100]) {
+		t.Fatalf("get range with the expiring urls: %d bytes, %v", len(got), err)
+	}
+	// but a URL expired before delivering anything is
+	d.wrapOpen = func(nodeID string, r io.ReadCloser) io.ReadCloser {
+		return &expiringReader{r, 0}
+	}
+	if _, err := get(s, "obj", 0, -1); !errors.Is(err, errURLExpired) {
+		t.Fatalf("get by the expired urls: %v", err)
+	}
+
+	// the refusal of an expired URL is not taken as the content
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &rangeChecker{http.DefaultTransport}}
+	body = "<Error><Code>AccessDenied</Code><Message>Request has expired.</Message></Error>"
+	if _, err := client.Get(srv.URL); !errors.Is(err, errURLExpired) {
+		t.Fatalf("download by an expired url: %v", err)
+	}
+	body = "<Error><Code>AccessDenied</Code></Error>"
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("download refused: %s", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || string(got) != body {
+		t.Fatalf("the other refusals are kept: %d %q", resp.StatusCode, got)
+	}
+}
+
+func TestAliyunStaleNode(t *testing.T) {
+	d := newFakeDrive()
+	d.write("/jfs/obj", []byte("v1"))
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	if got, err := get(s, "obj", 0, -1); err != nil || got != "v1" {
+		t.Fatalf("get: %q %v", got, err)
+	}
+	// overwritten by the app of the drive, with the old node cached
+	d.Lock()
+	d.remove(d.lookup("/jfs/obj").NodeId)
+	d.Unlock()
+	d.write("/jfs/obj", []byte("v2"))
+	if got, err := get(s, "obj", 0, -1); err != nil || got != "v2" {
+		t.Fatalf("get after overwritten out of band: %q %v", got, err)
+	}
+	buf := make([]byte, 2)
+	d.Lock()
+	d.remove(d.lookup("/jfs/obj").NodeId)
+	d.Unlock()
+	d.write("/jfs/obj", []byte("v3"))
+	if n, err := GetInto(s, "obj", 0, buf); err != nil || string(buf[:n]) != "v3" {
+		t.Fatalf("get into after overwritten out of band: %q %v", buf[:n], err)
+	}
+
+	// deleted out of band
+	d.Lock()
+	d.remove(d.lookup("/jfs/obj").NodeId)
+	d.Unlock()
+	if _, err := s.Get("obj", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get after deleted out of band: %v", err)
+	}
+	if _, ok := s.nodeIDCache.Load("/jfs/obj"); ok {
+		t.Fatalf("the stale node should be dropped from the cache")
+	}
+	d.write("/jfs/obj", []byte("v4"))
+	if _, err := s.Head("obj"); err != nil {
+		t.Fatalf("head: %s", err)
+	}
+	d.Lock()
+	d.remove(d.lookup("/jfs/obj").NodeId)
+	d.Unlock()
+	if _, err := s.Head("obj"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head after deleted out of band: %v", err)
+	}
+	if _, ok := s.nodeIDCache.Load("/jfs/obj"); ok {
+		t.Fatalf("the missing node should be dropped from the cache by head")
+	}
+}
+
+// countingReader delivers at most chunk bytes per Read and counts the reads.
+type countingReader struct {
+	io.ReadCloser
+	chunk int
+	reads *int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	*r.reads++
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	return r.ReadCloser.Read(p)
+}
+
+func TestAliyunReadBuffer(t *testing.T) {
+	d := newFakeDrive()
+	data := make([]byte, 100<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	d.write("/jfs/obj", data)
+	var reads int
+	d.wrapOpen = func(nodeID string, r io.ReadCloser) io.ReadCloser {
+		return &countingReader{r, 100, &reads}
+	}
+	for _, size := range []int{0, 1 << 10, 1 << 20} {
+		opts := defaultAliyunOptions
+		opts.readBuffer = size
+		s := newTestAliyun(t, d, opts)
+		for _, rng := range [][2]int64{{0, -1}, {12345, 5000}, {int64(len(data)) - 10, -1}} {
+			got, err := get(s, "obj", rng[0], rng[1])
+			expect := data[rng[0]:]
+			if rng[1] > 0 {
+				expect = expect[:rng[1]]
+			}
+			if err != nil || got != string(expect) {
+				t.Fatalf("buffer %d range %v: got %d bytes, %v", size, rng, len(got), err)
+			}
+		}
+	}
+
+	// a read through the buffer gets as many bytes as asked
+	for size, expect := range map[int]int{0: 100, 1 << 20: 4 << 10} {
+		opts := defaultAliyunOptions
+		opts.readBuffer = size
+		s := newTestAliyun(t, d, opts)
+		r, err := s.Get("obj", 0, -1)
+		if err != nil {
+			t.Fatalf("get: %s", err)
+		}
+		if n, err := r.Read(make([]byte, 4<<10)); err != nil || n != expect {
+			t.Fatalf("buffer %d: expect to read %d bytes, but got %d %v", size, expect, n, err)
+		}
+		_ = r.Close()
+	}
+	if _, opts, err := parseAliyunEndpoint("/jfs?read-buffer=4096"); err != nil || opts.readBuffer != 4096 {
+		t.Fatalf("parse read-buffer: %+v %v", opts, err)
+	}
+}
+
+func BenchmarkAliyunReadBuffer(b *testing.B) {
+	d := newFakeDrive()
+	data := make([]byte, 4<<20)
+	d.write("/jfs/obj", data)
+	var reads int
+	d.wrapOpen = func(nodeID string, r io.ReadCloser) io.ReadCloser {
+		return &countingReader{r, 512, &reads}
+	}
+	for _, size := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer-%d", size), func(b *testing.B) {
+			opts := defaultAliyunOptions
+			opts.readBuffer = size
+			s := newTestAliyun(b, d, opts)
+			buf := make([]byte, 4<<10)
+			b.SetBytes(int64(len(data)))
+			var calls int
+			for i := 0; i < b.N; i++ {
+				r, err := s.Get("obj", 0, -1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for err == nil {
+					_, err = r.Read(buf)
+					calls++
+				}
+				_ = r.Close()
+			}
+			b.ReportMetric(float64(calls)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	d := newFakeDrive()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	d.write("/jfs/obj", data)
+	aliyun := newTestAliyun(t, d, defaultAliyunOptions)
+	mem, _ := newMem("mem", "", "", "")
+	_ = mem.Put("obj", bytes.NewReader(data))
+	for _, s := range []ObjectStorage{aliyun, mem} {
+		buf := make([]byte, 1000)
+		if n, err := GetInto(s, "obj", 1234, buf); err != nil || n != 1000 || !bytes.Equal(buf, data[1234:2234]) {
+			t.Fatalf("%s: get into: %d %v", s, n, err)
+		}
+		if n, err := GetInto(s, "obj", 9500, buf); err != io.EOF || n != 500 || !bytes.Equal(buf[:n], data[9500:]) {
+			t.Fatalf("%s: get into at the end: %d %v", s, n, err)
+		}
+		if _, err := GetInto(s, "missing", 0, buf); err == nil {
+			t.Fatalf("%s: get into missing should fail", s)
+		}
+	}
+	if n, err := GetInto(aliyun, "obj", int64(len(data)), make([]byte, 10)); err != io.EOF || n != 0 {
+		t.Fatalf("get into from the end: %d %v", n, err)
+	}
+
+	// a broken stream is reopened
+	broken := 1
+	d.wrapOpen = func(nodeID string, r io.ReadCloser) io.ReadCloser {
+		if broken > 0 {
+			broken--
+			return &brokenReader{r, 100}
+		}
+		return r
+	}
+	buf := make([]byte, 5000)
+	if n, err := GetInto(aliyun, "obj", 10, buf); err != nil || n != 5000 || !bytes.Equal(buf, data[10:5010]) {
+		t.Fatalf("get into with a broken stream: %d %v", n, err)
+	}
+}
+
+func BenchmarkAliyunGetInto(b *testing.B) {
+	d := newFakeDrive()
+	d.write("/jfs/obj", make([]byte, 4<<20))
+	s := newTestAliyun(b, d, defaultAliyunOptions)
+	buf := make([]byte, 1<<20)
+	b.Run("get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r, err := s.Get("obj", 1<<20, int64(len(buf)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err = io.ReadFull(r, buf); err != nil {
+				b.Fatal(err)
+			}
+			_ = r.Close()
+		}
+	})
+	b.Run("get-into", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.GetInto("obj", 1<<20, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAliyunPutIfAbsent(t *testing.T) {
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	tempFiles := func() int {
+		d.Lock()
+		defer d.Unlock()
+		var n int
+		for _, node := range d.nodes {
+			if node.ParentId == s.tempdirID {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := s.PutIfAbsent("a", bytes.NewReader([]byte("first"))); err != nil {
+		t.Fatalf("create a: %s", err)
+	}
+	created := d.called("CreateFile")
+	if err := s.PutIfAbsent("a", bytes.NewReader([]byte("second"))); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expect ErrExist, but got %v", err)
+	}
+	if n := d.called("CreateFile"); n != created {
+		t.Fatalf("nothing should be written for an existing object")
+	}
+	if got, err := get(s, "a", 0, -1); err != nil || got != "first" {
+		t.Fatalf("expect first, but got %q: %v", got, err)
+	}
+
+	// the destination is created by someone else during the upload
+	d.fail = func(op, nodeID string) error {
+		if op == "CreateFile" && d.lookup("/jfs/b") == nil {
+			d.add(d.lookup("/jfs").NodeId, "b", drive.FileKind, []byte("other"))
+		}
+		return nil
+	}
+	if err := s.PutIfAbsent("b", bytes.NewReader([]byte("mine"))); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expect ErrExist, but got %v", err)
+	}
+	d.fail = nil
+	if n := tempFiles(); n != 0 {
+		t.Fatalf("temp files should be cleaned up, but got %d", n)
+	}
+	if got, err := get(s, "b", 0, -1); err != nil || got != "other" {
+		t.Fatalf("expect other, but got %q: %v", got, err)
+	}
+
+	if err := s.Put("a", bytes.NewReader([]byte("second"))); err != nil {
+		t.Fatalf("overwrite a: %s", err)
+	}
+	if got, err := get(s, "a", 0, -1); err != nil || got != "second" {
+		t.Fatalf("expect second, but got %q: %v", got, err)
+	}
+}
+
+func TestAliyunPutUnknownLength(t *testing.T) {
+	defer func(n int) { spoolMemory = n }(spoolMemory)
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	data := make([]byte, 3<<20+123)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	// spooled into memory and into a local file
+	for _, spool := range []int{8 << 20, 1 << 20} {
+		spoolMemory = spool
+		r, w := io.Pipe()
+		go func() {
+			for off := 0; off < len(data); off += 4000 {
+				end := off + 4000
+				if end > len(data) {
+					end = len(data)
+				}
+				_, _ = w.Write(data[off:end])
+			}
+			_ = w.Close()
+		}()
+		key := fmt.Sprintf("pipe%d", spool)
+		if err := s.Put(key, r); err != nil {
+			t.Fatalf("put from pipe: %s", err)
+		}
+		if o, err := s.Head(key); err != nil || o.Size() != int64(len(data)) {
+			t.Fatalf("head: %v %v", o, err)
+		}
+		if got, err := get(s, key, 0, -1); err != nil || got != string(data) {
+			t.Fatalf("get: %d bytes %v", len(got), err)
+		}
+	}
+
+	// a seekable reader uploads from its current offset
+	f, err := os.CreateTemp(t.TempDir(), "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, _ = f.Write(data)
+	_, _ = f.Seek(100, io.SeekStart)
+	if err := s.Put("file", f); err != nil {
+		t.Fatalf("put from file: %s", err)
+	}
+	if got, err := get(s, "file", 0, -1); err != nil || got != string(data[100:]) {
+		t.Fatalf("get: %d bytes %v", len(got), err)
+	}
+}
+
+func TestAliyunMkdirConcurrency(t *testing.T) {
+	if _, opts, err := parseAliyunEndpoint("/jfs?mkdir-concurrency=3"); err != nil || opts.mkdirConcurrency != 3 {
+		t.Fatalf("parse mkdir-concurrency: %d %v", opts.mkdirConcurrency, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?mkdir-concurrency=0"); err == nil {
+		t.Fatalf("zero mkdir-concurrency should be invalid")
+	}
+
+	d := newFakeDrive()
+	d.mkdirDelay = time.Millisecond * 10
+	opts := defaultAliyunOptions
+	opts.mkdirConcurrency = 3
+	s := newTestAliyun(t, d, opts)
+	s.putLock = newFairSemaphore(32)
+	var wg sync.WaitGroup
+	errs := make([]error, 32)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.Put(fmt.Sprintf("dir%d/obj", i), strings.NewReader("data"))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("put %d: %s", i, err)
+		}
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.mkdirPeak != 3 {
+		t.Fatalf("expect 3 folders created at the same time at most, but got %d", d.mkdirPeak)
+	}
+}
+
+func TestAliyunSharedPuts(t *testing.T) {
+	d := newFakeDrive()
+	d.moveDelay = time.Millisecond * 100
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	before := d.called("CreateFile")
+	put := func(contents ...string) []error {
+		var wg sync.WaitGroup
+		errs := make([]error, len(contents))
+		for i, c := range contents {
+			wg.Add(1)
+			go func(i int, c string) {
+				defer wg.Done()
+				errs[i] = s.Put("obj", strings.NewReader(c))
+			}(i, c)
+		}
+		wg.Wait()
+		return errs
+	}
+	for _, err := range put("same", "same") {
+		if err != nil {
+			t.Fatalf("put: %s", err)
+		}
+	}
+	if n := d.called("CreateFile") - before; n != 1 {
+		t.Fatalf("the identical Puts should share one upload, but got %d", n)
+	}
+
+	// the different contents are uploaded one by one, the last one wins
+	before = d.called("CreateFile")
+	for _, err := range put("one", "two") {
+		if err != nil {
+			t.Fatalf("put: %s", err)
+		}
+	}
+	if n := d.called("CreateFile") - before; n != 2 {
+		t.Fatalf("the different Puts should be uploaded both, but got %d", n)
+	}
+	if data, err := get(s, "obj", 0, -1); err != nil || data != "one" && data != "two" {
+		t.Fatalf("get after the Puts: %q %v", data, err)
+	}
+	if err := s.PutIfAbsent("obj", strings.NewReader("two")); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("put if absent: %v", err)
+	}
+}
+
+func TestAliyunConcurrentPut(t *testing.T) {
+	d := newFakeDrive()
+	d.moveDelay = time.Millisecond
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	s.putLock = newFairSemaphore(16)
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.Put("obj", strings.NewReader(fmt.Sprintf("data-%d", i)))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("put %d: %s", i, err)
+		}
+	}
+
+	d.Lock()
+	var found []*fakeNode
+	dir := d.lookup("/jfs")
+	for _, n := range d.nodes {
+		if n.ParentId == dir.NodeId && n.Name == "obj" {
+			found = append(found, n)
+		}
+	}
+	temp := 0
+	for _, n := range d.nodes {
+		if n.ParentId == s.tempdirID {
+			temp++
+		}
+	}
+	d.Unlock()
+	if len(found) != 1 || !strings.HasPrefix(string(found[0].data), "data-") || temp != 0 {
+		t.Fatalf("expect a single object and empty temp dir, but got %d objects and %d temp files", len(found), temp)
+	}
+	if got, err := get(s, "obj", 0, -1); err != nil || got != string(found[0].data) {
+		t.Fatalf("get: %q %v, expect %q", got, err, found[0].data)
+	}
+}
+
+func TestAliyunAPICalls(t *testing.T) {
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	base := s.APICalls()
+	_ = s.Put("a/b", strings.NewReader("b"))
+	_ = s.Put("a/b", strings.NewReader("bb"))
+	_, _ = get(s, "a/b", 0, -1)
+	_, _ = s.Head("a/c")
+	ch, _ := s.ListAll("", "")
+	collect(t, ch)
+	_ = s.Delete("a/b")
+
+	calls := s.APICalls()
+	expect := map[string]int64{
+		// the dir created by the first put, and the head
+		"GetByPath":               2,
+		"CreateFolderRecursively": 1,
+		"CreateFile":              2,
+		// the second put moves again after removing the old one
+		"Move":    3,
+		"Remove":  2,
+		"Open":    1,
+		"ListAll": 2,
+	}
+	for api, n := range expect {
+		if calls[api]-base[api] != n {
+			t.Fatalf("expect %d calls of %s, but got %d", n, api, calls[api]-base[api])
+		}
+	}
+	// every call to the drive is counted
+	for api, n := range calls {
+		if int64(d.called(api)) != n {
+			t.Fatalf("%d calls of %s are made, but %d are counted", d.called(api), api, n)
+		}
+	}
+}
+
+func TestAliyunSpace(t *testing.T) {
+	defer func(f func(context.Context, *drive.Config) (drive.Fs, error)) { newAliyunDrive = f }(newAliyunDrive)
+	personal, album := newFakeDrive(), newFakeDrive()
+	// an account with only one of the spaces
+	account := func(isAlbum bool) {
+		newAliyunDrive = func(ctx context.Context, c *drive.Config) (drive.Fs, error) {
+			if c.IsAlbum == isAlbum {
+				if isAlbum {
+					return album, nil
+				}
+				return personal, nil
+			}
+			if c.IsAlbum {
+				return nil, errors.New("failed to get driveId")
+			}
+			// the personal drive of an album account can be opened but not used
+			d := newFakeDrive()
+			d.fail = func(op, nodeID string) error { return errors.New(`got "400": InvalidParameter.DriveId`) }
+			return d, nil
+		}
+	}
+
+	for _, isAlbum := range []bool{false, true} {
+		account(isAlbum)
+		fs, err := openAliyunDrive(&drive.Config{}, "/jfs", "")
+		if err != nil {
+			t.Fatalf("detect the space of %s account: %s", aliyunSpace(isAlbum), err)
+		}
+		if expect := map[bool]drive.Fs{false: personal, true: album}[isAlbum]; fs != expect {
+			t.Fatalf("expect the %s", aliyunSpace(isAlbum))
+		}
+		if fs, err = openAliyunDrive(&drive.Config{}, "/jfs", strconv.FormatBool(isAlbum)); err != nil || fs == nil {
+			t.Fatalf("open the configured %s: %v", aliyunSpace(isAlbum), err)
+		}
+		_, err = openAliyunDrive(&drive.Config{}, "/jfs", strconv.FormatBool(!isAlbum))
+		if hint := fmt.Sprintf("album=%t", isAlbum); err == nil || !strings.Contains(err.Error(), hint) {
+			t.Fatalf("expect an error suggesting %s, but got %v", hint, err)
+		}
+	}
+
+	newAliyunDrive = func(ctx context.Context, c *drive.Config) (drive.Fs, error) {
+		return nil, errors.New("invalid refresh token")
+	}
+	if _, err := openAliyunDrive(&drive.Config{}, "/jfs", ""); err == nil || !strings.Contains(err.Error(), "invalid refresh token") {
+		t.Fatalf("expect the error of opening drive, but got %v", err)
+	}
+}
+
+func TestAliyunFailover(t *testing.T) {
+	if accounts, err := aliyunAccounts("dev", "a, b"); err != nil || len(accounts) != 2 || accounts[1].deviceID != "dev" ||
+		accounts[1].refreshToken != "b" || accounts[1].tokenFile != aliyunTokenFile+".1" {
+		t.Fatalf("accounts: %+v %v", accounts, err)
+	}
+	if _, err := aliyunAccounts("d1,d2", "a,b,c"); err == nil {
+		t.Fatalf("mismatched device ids should be rejected")
+	}
+
+	primary, backup := newFakeDrive(), newFakeDrive()
+	var revoked bool
+	open := func(a aliyunAccount) (drive.Fs, error) {
+		if a.refreshToken == "primary" {
+			if revoked {
+				return nil, statusError(http.StatusUnauthorized)
+			}
+			return primary, nil
+		}
+		return backup, nil
+	}
+	accounts := []aliyunAccount{{refreshToken: "primary"}, {refreshToken: "backup"}}
+	f, err := newFailoverDrive(accounts, open)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	s, err := newAliyunStorage(context.Background(), f, "/jfs", defaultAliyunOptions)
+	if err != nil {
+		t.Fatalf("create storage: %s", err)
+	}
+	if err = s.Put("a", bytes.NewReader([]byte("a"))); err != nil || s.ActiveAccount() != 0 {
+		t.Fatalf("put into the primary: %v, account %d", err, s.ActiveAccount())
+	}
+	if primary.lookup("/jfs/a") == nil {
+		t.Fatalf("a should be in the primary")
+	}
+
+	// forbidden to a file, not to the account
+	primary.fail = func(op, nodeID string) error { return statusError(http.StatusForbidden) }
+	if err = s.Put("c", bytes.NewReader([]byte("c"))); err == nil || s.ActiveAccount() != 0 {
+		t.Fatalf("a 403 should fail on the primary: %v, account %d", err, s.ActiveAccount())
+	}
+	for _, err := range []error{errors.New("InvalidParameter.RefreshToken: revoked"), errors.New("QuotaExhausted.Drive: full")} {
+		if !isAccountFailure(err) {
+			t.Fatalf("%s should fail the account", err)
+		}
+	}
+	primary.fail = nil
+
+	// the token is revoked
+	revoked = true
+	primary.fail = func(op, nodeID string) error { return statusError(http.StatusUnauthorized) }
+	if err = s.Put("b", bytes.NewReader([]byte("b"))); err != nil {
+		t.Fatalf("put via the backup: %s", err)
+	}
+	if s.ActiveAccount() != 1 {
+		t.Fatalf("expect the backup account active, but got %d", s.ActiveAccount())
+	}
+	if backup.lookup("/jfs/b") == nil {
+		t.Fatalf("b should be in the backup")
+	}
+	if d, err := get(s, "b", 0, -1); err != nil || d != "b" {
+		t.Fatalf("get b: %q %v", d, err)
+	}
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if keys := collect(t, ch); strings.Join(keys, ",") != "b" {
+		t.Fatalf("expect the objects of the backup, but got %v", keys)
+	}
+	if err = s.Delete("b"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+
+	// the primary is not usable at start
+	f, err = newFailoverDrive(accounts, open)
+	if err != nil || f.Active() != 1 {
+		t.Fatalf("expect the backup at start, but got %v", err)
+	}
+	if _, err = newFailoverDrive(accounts[:1], open); err == nil {
+		t.Fatalf("no account should be usable")
+	}
+}
+
+func TestAliyunTransport(t *testing.T) {
+	defer func(f func(context.Context, *drive.Config) (drive.Fs, error)) { newAliyunDrive = f }(newAliyunDrive)
+	var config *drive.Config
+	newAliyunDrive = func(ctx context.Context, c *drive.Config) (drive.Fs, error) {
+		config = c
+		return newFakeDrive(), nil
+	}
+	transport := func(endpoint string) *http.Transport {
+		if _, err := newAliyun(endpoint, "device", "token", ""); err != nil {
+			t.Fatalf("create aliyun %s: %s", endpoint, err)
+		}
+		return config.HttpClient.Transport.(*rangeChecker).RoundTripper.(*tokenRetrier).RoundTripper.(*requestIDTagger).RoundTripper.(*responseLimiter).RoundTripper.(*userAgentSetter).RoundTripper.(*idleReaper).Transport
+	}
+
+	tr := transport("/jfs")
+	if tr.MaxIdleConnsPerHost != 16 || !tr.ForceAttemptHTTP2 || tr.TLSNextProto != nil {
+		t.Fatalf("default transport: %d idle conns, http2 %v", tr.MaxIdleConnsPerHost, tr.ForceAttemptHTTP2)
+	}
+	tr = transport("/jfs?max-idle-conns=64&http2=false&keep-alive=10s")
+	if tr.MaxIdleConnsPerHost != 64 || tr.MaxIdleConns < 64 || tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+		t.Fatalf("tuned transport: %d idle conns, http2 %v", tr.MaxIdleConnsPerHost, tr.ForceAttemptHTTP2)
+	}
+	if tr == http.DefaultTransport {
+		t.Fatalf("the default transport should not be modified")
+	}
+	if _, opts, err := parseAliyunEndpoint("/jfs?keep-alive=10s"); err != nil || opts.keepAlive != 10*time.Second {
+		t.Fatalf("parse keep-alive: %+v %v", opts, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?http2=maybe"); err == nil {
+		t.Fatalf("invalid http2 should be rejected")
+	}
+}
+
+func TestAliyunGetBounds(t *testing.T) {
+	d := newFakeDrive()
+	d.write("/jfs/obj", []byte("0123456789"))
+	d.write("/jfs/empty", nil)
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+
+	if _, err := s.Get("obj", -1, 2); err == nil || !strings.Contains(err.Error(), "invalid offset") {
+		t.Fatalf("expect invalid offset, but got %v", err)
+	}
+	var re *rangeError
+	if _, err := s.Get("obj", 11, -1); !errors.As(err, &re) || re.size != 10 {
+		t.Fatalf("expect unsatisfiable range, but got %v", err)
+	}
+	if _, err := s.Get("obj", 20, 5); !errors.As(err, &re) {
+		t.Fatalf("expect unsatisfiable range, but got %v", err)
+	}
+	for _, c := range []struct {
+		key         string
+		off, length int64
+		expected    string
+	}{
+		{"obj", 10, -1, ""},
+		{"obj", 10, 4, ""},
+		{"obj", 8, 4, "89"},
+		{"obj", 9, 1, "9"},
+		{"empty", 0, -1, ""},
+	} {
+		if got, err := get(s, c.key, c.off, c.length); err != nil || got != c.expected {
+			t.Fatalf("get %s %d-%d: expect %q, but got %q: %v", c.key, c.off, c.length, c.expected, got, err)
+		}
+	}
+}
+
+// redirectTransport sends all the requests to a test server.
+type redirectTransport struct {
+	url *url.URL
+}
+
+func (r *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = r.url.Scheme, r.url.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestAliyunHeaders(t *testing.T) {
+	_, opts, err := parseAliyunEndpoint("/jfs?header=X-Debug:1&header=X-Beta:no&header.Open=X-Beta:yes&header.ListAll=X-Region:%20cn-hz")
+	if err != nil {
+		t.Fatalf("parse headers: %s", err)
+	}
+	if opts.headers[""].Get("X-Debug") != "1" || opts.headers["Open"].Get("X-Beta") != "yes" || opts.headers["ListAll"].Get("X-Region") != "cn-hz" {
+		t.Fatalf("unexpected headers: %v", opts.headers)
+	}
+	for _, e := range []string{"/jfs?header.Get=X-A:1", "/jfs?header=X-A", "/jfs?header=:1"} {
+		if _, _, err = parseAliyunEndpoint(e); err == nil {
+			t.Fatalf("%s should be invalid", e)
+		}
+	}
+
+	d := newFakeDrive()
+	d.write("/jfs/obj", []byte("0123456789"))
+	s := newTestAliyun(t, d, opts)
+	if data, err := get(s, "obj", 2, 3); err != nil || data != "234" {
+		t.Fatalf("get: %q %v", data, err)
+	}
+	if h := d.openHeaders; h["Range"] != "bytes=2-4" || h["X-Debug"] != "1" || h["X-Beta"] != "yes" {
+		t.Fatalf("the headers should be merged with the range: %v", h)
+	}
+
+	var mu sync.Mutex
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = r.Header.Clone()
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	client := aliyunConfig("device", "token", filepath.Join(t.TempDir(), "token"), opts).HttpClient
+	counter := newCountingDrive(nil)
+	send := func(api string, header http.Header) http.Header {
+		req, _ := http.NewRequestWithContext(counter.call(context.Background(), api), http.MethodPost, srv.URL, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request: %s", err)
+		}
+		resp.Body.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+	if h := send("ListAll", nil); h.Get("X-Region") != "cn-hz" || h.Get("X-Debug") != "1" || h.Get("X-Beta") != "no" {
+		t.Fatalf("headers of ListAll: %v", h)
+	}
+	if h := send("Remove", http.Header{"X-Debug": {"2"}}); h.Get("X-Region") != "" || h.Get("X-Debug") != "2" {
+		t.Fatalf("headers of Remove: %v", h)
+	}
+}
+
+func TestAliyunVerifyMove(t *testing.T) {
+	_, opts, err := parseAliyunEndpoint("/jfs?verify-move=true")
+	if err != nil || !opts.verifyMove {
+		t.Fatalf("parse verify-move: %+v %v", opts, err)
+	}
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, opts)
+	if err = s.Put("good", strings.NewReader("content")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	for name, broken := range map[string]func(n *fakeNode){
+		// left in the temp dir
+		"misplaced": func(n *fakeNode) { n.ParentId = s.tempdirID },
+		"truncated": func(n *fakeNode) { n.data = n.data[:3]; n.Size = 3 },
+		"corrupted": func(n *fakeNode) { n.data = []byte("CONTENT"); n.Hash = fmt.Sprintf("%X", sha1.Sum(n.data)) },
+	} {
+		d.badMove = broken
+		err = s.Put(name, bytes.NewReader([]byte("content")))
+		d.badMove = nil
+		if err == nil || !strings.Contains(err.Error(), "verify after move") {
+			t.Fatalf("the %s file should be caught: %v", name, err)
+		}
+		if _, err = s.Head(name); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("the %s file should be removed: %v", name, err)
+		}
+	}
+	d.Lock()
+	for _, n := range d.nodes {
+		if n.ParentId == s.tempdirID {
+			t.Fatalf("no temp file should be left: %s", n.Name)
+		}
+	}
+	d.Unlock()
+	if data, err := get(s, "good", 0, -1); err != nil || data != "content" {
+		t.Fatalf("get good: %q %v", data, err)
+	}
+}
+
+func TestAliyunTokenRefresh(t *testing.T) {
+	var mu sync.Mutex
+	var failures, refreshes int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/v2/account/token":
+			refreshes++
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			var req map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"access_token": "access", "expires_in": 7200, "refresh_token": req["refresh_token"] + "+"})
+		case strings.HasSuffix(r.URL.Path, "/create_session"):
+			writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+		default:
+			writeJSON(w, http.StatusOK, map[string]string{"default_drive_id": "drive1", "user_id": "user1"})
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	tokenFile := filepath.Join(t.TempDir(), aliyunTokenFile)
+	if err := os.WriteFile(tokenFile, []byte("old"), 0600); err != nil {
+		t.Fatalf("write token: %s", err)
+	}
+	connect := func(retries int) error {
+		opts := defaultAliyunOptions
+		opts.tokenRetries = retries
+		config := aliyunConfig("device", "old", tokenFile, opts)
+		tr := config.HttpClient.Transport.(*rangeChecker).RoundTripper.(*tokenRetrier)
+		tr.RoundTripper, tr.backoff = &redirectTransport{u}, time.Millisecond
+		_, err := drive.NewFs(context.Background(), config)
+		return err
+	}
+
+	// all the refreshes failed
+	failures = 10
+	if err := connect(2); err == nil {
+		t.Fatalf("the refresh should fail")
+	}
+	if refreshes != 3 {
+		t.Fatalf("expect 3 attempts, but got %d", refreshes)
+	}
+	if data, _ := os.ReadFile(tokenFile); string(data) != "old" {
+		t.Fatalf("the token file should be intact after a failed refresh: %q", data)
+	}
+
+	// the first attempt fails
+	failures, refreshes = 1, 0
+	if err := connect(2); err != nil {
+		t.Fatalf("the refresh should succeed after retry: %s", err)
+	}
+	if refreshes != 2 {
+		t.Fatalf("expect 2 attempts, but got %d", refreshes)
+	}
+	if data, _ := os.ReadFile(tokenFile); string(data) != "old+" {
+		t.Fatalf("the new token should be saved: %q", data)
+	}
+
+	if err := saveRefreshToken(tokenFile, ""); err == nil {
+		t.Fatalf("empty token should not be saved")
+	}
+	if data, _ := os.ReadFile(tokenFile); string(data) != "old+" {
+		t.Fatalf("the token file is corrupted: %q", data)
+	}
+}
+
+func TestAliyunTokenExpired(t *testing.T) {
+	var mu sync.Mutex
+	var refreshes, calls int
+	access := "access1"
+	var refreshed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/v2/account/token" {
+			refreshes++
+			var req map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			refreshed = append(refreshed, req["refresh_token"])
+			access = fmt.Sprintf("access%d", refreshes+1)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"access_token": access, "expires_in": 7200, "refresh_token": req["refresh_token"] + "+"})
+			return
+		}
+		calls++
+		data, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer "+access {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"code": "AccessTokenExpired", "message": "expired"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"got": string(data)})
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	tokenFile := filepath.Join(t.TempDir(), aliyunTokenFile)
+	config := aliyunConfig("device", "old", tokenFile, defaultAliyunOptions)
+	tr := config.HttpClient.Transport.(*rangeChecker).RoundTripper.(*tokenRetrier)
+	tr.RoundTripper, tr.backoff = &redirectTransport{u}, time.Millisecond
+	call := func(token string, body io.Reader) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "https://api.aliyundrive.com/v2/file/get", body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := config.HttpClient.Do(req)
+		if err != nil {
+			t.Fatalf("call: %s", err)
+		}
+		defer resp.Body.Close()
+		var r map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&r)
+		return resp.StatusCode, r["got"]
+	}
+
+	// expired before the drive knows, it's refreshed and the call is sent again
+	access = "revoked"
+	if code, got := call("access1", strings.NewReader("body")); code != http.StatusOK || got != "body" {
+		t.Fatalf("call with an expired token: %d %q", code, got)
+	}
+	if refreshes != 1 || calls != 2 {
+		t.Fatalf("expect 1 refresh and 2 calls, but got %d and %d", refreshes, calls)
+	}
+	if data, _ := os.ReadFile(tokenFile); string(data) != "old+" {
+		t.Fatalf("the new token should be saved: %q", data)
+	}
+
+	// the calls with the stale token of the drive use the new one, they are
+	// refreshed once when it expires again
+	calls = 0
+	if code, _ := call("access1", nil); code != http.StatusOK || calls != 1 {
+		t.Fatalf("call with the stale token: %d, %d calls", code, calls)
+	}
+	access = "revoked"
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, _ := call("access1", strings.NewReader("body")); code != http.StatusOK {
+				t.Errorf("concurrent call: %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshes != 2 {
+		t.Fatalf("expect 1 more refresh for the concurrent calls, but got %d", refreshes-1)
+	}
+
+	// the refresh of the drive uses the latest refresh token
+	req, _ := http.NewRequest(http.MethodPost, "https://auth.aliyundrive.com/v2/account/token",
+		strings.NewReader(`{"refresh_token":"old","grant_type":"refresh_token"}`))
+	resp, err := config.HttpClient.Do(req)
+	if err != nil {
+		t.Fatalf("refresh: %s", err)
+	}
+	_ = resp.Body.Close()
+	if refreshed[2] != "old++" || tr.refresh != "old+++" || tr.access != access {
+		t.Fatalf("refreshed with %q, latest %q %q", refreshed, tr.refresh, tr.access)
+	}
+
+	// a body read by the failed call can't be sent again
+	access, refreshes, calls = "revoked", 0, 0
+	code, _ := call(tr.access, io.MultiReader(strings.NewReader("streaming")))
+	if code != http.StatusUnauthorized || calls != 1 || refreshes != 1 {
+		t.Fatalf("call with a consumed body: %d, %d calls", code, calls)
+	}
+}
+
+func TestAliyunIdleTimeout(t *testing.T) {
+	type connKey struct{}
+	var mu sync.Mutex
+	var conns, dropBefore int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		drop := r.Context().Value(connKey{}).(int) < dropBefore
+		mu.Unlock()
+		if drop {
+			// dropped by the drive while idle, without noticing the client
+			c, _, _ := w.(http.Hijacker).Hijack()
+			_ = c.Close()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		mu.Lock()
+		defer mu.Unlock()
+		conns++
+		return context.WithValue(ctx, connKey{}, conns)
+	}
+	srv.Start()
+	defer srv.Close()
+
+	if _, opts, err := parseAliyunEndpoint("/jfs?idle-timeout=1m"); err != nil || opts.idleTimeout != time.Minute {
+		t.Fatalf("parse idle-timeout: %v %v", opts.idleTimeout, err)
+	}
+	opts := defaultAliyunOptions
+	opts.idleTimeout = time.Minute
+	tr := aliyunTransport(opts)
+	if tr.IdleConnTimeout != time.Minute {
+		t.Fatalf("idle timeout of the transport: %s", tr.IdleConnTimeout)
+	}
+	clock := NewFakeClock(time.Now())
+	client := &http.Client{Transport: &idleReaper{Transport: tr, timeout: time.Minute, clock: clock}}
+	post := func() error {
+		resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("body"))
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	if err := post(); err != nil {
+		t.Fatalf("post: %s", err)
+	}
+	// a stale connection fails the request
+	mu.Lock()
+	dropBefore = 2
+	mu.Unlock()
+	if err := post(); err == nil {
+		t.Fatalf("the request over a stale connection should fail")
+	}
+	if err := post(); err != nil {
+		t.Fatalf("post: %s", err)
+	}
+
+	// it's closed after idle for longer than the timeout
+	mu.Lock()
+	dropBefore = 3
+	mu.Unlock()
+	clock.Advance(2 * time.Minute)
+	if err := post(); err != nil {
+		t.Fatalf("post after idle: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 3 {
+		t.Fatalf("expect 3 connections, but got %d", conns)
+	}
+	if newIdleReaper(tr, 0) != tr {
+		t.Fatalf("no reaper without idle timeout")
+	}
+}
+
+// idDrive records the request ids of the calls.
+type idDrive struct {
+	*fakeDrive
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (d *idDrive) GetByPath(ctx context.Context, fullPath string, kind string) (*drive.Node, error) {
+	d.mu.Lock()
+	d.ids[RequestID(ctx)] = true
+	d.mu.Unlock()
+	return d.fakeDrive.GetByPath(ctx, fullPath, kind)
+}
+
+func TestAliyunRequestID(t *testing.T) {
+	d := &idDrive{fakeDrive: newFakeDrive(), ids: make(map[string]bool)}
+	s, err := newAliyunStorage(context.Background(), d, "/jfs", defaultAliyunOptions)
+	if err != nil {
+		t.Fatalf("create aliyun storage: %s", err)
+	}
+	d.ids = make(map[string]bool)
+	v := WithContext(s, WithRequestID(context.Background(), "req-1"))
+	if err = v.Put("a", strings.NewReader("data")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if got, err := get(v, "a", 0, -1); err != nil || got != "data" {
+		t.Fatalf("get: %q %v", got, err)
+	}
+	_, err = v.Head("missing")
+	if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "request id req-1") {
+		t.Fatalf("the error should have the request id: %v", err)
+	}
+	if len(d.ids) != 1 || !d.ids["req-1"] {
+		t.Fatalf("the calls should be in the context: %v", d.ids)
+	}
+	// the storage itself is not changed
+	if _, err = s.Head("missing"); !errors.Is(err, os.ErrNotExist) || strings.Contains(err.Error(), "request id") {
+		t.Fatalf("the error of the storage: %v", err)
+	}
+	if !d.ids[""] {
+		t.Fatalf("the calls of the storage should not have a request id")
+	}
+
+	// the header of the requests
+	ids := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get(RequestIDHeader)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	config := aliyunConfig("device", "token", filepath.Join(t.TempDir(), aliyunTokenFile), defaultAliyunOptions)
+	tr := config.HttpClient.Transport.(*rangeChecker).RoundTripper.(*tokenRetrier).RoundTripper.(*requestIDTagger)
+	tr.RoundTripper = &redirectTransport{u}
+	for _, id := range []string{"req-2", ""} {
+		req, _ := http.NewRequestWithContext(WithRequestID(context.Background(), id), http.MethodGet, "https://api.aliyundrive.com/v2/file/get", nil)
+		resp, err := config.HttpClient.Do(req)
+		if err != nil {
+			t.Fatalf("request: %s", err)
+		}
+		_ = resp.Body.Close()
+		if got := <-ids; got != id {
+			t.Fatalf("request id in the header: %q, expect %q", got, id)
+		}
+	}
+}
+
+func TestAliyunUserAgent(t *testing.T) {
+	agents := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	for query, expected := range map[string]string{"": UserAgent, "?user-agent=custom/1.0": "custom/1.0"} {
+		_, opts, err := parseAliyunEndpoint("/jfs" + query)
+		if err != nil {
+			t.Fatalf("parse %q: %s", query, err)
+		}
+		config := aliyunConfig("device", "token", filepath.Join(t.TempDir(), aliyunTokenFile), opts)
+		tr := config.HttpClient.Transport.(*rangeChecker).RoundTripper.(*tokenRetrier).RoundTripper.(*requestIDTagger).RoundTripper.(*responseLimiter).RoundTripper.(*userAgentSetter)
+		tr.RoundTripper = &redirectTransport{u}
+		req, _ := http.NewRequest(http.MethodGet, "https://api.aliyundrive.com/v2/file/get", nil)
+		resp, err := config.HttpClient.Do(req)
+		if err != nil {
+			t.Fatalf("request: %s", err)
+		}
+		_ = resp.Body.Close()
+		if got := <-agents; got != expected {
+			t.Fatalf("user agent of %q: %q, expect %q", query, got, expected)
+		}
+	}
+}
+
+func TestAliyunSwap(t *testing.T) {
+	d := newFakeDrive()
+	opts := defaultAliyunOptions
+	// not a buffer of 1 MiB for every Get of the readers below, the garbage
+	// keeps a single CPU so busy that the swaps hardly run
+	opts.readBuffer = 0
+	s := newTestAliyun(t, d, opts)
+	da, db := strings.Repeat("a", 100), strings.Repeat("b", 200)
+	_ = s.Put("dir/a", strings.NewReader(da))
+	_ = s.Put("b", strings.NewReader(db))
+	if err := Swap(s, "dir/a", "b"); err != nil {
+		t.Fatalf("swap: %s", err)
+	}
+	if got, err := get(s, "dir/a", 0, -1); err != nil || got != db {
+		t.Fatalf("dir/a after swap: %d bytes, %v", len(got), err)
+	}
+	if got, err := get(s, "b", 0, -1); err != nil || got != da {
+		t.Fatalf("b after swap: %d bytes, %v", len(got), err)
+	}
+	if o, err := s.Head("b"); err != nil || o.Size() != 100 {
+		t.Fatalf("head b: %+v %v", o, err)
+	}
+	if objs, err := s.List("", "", 10); err != nil || len(objs) != 2 {
+		t.Fatalf("list after swap: %+v %v", objs, err)
+	}
+	if err := Swap(s, "b", "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("swap with missing: %v", err)
+	}
+	if got, err := get(s, "b", 0, -1); err != nil || got != da {
+		t.Fatalf("b after failed swap: %d bytes, %v", len(got), err)
+	}
+
+	// the readers see either of the contents, never a missing or mixed one
+	d.moveDelay = time.Millisecond
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				got, err := get(s, key, 0, -1)
+				if err != nil || got != da && got != db {
+					t.Errorf("get %s in the middle of swap: %d bytes, %v", key, len(got), err)
+					return
+				}
+				if _, err = s.Head(key); err != nil {
+					t.Errorf("head %s in the middle of swap: %v", key, err)
+					return
+				}
+			}
+		}([]string{"dir/a", "b"}[i%2])
+	}
+	for i := 0; i < 10; i++ {
+		if err := s.Swap("dir/a", "b"); err != nil {
+			t.Fatalf("swap %d: %s", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if got, err := get(s, "dir/a", 0, -1); err != nil || got != db {
+		t.Fatalf("dir/a after even swaps: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestAliyunDirMarkers(t *testing.T) {
+	d := newFakeDrive()
+	opts := defaultAliyunOptions
+	opts.fanout = 4
+	s := newTestAliyun(t, d, opts)
+	for _, k := range []string{"dir/", "dir/a", "dir/sub/", "other/b"} {
+		if err := s.Put(k, bytes.NewReader(nil)); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	if d.lookup("/jfs/dir/"+aliyunDirMarker) == nil {
+		t.Fatalf("the marker of dir/ should be a file in the folder")
+	}
+	if got, err := get(s, "dir/", 0, -1); err != nil || got != "" {
+		t.Fatalf("get dir/: %q %v", got, err)
+	}
+	if o, err := s.Head("dir/"); err != nil || !o.IsDir() || o.Size() != 0 {
+		t.Fatalf("head dir/: %+v %v", o, err)
+	}
+	// other/ is a folder without a marker
+	if _, err := s.Head("other/"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head other/: %v", err)
+	}
+	objs, err := s.List("", "", 10)
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	var keys []string
+	for _, o := range objs {
+		if o.IsDir() != strings.HasSuffix(o.Key(), "/") {
+			t.Fatalf("%s is dir: %v", o.Key(), o.IsDir())
+		}
+		keys = append(keys, o.Key())
+	}
+	if strings.Join(keys, ",") != "dir/,dir/a,dir/sub/,other/b" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if objs, _ = s.List("dir/", "dir/", 10); len(objs) != 2 || objs[0].Key() != "dir/a" {
+		t.Fatalf("list after dir/: %+v", objs)
+	}
+	if err = s.Delete("dir/"); err != nil {
+		t.Fatalf("delete dir/: %s", err)
+	}
+	if _, err = s.Head("dir/"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head dir/ after deleted: %v", err)
+	}
+	if _, err = s.Head("dir/a"); err != nil {
+		t.Fatalf("dir/a should be kept: %s", err)
+	}
+	if err = s.Put("dir/"+aliyunDirMarker, bytes.NewReader(nil)); err == nil {
+		t.Fatalf("the name of markers should be reserved")
+	}
+
+	opts.dirMarkers = "reject"
+	s = newTestAliyun(t, d, opts)
+	if err = s.Put("new/", bytes.NewReader(nil)); err == nil || !strings.Contains(err.Error(), "dir-markers") {
+		t.Fatalf("put new/ should be rejected: %v", err)
+	}
+	if _, err = s.Get("dir/sub/", 0, -1); err == nil {
+		t.Fatalf("get dir/sub/ should be rejected")
+	}
+	if _, _, err = parseAliyunEndpoint("/jfs?dir-markers=keep"); err == nil {
+		t.Fatalf("invalid dir-markers should be rejected")
+	}
+}
+
+func TestAliyunVisibleTimeout(t *testing.T) {
+	if _, opts, err := parseAliyunEndpoint("/jfs?visible-timeout=3s"); err != nil || opts.visibleTimeout != 3*time.Second {
+		t.Fatalf("parse visible-timeout: %s %v", opts.visibleTimeout, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?visible-timeout=-1s"); err == nil {
+		t.Fatalf("negative visible-timeout should be invalid")
+	}
+
+	d := newFakeDrive()
+	d.indexDelay = time.Millisecond * 200
+	opts := defaultAliyunOptions
+	opts.keepTemp = true
+	reader := newTestAliyun(t, d, opts)
+	writer := newTestAliyun(t, d, opts)
+	if err := writer.Put("a", strings.NewReader("a")); err != nil {
+		t.Fatalf("put a: %s", err)
+	}
+	if _, err := get(reader, "a", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a should not be visible to others yet: %v", err)
+	}
+
+	opts.visibleTimeout = time.Second
+	writer = newTestAliyun(t, d, opts)
+	start := time.Now()
+	if err := writer.Put("b", strings.NewReader("b")); err != nil {
+		t.Fatalf("put b: %s", err)
+	}
+	if used := time.Since(start); used < d.indexDelay {
+		t.Fatalf("put b returned in %s before it's visible", used)
+	}
+	if data, err := get(reader, "b", 0, -1); err != nil || data != "b" {
+		t.Fatalf("get b after put: %q %v", data, err)
+	}
+
+	d.indexDelay = time.Second * 5
+	if err := writer.Put("c", strings.NewReader("c")); err == nil || !strings.Contains(err.Error(), "not visible") {
+		t.Fatalf("put c should time out: %v", err)
+	}
+}
+
+func TestAliyunMaxDepth(t *testing.T) {
+	if _, opts, err := parseAliyunEndpoint("/jfs"); err != nil || opts.maxDepth != defaultTreeDepth {
+		t.Fatalf("default max-depth: %d %v", opts.maxDepth, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?max-depth=-1"); err == nil {
+		t.Fatalf("negative max-depth should be invalid")
+	}
+
+	d := newFakeDrive()
+	opts := defaultAliyunOptions
+	opts.maxDepth = 3
+	s := newTestAliyun(t, d, opts)
+	for _, key := range []string{"a/b/x", "a/b/c/d/e/f/g", "z"} {
+		if err := s.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	var keys []string
+	var failed bool
+	for o := range ch {
+		if o == nil {
+			failed = true
+			continue
+		}
+		keys = append(keys, o.Key())
+	}
+	if !failed {
+		t.Fatalf("the walk should fail beyond the max depth, but got %v", keys)
+	}
+	if _, _, err = StatPrefix(context.Background(), s, "", nil); err == nil {
+		t.Fatalf("stat should fail beyond the max depth")
+	}
+
+	// skipped by the tolerant walk, as the directories failed
+	var skipped []string
+	ch, err = s.ListAllTolerant("", "", func(dir string, err error) {
+		if errors.Is(err, errTooDeep) {
+			skipped = append(skipped, dir)
+		}
+	})
+	if err != nil {
+		t.Fatalf("list all tolerant: %s", err)
+	}
+	keys = collect(t, ch)
+	if !reflect.DeepEqual(keys, []string{"a/b/x", "z"}) || !reflect.DeepEqual(skipped, []string{"a/b/c/d/"}) {
+		t.Fatalf("tolerant walk: %v, skipped %v", keys, skipped)
+	}
+
+	opts.maxDepth = 0
+	s = newTestAliyun(t, d, opts)
+	if count, _, err := StatPrefix(context.Background(), s, "", nil); err != nil || count != 3 {
+		t.Fatalf("stat without limit: %d %v", count, err)
+	}
+}
+
+func TestAliyunListDirs(t *testing.T) {
+	d := newFakeDrive()
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	for _, k := range []string{"a/b/c/1", "a/b/2", "a/3", "e/", "f"} {
+		if err := s.Put(k, bytes.NewReader([]byte(k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	list := func(s ObjectStorage, prefix, marker string) string {
+		ch, err := s.ListAll(prefix, marker)
+		if err != nil {
+			t.Fatalf("list all: %s", err)
+		}
+		var keys []string
+		for o := range ch {
+			if o == nil {
+				t.Fatalf("list failed")
+			}
+			if o.IsDir() != strings.HasSuffix(o.Key(), "/") || o.IsDir() && o.Size() != 0 {
+				t.Fatalf("%s is dir: %v, size %d", o.Key(), o.IsDir(), o.Size())
+			}
+			keys = append(keys, o.Key())
+		}
+		return strings.Join(keys, ",")
+	}
+	// the keys ending with `/` are always listed
+	if keys := list(s, "", ""); keys != "a/3,a/b/2,a/b/c/1,e/,f" {
+		t.Fatalf("files only: %s", keys)
+	}
+
+	opts := defaultAliyunOptions
+	opts.listDirs = true
+	s = newTestAliyun(t, d, opts)
+	if keys := list(s, "", ""); keys != "a/,a/3,a/b/,a/b/2,a/b/c/,a/b/c/1,e/,f" {
+		t.Fatalf("with dirs: %s", keys)
+	}
+	if keys := list(s, "a/b", "a/b/"); keys != "a/b/2,a/b/c/,a/b/c/1" {
+		t.Fatalf("with dirs after a/b/: %s", keys)
+	}
+	if objs, err := s.List("a/", "", 2); err != nil || len(objs) != 2 || objs[0].Key() != "a/" || objs[1].Key() != "a/3" {
+		t.Fatalf("list with dirs: %v %v", objs, err)
+	}
+	if _, opts, err := parseAliyunEndpoint("/jfs?list-dirs=true"); err != nil || !opts.listDirs {
+		t.Fatalf("parse list-dirs: %v", err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?list-dirs=maybe"); err == nil {
+		t.Fatalf("invalid list-dirs should be rejected")
+	}
+}
+
+func TestAliyunMaxRPS(t *testing.T) {
+	_, opts, err := parseAliyunEndpoint("/jfs?max-rps=100&rps-burst=5")
+	if err != nil || opts.maxRPS != 100 || opts.rpsBurst != 5 {
+		t.Fatalf("parse max-rps: %+v %v", opts, err)
+	}
+	if _, _, err = parseAliyunEndpoint("/jfs?rps-burst=0"); err == nil {
+		t.Fatalf("zero rps-burst should be invalid")
+	}
+	d := newFakeDrive()
+	d.write("/jfs/obj", []byte("hello"))
+	s := newTestAliyun(t, d, opts)
+
+	// a burst of small calls from a few threads is paced to 100 per second
+	const heads = 55
+	before := d.called("GetByPath")
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < heads; j += 8 {
+				if _, err := s.Head("obj"); err != nil {
+					t.Errorf("head: %s", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if n := d.called("GetByPath") - before; n != heads {
+		t.Fatalf("expect %d calls, but got %d", heads, n)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expect %d calls paced to about 500ms, but took %s", heads, elapsed)
+	}
+}
+
+func TestAliyunConcurrentKey(t *testing.T) {
+	d := newFakeDrive()
+	// the calls interleave more
+	d.moveDelay = 100 * time.Microsecond
+	s := newTestAliyun(t, d, defaultAliyunOptions)
+	testConcurrentKey(t, s, 16, 100)
+}
+
+func TestAliyunBothSpaces(t *testing.T) {
+	if _, opts, err := parseAliyunEndpoint("/jfs?both-spaces=true&album=true"); err != nil || !opts.bothSpaces || opts.album != "true" {
+		t.Fatalf("parse both-spaces: %+v %v", opts, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?both-spaces=maybe"); err == nil {
+		t.Fatalf("invalid both-spaces should fail")
+	}
+	if _, opts, err := parseAliyunEndpoint("/jfs?pool-accounts=true"); err != nil || !opts.poolAccounts {
+		t.Fatalf("parse pool-accounts: %+v %v", opts, err)
+	}
+	if _, opts, err := parseAliyunEndpoint("/jfs?inline-read-size=65536"); err != nil || opts.inlineReadSize != 65536 {
+		t.Fatalf("parse inline-read-size: %+v %v", opts, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?inline-read-size=-1"); err == nil {
+		t.Fatalf("negative inline-read-size should fail")
+	}
+	if _, opts, err := parseAliyunEndpoint("/jfs?metadata-sidecar=true"); err != nil || !opts.metadataSidecar {
+		t.Fatalf("parse metadata-sidecar: %+v %v", opts, err)
+	}
+
+	personal := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	album := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	_ = personal.Put("docs/a", strings.NewReader("personal a"))
+	_ = personal.Put("shared", strings.NewReader("personal shared"))
+	_ = album.Put("photos/b", strings.NewReader("album b"))
+	_ = album.Put("shared", strings.NewReader("album shared"))
+	s := newAliyunSpaces(album, personal, aliyunSpace(false))
+
+	// a key is found in either space, the one to write first
+	for key, expected := range map[string]string{"docs/a": "personal a", "photos/b": "album b", "shared": "album shared"} {
+		if d, err := get(s, key, 0, -1); err != nil || d != expected {
+			t.Fatalf("get %s: %q %v", key, d, err)
+		}
+		if o, err := s.Head(key); err != nil || o.Size() != int64(len(expected)) {
+			t.Fatalf("head %s: %+v %v", key, o, err)
+		}
+	}
+	if _, err := s.Get("missing", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get missing: %v", err)
+	}
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if keys := collect(t, ch); strings.Join(keys, ",") != "docs/a,photos/b,shared" {
+		t.Fatalf("merged listing: %v", keys)
+	}
+	if objs, err := s.List("", "docs/a", 1); err != nil || len(objs) != 1 || objs[0].Key() != "photos/b" {
+		t.Fatalf("list: %+v %v", objs, err)
+	}
+
+	// the writes go to the configured space
+	if err := s.Put("docs/c", strings.NewReader("new")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if _, err := album.Head("docs/c"); err != nil {
+		t.Fatalf("docs/c should be put into the album: %s", err)
+	}
+	if _, err := personal.Head("docs/c"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("docs/c should not be in the personal drive: %v", err)
+	}
+	if err := s.Delete("shared"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := s.Head("shared"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("shared should be deleted from both spaces: %v", err)
+	}
+}
+
+func TestAliyunPool(t *testing.T) {
+	full, empty := newFakeDrive(), newFakeDrive()
+	full.quota, empty.quota = 100, 100
+	a, b := newTestAliyun(t, full, defaultAliyunOptions), newTestAliyun(t, empty, defaultAliyunOptions)
+	if err := a.Put("old", strings.NewReader(strings.Repeat("x", 80))); err != nil {
+		t.Fatalf("put old: %s", err)
+	}
+	if l, err := a.Limits(); err != nil || l.Used != 80 || l.Total != 100 {
+		t.Fatalf("limits: %+v %v", l, err)
+	}
+
+	clock := NewFakeClock(time.Now())
+	p := newPool([]ObjectStorage{a, b}, clock)
+	// the writes prefer the emptier account
+	for _, key := range []string{"a", "b"} {
+		if err := p.Put(key, strings.NewReader(strings.Repeat("y", 40))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+		if _, err := b.Head(key); err != nil {
+			t.Fatalf("%s should be in the emptier account: %s", key, err)
+		}
+	}
+	// estimated by the bytes written: 20 bytes free in both
+	if err := p.Put("c", strings.NewReader("z")); err != nil {
+		t.Fatalf("put c: %s", err)
+	}
+	if _, err := a.Head("c"); err != nil {
+		t.Fatalf("c should be in the first account: %s", err)
+	}
+	// the limits are queried again later
+	if err := b.Delete("a"); err != nil {
+		t.Fatalf("delete a: %s", err)
+	}
+	clock.Advance(poolRefresh)
+	if err := p.Put("d", strings.NewReader("z")); err != nil {
+		t.Fatalf("put d: %s", err)
+	}
+	if _, err := b.Head("d"); err != nil {
+		t.Fatalf("d should be in the emptier account: %s", err)
+	}
+	// overwritten in place
+	if err := p.Put("old", strings.NewReader("new")); err != nil {
+		t.Fatalf("overwrite old: %s", err)
+	}
+	if _, err := b.Head("old"); err == nil {
+		t.Fatalf("old should not be written into the second account")
+	}
+
+	// any key is found across the accounts, even by another pool
+	p2 := NewPool([]ObjectStorage{a, b})
+	for key, data := range map[string]string{"old": "new", "b": strings.Repeat("y", 40), "c": "z", "d": "z"} {
+		if d, err := get(p2, key, 0, -1); err != nil || d != data {
+			t.Fatalf("get %s: %q %v", key, d, err)
+		}
+		if o, err := p2.Head(key); err != nil || o.Size() != int64(len(data)) {
+			t.Fatalf("head %s: %+v %v", key, o, err)
+		}
+	}
+	if _, err := p2.Head("a"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a should be deleted: %v", err)
+	}
+	ch, err := p2.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if keys := collect(t, ch); strings.Join(keys, ",") != "b,c,d,old" {
+		t.Fatalf("listed keys: %v", keys)
+	}
+	for _, key := range []string{"b", "c", "d", "old"} {
+		if err := p2.Delete(key); err != nil {
+			t.Fatalf("delete %s: %s", key, err)
+		}
+		if _, err := p.Head(key); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s should be deleted: %v", key, err)
+		}
+	}
+	if l, err := p2.(LimitsReporter).Limits(); err != nil || l.Used != 0 || l.Total != 200 {
+		t.Fatalf("limits of the pool: %+v %v", l, err)
+	}
+}
+
+// stallingDrive creates the file before the upload as the drive, which is
+// stuck until canceled.
+type stallingDrive struct {
+	*fakeDrive
+	started chan struct{}
+}
+
+func (d *stallingDrive) CreateFile(ctx context.Context, node drive.Node, in io.Reader) (string, error) {
+	d.Lock()
+	d.add(node.ParentId, node.Name, drive.FileKind, nil)
+	d.Unlock()
+	close(d.started)
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestAliyunCloseInflightPut(t *testing.T) {
+	d := &stallingDrive{newFakeDrive(), make(chan struct{})}
+	s, err := newAliyunStorage(context.Background(), d, "/jfs", defaultAliyunOptions)
+	if err != nil {
+		t.Fatalf("create aliyun storage: %s", err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- s.Put("a", strings.NewReader("a")) }()
+	<-d.started
+	if ups, _, err := s.ListUploads(""); err != nil || len(ups) != 1 {
+		t.Fatalf("temp file of the put: %+v %v", ups, err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if err = <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("put should be canceled: %v", err)
+	}
+	if ups, _, err := s.ListUploads(""); err != nil || len(ups) != 0 {
+		t.Fatalf("temp files left after close: %+v %v", ups, err)
+	}
+	if err = s.Put("b", strings.NewReader("b")); !errors.Is(err, errAliyunClosed) {
+		t.Fatalf("put after close: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("close again: %s", err)
+	}
+}
+
+func TestAliyunInlineRead(t *testing.T) {
+	d := newFakeDrive()
+	d.urls = true
+	opts := defaultAliyunOptions
+	opts.inlineReadSize = 10
+	s := newTestAliyun(t, d, opts)
+	_ = s.Put("small", strings.NewReader("0123456789"))
+	_ = s.Put("large", strings.NewReader("0123456789a"))
+	_ = s.Put("empty", strings.NewReader(""))
+
+	for _, c := range []struct {
+		key        string
+		off, limit int64
+		data       string
+		downloaded bool
+	}{
+		{"small", 0, -1, "0123456789", true},
+		{"small", 3, 4, "3456", true},
+		{"small", 10, -1, "", false},
+		{"empty", 0, -1, "", false},
+		{"large", 0, -1, "0123456789a", false},
+		{"large", 9, 2, "9a", false},
+	} {
+		// the node is looked up again
+		s.nodeIDCache.Delete(s.path(c.key))
+		downloads, opens := d.called("Download"), d.called("Open")
+		if data, err := get(s, c.key, c.off, c.limit); err != nil || data != c.data {
+			t.Fatalf("get %s at %d+%d: %q %v", c.key, c.off, c.limit, data, err)
+		}
+		if downloaded := d.called("Download") > downloads; downloaded != c.downloaded {
+			t.Fatalf("get %s at %d+%d: downloaded by url %t, expect %t", c.key, c.off, c.limit, downloaded, c.downloaded)
+		}
+		if c.downloaded && d.called("Open") != opens {
+			t.Fatalf("get %s at %d+%d: opened after downloaded", c.key, c.off, c.limit)
+		}
+	}
+
+	// the node cached is opened as usual
+	downloads := d.called("Download")
+	if data, err := get(s, "small", 0, -1); err != nil || data != "0123456789" || d.called("Download") != downloads {
+		t.Fatalf("get small cached: %q %v", data, err)
+	}
+	// fall back to Open if the URL fails
+	d.urlExpired = true
+	s.nodeIDCache.Delete(s.path("small"))
+	opens := d.called("Open")
+	if data, err := get(s, "small", 0, -1); err != nil || data != "0123456789" || d.called("Open") != opens+1 {
+		t.Fatalf("get small by an expired url: %q %v", data, err)
+	}
+	if _, err := get(s, "missing", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get missing: %v", err)
+	}
+}
+
+func BenchmarkAliyunSmallGet(b *testing.B) {
+	for _, size := range []int64{0, 4 << 10} {
+		b.Run(fmt.Sprintf("inline-read-size=%d", size), func(b *testing.B) {
+			d := newFakeDrive()
+			d.urls = true
+			opts := defaultAliyunOptions
+			opts.inlineReadSize = size
+			s := newTestAliyun(b, d, opts)
+			data := strings.Repeat("x", 1<<10)
+			for i := 0; i < b.N; i++ {
+				_ = s.Put(fmt.Sprintf("k%d", i), strings.NewReader(data))
+			}
+			// the nodes are not cached, as the reads by another client
+			s.nodeIDCache.Range(func(k, v interface{}) bool {
+				s.nodeIDCache.Delete(k)
+				return true
+			})
+			base := s.APICalls()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := get(s, fmt.Sprintf("k%d", i), 0, -1); err != nil {
+					b.Fatalf("get: %s", err)
+				}
+			}
+			b.StopTimer()
+			var requests int64
+			for api, n := range s.APICalls() {
+				requests += n - base[api]
+				if api == "Open" {
+					// for the download URL first
+					requests += n - base[api]
+				}
+			}
+			b.ReportMetric(float64(requests)/float64(b.N), "requests/op")
+		})
+	}
+}
+
+func TestAliyunBackgroundPriority(t *testing.T) {
+	opts := defaultAliyunOptions
+	opts.maxRPS, opts.rpsBurst = 200, 1
+	s := newTestAliyun(t, newFakeDrive(), opts)
+	_ = s.Put("a", strings.NewReader("a"))
+
+	// the average latency of Heads by 4 clients of each priority
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	latency := map[bool]time.Duration{}
+	for i := 0; i < 8; i++ {
+		bg := i%2 == 1
+		ctx := context.Background()
+		if bg {
+			ctx = WithBackground(ctx)
+		}
+		wg.Add(1)
+		go func(o ObjectStorage, bg bool) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				start := time.Now()
+				if _, err := o.Head("a"); err != nil {
+					t.Errorf("head: %s", err)
+				}
+				mu.Lock()
+				latency[bg] += time.Since(start)
+				mu.Unlock()
+			}
+		}(WithContext(s, ctx), bg)
+	}
+	wg.Wait()
+	if latency[false]*3 > latency[true]*2 {
+		t.Fatalf("foreground took %s, but background took %s", latency[false]/40, latency[true]/40)
+	}
+}
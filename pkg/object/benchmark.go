@@ -0,0 +1,196 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BenchOptions is the workload of Benchmark.
+type BenchOptions struct {
+	// all the objects are written under Prefix/<run id>/, it must not be empty
+	Prefix string
+	// number of objects
+	Count int
+	// size of every object in bytes
+	Size int
+	// number of operations in parallel
+	Threads int
+}
+
+var DefaultBenchOptions = BenchOptions{
+	Prefix:  "__juicefs_benchmark__/",
+	Count:   100,
+	Size:    1 << 20,
+	Threads: 4,
+}
+
+// BenchStat is the result of one kind of operations.
+type BenchStat struct {
+	Count    int
+	Errors   int
+	Duration time.Duration
+	// operations and bytes (for Put and Get) per second
+	OpsPerSec   float64
+	BytesPerSec float64
+	// latency of successful operations
+	P50, P90, P99, Max time.Duration
+}
+
+func (s BenchStat) String() string {
+	return fmt.Sprintf("%d ops (%d errors) in %s, %.1f ops/s, %.2f MiB/s, latency p50 %s p90 %s p99 %s max %s",
+		s.Count, s.Errors, s.Duration.Round(time.Millisecond), s.OpsPerSec, s.BytesPerSec/(1<<20),
+		s.P50, s.P90, s.P99, s.Max)
+}
+
+// BenchResult is the result of Benchmark.
+type BenchResult struct {
+	Put, Get, Delete BenchStat
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// benchRun runs op on every key with the threads, and summarizes it.
+func benchRun(keys []string, threads int, size int, op func(key string) error) BenchStat {
+	var mu sync.Mutex
+	var errs int
+	lats := make([]time.Duration, 0, len(keys))
+	todo := make(chan string, len(keys))
+	for _, k := range keys {
+		todo <- k
+	}
+	close(todo)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range todo {
+				st := time.Now()
+				err := op(key)
+				used := time.Since(st)
+				mu.Lock()
+				if err != nil {
+					errs++
+					logger.Debugf("Benchmark %s: %s", key, err)
+				} else {
+					lats = append(lats, used)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	s := BenchStat{Count: len(keys), Errors: errs, Duration: time.Since(start)}
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+	if secs := s.Duration.Seconds(); secs > 0 {
+		s.OpsPerSec = float64(len(lats)) / secs
+		s.BytesPerSec = float64(len(lats)*size) / secs
+	}
+	s.P50, s.P90, s.P99 = percentile(lats, 0.5), percentile(lats, 0.9), percentile(lats, 0.99)
+	if len(lats) > 0 {
+		s.Max = lats[len(lats)-1]
+	}
+	return s
+}
+
+// Benchmark puts, gets and deletes Count objects of Size bytes with Threads
+// in parallel. It only touches the objects written by itself, under a
+// private directory of Prefix, which are removed before it returns.
+func Benchmark(o ObjectStorage, opts BenchOptions) (BenchResult, error) {
+	var r BenchResult
+	if strings.Trim(opts.Prefix, "/") == "" {
+		return r, fmt.Errorf("a dedicated prefix is required for benchmark")
+	}
+	if opts.Count <= 0 || opts.Size < 0 || opts.Threads <= 0 {
+		return r, fmt.Errorf("invalid benchmark options: %+v", opts)
+	}
+	dir := strings.TrimSuffix(opts.Prefix, "/") + "/" + uuid.NewString() + "/"
+	keys := make([]string, opts.Count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s%08d", dir, i)
+	}
+	data := make([]byte, opts.Size)
+	if _, err := rand.Read(data); err != nil {
+		return r, err
+	}
+
+	written := make(map[string]bool, len(keys))
+	var mu sync.Mutex
+	defer func() {
+		// the objects left by failed deletes
+		for _, k := range keys {
+			if written[k] {
+				if err := o.Delete(k); err != nil {
+					logger.Warnf("Delete %s after benchmark: %s", k, err)
+				}
+			}
+		}
+	}()
+
+	r.Put = benchRun(keys, opts.Threads, opts.Size, func(key string) error {
+		mu.Lock()
+		// a failed put could still leave the object
+		written[key] = true
+		mu.Unlock()
+		return o.Put(key, bytes.NewReader(data))
+	})
+	r.Get = benchRun(keys, opts.Threads, opts.Size, func(key string) error {
+		in, err := o.Get(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		n, err := io.Copy(io.Discard, in)
+		if err == nil && n != int64(opts.Size) {
+			err = fmt.Errorf("short read: %d < %d", n, opts.Size)
+		}
+		return err
+	})
+	r.Delete = benchRun(keys, opts.Threads, 0, func(key string) error {
+		err := o.Delete(key)
+		if err == nil {
+			mu.Lock()
+			written[key] = false
+			mu.Unlock()
+		}
+		return err
+	})
+	return r, nil
+}
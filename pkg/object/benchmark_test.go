@@ -0,0 +1,86 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// flakyDelete fails the first delete of every key.
+type flakyDelete struct {
+	ObjectStorage
+	sync.Mutex
+	tried map[string]bool
+}
+
+func (f *flakyDelete) Delete(key string) error {
+	f.Lock()
+	tried := f.tried[key]
+	f.tried[key] = true
+	f.Unlock()
+	if !tried {
+		return errors.New("busy")
+	}
+	return f.ObjectStorage.Delete(key)
+}
+
+func TestBenchmark(t *testing.T) {
+	m, _ := newMem("mem", "", "", "")
+	_ = m.Put("a", bytes.NewReader([]byte("a")))
+	_ = m.Put(DefaultBenchOptions.Prefix+"keep", bytes.NewReader([]byte("keep")))
+
+	opts := BenchOptions{Prefix: DefaultBenchOptions.Prefix, Count: 50, Size: 4 << 10, Threads: 4}
+	r, err := Benchmark(m, opts)
+	if err != nil {
+		t.Fatalf("benchmark: %s", err)
+	}
+	for name, s := range map[string]BenchStat{"put": r.Put, "get": r.Get, "delete": r.Delete} {
+		if s.Count != 50 || s.Errors != 0 || s.OpsPerSec <= 0 || s.P50 > s.P99 || s.P99 > s.Max {
+			t.Fatalf("%s: %s", name, s)
+		}
+	}
+	if r.Get.BytesPerSec <= 0 || r.Delete.BytesPerSec != 0 {
+		t.Fatalf("throughput: get %s, delete %s", r.Get, r.Delete)
+	}
+	var keys []string
+	objs, _ := m.List("", "", 1000)
+	for _, o := range objs {
+		keys = append(keys, o.Key())
+	}
+	if strings.Join(keys, ",") != "__juicefs_benchmark__/keep,a" {
+		t.Fatalf("only the objects of benchmark should be removed: %v", keys)
+	}
+
+	// the objects failed to delete are still cleaned up
+	f := &flakyDelete{ObjectStorage: m, tried: make(map[string]bool)}
+	if r, err = Benchmark(f, opts); err != nil || r.Delete.Errors != 50 {
+		t.Fatalf("benchmark with failed deletes: %s %v", r.Delete, err)
+	}
+	if objs, _ = m.List("", "", 1000); len(objs) != 2 {
+		t.Fatalf("the objects of benchmark are left: %d", len(objs))
+	}
+
+	for _, bad := range []BenchOptions{{Prefix: "/", Count: 1, Threads: 1}, {Prefix: "b/", Count: 0, Threads: 1}} {
+		if _, err = Benchmark(m, bad); err == nil {
+			t.Fatalf("benchmark with %+v should fail", bad)
+		}
+	}
+}
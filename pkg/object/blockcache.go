@@ -0,0 +1,316 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// blockID is a block of an object, which covers the bytes from
+// index*blockSize, up to blockSize of them.
+type blockID struct {
+	key   string
+	index int64
+}
+
+type cachedBlock struct {
+	id   blockID
+	size int64
+	path string
+}
+
+// BlockCache is an object storage which caches the blocks of objects read
+// in a local dir. The objects are split into the blocks aligned at
+// blockSize, a Get only fetches the blocks touched by its range and missed
+// in the cache, so the nearby reads of large objects share the blocks.
+//
+// The cached blocks are evicted in LRU order when they are more than
+// capacity bytes, and those of an object are dropped once it's written or
+// deleted through the cache. The index is in memory, the blocks left in the
+// dir are removed when it's opened again, since the objects could be changed
+// in between.
+type BlockCache struct {
+	ObjectStorage
+	dir       string
+	blockSize int64
+	capacity  int64
+
+	mu     sync.Mutex
+	lru    *list.List // of *cachedBlock, the most recently used at front
+	blocks map[blockID]*list.Element
+	used   int64
+	// bumped when the blocks of a key are dropped, so a block fetched before
+	// that is not cached
+	gens map[string]uint64
+}
+
+func blockName(id blockID) string {
+	h := sha256.Sum256([]byte(id.key))
+	return hex.EncodeToString(h[:]) + "_" + strconv.FormatInt(id.index, 10)
+}
+
+func isBlockName(name string) bool {
+	parts := strings.SplitN(name, "_", 2)
+	if len(parts) != 2 || len(parts[0]) != sha256.Size*2 {
+		return false
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return false
+	}
+	_, err := strconv.ParseInt(strings.TrimSuffix(parts[1], ".tmp"), 10, 64)
+	return err == nil
+}
+
+// WithBlockCache returns a BlockCache of o caching at most capacity bytes of
+// blocks in dir.
+func WithBlockCache(o ObjectStorage, dir string, blockSize, capacity int64) (*BlockCache, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size: %d", blockSize)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if isBlockName(e.Name()) {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return &BlockCache{ObjectStorage: o, dir: dir, blockSize: blockSize, capacity: capacity,
+		lru: list.New(), blocks: make(map[blockID]*list.Element), gens: make(map[string]uint64)}, nil
+}
+
+func (c *BlockCache) String() string {
+	return fmt.Sprintf("%s(block cache %s)", c.ObjectStorage, c.dir)
+}
+
+// cached returns the content of a cached block, or false if it's missed.
+func (c *BlockCache) cached(id blockID) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.blocks[id]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	b := e.Value.(*cachedBlock)
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil || int64(len(data)) != b.size {
+		logger.Warnf("Read cached block %s of %s: %v", b.path, id.key, err)
+		c.mu.Lock()
+		if c.blocks[id] == e {
+			c.remove(e)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	return data, true
+}
+
+// remove drops a cached block, with the lock held.
+func (c *BlockCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*cachedBlock)
+	delete(c.blocks, b.id)
+	c.used -= b.size
+	_ = os.Remove(b.path)
+}
+
+// add caches a block fetched when the generation of its key was gen.
+func (c *BlockCache) add(id blockID, data []byte, gen uint64) {
+	if int64(len(data)) > c.capacity {
+		return
+	}
+	path := filepath.Join(c.dir, blockName(id))
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		logger.Warnf("Cache block %d of %s: %s", id.index, id.key, err)
+		_ = os.Remove(tmp)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gens[id.key] != gen {
+		_ = os.Remove(tmp)
+		return
+	}
+	if e, ok := c.blocks[id]; ok {
+		// cached by another Get in the meantime
+		c.remove(e)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logger.Warnf("Cache block %d of %s: %s", id.index, id.key, err)
+		_ = os.Remove(tmp)
+		return
+	}
+	c.blocks[id] = c.lru.PushFront(&cachedBlock{id, int64(len(data)), path})
+	c.used += int64(len(data))
+	for c.used > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// fetch reads a block from the storage and caches it, it's shorter than
+// blockSize only if it's the last one of the object.
+func (c *BlockCache) fetch(id blockID) ([]byte, error) {
+	c.mu.Lock()
+	gen := c.gens[id.key]
+	c.mu.Unlock()
+	in, err := c.ObjectStorage.Get(id.key, id.index*c.blockSize, c.blockSize)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > c.blockSize {
+		return nil, fmt.Errorf("block %d of %s: expect at most %d bytes, got %d", id.index, id.key, c.blockSize, len(data))
+	}
+	c.add(id, data, gen)
+	return data, nil
+}
+
+// invalidate drops the cached blocks of key.
+func (c *BlockCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gens[key]++
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cachedBlock).id.key == key {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// blockReader reads a range of an object block by block.
+type blockReader struct {
+	c   *BlockCache
+	key string
+	off int64
+	// the end of the range, -1 for the end of the object
+	end  int64
+	data []byte // the rest of the current block
+	last bool   // the current block is the last one
+	// the size of the object, -1 before it's needed
+	size int64
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.last || r.end >= 0 && r.off >= r.end {
+			return 0, io.EOF
+		}
+		if err := r.load(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	r.off += int64(n)
+	return n, nil
+}
+
+// load reads the block at off into data.
+func (r *blockReader) load() error {
+	index := r.off / r.c.blockSize
+	id := blockID{r.key, index}
+	data, ok := r.c.cached(id)
+	if !ok {
+		if index > 0 && r.off == index*r.c.blockSize {
+			// the previous block could be the last one of exactly blockSize,
+			// then no range starts here (416 InvalidRange of S3)
+			if r.size < 0 {
+				o, err := r.c.ObjectStorage.Head(r.key)
+				if err != nil {
+					return err
+				}
+				r.size = o.Size()
+			}
+			if r.off >= r.size {
+				r.last, r.data = true, nil
+				return nil
+			}
+		}
+		var err error
+		if data, err = r.c.fetch(id); err != nil {
+			return err
+		}
+	}
+	r.last = int64(len(data)) < r.c.blockSize
+	skip := r.off - index*r.c.blockSize
+	if skip > int64(len(data)) {
+		skip = int64(len(data))
+	}
+	data = data[skip:]
+	if r.end >= 0 && int64(len(data)) > r.end-r.off {
+		data = data[:r.end-r.off]
+	}
+	r.data = data
+	return nil
+}
+
+func (r *blockReader) Close() error {
+	r.data = nil
+	return nil
+}
+
+func (c *BlockCache) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r := &blockReader{c: c, key: key, off: off, end: -1, size: -1}
+	if limit > 0 {
+		r.end = off + limit
+	}
+	// fail at once if the object is missing
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *BlockCache) Put(key string, in io.Reader) error {
+	defer c.invalidate(key)
+	return c.ObjectStorage.Put(key, in)
+}
+
+func (c *BlockCache) Delete(key string) error {
+	defer c.invalidate(key)
+	return c.ObjectStorage.Delete(key)
+}
+
+func (c *BlockCache) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	defer c.invalidate(key)
+	return c.ObjectStorage.CompleteUpload(key, uploadID, parts)
+}
+
+var _ ObjectStorage = &BlockCache{}
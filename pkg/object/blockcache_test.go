@@ -0,0 +1,192 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// rangeGets records the ranges of the Gets.
+type rangeGets struct {
+	ObjectStorage
+	sync.Mutex
+	ranges []string
+}
+
+func (r *rangeGets) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r.Lock()
+	r.ranges = append(r.ranges, fmt.Sprintf("%s@%d+%d", key, off, limit))
+	r.Unlock()
+	return r.ObjectStorage.Get(key, off, limit)
+}
+
+func (r *rangeGets) take() []string {
+	r.Lock()
+	defer r.Unlock()
+	ranges := r.ranges
+	r.ranges = nil
+	return ranges
+}
+
+func TestBlockCache(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	g := &rangeGets{ObjectStorage: m}
+	dir := t.TempDir()
+	_ = ioutil.WriteFile(dir+"/"+blockName(blockID{"stale", 0}), []byte("stale"), 0600)
+	_ = ioutil.WriteFile(dir+"/other", []byte("kept"), 0600)
+	c, err := WithBlockCache(g, dir, 10, 40)
+	if err != nil {
+		t.Fatalf("block cache: %s", err)
+	}
+	if _, err := os.Stat(dir + "/" + blockName(blockID{"stale", 0})); !os.IsNotExist(err) {
+		t.Fatalf("stale block should be removed: %v", err)
+	}
+	if _, err := os.Stat(dir + "/other"); err != nil {
+		t.Fatalf("other files should be kept: %s", err)
+	}
+
+	data := make([]byte, 35)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	_ = m.Put("a", bytes.NewReader(data))
+	read := func(key string, off, limit int64) []byte {
+		t.Helper()
+		in, err := c.Get(key, off, limit)
+		if err != nil {
+			t.Fatalf("get %s at %d+%d: %s", key, off, limit, err)
+		}
+		defer in.Close()
+		d, err := ioutil.ReadAll(in)
+		if err != nil {
+			t.Fatalf("read %s at %d+%d: %s", key, off, limit, err)
+		}
+		return d
+	}
+	expectGets := func(expected ...string) {
+		t.Helper()
+		if got := g.take(); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("expect gets %v, got %v", expected, got)
+		}
+	}
+
+	// only the blocks touched are fetched, aligned at the block size
+	if d := read("a", 12, 5); string(d) != string(data[12:17]) {
+		t.Fatalf("expect %q, got %q", data[12:17], d)
+	}
+	expectGets("a@10+10")
+	if d := read("a", 15, 3); string(d) != string(data[15:18]) {
+		t.Fatalf("expect %q, got %q", data[15:18], d)
+	}
+	expectGets()
+
+	// a range overlapping cached and missed blocks only fetches the missed
+	if d := read("a", 5, 20); string(d) != string(data[5:25]) {
+		t.Fatalf("expect %q, got %q", data[5:25], d)
+	}
+	expectGets("a@0+10", "a@20+10")
+	if d := read("a", 0, -1); string(d) != string(data) {
+		t.Fatalf("expect %q, got %q", data, d)
+	}
+	expectGets("a@30+10")
+	if d := read("a", 28, 100); string(d) != string(data[28:]) {
+		t.Fatalf("expect %q, got %q", data[28:], d)
+	}
+	expectGets()
+
+	if _, err := c.Get("missing", 0, -1); !os.IsNotExist(err) {
+		t.Fatalf("get missing: %v", err)
+	}
+	g.take()
+
+	// the least recently used blocks are evicted beyond the capacity
+	_ = m.Put("b", bytes.NewReader(data[:20]))
+	read("a", 0, 1)
+	expectGets()
+	read("b", 0, 20) // evicts a@10 and a@20
+	expectGets("b@0+10", "b@10+10")
+	read("a", 0, 1)
+	read("a", 30, 1)
+	expectGets()
+	read("a", 10, 1)
+	expectGets("a@10+10")
+	if c.used > c.capacity {
+		t.Fatalf("used %d is beyond capacity %d", c.used, c.capacity)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != c.lru.Len()+1 {
+		t.Fatalf("expect %d cached blocks in dir, got %d", c.lru.Len(), len(entries)-1)
+	}
+
+	// the blocks of the objects written are dropped
+	if err := c.Put("a", bytes.NewReader([]byte("changed"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if d := read("a", 0, -1); string(d) != "changed" {
+		t.Fatalf("expect changed, got %q", d)
+	}
+	expectGets("a@0+10")
+	if err := c.Delete("a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := c.Get("a", 0, -1); !os.IsNotExist(err) {
+		t.Fatalf("get deleted: %v", err)
+	}
+}
+
+// strictRanges rejects the ranges starting at or past the end of an object
+// as S3 does.
+type strictRanges struct {
+	ObjectStorage
+}
+
+func (s *strictRanges) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	o, err := s.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	if off > 0 && off >= o.Size() {
+		return nil, fmt.Errorf("InvalidRange: %d of %d bytes", off, o.Size())
+	}
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func TestBlockCacheAlignedObject(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	c, err := WithBlockCache(&strictRanges{m}, t.TempDir(), 10, 100)
+	if err != nil {
+		t.Fatalf("block cache: %s", err)
+	}
+	data := []byte("0123456789abcdefghij")
+	_ = m.Put("a", bytes.NewReader(data))
+	for _, r := range []struct{ off, limit int64 }{{0, -1}, {10, -1}, {0, 30}, {5, -1}, {20, -1}} {
+		in, err := c.Get("a", r.off, r.limit)
+		if err != nil {
+			t.Fatalf("get at %d+%d: %s", r.off, r.limit, err)
+		}
+		d, err := ioutil.ReadAll(in)
+		_ = in.Close()
+		if err != nil || string(d) != string(data[r.off:]) {
+			t.Fatalf("read at %d+%d: %q %v", r.off, r.limit, d, err)
+		}
+	}
+}
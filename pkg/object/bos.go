@@ -33,12 +33,44 @@ import (
 	"github.com/baidubce/bce-sdk-go/services/bos/api"
 )
 
-const bosDefaultRegion = "bj"
+const (
+	bosDefaultRegion = "bj"
+	bosMaxParts      = 10000
+	// the keys deleted in one request at most
+	bosMaxDeletes = 1000
+)
+
+// bosAPI is the part of the BOS client used by bosclient.
+type bosAPI interface {
+	PutBucket(bucket string) (string, error)
+	GetObjectMeta(bucket, object string) (*api.GetObjectMetaResult, error)
+	GetObject(bucket, object string, responseHeaders map[string]string, ranges ...int64) (*api.GetObjectResult, error)
+	BasicPutObject(bucket, object string, body *bce.Body) (string, error)
+	BasicCopyObject(bucket, object, srcBucket, srcObject string) (*api.CopyObjectResult, error)
+	DeleteObject(bucket, object string) error
+	DeleteMultipleObjectsFromKeyList(bucket string, keyList []string) (*api.DeleteMultipleObjectsResult, error)
+	SimpleListObjects(bucket, prefix string, maxKeys int, marker, delimiter string) (*api.ListObjectsResult, error)
+	BasicInitiateMultipartUpload(bucket, object string) (*api.InitiateMultipartUploadResult, error)
+	BasicUploadPart(bucket, object, uploadId string, partNumber int, content *bce.Body) (string, error)
+	AbortMultipartUpload(bucket, object, uploadId string) error
+	CompleteMultipartUploadFromStruct(bucket, object, uploadId string, args *api.CompleteMultipartUploadArgs) (*api.CompleteMultipartUploadResult, error)
+	ListMultipartUploads(bucket string, args *api.ListMultipartUploadsArgs) (*api.ListMultipartUploadsResult, error)
+}
 
 type bosclient struct {
 	DefaultObjectStorage
 	bucket string
-	c      *bos.Client
+	c      bosAPI
+	// objects larger than partSize are uploaded part by part
+	partSize int64
+}
+
+// bosError returns os.ErrNotExist for the missing objects.
+func bosError(err error) error {
+	if e, ok := err.(*bce.BceServiceError); ok && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey") {
+		return os.ErrNotExist
+	}
+	return err
 }
 
 func (q *bosclient) String() string {
@@ -56,10 +88,7 @@ func (q *bosclient) Create() error {
 func (q *bosclient) Head(key string) (Object, error) {
 	r, err := q.c.GetObjectMeta(q.bucket, key)
 	if err != nil {
-		if e, ok := err.(*bce.BceServiceError); ok && e.StatusCode == http.StatusNotFound {
-			err = os.ErrNotExist
-		}
-		return nil, err
+		return nil, bosError(err)
 	}
 	mtime, _ := time.Parse(time.RFC1123, r.LastModified)
 	return &obj{
@@ -81,7 +110,7 @@ func (q *bosclient) Get(key string, off, limit int64) (io.ReadCloser, error) {
 		r, err = q.c.GetObject(q.bucket, key, nil)
 	}
 	if err != nil {
-		return nil, err
+		return nil, bosError(err)
 	}
 	return r.Body, nil
 }
@@ -91,6 +120,9 @@ func (q *bosclient) Put(key string, in io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if vlen > q.partSize {
+		return q.putMultipart(key, b, vlen)
+	}
 	body, err := bce.NewBodyFromSizedReader(b, vlen)
 	if err != nil {
 		return err
@@ -99,19 +131,86 @@ func (q *bosclient) Put(key string, in io.Reader) error {
 	return err
 }
 
+func (q *bosclient) putMultipart(key string, in io.Reader, size int64) error {
+	partSize := q.partSize
+	if n := (size + partSize - 1) / partSize; n > bosMaxParts {
+		partSize = (size + bosMaxParts - 1) / bosMaxParts
+	}
+	upload, err := q.CreateMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+	var parts []*Part
+	buf := make([]byte, partSize)
+	for num := 1; size > 0; num++ {
+		n := partSize
+		if size < n {
+			n = size
+		}
+		if _, err = io.ReadFull(in, buf[:n]); err != nil {
+			break
+		}
+		var part *Part
+		if part, err = q.UploadPart(key, upload.UploadID, num, buf[:n]); err != nil {
+			break
+		}
+		parts = append(parts, part)
+		size -= n
+	}
+	if err == nil {
+		err = q.CompleteUpload(key, upload.UploadID, parts)
+	}
+	if err != nil {
+		q.AbortUpload(key, upload.UploadID)
+	}
+	return err
+}
+
 func (q *bosclient) Copy(dst, src string) error {
 	_, err := q.c.BasicCopyObject(q.bucket, dst, q.bucket, src)
-	return err
+	return bosError(err)
 }
 
 func (q *bosclient) Delete(key string) error {
-	err := q.c.DeleteObject(q.bucket, key)
-	if err != nil && strings.Contains(err.Error(), "NoSuchKey") {
+	err := bosError(q.c.DeleteObject(q.bucket, key))
+	if os.IsNotExist(err) {
 		err = nil
 	}
 	return err
 }
 
+// DeleteMulti deletes the keys in batches, the failed keys are returned as
+// a BulkError.
+func (q *bosclient) DeleteMulti(keys []string) error {
+	b := &bulkRunner{op: "delete", mode: BulkBestEffort}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > bosMaxDeletes {
+			batch = batch[:bosMaxDeletes]
+		}
+		keys = keys[len(batch):]
+		r, err := q.c.DeleteMultipleObjectsFromKeyList(q.bucket, batch)
+		if err == io.EOF {
+			// the body is empty when all the keys are deleted
+			err, r = nil, &api.DeleteMultipleObjectsResult{}
+		}
+		if err != nil {
+			for _, key := range batch {
+				_, _ = b.run(key, func(string) error { return err })
+			}
+			continue
+		}
+		for _, e := range r.Errors {
+			if e.Code == "NoSuchKey" {
+				continue
+			}
+			err := fmt.Errorf("%s: %s", e.Code, e.Message)
+			_, _ = b.run(e.Key, func(string) error { return err })
+		}
+	}
+	return b.result()
+}
+
 func (q *bosclient) List(prefix, marker string, limit int64) ([]Object, error) {
 	if limit > 1000 {
 		limit = 1000
@@ -232,7 +331,7 @@ func newBOS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 	if err != nil {
 		return nil, err
 	}
-	return &bosclient{bucket: bucketName, c: bosClient}, nil
+	return &bosclient{bucket: bucketName, c: bosClient, partSize: 128 << 20}, nil
 }
 
 func init() {
@@ -0,0 +1,323 @@
+//go:build !nobos
+// +build !nobos
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baidubce/bce-sdk-go/bce"
+	"github.com/baidubce/bce-sdk-go/services/bos/api"
+)
+
+type fakeBOSObject struct {
+	data  []byte
+	mtime time.Time
+}
+
+// fakeBOS is an in-memory BOS bucket.
+type fakeBOS struct {
+	sync.Mutex
+	objects map[string]fakeBOSObject
+	uploads map[string]map[int][]byte
+	keys    map[string]string
+	seq     int
+	puts    int
+	lists   int
+	batches int
+	// the keys failed to delete in batch
+	undeletable map[string]bool
+}
+
+func newFakeBOS() *fakeBOS {
+	return &fakeBOS{
+		objects:     make(map[string]fakeBOSObject),
+		uploads:     make(map[string]map[int][]byte),
+		keys:        make(map[string]string),
+		undeletable: make(map[string]bool),
+	}
+}
+
+func bosNotFound(code string) error {
+	return bce.NewBceServiceError(code, "not found", "", http.StatusNotFound)
+}
+
+func readBody(body *bce.Body) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(body.Stream(), body.Size()))
+}
+
+func (f *fakeBOS) PutBucket(bucket string) (string, error) {
+	return "", bce.NewBceServiceError("BucketAlreadyExists", "exists", "", http.StatusConflict)
+}
+
+func (f *fakeBOS) GetObjectMeta(bucket, object string) (*api.GetObjectMetaResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, ok := f.objects[object]
+	if !ok {
+		// HEAD has no body for the code
+		return nil, bosNotFound("")
+	}
+	r := &api.GetObjectMetaResult{}
+	r.ContentLength = int64(len(o.data))
+	r.LastModified = o.mtime.UTC().Format(time.RFC1123)
+	return r, nil
+}
+
+func (f *fakeBOS) GetObject(bucket, object string, responseHeaders map[string]string, ranges ...int64) (*api.GetObjectResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, ok := f.objects[object]
+	if !ok {
+		return nil, bosNotFound("NoSuchKey")
+	}
+	data := o.data
+	if len(ranges) > 0 {
+		start, end := ranges[0], int64(len(data))-1
+		if len(ranges) > 1 && ranges[1] < end {
+			end = ranges[1]
+		}
+		if start > end {
+			return nil, bce.NewBceServiceError("InvalidRange", "invalid range", "", http.StatusRequestedRangeNotSatisfiable)
+		}
+		data = data[start : end+1]
+	}
+	return &api.GetObjectResult{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeBOS) BasicPutObject(bucket, object string, body *bce.Body) (string, error) {
+	data, err := readBody(body)
+	if err != nil {
+		return "", err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.puts++
+	f.objects[object] = fakeBOSObject{data, time.Now()}
+	return "etag", nil
+}
+
+func (f *fakeBOS) BasicCopyObject(bucket, object, srcBucket, srcObject string) (*api.CopyObjectResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, ok := f.objects[srcObject]
+	if !ok {
+		return nil, bosNotFound("NoSuchKey")
+	}
+	f.objects[object] = fakeBOSObject{o.data, time.Now()}
+	return &api.CopyObjectResult{}, nil
+}
+
+func (f *fakeBOS) DeleteObject(bucket, object string) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.objects[object]; !ok {
+		return bosNotFound("NoSuchKey")
+	}
+	delete(f.objects, object)
+	return nil
+}
+
+func (f *fakeBOS) DeleteMultipleObjectsFromKeyList(bucket string, keyList []string) (*api.DeleteMultipleObjectsResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	if len(keyList) > bosMaxDeletes {
+		return nil, bce.NewBceServiceError("InvalidArgument", "too many keys", "", http.StatusBadRequest)
+	}
+	f.batches++
+	r := &api.DeleteMultipleObjectsResult{}
+	for _, k := range keyList {
+		if f.undeletable[k] {
+			r.Errors = append(r.Errors, api.DeleteObjectResult{Key: k, Code: "AccessDenied", Message: "denied"})
+		} else if _, ok := f.objects[k]; !ok {
+			r.Errors = append(r.Errors, api.DeleteObjectResult{Key: k, Code: "NoSuchKey", Message: "not found"})
+		} else {
+			delete(f.objects, k)
+		}
+	}
+	if len(r.Errors) == 0 {
+		// as BOS, nothing is returned when all are deleted
+		return nil, io.EOF
+	}
+	return r, nil
+}
+
+func (f *fakeBOS) SimpleListObjects(bucket, prefix string, maxKeys int, marker, delimiter string) (*api.ListObjectsResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.lists++
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) && k > marker {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	r := &api.ListObjectsResult{Prefix: prefix, Marker: marker, MaxKeys: maxKeys}
+	for _, k := range keys {
+		if len(r.Contents) == maxKeys {
+			r.IsTruncated = true
+			r.NextMarker = r.Contents[len(r.Contents)-1].Key
+			break
+		}
+		o := f.objects[k]
+		r.Contents = append(r.Contents, api.ObjectSummaryType{Key: k, Size: len(o.data), LastModified: o.mtime.UTC().Format("2006-01-02T15:04:05Z")})
+	}
+	return r, nil
+}
+
+func (f *fakeBOS) BasicInitiateMultipartUpload(bucket, object string) (*api.InitiateMultipartUploadResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.seq++
+	id := fmt.Sprintf("upload-%d", f.seq)
+	f.uploads[id] = make(map[int][]byte)
+	f.keys[id] = object
+	return &api.InitiateMultipartUploadResult{Bucket: bucket, Key: object, UploadId: id}, nil
+}
+
+func (f *fakeBOS) BasicUploadPart(bucket, object, uploadId string, partNumber int, content *bce.Body) (string, error) {
+	data, err := readBody(content)
+	if err != nil {
+		return "", err
+	}
+	f.Lock()
+	defer f.Unlock()
+	parts, ok := f.uploads[uploadId]
+	if !ok {
+		return "", bosNotFound("NoSuchUpload")
+	}
+	parts[partNumber] = data
+	return fmt.Sprintf("etag-%d-%d", partNumber, len(data)), nil
+}
+
+func (f *fakeBOS) AbortMultipartUpload(bucket, object, uploadId string) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.uploads, uploadId)
+	return nil
+}
+
+func (f *fakeBOS) CompleteMultipartUploadFromStruct(bucket, object, uploadId string, args *api.CompleteMultipartUploadArgs) (*api.CompleteMultipartUploadResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	parts, ok := f.uploads[uploadId]
+	if !ok {
+		return nil, bosNotFound("NoSuchUpload")
+	}
+	var data []byte
+	for _, p := range args.Parts {
+		d := parts[p.PartNumber]
+		if p.ETag != fmt.Sprintf("etag-%d-%d", p.PartNumber, len(d)) {
+			return nil, bce.NewBceServiceError("InvalidPart", "bad etag", "", http.StatusBadRequest)
+		}
+		data = append(data, d...)
+	}
+	delete(f.uploads, uploadId)
+	f.objects[object] = fakeBOSObject{data, time.Now()}
+	return &api.CompleteMultipartUploadResult{Bucket: bucket, Key: object}, nil
+}
+
+func (f *fakeBOS) ListMultipartUploads(bucket string, args *api.ListMultipartUploadsArgs) (*api.ListMultipartUploadsResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	r := &api.ListMultipartUploadsResult{Bucket: bucket}
+	for id := range f.uploads {
+		r.Uploads = append(r.Uploads, api.ListMultipartUploadsType{Key: f.keys[id], UploadId: id})
+	}
+	return r, nil
+}
+
+func newTestBOS(f *fakeBOS) *bosclient {
+	return &bosclient{bucket: "jfs", c: f, partSize: 128 << 20}
+}
+
+func TestBOSFake(t *testing.T) {
+	testStorage(t, newTestBOS(newFakeBOS()))
+}
+
+func TestBOSPutMultipart(t *testing.T) {
+	f := newFakeBOS()
+	s := newTestBOS(f)
+	s.partSize = 10
+	data := []byte(strings.Repeat("0123456789", 3) + "abc")
+	if err := s.Put("large", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if f.puts != 0 || len(f.uploads) != 0 {
+		t.Fatalf("expect a completed multipart upload, but got %d puts and %d uploads", f.puts, len(f.uploads))
+	}
+	if d, err := get(s, "large", 0, -1); err != nil || d != string(data) {
+		t.Fatalf("expect %q, but got %q: %v", data, d, err)
+	}
+	if d, err := get(s, "large", 28, 4); err != nil || d != "89ab" {
+		t.Fatalf("expect 89ab, but got %q: %v", d, err)
+	}
+	if err := s.Copy("copied", "large"); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if err := s.Copy("copied", "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("copy of missing object: %v", err)
+	}
+	if _, err := s.Get("missing", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get of missing object: %v", err)
+	}
+}
+
+func TestBOSList(t *testing.T) {
+	f := newFakeBOS()
+	s := newTestBOS(f)
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("chunks/%05d", i))
+		f.objects[keys[i]] = fakeBOSObject{[]byte("data"), time.Now()}
+	}
+	ch, err := ListAll(s, "chunks/", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %d keys, but got %d", len(keys), len(got))
+	}
+	// 3 pages of 1000 keys, and an empty one
+	if f.lists != 4 {
+		t.Fatalf("expect 4 list requests, but got %d", f.lists)
+	}
+
+	f.undeletable[keys[1]] = true
+	err = s.DeleteMulti(append(keys, "missing"))
+	var e *BulkError
+	if !errors.As(err, &e) || len(e.Errors) != 1 || e.Errors[keys[1]] == nil {
+		t.Fatalf("expect %s failed to delete, but got %v", keys[1], err)
+	}
+	if f.batches != 3 || len(f.objects) != 1 {
+		t.Fatalf("expect 3 batches leaving 1 object, but got %d and %d", f.batches, len(f.objects))
+	}
+}
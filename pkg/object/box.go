@@ -0,0 +1,639 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	boxAPI    = "https://api.box.com/2.0"
+	boxUpload = "https://upload.box.com/api/2.0"
+	boxOAuth  = "https://api.box.com/oauth2/token"
+	// Box only accepts upload sessions for files of at least 20 MiB
+	boxChunkedThreshold = 20 << 20
+	boxTokenFile        = "box_refresh_token"
+	// the commits of an upload session still being processed
+	boxCommitAttempts = 30
+)
+
+type boxError struct {
+	Status      int    `json:"status"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	ContextInfo struct {
+		Conflicts json.RawMessage `json:"conflicts"`
+	} `json:"context_info"`
+}
+
+func (e *boxError) Error() string {
+	return fmt.Sprintf("box: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// conflictID returns the id of the existing item that caused a 409.
+func (e *boxError) conflictID() string {
+	var item boxItem
+	if json.Unmarshal(e.ContextInfo.Conflicts, &item) == nil && item.ID != "" {
+		return item.ID
+	}
+	var items []boxItem
+	if json.Unmarshal(e.ContextInfo.Conflicts, &items) == nil && len(items) > 0 {
+		return items[0].ID
+	}
+	return ""
+}
+
+type boxItem struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	ModifiedAt string `json:"modified_at"`
+}
+
+func (i *boxItem) mtime() time.Time {
+	t, _ := time.Parse(time.RFC3339, i.ModifiedAt)
+	return t
+}
+
+// oauthToken provides access tokens, an OAuth refresh token is exchanged for
+// new tokens when the client id is provided, otherwise the token is used as
+// an access (developer) token directly.
+type oauthToken struct {
+	sync.Mutex
+	// name of the service in errors
+	service      string
+	oauthURL     string
+	scope        string
+	clientID     string
+	clientSecret string
+	refreshToken string
+	accessToken  string
+	expireAt     time.Time
+	onRefresh    func(refreshToken string)
+}
+
+func (a *oauthToken) token(ctx context.Context, client *http.Client, force bool) (string, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.clientID == "" {
+		return a.accessToken, nil
+	}
+	if !force && a.accessToken != "" && time.Now().Before(a.expireAt) {
+		return a.accessToken, nil
+	}
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("client_id", a.clientID)
+	if a.clientSecret != "" {
+		form.Set("client_secret", a.clientSecret)
+	}
+	form.Set("refresh_token", a.refreshToken)
+	if a.scope != "" {
+		form.Set("scope", a.scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.oauthURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("refresh %s token: %s: %s", a.service, resp.Status, data)
+	}
+	var t struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("decode %s token: %s", a.service, err)
+	}
+	a.accessToken = t.AccessToken
+	// refresh a minute earlier to avoid expiring in the middle of a request
+	a.expireAt = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - time.Minute)
+	if t.RefreshToken != "" {
+		a.refreshToken = t.RefreshToken
+		if a.onRefresh != nil {
+			a.onRefresh(t.RefreshToken)
+		}
+	}
+	return a.accessToken, nil
+}
+
+type boxStorage struct {
+	DefaultObjectStorage
+	client      *http.Client
+	auth        *oauthToken
+	apiURL      string
+	uploadURL   string
+	rootFolder  string
+	workdir     string
+	tempdirID   string
+	nodeIDCache sync.Map
+	walker      *treeWalker
+	// files larger than this are uploaded with an upload session
+	chunkedThreshold int64
+}
+
+func (s *boxStorage) String() string {
+	return fmt.Sprintf("box://%s/%s", s.rootFolder, s.workdir)
+}
+
+// request sends an authorized request to Box, the access token is refreshed
+// and the request is retried once when it's rejected as unauthorized.
+func (s *boxStorage) request(ctx context.Context, method, u string, header http.Header, body []byte) (*http.Response, error) {
+	for i := 0; ; i++ {
+		token, err := s.auth.token(ctx, s.client, i > 0)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && i == 0 && s.auth.clientID != "" {
+			_ = resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			defer resp.Body.Close()
+			e := &boxError{Status: resp.StatusCode}
+			data, _ := ioutil.ReadAll(resp.Body)
+			_ = json.Unmarshal(data, e)
+			if resp.StatusCode == http.StatusNotFound {
+				return nil, fmt.Errorf("%s: %w", e, os.ErrNotExist)
+			}
+			return nil, e
+		}
+		return resp, nil
+	}
+}
+
+func (s *boxStorage) call(method, u string, request, response interface{}) error {
+	var body []byte
+	header := http.Header{}
+	if request != nil {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return err
+		}
+		header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.request(ctx, method, u, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
+
+func (s *boxStorage) listFolder(ctx context.Context, id string) ([]boxItem, error) {
+	var items []boxItem
+	marker := ""
+	for {
+		q := url.Values{}
+		q.Set("fields", "id,type,name,size,modified_at")
+		q.Set("limit", "1000")
+		q.Set("usemarker", "true")
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		var page struct {
+			Entries    []boxItem `json:"entries"`
+			NextMarker string    `json:"next_marker"`
+		}
+		resp, err := s.request(ctx, http.MethodGet, fmt.Sprintf("%s/folders/%s/items?%s", s.apiURL, id, q.Encode()), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Entries...)
+		if page.NextMarker == "" {
+			return items, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+func (s *boxStorage) listNodes(ctx context.Context, id string) ([]treeNode, error) {
+	items, err := s.listFolder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]treeNode, 0, len(items))
+	for _, i := range items {
+		if i.Type == "web_link" {
+			continue
+		}
+		nodes = append(nodes, treeNode{i.ID, i.Name, i.Type == "folder", i.Size, i.mtime(), ""})
+	}
+	return nodes, nil
+}
+
+func (s *boxStorage) createFolder(parent, name string) (string, error) {
+	var item boxItem
+	req := map[string]interface{}{"name": name, "parent": map[string]string{"id": parent}}
+	err := s.call(http.MethodPost, s.apiURL+"/folders", req, &item)
+	var e *boxError
+	if errors.As(err, &e) && e.Status == http.StatusConflict && e.conflictID() != "" {
+		return e.conflictID(), nil
+	}
+	return item.ID, err
+}
+
+// getNode resolves a path (relative to the root folder) into an item id,
+// the children of the listed directories are cached along the way.
+func (s *boxStorage) getNode(p string, createDir bool) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return s.rootFolder, nil
+	}
+	if v, ok := s.nodeIDCache.Load(p); ok {
+		return v.(string), nil
+	}
+	dir, name := path.Split(p)
+	parent, err := s.getNode(dir, createDir)
+	if err != nil {
+		return "", err
+	}
+	items, err := s.listFolder(ctx, parent)
+	if err != nil {
+		return "", err
+	}
+	for _, i := range items {
+		s.nodeIDCache.Store(path.Join(dir, i.Name), i.ID)
+	}
+	if v, ok := s.nodeIDCache.Load(p); ok {
+		return v.(string), nil
+	}
+	if !createDir {
+		return "", fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	id, err := s.createFolder(parent, name)
+	if err != nil {
+		return "", err
+	}
+	s.nodeIDCache.Store(p, id)
+	return id, nil
+}
+
+func (s *boxStorage) path(key string) string {
+	return path.Join(s.workdir, key)
+}
+
+func (s *boxStorage) Head(key string) (Object, error) {
+	id, err := s.getNode(s.path(key), false)
+	if err != nil {
+		return nil, err
+	}
+	var item boxItem
+	if err = s.call(http.MethodGet, fmt.Sprintf("%s/files/%s?fields=id,type,name,size,modified_at", s.apiURL, id), nil, &item); err != nil {
+		return nil, err
+	}
+	return &obj{key, item.Size, item.mtime(), false}, nil
+}
+
+func (s *boxStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	id, err := s.getNode(s.path(key), false)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if limit > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+limit-1))
+	} else if off > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := s.request(ctx, http.MethodGet, fmt.Sprintf("%s/files/%s/content", s.apiURL, id), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *boxStorage) uploadSimple(parent, name string, data []byte) (string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	attrs, _ := json.Marshal(map[string]interface{}{"name": name, "parent": map[string]string{"id": parent}})
+	_ = w.WriteField("attributes", string(attrs))
+	fw, _ := w.CreateFormFile("file", name)
+	_, _ = fw.Write(data)
+	_ = w.Close()
+	header := http.Header{}
+	header.Set("Content-Type", w.FormDataContentType())
+	resp, err := s.request(ctx, http.MethodPost, s.uploadURL+"/files/content", header, buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Entries []boxItem `json:"entries"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Entries) == 0 {
+		return "", errors.New("box: no file uploaded")
+	}
+	return result.Entries[0].ID, nil
+}
+
+func sha1Digest(data []byte) string {
+	h := sha1.Sum(data)
+	return "sha=" + base64.StdEncoding.EncodeToString(h[:])
+}
+
+// uploadChunked uploads a large file with an upload session.
+func (s *boxStorage) uploadChunked(parent, name string, in io.ReaderAt, size int64) (string, error) {
+	var session struct {
+		ID       string `json:"id"`
+		PartSize int64  `json:"part_size"`
+	}
+	req := map[string]interface{}{"folder_id": parent, "file_size": size, "file_name": name}
+	if err := s.call(http.MethodPost, s.uploadURL+"/files/upload_sessions", req, &session); err != nil {
+		return "", err
+	}
+	sessionURL := fmt.Sprintf("%s/files/upload_sessions/%s", s.uploadURL, session.ID)
+	abort := func() { _ = s.call(http.MethodDelete, sessionURL, nil, nil) }
+
+	var parts []json.RawMessage
+	whole := sha1.New()
+	buf := make([]byte, session.PartSize)
+	for off := int64(0); off < size; off += session.PartSize {
+		n, err := in.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			abort()
+			return "", err
+		}
+		part := buf[:n]
+		whole.Write(part)
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+int64(n)-1, size))
+		header.Set("Digest", sha1Digest(part))
+		resp, err := s.request(ctx, http.MethodPut, sessionURL, header, part)
+		if err != nil {
+			abort()
+			return "", fmt.Errorf("upload part at %d: %w", off, err)
+		}
+		var result struct {
+			Part json.RawMessage `json:"part"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			abort()
+			return "", err
+		}
+		parts = append(parts, result.Part)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"parts": parts})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Digest", "sha="+base64.StdEncoding.EncodeToString(whole.Sum(nil)))
+	for i := 1; ; i++ {
+		resp, err := s.request(ctx, http.MethodPost, sessionURL+"/commit", header, body)
+		if err != nil {
+			abort()
+			return "", fmt.Errorf("commit upload session: %w", err)
+		}
+		var result struct {
+			Entries []boxItem `json:"entries"`
+		}
+		retry := resp.StatusCode == http.StatusAccepted
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if retry {
+			// the parts are still being processed
+			if i >= boxCommitAttempts {
+				abort()
+				return "", fmt.Errorf("commit upload session: still processing after %d attempts", i)
+			}
+			time.Sleep(boxRetryAfter(resp.Header))
+			continue
+		}
+		if err != nil {
+			abort()
+			return "", err
+		}
+		if len(result.Entries) == 0 {
+			return "", errors.New("box: no file committed")
+		}
+		return result.Entries[0].ID, nil
+	}
+}
+
+// boxRetryAfter is the wait asked by the Retry-After header in seconds, or a
+// second without it.
+func boxRetryAfter(h http.Header) time.Duration {
+	if n, err := strconv.Atoi(h.Get("Retry-After")); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	return time.Second
+}
+
+func (s *boxStorage) upload(parent, name string, in io.Reader) (string, error) {
+	// the upload session needs to know the size ahead, spool large files to disk
+	data, err := ioutil.ReadAll(io.LimitReader(in, s.chunkedThreshold))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) < s.chunkedThreshold {
+		return s.uploadSimple(parent, name, data)
+	}
+	f, err := ioutil.TempFile("", "box")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if _, err = f.Write(data); err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(f, in); err != nil {
+		return "", err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	return s.uploadChunked(parent, name, f, size)
+}
+
+func (s *boxStorage) move(id, parent, name string) error {
+	req := map[string]interface{}{"name": name, "parent": map[string]string{"id": parent}}
+	return s.call(http.MethodPut, fmt.Sprintf("%s/files/%s", s.apiURL, id), req, nil)
+}
+
+// Put uploads the content into the temp folder, then moves it to the destination.
+func (s *boxStorage) Put(key string, in io.Reader) error {
+	p := s.path(key)
+	dir, name := path.Split(p)
+	dirID, err := s.getNode(dir, true)
+	if err != nil {
+		return fmt.Errorf("get node: %w", err)
+	}
+	id, err := s.upload(s.tempdirID, uuid.NewString(), in)
+	if err != nil {
+		return fmt.Errorf("upload temp file: %w", err)
+	}
+	var e *boxError
+	if err = s.move(id, dirID, name); errors.As(err, &e) && e.Status == http.StatusConflict {
+		if err = s.Delete(key); err == nil {
+			err = s.move(id, dirID, name)
+		}
+	}
+	if err != nil {
+		_ = s.call(http.MethodDelete, fmt.Sprintf("%s/files/%s", s.apiURL, id), nil, nil)
+		return fmt.Errorf("move temp file: %w", err)
+	}
+	s.nodeIDCache.Store(strings.Trim(p, "/"), id)
+	return nil
+}
+
+func (s *boxStorage) Delete(key string) error {
+	p := strings.Trim(s.path(key), "/")
+	id, err := s.getNode(p, false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.nodeIDCache.Delete(p)
+	err = s.call(http.MethodDelete, fmt.Sprintf("%s/files/%s", s.apiURL, id), nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+func (s *boxStorage) ListAll(prefix, marker string) (<-chan Object, error) {
+	rootID, err := s.getNode(s.workdir, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.walker.listAll(ctx, rootID, prefix, marker), nil
+}
+
+func (s *boxStorage) init() error {
+	workdirID, err := s.getNode(s.workdir, true)
+	if err != nil {
+		return err
+	}
+	s.walker = newTreeWalker(4, s.listNodes)
+	s.walker.skip = func(key string) bool { return key == driveTempDir+"/" }
+
+	// clean temp dir
+	tempDir := path.Join(s.workdir, driveTempDir)
+	if id, err := s.getNode(tempDir, false); err == nil {
+		s.nodeIDCache.Delete(strings.Trim(tempDir, "/"))
+		if err = s.call(http.MethodDelete, fmt.Sprintf("%s/folders/%s?recursive=true", s.apiURL, id), nil, nil); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if s.tempdirID, err = s.createFolder(workdirID, driveTempDir); err != nil {
+		return err
+	}
+	s.nodeIDCache.Store(strings.Trim(tempDir, "/"), s.tempdirID)
+	return nil
+}
+
+// newBox creates a storage on Box, the endpoint is `box://<folder id>/<path>`
+// where folder id 0 is the root of the account. The accessKey and secretKey
+// are the client id and secret of the OAuth app and token is the refresh
+// token, or a developer token if the client id is empty.
+func newBox(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	u, err := ParseEndpoint(endpoint, EndpointSpec{Scheme: "box", Host: "folder id", Example: "box://0/jfs"})
+	if err != nil {
+		return nil, err
+	}
+	auth := &oauthToken{service: "box", oauthURL: boxOAuth, clientID: accessKey, clientSecret: secretKey}
+	if accessKey == "" {
+		auth.accessToken = token
+	} else {
+		auth.refreshToken = token
+		if data, err := os.ReadFile(boxTokenFile); err == nil {
+			auth.refreshToken = string(data)
+		}
+		auth.onRefresh = func(refreshToken string) {
+			if err := os.WriteFile(boxTokenFile, []byte(refreshToken), 0600); err != nil {
+				logger.Warnf("save box refresh token: %s", err)
+			}
+		}
+	}
+	s := &boxStorage{
+		client:     httpClient,
+		auth:       auth,
+		apiURL:     boxAPI,
+		uploadURL:  boxUpload,
+		rootFolder: u.Host,
+		workdir:    strings.Trim(u.Path, "/"),
+
+		chunkedThreshold: boxChunkedThreshold,
+	}
+	if err = s.init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func init() {
+	Register("box", newBox)
+}
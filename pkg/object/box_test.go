@@ -0,0 +1,374 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockBoxItem struct {
+	boxItem
+	parent string
+	data   []byte
+}
+
+// mockBox emulates the subset of Box API used by boxStorage.
+type mockBox struct {
+	sync.Mutex
+	items    map[string]*mockBoxItem
+	sessions map[string]*mockBoxItem
+	seq      int
+	pageSize int
+	token    string
+	parts    int
+	commits  int
+	aborts   int
+	// the commits answered as still processing
+	processing int
+}
+
+func newMockBox() *mockBox {
+	m := &mockBox{items: make(map[string]*mockBoxItem), sessions: make(map[string]*mockBoxItem), pageSize: 2, token: "access1"}
+	m.items["0"] = &mockBoxItem{boxItem: boxItem{Type: "folder", ID: "0"}}
+	return m
+}
+
+func (m *mockBox) add(parent, typ, name string, data []byte) *mockBoxItem {
+	m.seq++
+	i := &mockBoxItem{boxItem{typ, strconv.Itoa(m.seq + 100), name, int64(len(data)), time.Now().Format(time.RFC3339)}, parent, data}
+	m.items[i.ID] = i
+	return i
+}
+
+func (m *mockBox) child(parent, name string) *mockBoxItem {
+	for _, i := range m.items {
+		if i.parent == parent && i.Name == name {
+			return i
+		}
+	}
+	return nil
+}
+
+func (m *mockBox) remove(id string) {
+	for cid, i := range m.items {
+		if i.parent == id {
+			m.remove(cid)
+		}
+	}
+	delete(m.items, id)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (m *mockBox) conflict(w http.ResponseWriter, existing *mockBoxItem) {
+	writeJSON(w, http.StatusConflict, map[string]interface{}{
+		"status": 409, "code": "item_name_in_use", "message": "Item with the same name already exists",
+		"context_info": map[string]interface{}{"conflicts": []interface{}{existing.boxItem}},
+	})
+}
+
+func (m *mockBox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	if r.URL.Path == "/oauth2/token" {
+		_ = r.ParseForm()
+		if r.Form.Get("refresh_token") != "refresh1" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": m.token, "refresh_token": "refresh1", "expires_in": 3600})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+m.token {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"status": 401, "code": "unauthorized"})
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	notFound := func() {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"status": 404, "code": "not_found"})
+	}
+	var req struct {
+		Name   string `json:"name"`
+		Parent struct {
+			ID string `json:"id"`
+		} `json:"parent"`
+		FolderID string `json:"folder_id"`
+		FileSize int64  `json:"file_size"`
+		FileName string `json:"file_name"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		_ = json.NewDecoder(r.Body).Decode(&req)
+	}
+	switch {
+	case len(parts) == 4 && parts[1] == "folders" && parts[3] == "items":
+		if _, ok := m.items[parts[2]]; !ok {
+			notFound()
+			return
+		}
+		var entries []boxItem
+		for _, i := range m.items {
+			if i.parent == parts[2] {
+				entries = append(entries, i.boxItem)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+		start, _ := strconv.Atoi(r.URL.Query().Get("marker"))
+		end := start + m.pageSize
+		next := strconv.Itoa(end)
+		if end >= len(entries) {
+			end, next = len(entries), ""
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries[start:end], "next_marker": next})
+	case len(parts) == 2 && parts[1] == "folders" && r.Method == http.MethodPost:
+		if e := m.child(req.Parent.ID, req.Name); e != nil {
+			m.conflict(w, e)
+			return
+		}
+		writeJSON(w, http.StatusCreated, m.add(req.Parent.ID, "folder", req.Name, nil).boxItem)
+	case len(parts) == 3 && parts[1] == "folders" && r.Method == http.MethodDelete:
+		if _, ok := m.items[parts[2]]; !ok {
+			notFound()
+			return
+		}
+		m.remove(parts[2])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) >= 3 && parts[0] == "api" && parts[1] == "files" && parts[2] != "content" && parts[2] != "upload_sessions":
+		i, ok := m.items[parts[2]]
+		if !ok || i.Type != "file" {
+			notFound()
+			return
+		}
+		switch {
+		case len(parts) == 4 && parts[3] == "content":
+			data := i.data
+			if rng := r.Header.Get("Range"); rng != "" {
+				start, end, _ := parseRange(rng)
+				if end < 0 || end >= int64(len(data)) {
+					end = int64(len(data)) - 1
+				}
+				data = data[start : end+1]
+				w.WriteHeader(http.StatusPartialContent)
+			}
+			_, _ = w.Write(data)
+		case r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, i.boxItem)
+		case r.Method == http.MethodPut:
+			if e := m.child(req.Parent.ID, req.Name); e != nil {
+				m.conflict(w, e)
+				return
+			}
+			i.parent, i.Name = req.Parent.ID, req.Name
+			writeJSON(w, http.StatusOK, i.boxItem)
+		case r.Method == http.MethodDelete:
+			delete(m.items, i.ID)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case r.URL.Path == "/upload/files/content":
+		var attrs struct {
+			Name   string `json:"name"`
+			Parent struct {
+				ID string `json:"id"`
+			} `json:"parent"`
+		}
+		_ = json.Unmarshal([]byte(r.FormValue("attributes")), &attrs)
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"code": "bad_request"})
+			return
+		}
+		data, _ := io.ReadAll(f)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"entries": []boxItem{m.add(attrs.Parent.ID, "file", attrs.Name, data).boxItem}})
+	case r.URL.Path == "/upload/files/upload_sessions":
+		m.seq++
+		id := fmt.Sprintf("session%d", m.seq)
+		m.sessions[id] = &mockBoxItem{boxItem: boxItem{Name: req.FileName, Size: req.FileSize}, parent: req.FolderID}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"id": id, "part_size": 4, "total_parts": (req.FileSize + 3) / 4})
+	case len(parts) == 4 && parts[2] == "upload_sessions" && r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if sha1Digest(data) != r.Header.Get("Digest") {
+			writeJSON(w, http.StatusPreconditionFailed, map[string]string{"code": "bad_digest"})
+			return
+		}
+		m.parts++
+		m.sessions[parts[3]].data = append(m.sessions[parts[3]].data, data...)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"part": map[string]interface{}{"size": len(data)}})
+	case len(parts) == 4 && parts[2] == "upload_sessions" && r.Method == http.MethodDelete:
+		m.aborts++
+		delete(m.sessions, parts[3])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 5 && parts[4] == "commit":
+		m.commits++
+		if m.processing > 0 {
+			m.processing--
+			w.Header().Set("Retry-After", "0")
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{"entries": []boxItem{}})
+			return
+		}
+		s := m.sessions[parts[3]]
+		data := s.data
+		delete(m.sessions, parts[3])
+		if sha1Digest(data) != r.Header.Get("Digest") || int64(len(data)) != s.Size {
+			writeJSON(w, http.StatusPreconditionFailed, map[string]string{"code": "bad_digest"})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"entries": []boxItem{m.add(s.parent, "file", s.Name, data).boxItem}})
+	default:
+		notFound()
+	}
+}
+
+func newTestBox(t *testing.T, m *mockBox, auth *oauthToken) *boxStorage {
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+	auth.oauthURL = srv.URL + "/oauth2/token"
+	s := &boxStorage{
+		client:           srv.Client(),
+		auth:             auth,
+		apiURL:           srv.URL + "/api",
+		uploadURL:        srv.URL + "/upload",
+		rootFolder:       "0",
+		workdir:          "jfs",
+		chunkedThreshold: 30,
+	}
+	if err := s.init(); err != nil {
+		t.Fatalf("init box: %s", err)
+	}
+	return s
+}
+
+func TestBox(t *testing.T) {
+	m := newMockBox()
+	s := newTestBox(t, m, &oauthToken{service: "box", accessToken: "access1"})
+
+	if _, err := get(s, "chunks/0/0/1_0_4", 0, -1); err == nil {
+		t.Fatalf("get not existed object should fail")
+	}
+	keys := []string{"chunks/0/0/1_0_4", "chunks/0/1/2_0_4", "chunks/1/0/3_0_4", "meta"}
+	for _, k := range keys {
+		if err := s.Put(k, bytes.NewReader([]byte("data-"+k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	if err := s.Put("meta", bytes.NewReader([]byte("new meta"))); err != nil {
+		t.Fatalf("overwrite: %s", err)
+	}
+	if d, err := get(s, "meta", 0, -1); err != nil || d != "new meta" {
+		t.Fatalf("get meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, 4); err != nil || d != "meta" {
+		t.Fatalf("get range of meta: %q %v", d, err)
+	}
+	if o, err := s.Head("chunks/0/1/2_0_4"); err != nil || o.Size() != int64(len("data-chunks/0/1/2_0_4")) {
+		t.Fatalf("head: %v %v", o, err)
+	}
+
+	// a fresh client resolves the paths by walking the folders
+	s2 := &boxStorage{client: s.client, auth: s.auth, apiURL: s.apiURL, uploadURL: s.uploadURL, rootFolder: "0", workdir: "jfs", chunkedThreshold: 30}
+	if err := s2.init(); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ch, err := s2.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %v, but got %v", keys, got)
+	}
+	if d, err := get(s2, "chunks/1/0/3_0_4", 0, -1); err != nil || d != "data-chunks/1/0/3_0_4" {
+		t.Fatalf("get: %q %v", d, err)
+	}
+
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete not existed object: %s", err)
+	}
+	if _, err := s.Head("meta"); err == nil {
+		t.Fatalf("meta should be deleted")
+	}
+	m.Lock()
+	defer m.Unlock()
+	for _, i := range m.items {
+		if i.parent == s.tempdirID {
+			t.Fatalf("temp file %s is left", i.Name)
+		}
+	}
+}
+
+func TestBoxChunkedUpload(t *testing.T) {
+	m := newMockBox()
+	s := newTestBox(t, m, &oauthToken{service: "box", accessToken: "access1"})
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	if err := s.Put("large", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put large: %s", err)
+	}
+	if m.parts != 9 || m.commits != 1 {
+		t.Fatalf("expect 9 parts and 1 commit, but got %d and %d", m.parts, m.commits)
+	}
+	if d, err := get(s, "large", 0, -1); err != nil || d != string(data) {
+		t.Fatalf("get large: %q %v", d, err)
+	}
+
+	// committed after being processed
+	m.commits, m.processing = 0, 3
+	if err := s.Put("large2", bytes.NewReader(data)); err != nil || m.commits != 4 {
+		t.Fatalf("put large2: %d commits, %v", m.commits, err)
+	}
+	// the session is aborted if it's committed by none of the attempts
+	m.commits, m.processing = 0, boxCommitAttempts
+	if err := s.Put("large3", bytes.NewReader(data)); err == nil || m.commits != boxCommitAttempts || m.aborts != 1 {
+		t.Fatalf("put large3: %d commits, %d aborts, %v", m.commits, m.aborts, err)
+	}
+	if len(m.sessions) != 0 {
+		t.Fatalf("sessions are left: %v", m.sessions)
+	}
+}
+
+func TestBoxRefreshToken(t *testing.T) {
+	m := newMockBox()
+	var saved string
+	s := newTestBox(t, m, &oauthToken{service: "box", clientID: "id", clientSecret: "secret", refreshToken: "refresh1", onRefresh: func(t string) { saved = t }})
+	if saved != "refresh1" {
+		t.Fatalf("refresh token should be saved")
+	}
+	// the access token is revoked, a new one should be requested
+	m.Lock()
+	m.token = "access2"
+	m.Unlock()
+	if err := s.Put("a", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatalf("put after token revoked: %s", err)
+	}
+	if s.auth.accessToken != "access2" {
+		t.Fatalf("access token is not refreshed")
+	}
+}
@@ -0,0 +1,482 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BulkMode controls how bulk operations react to the failure of a single key.
+type BulkMode int
+
+const (
+	// BulkDefault uses the default mode of the operation: best-effort for
+	// deletes and fail-fast for scrub.
+	BulkDefault BulkMode = iota
+	// BulkFailFast returns at the first failed key.
+	BulkFailFast
+	// BulkBestEffort processes all the keys and returns a BulkError listing
+	// every failed one.
+	BulkBestEffort
+)
+
+func (m BulkMode) or(def BulkMode) BulkMode {
+	if m == BulkDefault {
+		return def
+	}
+	return m
+}
+
+// BulkError is the aggregated error of a best-effort bulk operation.
+type BulkError struct {
+	Op     string
+	Errors map[string]error
+}
+
+func (e *BulkError) Error() string {
+	keys := make([]string, 0, len(e.Errors))
+	for k := range e.Errors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	msgs := make([]string, len(keys))
+	for i, k := range keys {
+		msgs[i] = fmt.Sprintf("%s: %s", k, e.Errors[k])
+	}
+	return fmt.Sprintf("%s failed for %d keys: %s", e.Op, len(keys), strings.Join(msgs, "; "))
+}
+
+// BulkRetryDeadline is the wall-clock time a bulk operation (DeleteMulti,
+// DeleteAll, DeleteAllConcurrently and Scrub) spends on a key across all the
+// attempts, the retryable failures (see ClassifyError) are retried within it.
+// Once it's passed, the key is abandoned with the last error, even if an
+// attempt is still running, and the operation moves on, so a bad object
+// can't stall the others. It's not the timeout of an attempt, which is up to
+// the storage. 0 disables the retries.
+var BulkRetryDeadline time.Duration
+
+// BulkRetryBackoff is the wait before the first retry of a key in a bulk
+// operation, doubled for every next one.
+var BulkRetryBackoff = time.Second
+
+type bulkRunner struct {
+	op   string
+	mode BulkMode
+	errs map[string]error
+
+	// the keys are retried within deadline if it's positive
+	store    ObjectStorage
+	clock    Clock
+	deadline time.Duration
+	backoff  time.Duration
+}
+
+// newBulkRunner returns a bulkRunner retrying the keys of store as
+// BulkRetryDeadline.
+func newBulkRunner(store ObjectStorage, op string, mode BulkMode) *bulkRunner {
+	return &bulkRunner{op: op, mode: mode, store: store, clock: SystemClock,
+		deadline: BulkRetryDeadline, backoff: BulkRetryBackoff}
+}
+
+// attempt calls fn for the key, and retries the retryable failures until the
+// deadline of the key. An attempt still running at the deadline is left
+// behind.
+func (b *bulkRunner) attempt(key string, fn func(string) error) error {
+	if b.deadline <= 0 {
+		return fn(key)
+	}
+	expire := b.clock.After(b.deadline)
+	var last error
+	abandon := func(attempts int) error {
+		if last == nil {
+			last = errors.New("no response")
+		}
+		logger.Warnf("Abandon %s %s after %s (%d attempts): %s", b.op, key, b.deadline, attempts, last)
+		return fmt.Errorf("abandoned after %s: %w", b.deadline, last)
+	}
+	backoff := b.backoff
+	for i := 1; ; i++ {
+		done := make(chan error, 1)
+		go func() { done <- fn(key) }()
+		select {
+		case last = <-done:
+		case <-expire:
+			return abandon(i)
+		}
+		if last == nil || ClassifyError(b.store, last) == ErrorPermanent {
+			return last
+		}
+		logger.Debugf("%s %s (attempt %d): %s, retry in %s", b.op, key, i, last, backoff)
+		select {
+		case <-b.clock.After(backoff):
+		case <-expire:
+			return abandon(i)
+		}
+		backoff *= 2
+	}
+}
+
+// record keeps the result of the key, and returns false if the operation
+// should stop.
+func (b *bulkRunner) record(key string, err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	if b.mode == BulkFailFast {
+		return false, fmt.Errorf("%s %s: %w", b.op, key, err)
+	}
+	if b.errs == nil {
+		b.errs = make(map[string]error)
+	}
+	b.errs[key] = err
+	return true, nil
+}
+
+// run calls fn for the key, and returns false if the operation should stop.
+func (b *bulkRunner) run(key string, fn func(string) error) (bool, error) {
+	return b.record(key, b.attempt(key, fn))
+}
+
+func (b *bulkRunner) result() error {
+	if len(b.errs) > 0 {
+		return &BulkError{b.op, b.errs}
+	}
+	return nil
+}
+
+// BatchDeleter is implemented by the storages deleting many keys in one call.
+type BatchDeleter interface {
+	// DeleteMulti deletes the keys, the failed ones are returned as a
+	// BulkError. It returns notSupported if it can't, e.g. a wrapper of a
+	// storage without it.
+	DeleteMulti(keys []string) error
+}
+
+// the number of keys listed before they are deleted in a batch
+const deleteBatchSize = 1000
+
+// batchDeleting tells whether the keys are deleted in batches, which are
+// best-effort, so not for BulkFailFast.
+func batchDeleting(store ObjectStorage, mode BulkMode) bool {
+	_, ok := store.(BatchDeleter)
+	return ok && mode != BulkFailFast
+}
+
+// batchDelete deletes the keys by the BatchDeleter of store, and returns the
+// keys left to delete one by one: those failed in the batch, or all of them if
+// store can't.
+func batchDelete(store ObjectStorage, keys []string) []string {
+	err := store.(BatchDeleter).DeleteMulti(keys)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, notSupported) {
+		return keys
+	}
+	var be *BulkError
+	if !errors.As(err, &be) {
+		logger.Warnf("Delete %d keys in a batch: %s", len(keys), err)
+		return keys
+	}
+	failed := make([]string, 0, len(be.Errors))
+	for key := range be.Errors {
+		failed = append(failed, key)
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// DeleteMulti deletes the given keys from the object storage, in batches by
+// a BatchDeleter unless mode is BulkFailFast. The keys failed in a batch are
+// deleted again one by one, with the retries of BulkRetryDeadline.
+func DeleteMulti(store ObjectStorage, keys []string, mode BulkMode) error {
+	b := newBulkRunner(store, "delete", mode.or(BulkBestEffort))
+	if batchDeleting(store, b.mode) && len(keys) > 0 {
+		keys = batchDelete(store, keys)
+	}
+	for _, key := range keys {
+		if ok, err := b.run(key, store.Delete); !ok {
+			return err
+		}
+	}
+	return b.result()
+}
+
+func walkBulk(store ObjectStorage, prefix string, b *bulkRunner, fn func(string) error) error {
+	ch, err := ListAll(store, prefix, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for range ch {
+		}
+	}()
+	for o := range ch {
+		if o == nil {
+			return errors.New("list failed")
+		}
+		if o.IsDir() {
+			continue
+		}
+		if ok, err := b.run(o.Key(), fn); !ok {
+			return err
+		}
+	}
+	return b.result()
+}
+
+// DeleteAll deletes all the objects with the prefix, in batches as
+// DeleteMulti.
+func DeleteAll(store ObjectStorage, prefix string, mode BulkMode) error {
+	b := newBulkRunner(store, "delete", mode.or(BulkBestEffort))
+	if !batchDeleting(store, b.mode) {
+		return walkBulk(store, prefix, b, store.Delete)
+	}
+	ch, err := ListAll(store, prefix, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for range ch {
+		}
+	}()
+	var batch []string
+	flush := func() {
+		for _, key := range batchDelete(store, batch) {
+			_, _ = b.run(key, store.Delete)
+		}
+		batch = batch[:0]
+	}
+	for o := range ch {
+		if o == nil {
+			return errors.New("list failed")
+		}
+		if o.IsDir() {
+			continue
+		}
+		if batch = append(batch, o.Key()); len(batch) == deleteBatchSize {
+			flush()
+		}
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	return b.result()
+}
+
+// DirDeleter is implemented by the storages removing a directory with all
+// the objects inside in one call, e.g. the drives like Aliyun.
+type DirDeleter interface {
+	// DeleteDir deletes all the objects with the prefix dir, which ends with
+	// "/", it returns notSupported if it can't.
+	DeleteDir(dir string) error
+}
+
+// DeleteConcurrency is implemented by the storages telling how many deletes
+// could be issued in parallel within their rate limits.
+type DeleteConcurrency interface {
+	DeleteConcurrency() int
+}
+
+// default number of the parallel deletes of DeleteAllConcurrently
+const defaultDeleteConcurrency = 16
+
+func deleteConcurrency(store ObjectStorage) int {
+	if d, ok := store.(DeleteConcurrency); ok && d.DeleteConcurrency() > 0 {
+		return d.DeleteConcurrency()
+	}
+	return defaultDeleteConcurrency
+}
+
+// DeleteAllConcurrently deletes all the objects with the prefix as DeleteAll,
+// but by at most threads deletes (or batches of them) in parallel (those of
+// the storage if it's not positive), so a slow key doesn't block the others.
+// A prefix of a directory is removed in one call by a DirDeleter, but not the
+// empty one, whose objects are deleted as they are listed.
+func DeleteAllConcurrently(store ObjectStorage, prefix string, mode BulkMode, threads int) error {
+	if d, ok := store.(DirDeleter); ok && strings.HasSuffix(prefix, "/") {
+		if err := d.DeleteDir(prefix); !errors.Is(err, notSupported) {
+			return err
+		}
+	}
+	if threads <= 0 {
+		threads = deleteConcurrency(store)
+	}
+	ch, err := ListAll(store, prefix, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for range ch {
+		}
+	}()
+
+	b := newBulkRunner(store, "delete", mode.or(BulkBestEffort))
+	batching := batchDeleting(store, b.mode)
+	var mu sync.Mutex
+	var failed error
+	batches := make(chan []string, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for keys := range batches {
+				if batching {
+					keys = batchDelete(store, keys)
+				}
+				for _, key := range keys {
+					err := b.attempt(key, store.Delete)
+					if err == nil {
+						continue
+					}
+					mu.Lock()
+					if ok, err := b.record(key, err); !ok && failed == nil {
+						failed = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	stopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed != nil
+	}
+	size := 1
+	if batching {
+		size = deleteBatchSize
+	}
+	var batch []string
+	for o := range ch {
+		if o == nil {
+			mu.Lock()
+			if failed == nil {
+				failed = errors.New("list failed")
+			}
+			mu.Unlock()
+			batch = nil
+			break
+		}
+		if stopped() {
+			batch = nil
+			break
+		}
+		if o.IsDir() {
+			continue
+		}
+		if batch = append(batch, o.Key()); len(batch) == size {
+			batches <- batch
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+	if failed != nil {
+		return failed
+	}
+	return b.result()
+}
+
+// Scrub reads all the objects with the prefix to check that they are readable.
+func Scrub(store ObjectStorage, prefix string, mode BulkMode) error {
+	return walkBulk(store, prefix, newBulkRunner(store, "scrub", mode.or(BulkFailFast)), func(key string) error {
+		r, err := store.Get(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(ioutil.Discard, r)
+		return err
+	})
+}
+
+// the bytes read from every object checked by Fsck
+const fsckReadSize = 4 << 10
+
+// sampled tells whether key is in the sample fraction of the keys, which is
+// decided by the hash of it, so the same keys are checked in every run.
+func sampled(key string, sample float64) bool {
+	if sample >= 1 {
+		return true
+	}
+	return float64(crc32.ChecksumIEEE([]byte(key))) < sample*(1<<32)
+}
+
+// Fsck lists the objects with the prefix and reads the first few bytes of the
+// sample fraction (1.0 for all) of them, to find the objects listed but not
+// readable, e.g. no permission, corrupted or partially uploaded. The failed
+// ones are passed to report, the error returned is only of the listing.
+func Fsck(store ObjectStorage, prefix string, sample float64, report func(key string, err error)) error {
+	ch, err := ListAll(store, prefix, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for range ch {
+		}
+	}()
+	for o := range ch {
+		if o == nil {
+			return errors.New("list failed")
+		}
+		if o.IsDir() || !sampled(o.Key(), sample) {
+			continue
+		}
+		if err := fsckObject(store, o); err != nil {
+			report(o.Key(), err)
+		}
+	}
+	return nil
+}
+
+func fsckObject(store ObjectStorage, o Object) error {
+	expect := o.Size()
+	if expect > fsckReadSize {
+		expect = fsckReadSize
+	}
+	// a range of an empty object is not satisfiable in some storages
+	var limit int64 = -1
+	if expect > 0 {
+		limit = expect
+	}
+	r, err := store.Get(o.Key(), 0, limit)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(r, expect))
+	if err != nil {
+		return err
+	}
+	if n != expect {
+		return fmt.Errorf("read %d bytes of %d", n, expect)
+	}
+	return nil
+}
@@ -0,0 +1,458 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingStore fails Get and Delete of the chosen keys.
+type failingStore struct {
+	ObjectStorage
+	bad     map[string]bool
+	visited []string
+}
+
+var errInjected = errors.New("injected error")
+
+func (s *failingStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	s.visited = append(s.visited, key)
+	if s.bad[key] {
+		return nil, errInjected
+	}
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func (s *failingStore) Delete(key string) error {
+	s.visited = append(s.visited, key)
+	if s.bad[key] {
+		return errInjected
+	}
+	return s.ObjectStorage.Delete(key)
+}
+
+func newFailingStore(t *testing.T, bad ...string) *failingStore {
+	m, _ := newMem("bulk", "", "", "")
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := m.Put(k, bytes.NewReader([]byte(k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	s := &failingStore{ObjectStorage: m, bad: make(map[string]bool)}
+	for _, k := range bad {
+		s.bad[k] = true
+	}
+	return s
+}
+
+func TestBulkDelete(t *testing.T) {
+	s := newFailingStore(t, "b", "c")
+	err := DeleteMulti(s, []string{"a", "b", "c", "d"}, BulkDefault)
+	var be *BulkError
+	if !errors.As(err, &be) || len(be.Errors) != 2 || be.Errors["b"] == nil || be.Errors["c"] == nil {
+		t.Fatalf("expect failures of b and c, but got %v", err)
+	}
+	if len(s.visited) != 4 {
+		t.Fatalf("best-effort should visit all keys: %v", s.visited)
+	}
+	if _, err := s.Head("d"); err == nil {
+		t.Fatalf("d should be deleted")
+	}
+
+	s = newFailingStore(t, "b")
+	if err := DeleteMulti(s, []string{"a", "b", "c"}, BulkFailFast); !errors.Is(err, errInjected) {
+		t.Fatalf("expect injected error, but got %v", err)
+	}
+	if len(s.visited) != 2 {
+		t.Fatalf("fail-fast should stop at b: %v", s.visited)
+	}
+
+	s = newFailingStore(t, "c")
+	if err := DeleteAll(s, "", BulkDefault); !errors.As(err, &be) || len(be.Errors) != 1 {
+		t.Fatalf("expect failure of c, but got %v", err)
+	}
+	if objs, _ := s.List("", "", 10); len(objs) != 1 || objs[0].Key() != "c" {
+		t.Fatalf("only c should be left: %v", objs)
+	}
+	s = newFailingStore(t, "b")
+	if err := DeleteAll(s, "", BulkFailFast); !errors.Is(err, errInjected) {
+		t.Fatalf("expect injected error, but got %v", err)
+	}
+	if objs, _ := s.List("", "", 10); len(objs) != 3 {
+		t.Fatalf("c and d should not be deleted: %v", objs)
+	}
+}
+
+// retryingStore fails Delete of bad always, of flaky twice, and hangs on
+// the deletes of stuck.
+type retryingStore struct {
+	ObjectStorage
+	mu       sync.Mutex
+	attempts map[string]int
+	stuck    chan struct{}
+}
+
+func (s *retryingStore) Delete(key string) error {
+	s.mu.Lock()
+	s.attempts[key]++
+	n := s.attempts[key]
+	s.mu.Unlock()
+	switch {
+	case key == "bad", key == "flaky" && n <= 2:
+		return errInjected
+	case key == "denied":
+		return os.ErrPermission
+	case key == "stuck":
+		<-s.stuck
+	}
+	return s.ObjectStorage.Delete(key)
+}
+
+func TestBulkRetryDeadline(t *testing.T) {
+	defer func(d, b time.Duration) { BulkRetryDeadline, BulkRetryBackoff = d, b }(BulkRetryDeadline, BulkRetryBackoff)
+	BulkRetryDeadline, BulkRetryBackoff = 300*time.Millisecond, 5*time.Millisecond
+
+	m, _ := newMem("bulk", "", "", "")
+	for i := 0; i < 20; i++ {
+		_ = m.Put(fmt.Sprintf("ok%02d", i), bytes.NewReader([]byte("x")))
+	}
+	for _, k := range []string{"bad", "denied", "flaky"} {
+		_ = m.Put(k, bytes.NewReader([]byte("x")))
+	}
+	s := &retryingStore{ObjectStorage: m, attempts: make(map[string]int)}
+	start := time.Now()
+	err := DeleteAllConcurrently(s, "", BulkDefault, 4)
+	var be *BulkError
+	if !errors.As(err, &be) || len(be.Errors) != 2 || !errors.Is(be.Errors["bad"], errInjected) ||
+		!errors.Is(be.Errors["denied"], os.ErrPermission) {
+		t.Fatalf("expect failures of bad and denied, but got %v", err)
+	}
+	if used := time.Since(start); used > 5*BulkRetryDeadline {
+		t.Fatalf("the batch took %s with a deadline %s", used, BulkRetryDeadline)
+	}
+	if s.attempts["bad"] < 2 || s.attempts["flaky"] != 3 || s.attempts["denied"] != 1 {
+		t.Fatalf("attempts: %v", s.attempts)
+	}
+	if objs, _ := m.List("", "", 100); len(objs) != 2 {
+		t.Fatalf("only bad and denied should be left: %v", objs)
+	}
+
+	// a hanging attempt is abandoned too
+	_ = m.Put("stuck", bytes.NewReader([]byte("x")))
+	_ = m.Put("ok", bytes.NewReader([]byte("x")))
+	s.stuck = make(chan struct{})
+	defer close(s.stuck)
+	start = time.Now()
+	err = DeleteMulti(s, []string{"stuck", "ok"}, BulkDefault)
+	if !errors.As(err, &be) || len(be.Errors) != 1 || be.Errors["stuck"] == nil {
+		t.Fatalf("expect failure of stuck, but got %v", err)
+	}
+	if used := time.Since(start); used < BulkRetryDeadline || used > 5*BulkRetryDeadline {
+		t.Fatalf("stuck was abandoned after %s with a deadline %s", used, BulkRetryDeadline)
+	}
+	if _, err = m.Head("ok"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ok should be deleted: %v", err)
+	}
+}
+
+// batchStore deletes the keys in batches, the bad keys fail in batches, and
+// the worse ones fail always.
+type batchStore struct {
+	ObjectStorage
+	mu         sync.Mutex
+	bad, worse map[string]bool
+	batches    [][]string
+}
+
+func (s *batchStore) Delete(key string) error {
+	if s.worse[key] {
+		return errInjected
+	}
+	return s.ObjectStorage.Delete(key)
+}
+
+func (s *batchStore) DeleteMulti(keys []string) error {
+	s.mu.Lock()
+	s.batches = append(s.batches, keys)
+	s.mu.Unlock()
+	b := &bulkRunner{op: "delete", mode: BulkBestEffort}
+	for _, key := range keys {
+		_, _ = b.run(key, func(key string) error {
+			if s.bad[key] {
+				return errInjected
+			}
+			return s.Delete(key)
+		})
+	}
+	return b.result()
+}
+
+func TestBulkBatchDelete(t *testing.T) {
+	m, _ := newMem("bulk", "", "", "")
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			_ = m.Put(fmt.Sprintf("p/k%04d", i), bytes.NewReader([]byte("x")))
+		}
+	}
+	b := &batchStore{ObjectStorage: m, bad: map[string]bool{"p/k0001": true}, worse: map[string]bool{"p/k0002": true}}
+	s := WithPrefix(b, "p/")
+	if c := Capabilities(s); !c.DeleteMulti {
+		t.Fatalf("batch delete should be forwarded: %s", c)
+	}
+	put(3)
+	err := DeleteMulti(s, []string{"k0000", "k0001", "k0002"}, BulkDefault)
+	var be *BulkError
+	if !errors.As(err, &be) || len(be.Errors) != 1 || !errors.Is(be.Errors["k0002"], errInjected) {
+		t.Fatalf("expect failure of k0002, but got %v", err)
+	}
+	// the key failed in the batch is deleted again
+	if _, err = m.Head("p/k0001"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("k0001 should be deleted: %v", err)
+	}
+	if len(b.batches) != 1 || len(b.batches[0]) != 3 || b.batches[0][0] != "p/k0000" {
+		t.Fatalf("expect one batch of the prefixed keys: %v", b.batches)
+	}
+	delete(b.worse, "p/k0002")
+	b.batches = nil
+	put(2500)
+	if err = DeleteAll(s, "", BulkDefault); err != nil {
+		t.Fatalf("delete all: %s", err)
+	}
+	if len(b.batches) != 3 || len(b.batches[0]) != deleteBatchSize || len(b.batches[2]) != 500 {
+		t.Fatalf("expect 3 batches, got %d", len(b.batches))
+	}
+	b.batches = nil
+	put(2500)
+	b.worse["p/k0007"] = true
+	if err = DeleteAllConcurrently(s, "", BulkDefault, 2); !errors.As(err, &be) || len(be.Errors) != 1 || be.Errors["k0007"] == nil {
+		t.Fatalf("expect failure of k0007, but got %v", err)
+	}
+	if len(b.batches) != 3 {
+		t.Fatalf("expect 3 batches, got %d", len(b.batches))
+	}
+	// fail-fast deletes one by one
+	b.batches = nil
+	if err = DeleteMulti(s, []string{"k0007"}, BulkFailFast); !errors.Is(err, errInjected) || len(b.batches) != 0 {
+		t.Fatalf("fail-fast delete: %v, %d batches", err, len(b.batches))
+	}
+}
+
+func TestBulkScrub(t *testing.T) {
+	s := newFailingStore(t)
+	if err := Scrub(s, "", BulkDefault); err != nil {
+		t.Fatalf("scrub: %s", err)
+	}
+
+	s = newFailingStore(t, "b", "d")
+	if err := Scrub(s, "", BulkDefault); !errors.Is(err, errInjected) {
+		t.Fatalf("expect injected error, but got %v", err)
+	}
+	if len(s.visited) != 2 {
+		t.Fatalf("scrub should fail fast by default: %v", s.visited)
+	}
+
+	s = newFailingStore(t, "b", "d")
+	var be *BulkError
+	if err := Scrub(s, "", BulkBestEffort); !errors.As(err, &be) || len(be.Errors) != 2 {
+		t.Fatalf("expect failures of b and d, but got %v", err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	s := newFailingStore(t, "b", "d")
+	_ = s.ObjectStorage.Put("empty", bytes.NewReader(nil))
+	reported := make(map[string]error)
+	report := func(key string, err error) { reported[key] = err }
+	if err := Fsck(s, "", 1, report); err != nil {
+		t.Fatalf("fsck: %s", err)
+	}
+	if len(reported) != 2 || !errors.Is(reported["b"], errInjected) || !errors.Is(reported["d"], errInjected) {
+		t.Fatalf("expect failures of b and d, but got %v", reported)
+	}
+
+	s = newFailingStore(t, "b")
+	reported = make(map[string]error)
+	if err := Fsck(s, "", 0, report); err != nil || len(reported) != 0 || len(s.visited) != 0 {
+		t.Fatalf("nothing should be checked: %v %v %v", err, reported, s.visited)
+	}
+
+	m, _ := newMem("bulk", "", "", "")
+	for i := 0; i < 1000; i++ {
+		_ = m.Put(fmt.Sprintf("chunks/%d", i), bytes.NewReader([]byte("x")))
+	}
+	s = &failingStore{ObjectStorage: m}
+	_ = Fsck(s, "chunks/", 0.1, report)
+	if len(s.visited) < 50 || len(s.visited) > 150 {
+		t.Fatalf("about 100 objects should be checked, but got %d", len(s.visited))
+	}
+	checked := s.visited
+	s.visited = nil
+	_ = Fsck(s, "chunks/", 0.1, report)
+	if fmt.Sprint(s.visited) != fmt.Sprint(checked) {
+		t.Fatalf("the same objects should be checked")
+	}
+}
+
+// slowDeleter counts the deletes of every key and the deletes in flight.
+type slowDeleter struct {
+	ObjectStorage
+	delay    time.Duration
+	bad      map[string]bool
+	mu       sync.Mutex
+	deleted  map[string]int
+	inflight int
+	peak     int
+}
+
+func newSlowDeleter(tb testing.TB, n int, delay time.Duration) *slowDeleter {
+	m, _ := newMem("bulk", "", "", "")
+	for i := 0; i < n; i++ {
+		if err := m.Put(fmt.Sprintf("dir/%05d", i), bytes.NewReader(nil)); err != nil {
+			tb.Fatalf("put: %s", err)
+		}
+	}
+	return &slowDeleter{ObjectStorage: m, delay: delay, bad: make(map[string]bool), deleted: make(map[string]int)}
+}
+
+func (s *slowDeleter) Delete(key string) error {
+	s.mu.Lock()
+	s.deleted[key]++
+	if s.inflight++; s.inflight > s.peak {
+		s.peak = s.inflight
+	}
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+	if s.bad[key] {
+		return errInjected
+	}
+	return s.ObjectStorage.Delete(key)
+}
+
+func TestDeleteAllConcurrently(t *testing.T) {
+	s := newSlowDeleter(t, 200, time.Millisecond)
+	s.bad["dir/00042"] = true
+	var be *BulkError
+	if err := DeleteAllConcurrently(s, "dir/", BulkDefault, 4); !errors.As(err, &be) || len(be.Errors) != 1 || be.Errors["dir/00042"] == nil {
+		t.Fatalf("expect failure of dir/00042, but got %v", err)
+	}
+	if len(s.deleted) != 200 {
+		t.Fatalf("expect 200 keys deleted, but got %d", len(s.deleted))
+	}
+	for k, n := range s.deleted {
+		if n != 1 {
+			t.Fatalf("%s is deleted %d times", k, n)
+		}
+	}
+	if s.peak > 4 || s.peak < 2 {
+		t.Fatalf("expect at most 4 deletes in parallel, but got %d", s.peak)
+	}
+	if objs, _ := s.List("", "", 10); len(objs) != 1 || objs[0].Key() != "dir/00042" {
+		t.Fatalf("only dir/00042 should be left: %v", objs)
+	}
+
+	s = newSlowDeleter(t, 200, 0)
+	s.bad["dir/00010"] = true
+	if err := DeleteAllConcurrently(s, "", BulkFailFast, 4); !errors.Is(err, errInjected) {
+		t.Fatalf("expect injected error, but got %v", err)
+	}
+	if len(s.deleted) == 200 {
+		t.Fatalf("fail-fast should stop after dir/00010")
+	}
+}
+
+func TestAliyunDeleteDir(t *testing.T) {
+	d := newFakeDrive()
+	opts := defaultAliyunOptions
+	opts.fanout = 4
+	s := newTestAliyun(t, d, opts)
+	for _, k := range []string{"dir/a", "dir/b", "dir/sub/c", "other"} {
+		if err := s.Put(k, bytes.NewReader([]byte(k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	removes := d.called("Remove")
+	if err := DeleteAllConcurrently(s, "dir/", BulkDefault, 0); err != nil {
+		t.Fatalf("delete dir/: %s", err)
+	}
+	if n := d.called("Remove") - removes; n != 1 {
+		t.Fatalf("expect the folder removed in one call, but got %d", n)
+	}
+	if objs, err := s.List("", "", 10); err != nil || len(objs) != 1 || objs[0].Key() != "other" {
+		t.Fatalf("only other should be left: %+v %v", objs, err)
+	}
+	if _, err := s.Head("dir/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head dir/a: %v", err)
+	}
+	if err := DeleteAllConcurrently(s, "missing/", BulkDefault, 0); err != nil {
+		t.Fatalf("delete missing/: %s", err)
+	}
+	// not a directory
+	if err := DeleteAllConcurrently(s, "oth", BulkDefault, 0); err != nil {
+		t.Fatalf("delete oth: %s", err)
+	}
+	if objs, _ := s.List("", "", 10); len(objs) != 0 {
+		t.Fatalf("all should be deleted: %+v", objs)
+	}
+	// the workdir is only removed by Purge
+	for _, k := range []string{"dir/a", "other"} {
+		_ = s.Put(k, bytes.NewReader([]byte(k)))
+	}
+	if err := s.DeleteDir(""); !errors.Is(err, notSupported) {
+		t.Fatalf("delete the workdir: %v", err)
+	}
+	removes = d.called("Remove")
+	if err := DeleteAllConcurrently(s, "", BulkDefault, 0); err != nil {
+		t.Fatalf("delete all: %s", err)
+	}
+	if n := d.called("Remove") - removes; n != 2 {
+		t.Fatalf("expect the objects removed one by one, but got %d removes", n)
+	}
+	if objs, _ := s.List("", "", 10); len(objs) != 0 {
+		t.Fatalf("all should be deleted: %+v", objs)
+	}
+	if d.lookup("/jfs/dir") == nil {
+		t.Fatalf("the folders should be kept")
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?delete-concurrency=0"); err == nil {
+		t.Fatalf("zero delete-concurrency should be invalid")
+	}
+}
+
+func BenchmarkDeleteAllConcurrently(b *testing.B) {
+	for _, threads := range []int{1, 16} {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				s := newSlowDeleter(b, 1000, 100*time.Microsecond)
+				b.StartTimer()
+				if err := DeleteAllConcurrently(s, "", BulkDefault, threads); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
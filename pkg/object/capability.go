@@ -0,0 +1,133 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CapabilitySet tells which optional operations are implemented by an
+// object storage, besides the ones of ObjectStorage.
+type CapabilitySet struct {
+	// Copy(dst, src string) error, copy inside the storage
+	Copy bool
+	// PutIfAbsent(key string, in io.Reader) error
+	PutIfAbsent bool
+	// Prefetch(keys []string), warm up the metadata of keys
+	Prefetch bool
+	// BatchDeleter, delete in batch
+	DeleteMulti bool
+	// SetKeyLocker(l KeyLocker), serialize writes across clients
+	KeyLocker bool
+	// SinceLister, filter the listing by mtime
+	ListSince bool
+	// RecentLister, list the objects in the order of mtime
+	ListRecent bool
+	// Purger, remove all the objects at once
+	Purge bool
+	// MtimeChanger
+	Chtimes bool
+	// MtimePutter, set the mtime of an object when it's written
+	PutMtime bool
+	// RangeCopier, copy a range of an object inside the storage
+	CopyRange bool
+	// Swapper, exchange the contents of two objects
+	Swap bool
+	// Renamer, move an object without copying
+	Rename bool
+	// BufferGetter, read a range into the buffer of the caller
+	GetInto bool
+	// VersionGetter, read a range only if the object is not changed
+	GetIfMatch bool
+	// RangesGetter, read several ranges in one request
+	GetRanges bool
+	// ResultPutter, report the checksum of an object written
+	PutResult bool
+	// Watcher, notify the changes of objects
+	Watch bool
+	// ContextBinder, make the calls of an operation in a context
+	Context bool
+	// Retainer, lock the objects until their retention
+	Retention bool
+	// MetadataSetter, keep the content type, tags and other metadata
+	Metadata bool
+	// LimitsReporter, report the used and total space
+	Limits bool
+	// SupportSymlink
+	Symlink bool
+	// FileSystem, change the mode and owner of files
+	FileSystem bool
+}
+
+// String lists the names of supported capabilities.
+func (c CapabilitySet) String() string {
+	var names []string
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Bool() {
+			names = append(names, v.Type().Field(i).Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Capabilities probes the optional interfaces implemented by o. Note that a
+// wrapper may implement an operation by forwarding it, which still fails if
+// the underlying storage does not support it.
+func Capabilities(o ObjectStorage) CapabilitySet {
+	var c CapabilitySet
+	_, c.Copy = o.(interface{ Copy(dst, src string) error })
+	_, c.PutIfAbsent = o.(interface {
+		PutIfAbsent(key string, in io.Reader) error
+	})
+	_, c.Prefetch = o.(interface{ Prefetch(keys []string) })
+	_, c.DeleteMulti = o.(BatchDeleter)
+	_, c.KeyLocker = o.(interface{ SetKeyLocker(l KeyLocker) })
+	_, c.ListSince = o.(SinceLister)
+	_, c.ListRecent = o.(RecentLister)
+	_, c.Purge = o.(Purger)
+	_, c.Chtimes = o.(MtimeChanger)
+	_, c.PutMtime = o.(MtimePutter)
+	_, c.CopyRange = o.(RangeCopier)
+	_, c.Swap = o.(Swapper)
+	_, c.Rename = o.(Renamer)
+	_, c.GetInto = o.(BufferGetter)
+	_, c.GetIfMatch = o.(VersionGetter)
+	_, c.GetRanges = o.(RangesGetter)
+	_, c.PutResult = o.(ResultPutter)
+	_, c.Watch = o.(Watcher)
+	_, c.Context = o.(ContextBinder)
+	_, c.Retention = o.(Retainer)
+	_, c.Metadata = o.(MetadataSetter)
+	_, c.Limits = o.(LimitsReporter)
+	_, c.Symlink = o.(SupportSymlink)
+	_, c.FileSystem = o.(FileSystem)
+	return c
+}
+
+// RegisteredSchemes returns the names of all registered storages in order.
+func RegisteredSchemes() []string {
+	names := make([]string, 0, len(storages))
+	for name := range storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,52 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	aliyun := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	expect := CapabilitySet{PutIfAbsent: true, Prefetch: true, KeyLocker: true, ListSince: true, Purge: true, Swap: true, GetInto: true, GetIfMatch: true, PutResult: true, Context: true, Limits: true}
+	if c := Capabilities(aliyun); c != expect {
+		t.Fatalf("aliyun: expect %s, but got %s", expect, c)
+	}
+	mem, _ := newMem("mem", "", "", "")
+	if c := Capabilities(mem); c.String() != "Copy" {
+		t.Fatalf("mem: %s", c)
+	}
+	disk, _ := newDisk(t.TempDir(), "", "", "")
+	if c := Capabilities(disk); !c.Copy || !c.Symlink || !c.FileSystem || !c.PutMtime || !c.Rename {
+		t.Fatalf("disk: %s", c)
+	}
+
+	schemes := RegisteredSchemes()
+	if !sort.StringsAreSorted(schemes) {
+		t.Fatalf("schemes should be sorted: %v", schemes)
+	}
+	found := make(map[string]bool)
+	for _, s := range schemes {
+		found[s] = true
+	}
+	for _, s := range []string{"aliyun", "file", "mem", "s3", "yandex"} {
+		if !found[s] {
+			t.Fatalf("%s is not registered: %v", s, schemes)
+		}
+	}
+}
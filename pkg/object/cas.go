@@ -0,0 +1,197 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the reference counts of the contents are kept under this prefix
+const casRefPrefix = ".refs/"
+
+// ContentStore is an object storage addressed by content (CAS): an object is
+// stored under the checksum of its content in DefaultHashAlgo, so the same
+// content written many times is stored once, e.g. to dedup the blocks across
+// volumes.
+//
+// It changes the meaning of the keys, so it's opt-in: Put ignores the key
+// given, and the checksum is returned by PutContent or PutWithResult (as
+// PutResult.Hash). Get, Head and Delete take the checksum as the key. Every
+// Put of a content adds a reference to it and every Delete drops one, the
+// content is deleted with its last reference. The reference counts are kept
+// under .refs/ of the storage, and are expected to be changed by only one
+// ContentStore. Multipart uploads are not supported.
+type ContentStore struct {
+	ObjectStorage
+	locks KeyLocker
+}
+
+// WithContentAddressing returns a ContentStore of o.
+func WithContentAddressing(o ObjectStorage) *ContentStore {
+	return &ContentStore{ObjectStorage: o, locks: NewLocalKeyLocker()}
+}
+
+func (c *ContentStore) String() string {
+	return fmt.Sprintf("%s(cas)", c.ObjectStorage)
+}
+
+// refs returns the reference count of a content, 0 if it has none.
+func (c *ContentStore) refs(sum string) (int64, error) {
+	r, err := c.ObjectStorage.Get(casRefPrefix+sum, 0, -1)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid reference count of %s: %q", sum, data)
+	}
+	return n, nil
+}
+
+func (c *ContentStore) setRefs(sum string, n int64) error {
+	var err error
+	if n > 0 {
+		err = c.ObjectStorage.Put(casRefPrefix+sum, strings.NewReader(strconv.FormatInt(n, 10)))
+	} else if err = c.ObjectStorage.Delete(casRefPrefix + sum); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("save the reference count of %s: %w", sum, err)
+	}
+	return nil
+}
+
+// PutContent stores the content of in if it's not stored yet, and returns its
+// checksum, which is the key to read it.
+func (c *ContentStore) PutContent(in io.Reader) (string, error) {
+	r, err := c.PutWithResult("", in)
+	if err != nil {
+		return "", err
+	}
+	return r.Hash, nil
+}
+
+// PutWithResult stores the content as PutContent, key is ignored.
+func (c *ContentStore) PutWithResult(key string, in io.Reader) (*PutResult, error) {
+	sp, err := Spool(in, 1<<20, DefaultHashAlgo)
+	if err != nil {
+		return nil, err
+	}
+	defer sp.Close()
+	sum := sp.Hash
+	if sum == "" {
+		// no checksum is computed for the empty content
+		h, _ := DefaultHashAlgo.New()
+		sum = sumOf(h)
+	}
+	unlock, err := c.locks.Lock(sum)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	n, err := c.refs(sum)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		if err = c.ObjectStorage.Put(sum, sp); err != nil {
+			return nil, err
+		}
+	}
+	if err = c.setRefs(sum, n+1); err != nil {
+		return nil, err
+	}
+	return &PutResult{Size: sp.Size, Algo: DefaultHashAlgo, Hash: sum}, nil
+}
+
+// Put stores the content as PutContent, key is ignored.
+func (c *ContentStore) Put(key string, in io.Reader) error {
+	_, err := c.PutWithResult(key, in)
+	return err
+}
+
+// Delete drops a reference to the content of checksum key, which is deleted
+// with the last one. A content without reference count (not written by a
+// ContentStore) is deleted at once.
+func (c *ContentStore) Delete(key string) error {
+	unlock, err := c.locks.Lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	n, err := c.refs(key)
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return c.setRefs(key, n-1)
+	}
+	if err = c.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	return c.setRefs(key, 0)
+}
+
+func (c *ContentStore) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return nil, notSupported
+}
+
+// ListAll skips the reference counts.
+func (c *ContentStore) ListAll(prefix, marker string) (<-chan Object, error) {
+	ch, err := ListAll(c.ObjectStorage, prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(casRefPrefix, prefix) {
+		return ch, nil
+	}
+	out := make(chan Object, 1000)
+	go func() {
+		defer close(out)
+		for o := range ch {
+			if o != nil && strings.HasPrefix(o.Key(), casRefPrefix) {
+				continue
+			}
+			out <- o
+		}
+	}()
+	return out, nil
+}
+
+// List skips the reference counts, the storage is listed no more than limit
+// objects.
+func (c *ContentStore) List(prefix, marker string, limit int64) ([]Object, error) {
+	var skip string
+	if strings.HasPrefix(casRefPrefix, prefix) {
+		skip = casRefPrefix
+	}
+	return listSkipping(c.ObjectStorage, prefix, marker, limit, skip)
+}
+
+var _ ResultPutter = &ContentStore{}
@@ -0,0 +1,92 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestContentStore(t *testing.T) {
+	m, _ := newMem("mem", "", "", "")
+	c := WithContentAddressing(m)
+	sum := sha256.Sum256([]byte("data"))
+	expected := hex.EncodeToString(sum[:])
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Put(key, strings.NewReader("data")); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	got, err := c.PutContent(strings.NewReader("data"))
+	if err != nil || got != expected {
+		t.Fatalf("put content: %s %v", got, err)
+	}
+	other, err := c.PutContent(strings.NewReader("other"))
+	if err != nil {
+		t.Fatalf("put other content: %s", err)
+	}
+	if _, err = m.Head("a"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the key given should be ignored: %v", err)
+	}
+	// stored once, and the reference counts are not listed
+	stored := []string{expected, other}
+	sort.Strings(stored)
+	if keys := collect(t, mustList(t, c)); strings.Join(keys, ",") != strings.Join(stored, ",") {
+		t.Fatalf("stored objects: %v", keys)
+	}
+	if objs, err := c.List("", "", 1); err != nil || len(objs) != 1 || objs[0].Key() != stored[0] {
+		t.Fatalf("the first page: %v %v", objs, err)
+	}
+	if d, err := get(c, expected, 0, -1); err != nil || d != "data" {
+		t.Fatalf("get by checksum: %q %v", d, err)
+	}
+	if n, err := c.refs(expected); err != nil || n != 4 {
+		t.Fatalf("references of %s: %d %v", expected, n, err)
+	}
+
+	// kept until the last reference is dropped
+	for i := 0; i < 3; i++ {
+		if err = c.Delete(expected); err != nil {
+			t.Fatalf("delete %d: %s", i, err)
+		}
+		if d, err := get(c, expected, 0, -1); err != nil || d != "data" {
+			t.Fatalf("get after %d deletes: %q %v", i+1, d, err)
+		}
+	}
+	if err = c.Delete(expected); err != nil {
+		t.Fatalf("delete the last reference: %s", err)
+	}
+	if _, err = c.Head(expected); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("%s should be deleted: %v", expected, err)
+	}
+	if keys := collect(t, mustList(t, m)); strings.Join(keys, ",") != casRefPrefix+other+","+other {
+		t.Fatalf("objects left: %v", keys)
+	}
+
+	r, err := c.PutWithResult("", strings.NewReader(""))
+	if err != nil || r.Size != 0 || r.Hash == "" {
+		t.Fatalf("put empty content: %+v %v", r, err)
+	}
+	if _, err = c.CreateMultipartUpload("x"); !errors.Is(err, notSupported) {
+		t.Fatalf("multipart upload should not be supported: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// encodeCase escapes the upper case letters as `@` and the lower case one,
+// and `@` as `@@`, so the encoded keys have no upper case letters. Since `@`
+// sorts right before `A`, the order of keys is kept.
+func encodeCase(key string) string {
+	if strings.IndexFunc(key, func(r rune) bool { return r == '@' || r >= 'A' && r <= 'Z' }) < 0 {
+		return key
+	}
+	var b strings.Builder
+	b.Grow(len(key) + 8)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c == '@':
+			b.WriteString("@@")
+		case c >= 'A' && c <= 'Z':
+			b.WriteByte('@')
+			b.WriteByte(c + 'a' - 'A')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// decodeCase reverses encodeCase, an invalid escape is kept as it is.
+func decodeCase(key string) string {
+	if !strings.Contains(key, "@") {
+		return key
+	}
+	var b strings.Builder
+	b.Grow(len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c == '@' && i+1 < len(key) {
+			if n := key[i+1]; n == '@' {
+				c = '@'
+				i++
+			} else if n >= 'a' && n <= 'z' {
+				c = n - 'a' + 'A'
+				i++
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func decodeKey(o Object) {
+	switch p := o.(type) {
+	case *obj:
+		p.key = decodeCase(p.key)
+	case *file:
+		p.key = decodeCase(p.key)
+	case *hashedObj:
+		p.key = decodeCase(p.key)
+	case *describedObj:
+		p.key = decodeCase(p.key)
+	}
+}
+
+type withCaseEncoding struct {
+	ObjectStorage
+}
+
+// WithCaseEncoding returns an object storage keeping the keys different only
+// in case apart on a case-insensitive storage, e.g. the drives like Aliyun,
+// Box, pCloud, Seafile, or a disk on Windows and macOS. The upper case letters
+// are encoded into the stored keys, so the existing objects written without
+// it can not be read through it.
+func WithCaseEncoding(o ObjectStorage) ObjectStorage {
+	return &withCaseEncoding{o}
+}
+
+func (c *withCaseEncoding) Head(key string) (Object, error) {
+	o, err := c.ObjectStorage.Head(encodeCase(key))
+	if err != nil {
+		return nil, err
+	}
+	decodeKey(o)
+	return o, nil
+}
+
+func (c *withCaseEncoding) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return c.ObjectStorage.Get(encodeCase(key), off, limit)
+}
+
+func (c *withCaseEncoding) Put(key string, in io.Reader) error {
+	return c.ObjectStorage.Put(encodeCase(key), in)
+}
+
+func (c *withCaseEncoding) Delete(key string) error {
+	return c.ObjectStorage.Delete(encodeCase(key))
+}
+
+func (c *withCaseEncoding) List(prefix, marker string, limit int64) ([]Object, error) {
+	objs, err := c.ObjectStorage.List(encodeCase(prefix), encodeCase(marker), limit)
+	for _, o := range objs {
+		decodeKey(o)
+	}
+	return objs, err
+}
+
+func (c *withCaseEncoding) ListAll(prefix, marker string) (<-chan Object, error) {
+	r, err := c.ObjectStorage.ListAll(encodeCase(prefix), encodeCase(marker))
+	if err != nil {
+		return r, err
+	}
+	r2 := make(chan Object, 10240)
+	go func() {
+		for o := range r {
+			if o != nil {
+				decodeKey(o)
+			}
+			r2 <- o
+		}
+		close(r2)
+	}()
+	return r2, nil
+}
+
+func (c *withCaseEncoding) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return c.ObjectStorage.CreateMultipartUpload(encodeCase(key))
+}
+
+func (c *withCaseEncoding) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	return c.ObjectStorage.UploadPart(encodeCase(key), uploadID, num, body)
+}
+
+func (c *withCaseEncoding) AbortUpload(key string, uploadID string) {
+	c.ObjectStorage.AbortUpload(encodeCase(key), uploadID)
+}
+
+func (c *withCaseEncoding) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	return c.ObjectStorage.CompleteUpload(encodeCase(key), uploadID, parts)
+}
+
+func (c *withCaseEncoding) ListUploads(marker string) ([]*PendingPart, string, error) {
+	parts, next, err := c.ObjectStorage.ListUploads(encodeCase(marker))
+	for _, p := range parts {
+		p.Key = decodeCase(p.Key)
+	}
+	return parts, decodeCase(next), err
+}
+
+// IsCaseInsensitive tells whether the keys different only in case are the
+// same object in the storage, by writing a probe object under prefix.
+func IsCaseInsensitive(o ObjectStorage, prefix string) (bool, error) {
+	key := prefix + "case-probe-" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if err := o.Put(key, bytes.NewReader([]byte("probe"))); err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := o.Delete(key); err != nil {
+			logger.Warnf("delete probe %s: %s", key, err)
+		}
+	}()
+	_, err := o.Head(strings.ToUpper(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+var _ ObjectStorage = &withCaseEncoding{}
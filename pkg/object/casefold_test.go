@@ -0,0 +1,114 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// caseInsensitive emulates a storage ignoring the case of keys.
+type caseInsensitive struct {
+	ObjectStorage
+}
+
+func (c *caseInsensitive) Head(key string) (Object, error) {
+	return c.ObjectStorage.Head(strings.ToLower(key))
+}
+
+func (c *caseInsensitive) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return c.ObjectStorage.Get(strings.ToLower(key), off, limit)
+}
+
+func (c *caseInsensitive) Put(key string, in io.Reader) error {
+	return c.ObjectStorage.Put(strings.ToLower(key), in)
+}
+
+func (c *caseInsensitive) Delete(key string) error {
+	return c.ObjectStorage.Delete(strings.ToLower(key))
+}
+
+func TestCaseEncoding(t *testing.T) {
+	mem, _ := newMem("case", "", "", "")
+	ci := &caseInsensitive{mem}
+	if yes, err := IsCaseInsensitive(ci, "jfs/"); err != nil || !yes {
+		t.Fatalf("detect case-insensitive storage: %v %v", yes, err)
+	}
+	if yes, err := IsCaseInsensitive(mem, "jfs/"); err != nil || yes {
+		t.Fatalf("detect case-sensitive storage: %v %v", yes, err)
+	}
+
+	s := WithCaseEncoding(ci)
+	keys := []string{"Foo", "foo", "FOO", "a@b", "a@B"}
+	for _, k := range keys {
+		if err := s.Put(k, bytes.NewReader([]byte(k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	for _, k := range keys {
+		if d, err := get(s, k, 0, -1); err != nil || d != k {
+			t.Fatalf("get %s: %q %v", k, d, err)
+		}
+		if o, err := s.Head(k); err != nil || o.Key() != k {
+			t.Fatalf("head %s: %v %v", k, o, err)
+		}
+	}
+	objs, err := s.List("", "", 100)
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	var listed []string
+	for _, o := range objs {
+		listed = append(listed, o.Key())
+	}
+	sort.Strings(keys)
+	if strings.Join(listed, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %v, but got %v", keys, listed)
+	}
+	if err := s.Delete("Foo"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if d, err := get(s, "foo", 0, -1); err != nil || d != "foo" {
+		t.Fatalf("foo should be kept: %q %v", d, err)
+	}
+}
+
+func TestCaseEncodingOrder(t *testing.T) {
+	chars := "@?AZ[az^_0-~/\xff"
+	keys := make([]string, 1000)
+	for i := range keys {
+		b := make([]byte, 1+rand.Intn(6))
+		for j := range b {
+			b[j] = chars[rand.Intn(len(chars))]
+		}
+		keys[i] = string(b)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		e := encodeCase(k)
+		if strings.ContainsAny(e, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") || decodeCase(e) != k {
+			t.Fatalf("encode %q as %q", k, e)
+		}
+		if i > 0 && keys[i-1] < k && !(encodeCase(keys[i-1]) < e) {
+			t.Fatalf("order of %q and %q is not kept", keys[i-1], k)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	select {
+	case <-c.After(0):
+	default:
+		t.Fatalf("timer of zero duration should fire immediately")
+	}
+	a, b := c.After(time.Second), c.After(2*time.Second)
+	c.Advance(time.Second)
+	select {
+	case now := <-a:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("fired at %s", now)
+		}
+	default:
+		t.Fatalf("timer of 1s should fire")
+	}
+	if c.Waiters() != 1 {
+		t.Fatalf("expect 1 waiter, but got %d", c.Waiters())
+	}
+	done := make(chan struct{})
+	go func() {
+		c.Sleep(time.Second)
+		close(done)
+	}()
+	c.BlockUntil(2)
+	c.Advance(time.Second)
+	<-b
+	<-done
+	if !c.Now().Equal(start.Add(2 * time.Second)) {
+		t.Fatalf("now is %s", c.Now())
+	}
+}
+
+type failingToken struct {
+	failures int32
+	attempts int32
+}
+
+func (f *failingToken) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := http.StatusOK
+	if atomic.AddInt32(&f.attempts, 1) <= f.failures {
+		status = http.StatusServiceUnavailable
+	}
+	return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader("{}"))}, nil
+}
+
+func TestTokenRetrierBackoff(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	f := &failingToken{failures: 5}
+	tr := &tokenRetrier{RoundTripper: f, retries: 5, backoff: time.Second, clock: clock}
+	req, _ := http.NewRequest(http.MethodPost, "https://auth.aliyundrive.com/v2/account/token", nil)
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("refresh token: %s", err)
+		}
+		done <- resp
+	}()
+
+	// doubled on every failure, up to 10s
+	for i, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		clock.BlockUntil(1)
+		if n := atomic.LoadInt32(&f.attempts); n != int32(i+1) {
+			t.Fatalf("expect %d attempts before backoff %s, but got %d", i+1, backoff, n)
+		}
+		clock.Advance(backoff - time.Millisecond)
+		if clock.Waiters() != 1 {
+			t.Fatalf("retried before backoff %s", backoff)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	if resp := <-done; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect success after retries, but got %v", resp)
+	}
+	if f.attempts != 6 {
+		t.Fatalf("expect 6 attempts, but got %d", f.attempts)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// CopyOptions are the options of CopyObject.
+type CopyOptions struct {
+	// PartSize is the size of parts uploaded, the object is copied in a
+	// single Put if it's not larger than this. 0 means 32 MiB.
+	PartSize int64
+	// Progress is called with the bytes copied so far after every part.
+	Progress func(copied, total int64)
+	// Checkpoint is a local file to save the state of the multipart upload,
+	// an interrupted copy is resumed from it. Empty to disable resuming.
+	Checkpoint string
+}
+
+// copyCheckpoint is the state of a multipart copy saved in the checkpoint.
+type copyCheckpoint struct {
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	Size     int64     `json:"size"`
+	Mtime    time.Time `json:"mtime"`
+	PartSize int64     `json:"part_size"`
+	UploadID string    `json:"upload_id"`
+	Parts    []*Part   `json:"parts"`
+}
+
+func (c *copyCheckpoint) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadCheckpoint returns the saved state if it's for the same copy of the
+// same source, or nil.
+func loadCheckpoint(path, src, dst string, o Object) *copyCheckpoint {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var c copyCheckpoint
+	if err = json.Unmarshal(data, &c); err != nil {
+		logger.Warnf("ignore the broken checkpoint %s: %s", path, err)
+		return nil
+	}
+	if c.Src != src || c.Dst != dst || c.Size != o.Size() || !c.Mtime.Equal(o.Mtime()) || c.PartSize <= 0 {
+		logger.Infof("ignore the checkpoint %s of another copy", path)
+		return nil
+	}
+	return &c
+}
+
+// CopyObject copies an object from src to dst. Inside the same storage it is
+// done by the server if supported. Otherwise a large object is copied by a
+// multipart upload, which could be resumed with the checkpoint after failed.
+func CopyObject(dst ObjectStorage, dstKey string, src ObjectStorage, srcKey string, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	if c, ok := dst.(interface{ Copy(dst, src string) error }); ok && dst == src {
+		if err := c.Copy(dstKey, srcKey); err == nil || !errors.Is(err, notSupported) {
+			return err
+		}
+	}
+	o, err := src.Head(srcKey)
+	if err != nil {
+		return err
+	}
+	progress := func(copied int64) {
+		if opts.Progress != nil {
+			opts.Progress(copied, o.Size())
+		}
+	}
+	partSize := opts.PartSize
+	if partSize <= 0 {
+		partSize = 32 << 20
+	}
+	if o.Size() > partSize {
+		err = copyMultipart(dst, dstKey, src, srcKey, o, partSize, opts.Checkpoint, progress)
+		if err == nil || !errors.Is(err, notSupported) {
+			return err
+		}
+	}
+	in, err := src.Get(srcKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = dst.Put(dstKey, in); err != nil {
+		return err
+	}
+	progress(o.Size())
+	return nil
+}
+
+func copyMultipart(dst ObjectStorage, dstKey string, src ObjectStorage, srcKey string, o Object, partSize int64,
+	checkpoint string, progress func(int64)) error {
+	var c *copyCheckpoint
+	if checkpoint != "" {
+		c = loadCheckpoint(checkpoint, srcKey, dstKey, o)
+	}
+	if c == nil {
+		upload, err := dst.CreateMultipartUpload(dstKey)
+		if err != nil {
+			return err
+		}
+		if partSize < int64(upload.MinPartSize) {
+			partSize = int64(upload.MinPartSize)
+		}
+		if upload.MaxCount > 0 && (o.Size()-1)/partSize >= int64(upload.MaxCount) {
+			partSize = (o.Size()-1)/int64(upload.MaxCount) + 1
+		}
+		c = &copyCheckpoint{Src: srcKey, Dst: dstKey, Size: o.Size(), Mtime: o.Mtime(), PartSize: partSize, UploadID: upload.UploadID}
+	} else {
+		logger.Infof("Resume the copy of %s from %d parts", srcKey, len(c.Parts))
+	}
+
+	copied := int64(len(c.Parts)) * c.PartSize
+	progress(copied)
+	for off := copied; off < o.Size(); off += c.PartSize {
+		size := c.PartSize
+		if off+size > o.Size() {
+			size = o.Size() - off
+		}
+		part, err := copyPart(dst, dstKey, src, srcKey, c.UploadID, len(c.Parts)+1, off, size)
+		if err != nil {
+			// keep the upload to be resumed
+			if checkpoint == "" {
+				dst.AbortUpload(dstKey, c.UploadID)
+			}
+			return fmt.Errorf("copy part %d of %s: %w", len(c.Parts)+1, srcKey, err)
+		}
+		c.Parts = append(c.Parts, part)
+		if checkpoint != "" {
+			if err = c.save(checkpoint); err != nil {
+				logger.Warnf("save checkpoint %s: %s", checkpoint, err)
+			}
+		}
+		progress(off + size)
+	}
+	if err := dst.CompleteUpload(dstKey, c.UploadID, c.Parts); err != nil {
+		return fmt.Errorf("complete upload of %s: %w", dstKey, err)
+	}
+	if checkpoint != "" {
+		_ = os.Remove(checkpoint)
+	}
+	return nil
+}
+
+func copyPart(dst ObjectStorage, dstKey string, src ObjectStorage, srcKey, uploadID string, num int, off, size int64) (*Part, error) {
+	in, err := src.Get(srcKey, off, size)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	data := make([]byte, size)
+	if _, err = io.ReadFull(in, data); err != nil {
+		return nil, err
+	}
+	return dst.UploadPart(dstKey, uploadID, num, data)
+}
+
+// the buffer of StreamCopy to read from the source
+const streamCopyBuffer = 1 << 20
+
+// StreamCopy copies an object from src into dst with the same key through a
+// pipe, so the memory used is bounded whatever size it has, unless dst needs
+// to buffer the whole object to Put. The copy is verified end to end: the
+// stream is hashed by the algorithm of the checksum kept by src (if any) and
+// DefaultHashAlgo, which are compared with the checksums of src and dst. The
+// content of dst is read again if it keeps a checksum of another algorithm or
+// none, e.g. migrating from the Aliyun drive (SHA1) into S3 (MD5). The copy
+// is deleted from dst if it fails the verification.
+func StreamCopy(dst, src ObjectStorage, key string) error {
+	o, err := src.Head(key)
+	if err != nil {
+		return err
+	}
+	info := InfoOf(o)
+	algo, sum := info.HashAlgo, info.Hash
+	sums := map[HashAlgo]hash.Hash{DefaultHashAlgo: nil}
+	if sum != "" {
+		if _, err = algo.New(); err != nil {
+			sum = ""
+		} else {
+			sums[algo] = nil
+		}
+	}
+	var hashes []io.Writer
+	for a := range sums {
+		sums[a], _ = a.New()
+		hashes = append(hashes, sums[a])
+	}
+	in, err := src.Get(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	pr, pw := io.Pipe()
+	var copied int64
+	var readErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := io.MultiWriter(append(hashes, pw)...)
+		copied, readErr = io.CopyBuffer(w, in, make([]byte, streamCopyBuffer))
+		if readErr == nil && copied != o.Size() {
+			readErr = fmt.Errorf("read %d bytes of %s from %s, but it has %d", copied, key, src, o.Size())
+		}
+		// the Put fails with readErr, or finishes at the EOF
+		_ = pw.CloseWithError(readErr)
+	}()
+	err = dst.Put(key, pr)
+	// unblock the reading if the Put returns early
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if readErr != nil {
+		return readErr
+	}
+	if err != nil {
+		return fmt.Errorf("put %s into %s: %w", key, dst, err)
+	}
+	streamed := make(map[HashAlgo]string, len(sums))
+	for a, h := range sums {
+		streamed[a] = hex.EncodeToString(h.Sum(nil))
+	}
+	if err = verifyCopy(dst, src, key, o.Size(), algo, sum, streamed); err != nil {
+		// not to be taken as copied by the next try
+		if e := dst.Delete(key); e != nil {
+			logger.Warnf("Delete the corrupted copy of %s from %s: %s", key, dst, e)
+		}
+	}
+	return err
+}
+
+// verifyCopy checks the copy of key in dst by the checksums of the stream.
+func verifyCopy(dst, src ObjectStorage, key string, size int64, algo HashAlgo, sum string, streamed map[HashAlgo]string) error {
+	if sum != "" && streamed[algo] != sum {
+		return fmt.Errorf("%s of %s read from %s is %s, but expect %s", algo, key, src, streamed[algo], sum)
+	}
+
+	d, err := dst.Head(key)
+	if err != nil {
+		return fmt.Errorf("head %s in %s after copied: %w", key, dst, err)
+	}
+	if d.Size() != size {
+		return fmt.Errorf("size of %s copied into %s is %d, but expect %d", key, dst, d.Size(), size)
+	}
+	i := InfoOf(d)
+	dalgo, dsum := i.HashAlgo, i.Hash
+	if _, ok := streamed[dalgo]; !ok || dsum == "" {
+		dalgo = DefaultHashAlgo
+		if dsum, err = hashContent(dst, key, dalgo); err != nil {
+			return fmt.Errorf("read %s from %s after copied: %w", key, dst, err)
+		}
+	}
+	if dsum != streamed[dalgo] {
+		return fmt.Errorf("%s of %s copied into %s is %s, but expect %s", dalgo, key, dst, dsum, streamed[dalgo])
+	}
+	return nil
+}
+
+// RangeCopier is implemented by the storages which could copy a range of an
+// object into another one inside the storage.
+type RangeCopier interface {
+	CopyRange(dst, src string, offset, length int64) error
+}
+
+// CopyRange creates dst with the length bytes of src from offset, e.g. to
+// compact or repair a block. It's copied inside the storage by a RangeCopier,
+// or read by a ranged Get and written by Put on the others (e.g. the Aliyun
+// drive has no ranged copy). It fails if src has less bytes than asked.
+func CopyRange(s ObjectStorage, dst, src string, offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid range of %s: offset %d, length %d", src, offset, length)
+	}
+	if c, ok := s.(RangeCopier); ok {
+		return c.CopyRange(dst, src, offset, length)
+	}
+	if length == 0 {
+		return s.Put(dst, bytes.NewReader(nil))
+	}
+	in, err := s.Get(src, offset, length)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return s.Put(dst, &exactReader{in, length})
+}
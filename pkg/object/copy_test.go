@@ -0,0 +1,261 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// multipartMem adds multipart upload to memStore, it fails the upload of
+// part failAt once.
+type multipartMem struct {
+	*memStore
+	mu      sync.Mutex
+	uploads map[string]map[int][]byte
+	seq     int
+	failAt  int
+	partsUp int
+}
+
+func newMultipartMem() *multipartMem {
+	m, _ := newMem("dst", "", "", "")
+	return &multipartMem{memStore: m.(*memStore), uploads: make(map[string]map[int][]byte)}
+}
+
+func (m *multipartMem) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	id := fmt.Sprintf("upload%d", m.seq)
+	m.uploads[id] = make(map[int][]byte)
+	return &MultipartUpload{MinPartSize: 1, MaxCount: 100, UploadID: id}, nil
+}
+
+func (m *multipartMem) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts, ok := m.uploads[uploadID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if num == m.failAt {
+		m.failAt = 0
+		return nil, errors.New("connection reset")
+	}
+	m.partsUp++
+	parts[num] = append([]byte{}, body...)
+	return &Part{Num: num, Size: len(body), ETag: fmt.Sprint(num)}, nil
+}
+
+func (m *multipartMem) AbortUpload(key string, uploadID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, uploadID)
+}
+
+func (m *multipartMem) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	m.mu.Lock()
+	uploaded, ok := m.uploads[uploadID]
+	delete(m.uploads, uploadID)
+	m.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Num < parts[j].Num })
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.Write(uploaded[p.Num])
+	}
+	return m.Put(key, &buf)
+}
+
+func TestCopyObject(t *testing.T) {
+	src, _ := newMem("src", "", "", "")
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_ = src.Put("big", bytes.NewReader(data))
+	_ = src.Put("small", bytes.NewReader(data[:10]))
+
+	// an interrupted copy is resumed from the checkpoint
+	dst := newMultipartMem()
+	dst.failAt = 3
+	checkpoint := filepath.Join(t.TempDir(), "copy.json")
+	var copied []int64
+	opts := &CopyOptions{PartSize: 300, Checkpoint: checkpoint, Progress: func(n, total int64) {
+		if total != int64(len(data)) {
+			t.Fatalf("total size %d", total)
+		}
+		copied = append(copied, n)
+	}}
+	if err := CopyObject(dst, "big", src, "big", opts); err == nil {
+		t.Fatalf("copy should fail at part 3")
+	}
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatalf("checkpoint should be kept: %s", err)
+	}
+	if err := CopyObject(dst, "big", src, "big", opts); err != nil {
+		t.Fatalf("resume copy: %s", err)
+	}
+	if d, err := get(dst, "big", 0, -1); err != nil || d != string(data) {
+		t.Fatalf("copied %d bytes: %v", len(d), err)
+	}
+	if dst.partsUp != 4 {
+		t.Fatalf("the copied parts should not be uploaded again: %d parts uploaded", dst.partsUp)
+	}
+	if fmt.Sprint(copied) != "[0 300 600 600 900 1000]" {
+		t.Fatalf("progress: %v", copied)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint should be removed after completed: %v", err)
+	}
+
+	// a checkpoint of a changed source is not used
+	opts.Progress = nil
+	dst.failAt = 2
+	if err := CopyObject(dst, "big2", src, "big", opts); err == nil {
+		t.Fatalf("copy should fail at part 2")
+	}
+	_ = src.Put("big", bytes.NewReader(data[:900]))
+	if err := CopyObject(dst, "big2", src, "big", opts); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if d, err := get(dst, "big2", 0, -1); err != nil || d != string(data[:900]) {
+		t.Fatalf("copied %d bytes: %v", len(d), err)
+	}
+
+	// small objects and storages without multipart upload use Put
+	mem, _ := newMem("mem", "", "", "")
+	for _, key := range []string{"small", "big"} {
+		if err := CopyObject(mem, key, src, key, &CopyOptions{PartSize: 300}); err != nil {
+			t.Fatalf("copy %s: %s", key, err)
+		}
+	}
+	if d, err := get(mem, "big", 0, -1); err != nil || d != string(data[:900]) {
+		t.Fatalf("copied %d bytes: %v", len(d), err)
+	}
+	// inside the same storage
+	if err := CopyObject(src, "small2", src, "small", nil); err != nil {
+		t.Fatalf("copy inside storage: %s", err)
+	}
+	if d, err := get(src, "small2", 0, -1); err != nil || d != string(data[:10]) {
+		t.Fatalf("copied %d bytes: %v", len(d), err)
+	}
+}
+
+// corruptedSrc truncates the content or lies about the checksum.
+type corruptedSrc struct {
+	ObjectStorage
+	truncate bool
+	sum      string
+}
+
+func (c *corruptedSrc) Head(key string) (Object, error) {
+	o, err := c.ObjectStorage.Head(key)
+	if err != nil || c.sum == "" {
+		return o, err
+	}
+	return &hashedObj{obj{o.Key(), o.Size(), o.Mtime(), false}, HashSHA256, c.sum}, nil
+}
+
+func (c *corruptedSrc) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r, err := c.ObjectStorage.Get(key, off, limit)
+	if err != nil || !c.truncate {
+		return r, err
+	}
+	return io.NopCloser(io.LimitReader(r, 100)), nil
+}
+
+func TestStreamCopy(t *testing.T) {
+	src, _ := newMem("src", "", "", "")
+	dst, _ := newMem("dst", "", "", "")
+	data := make([]byte, 5<<20+123)
+	_, _ = rand.Read(data)
+	_ = src.Put("big", bytes.NewReader(data))
+	if err := StreamCopy(dst, src, "big"); err != nil {
+		t.Fatalf("stream copy: %s", err)
+	}
+	if o, err := dst.Head("big"); err != nil || o.Size() != int64(len(data)) {
+		t.Fatalf("head copied: %v %v", o, err)
+	}
+	if d, err := get(dst, "big", 0, -1); err != nil || d != string(data) {
+		t.Fatalf("copied %d bytes: %v", len(d), err)
+	}
+	if err := StreamCopy(dst, src, "missing"); !os.IsNotExist(err) {
+		t.Fatalf("copy of missing object: %v", err)
+	}
+
+	if err := StreamCopy(dst, &corruptedSrc{ObjectStorage: src, truncate: true}, "big"); err == nil || !strings.Contains(err.Error(), "read 100 bytes") {
+		t.Fatalf("truncated copy should fail: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if err := StreamCopy(dst, &corruptedSrc{ObjectStorage: src, sum: hex.EncodeToString(sum[:])}, "big"); err != nil {
+		t.Fatalf("copy with checksum: %s", err)
+	}
+	if err := StreamCopy(dst, &corruptedSrc{ObjectStorage: src, sum: "bad"}, "big"); err == nil || !strings.Contains(err.Error(), "expect bad") {
+		t.Fatalf("copy with bad checksum should fail: %v", err)
+	}
+}
+
+func TestCopyRange(t *testing.T) {
+	mem, _ := newMem("mem", "", "", "")
+	disk, _ := newDisk(t.TempDir()+"/", "", "", "")
+	aliyun := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, s := range []ObjectStorage{mem, disk, aliyun} {
+		if err := s.Put("src", bytes.NewReader(data)); err != nil {
+			t.Fatalf("put %s: %s", s, err)
+		}
+		if err := CopyRange(s, "part", "src", 100, 300); err != nil {
+			t.Fatalf("copy range in %s: %s", s, err)
+		}
+		if d, err := get(s, "part", 0, -1); err != nil || d != string(data[100:400]) {
+			t.Fatalf("%s: expect %d bytes from 100, but got %d: %v", s, 300, len(d), err)
+		}
+		if err := CopyRange(s, "empty", "src", 10, 0); err != nil {
+			t.Fatalf("copy empty range in %s: %s", s, err)
+		}
+		if d, err := get(s, "empty", 0, -1); err != nil || d != "" {
+			t.Fatalf("%s: expect empty object, but got %q: %v", s, d, err)
+		}
+		if err := CopyRange(s, "beyond", "src", 900, 200); err == nil {
+			t.Fatalf("%s: copy beyond the end should fail", s)
+		}
+		if _, err := s.Head("beyond"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s: incomplete copy should not be created: %v", s, err)
+		}
+		if err := CopyRange(s, "missing", "nonexistent", 0, 10); err == nil {
+			t.Fatalf("%s: copy from missing object should fail", s)
+		}
+	}
+}
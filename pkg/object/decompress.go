@@ -0,0 +1,118 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/DataDog/zstd"
+)
+
+// a compression scheme of the objects written by other tools, detected by
+// the magic bytes at the beginning
+type decompressor struct {
+	magic []byte
+	open  func(r io.Reader) (io.ReadCloser, error)
+}
+
+var decompressors = map[string]decompressor{
+	"gzip": {[]byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }},
+	"zstd": {[]byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) { return zstd.NewReader(r), nil }},
+}
+
+type withDecompression struct {
+	ObjectStorage
+	schemes []decompressor
+}
+
+// WithDecompression returns an object storage decompressing the objects
+// compressed at rest by one of the schemes (gzip or zstd) on Get, and the
+// others are read as they are. The offset and limit of Get are those in the
+// decompressed content, which is read from the beginning. The objects are
+// written, listed and sized as they're stored, it's meant for reading the
+// legacy data migrated from other systems.
+func WithDecompression(o ObjectStorage, schemes ...string) (ObjectStorage, error) {
+	w := &withDecompression{ObjectStorage: o}
+	for _, name := range schemes {
+		d, ok := decompressors[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown compression scheme: %s", name)
+		}
+		w.schemes = append(w.schemes, d)
+	}
+	return w, nil
+}
+
+type decompressedReader struct {
+	io.Reader
+	dec io.Closer
+	raw io.Closer
+}
+
+func (r *decompressedReader) Close() error {
+	_ = r.dec.Close()
+	return r.raw.Close()
+}
+
+func (w *withDecompression) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	raw, err := w.ObjectStorage.Get(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(raw)
+	var scheme *decompressor
+	for i, d := range w.schemes {
+		if head, _ := br.Peek(len(d.magic)); bytes.Equal(head, d.magic) {
+			scheme = &w.schemes[i]
+			break
+		}
+	}
+	if scheme == nil {
+		if off > 0 {
+			// not compressed, read the range only
+			_ = raw.Close()
+			return w.ObjectStorage.Get(key, off, limit)
+		}
+		var r io.Reader = br
+		if limit > 0 {
+			r = io.LimitReader(br, limit)
+		}
+		return &decompressedReader{r, io.NopCloser(nil), raw}, nil
+	}
+	dec, err := scheme.open(br)
+	if err != nil {
+		_ = raw.Close()
+		return nil, fmt.Errorf("decompress %s: %w", key, err)
+	}
+	if off > 0 {
+		if _, err = io.CopyN(io.Discard, dec, off); err != nil && err != io.EOF {
+			_ = dec.Close()
+			_ = raw.Close()
+			return nil, fmt.Errorf("decompress %s: %w", key, err)
+		}
+	}
+	var r io.Reader = dec
+	if limit > 0 {
+		r = io.LimitReader(dec, limit)
+	}
+	return &decompressedReader{r, dec, raw}, nil
+}
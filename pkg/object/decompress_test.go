@@ -0,0 +1,64 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/DataDog/zstd"
+)
+
+func TestDecompression(t *testing.T) {
+	m, _ := newMem("legacy", "", "", "")
+	data := bytes.Repeat([]byte("hello world "), 1000)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+	_ = m.Put("gzip", bytes.NewReader(gz.Bytes()))
+	zs, _ := zstd.Compress(nil, data)
+	_ = m.Put("zstd", bytes.NewReader(zs))
+	_ = m.Put("plain", bytes.NewReader(data))
+	_ = m.Put("empty", bytes.NewReader(nil))
+
+	s, err := WithDecompression(m, "gzip", "zstd")
+	if err != nil {
+		t.Fatalf("with decompression: %s", err)
+	}
+	for _, key := range []string{"gzip", "zstd", "plain"} {
+		if got, err := get(s, key, 0, -1); err != nil || got != string(data) {
+			t.Fatalf("get %s: %d bytes, %v", key, len(got), err)
+		}
+		if got, err := get(s, key, 6, 11); err != nil || got != "world hello" {
+			t.Fatalf("get range of %s: %q, %v", key, got, err)
+		}
+	}
+	if got, err := get(s, "empty", 0, -1); err != nil || got != "" {
+		t.Fatalf("get empty: %q, %v", got, err)
+	}
+
+	// only the configured schemes are decompressed
+	s, _ = WithDecompression(m, "zstd")
+	if got, err := get(s, "gzip", 0, -1); err != nil || got != gz.String() {
+		t.Fatalf("the gzip object should pass through: %d bytes, %v", len(got), err)
+	}
+	if _, err = WithDecompression(m, "lzma"); err == nil {
+		t.Fatalf("unknown scheme should be rejected")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// EndpointSpec describes the endpoints of a storage for ParseEndpoint.
+type EndpointSpec struct {
+	// Scheme of the storage, which could be omitted in the endpoints
+	Scheme string
+	// Host names what's in the host in the errors (e.g. "folder id"), which
+	// is required then, or the endpoints have no host if it's empty
+	Host string
+	// Path names what's in the path in the errors (e.g. "workdir"), which
+	// is required then, or optional if it's empty
+	Path string
+	// Options are the names of the options in the query, those ending with
+	// "." are prefixes, e.g. "header." for "header.Open"
+	Options []string
+	// Example is a valid endpoint shown in the errors
+	Example string
+}
+
+// Endpoint is the parts of an endpoint parsed by ParseEndpoint.
+type Endpoint struct {
+	Host  string
+	Path  string
+	Query url.Values
+}
+
+// ParseEndpoint checks the endpoint against spec before connecting to the
+// storage, so a typo fails by an error telling how to fix it instead of one
+// from deep inside of the storage.
+func ParseEndpoint(endpoint string, spec EndpointSpec) (*Endpoint, error) {
+	fail := func(format string, args ...interface{}) (*Endpoint, error) {
+		msg := fmt.Sprintf(format, args...)
+		if spec.Example != "" {
+			msg += fmt.Sprintf(" (e.g. %s)", spec.Example)
+		}
+		return nil, fmt.Errorf("invalid endpoint %s: %s", endpoint, msg)
+	}
+	raw := endpoint
+	if spec.Host != "" && !strings.Contains(raw, "://") {
+		// the scheme could be omitted before the host
+		raw = spec.Scheme + "://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fail("%s", err)
+	}
+	if u.Scheme != "" && u.Scheme != spec.Scheme {
+		return fail("unsupported scheme %s, it should be %s://", u.Scheme, spec.Scheme)
+	}
+	if u.Opaque != "" {
+		return fail("%s:%s is not a URL, it should start with %s://", u.Scheme, u.Opaque, spec.Scheme)
+	}
+	// not u.Query(), which drops the malformed options silently
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return fail("%s", err)
+	}
+	ep := &Endpoint{Host: u.Host, Path: u.Path, Query: q}
+	switch {
+	case spec.Host != "" && ep.Host == "":
+		return fail("missing %s", spec.Host)
+	case spec.Host == "" && ep.Host != "":
+		if spec.Path != "" && strings.Trim(ep.Path, "/") == "" {
+			return fail("missing %s, %s is taken as the host, use %s:///%s to put it in the path", spec.Path, ep.Host, spec.Scheme, ep.Host)
+		}
+		return fail("unexpected host %s", ep.Host)
+	case spec.Path != "" && strings.Trim(ep.Path, "/") == "":
+		return fail("missing %s", spec.Path)
+	}
+
+	var names []string
+	for name := range ep.Query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !spec.option(name) {
+			if s := spec.suggest(name); s != "" {
+				return fail("unknown option '%s', did you mean '%s'?", name, s)
+			}
+			if len(spec.Options) == 0 {
+				return fail("unknown option '%s', it has no options", name)
+			}
+			return fail("unknown option '%s', it should be one of %s", name, strings.Join(spec.Options, ", "))
+		}
+	}
+	return ep, nil
+}
+
+// option tells whether name is an option of the storage.
+func (spec *EndpointSpec) option(name string) bool {
+	for _, o := range spec.Options {
+		if strings.HasSuffix(o, ".") {
+			if strings.HasPrefix(name, o) && len(name) > len(o) {
+				return true
+			}
+		} else if o == name {
+			return true
+		}
+	}
+	return false
+}
+
+// suggest returns the option closest to name within 2 edits, if there is.
+func (spec *EndpointSpec) suggest(name string) string {
+	best, dist := "", 3
+	for _, o := range spec.Options {
+		if d := editDistance(name, o); d < dist {
+			best, dist = o, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
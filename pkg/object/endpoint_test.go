@@ -0,0 +1,71 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	box := EndpointSpec{Scheme: "box", Host: "folder id", Example: "box://0/jfs"}
+	for _, c := range []struct {
+		endpoint string
+		spec     EndpointSpec
+		// the host and path parsed, or the error expected
+		host, path, err string
+	}{
+		{endpoint: "/jfs", spec: aliyunEndpoint, path: "/jfs"},
+		{endpoint: "aliyun:///jfs/sub?list-concurrency=8&header.Open=A:1&header=B:2&header=C:3", spec: aliyunEndpoint, path: "/jfs/sub"},
+		{endpoint: "box://0/jfs", spec: box, host: "0", path: "/jfs"},
+		{endpoint: "0", spec: box, host: "0"},
+
+		{endpoint: "aliyun://", spec: aliyunEndpoint, err: "missing workdir (e.g. aliyun:///jfs?list-concurrency=8)"},
+		{endpoint: "/", spec: aliyunEndpoint, err: "missing workdir"},
+		{endpoint: "aliyun://jfs", spec: aliyunEndpoint, err: "missing workdir, jfs is taken as the host, use aliyun:///jfs to put it in the path"},
+		{endpoint: "aliyun://host/jfs", spec: aliyunEndpoint, err: "unexpected host host"},
+		{endpoint: "aliyun:jfs", spec: aliyunEndpoint, err: "aliyun:jfs is not a URL, it should start with aliyun://"},
+		{endpoint: "s3:///jfs", spec: aliyunEndpoint, err: "unsupported scheme s3, it should be aliyun://"},
+		{endpoint: "/jfs?foo=1", spec: aliyunEndpoint, err: "unknown option 'foo', it should be one of album, "},
+		{endpoint: "/jfs?list-concurency=8", spec: aliyunEndpoint, err: "unknown option 'list-concurency', did you mean 'list-concurrency'?"},
+		{endpoint: "/jfs?header.=A:1", spec: aliyunEndpoint, err: "unknown option 'header.'"},
+		{endpoint: "/jfs?a=%zz", spec: aliyunEndpoint, err: "invalid URL escape"},
+		{endpoint: "box:///jfs", spec: box, err: "missing folder id (e.g. box://0/jfs)"},
+		{endpoint: "box://0/jfs?x=1", spec: box, err: "unknown option 'x', it has no options"},
+	} {
+		ep, err := ParseEndpoint(c.endpoint, c.spec)
+		if c.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), "invalid endpoint "+c.endpoint+": ") || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s: expect error %q, but got %v", c.endpoint, c.err, err)
+			}
+			continue
+		}
+		if err != nil || ep.Host != c.host || ep.Path != c.path {
+			t.Fatalf("%s: expect host %q path %q, but got %+v %v", c.endpoint, c.host, c.path, ep, err)
+		}
+	}
+
+	// the defaults are added into the endpoints
+	for name := range DefaultOptions("aliyun") {
+		if !aliyunEndpoint.option(name) {
+			t.Fatalf("default option %s of aliyun is unknown", name)
+		}
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?max-rsp=10"); err == nil || !strings.Contains(err.Error(), "did you mean 'max-rps'?") {
+		t.Fatalf("a typo of the options should be reported: %v", err)
+	}
+}
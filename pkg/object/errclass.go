@@ -0,0 +1,100 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrorClass tells whether an operation failed with an error is worth
+// retrying.
+type ErrorClass int
+
+const (
+	// ErrorRetryable is a transient failure, e.g. throttled or a broken
+	// connection.
+	ErrorRetryable ErrorClass = iota
+	// ErrorPermanent fails again when retried, e.g. not found or denied.
+	ErrorPermanent
+)
+
+func (c ErrorClass) String() string {
+	if c == ErrorPermanent {
+		return "permanent"
+	}
+	return "retryable"
+}
+
+// ErrorClassifier classifies the errors of a storage.
+type ErrorClassifier func(err error) ErrorClass
+
+var (
+	classifierLock sync.RWMutex
+	classifiers    = make(map[string]ErrorClassifier)
+)
+
+// RegisterErrorClassifier sets the classifier of the storages of scheme, which
+// is consulted by the wrappers retrying the operations (e.g. WriteBack).
+func RegisterErrorClassifier(scheme string, c ErrorClassifier) {
+	classifierLock.Lock()
+	defer classifierLock.Unlock()
+	classifiers[scheme] = c
+}
+
+// ClassifyError classifies the error returned by s, by the classifier
+// registered for its scheme or DefaultErrorClassifier.
+func ClassifyError(s ObjectStorage, err error) ErrorClass {
+	scheme := strings.SplitN(s.String(), "://", 2)[0]
+	classifierLock.RLock()
+	c, ok := classifiers[scheme]
+	classifierLock.RUnlock()
+	if !ok {
+		c = DefaultErrorClassifier
+	}
+	return c(err)
+}
+
+// statusOf returns the HTTP status carried by err, or 0.
+func statusOf(err error) int {
+	var e interface{ StatusCode() int }
+	if errors.As(err, &e) {
+		return e.StatusCode()
+	}
+	return 0
+}
+
+// DefaultErrorClassifier treats the errors about the objects themselves and
+// the HTTP status 4xx except 408 and 429 as permanent, and the others (e.g.
+// 5xx or network errors) as retryable.
+func DefaultErrorClassifier(err error) ErrorClass {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrExist) || errors.Is(err, os.ErrPermission) ||
+		errors.Is(err, notSupported) || errors.Is(err, context.Canceled) {
+		return ErrorPermanent
+	}
+	switch code := statusOf(err); {
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests:
+		return ErrorRetryable
+	case code >= 400 && code < 500:
+		return ErrorPermanent
+	}
+	return ErrorRetryable
+}
@@ -0,0 +1,88 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type statusError int
+
+func (e statusError) Error() string   { return fmt.Sprintf("got %d", int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+func TestErrorClassifier(t *testing.T) {
+	aliyun := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	mem, _ := newMem("mem", "", "", "")
+	wrap := func(err error) error { return fmt.Errorf("put chunks/1: %w", err) }
+	cases := []struct {
+		err           error
+		aliyun, other ErrorClass
+	}{
+		{wrap(statusError(429)), ErrorRetryable, ErrorRetryable},
+		{wrap(statusError(403)), ErrorPermanent, ErrorPermanent},
+		{wrap(statusError(401)), ErrorRetryable, ErrorPermanent},
+		{wrap(statusError(503)), ErrorRetryable, ErrorRetryable},
+		{wrap(statusError(404)), ErrorPermanent, ErrorPermanent},
+		{wrap(os.ErrNotExist), ErrorPermanent, ErrorPermanent},
+		{wrap(io.ErrUnexpectedEOF), ErrorRetryable, ErrorRetryable},
+		{errors.New(`got "409", {"code":"AlreadyExist.File"}`), ErrorPermanent, ErrorRetryable},
+	}
+	for _, c := range cases {
+		if got := ClassifyError(aliyun, c.err); got != c.aliyun {
+			t.Fatalf("aliyun: expect %q to be %s, but got %s", c.err, c.aliyun, got)
+		}
+		if got := ClassifyError(mem, c.err); got != c.other {
+			t.Fatalf("mem: expect %q to be %s, but got %s", c.err, c.other, got)
+		}
+	}
+}
+
+type deniedPut struct {
+	ObjectStorage
+	puts int32
+}
+
+func (d *deniedPut) Put(key string, in io.Reader) error {
+	atomic.AddInt32(&d.puts, 1)
+	return statusError(403)
+}
+
+func TestWriteBackPermanentFailure(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	d := &deniedPut{ObjectStorage: m}
+	w, err := WithWriteBack(d, t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("write back: %s", err)
+	}
+	w.backoff = 0
+	if err = w.Put("a", strings.NewReader("aaa")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err = w.Flush(); err == nil {
+		t.Fatalf("the denied upload should be reported")
+	}
+	if n := atomic.LoadInt32(&d.puts); n != 1 {
+		t.Fatalf("a permanent failure should not be retried, but tried %d times", n)
+	}
+}
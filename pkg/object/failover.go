@@ -0,0 +1,249 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/K265/aliyundrive-go/pkg/aliyun/drive"
+)
+
+// aliyunAccount is the credential of one of the accounts serving a workdir.
+type aliyunAccount struct {
+	deviceID     string
+	refreshToken string
+	// keeps the latest refresh token of the account
+	tokenFile string
+}
+
+// aliyunAccounts pairs the comma separated refresh tokens with the device
+// ids, which could be a single one shared by all. The token saved in the
+// token file of an account takes precedence.
+func aliyunAccounts(deviceIDs, refreshTokens string) ([]aliyunAccount, error) {
+	ids, tokens := strings.Split(deviceIDs, ","), strings.Split(refreshTokens, ",")
+	if len(ids) != 1 && len(ids) != len(tokens) {
+		return nil, fmt.Errorf("%d device ids for %d refresh tokens", len(ids), len(tokens))
+	}
+	accounts := make([]aliyunAccount, len(tokens))
+	for i, token := range tokens {
+		a := aliyunAccount{deviceID: ids[0], refreshToken: strings.TrimSpace(token), tokenFile: aliyunTokenFile}
+		if len(ids) > 1 {
+			a.deviceID = ids[i]
+		}
+		if i > 0 {
+			a.tokenFile = fmt.Sprintf("%s.%d", aliyunTokenFile, i)
+		}
+		if data, err := os.ReadFile(a.tokenFile); err == nil {
+			a.refreshToken = string(data)
+		}
+		accounts[i] = a
+	}
+	return accounts, nil
+}
+
+// errAccountSwitched is returned by the calls on the nodes of an account
+// failed over, which are unknown to the next one.
+var errAccountSwitched = errors.New("switched to another account of aliyun drive")
+
+// isAccountFailure tells whether the account can't be used any more: its
+// refresh token is revoked, its quota is exhausted, or it's still unauthorized
+// (401) after the tokenRetrier failed to refresh the token. The other 403s
+// (e.g. forbidden to a file) are not failures of the account.
+func isAccountFailure(err error) bool {
+	if statusOf(err) == http.StatusUnauthorized {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "InvalidParameter.RefreshToken") || strings.Contains(msg, "QuotaExhausted")
+}
+
+// failoverDrive serves the drive of one of the accounts, the next one is
+// opened once the active one fails as isAccountFailure. The calls by path are
+// retried on the next account, while those on nodes fail with
+// errAccountSwitched since the node ids are different across accounts.
+type failoverDrive struct {
+	drive.Fs
+	mu       sync.Mutex
+	accounts []aliyunAccount
+	active   int
+	open     func(a aliyunAccount) (drive.Fs, error)
+	// onSwitch is called after the account is switched, e.g. to drop the
+	// node ids of the previous one
+	onSwitch func()
+}
+
+// newFailoverDrive opens the first usable account in order.
+func newFailoverDrive(accounts []aliyunAccount, open func(a aliyunAccount) (drive.Fs, error)) (*failoverDrive, error) {
+	var errs []string
+	for i, a := range accounts {
+		fs, err := open(a)
+		if err == nil {
+			if i > 0 {
+				logger.Warnf("Use the account %d of aliyun drive, since the previous ones failed: %s", i, strings.Join(errs, "; "))
+			}
+			return &failoverDrive{Fs: fs, accounts: accounts, active: i, open: open}, nil
+		}
+		errs = append(errs, fmt.Sprintf("account %d: %s", i, err))
+	}
+	return nil, fmt.Errorf("no account of aliyun drive is usable: %s", strings.Join(errs, "; "))
+}
+
+// current returns the active drive and the index of its account.
+func (f *failoverDrive) current() (drive.Fs, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Fs, f.active
+}
+
+// Active returns the index of the account in use.
+func (f *failoverDrive) Active() int {
+	_, i := f.current()
+	return i
+}
+
+// failover switches from the account i failed with err to the next usable
+// one, it returns false if it's not an account failure or none is usable.
+func (f *failoverDrive) failover(i int, err error) bool {
+	if err == nil || !isAccountFailure(err) {
+		return false
+	}
+	f.mu.Lock()
+	if f.active != i {
+		// switched by another call
+		f.mu.Unlock()
+		return true
+	}
+	switched := false
+	for n := 1; n < len(f.accounts); n++ {
+		next := (i + n) % len(f.accounts)
+		fs, e := f.open(f.accounts[next])
+		if e != nil {
+			logger.Warnf("Open the account %d of aliyun drive: %s", next, e)
+			continue
+		}
+		logger.Warnf("The account %d of aliyun drive failed: %s, switch to the account %d", i, err, next)
+		f.Fs, f.active, switched = fs, next, true
+		break
+	}
+	f.mu.Unlock()
+	if switched && f.onSwitch != nil {
+		f.onSwitch()
+	}
+	return switched
+}
+
+// byPath runs a call by path, which is tried again on the next account.
+func (f *failoverDrive) byPath(call func(fs drive.Fs) error) error {
+	fs, i := f.current()
+	err := call(fs)
+	if f.failover(i, err) {
+		fs, _ = f.current()
+		err = call(fs)
+	}
+	return err
+}
+
+// onNode runs a call on a node of the active account.
+func (f *failoverDrive) onNode(call func(fs drive.Fs) error) error {
+	fs, i := f.current()
+	err := call(fs)
+	if f.failover(i, err) {
+		return fmt.Errorf("%s: %w", err, errAccountSwitched)
+	}
+	return err
+}
+
+func (f *failoverDrive) GetByPath(ctx context.Context, fullPath string, kind string) (node *drive.Node, err error) {
+	err = f.byPath(func(fs drive.Fs) error {
+		node, err = fs.GetByPath(ctx, fullPath, kind)
+		return err
+	})
+	return
+}
+
+func (f *failoverDrive) About(ctx context.Context) (info *drive.PersonalSpaceInfo, err error) {
+	err = f.byPath(func(fs drive.Fs) error {
+		info, err = fs.About(ctx)
+		return err
+	})
+	return
+}
+
+func (f *failoverDrive) CreateFolderRecursively(ctx context.Context, fullPath string) (id string, err error) {
+	err = f.byPath(func(fs drive.Fs) error {
+		id, err = fs.CreateFolderRecursively(ctx, fullPath)
+		return err
+	})
+	return
+}
+
+func (f *failoverDrive) CreateFile(ctx context.Context, node drive.Node, in io.Reader) (id string, err error) {
+	err = f.onNode(func(fs drive.Fs) error {
+		id, err = fs.CreateFile(ctx, node, in)
+		return err
+	})
+	return
+}
+
+func (f *failoverDrive) Move(ctx context.Context, nodeId string, dstParentNodeId string, dstName string) (id string, err error) {
+	err = f.onNode(func(fs drive.Fs) error {
+		id, err = fs.Move(ctx, nodeId, dstParentNodeId, dstName)
+		return err
+	})
+	return
+}
+
+func (f *failoverDrive) Remove(ctx context.Context, nodeId string) error {
+	return f.onNode(func(fs drive.Fs) error {
+		return fs.Remove(ctx, nodeId)
+	})
+}
+
+func (f *failoverDrive) Open(ctx context.Context, nodeId string, headers map[string]string) (r io.ReadCloser, err error) {
+	err = f.onNode(func(fs drive.Fs) error {
+		r, err = fs.Open(ctx, nodeId, headers)
+		return err
+	})
+	return
+}
+
+func (f *failoverDrive) Download(ctx context.Context, url string, headers map[string]string) (r io.ReadCloser, err error) {
+	err = f.onNode(func(fs drive.Fs) error {
+		dl, ok := fs.(urlDownloader)
+		if !ok {
+			return notSupported
+		}
+		r, err = dl.Download(ctx, url, headers)
+		return err
+	})
+	return
+}
+
+func (f *failoverDrive) ListAll(ctx context.Context, nodeId string) (nodes []drive.Node, err error) {
+	err = f.onNode(func(fs drive.Fs) error {
+		nodes, err = fs.ListAll(ctx, nodeId)
+		return err
+	})
+	return
+}
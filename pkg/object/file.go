@@ -133,6 +133,16 @@ func (d *filestore) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (d *filestore) Put(key string, in io.Reader) error {
+	return d.put(key, in, time.Time{})
+}
+
+// PutWithMtime sets the mtime of the temp file before it's renamed, so the
+// object never shows up with the time of upload.
+func (d *filestore) PutWithMtime(key string, in io.Reader, mtime time.Time) error {
+	return d.put(key, in, mtime)
+}
+
+func (d *filestore) put(key string, in io.Reader, mtime time.Time) error {
 	p := d.path(key)
 
 	if strings.HasSuffix(key, dirSuffix) || key == "" && strings.HasSuffix(d.root, dirSuffix) {
@@ -171,6 +181,11 @@ func (d *filestore) Put(key string, in io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if !mtime.IsZero() {
+		if err = os.Chtimes(tmp, mtime, mtime); err != nil {
+			return err
+		}
+	}
 	err = os.Rename(tmp, p)
 	return err
 }
@@ -184,6 +199,15 @@ func (d *filestore) Copy(dst, src string) error {
 	return d.Put(dst, r)
 }
 
+// Rename moves the file src to dst, the parent directories of dst are created.
+func (d *filestore) Rename(src, dst string) error {
+	p := d.path(dst)
+	if err := os.MkdirAll(filepath.Dir(p), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return os.Rename(d.path(src), p)
+}
+
 func (d *filestore) Delete(key string) error {
 	err := os.Remove(d.path(key))
 	if err != nil && os.IsNotExist(err) {
@@ -0,0 +1,108 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const filebaseEndpoint = "s3.filebase.com"
+
+// filebase is the S3 API of Filebase, which stores the objects in IPFS.
+type filebase struct {
+	s3client
+}
+
+func (s *filebase) String() string {
+	return fmt.Sprintf("filebase://%s/", s.s3client.bucket)
+}
+
+// GetCID returns the IPFS CID of an object, so it could be pinned or fetched
+// from any IPFS gateway.
+func (s *filebase) GetCID(key string) (string, error) {
+	r, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
+		return "", err
+	}
+	for k, v := range r.Metadata {
+		if strings.EqualFold(k, "cid") && v != nil && *v != "" {
+			return *v, nil
+		}
+	}
+	return "", fmt.Errorf("no CID of %s", key)
+}
+
+// parseFilebaseEndpoint accepts `bucket`, `bucket.s3.filebase.com` or
+// `https://s3.filebase.com/bucket`.
+func parseFilebaseEndpoint(endpoint string) (string, string, error) {
+	if !strings.Contains(endpoint, "://") {
+		if b := strings.TrimSuffix(endpoint, "."+filebaseEndpoint); !strings.Contains(b, ".") && !strings.Contains(b, "/") && b != "" {
+			return "https://" + filebaseEndpoint, b, nil
+		}
+		endpoint = "https://" + endpoint
+	}
+	uri, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid endpoint %s: %s", endpoint, err)
+	}
+	bucket := strings.Trim(uri.Path, "/")
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return "", "", fmt.Errorf("Invalid bucket in endpoint %s", endpoint)
+	}
+	return fmt.Sprintf("%s://%s", uri.Scheme, uri.Host), bucket, nil
+}
+
+func newFilebase(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	service, bucket, err := parseFilebaseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	awsConfig := &aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         &service,
+		S3ForcePathStyle: aws.Bool(true),
+		HTTPClient:       httpClient,
+		Credentials:      credentials.NewStaticCredentials(accessKey, secretKey, token),
+	}
+	ses, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("aws session: %s", err)
+	}
+	ses.Handlers.Build.PushFront(disableSha256Func)
+	c, err := newS3Client(bucket, ses, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &filebase{c}, nil
+}
+
+func init() {
+	Register("filebase", newFilebase)
+}
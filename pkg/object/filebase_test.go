@@ -0,0 +1,78 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFilebaseCID(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/jfs/chunks/1_0_4":
+			w.Header().Set("x-amz-meta-cid", "QmXoypizjW3WknFiJnKLwHCnL72vedxjQkDDP1mXWo6uco")
+			w.Header().Set("Content-Length", "4")
+		case "/jfs/pending":
+			w.Header().Set("Content-Length", "4")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	s, err := newFilebase(srv.URL+"/jfs", "key", "secret", "")
+	if err != nil {
+		t.Fatalf("create filebase: %s", err)
+	}
+	f := s.(*filebase)
+	if cid, err := f.GetCID("chunks/1_0_4"); err != nil || cid != "QmXoypizjW3WknFiJnKLwHCnL72vedxjQkDDP1mXWo6uco" {
+		t.Fatalf("get cid: %q %v", cid, err)
+	}
+	if _, err = f.GetCID("pending"); err == nil {
+		t.Fatalf("object without CID should fail")
+	}
+	if _, err = f.GetCID("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("cid of missing object: %v", err)
+	}
+}
+
+func TestFilebaseEndpoint(t *testing.T) {
+	for ep, expect := range map[string][2]string{
+		"jfs":                         {"https://s3.filebase.com", "jfs"},
+		"jfs.s3.filebase.com":         {"https://s3.filebase.com", "jfs"},
+		"https://s3.filebase.com/jfs": {"https://s3.filebase.com", "jfs"},
+		"http://127.0.0.1:9000/jfs/":  {"http://127.0.0.1:9000", "jfs"},
+	} {
+		service, bucket, err := parseFilebaseEndpoint(ep)
+		if err != nil || service != expect[0] || bucket != expect[1] {
+			t.Fatalf("parse %s: expect %v, but got %s %s %v", ep, expect, service, bucket, err)
+		}
+	}
+	s, err := newFilebase("jfs", "key", "secret", "")
+	if err != nil {
+		t.Fatalf("create filebase: %s", err)
+	}
+	if c := s.(*filebase).s3.Client; c.Endpoint != "https://s3.filebase.com" || *c.Config.Region != "us-east-1" || !*c.Config.S3ForcePathStyle {
+		t.Fatalf("preset of filebase: %s %s %v", c.Endpoint, *c.Config.Region, *c.Config.S3ForcePathStyle)
+	}
+	if _, _, err := parseFilebaseEndpoint("https://s3.filebase.com/"); err == nil {
+		t.Fatalf("endpoint without bucket should be rejected")
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// number of the buckets of GetSizeStats.Sizes
+const getSizeBuckets = 12
+
+// GetSizeStats is the distribution of the sizes of Gets, in the bytes read.
+type GetSizeStats struct {
+	Gets  int64
+	Bytes int64
+	// Sizes[i] counts the Gets of less than 1KiB<<i bytes which are not
+	// counted by Sizes[i-1], the last one counts the larger ones too
+	Sizes [getSizeBuckets]int64
+	// times the average size fell below the threshold
+	Warnings int64
+}
+
+// GetSizeGuard is an object storage tracking the sizes of Gets. It warns once
+// the average size of the last window of Gets falls below the threshold,
+// since each request costs the same overhead and the tiny ones waste most of
+// it, which usually means the block size is too small for the storage.
+type GetSizeGuard struct {
+	ObjectStorage
+	threshold int64
+	window    int64
+	clock     Clock
+	// the warnings are logged at most once in it
+	quiet time.Duration
+
+	mu       sync.Mutex
+	stats    GetSizeStats
+	gets     int64 // of the current window
+	bytes    int64
+	lastWarn time.Time
+}
+
+// WithGetSizeGuard returns a GetSizeGuard of o checking the average size of
+// every window Gets against threshold in bytes.
+func WithGetSizeGuard(o ObjectStorage, threshold int64, window int) *GetSizeGuard {
+	return withGetSizeGuard(o, threshold, window, SystemClock)
+}
+
+func withGetSizeGuard(o ObjectStorage, threshold int64, window int, clock Clock) *GetSizeGuard {
+	if window <= 0 {
+		window = 1000
+	}
+	return &GetSizeGuard{ObjectStorage: o, threshold: threshold, window: int64(window), clock: clock, quiet: time.Minute}
+}
+
+func (g *GetSizeGuard) String() string {
+	return fmt.Sprintf("%s(get size guard %d)", g.ObjectStorage, g.threshold)
+}
+
+// Stats returns the distribution of the sizes of Gets so far.
+func (g *GetSizeGuard) Stats() GetSizeStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats
+}
+
+func (g *GetSizeGuard) record(n int64) {
+	b := 0
+	for b < getSizeBuckets-1 && n >= 1<<10<<b {
+		b++
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stats.Gets++
+	g.stats.Bytes += n
+	g.stats.Sizes[b]++
+	g.gets++
+	g.bytes += n
+	if g.gets < g.window {
+		return
+	}
+	avg := g.bytes / g.gets
+	g.gets, g.bytes = 0, 0
+	if avg >= g.threshold {
+		return
+	}
+	g.stats.Warnings++
+	if now := g.clock.Now(); now.Sub(g.lastWarn) >= g.quiet {
+		g.lastWarn = now
+		logger.Warnf("The average size of the last %d Gets from %s is %d bytes, smaller than %d, consider a larger block size (--block-size)", g.window, g.ObjectStorage, avg, g.threshold)
+	}
+}
+
+// sizedReader records the bytes read at the end or when it's closed.
+type sizedReader struct {
+	io.ReadCloser
+	g    *GetSizeGuard
+	n    int64
+	once sync.Once
+}
+
+func (r *sizedReader) done() {
+	r.once.Do(func() { r.g.record(r.n) })
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if err == io.EOF {
+		r.done()
+	}
+	return n, err
+}
+
+func (r *sizedReader) Close() error {
+	r.done()
+	return r.ReadCloser.Close()
+}
+
+func (g *GetSizeGuard) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r, err := g.ObjectStorage.Get(key, off, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedReader{ReadCloser: r, g: g}, nil
+}
+
+func (g *GetSizeGuard) GetInto(key string, offset int64, buf []byte) (int, error) {
+	n, err := GetInto(g.ObjectStorage, key, offset, buf)
+	if err == nil || err == io.EOF {
+		g.record(int64(n))
+	}
+	return n, err
+}
+
+var _ ObjectStorage = &GetSizeGuard{}
@@ -0,0 +1,57 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestGetSizeGuard(t *testing.T) {
+	mem, _ := newMem("mem", "", "", "")
+	_ = mem.Put("obj", bytes.NewReader(make([]byte, 4<<20)))
+	g := withGetSizeGuard(mem, 64<<10, 50, NewFakeClock(time.Now()))
+
+	for i := 0; i < 100; i++ {
+		if _, err := get(g, "obj", int64(i)<<12, 4<<10); err != nil {
+			t.Fatalf("get: %s", err)
+		}
+	}
+	st := g.Stats()
+	if st.Gets != 100 || st.Bytes != 100<<12 || st.Sizes[3] != 100 {
+		t.Fatalf("unexpected stats of small gets: %+v", st)
+	}
+	if st.Warnings != 2 {
+		t.Fatalf("expect 2 warnings of small gets, but got %d", st.Warnings)
+	}
+
+	g = withGetSizeGuard(mem, 64<<10, 50, NewFakeClock(time.Now()))
+	buf := make([]byte, 1<<20)
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			if _, err := get(g, "obj", 0, 1<<20); err != nil {
+				t.Fatalf("get: %s", err)
+			}
+		} else if _, err := g.GetInto("obj", 1<<20, buf); err != nil {
+			t.Fatalf("get into: %s", err)
+		}
+	}
+	if st = g.Stats(); st.Warnings != 0 || st.Sizes[getSizeBuckets-1] != 100 {
+		t.Fatalf("large gets should not warn: %+v", st)
+	}
+}
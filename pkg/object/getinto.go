@@ -0,0 +1,57 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import "io"
+
+// BufferGetter is implemented by the storages which could read a range of an
+// object into the buffer of the caller, without the buffers and readers of
+// the stream returned by Get.
+type BufferGetter interface {
+	GetInto(key string, offset int64, buf []byte) (int, error)
+}
+
+// GetInto reads the object from offset into buf, by GetInto of a
+// BufferGetter or a ranged Get of the others. As io.ReaderAt, it returns
+// io.EOF with the bytes read if the object ends before buf is filled.
+func GetInto(s ObjectStorage, key string, offset int64, buf []byte) (int, error) {
+	if g, ok := s.(BufferGetter); ok {
+		return g.GetInto(key, offset, buf)
+	}
+	return getInto(s, key, offset, buf)
+}
+
+func getInto(s ObjectStorage, key string, offset int64, buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	r, err := s.Get(key, offset, int64(len(buf)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return readFull(r, buf)
+}
+
+// readFull fills buf from r, a short read at the end is io.EOF.
+func readFull(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
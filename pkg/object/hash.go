@@ -0,0 +1,127 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// HashAlgo names an algorithm to hash the whole content of objects.
+type HashAlgo string
+
+const (
+	HashMD5    HashAlgo = "md5"
+	HashSHA1   HashAlgo = "sha1"
+	HashSHA256 HashAlgo = "sha256"
+	HashCRC32C HashAlgo = "crc32c"
+)
+
+// DefaultHashAlgo is used when the storage keeps no checksum of objects.
+var DefaultHashAlgo = HashSHA256
+
+// New returns a hash of the algorithm.
+func (a HashAlgo) New() (hash.Hash, error) {
+	switch a {
+	case HashMD5:
+		return md5.New(), nil
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashCRC32C:
+		return crc32.New(crc32c), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", a)
+}
+
+// HashedObject is an object carrying the checksum kept by the storage, as
+// the ETag of a single part upload in S3. The checksum is in lower case hex.
+type HashedObject interface {
+	Object
+	Hash() (HashAlgo, string)
+}
+
+type hashedObj struct {
+	obj
+	algo HashAlgo
+	sum  string
+}
+
+func (o *hashedObj) Hash() (HashAlgo, string) { return o.algo, o.sum }
+
+// HashOf returns the checksum of an object. The one returned by Head is used
+// if there is, so the content is not read again, otherwise the content is
+// read and hashed with algo (or DefaultHashAlgo if empty).
+func HashOf(o ObjectStorage, key string, algo HashAlgo) (HashAlgo, string, error) {
+	head, err := o.Head(key)
+	if err != nil {
+		return "", "", err
+	}
+	if h, ok := head.(HashedObject); ok {
+		if a, sum := h.Hash(); sum != "" {
+			return a, sum, nil
+		}
+	}
+	if algo == "" {
+		algo = DefaultHashAlgo
+	}
+	sum, err := hashContent(o, key, algo)
+	return algo, sum, err
+}
+
+func hashContent(o ObjectStorage, key string, algo HashAlgo) (string, error) {
+	h, err := algo.New()
+	if err != nil {
+		return "", err
+	}
+	in, err := o.Get(key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	if _, err = io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SameContent tells whether two objects have the same content by their
+// checksums, the content of a is read only when b keeps a checksum of
+// another algorithm.
+func SameContent(a ObjectStorage, akey string, b ObjectStorage, bkey string) (bool, error) {
+	algo, sum, err := HashOf(a, akey, "")
+	if err != nil {
+		return false, err
+	}
+	balgo, bsum, err := HashOf(b, bkey, algo)
+	if err != nil {
+		return false, err
+	}
+	if balgo != algo {
+		if sum, err = hashContent(a, akey, balgo); err != nil {
+			return false, err
+		}
+	}
+	return sum == bsum, nil
+}
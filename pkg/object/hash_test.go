@@ -0,0 +1,41 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHashOf(t *testing.T) {
+	m, _ := newMem("mem", "", "", "")
+	_ = m.Put("a", bytes.NewReader([]byte("hello")))
+	for algo, expect := range map[HashAlgo]string{
+		"":         "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		HashMD5:    "5d41402abc4b2a76b9719d911017c592",
+		HashSHA1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		HashCRC32C: "9a71bb4c",
+	} {
+		a, sum, err := HashOf(m, "a", algo)
+		if err != nil || sum != expect || algo != "" && a != algo || algo == "" && a != DefaultHashAlgo {
+			t.Fatalf("hash with %q: %s %s %v", algo, a, sum, err)
+		}
+	}
+	if _, _, err := HashOf(m, "a", "crc64"); err == nil {
+		t.Fatalf("unknown algorithm should fail")
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Hooks are the callbacks after the changes of objects succeeded, e.g. to
+// notify a webhook or update an external index. Either of them could be nil.
+type Hooks struct {
+	// AfterWrite is called with the key and size of an object written by Put,
+	// PutIfAbsent, Copy, Rename (as dst) or CompleteUpload. The size is -1 if
+	// it can't be known after the write.
+	AfterWrite func(key string, size int64) error
+	// AfterDelete is called with the key of an object deleted by Delete or
+	// Rename (as src).
+	AfterDelete func(key string) error
+	// Timeout is the longest an operation waits for its hook before
+	// returning, the hook keeps running in background after that. Zero means
+	// not to wait at all.
+	Timeout time.Duration
+}
+
+type withHooks struct {
+	ObjectStorage
+	hooks Hooks
+}
+
+// WithHooks returns an object storage of o calling the hooks after the writes
+// and deletes. The errors of hooks are logged, which don't fail the
+// operations already done.
+func WithHooks(o ObjectStorage, hooks Hooks) ObjectStorage {
+	return &withHooks{o, hooks}
+}
+
+func (h *withHooks) String() string {
+	return fmt.Sprintf("%s(hooks)", h.ObjectStorage)
+}
+
+// run calls fn in background, and waits for it up to the timeout.
+func (h *withHooks) run(op, key string, fn func() error) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := fn(); err != nil {
+			logger.Warnf("Hook after %s %s of %s: %s", op, key, h.ObjectStorage, err)
+		}
+	}()
+	if h.hooks.Timeout <= 0 {
+		return
+	}
+	t := time.NewTimer(h.hooks.Timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		logger.Warnf("Hook after %s %s of %s is not done in %s", op, key, h.ObjectStorage, h.hooks.Timeout)
+	}
+}
+
+func (h *withHooks) written(op, key string, size int64) {
+	if h.hooks.AfterWrite == nil {
+		return
+	}
+	if size < 0 {
+		if o, err := h.ObjectStorage.Head(key); err == nil {
+			size = o.Size()
+		}
+	}
+	h.run(op, key, func() error { return h.hooks.AfterWrite(key, size) })
+}
+
+func (h *withHooks) deleted(op, key string) {
+	if h.hooks.AfterDelete != nil {
+		h.run(op, key, func() error { return h.hooks.AfterDelete(key) })
+	}
+}
+
+// sizeCounter counts the bytes read from it.
+type sizeCounter struct {
+	io.Reader
+	n int64
+}
+
+func (c *sizeCounter) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (h *withHooks) Put(key string, in io.Reader) error {
+	// a seekable one could be read more than once, e.g. by the retries, so
+	// its size is from Head
+	var c *sizeCounter
+	if _, ok := in.(io.Seeker); !ok {
+		c = &sizeCounter{Reader: in}
+		in = c
+	}
+	if err := h.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	size := int64(-1)
+	if c != nil {
+		size = c.n
+	}
+	h.written("put", key, size)
+	return nil
+}
+
+func (h *withHooks) PutIfAbsent(key string, in io.Reader) error {
+	p, ok := h.ObjectStorage.(interface {
+		PutIfAbsent(key string, in io.Reader) error
+	})
+	if !ok {
+		return notSupported
+	}
+	if err := p.PutIfAbsent(key, in); err != nil {
+		return err
+	}
+	h.written("put", key, -1)
+	return nil
+}
+
+func (h *withHooks) Copy(dst, src string) error {
+	var err error
+	if c, ok := h.ObjectStorage.(interface{ Copy(dst, src string) error }); ok {
+		err = c.Copy(dst, src)
+	} else {
+		var in io.ReadCloser
+		if in, err = h.ObjectStorage.Get(src, 0, -1); err == nil {
+			err = h.ObjectStorage.Put(dst, in)
+			_ = in.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	h.written("copy", dst, -1)
+	return nil
+}
+
+func (h *withHooks) Rename(src, dst string) error {
+	if err := Rename(h.ObjectStorage, src, dst); err != nil {
+		return err
+	}
+	h.written("rename", dst, -1)
+	h.deleted("rename", src)
+	return nil
+}
+
+func (h *withHooks) Delete(key string) error {
+	if err := h.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	h.deleted("delete", key)
+	return nil
+}
+
+func (h *withHooks) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if err := h.ObjectStorage.CompleteUpload(key, uploadID, parts); err != nil {
+		return err
+	}
+	h.written("complete upload", key, -1)
+	return nil
+}
+
+func (h *withHooks) GetInto(key string, offset int64, buf []byte) (int, error) {
+	return GetInto(h.ObjectStorage, key, offset, buf)
+}
+
+func (h *withHooks) GetIfMatch(key string, off, limit int64, version string) (io.ReadCloser, string, error) {
+	return GetIfMatch(h.ObjectStorage, key, off, limit, version)
+}
+
+var _ ObjectStorage = &withHooks{}
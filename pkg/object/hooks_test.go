@@ -0,0 +1,107 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	mem, _ := newMem("mem", "", "", "")
+	s := WithHooks(mem, Hooks{
+		AfterWrite: func(key string, size int64) error {
+			record(fmt.Sprintf("write %s %d", key, size))
+			return nil
+		},
+		AfterDelete: func(key string) error {
+			record("delete " + key)
+			return errors.New("ignored")
+		},
+		Timeout: time.Second,
+	})
+	expect := func(e ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(events, e) {
+			t.Fatalf("expect hooks %q, but got %q", e, events)
+		}
+		events = nil
+	}
+
+	if err := s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put a: %s", err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write([]byte("pipe"))
+		_ = pw.Close()
+	}()
+	if err := s.Put("b", pr); err != nil {
+		t.Fatalf("put b: %s", err)
+	}
+	expect("write a 5", "write b 4")
+
+	broken := errors.New("broken")
+	if err := s.Put("c", io.MultiReader(strings.NewReader("part"), iotest.ErrReader(broken))); !errors.Is(err, broken) {
+		t.Fatalf("put c should fail: %v", err)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatalf("delete a: %s", err)
+	}
+	expect("delete a")
+
+	if err := s.(interface{ Copy(dst, src string) error }).Copy("c", "b"); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if err := Rename(s, "c", "d"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	expect("write c 4", "write d 4", "delete c")
+
+	// a slow hook delays the operation by the timeout at most
+	slow := WithHooks(mem, Hooks{
+		AfterWrite: func(key string, size int64) error {
+			time.Sleep(time.Second)
+			return nil
+		},
+		Timeout: time.Millisecond * 50,
+	})
+	start := time.Now()
+	if err := slow.Put("e", strings.NewReader("e")); err != nil {
+		t.Fatalf("put e: %s", err)
+	}
+	if used := time.Since(start); used > time.Millisecond*500 {
+		t.Fatalf("the slow hook blocked the put for %s", used)
+	}
+}
@@ -23,7 +23,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -33,6 +33,7 @@ import (
 
 	"github.com/IBM/ibm-cos-sdk-go/aws"
 	"github.com/IBM/ibm-cos-sdk-go/aws/awserr"
+	"github.com/IBM/ibm-cos-sdk-go/aws/credentials"
 	"github.com/IBM/ibm-cos-sdk-go/aws/credentials/ibmiam"
 	"github.com/IBM/ibm-cos-sdk-go/aws/session"
 	"github.com/IBM/ibm-cos-sdk-go/service/s3"
@@ -69,22 +70,22 @@ func (s *ibmcos) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	}
 	resp, err := s.s3.GetObject(params)
 	if err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
 		return nil, err
 	}
 	return resp.Body, nil
 }
 
 func (s *ibmcos) Put(key string, in io.Reader) error {
-	var body io.ReadSeeker
-	if b, ok := in.(io.ReadSeeker); ok {
-		body = b
-	} else {
-		data, err := ioutil.ReadAll(in)
-		if err != nil {
-			return err
-		}
-		body = bytes.NewReader(data)
+	// the length is required, the content of unknown length is spooled
+	sp, err := Spool(in, spoolMemory, "")
+	if err != nil {
+		return err
 	}
+	defer sp.Close()
+	body := sp.ReadSeeker
 	mimeType := utils.GuessMimeType(key)
 	params := &s3.PutObjectInput{
 		Bucket:      &s.bucket,
@@ -92,7 +93,7 @@ func (s *ibmcos) Put(key string, in io.Reader) error {
 		Body:        body,
 		ContentType: &mimeType,
 	}
-	_, err := s.s3.PutObject(params)
+	_, err = s.s3.PutObject(params)
 	return err
 }
 
@@ -240,21 +241,62 @@ func (s *ibmcos) ListUploads(marker string) ([]*PendingPart, string, error) {
 	return parts, nextMarker, nil
 }
 
-func newIBMCOS(endpoint, apiKey, serviceInstanceID, token string) (ObjectStorage, error) {
+// parseIBMCOSEndpoint returns the bucket, region and URL of service from the
+// endpoint, which is `bucket.s3.<region>.cloud-object-storage.appdomain.cloud`
+// or `http://host:port/bucket` for other compatible services.
+func parseIBMCOSEndpoint(uri *url.URL) (bucket, region, serviceEndpoint string, err error) {
+	hostParts := strings.Split(uri.Host, ".")
+	if len(hostParts) >= 3 && net.ParseIP(uri.Hostname()) == nil {
+		bucket = hostParts[0]
+		region = hostParts[2]
+		serviceEndpoint = uri.Scheme + "://" + strings.SplitN(uri.Host, ".", 2)[1]
+	} else {
+		bucket = strings.Split(strings.Trim(uri.Path, "/"), "/")[0]
+		region = "us-south"
+		serviceEndpoint = uri.Scheme + "://" + uri.Host
+	}
+	if r := uri.Query().Get("region"); r != "" {
+		region = r
+	}
+	if bucket == "" {
+		err = fmt.Errorf("no bucket in endpoint %s", uri)
+	}
+	return
+}
+
+// newIBMCOS creates a storage with IAM (default) or HMAC credentials, chosen
+// by `auth=iam|hmac` in the endpoint. For IAM, the access key and secret key
+// are the API key and the service instance ID, and the token is refreshed
+// before expired. For HMAC, they are the access key ID and secret access key.
+func newIBMCOS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
 	if !strings.Contains(endpoint, "://") {
 		endpoint = fmt.Sprintf("https://%s", endpoint)
 	}
-	uri, _ := url.ParseRequestURI(endpoint)
-	hostParts := strings.Split(uri.Host, ".")
-	bucket := hostParts[0]
-	region := hostParts[2]
-	authEndpoint := "https://iam.cloud.ibm.com/identity/token"
-	serviceEndpoint := "https://" + strings.SplitN(uri.Host, ".", 2)[1]
+	uri, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+	}
+	bucket, region, serviceEndpoint, err := parseIBMCOSEndpoint(uri)
+	if err != nil {
+		return nil, err
+	}
+	var cred *credentials.Credentials
+	switch auth := uri.Query().Get("auth"); auth {
+	case "", "iam":
+		authEndpoint := "https://iam.cloud.ibm.com/identity/token"
+		if e := uri.Query().Get("iam-endpoint"); e != "" {
+			authEndpoint = e
+		}
+		cred = ibmiam.NewStaticCredentials(aws.NewConfig(), authEndpoint, accessKey, secretKey)
+	case "hmac":
+		cred = credentials.NewStaticCredentials(accessKey, secretKey, token)
+	default:
+		return nil, fmt.Errorf("invalid auth %s, it should be iam or hmac", auth)
+	}
 	conf := aws.NewConfig().
 		WithRegion(region).
 		WithEndpoint(serviceEndpoint).
-		WithCredentials(ibmiam.NewStaticCredentials(aws.NewConfig(),
-			authEndpoint, apiKey, serviceInstanceID)).
+		WithCredentials(cred).
 		WithS3ForcePathStyle(true)
 	sess := session.Must(session.NewSession())
 	client := s3.New(sess, conf)
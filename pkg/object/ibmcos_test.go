@@ -0,0 +1,220 @@
+//go:build !noibmcos
+// +build !noibmcos
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIBMCOS emulates IAM and a few APIs of S3 on a bucket, it records the
+// Authorization headers received.
+type mockIBMCOS struct {
+	sync.Mutex
+	srv      *httptest.Server
+	objects  map[string][]byte
+	tokenTTL int64
+	tokens   int
+	grants   []string
+	auths    []string
+}
+
+func newMockIBMCOS() *mockIBMCOS {
+	m := &mockIBMCOS{objects: make(map[string][]byte), tokenTTL: 3600}
+	m.srv = httptest.NewServer(m)
+	return m
+}
+
+func (m *mockIBMCOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	if r.URL.Path == "/identity/token" {
+		_ = r.ParseForm()
+		m.grants = append(m.grants, r.Form.Get("grant_type"))
+		if r.Form.Get("apikey") != "apikey1" && r.Form.Get("refresh_token") == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"errorCode": "BXNIM0415E", "errorMessage": "Provided API key could not be found"})
+			return
+		}
+		m.tokens++
+		ttl := m.tokenTTL
+		if r.Form.Get("grant_type") == "refresh_token" {
+			ttl = 3600
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"access_token":  fmt.Sprintf("token%d", m.tokens),
+			"refresh_token": fmt.Sprintf("refresh%d", m.tokens),
+			"token_type":    "Bearer",
+			"expires_in":    ttl,
+			"expiration":    time.Now().Unix() + ttl,
+		})
+		return
+	}
+	m.auths = append(m.auths, r.Header.Get("Authorization"))
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+		}
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			data, ok := m.objects[strings.TrimPrefix(src, "bucket/")]
+			if !ok {
+				notFound()
+				return
+			}
+			m.objects[key] = data
+			_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><CopyObjectResult><ETag>"etag"</ETag><LastModified>2022-01-01T00:00:00.000Z</LastModified></CopyObjectResult>`)
+			return
+		}
+		m.objects[key], _ = io.ReadAll(r.Body)
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		data, ok := m.objects[key]
+		if !ok {
+			notFound()
+			return
+		}
+		http.ServeContent(w, r, key, time.Unix(1600000000, 0), bytes.NewReader(data))
+	case http.MethodDelete:
+		delete(m.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (m *mockIBMCOS) lastAuth() string {
+	m.Lock()
+	defer m.Unlock()
+	return m.auths[len(m.auths)-1]
+}
+
+func testIBMCOSOps(t *testing.T, s ObjectStorage) {
+	if err := s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if d, err := get(s, "a", 1, 3); err != nil || d != "ell" {
+		t.Fatalf("get: %q %v", d, err)
+	}
+	if o, err := s.Head("a"); err != nil || o.Size() != 5 {
+		t.Fatalf("head: %v %v", o, err)
+	}
+	if _, err := s.Head("b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head of not existed object: %v", err)
+	}
+	if _, err := s.Get("b", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get of not existed object: %v", err)
+	}
+	if err := s.(*ibmcos).Copy("b", "a"); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if d, err := get(s, "b", 0, -1); err != nil || d != "hello" {
+		t.Fatalf("get copied: %q %v", d, err)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+}
+
+func TestIBMCOSIAM(t *testing.T) {
+	m := newMockIBMCOS()
+	defer m.srv.Close()
+	// the SDK refreshes a token with less than 6 seconds left in the request
+	m.tokenTTL = 8
+	endpoint := m.srv.URL + "/bucket?iam-endpoint=" + url.QueryEscape(m.srv.URL+"/identity/token")
+	s, err := newIBMCOS(endpoint, "apikey1", "instance1", "")
+	if err != nil {
+		t.Fatalf("create ibmcos: %s", err)
+	}
+	testIBMCOSOps(t, s)
+	if auth := m.lastAuth(); auth != "Bearer token1" {
+		t.Fatalf("expect the IAM token, but got %q", auth)
+	}
+
+	// the token is refreshed before expired
+	time.Sleep(2500 * time.Millisecond)
+	if _, err := s.Head("b"); err != nil {
+		t.Fatalf("head with an expiring token: %s", err)
+	}
+	if auth := m.lastAuth(); auth == "Bearer token1" || !strings.HasPrefix(auth, "Bearer token") {
+		t.Fatalf("expect a refreshed token, but got %q", auth)
+	}
+	m.Lock()
+	grants := strings.Join(m.grants, ",")
+	m.Unlock()
+	if !strings.Contains(grants, "refresh_token") {
+		t.Fatalf("the token should be refreshed with the refresh token: %s", grants)
+	}
+
+	s, _ = newIBMCOS(endpoint, "bad key", "instance1", "")
+	if err := s.Put("a", bytes.NewReader(nil)); err == nil {
+		t.Fatalf("put with a bad API key should fail")
+	}
+}
+
+func TestIBMCOSHMAC(t *testing.T) {
+	m := newMockIBMCOS()
+	defer m.srv.Close()
+	s, err := newIBMCOS(m.srv.URL+"/bucket?auth=hmac&region=eu-de", "access1", "secret1", "")
+	if err != nil {
+		t.Fatalf("create ibmcos: %s", err)
+	}
+	testIBMCOSOps(t, s)
+	auth := m.lastAuth()
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access1/") || !strings.Contains(auth, "/eu-de/s3/aws4_request") ||
+		!strings.Contains(auth, "Signature=") {
+		t.Fatalf("expect a signature with the HMAC key, but got %q", auth)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if len(m.grants) != 0 {
+		t.Fatalf("IAM should not be used with HMAC: %v", m.grants)
+	}
+
+	if _, err := newIBMCOS(m.srv.URL+"/bucket?auth=oauth", "", "", ""); err == nil {
+		t.Fatalf("unknown auth should be rejected")
+	}
+}
+
+func TestIBMCOSEndpoint(t *testing.T) {
+	for ep, expect := range map[string][3]string{
+		"https://jfs.s3.us-south.cloud-object-storage.appdomain.cloud":        {"jfs", "us-south", "https://s3.us-south.cloud-object-storage.appdomain.cloud"},
+		"https://jfs.s3.eu-de.cloud-object-storage.appdomain.cloud?auth=hmac": {"jfs", "eu-de", "https://s3.eu-de.cloud-object-storage.appdomain.cloud"},
+		"http://127.0.0.1:9000/jfs?region=jp-tok":                             {"jfs", "jp-tok", "http://127.0.0.1:9000"},
+	} {
+		u, _ := url.ParseRequestURI(ep)
+		bucket, region, service, err := parseIBMCOSEndpoint(u)
+		if err != nil || bucket != expect[0] || region != expect[1] || service != expect[2] {
+			t.Fatalf("parse %s: expect %v, but got %s %s %s %v", ep, expect, bucket, region, service, err)
+		}
+	}
+}
@@ -21,14 +21,70 @@ import (
 	"time"
 )
 
+// Object is an object returned by Head or List. The storages may carry more
+// about it by the optional interfaces, e.g. HashedObject, see InfoOf.
 type Object interface {
+	// Key is relative to the storage, directories end with `/`.
 	Key() string
+	// Size of the content in bytes, 0 for directories.
 	Size() int64
+	// Mtime is the last modified time, zero if it's unknown.
 	Mtime() time.Time
 	IsDir() bool
 	IsSymlink() bool
 }
 
+// ObjectInfo is all the metadata of an object, the fields not kept by the
+// storage are left zero.
+type ObjectInfo struct {
+	Key       string
+	Size      int64
+	Mtime     time.Time
+	IsDir     bool
+	IsSymlink bool
+	// checksum of the content in lower case hex, empty if it's unknown
+	HashAlgo HashAlgo
+	Hash     string
+	// ETag as returned by the storage, empty if it has no ETag
+	ETag string
+	// the MIME type of the content, empty if it's unknown
+	ContentType string
+	// empty for the default class of the storage
+	StorageClass string
+	// server-side encryption, e.g. AES256, aws:kms or SSE-C for S3, empty
+	// if it's not encrypted or unknown
+	Encryption string
+	// the object can't be deleted or overwritten before it, zero if it's not
+	// retained (see Retainer)
+	RetainUntil time.Time
+	// user defined metadata, nil if there is none
+	Metadata map[string]string
+	// the tags of the object, nil if there is none
+	Tags map[string]string
+}
+
+// DescribedObject is an object carrying more metadata than HashedObject.
+type DescribedObject interface {
+	Object
+	Info() ObjectInfo
+}
+
+// InfoOf returns the metadata carried by an object, it does not request the
+// storage for the missing ones.
+func InfoOf(o Object) ObjectInfo {
+	if d, ok := o.(DescribedObject); ok {
+		return d.Info()
+	}
+	i := ObjectInfo{Key: o.Key(), Size: o.Size(), Mtime: o.Mtime(), IsDir: o.IsDir(), IsSymlink: o.IsSymlink()}
+	if h, ok := o.(HashedObject); ok {
+		i.HashAlgo, i.Hash = h.Hash()
+		if i.Hash == "" {
+			i.HashAlgo = ""
+		}
+	}
+	return i
+}
+
 type obj struct {
 	key   string
 	size  int64
@@ -42,6 +98,18 @@ func (o *obj) Mtime() time.Time { return o.mtime }
 func (o *obj) IsDir() bool      { return o.isDir }
 func (o *obj) IsSymlink() bool  { return false }
 
+// describedObj is an obj carrying the other metadata of ObjectInfo.
+type describedObj struct {
+	obj
+	info ObjectInfo
+}
+
+func (o *describedObj) Info() ObjectInfo {
+	i := o.info
+	i.Key, i.Size, i.Mtime, i.IsDir = o.key, o.size, o.mtime, o.isDir
+	return i
+}
+
 type MultipartUpload struct {
 	MinPartSize int
 	MaxCount    int
@@ -0,0 +1,253 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// objectFS is an io/fs.FS of the objects with a prefix.
+type objectFS struct {
+	o      ObjectStorage
+	prefix string
+}
+
+// AsFS returns a read-only io/fs.FS of the objects with the prefix, e.g. for
+// the tools walking a fs.FS. The keys are split by `/` into the directories,
+// which exist as long as there are objects inside them; an object with the
+// same name of a directory (e.g. `a` of `a/b`) is shadowed by it, and the
+// keys ending with `/` are the directories themselves.
+func AsFS(o ObjectStorage, prefix string) fs.FS {
+	return &objectFS{o, prefix}
+}
+
+// fileInfo is the fs.FileInfo of an object or a directory.
+type fileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.mtime }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() interface{}   { return nil }
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i *fileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *fileInfo) Info() (fs.FileInfo, error) { return i, nil }
+func (i *fileInfo) String() string             { return fs.FormatDirEntry(i) }
+
+// dirKey is the prefix of the keys inside the directory name.
+func (f *objectFS) dirKey(name string) string {
+	if name == "." {
+		return f.prefix
+	}
+	return f.prefix + name + "/"
+}
+
+// list returns the entries of the directory name in the order of names.
+func (f *objectFS) list(name string) ([]fs.DirEntry, error) {
+	dir := f.dirKey(name)
+	ch, err := ListAll(f.o, dir, "")
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*fileInfo)
+	for o := range ch {
+		if o == nil {
+			return nil, errors.New("list failed")
+		}
+		rel := o.Key()[len(dir):]
+		if rel == "" {
+			continue
+		}
+		if i := strings.IndexByte(rel, '/'); i >= 0 {
+			byName[rel[:i]] = &fileInfo{name: rel[:i], dir: true}
+		} else if _, ok := byName[rel]; !ok {
+			byName[rel] = &fileInfo{name: rel, size: o.Size(), mtime: o.Mtime()}
+		}
+	}
+	entries := make([]fs.DirEntry, 0, len(byName))
+	for _, e := range byName {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// isDir tells whether there is any object inside the directory name.
+func (f *objectFS) isDir(name string) (bool, error) {
+	objs, err := f.o.List(f.dirKey(name), "", 1)
+	if errors.Is(err, notSupported) {
+		var ch <-chan Object
+		if ch, err = ListAll(f.o, f.dirKey(name), ""); err == nil {
+			o, ok := <-ch
+			go func() {
+				for range ch {
+				}
+			}()
+			return ok && o != nil, nil
+		}
+	}
+	return len(objs) > 0, err
+}
+
+func (f *objectFS) stat(op, name string) (*fileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &fileInfo{name: ".", dir: true}, nil
+	}
+	dir, err := f.isDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if dir {
+		return &fileInfo{name: path.Base(name), dir: true}, nil
+	}
+	o, err := f.o.Head(f.prefix + name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return &fileInfo{name: path.Base(name), size: o.Size(), mtime: o.Mtime()}, nil
+}
+
+func (f *objectFS) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.dir {
+		return &dirFile{fs: f, name: name, info: info}, nil
+	}
+	return &objectFile{fs: f, name: name, info: info}, nil
+}
+
+func (f *objectFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := f.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (f *objectFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := f.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := f.list(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// objectFile reads an object from the beginning, which is opened by the
+// first Read.
+type objectFile struct {
+	fs   *objectFS
+	name string
+	info *fileInfo
+	in   io.ReadCloser
+}
+
+func (f *objectFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	if f.in == nil {
+		in, err := f.fs.o.Get(f.fs.prefix+f.name, 0, -1)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		f.in = in
+	}
+	return f.in.Read(p)
+}
+
+func (f *objectFile) Close() error {
+	if f.in != nil {
+		return f.in.Close()
+	}
+	return nil
+}
+
+// dirFile is an opened directory, which is listed by the first ReadDir.
+type dirFile struct {
+	fs      *objectFS
+	name    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *dirFile) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) Close() error { return nil }
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.fs.list(d.name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		d.entries, d.listed = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+var _ fs.ReadDirFS = &objectFS{}
+var _ fs.StatFS = &objectFS{}
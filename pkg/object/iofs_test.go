@@ -0,0 +1,63 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAsFS(t *testing.T) {
+	m, _ := newMem("mem", "", "", "")
+	for _, key := range []string{"other", "p/a.txt", "p/dir/b.txt", "p/dir/sub/c", "p/dir.txt", "p/empty/", "p/x", "p/x/y"} {
+		if err := m.Put(key, bytes.NewReader([]byte("content of "+key))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	fsys := AsFS(m, "p/")
+	if err := fstest.TestFS(fsys, "a.txt", "dir/b.txt", "dir/sub/c", "dir.txt", "x/y"); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := fs.ReadFile(fsys, "dir/b.txt"); err != nil || string(data) != "content of p/dir/b.txt" {
+		t.Fatalf("read dir/b.txt: %q %v", data, err)
+	}
+	var names []string
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatalf("readdir: %s", err)
+	}
+	for _, e := range entries {
+		names = append(names, e.Name())
+		if e.IsDir() != (e.Name() != "a.txt" && e.Name() != "dir.txt") {
+			t.Fatalf("%s is dir: %v", e.Name(), e.IsDir())
+		}
+	}
+	if expect := "a.txt dir dir.txt empty x"; strings.Join(names, " ") != expect {
+		t.Fatalf("entries %s, expect %s", strings.Join(names, " "), expect)
+	}
+	if _, err := fs.Stat(fsys, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat missing: %v", err)
+	}
+	if _, err := fsys.Open("../other"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("open outside: %v", err)
+	}
+}
@@ -74,7 +74,11 @@ func newJSS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, err
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &jss{s3client{bucket, s3.New(ses), ses}}, nil
+	c, err := newS3Client(bucket, ses, uri.Query())
+	if err != nil {
+		return nil, err
+	}
+	return &jss{c}, nil
 }
 
 func init() {
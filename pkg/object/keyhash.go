@@ -0,0 +1,269 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type withKeyHashing struct {
+	ObjectStorage
+	n uint32
+}
+
+// WithKeyHashing returns an object storage storing key as `.k<hash of key>/key`
+// in one of n buckets, so the sequential keys are spread across the top
+// directories instead of contending on a hot one. The `k` keeps them apart
+// from the buckets of the Aliyun fanout, which are flattened in listing. The keys are recovered by
+// merging the buckets in listing, so the objects written without it (or with
+// another n) can not be read through it.
+func WithKeyHashing(o ObjectStorage, n int) ObjectStorage {
+	if n <= 1 {
+		return o
+	}
+	return &withKeyHashing{o, uint32(n)}
+}
+
+func (k *withKeyHashing) String() string {
+	return fmt.Sprintf("%s(key buckets %d)", k.ObjectStorage, k.n)
+}
+
+func (k *withKeyHashing) bucket(i uint32) string {
+	return fmt.Sprintf(".k%x/", i)
+}
+
+func (k *withKeyHashing) hashed(key string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return k.bucket(h.Sum32()%k.n) + key
+}
+
+// unhash returns the key of a stored one, or false if it's not in a bucket.
+func (k *withKeyHashing) unhash(stored string) (string, bool) {
+	i := strings.Index(stored, "/")
+	if i < 3 || !strings.HasPrefix(stored, ".k") {
+		return "", false
+	}
+	b, err := strconv.ParseUint(stored[2:i], 16, 32)
+	if err != nil || uint32(b) >= k.n || k.bucket(uint32(b)) != stored[:i+1] {
+		return "", false
+	}
+	return stored[i+1:], true
+}
+
+func setKey(o Object, key string) {
+	switch p := o.(type) {
+	case *obj:
+		p.key = key
+	case *file:
+		p.key = key
+	case *hashedObj:
+		p.key = key
+	case *describedObj:
+		p.key = key
+	}
+}
+
+// unhashObject recovers the key of o, and tells whether o is an object
+// written through it, which excludes the buckets themselves.
+func (k *withKeyHashing) unhashObject(o Object) bool {
+	key, ok := k.unhash(o.Key())
+	if !ok || key == "" {
+		return false
+	}
+	setKey(o, key)
+	return true
+}
+
+func (k *withKeyHashing) Head(key string) (Object, error) {
+	o, err := k.ObjectStorage.Head(k.hashed(key))
+	if err != nil {
+		return nil, err
+	}
+	setKey(o, key)
+	return o, nil
+}
+
+func (k *withKeyHashing) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return k.ObjectStorage.Get(k.hashed(key), off, limit)
+}
+
+func (k *withKeyHashing) Put(key string, in io.Reader) error {
+	return k.ObjectStorage.Put(k.hashed(key), in)
+}
+
+func (k *withKeyHashing) Delete(key string) error {
+	return k.ObjectStorage.Delete(k.hashed(key))
+}
+
+func (k *withKeyHashing) marker(i uint32, marker string) string {
+	if marker == "" {
+		return ""
+	}
+	return k.bucket(i) + marker
+}
+
+// List lists every bucket and merges them. A bucket returning a full page may
+// have more keys than those in the page, so the result is cut at the smallest
+// last key of the full pages for the next call to continue from.
+func (k *withKeyHashing) List(prefix, marker string, limit int64) ([]Object, error) {
+	var all []Object
+	var cut string
+	var truncated bool
+	for i := uint32(0); i < k.n; i++ {
+		objs, err := k.ObjectStorage.List(k.bucket(i)+prefix, k.marker(i, marker), limit)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(objs)) >= limit && len(objs) > 0 {
+			last, _ := k.unhash(objs[len(objs)-1].Key())
+			if !truncated || last < cut {
+				cut, truncated = last, true
+			}
+		}
+		for _, o := range objs {
+			if k.unhashObject(o) {
+				all = append(all, o)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Key() < all[j].Key() })
+	if truncated {
+		n := 0
+		for n < len(all) && all[n].Key() <= cut {
+			n++
+		}
+		all = all[:n]
+	}
+	if int64(len(all)) > limit {
+		all = all[:limit]
+	}
+	return all, nil
+}
+
+// ListAll merges the sorted listings of the buckets.
+func (k *withKeyHashing) ListAll(prefix, marker string) (<-chan Object, error) {
+	chs := make([]<-chan Object, k.n)
+	for i := range chs {
+		ch, err := ListAll(k.ObjectStorage, k.bucket(uint32(i))+prefix, k.marker(uint32(i), marker))
+		if err != nil {
+			return nil, err
+		}
+		chs[i] = ch
+	}
+	out := make(chan Object, maxResults)
+	go func() {
+		defer close(out)
+		heads := make([]Object, len(chs))
+		next := func(i int) bool {
+			for o := range chs[i] {
+				if o == nil {
+					return false
+				}
+				if k.unhashObject(o) {
+					heads[i] = o
+					return true
+				}
+			}
+			heads[i] = nil
+			return true
+		}
+		for i := range chs {
+			if !next(i) {
+				out <- nil
+				return
+			}
+		}
+		for {
+			min := -1
+			for i, o := range heads {
+				if o != nil && (min < 0 || o.Key() < heads[min].Key()) {
+					min = i
+				}
+			}
+			if min < 0 {
+				return
+			}
+			out <- heads[min]
+			if !next(min) {
+				out <- nil
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (k *withKeyHashing) PutIfAbsent(key string, in io.Reader) error {
+	if p, ok := k.ObjectStorage.(interface {
+		PutIfAbsent(key string, in io.Reader) error
+	}); ok {
+		return p.PutIfAbsent(k.hashed(key), in)
+	}
+	return notSupported
+}
+
+func (k *withKeyHashing) GetInto(key string, offset int64, buf []byte) (int, error) {
+	return GetInto(k.ObjectStorage, k.hashed(key), offset, buf)
+}
+
+func (k *withKeyHashing) GetIfMatch(key string, off, limit int64, version string) (io.ReadCloser, string, error) {
+	return GetIfMatch(k.ObjectStorage, k.hashed(key), off, limit, version)
+}
+
+func (k *withKeyHashing) Swap(a, b string) error {
+	return Swap(k.ObjectStorage, k.hashed(a), k.hashed(b))
+}
+
+func (k *withKeyHashing) Rename(src, dst string) error {
+	return Rename(k.ObjectStorage, k.hashed(src), k.hashed(dst))
+}
+
+func (k *withKeyHashing) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return k.ObjectStorage.CreateMultipartUpload(k.hashed(key))
+}
+
+func (k *withKeyHashing) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	return k.ObjectStorage.UploadPart(k.hashed(key), uploadID, num, body)
+}
+
+func (k *withKeyHashing) AbortUpload(key string, uploadID string) {
+	k.ObjectStorage.AbortUpload(k.hashed(key), uploadID)
+}
+
+func (k *withKeyHashing) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	return k.ObjectStorage.CompleteUpload(k.hashed(key), uploadID, parts)
+}
+
+func (k *withKeyHashing) ListUploads(marker string) ([]*PendingPart, string, error) {
+	parts, next, err := k.ObjectStorage.ListUploads(marker)
+	var ours []*PendingPart
+	for _, p := range parts {
+		if key, ok := k.unhash(p.Key); ok {
+			p.Key = key
+			ours = append(ours, p)
+		}
+	}
+	return ours, next, err
+}
+
+var _ ObjectStorage = &withKeyHashing{}
@@ -0,0 +1,136 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyHashing(t *testing.T) {
+	if _, opts, err := parseAliyunEndpoint("/jfs?key-buckets=16"); err != nil || opts.keyBuckets != 16 {
+		t.Fatalf("parse key-buckets: %d %v", opts.keyBuckets, err)
+	}
+	if _, _, err := parseAliyunEndpoint("/jfs?key-buckets=-1"); err == nil {
+		t.Fatalf("negative key-buckets should be invalid")
+	}
+	mem, _ := newMem("mem", "", "", "")
+	for _, o := range []ObjectStorage{mem, newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)} {
+		s := WithKeyHashing(o, 8)
+		var keys []string
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("chunks/%d/%d_0_4", i%3, i)
+			if err := s.Put(key, bytes.NewReader([]byte(key))); err != nil {
+				t.Fatalf("put %s: %s", key, err)
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		ch, err := ListAll(o, "", "")
+		if err != nil {
+			t.Fatalf("list the buckets: %s", err)
+		}
+		buckets := make(map[string]bool)
+		for _, k := range collect(t, ch) {
+			if !strings.HasPrefix(k, ".") {
+				t.Fatalf("%s is not in a bucket", k)
+			}
+			buckets[k[:strings.Index(k, "/")]] = true
+		}
+		if len(buckets) < 2 {
+			t.Fatalf("the keys should be spread, but in %d buckets", len(buckets))
+		}
+
+		if ch, err = s.ListAll("", ""); err != nil {
+			t.Fatalf("list all: %s", err)
+		}
+		if got := collect(t, ch); !reflect.DeepEqual(got, keys) {
+			t.Fatalf("expect %v, but got %v", keys, got)
+		}
+		if ch, err = s.ListAll("chunks/1/", "chunks/1/25_0_4"); err != nil {
+			t.Fatalf("list all: %s", err)
+		}
+		for _, k := range collect(t, ch) {
+			if !strings.HasPrefix(k, "chunks/1/") || k <= "chunks/1/25_0_4" {
+				t.Fatalf("%s should not be listed", k)
+			}
+		}
+
+		// pages smaller than the buckets
+		var got []string
+		var marker string
+		for {
+			objs, err := s.List("", marker, 7)
+			if err != nil {
+				t.Fatalf("list: %s", err)
+			}
+			if len(objs) == 0 {
+				break
+			}
+			for _, o := range objs {
+				got = append(got, o.Key())
+			}
+			marker = objs[len(objs)-1].Key()
+		}
+		if !reflect.DeepEqual(got, keys) {
+			t.Fatalf("expect %v, but got %v", keys, got)
+		}
+
+		if h, err := s.Head(keys[0]); err != nil || h.Key() != keys[0] {
+			t.Fatalf("head %s: %v %v", keys[0], h, err)
+		}
+		if d, err := get(s, keys[0], 0, -1); err != nil || d != keys[0] {
+			t.Fatalf("get %s: %q %v", keys[0], d, err)
+		}
+		if err := s.Delete(keys[0]); err != nil {
+			t.Fatalf("delete: %s", err)
+		}
+		if _, err := s.Head(keys[0]); err == nil {
+			t.Fatalf("%s should be deleted", keys[0])
+		}
+	}
+}
+
+// BenchmarkKeyHashing puts objects of one directory in parallel, which are
+// moved into a single hot folder without the hashing.
+func BenchmarkKeyHashing(b *testing.B) {
+	for _, n := range []int{0, 16} {
+		b.Run(fmt.Sprintf("buckets-%d", n), func(b *testing.B) {
+			d := newFakeDrive()
+			d.folderDelay = time.Millisecond
+			s := WithKeyHashing(newTestAliyun(b, d, defaultAliyunOptions), n)
+			var seq int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := fmt.Sprintf("chunks/0/%d_0_4", atomic.AddInt64(&seq, 1))
+					if err := s.Put(key, bytes.NewReader([]byte("data"))); err != nil {
+						b.Fatalf("put %s: %s", key, err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import "sync"
+
+// KeyLocker serializes the writes to the same key. The local one only works
+// within a process, an implementation backed by a distributed lock service
+// is needed when multiple clients write the same keys.
+type KeyLocker interface {
+	// Lock blocks until the lock of key is acquired, or returns an error.
+	// The returned function releases the lock.
+	Lock(key string) (unlock func(), err error)
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+type localKeyLocker struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// NewLocalKeyLocker returns a KeyLocker within the process. The lock of a key
+// is dropped once nobody holds or waits for it, so the memory used is bounded
+// by the number of keys being written.
+func NewLocalKeyLocker() KeyLocker {
+	return &localKeyLocker{locks: make(map[string]*keyLock)}
+}
+
+func (l *localKeyLocker) Lock(key string) (func(), error) {
+	l.mu.Lock()
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Mutex.Lock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			kl.Mutex.Unlock()
+			l.mu.Lock()
+			if kl.refs--; kl.refs == 0 {
+				delete(l.locks, key)
+			}
+			l.mu.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,59 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLocalKeyLocker(t *testing.T) {
+	l := NewLocalKeyLocker()
+	var counts [10]int
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i%len(counts))
+			unlock, err := l.Lock(key)
+			if err != nil {
+				t.Errorf("lock %s: %s", key, err)
+				return
+			}
+			counts[i%len(counts)]++
+			unlock()
+			unlock() // releasing twice is harmless
+		}(i)
+	}
+	wg.Wait()
+	for k, c := range counts {
+		if c != 100 {
+			t.Fatalf("key%d is updated %d times", k, c)
+		}
+	}
+
+	// other keys are not blocked by a held lock
+	unlock, _ := l.Lock("a")
+	u, _ := l.Lock("b")
+	u()
+	unlock()
+	if n := len(l.(*localKeyLocker).locks); n != 0 {
+		t.Fatalf("%d locks are left after released", n)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// KeyRules are the constraints of keys checked by WithKeyValidation.
+type KeyRules struct {
+	// MaxLength is the max length of keys in bytes, 0 means unlimited.
+	MaxLength int
+	// Allowed tells whether a character could be used in keys, nil allows
+	// any character. Keys must be valid UTF-8 when it's set.
+	Allowed func(r rune) bool
+	// NoLeadingSlash rejects the keys starting with `/`.
+	NoLeadingSlash bool
+}
+
+// InvalidKeyError is returned for the keys violating the KeyRules.
+type InvalidKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", e.Key, e.Reason)
+}
+
+// Check returns an InvalidKeyError if the key violates the rules.
+func (r *KeyRules) Check(key string) error {
+	if r.MaxLength > 0 && len(key) > r.MaxLength {
+		return &InvalidKeyError{key, fmt.Sprintf("longer than %d bytes", r.MaxLength)}
+	}
+	if r.NoLeadingSlash && strings.HasPrefix(key, "/") {
+		return &InvalidKeyError{key, "leading slash"}
+	}
+	if r.Allowed != nil {
+		if !utf8.ValidString(key) {
+			return &InvalidKeyError{key, "invalid UTF-8"}
+		}
+		for i, c := range key {
+			if !r.Allowed(c) {
+				return &InvalidKeyError{key, fmt.Sprintf("forbidden character %q at %d", c, i)}
+			}
+		}
+	}
+	return nil
+}
+
+type withKeyValidation struct {
+	ObjectStorage
+	rules KeyRules
+}
+
+// WithKeyValidation returns an object storage that checks the keys against
+// the rules before any operation.
+func WithKeyValidation(o ObjectStorage, rules KeyRules) ObjectStorage {
+	return &withKeyValidation{o, rules}
+}
+
+// checkPrefix checks the prefix or marker of listing, which could be empty.
+func (v *withKeyValidation) checkPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	return v.rules.Check(prefix)
+}
+
+func (v *withKeyValidation) Head(key string) (Object, error) {
+	if err := v.rules.Check(key); err != nil {
+		return nil, err
+	}
+	return v.ObjectStorage.Head(key)
+}
+
+func (v *withKeyValidation) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if err := v.rules.Check(key); err != nil {
+		return nil, err
+	}
+	return v.ObjectStorage.Get(key, off, limit)
+}
+
+func (v *withKeyValidation) Put(key string, in io.Reader) error {
+	if err := v.rules.Check(key); err != nil {
+		return err
+	}
+	return v.ObjectStorage.Put(key, in)
+}
+
+func (v *withKeyValidation) Delete(key string) error {
+	if err := v.rules.Check(key); err != nil {
+		return err
+	}
+	return v.ObjectStorage.Delete(key)
+}
+
+func (v *withKeyValidation) List(prefix, marker string, limit int64) ([]Object, error) {
+	if err := v.checkPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if err := v.checkPrefix(marker); err != nil {
+		return nil, err
+	}
+	return v.ObjectStorage.List(prefix, marker, limit)
+}
+
+func (v *withKeyValidation) ListAll(prefix, marker string) (<-chan Object, error) {
+	if err := v.checkPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if err := v.checkPrefix(marker); err != nil {
+		return nil, err
+	}
+	return v.ObjectStorage.ListAll(prefix, marker)
+}
+
+func (v *withKeyValidation) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	if err := v.rules.Check(key); err != nil {
+		return nil, err
+	}
+	return v.ObjectStorage.CreateMultipartUpload(key)
+}
+
+func (v *withKeyValidation) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	if err := v.rules.Check(key); err != nil {
+		return nil, err
+	}
+	return v.ObjectStorage.UploadPart(key, uploadID, num, body)
+}
+
+func (v *withKeyValidation) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if err := v.rules.Check(key); err != nil {
+		return err
+	}
+	return v.ObjectStorage.CompleteUpload(key, uploadID, parts)
+}
+
+var _ ObjectStorage = &withKeyValidation{}
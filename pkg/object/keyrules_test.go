@@ -0,0 +1,88 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeyRules(t *testing.T) {
+	ascii := func(r rune) bool { return r > 0x1f && r < 0x7f && r != '\\' }
+	cases := []struct {
+		rules KeyRules
+		good  []string
+		bad   []string
+	}{
+		{KeyRules{MaxLength: 8}, []string{"", "a", "12345678", "测试"}, []string{"123456789", "测试测试"}},
+		{KeyRules{NoLeadingSlash: true}, []string{"a/b", "a/", "a//b"}, []string{"/", "/a"}},
+		{KeyRules{Allowed: ascii}, []string{"chunks/0/1_0_4", "a b+c"}, []string{"a\\b", "a\nb", "测试", "\xff"}},
+		{KeyRules{}, []string{"/a", "\xff", strings.Repeat("a", 4096)}, nil},
+	}
+	for _, c := range cases {
+		for _, k := range c.good {
+			if err := c.rules.Check(k); err != nil {
+				t.Fatalf("%q should be valid: %s", k, err)
+			}
+		}
+		for _, k := range c.bad {
+			var e *InvalidKeyError
+			if err := c.rules.Check(k); !errors.As(err, &e) || e.Key != k {
+				t.Fatalf("%q should be invalid, but got %v", k, err)
+			}
+		}
+	}
+}
+
+func TestWithKeyValidation(t *testing.T) {
+	m, _ := newMem("keys", "", "", "")
+	s := WithKeyValidation(m, KeyRules{MaxLength: 10, NoLeadingSlash: true})
+	var e *InvalidKeyError
+	if err := s.Put("/a", bytes.NewReader([]byte("a"))); !errors.As(err, &e) {
+		t.Fatalf("put with a leading slash: %v", err)
+	}
+	if _, err := m.Head("/a"); err == nil {
+		t.Fatalf("invalid key should not be written")
+	}
+	if err := s.Put("a", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatalf("put a: %s", err)
+	}
+	if d, err := get(s, "a", 0, -1); err != nil || d != "a" {
+		t.Fatalf("get a: %q %v", d, err)
+	}
+	if _, err := s.Get("very-long-key", 0, -1); !errors.As(err, &e) {
+		t.Fatalf("get a long key: %v", err)
+	}
+	if _, err := s.Head("/a"); !errors.As(err, &e) {
+		t.Fatalf("head with a leading slash: %v", err)
+	}
+	if err := s.Delete("/a"); !errors.As(err, &e) {
+		t.Fatalf("delete with a leading slash: %v", err)
+	}
+	if _, err := s.List("/", "", 10); !errors.As(err, &e) {
+		t.Fatalf("list with a leading slash: %v", err)
+	}
+	if _, err := s.CreateMultipartUpload("very-long-key"); !errors.As(err, &e) {
+		t.Fatalf("multipart upload of a long key: %v", err)
+	}
+	objs, err := s.List("", "", 10)
+	if err != nil || len(objs) != 1 || objs[0].Key() != "a" {
+		t.Fatalf("list: %v %v", objs, err)
+	}
+}
@@ -23,7 +23,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -98,16 +97,13 @@ func (s *ks3) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (s *ks3) Put(key string, in io.Reader) error {
-	var body io.ReadSeeker
-	if b, ok := in.(io.ReadSeeker); ok {
-		body = b
-	} else {
-		data, err := ioutil.ReadAll(in)
-		if err != nil {
-			return err
-		}
-		body = bytes.NewReader(data)
+	// the length is required, the content of unknown length is spooled
+	sp, err := Spool(in, spoolMemory, "")
+	if err != nil {
+		return err
 	}
+	defer sp.Close()
+	body := sp.ReadSeeker
 	mimeType := utils.GuessMimeType(key)
 	params := &s3.PutObjectInput{
 		Bucket:      &s.bucket,
@@ -115,7 +111,7 @@ func (s *ks3) Put(key string, in io.Reader) error {
 		Body:        body,
 		ContentType: &mimeType,
 	}
-	_, err := s.s3.PutObject(params)
+	_, err = s.s3.PutObject(params)
 	return err
 }
 func (s *ks3) Copy(dst, src string) error {
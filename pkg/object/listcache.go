@@ -0,0 +1,186 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum interval of revalidation in multiples of the initial one
+const listCacheMaxFactor = 64
+
+type cachedNode struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name"`
+	IsDir bool      `json:"dir,omitempty"`
+	Size  int64     `json:"size,omitempty"`
+	Mtime time.Time `json:"mtime"`
+	Hash  string    `json:"hash,omitempty"`
+}
+
+// cachedDir is the listing of a directory, which is valid until the
+// directory node changes or the interval passes since it's checked.
+type cachedDir struct {
+	ID       string        `json:"id"`
+	Mtime    time.Time     `json:"mtime"`
+	Checked  time.Time     `json:"checked"`
+	Interval time.Duration `json:"interval"`
+	Nodes    []cachedNode  `json:"nodes"`
+}
+
+// listCache keeps the listings of directories across the scans of a
+// drive-like storage (e.g. by gc), keyed by the path of directories and
+// persisted into a file.
+//
+// A listing is reused without fetching as long as the directory node has the
+// same id and mtime in its parent and it was checked within the interval. The
+// interval starts at ttl and is doubled whenever a fetch finds the listing
+// unchanged, up to 64 times of ttl, so the stable directories are fetched
+// less and less. It's reset to ttl once a change is found. Since the mtime of
+// a folder is not updated by the changes deep inside it, the changes made by
+// others could be missed until the interval passes, the writes through the
+// same storage invalidate the listings of their directories.
+type listCache struct {
+	sync.Mutex
+	path  string
+	ttl   time.Duration
+	clock Clock
+	dirs  map[string]*cachedDir
+	dirty bool
+}
+
+// openListCache loads the listings saved in path, a missing or broken file
+// starts an empty cache.
+func openListCache(path string, ttl time.Duration) *listCache {
+	c := &listCache{path: path, ttl: ttl, clock: SystemClock, dirs: make(map[string]*cachedDir)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warnf("Read listing cache %s: %s", path, err)
+		}
+		return c
+	}
+	if err = json.Unmarshal(data, &c.dirs); err != nil {
+		logger.Warnf("Broken listing cache %s: %s", path, err)
+		c.dirs = make(map[string]*cachedDir)
+	}
+	return c
+}
+
+// get returns the cached children of the directory n at dir, which are sorted
+// as fetched.
+func (c *listCache) get(dir string, n treeNode) ([]treeNode, bool) {
+	c.Lock()
+	defer c.Unlock()
+	d, ok := c.dirs[dir]
+	if !ok || d.ID != n.id || !d.Mtime.Equal(n.mtime) || !c.clock.Now().Before(d.Checked.Add(d.Interval)) {
+		return nil, false
+	}
+	nodes := make([]treeNode, len(d.Nodes))
+	for i, cn := range d.Nodes {
+		nodes[i] = treeNode{cn.ID, cn.Name, cn.IsDir, cn.Size, cn.Mtime, cn.Hash}
+	}
+	return nodes, true
+}
+
+// put stores the children of the directory n at dir just fetched.
+func (c *listCache) put(dir string, n treeNode, nodes []treeNode) {
+	cached := make([]cachedNode, len(nodes))
+	for i, tn := range nodes {
+		cached[i] = cachedNode{tn.id, tn.name, tn.isDir, tn.size, tn.mtime, tn.hash}
+	}
+	c.Lock()
+	defer c.Unlock()
+	interval := c.ttl
+	if old, ok := c.dirs[dir]; ok && old.ID == n.id && old.Mtime.Equal(n.mtime) && sameNodes(old.Nodes, cached) {
+		interval = old.Interval * 2
+		if interval > c.ttl*listCacheMaxFactor {
+			interval = c.ttl * listCacheMaxFactor
+		}
+		if interval < c.ttl {
+			interval = c.ttl
+		}
+	}
+	c.dirs[dir] = &cachedDir{n.id, n.mtime, c.clock.Now(), interval, cached}
+	c.dirty = true
+}
+
+func sameNodes(a, b []cachedNode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Name != b[i].Name || a[i].IsDir != b[i].IsDir ||
+			a[i].Size != b[i].Size || !a[i].Mtime.Equal(b[i].Mtime) || a[i].Hash != b[i].Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidate drops the listings of the directories containing key, from the
+// parent of it up to the root.
+func (c *listCache) invalidate(key string) {
+	c.Lock()
+	defer c.Unlock()
+	for {
+		i := strings.LastIndex(strings.TrimSuffix(key, "/"), "/")
+		key = key[:i+1]
+		if _, ok := c.dirs[key]; ok {
+			delete(c.dirs, key)
+			c.dirty = true
+		}
+		if key == "" {
+			return
+		}
+	}
+}
+
+// reset drops all the listings.
+func (c *listCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.dirs = make(map[string]*cachedDir)
+	c.dirty = true
+}
+
+// save writes the listings into the file if they are changed.
+func (c *listCache) save() error {
+	c.Lock()
+	defer c.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.dirs)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManifestEntry is a line of the manifest exported by ExportManifest.
+type ManifestEntry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Mtime    time.Time `json:"mtime"`
+	Checksum string    `json:"crc32c"`
+}
+
+func objectChecksum(store ObjectStorage, key string) (string, error) {
+	r, err := store.Get(key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := crc32.New(crc32c)
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(int(h.Sum32())), nil
+}
+
+// scanManifest calls fn for every object with the prefix, the checksum of
+// an object is only calculated when needed returns true for it.
+func scanManifest(store ObjectStorage, prefix string, needed func(o Object) bool, fn func(e *ManifestEntry) error) error {
+	ch, err := ListAll(store, prefix, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for range ch {
+		}
+	}()
+	for o := range ch {
+		if o == nil {
+			return errors.New("list failed")
+		}
+		if o.IsDir() {
+			continue
+		}
+		e := &ManifestEntry{Key: o.Key(), Size: o.Size(), Mtime: o.Mtime().UTC()}
+		if needed(o) {
+			if e.Checksum, err = objectChecksum(store, o.Key()); err != nil {
+				return fmt.Errorf("checksum of %s: %w", o.Key(), err)
+			}
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportManifest writes all the objects with the prefix as newline-delimited
+// JSON of ManifestEntry, in the order of keys. Every object is read to
+// calculate its checksum.
+func ExportManifest(store ObjectStorage, prefix string, w io.Writer) error {
+	return ExportManifestAs(store, prefix, w, ManifestJSON)
+}
+
+// ExportManifestAs writes the manifest as ExportManifest in the format. The
+// manifests read by DiffManifest and SnapshotView could be in any format.
+func ExportManifestAs(store ObjectStorage, prefix string, w io.Writer, format ManifestFormat) error {
+	bw := bufio.NewWriter(w)
+	enc, err := newManifestEncoder(bw, format)
+	if err != nil {
+		return err
+	}
+	err = scanManifest(store, prefix, func(Object) bool { return true }, enc.encode)
+	if err != nil {
+		return err
+	}
+	if err = enc.flush(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// loadManifest reads the entries with the prefix of a manifest.
+func loadManifest(r io.Reader, prefix string) (map[string]*ManifestEntry, error) {
+	dec, err := newManifestDecoder(r)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	entries := make(map[string]*ManifestEntry)
+	for {
+		e, err := dec.decode()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("read manifest: %w", err)
+		}
+		if strings.HasPrefix(e.Key, prefix) {
+			entries[e.Key] = e
+		}
+	}
+}
+
+// DiffManifest compares the objects with the prefix against a manifest
+// exported before. An object is changed if its size or checksum differs.
+func DiffManifest(store ObjectStorage, prefix string, old io.Reader) (added, removed, changed []string, err error) {
+	saved, err := loadManifest(old, prefix)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// the checksum is only needed to tell the change of objects in same size
+	needed := func(o Object) bool {
+		e, ok := saved[o.Key()]
+		return ok && e.Size == o.Size()
+	}
+	err = scanManifest(store, prefix, needed, func(e *ManifestEntry) error {
+		s, ok := saved[e.Key]
+		if !ok {
+			added = append(added, e.Key)
+			return nil
+		}
+		delete(saved, e.Key)
+		if s.Size != e.Size || s.Checksum != e.Checksum {
+			changed = append(changed, e.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for k := range saved {
+		removed = append(removed, k)
+	}
+	sort.Strings(removed)
+	return added, removed, changed, nil
+}
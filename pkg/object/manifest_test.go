@@ -0,0 +1,123 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	m, _ := newMem("manifest", "", "", "")
+	put := func(key, data string) {
+		if err := m.Put(key, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	put("a/1", "one")
+	put("a/2", "two")
+	put("a/3", "three")
+	put("b/1", "other")
+
+	var buf bytes.Buffer
+	if err := ExportManifest(m, "a/", &buf); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 entries, but got %q", lines)
+	}
+	var e ManifestEntry
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil || e.Key != "a/2" || e.Size != 3 || e.Checksum == "" {
+		t.Fatalf("unexpected entry %+v: %v", e, err)
+	}
+	manifest := buf.Bytes()
+
+	added, removed, changed, err := DiffManifest(m, "a/", bytes.NewReader(manifest))
+	if err != nil || len(added)+len(removed)+len(changed) != 0 {
+		t.Fatalf("expect no difference, but got %v %v %v: %v", added, removed, changed, err)
+	}
+
+	put("a/0", "zero")
+	_ = m.Delete("a/2")
+	put("a/1", "ONE")    // same size
+	put("a/3", "three!") // different size
+	put("b/2", "not in the prefix")
+	added, removed, changed, err = DiffManifest(m, "a/", bytes.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	if strings.Join(added, ",") != "a/0" || strings.Join(removed, ",") != "a/2" || strings.Join(changed, ",") != "a/1,a/3" {
+		t.Fatalf("unexpected difference: added %v, removed %v, changed %v", added, removed, changed)
+	}
+
+	if _, _, _, err = DiffManifest(m, "a/", strings.NewReader("not json")); err == nil {
+		t.Fatalf("diff with a broken manifest should fail")
+	}
+}
+
+func TestManifestFormats(t *testing.T) {
+	m, _ := newMem("manifest", "", "", "")
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("chunks/%d/%d/%d_0_4194304", i/1000, i/100, i)
+		if err := m.Put(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	_ = m.Put("a,\"quoted\"\nkey", bytes.NewReader(nil))
+
+	sizes := make(map[ManifestFormat]int)
+	var expected map[string]*ManifestEntry
+	for _, f := range []ManifestFormat{ManifestJSON, ManifestCSV, ManifestBinary} {
+		var buf bytes.Buffer
+		if err := ExportManifestAs(m, "", &buf, f); err != nil {
+			t.Fatalf("export %s: %s", f, err)
+		}
+		sizes[f] = buf.Len()
+		entries, err := loadManifest(bytes.NewReader(buf.Bytes()), "")
+		if err != nil || len(entries) != 2001 {
+			t.Fatalf("load %s: %d entries, %v", f, len(entries), err)
+		}
+		if expected == nil {
+			expected = entries
+		}
+		for k, e := range expected {
+			if g := entries[k]; g == nil || g.Size != e.Size || !g.Mtime.Equal(e.Mtime) || g.Checksum != e.Checksum || e.Checksum == "" {
+				t.Fatalf("entry of %q in %s: %+v, but expect %+v", k, f, g, e)
+			}
+		}
+		added, removed, changed, err := DiffManifest(m, "chunks/", bytes.NewReader(buf.Bytes()))
+		if err != nil || len(added)+len(removed)+len(changed) != 0 {
+			t.Fatalf("diff with %s: %v %v %v %v", f, added, removed, changed, err)
+		}
+		if f == ManifestBinary {
+			if _, err = loadManifest(bytes.NewReader(buf.Bytes()[:buf.Len()-3]), ""); err == nil {
+				t.Fatalf("load a truncated %s manifest should fail", f)
+			}
+		}
+	}
+	if sizes[ManifestBinary]*3 > sizes[ManifestJSON] || sizes[ManifestBinary] >= sizes[ManifestCSV] {
+		t.Fatalf("binary manifest should be much smaller: %v", sizes)
+	}
+	if err := ExportManifestAs(m, "", io.Discard, "xml"); err == nil {
+		t.Fatalf("export in an unknown format should fail")
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ManifestFormat is the encoding of a manifest, see ExportManifestAs.
+type ManifestFormat string
+
+const (
+	// ManifestJSON has a ManifestEntry in JSON per line:
+	//
+	//	{"key":"a/1","size":3,"mtime":"2022-06-01T00:00:00Z","crc32c":"123"}
+	//
+	// The mtime is in RFC 3339, and the CRC32C checksum in decimal.
+	ManifestJSON ManifestFormat = "ndjson"
+	// ManifestCSV is CSV (RFC 4180) starting with the header line
+	// `key,size,mtime,crc32c`, the fields are in the same format as
+	// ManifestJSON.
+	ManifestCSV ManifestFormat = "csv"
+	// ManifestBinary is the compact encoding for large manifests, starting
+	// with the magic "JFSMANI1". Every entry then has, in order:
+	//
+	//	uvarint  the length of the prefix shared with the previous key
+	//	uvarint  the length of the rest of the key
+	//	bytes    the rest of the key
+	//	uvarint  size
+	//	varint   mtime in nanoseconds since the mtime of the previous entry
+	//	         (the first one since the Unix epoch)
+	//	uvarint  CRC32C + 1, or 0 if there is no checksum
+	ManifestBinary ManifestFormat = "binary"
+)
+
+const manifestMagic = "JFSMANI1"
+
+var csvManifestHeader = []string{"key", "size", "mtime", "crc32c"}
+
+type manifestEncoder interface {
+	encode(e *ManifestEntry) error
+	flush() error
+}
+
+type manifestDecoder interface {
+	// decode returns the next entry, or io.EOF at the end.
+	decode() (*ManifestEntry, error)
+}
+
+func newManifestEncoder(w *bufio.Writer, format ManifestFormat) (manifestEncoder, error) {
+	switch format {
+	case ManifestJSON, "":
+		return &jsonManifest{enc: json.NewEncoder(w)}, nil
+	case ManifestCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvManifestHeader); err != nil {
+			return nil, err
+		}
+		return &csvManifest{w: cw}, nil
+	case ManifestBinary:
+		if _, err := w.WriteString(manifestMagic); err != nil {
+			return nil, err
+		}
+		return &binaryManifest{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown manifest format %q", format)
+}
+
+// newManifestDecoder detects the format of the manifest in r.
+func newManifestDecoder(r io.Reader) (manifestDecoder, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(manifestMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case string(head) == manifestMagic:
+		_, _ = br.Discard(len(manifestMagic))
+		return &binaryManifest{r: br}, nil
+	case bytes.HasPrefix(head, []byte("key,")):
+		cr := csv.NewReader(br)
+		cr.FieldsPerRecord = len(csvManifestHeader)
+		if _, err = cr.Read(); err != nil {
+			return nil, err
+		}
+		return &csvManifest{r: cr}, nil
+	}
+	return &jsonManifest{dec: json.NewDecoder(br)}, nil
+}
+
+type jsonManifest struct {
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+func (m *jsonManifest) encode(e *ManifestEntry) error { return m.enc.Encode(e) }
+func (m *jsonManifest) flush() error                  { return nil }
+
+func (m *jsonManifest) decode() (*ManifestEntry, error) {
+	var e ManifestEntry
+	if err := m.dec.Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+type csvManifest struct {
+	w *csv.Writer
+	r *csv.Reader
+}
+
+func (m *csvManifest) encode(e *ManifestEntry) error {
+	return m.w.Write([]string{e.Key, strconv.FormatInt(e.Size, 10), e.Mtime.Format(time.RFC3339Nano), e.Checksum})
+}
+
+func (m *csvManifest) flush() error {
+	m.w.Flush()
+	return m.w.Error()
+}
+
+func (m *csvManifest) decode() (*ManifestEntry, error) {
+	rec, err := m.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	e := &ManifestEntry{Key: rec[0], Checksum: rec[3]}
+	if e.Size, err = strconv.ParseInt(rec[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid size of %s: %q", e.Key, rec[1])
+	}
+	if e.Mtime, err = time.Parse(time.RFC3339Nano, rec[2]); err != nil {
+		return nil, fmt.Errorf("invalid mtime of %s: %q", e.Key, rec[2])
+	}
+	return e, nil
+}
+
+type binaryManifest struct {
+	w       *bufio.Writer
+	r       *bufio.Reader
+	buf     [binary.MaxVarintLen64]byte
+	lastKey string
+	// UnixNano of the previous mtime
+	last int64
+}
+
+func (m *binaryManifest) uvarint(v uint64) {
+	n := binary.PutUvarint(m.buf[:], v)
+	_, _ = m.w.Write(m.buf[:n])
+}
+
+func (m *binaryManifest) encode(e *ManifestEntry) error {
+	var sum uint64
+	if e.Checksum != "" {
+		crc, err := strconv.ParseUint(e.Checksum, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid checksum of %s: %q", e.Key, e.Checksum)
+		}
+		sum = crc + 1
+	}
+	shared := 0
+	for shared < len(e.Key) && shared < len(m.lastKey) && e.Key[shared] == m.lastKey[shared] {
+		shared++
+	}
+	m.uvarint(uint64(shared))
+	m.uvarint(uint64(len(e.Key) - shared))
+	_, _ = m.w.WriteString(e.Key[shared:])
+	m.uvarint(uint64(e.Size))
+	mtime := e.Mtime.UnixNano()
+	n := binary.PutVarint(m.buf[:], mtime-m.last)
+	_, _ = m.w.Write(m.buf[:n])
+	m.uvarint(sum)
+	m.lastKey, m.last = e.Key, mtime
+	// the errors are kept by the writer until Flush
+	return nil
+}
+
+func (m *binaryManifest) flush() error { return nil }
+
+func (m *binaryManifest) decode() (*ManifestEntry, error) {
+	shared, err := binary.ReadUvarint(m.r)
+	if err != nil {
+		// io.EOF only at the start of an entry
+		return nil, err
+	}
+	e, err := m.decodeRest(shared)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return e, err
+}
+
+// the longest key accepted, to refuse a broken manifest early
+const maxManifestKey = 64 << 10
+
+func (m *binaryManifest) decodeRest(shared uint64) (*ManifestEntry, error) {
+	n, err := binary.ReadUvarint(m.r)
+	if err != nil {
+		return nil, err
+	}
+	if shared > uint64(len(m.lastKey)) || n > maxManifestKey {
+		return nil, fmt.Errorf("invalid key length %d+%d", shared, n)
+	}
+	rest := make([]byte, n)
+	if _, err = io.ReadFull(m.r, rest); err != nil {
+		return nil, err
+	}
+	e := &ManifestEntry{Key: m.lastKey[:shared] + string(rest)}
+	size, err := binary.ReadUvarint(m.r)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := binary.ReadVarint(m.r)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := binary.ReadUvarint(m.r)
+	if err != nil {
+		return nil, err
+	}
+	m.lastKey, m.last = e.Key, m.last+delta
+	e.Size, e.Mtime = int64(size), time.Unix(0, m.last).UTC()
+	if sum > 0 {
+		e.Checksum = strconv.FormatUint(sum-1, 10)
+	}
+	return e, nil
+}
@@ -83,7 +83,7 @@ func (m *memStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	}
 	d, ok := m.objects[key]
 	if !ok {
-		return nil, errors.New("not exists")
+		return nil, os.ErrNotExist
 	}
 	if off > int64(len(d.data)) {
 		off = int64(len(d.data))
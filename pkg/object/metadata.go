@@ -0,0 +1,275 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// MetadataSetter is implemented by the storages keeping the metadata of
+// objects, which is reported by Head (see ObjectInfo).
+type MetadataSetter interface {
+	// PutWithMetadata writes the object with the ContentType, StorageClass,
+	// Metadata and Tags of info, the others are ignored.
+	PutWithMetadata(key string, in io.Reader, info ObjectInfo) error
+	// SetTags replaces the tags of an object.
+	SetTags(key string, tags map[string]string) error
+	// SetStorageClass changes the storage class of an object.
+	SetStorageClass(key, class string) error
+}
+
+// PutWithMetadata writes the object with the metadata in info, it's not
+// supported by the storages without MetadataSetter, wrap them by
+// WithMetadataSidecar to keep the metadata.
+func PutWithMetadata(s ObjectStorage, key string, in io.Reader, info ObjectInfo) error {
+	if m, ok := s.(MetadataSetter); ok {
+		return m.PutWithMetadata(key, in, info)
+	}
+	return notSupported
+}
+
+// SetTags replaces the tags of an object, see PutWithMetadata.
+func SetTags(s ObjectStorage, key string, tags map[string]string) error {
+	if m, ok := s.(MetadataSetter); ok {
+		return m.SetTags(key, tags)
+	}
+	return notSupported
+}
+
+// SetStorageClass changes the storage class of an object, see
+// PutWithMetadata.
+func SetStorageClass(s ObjectStorage, key, class string) error {
+	if m, ok := s.(MetadataSetter); ok {
+		return m.SetStorageClass(key, class)
+	}
+	return notSupported
+}
+
+// metaSidecarPrefix is the prefix of the sidecars, which are not listed.
+const metaSidecarPrefix = ".jfsmeta/"
+
+// objectMeta is the metadata kept in a sidecar.
+type objectMeta struct {
+	ContentType  string            `json:"content_type,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// metaSidecar keeps the metadata of an object in a sidecar object.
+type metaSidecar struct {
+	ObjectStorage
+}
+
+// WithMetadataSidecar returns a MetadataSetter of o, which keeps the metadata
+// of an object in a small sidecar object under .jfsmeta/ for the storages
+// unable to keep them natively (e.g. a drive), and reports it in Head. The
+// storages with MetadataSetter are used as is.
+//
+// It costs one more request for every Put, Delete, Head, SetTags and
+// SetStorageClass, to write, remove or read the sidecar. The listing doesn't
+// carry the metadata. A storage class is kept as metadata, the class of the
+// object in the storage is not changed. The sidecars are only kept consistent
+// with the changes through the wrapper, an object overwritten by others
+// could have the metadata of the previous one.
+func WithMetadataSidecar(o ObjectStorage) ObjectStorage {
+	if _, ok := o.(MetadataSetter); ok {
+		return o
+	}
+	return &metaSidecar{o}
+}
+
+func (s *metaSidecar) String() string {
+	return fmt.Sprintf("%s(metadata sidecar)", s.ObjectStorage)
+}
+
+func (s *metaSidecar) check(key string) error {
+	if strings.HasPrefix(key, metaSidecarPrefix) {
+		return fmt.Errorf("key %s: the prefix %s is reserved for the metadata sidecars", key, metaSidecarPrefix)
+	}
+	return nil
+}
+
+// load reads the sidecar of key, nil if it has none.
+func (s *metaSidecar) load(key string) (*objectMeta, error) {
+	r, err := s.ObjectStorage.Get(metaSidecarPrefix+key, 0, -1)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var m objectMeta
+	if err = json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode the metadata of %s: %w", key, err)
+	}
+	return &m, nil
+}
+
+func (s *metaSidecar) save(key string, m *objectMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = s.ObjectStorage.Put(metaSidecarPrefix+key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("save the metadata of %s: %w", key, err)
+	}
+	return nil
+}
+
+// drop removes the sidecar of key, which is not there for most objects.
+func (s *metaSidecar) drop(key string) error {
+	if err := s.ObjectStorage.Delete(metaSidecarPrefix + key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete the metadata of %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *metaSidecar) Head(key string) (Object, error) {
+	o, err := s.ObjectStorage.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.load(key)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return o, nil
+	}
+	info := InfoOf(o)
+	info.ContentType, info.StorageClass, info.Metadata, info.Tags = m.ContentType, m.StorageClass, m.Metadata, m.Tags
+	return &describedObj{obj{o.Key(), o.Size(), o.Mtime(), o.IsDir()}, info}, nil
+}
+
+// Put writes an object without metadata, the sidecar of the previous one is
+// removed.
+func (s *metaSidecar) Put(key string, in io.Reader) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	if err := s.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	return s.drop(key)
+}
+
+func (s *metaSidecar) PutWithMetadata(key string, in io.Reader, info ObjectInfo) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	if err := s.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	m := &objectMeta{info.ContentType, info.StorageClass, info.Metadata, info.Tags}
+	if m.ContentType == "" && m.StorageClass == "" && len(m.Metadata) == 0 && len(m.Tags) == 0 {
+		return s.drop(key)
+	}
+	return s.save(key, m)
+}
+
+func (s *metaSidecar) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if err := s.ObjectStorage.CompleteUpload(key, uploadID, parts); err != nil {
+		return err
+	}
+	return s.drop(key)
+}
+
+// update changes the metadata of an existing object.
+func (s *metaSidecar) update(key string, change func(m *objectMeta)) error {
+	if _, err := s.ObjectStorage.Head(key); err != nil {
+		return err
+	}
+	m, err := s.load(key)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &objectMeta{}
+	}
+	change(m)
+	return s.save(key, m)
+}
+
+func (s *metaSidecar) SetTags(key string, tags map[string]string) error {
+	return s.update(key, func(m *objectMeta) { m.Tags = tags })
+}
+
+func (s *metaSidecar) SetStorageClass(key, class string) error {
+	return s.update(key, func(m *objectMeta) { m.StorageClass = class })
+}
+
+func (s *metaSidecar) Delete(key string) error {
+	if err := s.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	return s.drop(key)
+}
+
+// ListAll skips the sidecars.
+func (s *metaSidecar) ListAll(prefix, marker string) (<-chan Object, error) {
+	ch, err := ListAll(s.ObjectStorage, prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(metaSidecarPrefix, prefix) {
+		return ch, nil
+	}
+	out := make(chan Object, 1000)
+	go func() {
+		defer close(out)
+		for o := range ch {
+			if o != nil && strings.HasPrefix(o.Key(), metaSidecarPrefix) {
+				continue
+			}
+			out <- o
+		}
+	}()
+	return out, nil
+}
+
+func (s *metaSidecar) List(prefix, marker string, limit int64) ([]Object, error) {
+	ch, err := s.ListAll(prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	var objs []Object
+	for o := range ch {
+		if o == nil {
+			return nil, fmt.Errorf("list %s from %q failed", prefix, marker)
+		}
+		objs = append(objs, o)
+		if int64(len(objs)) >= limit {
+			break
+		}
+	}
+	return objs, nil
+}
+
+var _ MetadataSetter = &metaSidecar{}
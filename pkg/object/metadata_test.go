@@ -0,0 +1,98 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataSidecar(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	if err := PutWithMetadata(m, "a", strings.NewReader("a"), ObjectInfo{ContentType: "text/plain"}); !errors.Is(err, notSupported) {
+		t.Fatalf("metadata of mem should not be supported: %v", err)
+	}
+	s := WithMetadataSidecar(m)
+	if c := Capabilities(s); !c.Metadata {
+		t.Fatalf("capabilities of the sidecar: %s", c)
+	}
+	if WithMetadataSidecar(s) != s {
+		t.Fatalf("the storage with metadata should be used as is")
+	}
+
+	info := ObjectInfo{ContentType: "text/plain", StorageClass: "STANDARD_IA",
+		Metadata: map[string]string{"owner": "jfs"}, Tags: map[string]string{"env": "test"}}
+	if err := PutWithMetadata(s, "dir/a", strings.NewReader("aaa"), info); err != nil {
+		t.Fatalf("put with metadata: %s", err)
+	}
+	o, err := s.Head("dir/a")
+	if err != nil {
+		t.Fatalf("head: %s", err)
+	}
+	got := InfoOf(o)
+	if o.Key() != "dir/a" || o.Size() != 3 || got.ContentType != info.ContentType || got.StorageClass != info.StorageClass ||
+		!reflect.DeepEqual(got.Metadata, info.Metadata) || !reflect.DeepEqual(got.Tags, info.Tags) {
+		t.Fatalf("head: %+v", got)
+	}
+
+	if err = SetTags(s, "dir/a", map[string]string{"env": "prod"}); err != nil {
+		t.Fatalf("set tags: %s", err)
+	}
+	if err = SetStorageClass(s, "dir/a", "GLACIER"); err != nil {
+		t.Fatalf("set storage class: %s", err)
+	}
+	if o, err = s.Head("dir/a"); err != nil {
+		t.Fatalf("head: %s", err)
+	} else if got = InfoOf(o); got.Tags["env"] != "prod" || got.StorageClass != "GLACIER" || got.ContentType != "text/plain" {
+		t.Fatalf("head after changed: %+v", got)
+	}
+	if err = SetTags(s, "missing", map[string]string{"env": "prod"}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("set tags of a missing object: %v", err)
+	}
+
+	// the sidecars are not listed
+	_ = s.Put("b", strings.NewReader("b"))
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if keys := collect(t, ch); strings.Join(keys, ",") != "b,dir/a" {
+		t.Fatalf("listed keys: %v", keys)
+	}
+	if err = s.Put(metaSidecarPrefix+"b", strings.NewReader("b")); err == nil {
+		t.Fatalf("the keys of sidecars should be refused")
+	}
+
+	// overwritten without metadata
+	if err = s.Put("dir/a", strings.NewReader("a2")); err != nil {
+		t.Fatalf("overwrite: %s", err)
+	}
+	if o, err = s.Head("dir/a"); err != nil || InfoOf(o).ContentType != "" || InfoOf(o).Tags != nil {
+		t.Fatalf("head after overwritten: %+v %v", InfoOf(o), err)
+	}
+	// the sidecar is deleted with the object
+	_ = SetTags(s, "b", map[string]string{"k": "v"})
+	if err = s.Delete("b"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if n := countObjects(t, m, metaSidecarPrefix); n != 0 {
+		t.Fatalf("%d sidecars are left", n)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MigrateOptions are the options of Migrate.
+type MigrateOptions struct {
+	// Prefix of the keys migrated, empty for all
+	Prefix string
+	// Threads is the number of objects copied at the same time, 0 means 10.
+	Threads int
+	// DeleteSource deletes the objects migrated from src once all of them
+	// are copied, nothing is deleted if any of them failed.
+	DeleteSource bool
+	// Progress is called with the result so far after every object.
+	Progress func(r MigrateResult)
+	// CheckSkipped compares the contents of the objects in dst of the same
+	// size (see SameContent) before skipping them, instead of their mtimes
+	// if src and dst keep checksums of different algorithms, so a resumed
+	// migration never keeps an object changed or broken in dst. It reads
+	// the objects of one side or both.
+	CheckSkipped bool
+}
+
+// MigrateResult is the outcome of Migrate.
+type MigrateResult struct {
+	// objects copied and verified, and the bytes of them
+	Copied int64
+	Bytes  int64
+	// objects already the same in dst, e.g. copied by a previous run
+	Skipped int64
+	// keys failed to copy or verify, in lexical order
+	Failed []string
+	// objects deleted from src
+	Deleted int64
+}
+
+// Migrate copies the objects of src into dst with the same keys, e.g. to move
+// a volume to another storage. Every object is copied by StreamCopy, which
+// verifies it end to end, even if src and dst keep checksums of different
+// algorithms. The objects already the same in dst (as
+// PlanSync compares them, or by content with CheckSkipped) are skipped, so an
+// interrupted or partly failed migration is resumed by running it again,
+// without any state other than dst. The objects only in dst are kept. The
+// error is about the listing; the objects failed are in the result and
+// logged.
+func Migrate(src, dst ObjectStorage, opts MigrateOptions) (MigrateResult, error) {
+	threads := opts.Threads
+	if threads <= 0 {
+		threads = 10
+	}
+	var mu sync.Mutex
+	var result MigrateResult
+	var migrated []string
+	report := func(update func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		update()
+		if opts.Progress != nil {
+			opts.Progress(result)
+		}
+	}
+
+	skip := func(key string) {
+		report(func() {
+			result.Skipped++
+			migrated = append(migrated, key)
+		})
+	}
+	type task struct {
+		o Object
+		// skipped by the plan, to be checked
+		check bool
+	}
+	todo := make(chan task, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range todo {
+				o, key := t.o, t.o.Key()
+				if t.check {
+					same, err := SameContent(src, key, dst, key)
+					if err == nil && same {
+						skip(key)
+						continue
+					}
+					if err != nil {
+						logger.Warnf("Compare %s in %s and %s: %s", key, src, dst, err)
+					} else {
+						logger.Infof("%s in %s is different from %s, copy it again", key, dst, src)
+					}
+				}
+				if err := StreamCopy(dst, src, key); err != nil {
+					logger.Errorf("Migrate %s from %s to %s: %s", key, src, dst, err)
+					report(func() { result.Failed = append(result.Failed, key) })
+					continue
+				}
+				report(func() {
+					result.Copied++
+					result.Bytes += o.Size()
+					migrated = append(migrated, key)
+				})
+			}
+		}()
+	}
+	err := WalkSyncPlan(src, dst, opts.Prefix, func(action SyncAction, o Object) error {
+		switch action {
+		case SyncAdd, SyncUpdate:
+			todo <- task{o, false}
+		case SyncSkip:
+			if opts.CheckSkipped {
+				todo <- task{o, true}
+			} else {
+				skip(o.Key())
+			}
+		}
+		return nil
+	})
+	close(todo)
+	wg.Wait()
+	sort.Strings(result.Failed)
+	if err != nil {
+		return result, err
+	}
+	if !opts.DeleteSource {
+		return result, nil
+	}
+	if len(result.Failed) > 0 {
+		logger.Warnf("Keep the objects in %s, since %d of them failed to migrate", src, len(result.Failed))
+		return result, nil
+	}
+	for _, key := range migrated {
+		if err = src.Delete(key); err != nil {
+			return result, fmt.Errorf("delete %s from %s: %w", key, src, err)
+		}
+		report(func() { result.Deleted++ })
+	}
+	return result, nil
+}
@@ -0,0 +1,213 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// failingGets fails the Gets of some keys.
+type failingGets struct {
+	ObjectStorage
+	sync.Mutex
+	fail map[string]bool
+}
+
+func (f *failingGets) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	f.Lock()
+	failed := f.fail[key]
+	f.Unlock()
+	if failed {
+		return nil, errors.New("injected failure")
+	}
+	return f.ObjectStorage.Get(key, off, limit)
+}
+
+// corruptPuts flips the first byte of the objects written.
+type corruptPuts struct {
+	ObjectStorage
+}
+
+func (c *corruptPuts) Put(key string, in io.Reader) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		data[0] ^= 1
+	}
+	return c.ObjectStorage.Put(key, bytes.NewReader(data))
+}
+
+// md5Puts flips a byte in the middle of the objects written, and reports
+// the MD5 of what it keeps, as S3 does.
+type md5Puts struct {
+	ObjectStorage
+}
+
+func (c *md5Puts) Put(key string, in io.Reader) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		data[len(data)/2] ^= 1
+	}
+	return c.ObjectStorage.Put(key, bytes.NewReader(data))
+}
+
+func (c *md5Puts) Head(key string) (Object, error) {
+	o, err := c.ObjectStorage.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := hashContent(c.ObjectStorage, key, HashMD5)
+	if err != nil {
+		return nil, err
+	}
+	return &hashedObj{obj{o.Key(), o.Size(), o.Mtime(), false}, HashMD5, sum}, nil
+}
+
+func putObjects(t *testing.T, s ObjectStorage, n int) []string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("chunks/0/%d_0_8", i)
+		if err := s.Put(key, bytes.NewReader([]byte(fmt.Sprintf("data-%03d", i)))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestMigrate(t *testing.T) {
+	src := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	keys := putObjects(t, src, 20)
+	dst, _ := newMem("mem", "", "", "")
+	var progressed int
+	r, err := Migrate(src, dst, MigrateOptions{Threads: 4, DeleteSource: true, Progress: func(MigrateResult) { progressed++ }})
+	if err != nil || r.Copied != 20 || r.Bytes != 20*8 || r.Skipped != 0 || len(r.Failed) != 0 || r.Deleted != 20 {
+		t.Fatalf("migrate: %+v %v", r, err)
+	}
+	if progressed != 40 {
+		t.Fatalf("expect progress of 20 copies and 20 deletes, but got %d", progressed)
+	}
+	for i, key := range keys {
+		if data, err := get(dst, key, 0, -1); err != nil || data != fmt.Sprintf("data-%03d", i) {
+			t.Fatalf("migrated %s: %q %v", key, data, err)
+		}
+		if _, err := src.Head(key); err == nil {
+			t.Fatalf("%s should be deleted from the source", key)
+		}
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	mem, _ := newMem("mem", "", "", "")
+	keys := putObjects(t, mem, 10)
+	src := &failingGets{ObjectStorage: mem, fail: map[string]bool{keys[3]: true, keys[7]: true}}
+	dst, _ := newMem("mem", "", "", "")
+	r, err := Migrate(src, dst, MigrateOptions{DeleteSource: true})
+	if err != nil || r.Copied != 8 || !reflect.DeepEqual(r.Failed, []string{keys[3], keys[7]}) || r.Deleted != 0 {
+		t.Fatalf("migrate with failures: %+v %v", r, err)
+	}
+	if _, err = mem.Head(keys[0]); err != nil {
+		t.Fatalf("nothing should be deleted after a failure: %s", err)
+	}
+
+	src.Lock()
+	src.fail = nil
+	src.Unlock()
+	r, err = Migrate(src, dst, MigrateOptions{})
+	if err != nil || r.Copied != 2 || r.Skipped != 8 || len(r.Failed) != 0 {
+		t.Fatalf("resume: %+v %v", r, err)
+	}
+	for _, key := range []string{keys[3], keys[7]} {
+		if _, err = dst.Head(key); err != nil {
+			t.Fatalf("%s should be migrated by the resume: %s", key, err)
+		}
+	}
+}
+
+func TestMigrateVerify(t *testing.T) {
+	src := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	keys := putObjects(t, src, 3)
+	dst := &corruptPuts{newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)}
+	r, err := Migrate(src, dst, MigrateOptions{DeleteSource: true})
+	if err != nil || r.Copied != 0 || !reflect.DeepEqual(r.Failed, keys) || r.Deleted != 0 {
+		t.Fatalf("the corrupted copies should fail: %+v %v", r, err)
+	}
+	for _, key := range keys {
+		if _, err = src.Head(key); err != nil {
+			t.Fatalf("%s should be kept in the source: %s", key, err)
+		}
+	}
+}
+
+func TestMigrateVerifyAcrossChecksums(t *testing.T) {
+	src := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	keys := putObjects(t, src, 3)
+	mem, _ := newMem("mem", "", "", "")
+	dst := &md5Puts{mem}
+	// the SHA1 of Aliyun can't be compared with the MD5 kept by dst
+	r, err := Migrate(src, dst, MigrateOptions{DeleteSource: true})
+	if err != nil || r.Copied != 0 || !reflect.DeepEqual(r.Failed, keys) || r.Deleted != 0 {
+		t.Fatalf("the corrupted copies should fail: %+v %v", r, err)
+	}
+	// the corrupted copies are deleted, not skipped by the resume
+	r, err = Migrate(src, mem, MigrateOptions{})
+	if err != nil || r.Copied != 3 || len(r.Failed) != 0 {
+		t.Fatalf("migrate: %+v %v", r, err)
+	}
+}
+
+func TestMigratePartialDestination(t *testing.T) {
+	src := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	keys := putObjects(t, src, 10)
+	dst, _ := newMem("mem", "", "", "")
+	// copied by a crashed migration
+	for _, key := range keys[:6] {
+		if err := StreamCopy(dst, src, key); err != nil {
+			t.Fatalf("copy %s: %s", key, err)
+		}
+	}
+	// changed in dst with the same size, but mem keeps no checksum
+	_ = dst.Put(keys[2], bytes.NewReader([]byte("changed!")))
+
+	r, err := Migrate(src, dst, MigrateOptions{})
+	if err != nil || r.Copied != 4 || r.Skipped != 6 || len(r.Failed) != 0 {
+		t.Fatalf("resume: %+v %v", r, err)
+	}
+	if data, _ := get(dst, keys[2], 0, -1); data != "changed!" {
+		t.Fatalf("%s should be skipped by its mtime: %q", keys[2], data)
+	}
+	r, err = Migrate(src, dst, MigrateOptions{CheckSkipped: true})
+	if err != nil || r.Copied != 1 || r.Skipped != 9 || len(r.Failed) != 0 {
+		t.Fatalf("resume with the contents checked: %+v %v", r, err)
+	}
+	for i, key := range keys {
+		if data, err := get(dst, key, 0, -1); err != nil || data != fmt.Sprintf("data-%03d", i) {
+			t.Fatalf("migrated %s: %q %v", key, data, err)
+		}
+	}
+}
@@ -20,15 +20,20 @@
 package object
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 )
 
 type minio struct {
@@ -39,6 +44,121 @@ func (m *minio) String() string {
 	return fmt.Sprintf("minio://%s/%s/", *m.s3client.ses.Config.Endpoint, m.s3client.bucket)
 }
 
+// minioRecord is an event of the bucket notifications of MinIO.
+type minioRecord struct {
+	EventName string    `json:"eventName"`
+	EventTime time.Time `json:"eventTime"`
+	S3        struct {
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// listen opens the stream of the bucket notifications (ListenBucketNotification
+// of MinIO) for the objects with the prefix, which lasts until ctx is done.
+func (m *minio) listen(ctx context.Context, prefix string) (*http.Response, error) {
+	scheme := "https"
+	if aws.BoolValue(m.ses.Config.DisableSSL) {
+		scheme = "http"
+	}
+	q := url.Values{"prefix": {prefix}, "suffix": {""}, "events": {"s3:ObjectCreated:*", "s3:ObjectRemoved:*"}}
+	u := fmt.Sprintf("%s://%s/%s?%s", scheme, aws.StringValue(m.ses.Config.Endpoint), m.bucket, q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.ses.Config.Credentials != credentials.AnonymousCredentials {
+		if _, err = v4.NewSigner(m.ses.Config.Credentials).Sign(req, nil, "s3", aws.StringValue(m.ses.Config.Region), time.Now()); err != nil {
+			return nil, fmt.Errorf("sign: %s", err)
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("listen bucket notification: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// Watch receives the bucket notifications of MinIO, the stream is reopened
+// when it's broken.
+func (m *minio) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	resp, err := m.listen(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Event, 1024)
+	go func() {
+		defer close(out)
+		for {
+			m.receive(ctx, resp, out)
+			resp = nil
+			for backoff := time.Second; resp == nil; {
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				if resp, err = m.listen(ctx, prefix); err != nil && ctx.Err() == nil {
+					logger.Warnf("Reconnect the notifications of %s: %s", m, err)
+				}
+				if backoff *= 2; backoff > time.Minute {
+					backoff = time.Minute
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// receive sends the events in the stream of notifications until it's broken
+// or ctx is done, which closes the stream.
+func (m *minio) receive(ctx context.Context, resp *http.Response, out chan<- Event) {
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		// the blank lines are sent to keep the stream alive
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var info struct{ Records []minioRecord }
+		if err := json.Unmarshal([]byte(line), &info); err != nil {
+			logger.Warnf("Invalid notification from %s: %s", m, err)
+			continue
+		}
+		for _, r := range info.Records {
+			e := Event{Key: r.S3.Object.Key, Time: r.EventTime}
+			// the keys are escaped in the notifications
+			if key, err := url.QueryUnescape(e.Key); err == nil {
+				e.Key = key
+			}
+			switch {
+			case strings.HasPrefix(r.EventName, "s3:ObjectCreated:"):
+				e.Type, e.Size = EventPut, r.S3.Object.Size
+			case strings.HasPrefix(r.EventName, "s3:ObjectRemoved:"):
+				e.Type = EventDelete
+			default:
+				continue
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		logger.Warnf("The notifications of %s are broken: %s", m, err)
+	}
+}
+
 func newMinio(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
 	if !strings.Contains(endpoint, "://") {
 		endpoint = fmt.Sprintf("http://%s", endpoint)
@@ -83,7 +203,11 @@ func newMinio(endpoint, accessKey, secretKey, token string) (ObjectStorage, erro
 		bucket = bucket[len("minio/"):]
 	}
 	bucket = strings.Split(bucket, "/")[0]
-	return &minio{s3client{bucket, s3.New(ses), ses}}, nil
+	c, err := newS3Client(bucket, ses, uri.Query())
+	if err != nil {
+		return nil, err
+	}
+	return &minio{c}, nil
 }
 
 func init() {
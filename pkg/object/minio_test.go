@@ -0,0 +1,103 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMinioWatch(t *testing.T) {
+	record := func(name, key string, size int) string {
+		return fmt.Sprintf(`{"eventName":%q,"eventTime":"2022-09-01T10:00:00.000Z","s3":{"object":{"key":%q,"size":%d}}}`, name, key, size)
+	}
+	stopped := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/jfs" || q.Get("prefix") != "p/chunks/" || !reflect.DeepEqual(q["events"], []string{"s3:ObjectCreated:*", "s3:ObjectRemoved:*"}) {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=ak/") {
+			http.Error(w, "not signed", http.StatusForbidden)
+			return
+		}
+		f := w.(http.Flusher)
+		_, _ = fmt.Fprintf(w, " \n{\"Records\":[%s,%s]}\n", record("s3:ObjectCreated:Put", "p%2Fchunks%2Fa+b", 10),
+			record("s3:BucketCreated", "p/chunks/x", 0))
+		f.Flush()
+		_, _ = fmt.Fprintf(w, "{\"Records\":[%s]}\n", record("s3:ObjectRemoved:Delete", "p/chunks/c", 0))
+		f.Flush()
+		// the stream lasts until the watch is canceled
+		<-r.Context().Done()
+		close(stopped)
+	}))
+	defer srv.Close()
+
+	m, err := newMinio(srv.URL+"/jfs", "ak", "sk", "")
+	if err != nil {
+		t.Fatalf("create minio: %s", err)
+	}
+	if !Capabilities(m).Watch {
+		t.Fatalf("minio should support Watch")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := WithPrefix(m, "p/").(Watcher).Watch(ctx, "chunks/")
+	if err != nil {
+		t.Fatalf("watch: %s", err)
+	}
+	mtime, _ := time.Parse(time.RFC3339, "2022-09-01T10:00:00Z")
+	for _, expect := range []Event{{EventPut, "chunks/a b", 10, mtime}, {EventDelete, "chunks/c", 0, mtime}} {
+		select {
+		case e := <-ch:
+			if e != expect {
+				t.Fatalf("expect event %+v, but got %+v", expect, e)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("no event of %s", expect.Key)
+		}
+	}
+
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(closed)
+	}()
+	for _, done := range []chan struct{}{stopped, closed} {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("the watch is not stopped after canceled")
+		}
+	}
+
+	if _, err = m.(Watcher).Watch(context.Background(), "other/"); err == nil {
+		t.Fatalf("watch should fail when the server refuses")
+	}
+	if _, ok := interface{}(&s3client{}).(Watcher); ok {
+		t.Fatalf("s3 has no native notifications")
+	}
+}
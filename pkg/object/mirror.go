@@ -0,0 +1,114 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// readMirror reads the objects from a CDN or a mirror serving them at
+// `<base>/<key>`, which is read-only and may be out of date.
+type readMirror struct {
+	base   string
+	client *http.Client
+}
+
+func newReadMirror(base string) (*readMirror, error) {
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid mirror %s", base)
+	}
+	return &readMirror{strings.TrimSuffix(base, "/"), httpClient}, nil
+}
+
+func (m *readMirror) url(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return m.base + "/" + strings.Join(parts, "/")
+}
+
+// get returns the range of key from the mirror, or an error if the mirror
+// does not have it.
+func (m *readMirror) get(key string, off, limit int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, m.url(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+limit-1))
+	} else if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		// the range is ignored by the mirror
+		if off > 0 {
+			if _, err = io.CopyN(io.Discard, resp.Body, off); err != nil {
+				_ = resp.Body.Close()
+				return nil, err
+			}
+		}
+		if limit > 0 {
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(resp.Body, limit), resp.Body}, nil
+		}
+		return resp.Body, nil
+	}
+	_ = resp.Body.Close()
+	return nil, fmt.Errorf("get %s from mirror: %s", key, resp.Status)
+}
+
+type withReadMirror struct {
+	ObjectStorage
+	mirror *readMirror
+}
+
+// WithReadMirror returns an object storage which reads the objects from a CDN
+// or a mirror at base first, and from o if the mirror fails. The writes always
+// go to o, so the mirror should not cache the objects being overwritten.
+func WithReadMirror(o ObjectStorage, base string) (ObjectStorage, error) {
+	m, err := newReadMirror(base)
+	if err != nil {
+		return nil, err
+	}
+	return &withReadMirror{o, m}, nil
+}
+
+func (w *withReadMirror) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r, err := w.mirror.get(key, off, limit)
+	if err == nil {
+		return r, nil
+	}
+	logger.Debugf("Read %s from origin: %s", key, err)
+	return w.ObjectStorage.Get(key, off, limit)
+}
+
+var _ ObjectStorage = &withReadMirror{}
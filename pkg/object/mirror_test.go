@@ -0,0 +1,104 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mirrorServer serves the objects under /cdn/, the ones in full are returned
+// as a whole ignoring the range.
+type mirrorServer struct {
+	sync.Mutex
+	objects map[string]string
+	full    map[string]bool
+	hits    []string
+}
+
+func (m *mirrorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/cdn/")
+	m.hits = append(m.hits, key)
+	data, ok := m.objects[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if m.full[key] {
+		_, _ = io.WriteString(w, data)
+		return
+	}
+	http.ServeContent(w, r, key, time.Now(), strings.NewReader(data))
+}
+
+func TestReadMirror(t *testing.T) {
+	ms := &mirrorServer{
+		objects: map[string]string{"chunks/a b": "mirror a", "full": "mirror full"},
+		full:    map[string]bool{"full": true},
+	}
+	srv := httptest.NewServer(ms)
+	defer srv.Close()
+	origin, _ := newMem("mem", "", "", "")
+	for _, key := range []string{"chunks/a b", "full", "missed"} {
+		_ = origin.Put(key, bytes.NewReader([]byte("origin "+key)))
+	}
+	s, err := WithReadMirror(origin, srv.URL+"/cdn/")
+	if err != nil {
+		t.Fatalf("with mirror: %s", err)
+	}
+
+	for _, c := range []struct {
+		key        string
+		off, limit int64
+		expect     string
+	}{
+		{"chunks/a b", 0, -1, "mirror a"},
+		{"chunks/a b", 2, 3, "rro"},
+		{"full", 7, -1, "full"},
+		{"full", 1, 5, "irror"},
+		{"missed", 0, -1, "origin missed"},
+		{"missed", 7, 3, "mis"},
+	} {
+		if d, err := get(s, c.key, c.off, c.limit); err != nil || d != c.expect {
+			t.Fatalf("get %s (%d, %d): expect %q, but got %q %v", c.key, c.off, c.limit, c.expect, d, err)
+		}
+	}
+	ms.Lock()
+	hits := strings.Join(ms.hits, ",")
+	ms.Unlock()
+	if hits != "chunks/a b,chunks/a b,full,full,missed,missed" {
+		t.Fatalf("every get should try the mirror first: %s", hits)
+	}
+
+	if err = s.Put("new", bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if _, err = origin.Head("new"); err != nil {
+		t.Fatalf("the writes should go to origin: %s", err)
+	}
+	if _, err = WithReadMirror(origin, "cdn.example.com"); err == nil {
+		t.Fatalf("mirror without scheme should be rejected")
+	}
+}
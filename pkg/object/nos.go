@@ -20,10 +20,8 @@
 package object
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -92,23 +90,19 @@ func (s *nos) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (s *nos) Put(key string, in io.Reader) error {
-	var body io.ReadSeeker
-	switch body.(type) {
-	case io.ReadSeeker:
-		body = in.(io.ReadSeeker)
-	default:
-		data, err := ioutil.ReadAll(in)
-		if err != nil {
-			return err
-		}
-		body = bytes.NewReader(data)
+	// the length is required, the content of unknown length is spooled
+	sp, err := Spool(in, spoolMemory, "")
+	if err != nil {
+		return err
 	}
+	defer sp.Close()
+	body := sp.ReadSeeker
 	params := &model.PutObjectRequest{
 		Bucket: s.bucket,
 		Object: key,
 		Body:   body,
 	}
-	_, err := s.client.PutObjectByStream(params)
+	_, err = s.client.PutObjectByStream(params)
 	return err
 }
 
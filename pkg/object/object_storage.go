@@ -18,24 +18,56 @@ package object
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/version"
 )
 
 var ctx = context.Background()
 var logger = utils.GetLogger("juicefs")
 
-var UserAgent = "JuiceFS"
+// UserAgent identifies JuiceFS in the requests to the storages, it's added to
+// the User-Agent of the SDKs.
+var UserAgent = "JuiceFS-" + version.Version()
 
 type MtimeChanger interface {
 	Chtimes(path string, mtime time.Time) error
 }
 
+// MtimePutter is implemented by the storages which could set the mtime of an
+// object when it's written, e.g. to keep the original mtime by sync.
+type MtimePutter interface {
+	PutWithMtime(key string, in io.Reader, mtime time.Time) error
+}
+
+// PutWithMtime writes the object with mtime as its modification time. It's
+// set by PutWithMtime of a MtimePutter or Chtimes of a MtimeChanger after Put,
+// and ignored by the other storages (e.g. the Aliyun drive, which can not
+// update the time of a node), those have the time of upload instead. The
+// object is still written if Chtimes fails (e.g. not permitted by sftp),
+// which is only logged.
+func PutWithMtime(s ObjectStorage, key string, in io.Reader, mtime time.Time) error {
+	if p, ok := s.(MtimePutter); ok {
+		return p.PutWithMtime(key, in, mtime)
+	}
+	if err := s.Put(key, in); err != nil {
+		return err
+	}
+	if c, ok := s.(MtimeChanger); ok {
+		if err := c.Chtimes(key, mtime); err != nil && !errors.Is(err, notSupported) {
+			logger.Warnf("Update mtime of %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
 type SupportSymlink interface {
 	// Symlink create a symbolic link
 	Symlink(oldName, newName string) error
@@ -142,15 +174,62 @@ func (s DefaultObjectStorage) ListAll(prefix, marker string) (<-chan Object, err
 
 type Creator func(bucket, accessKey, secretKey, token string) (ObjectStorage, error)
 
+// Options are the query parameters of the endpoint of a storage.
+type Options map[string]string
+
 var storages = make(map[string]Creator)
+var storageDefaults = make(map[string]Options)
 
 func Register(name string, register Creator) {
 	storages[name] = register
 }
 
+// RegisterWithDefaults is like Register, but the defaults are added into the
+// query of the endpoint unless it has them already.
+func RegisterWithDefaults(name string, register Creator, defaults Options) {
+	storages[name] = register
+	storageDefaults[name] = defaults
+}
+
+// DefaultOptions returns a copy of the default options of a storage, it's
+// nil if the storage has none.
+func DefaultOptions(name string) Options {
+	defaults, ok := storageDefaults[name]
+	if !ok {
+		return nil
+	}
+	opts := make(Options, len(defaults))
+	for k, v := range defaults {
+		opts[k] = v
+	}
+	return opts
+}
+
+// withDefaults adds the options missing in the query of endpoint.
+func withDefaults(endpoint string, defaults Options) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parse endpoint %s: %s", endpoint, err)
+	}
+	q := u.Query()
+	for k, v := range defaults {
+		if _, ok := q[k]; !ok {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
 func CreateStorage(name, endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
 	f, ok := storages[name]
 	if ok {
+		if defaults := storageDefaults[name]; len(defaults) > 0 {
+			var err error
+			if endpoint, err = withDefaults(endpoint, defaults); err != nil {
+				return nil, err
+			}
+		}
 		logger.Debugf("Creating %s storage at endpoint %s", name, endpoint)
 		return f(endpoint, accessKey, secretKey, token)
 	}
@@ -26,14 +26,20 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/go-redis/redis/v8"
 )
 
@@ -318,16 +324,173 @@ func testStorage(t *testing.T, s ObjectStorage) {
 	}
 }
 
+// testConcurrentKey hammers one key with interleaved Put, Delete and Get from
+// many goroutines. Every Get should see a complete version written by a Put
+// or a clean not-found, and no upload should be left behind.
+func testConcurrentKey(t *testing.T, s ObjectStorage, workers, rounds int) {
+	const key = "concurrent/key"
+	// a version repeats its name, so a torn or mixed read is detected
+	version := func(w, i int) string {
+		return strings.Repeat(fmt.Sprintf("<%d-%d>", w, i), 100)
+	}
+	check := func(data string) error {
+		if len(data) == 0 {
+			return fmt.Errorf("empty content")
+		}
+		end := strings.Index(data, ">")
+		if end < 0 || strings.Repeat(data[:end+1], 100) != data {
+			return fmt.Errorf("torn content %.40q...", data)
+		}
+		return nil
+	}
+
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			var err error
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+				}
+				errs <- err
+			}()
+			for i := 0; i < rounds && err == nil; i++ {
+				switch (w + i) % 3 {
+				case 0:
+					if err = s.Put(key, bytes.NewReader([]byte(version(w, i)))); err != nil {
+						err = fmt.Errorf("put: %w", err)
+					}
+				case 1:
+					if err = s.Delete(key); err != nil {
+						err = fmt.Errorf("delete: %w", err)
+					}
+				default:
+					var data string
+					if data, err = get(s, key, 0, -1); errors.Is(err, os.ErrNotExist) {
+						err = nil
+					} else if err != nil {
+						err = fmt.Errorf("get: %w", err)
+					} else {
+						err = check(data)
+					}
+				}
+			}
+		}(w)
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+	if data, err := get(s, key, 0, -1); err == nil {
+		if err = check(data); err != nil {
+			t.Fatalf("%s: final %s", s, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("%s: final get: %s", s, err)
+	}
+	if uploads, _, err := s.ListUploads(""); err != nil || len(uploads) != 0 {
+		t.Fatalf("%s: %d uploads are left (%v)", s, len(uploads), err)
+	}
+	_ = s.Delete(key)
+}
+
 func TestMem(t *testing.T) {
 	m, _ := newMem("", "", "", "")
 	testStorage(t, m)
 }
 
+func TestMemConcurrentKey(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	testConcurrentKey(t, m, 16, 200)
+}
+
 func TestDisk(t *testing.T) {
 	s, _ := newDisk("/tmp/abc/", "", "", "")
 	testStorage(t, s)
 }
 
+func TestPutWithMtime(t *testing.T) {
+	disk, _ := newDisk(t.TempDir()+"/", "", "", "")
+	mtime := time.Date(2020, 2, 2, 12, 0, 0, 0, time.UTC)
+	for _, s := range []ObjectStorage{disk, WithPrefix(disk, "prefix/")} {
+		if err := PutWithMtime(s, "restored", bytes.NewReader([]byte("data")), mtime); err != nil {
+			t.Fatalf("put %s with mtime: %s", s, err)
+		}
+		o, err := s.Head("restored")
+		if err != nil {
+			t.Fatalf("head %s: %s", s, err)
+		}
+		if !o.Mtime().Equal(mtime) || o.Size() != 4 {
+			t.Fatalf("expect mtime %s and size 4, but got %s and %d", mtime, o.Mtime(), o.Size())
+		}
+	}
+	// ignored by the storages not supporting it
+	mem, _ := newMem("mem", "", "", "")
+	if err := PutWithMtime(mem, "restored", bytes.NewReader([]byte("data")), mtime); err != nil {
+		t.Fatalf("put mem with mtime: %s", err)
+	}
+	if o, err := mem.Head("restored"); err != nil || o.Mtime().Equal(mtime) {
+		t.Fatalf("mem should have the time of upload: %v %v", o, err)
+	}
+	// the object is kept if the mtime can't be changed
+	if err := PutWithMtime(failedChtimes{mem}, "denied", bytes.NewReader([]byte("data")), mtime); err != nil {
+		t.Fatalf("put with a failed chtimes: %s", err)
+	}
+	if o, err := mem.Head("denied"); err != nil || o.Size() != 4 {
+		t.Fatalf("head denied: %v %v", o, err)
+	}
+}
+
+type failedChtimes struct {
+	ObjectStorage
+}
+
+func (failedChtimes) Chtimes(key string, mtime time.Time) error {
+	return os.ErrPermission
+}
+
+func TestRegisterWithDefaults(t *testing.T) {
+	var got string
+	RegisterWithDefaults("test-defaults", func(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+		got = endpoint
+		return newMem(endpoint, accessKey, secretKey, token)
+	}, Options{"retries": "3", "timeout": "10s"})
+	defer func() {
+		delete(storages, "test-defaults")
+		delete(storageDefaults, "test-defaults")
+	}()
+
+	for endpoint, expect := range map[string]string{
+		"test-defaults://bucket/dir":                       "test-defaults://bucket/dir?retries=3&timeout=10s",
+		"test-defaults://bucket/dir?timeout=1m":            "test-defaults://bucket/dir?retries=3&timeout=1m",
+		"test-defaults://bucket/dir?retries=0&other=x":     "test-defaults://bucket/dir?other=x&retries=0&timeout=10s",
+		"test-defaults://bucket/dir?retries=&timeout=10ms": "test-defaults://bucket/dir?retries=&timeout=10ms",
+	} {
+		if _, err := CreateStorage("test-defaults", endpoint, "", "", ""); err != nil {
+			t.Fatalf("create %s: %s", endpoint, err)
+		}
+		if got != expect {
+			t.Fatalf("expect endpoint %s, but got %s", expect, got)
+		}
+	}
+
+	opts := DefaultOptions("test-defaults")
+	opts["retries"] = "5"
+	if DefaultOptions("test-defaults")["retries"] != "3" {
+		t.Fatalf("the defaults should not be changed by the caller")
+	}
+	if DefaultOptions("mem") != nil {
+		t.Fatalf("mem has no defaults")
+	}
+	if v := DefaultOptions("aliyun")["list-concurrency"]; v != strconv.Itoa(defaultAliyunOptions.listConcurrency) {
+		t.Fatalf("default list-concurrency of aliyun: %q", v)
+	}
+	if _, opts, err := parseAliyunEndpoint("aliyun:///jfs?list-concurrency=8"); err != nil || opts.listConcurrency != 8 {
+		t.Fatalf("list-concurrency in endpoint should override the default: %d %v", opts.listConcurrency, err)
+	}
+}
+
 func TestQingStor(t *testing.T) {
 	if os.Getenv("QY_ACCESS_KEY") == "" {
 		t.SkipNow()
@@ -757,6 +920,39 @@ func TestTOS(t *testing.T) {
 	testStorage(t, tos)
 }
 
+func TestUserAgent(t *testing.T) {
+	agents := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+	if !strings.HasPrefix(UserAgent, "JuiceFS-") {
+		t.Fatalf("default user agent: %s", UserAgent)
+	}
+	old := UserAgent
+	defer func() { UserAgent = old }()
+	UserAgent = "JuiceFS-test"
+
+	rs := &RestfulStorage{endpoint: srv.URL, signer: sign}
+	_, _ = rs.Head("key")
+	if got := <-agents; got != "JuiceFS-test" {
+		t.Fatalf("user agent of restful storage: %q", got)
+	}
+	ses, err := session.NewSession(&aws.Config{Region: aws.String(awsDefaultRegion), Endpoint: aws.String(srv.URL),
+		S3ForcePathStyle: aws.Bool(true), Credentials: credentials.AnonymousCredentials, HTTPClient: httpClient})
+	if err != nil {
+		t.Fatalf("aws session: %s", err)
+	}
+	c, err := newS3Client("bucket", ses, nil)
+	if err != nil {
+		t.Fatalf("s3 client: %s", err)
+	}
+	_ = c.Delete("key")
+	if got := <-agents; !strings.HasPrefix(got, "aws-sdk-go/") || !strings.HasSuffix(got, " JuiceFS-test") {
+		t.Fatalf("user agent of s3: %q", got)
+	}
+}
+
 func TestMain(m *testing.M) {
 	if envFile := os.Getenv("JUICEFS_ENV_FILE_FOR_TEST"); envFile != "" {
 		// schema: S3 AWS_ENDPOINT=xxxxx  AWS_ACCESS_KEY_ID=xxxx  AWS_SECRET_ACCESS_KEY=xxxx
@@ -38,13 +38,106 @@ import (
 	"golang.org/x/net/http/httpproxy"
 )
 
-const obsDefaultRegion = "cn-north-1"
+const (
+	obsDefaultRegion = "cn-north-1"
+	obsMaxParts      = 10000
+	// the keys deleted in one request at most
+	obsMaxDeletes = 1000
+)
+
+// obsAPI is the part of the OBS client used by obsClient. The extensions of
+// the SDK can't be named out of it, so the range of GetObject is an argument.
+type obsAPI interface {
+	CreateBucket(input *obs.CreateBucketInput) (*obs.BaseModel, error)
+	GetObjectMetadata(input *obs.GetObjectMetadataInput) (*obs.GetObjectMetadataOutput, error)
+	GetObject(input *obs.GetObjectInput, rangeStr string) (*obs.GetObjectOutput, error)
+	PutObject(input *obs.PutObjectInput) (*obs.PutObjectOutput, error)
+	CopyObject(input *obs.CopyObjectInput) (*obs.CopyObjectOutput, error)
+	DeleteObject(input *obs.DeleteObjectInput) (*obs.DeleteObjectOutput, error)
+	DeleteObjects(input *obs.DeleteObjectsInput) (*obs.DeleteObjectsOutput, error)
+	ListObjects(input *obs.ListObjectsInput) (*obs.ListObjectsOutput, error)
+	InitiateMultipartUpload(input *obs.InitiateMultipartUploadInput) (*obs.InitiateMultipartUploadOutput, error)
+	UploadPart(input *obs.UploadPartInput) (*obs.UploadPartOutput, error)
+	AbortMultipartUpload(input *obs.AbortMultipartUploadInput) (*obs.BaseModel, error)
+	CompleteMultipartUpload(input *obs.CompleteMultipartUploadInput) (*obs.CompleteMultipartUploadOutput, error)
+	ListMultipartUploads(input *obs.ListMultipartUploadsInput) (*obs.ListMultipartUploadsOutput, error)
+}
+
+// obsSDK adapts the client of the SDK to obsAPI.
+type obsSDK struct {
+	c *obs.ObsClient
+}
+
+func (o obsSDK) CreateBucket(input *obs.CreateBucketInput) (*obs.BaseModel, error) {
+	return o.c.CreateBucket(input)
+}
+
+func (o obsSDK) GetObjectMetadata(input *obs.GetObjectMetadataInput) (*obs.GetObjectMetadataOutput, error) {
+	return o.c.GetObjectMetadata(input)
+}
+
+func (o obsSDK) GetObject(input *obs.GetObjectInput, rangeStr string) (*obs.GetObjectOutput, error) {
+	if rangeStr != "" {
+		return o.c.GetObject(input, obs.WithHeader(obs.HEADER_RANGE, []string{rangeStr}))
+	}
+	return o.c.GetObject(input)
+}
+
+func (o obsSDK) PutObject(input *obs.PutObjectInput) (*obs.PutObjectOutput, error) {
+	return o.c.PutObject(input)
+}
+
+func (o obsSDK) CopyObject(input *obs.CopyObjectInput) (*obs.CopyObjectOutput, error) {
+	return o.c.CopyObject(input)
+}
+
+func (o obsSDK) DeleteObject(input *obs.DeleteObjectInput) (*obs.DeleteObjectOutput, error) {
+	return o.c.DeleteObject(input)
+}
+
+func (o obsSDK) DeleteObjects(input *obs.DeleteObjectsInput) (*obs.DeleteObjectsOutput, error) {
+	return o.c.DeleteObjects(input)
+}
+
+func (o obsSDK) ListObjects(input *obs.ListObjectsInput) (*obs.ListObjectsOutput, error) {
+	return o.c.ListObjects(input)
+}
+
+func (o obsSDK) InitiateMultipartUpload(input *obs.InitiateMultipartUploadInput) (*obs.InitiateMultipartUploadOutput, error) {
+	return o.c.InitiateMultipartUpload(input)
+}
+
+func (o obsSDK) UploadPart(input *obs.UploadPartInput) (*obs.UploadPartOutput, error) {
+	return o.c.UploadPart(input)
+}
+
+func (o obsSDK) AbortMultipartUpload(input *obs.AbortMultipartUploadInput) (*obs.BaseModel, error) {
+	return o.c.AbortMultipartUpload(input)
+}
+
+func (o obsSDK) CompleteMultipartUpload(input *obs.CompleteMultipartUploadInput) (*obs.CompleteMultipartUploadOutput, error) {
+	return o.c.CompleteMultipartUpload(input)
+}
+
+func (o obsSDK) ListMultipartUploads(input *obs.ListMultipartUploadsInput) (*obs.ListMultipartUploadsOutput, error) {
+	return o.c.ListMultipartUploads(input)
+}
 
 type obsClient struct {
 	bucket    string
 	region    string
 	checkEtag bool
-	c         *obs.ObsClient
+	c         obsAPI
+	// objects larger than partSize are uploaded part by part
+	partSize int64
+}
+
+// obsError returns os.ErrNotExist for the missing objects.
+func obsError(err error) error {
+	if e, ok := err.(obs.ObsError); ok && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey") {
+		return os.ErrNotExist
+	}
+	return err
 }
 
 func (s *obsClient) String() string {
@@ -70,10 +163,7 @@ func (s *obsClient) Head(key string) (Object, error) {
 	}
 	r, err := s.c.GetObjectMetadata(params)
 	if err != nil {
-		if e, ok := err.(obs.ObsError); ok && e.BaseModel.StatusCode == http.StatusNotFound {
-			err = os.ErrNotExist
-		}
-		return nil, err
+		return nil, obsError(err)
 	}
 	return &obj{
 		key,
@@ -87,16 +177,10 @@ func (s *obsClient) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	params := &obs.GetObjectInput{}
 	params.Bucket = s.bucket
 	params.Key = key
-	var resp *obs.GetObjectOutput
-	var err error
 	rangeStr := getRange(off, limit)
-	if rangeStr != "" {
-		resp, err = s.c.GetObject(params, obs.WithHeader(obs.HEADER_RANGE, []string{rangeStr}))
-	} else {
-		resp, err = s.c.GetObject(params)
-	}
+	resp, err := s.c.GetObject(params, rangeStr)
 	if err != nil {
-		return nil, err
+		return nil, obsError(err)
 	}
 	if err = checkGetStatus(resp.StatusCode, rangeStr != ""); err != nil {
 		_ = resp.Body.Close()
@@ -106,16 +190,20 @@ func (s *obsClient) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (s *obsClient) Put(key string, in io.Reader) error {
+	in, vlen, err := findLen(in)
+	if err != nil {
+		return err
+	}
+	if vlen > s.partSize {
+		return s.putMultipart(key, in, vlen)
+	}
 	var body io.ReadSeeker
-	var vlen int64
 	var sum []byte
 	if b, ok := in.(io.ReadSeeker); ok {
-		var err error
 		h := md5.New()
 		buf := bufPool.Get().(*[]byte)
 		defer bufPool.Put(buf)
-		vlen, err = io.CopyBuffer(h, in, *buf)
-		if err != nil {
+		if _, err = io.CopyBuffer(h, in, *buf); err != nil {
 			return err
 		}
 		_, err = b.Seek(0, io.SeekStart)
@@ -129,7 +217,6 @@ func (s *obsClient) Put(key string, in io.Reader) error {
 		if err != nil {
 			return err
 		}
-		vlen = int64(len(data))
 		s := md5.Sum(data)
 		sum = s[:]
 		body = bytes.NewReader(data)
@@ -156,7 +243,7 @@ func (s *obsClient) Copy(dst, src string) error {
 	params.CopySourceBucket = s.bucket
 	params.CopySourceKey = src
 	_, err := s.c.CopyObject(params)
-	return err
+	return obsError(err)
 }
 
 func (s *obsClient) Delete(key string) error {
@@ -164,10 +251,48 @@ func (s *obsClient) Delete(key string) error {
 	params.Bucket = s.bucket
 	params.Key = key
 	_, err := s.c.DeleteObject(&params)
+	if err = obsError(err); os.IsNotExist(err) {
+		err = nil
+	}
 	return err
 }
 
+// DeleteMulti deletes the keys in batches, the failed keys are returned as
+// a BulkError.
+func (s *obsClient) DeleteMulti(keys []string) error {
+	b := &bulkRunner{op: "delete", mode: BulkBestEffort}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > obsMaxDeletes {
+			batch = batch[:obsMaxDeletes]
+		}
+		keys = keys[len(batch):]
+		input := &obs.DeleteObjectsInput{Bucket: s.bucket, Quiet: true}
+		for _, key := range batch {
+			input.Objects = append(input.Objects, obs.ObjectToDelete{Key: key})
+		}
+		r, err := s.c.DeleteObjects(input)
+		if err != nil {
+			for _, key := range batch {
+				_, _ = b.run(key, func(string) error { return err })
+			}
+			continue
+		}
+		for _, e := range r.Errors {
+			if e.Code == "NoSuchKey" {
+				continue
+			}
+			err := fmt.Errorf("%s: %s", e.Code, e.Message)
+			_, _ = b.run(e.Key, func(string) error { return err })
+		}
+	}
+	return b.result()
+}
+
 func (s *obsClient) List(prefix, marker string, limit int64) ([]Object, error) {
+	if limit > 1000 {
+		limit = 1000
+	}
 	input := &obs.ListObjectsInput{
 		Bucket: s.bucket,
 		Marker: marker,
@@ -204,7 +329,42 @@ func (s *obsClient) CreateMultipartUpload(key string) (*MultipartUpload, error)
 	if err != nil {
 		return nil, err
 	}
-	return &MultipartUpload{UploadID: resp.UploadId, MinPartSize: 5 << 20, MaxCount: 10000}, nil
+	return &MultipartUpload{UploadID: resp.UploadId, MinPartSize: 5 << 20, MaxCount: obsMaxParts}, nil
+}
+
+func (s *obsClient) putMultipart(key string, in io.Reader, size int64) error {
+	partSize := s.partSize
+	if n := (size + partSize - 1) / partSize; n > obsMaxParts {
+		partSize = (size + obsMaxParts - 1) / obsMaxParts
+	}
+	upload, err := s.CreateMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+	var parts []*Part
+	buf := make([]byte, partSize)
+	for num := 1; size > 0; num++ {
+		n := partSize
+		if size < n {
+			n = size
+		}
+		if _, err = io.ReadFull(in, buf[:n]); err != nil {
+			break
+		}
+		var part *Part
+		if part, err = s.UploadPart(key, upload.UploadID, num, buf[:n]); err != nil {
+			break
+		}
+		parts = append(parts, part)
+		size -= n
+	}
+	if err == nil {
+		err = s.CompleteUpload(key, upload.UploadID, parts)
+	}
+	if err != nil {
+		s.AbortUpload(key, upload.UploadID)
+	}
+	return err
 }
 
 func (s *obsClient) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
@@ -224,7 +384,7 @@ func (s *obsClient) UploadPart(key string, uploadID string, num int, body []byte
 	if err != nil {
 		return nil, err
 	}
-	return &Part{Num: num, ETag: resp.ETag}, err
+	return &Part{Num: num, Size: len(body), ETag: resp.ETag}, err
 }
 
 func (s *obsClient) AbortUpload(key string, uploadID string) {
@@ -353,7 +513,7 @@ func newOBS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 			logger.Warnf("get bucket encryption: %q", err)
 		}
 	}
-	return &obsClient{bucket: bucketName, region: region, checkEtag: checkEtag, c: c}, nil
+	return &obsClient{bucket: bucketName, region: region, checkEtag: checkEtag, c: obsSDK{c}, partSize: 128 << 20}, nil
 }
 
 func init() {
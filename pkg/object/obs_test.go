@@ -0,0 +1,349 @@
+//go:build !noobs
+// +build !noobs
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/huaweicloud/huaweicloud-sdk-go-obs/obs"
+)
+
+type fakeOBSObject struct {
+	data  []byte
+	mtime time.Time
+}
+
+// fakeOBS is an in-memory OBS bucket.
+type fakeOBS struct {
+	sync.Mutex
+	objects map[string]fakeOBSObject
+	uploads map[string]map[int][]byte
+	keys    map[string]string
+	seq     int
+	puts    int
+	lists   int
+	batches int
+	// the keys failed to delete in batch
+	undeletable map[string]bool
+}
+
+func newFakeOBS() *fakeOBS {
+	return &fakeOBS{
+		objects:     make(map[string]fakeOBSObject),
+		uploads:     make(map[string]map[int][]byte),
+		keys:        make(map[string]string),
+		undeletable: make(map[string]bool),
+	}
+}
+
+func obsFakeError(status int, code string) error {
+	e := obs.ObsError{Code: code, Message: code}
+	e.StatusCode = status
+	return e
+}
+
+func (f *fakeOBS) CreateBucket(input *obs.CreateBucketInput) (*obs.BaseModel, error) {
+	return nil, obsFakeError(http.StatusConflict, "BucketAlreadyOwnedByYou")
+}
+
+func (f *fakeOBS) GetObjectMetadata(input *obs.GetObjectMetadataInput) (*obs.GetObjectMetadataOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, ok := f.objects[input.Key]
+	if !ok {
+		// HEAD has no body for the code
+		return nil, obsFakeError(http.StatusNotFound, "")
+	}
+	r := &obs.GetObjectMetadataOutput{ContentLength: int64(len(o.data)), LastModified: o.mtime}
+	r.StatusCode = http.StatusOK
+	return r, nil
+}
+
+func (f *fakeOBS) GetObject(input *obs.GetObjectInput, rangeStr string) (*obs.GetObjectOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, ok := f.objects[input.Key]
+	if !ok {
+		return nil, obsFakeError(http.StatusNotFound, "NoSuchKey")
+	}
+	data := o.data
+	r := &obs.GetObjectOutput{}
+	r.StatusCode = http.StatusOK
+	if rangeStr != "" {
+		start, end := int64(0), int64(len(data))-1
+		var last int64
+		if n, _ := fmt.Sscanf(rangeStr, "bytes=%d-%d", &start, &last); n == 2 && last < end {
+			end = last
+		}
+		if start > end {
+			return nil, obsFakeError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		}
+		data = data[start : end+1]
+		r.StatusCode = http.StatusPartialContent
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return r, nil
+}
+
+func (f *fakeOBS) PutObject(input *obs.PutObjectInput) (*obs.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.puts++
+	f.objects[input.Key] = fakeOBSObject{data, time.Now()}
+	return &obs.PutObjectOutput{ETag: fmt.Sprintf("%q", obs.Hex(obs.Md5(data)))}, nil
+}
+
+func (f *fakeOBS) CopyObject(input *obs.CopyObjectInput) (*obs.CopyObjectOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, ok := f.objects[input.CopySourceKey]
+	if !ok {
+		return nil, obsFakeError(http.StatusNotFound, "NoSuchKey")
+	}
+	f.objects[input.Key] = fakeOBSObject{o.data, time.Now()}
+	return &obs.CopyObjectOutput{}, nil
+}
+
+func (f *fakeOBS) DeleteObject(input *obs.DeleteObjectInput) (*obs.DeleteObjectOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.objects[input.Key]; !ok {
+		return nil, obsFakeError(http.StatusNotFound, "NoSuchKey")
+	}
+	if f.undeletable[input.Key] {
+		return nil, obsFakeError(http.StatusForbidden, "AccessDenied")
+	}
+	delete(f.objects, input.Key)
+	return &obs.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeOBS) DeleteObjects(input *obs.DeleteObjectsInput) (*obs.DeleteObjectsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if len(input.Objects) > obsMaxDeletes {
+		return nil, obsFakeError(http.StatusBadRequest, "InvalidArgument")
+	}
+	f.batches++
+	r := &obs.DeleteObjectsOutput{}
+	for _, o := range input.Objects {
+		if f.undeletable[o.Key] {
+			r.Errors = append(r.Errors, obs.Error{Key: o.Key, Code: "AccessDenied", Message: "denied"})
+		} else if _, ok := f.objects[o.Key]; !ok {
+			r.Errors = append(r.Errors, obs.Error{Key: o.Key, Code: "NoSuchKey", Message: "not found"})
+		} else {
+			delete(f.objects, o.Key)
+		}
+	}
+	return r, nil
+}
+
+func (f *fakeOBS) ListObjects(input *obs.ListObjectsInput) (*obs.ListObjectsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.lists++
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, input.Prefix) && k > input.Marker {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	r := &obs.ListObjectsOutput{}
+	for _, k := range keys {
+		if len(r.Contents) == input.MaxKeys {
+			r.IsTruncated = true
+			r.NextMarker = k
+			break
+		}
+		o := f.objects[k]
+		key := k
+		if input.EncodingType == "url" {
+			key = url.QueryEscape(k)
+		}
+		r.Contents = append(r.Contents, obs.Content{Key: key, Size: int64(len(o.data)), LastModified: o.mtime})
+	}
+	return r, nil
+}
+
+func (f *fakeOBS) InitiateMultipartUpload(input *obs.InitiateMultipartUploadInput) (*obs.InitiateMultipartUploadOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.seq++
+	id := fmt.Sprintf("upload-%d", f.seq)
+	f.uploads[id] = make(map[int][]byte)
+	f.keys[id] = input.Key
+	return &obs.InitiateMultipartUploadOutput{Bucket: input.Bucket, Key: input.Key, UploadId: id}, nil
+}
+
+func (f *fakeOBS) UploadPart(input *obs.UploadPartInput) (*obs.UploadPartOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	parts, ok := f.uploads[input.UploadId]
+	if !ok {
+		return nil, obsFakeError(http.StatusNotFound, "NoSuchUpload")
+	}
+	parts[input.PartNumber] = data
+	return &obs.UploadPartOutput{PartNumber: input.PartNumber, ETag: fmt.Sprintf("%q", obs.Hex(obs.Md5(data)))}, nil
+}
+
+func (f *fakeOBS) AbortMultipartUpload(input *obs.AbortMultipartUploadInput) (*obs.BaseModel, error) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.uploads, input.UploadId)
+	return &obs.BaseModel{}, nil
+}
+
+func (f *fakeOBS) CompleteMultipartUpload(input *obs.CompleteMultipartUploadInput) (*obs.CompleteMultipartUploadOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	parts, ok := f.uploads[input.UploadId]
+	if !ok {
+		return nil, obsFakeError(http.StatusNotFound, "NoSuchUpload")
+	}
+	var data []byte
+	for _, p := range input.Parts {
+		d := parts[p.PartNumber]
+		if strings.Trim(p.ETag, "\"") != obs.Hex(obs.Md5(d)) {
+			return nil, obsFakeError(http.StatusBadRequest, "InvalidPart")
+		}
+		data = append(data, d...)
+	}
+	delete(f.uploads, input.UploadId)
+	f.objects[input.Key] = fakeOBSObject{data, time.Now()}
+	return &obs.CompleteMultipartUploadOutput{Bucket: input.Bucket, Key: input.Key}, nil
+}
+
+func (f *fakeOBS) ListMultipartUploads(input *obs.ListMultipartUploadsInput) (*obs.ListMultipartUploadsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	r := &obs.ListMultipartUploadsOutput{Bucket: input.Bucket}
+	for id := range f.uploads {
+		r.Uploads = append(r.Uploads, obs.Upload{Key: f.keys[id], UploadId: id})
+	}
+	return r, nil
+}
+
+func newTestOBS(f *fakeOBS) *obsClient {
+	return &obsClient{bucket: "jfs", region: obsDefaultRegion, checkEtag: true, c: f, partSize: 128 << 20}
+}
+
+func TestOBSFake(t *testing.T) {
+	testStorage(t, newTestOBS(newFakeOBS()))
+}
+
+func TestOBSPutMultipart(t *testing.T) {
+	f := newFakeOBS()
+	s := newTestOBS(f)
+	s.partSize = 10
+	data := []byte(strings.Repeat("0123456789", 3) + "abc")
+	if err := s.Put("large", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if f.puts != 0 || len(f.uploads) != 0 {
+		t.Fatalf("expect a completed multipart upload, but got %d puts and %d uploads", f.puts, len(f.uploads))
+	}
+	if d, err := get(s, "large", 0, -1); err != nil || d != string(data) {
+		t.Fatalf("expect %q, but got %q: %v", data, d, err)
+	}
+	if d, err := get(s, "large", 28, 4); err != nil || d != "89ab" {
+		t.Fatalf("expect 89ab, but got %q: %v", d, err)
+	}
+	if err := s.Copy("copied", "large"); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if err := s.Copy("copied", "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("copy of missing object: %v", err)
+	}
+	if _, err := s.Get("missing", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get of missing object: %v", err)
+	}
+	if _, err := s.Head("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head of missing object: %v", err)
+	}
+	if err := s.Delete("missing"); err != nil {
+		t.Fatalf("delete of missing object: %v", err)
+	}
+}
+
+func TestOBSList(t *testing.T) {
+	f := newFakeOBS()
+	s := newTestOBS(f)
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("chunks/%05d", i))
+		f.objects[keys[i]] = fakeOBSObject{[]byte("data"), time.Now()}
+	}
+	// encoded in the listing
+	keys = append(keys, "chunks/x y+z")
+	f.objects["chunks/x y+z"] = fakeOBSObject{[]byte("data"), time.Now()}
+	ch, err := ListAll(s, "chunks/", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %d keys, but got %d", len(keys), len(got))
+	}
+	// 3 pages of 1000 keys, and an empty one
+	if f.lists != 4 {
+		t.Fatalf("expect 4 list requests, but got %d", f.lists)
+	}
+
+	f.undeletable[keys[1]] = true
+	err = s.DeleteMulti(append(keys, "missing"))
+	var e *BulkError
+	if !errors.As(err, &e) || len(e.Errors) != 1 || e.Errors[keys[1]] == nil {
+		t.Fatalf("expect %s failed to delete, but got %v", keys[1], err)
+	}
+	if f.batches != 3 || len(f.objects) != 1 {
+		t.Fatalf("expect 3 batches leaving 1 object, but got %d and %d", f.batches, len(f.objects))
+	}
+
+	// the bulk deletes through a prefix are in batches too
+	for i := 0; i < 1500; i++ {
+		f.objects[keys[i]] = fakeOBSObject{[]byte("data"), time.Now()}
+	}
+	f.batches = 0
+	err = DeleteAll(WithPrefix(s, "chunks/"), "", BulkDefault)
+	if !errors.As(err, &e) || len(e.Errors) != 1 || e.Errors["00001"] == nil {
+		t.Fatalf("expect 00001 failed to delete, but got %v", err)
+	}
+	if f.batches != 2 || len(f.objects) != 1 {
+		t.Fatalf("expect 2 batches leaving 1 object, but got %d and %d", f.batches, len(f.objects))
+	}
+}
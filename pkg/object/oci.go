@@ -0,0 +1,492 @@
+//go:build !nooci
+// +build !nooci
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/common/auth"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+)
+
+const (
+	ociMaxParts    = 10000
+	ociMinPartSize = 5 << 20
+)
+
+// ociAPI is the part of the OCI object storage client used by ociStore.
+type ociAPI interface {
+	GetNamespace(ctx context.Context, request objectstorage.GetNamespaceRequest) (objectstorage.GetNamespaceResponse, error)
+	CreateBucket(ctx context.Context, request objectstorage.CreateBucketRequest) (objectstorage.CreateBucketResponse, error)
+	HeadObject(ctx context.Context, request objectstorage.HeadObjectRequest) (objectstorage.HeadObjectResponse, error)
+	GetObject(ctx context.Context, request objectstorage.GetObjectRequest) (objectstorage.GetObjectResponse, error)
+	PutObject(ctx context.Context, request objectstorage.PutObjectRequest) (objectstorage.PutObjectResponse, error)
+	DeleteObject(ctx context.Context, request objectstorage.DeleteObjectRequest) (objectstorage.DeleteObjectResponse, error)
+	ListObjects(ctx context.Context, request objectstorage.ListObjectsRequest) (objectstorage.ListObjectsResponse, error)
+	CopyObject(ctx context.Context, request objectstorage.CopyObjectRequest) (objectstorage.CopyObjectResponse, error)
+	GetWorkRequest(ctx context.Context, request objectstorage.GetWorkRequestRequest) (objectstorage.GetWorkRequestResponse, error)
+	CreateMultipartUpload(ctx context.Context, request objectstorage.CreateMultipartUploadRequest) (objectstorage.CreateMultipartUploadResponse, error)
+	UploadPart(ctx context.Context, request objectstorage.UploadPartRequest) (objectstorage.UploadPartResponse, error)
+	CommitMultipartUpload(ctx context.Context, request objectstorage.CommitMultipartUploadRequest) (objectstorage.CommitMultipartUploadResponse, error)
+	AbortMultipartUpload(ctx context.Context, request objectstorage.AbortMultipartUploadRequest) (objectstorage.AbortMultipartUploadResponse, error)
+	ListMultipartUploads(ctx context.Context, request objectstorage.ListMultipartUploadsRequest) (objectstorage.ListMultipartUploadsResponse, error)
+}
+
+type ociStore struct {
+	DefaultObjectStorage
+	c           ociAPI
+	region      string
+	namespace   string
+	bucket      string
+	compartment string
+	// objects larger than partSize are uploaded part by part
+	partSize int64
+	// interval to poll the work request of an asynchronous copy
+	pollInterval time.Duration
+	// the longest wait for the work request of a copy, the copy-timeout option
+	copyTimeout time.Duration
+	// parallel deletes of DeleteMulti, the delete-concurrency option
+	deletes int
+}
+
+func (s *ociStore) String() string {
+	return fmt.Sprintf("oci://%s/%s/", s.namespace, s.bucket)
+}
+
+func ociError(err error) error {
+	if e, ok := common.IsServiceError(err); ok && e.GetHTTPStatusCode() == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (s *ociStore) Create() error {
+	_, err := s.c.CreateBucket(ctx, objectstorage.CreateBucketRequest{
+		NamespaceName: &s.namespace,
+		CreateBucketDetails: objectstorage.CreateBucketDetails{
+			Name:          &s.bucket,
+			CompartmentId: &s.compartment,
+		},
+	})
+	if e, ok := common.IsServiceError(err); ok && e.GetHTTPStatusCode() == http.StatusConflict {
+		err = nil
+	}
+	return err
+}
+
+func (s *ociStore) Head(key string) (Object, error) {
+	r, err := s.c.HeadObject(ctx, objectstorage.HeadObjectRequest{
+		NamespaceName: &s.namespace,
+		BucketName:    &s.bucket,
+		ObjectName:    &key,
+	})
+	if err != nil {
+		return nil, ociError(err)
+	}
+	var size int64
+	if r.ContentLength != nil {
+		size = *r.ContentLength
+	}
+	var mtime time.Time
+	if r.LastModified != nil {
+		mtime = r.LastModified.Time
+	}
+	return &obj{key, size, mtime, strings.HasSuffix(key, "/")}, nil
+}
+
+func (s *ociStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	req := objectstorage.GetObjectRequest{
+		NamespaceName: &s.namespace,
+		BucketName:    &s.bucket,
+		ObjectName:    &key,
+	}
+	if limit > 0 {
+		req.Range = common.String(fmt.Sprintf("bytes=%d-%d", off, off+limit-1))
+	} else if off > 0 {
+		req.Range = common.String(fmt.Sprintf("bytes=%d-", off))
+	}
+	r, err := s.c.GetObject(ctx, req)
+	if err != nil {
+		return nil, ociError(err)
+	}
+	return r.Content, nil
+}
+
+func (s *ociStore) Put(key string, in io.Reader) error {
+	body, vlen, err := findLen(in)
+	if err != nil {
+		return err
+	}
+	if vlen > s.partSize {
+		return s.putMultipart(key, body, vlen)
+	}
+	_, err = s.c.PutObject(ctx, objectstorage.PutObjectRequest{
+		NamespaceName: &s.namespace,
+		BucketName:    &s.bucket,
+		ObjectName:    &key,
+		ContentLength: &vlen,
+		PutObjectBody: ioutil.NopCloser(body),
+	})
+	return err
+}
+
+func (s *ociStore) putMultipart(key string, in io.Reader, size int64) error {
+	partSize := s.partSize
+	if n := (size + partSize - 1) / partSize; n > ociMaxParts {
+		partSize = (size + ociMaxParts - 1) / ociMaxParts
+	}
+	upload, err := s.CreateMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+	var parts []*Part
+	buf := make([]byte, partSize)
+	for num := 1; size > 0; num++ {
+		n := partSize
+		if size < n {
+			n = size
+		}
+		if _, err = io.ReadFull(in, buf[:n]); err != nil {
+			break
+		}
+		var part *Part
+		if part, err = s.UploadPart(key, upload.UploadID, num, buf[:n]); err != nil {
+			break
+		}
+		parts = append(parts, part)
+		size -= n
+	}
+	if err == nil {
+		err = s.CompleteUpload(key, upload.UploadID, parts)
+	}
+	if err != nil {
+		s.AbortUpload(key, upload.UploadID)
+	}
+	return err
+}
+
+// Copy copies an object inside the bucket. The copy is asynchronous in OCI,
+// so it waits for the work request to finish, but at most copyTimeout, then
+// it fails with the last status of the request.
+func (s *ociStore) Copy(dst, src string) error {
+	r, err := s.c.CopyObject(ctx, objectstorage.CopyObjectRequest{
+		NamespaceName: &s.namespace,
+		BucketName:    &s.bucket,
+		CopyObjectDetails: objectstorage.CopyObjectDetails{
+			SourceObjectName:      &src,
+			DestinationRegion:     &s.region,
+			DestinationNamespace:  &s.namespace,
+			DestinationBucket:     &s.bucket,
+			DestinationObjectName: &dst,
+		},
+	})
+	if err != nil {
+		return ociError(err)
+	}
+	if r.OpcWorkRequestId == nil {
+		return nil
+	}
+	wctx, cancel := context.WithTimeout(ctx, s.copyTimeout)
+	defer cancel()
+	status := objectstorage.WorkRequestStatusAccepted
+	for wctx.Err() == nil {
+		w, err := s.c.GetWorkRequest(wctx, objectstorage.GetWorkRequestRequest{WorkRequestId: r.OpcWorkRequestId})
+		if err != nil {
+			if wctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		switch status = w.Status; status {
+		case objectstorage.WorkRequestStatusCompleted:
+			return nil
+		case objectstorage.WorkRequestStatusFailed, objectstorage.WorkRequestStatusCanceled:
+			return fmt.Errorf("copy %s to %s: work request %s is %s", src, dst, *r.OpcWorkRequestId, status)
+		}
+		select {
+		case <-time.After(s.pollInterval):
+		case <-wctx.Done():
+		}
+	}
+	return fmt.Errorf("copy %s to %s: work request %s is still %s after %s", src, dst, *r.OpcWorkRequestId, status, s.copyTimeout)
+}
+
+func (s *ociStore) Delete(key string) error {
+	_, err := s.c.DeleteObject(ctx, objectstorage.DeleteObjectRequest{
+		NamespaceName: &s.namespace,
+		BucketName:    &s.bucket,
+		ObjectName:    &key,
+	})
+	if err = ociError(err); os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// DeleteMulti deletes the keys by DeleteConcurrency deletes in parallel,
+// since OCI has no batch API for deletion. The keys are retried as
+// BulkRetryDeadline, and the failed ones are returned as a BulkError.
+func (s *ociStore) DeleteMulti(keys []string) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	b := newBulkRunner(s, "delete", BulkBestEffort)
+	sem := make(chan struct{}, deleteConcurrency(s))
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer func() { <-sem; wg.Done() }()
+			err := b.attempt(key, s.Delete)
+			mu.Lock()
+			_, _ = b.record(key, err)
+			mu.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	return b.result()
+}
+
+// DeleteConcurrency is the number of parallel deletes, set by the
+// delete-concurrency option.
+func (s *ociStore) DeleteConcurrency() int {
+	return s.deletes
+}
+
+func (s *ociStore) List(prefix, marker string, limit int64) ([]Object, error) {
+	if limit > 1000 {
+		limit = 1000
+	}
+	req := objectstorage.ListObjectsRequest{
+		NamespaceName: &s.namespace,
+		BucketName:    &s.bucket,
+		Prefix:        &prefix,
+		Limit:         common.Int(int(limit)),
+		Fields:        common.String("name,size,timeModified"),
+	}
+	if marker != "" {
+		req.StartAfter = &marker
+	}
+	r, err := s.c.ListObjects(ctx, req)
+	if err != nil {
+		return nil, ociError(err)
+	}
+	objs := make([]Object, len(r.Objects))
+	for i, o := range r.Objects {
+		var size int64
+		if o.Size != nil {
+			size = *o.Size
+		}
+		var mtime time.Time
+		if o.TimeModified != nil {
+			mtime = o.TimeModified.Time
+		}
+		objs[i] = &obj{*o.Name, size, mtime, strings.HasSuffix(*o.Name, "/")}
+	}
+	return objs, nil
+}
+
+func (s *ociStore) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	r, err := s.c.CreateMultipartUpload(ctx, objectstorage.CreateMultipartUploadRequest{
+		NamespaceName:                &s.namespace,
+		BucketName:                   &s.bucket,
+		CreateMultipartUploadDetails: objectstorage.CreateMultipartUploadDetails{Object: &key},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MultipartUpload{UploadID: *r.UploadId, MinPartSize: ociMinPartSize, MaxCount: ociMaxParts}, nil
+}
+
+func (s *ociStore) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	r, err := s.c.UploadPart(ctx, objectstorage.UploadPartRequest{
+		NamespaceName:  &s.namespace,
+		BucketName:     &s.bucket,
+		ObjectName:     &key,
+		UploadId:       &uploadID,
+		UploadPartNum:  &num,
+		ContentLength:  common.Int64(int64(len(body))),
+		UploadPartBody: ioutil.NopCloser(bytes.NewReader(body)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Part{Num: num, Size: len(body), ETag: *r.ETag}, nil
+}
+
+func (s *ociStore) AbortUpload(key string, uploadID string) {
+	_, _ = s.c.AbortMultipartUpload(ctx, objectstorage.AbortMultipartUploadRequest{
+		NamespaceName: &s.namespace,
+		BucketName:    &s.bucket,
+		ObjectName:    &key,
+		UploadId:      &uploadID,
+	})
+}
+
+func (s *ociStore) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	details := make([]objectstorage.CommitMultipartUploadPartDetails, len(parts))
+	for i := range parts {
+		details[i] = objectstorage.CommitMultipartUploadPartDetails{
+			PartNum: &parts[i].Num,
+			Etag:    &parts[i].ETag,
+		}
+	}
+	_, err := s.c.CommitMultipartUpload(ctx, objectstorage.CommitMultipartUploadRequest{
+		NamespaceName:                &s.namespace,
+		BucketName:                   &s.bucket,
+		ObjectName:                   &key,
+		UploadId:                     &uploadID,
+		CommitMultipartUploadDetails: objectstorage.CommitMultipartUploadDetails{PartsToCommit: details},
+	})
+	return err
+}
+
+func (s *ociStore) ListUploads(marker string) ([]*PendingPart, string, error) {
+	req := objectstorage.ListMultipartUploadsRequest{
+		NamespaceName: &s.namespace,
+		BucketName:    &s.bucket,
+		Limit:         common.Int(1000),
+	}
+	if marker != "" {
+		req.Page = &marker
+	}
+	r, err := s.c.ListMultipartUploads(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	parts := make([]*PendingPart, len(r.Items))
+	for i, u := range r.Items {
+		var created time.Time
+		if u.TimeCreated != nil {
+			created = u.TimeCreated.Time
+		}
+		parts[i] = &PendingPart{*u.Object, *u.UploadId, created}
+	}
+	var next string
+	if r.OpcNextPage != nil {
+		next = *r.OpcNextPage
+	}
+	return parts, next, nil
+}
+
+// parseOCIEndpoint parses the native endpoint of OCI object storage:
+// [https://]objectstorage.<region>.oraclecloud.com/n/<namespace>/b/<bucket>,
+// or only the name of a bucket, whose region and namespace come from the
+// configuration of the credentials.
+func parseOCIEndpoint(endpoint string) (region, namespace, bucket string, query url.Values, err error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	uri, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return "", "", "", nil, fmt.Errorf("Invalid endpoint: %v, error: %v", endpoint, err)
+	}
+	query = uri.Query()
+	if !strings.HasPrefix(uri.Host, "objectstorage.") {
+		return "", "", uri.Host, query, nil
+	}
+	region = strings.SplitN(strings.TrimPrefix(uri.Host, "objectstorage."), ".", 2)[0]
+	ps := strings.Split(strings.Trim(uri.Path, "/"), "/")
+	if len(ps) != 4 || ps[0] != "n" || ps[2] != "b" {
+		return "", "", "", nil, fmt.Errorf("Invalid endpoint %s: expect objectstorage.<region>.oraclecloud.com/n/<namespace>/b/<bucket>", endpoint)
+	}
+	return region, ps[1], ps[3], query, nil
+}
+
+func newOCI(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	region, namespace, bucket, query, err := parseOCIEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	copyTimeout, deletes := 10*time.Minute, defaultDeleteConcurrency
+	if v := query.Get("copy-timeout"); v != "" {
+		if copyTimeout, err = time.ParseDuration(v); err != nil || copyTimeout <= 0 {
+			return nil, fmt.Errorf("invalid copy-timeout of oci: %s", v)
+		}
+	}
+	if v := query.Get("delete-concurrency"); v != "" {
+		if deletes, err = strconv.Atoi(v); err != nil || deletes <= 0 {
+			return nil, fmt.Errorf("invalid delete-concurrency of oci: %s", v)
+		}
+	}
+	var provider common.ConfigurationProvider
+	switch query.Get("auth") {
+	case "instance_principal":
+		if provider, err = auth.InstancePrincipalConfigurationProvider(); err != nil {
+			return nil, fmt.Errorf("instance principal: %s", err)
+		}
+	case "", "config":
+		if profile := query.Get("profile"); profile != "" {
+			provider = common.CustomProfileConfigProvider("", profile)
+		} else {
+			provider = common.DefaultConfigProvider()
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth of oci: %s", query.Get("auth"))
+	}
+	client, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	if region == "" {
+		if region, err = provider.Region(); err != nil {
+			return nil, fmt.Errorf("region of oci: %s", err)
+		}
+	}
+	client.SetRegion(region)
+	if namespace == "" {
+		r, err := client.GetNamespace(ctx, objectstorage.GetNamespaceRequest{})
+		if err != nil {
+			return nil, fmt.Errorf("get namespace: %s", err)
+		}
+		namespace = *r.Value
+	}
+	compartment := os.Getenv("OCI_COMPARTMENT_ID")
+	if compartment == "" {
+		// the root compartment
+		compartment, _ = provider.TenancyOCID()
+	}
+	return &ociStore{
+		c:            client,
+		region:       region,
+		namespace:    namespace,
+		bucket:       bucket,
+		compartment:  compartment,
+		partSize:     128 << 20,
+		pollInterval: time.Second,
+		copyTimeout:  copyTimeout,
+		deletes:      deletes,
+	}, nil
+}
+
+func init() {
+	Register("oci", newOCI)
+}
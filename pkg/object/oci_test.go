@@ -0,0 +1,360 @@
+//go:build !nooci
+// +build !nooci
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+)
+
+type ociServiceError struct{ status int }
+
+func (e ociServiceError) Error() string           { return fmt.Sprintf("status %d", e.status) }
+func (e ociServiceError) GetHTTPStatusCode() int  { return e.status }
+func (e ociServiceError) GetMessage() string      { return http.StatusText(e.status) }
+func (e ociServiceError) GetCode() string         { return strconv.Itoa(e.status) }
+func (e ociServiceError) GetOpcRequestID() string { return "" }
+
+type fakeOCIObject struct {
+	data  []byte
+	mtime time.Time
+}
+
+// fakeOCI is an in-memory OCI object storage, the copies finish after
+// being polled copyPolls times.
+type fakeOCI struct {
+	sync.Mutex
+	objects   map[string]fakeOCIObject
+	uploads   map[string]map[int][]byte
+	keys      map[string]string
+	copies    map[string]*fakeOCICopy
+	copyPolls int
+	copyFail  bool
+	puts      int
+	seq       int
+}
+
+type fakeOCICopy struct {
+	src, dst string
+	polls    int
+	status   objectstorage.WorkRequestStatusEnum
+}
+
+func newFakeOCI() *fakeOCI {
+	return &fakeOCI{
+		objects: make(map[string]fakeOCIObject),
+		uploads: make(map[string]map[int][]byte),
+		keys:    make(map[string]string),
+		copies:  make(map[string]*fakeOCICopy),
+	}
+}
+
+var errOCINotFound = ociServiceError{http.StatusNotFound}
+
+func (f *fakeOCI) GetNamespace(ctx context.Context, request objectstorage.GetNamespaceRequest) (objectstorage.GetNamespaceResponse, error) {
+	return objectstorage.GetNamespaceResponse{Value: common.String("ns")}, nil
+}
+
+func (f *fakeOCI) CreateBucket(ctx context.Context, request objectstorage.CreateBucketRequest) (objectstorage.CreateBucketResponse, error) {
+	return objectstorage.CreateBucketResponse{}, ociServiceError{http.StatusConflict}
+}
+
+func (f *fakeOCI) HeadObject(ctx context.Context, request objectstorage.HeadObjectRequest) (objectstorage.HeadObjectResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, ok := f.objects[*request.ObjectName]
+	if !ok {
+		return objectstorage.HeadObjectResponse{}, errOCINotFound
+	}
+	return objectstorage.HeadObjectResponse{
+		ContentLength: common.Int64(int64(len(o.data))),
+		LastModified:  &common.SDKTime{Time: o.mtime},
+	}, nil
+}
+
+func (f *fakeOCI) GetObject(ctx context.Context, request objectstorage.GetObjectRequest) (objectstorage.GetObjectResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, ok := f.objects[*request.ObjectName]
+	if !ok {
+		return objectstorage.GetObjectResponse{}, errOCINotFound
+	}
+	data := o.data
+	if request.Range != nil {
+		var start, end int
+		rs := strings.Split(strings.TrimPrefix(*request.Range, "bytes="), "-")
+		start, _ = strconv.Atoi(rs[0])
+		end = len(data) - 1
+		if rs[1] != "" {
+			end, _ = strconv.Atoi(rs[1])
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		if start > end {
+			return objectstorage.GetObjectResponse{}, ociServiceError{http.StatusRequestedRangeNotSatisfiable}
+		}
+		data = data[start : end+1]
+	}
+	return objectstorage.GetObjectResponse{Content: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeOCI) PutObject(ctx context.Context, request objectstorage.PutObjectRequest) (objectstorage.PutObjectResponse, error) {
+	data, err := ioutil.ReadAll(request.PutObjectBody)
+	if err != nil {
+		return objectstorage.PutObjectResponse{}, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.puts++
+	f.objects[*request.ObjectName] = fakeOCIObject{data, time.Now()}
+	return objectstorage.PutObjectResponse{}, nil
+}
+
+func (f *fakeOCI) DeleteObject(ctx context.Context, request objectstorage.DeleteObjectRequest) (objectstorage.DeleteObjectResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.objects[*request.ObjectName]; !ok {
+		return objectstorage.DeleteObjectResponse{}, errOCINotFound
+	}
+	delete(f.objects, *request.ObjectName)
+	return objectstorage.DeleteObjectResponse{}, nil
+}
+
+func (f *fakeOCI) ListObjects(ctx context.Context, request objectstorage.ListObjectsRequest) (objectstorage.ListObjectsResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, *request.Prefix) && (request.StartAfter == nil || k > *request.StartAfter) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var r objectstorage.ListObjectsResponse
+	for _, k := range keys {
+		if len(r.Objects) == *request.Limit {
+			r.NextStartWith = common.String(k)
+			break
+		}
+		o := f.objects[k]
+		r.Objects = append(r.Objects, objectstorage.ObjectSummary{
+			Name:         common.String(k),
+			Size:         common.Int64(int64(len(o.data))),
+			TimeModified: &common.SDKTime{Time: o.mtime},
+		})
+	}
+	return r, nil
+}
+
+func (f *fakeOCI) CopyObject(ctx context.Context, request objectstorage.CopyObjectRequest) (objectstorage.CopyObjectResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.objects[*request.SourceObjectName]; !ok {
+		return objectstorage.CopyObjectResponse{}, errOCINotFound
+	}
+	f.seq++
+	id := fmt.Sprintf("wr-%d", f.seq)
+	f.copies[id] = &fakeOCICopy{src: *request.SourceObjectName, dst: *request.DestinationObjectName, status: objectstorage.WorkRequestStatusAccepted}
+	return objectstorage.CopyObjectResponse{OpcWorkRequestId: &id}, nil
+}
+
+func (f *fakeOCI) GetWorkRequest(ctx context.Context, request objectstorage.GetWorkRequestRequest) (objectstorage.GetWorkRequestResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	c, ok := f.copies[*request.WorkRequestId]
+	if !ok {
+		return objectstorage.GetWorkRequestResponse{}, errOCINotFound
+	}
+	c.polls++
+	if c.status != objectstorage.WorkRequestStatusCompleted && c.status != objectstorage.WorkRequestStatusFailed {
+		if c.polls < f.copyPolls {
+			c.status = objectstorage.WorkRequestStatusInProgress
+		} else if f.copyFail {
+			c.status = objectstorage.WorkRequestStatusFailed
+		} else {
+			c.status = objectstorage.WorkRequestStatusCompleted
+			f.objects[c.dst] = f.objects[c.src]
+		}
+	}
+	var r objectstorage.GetWorkRequestResponse
+	r.Id = request.WorkRequestId
+	r.Status = c.status
+	return r, nil
+}
+
+func (f *fakeOCI) CreateMultipartUpload(ctx context.Context, request objectstorage.CreateMultipartUploadRequest) (objectstorage.CreateMultipartUploadResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.seq++
+	id := fmt.Sprintf("upload-%d", f.seq)
+	f.uploads[id] = make(map[int][]byte)
+	f.keys[id] = *request.Object
+	var r objectstorage.CreateMultipartUploadResponse
+	r.Object = request.Object
+	r.UploadId = &id
+	return r, nil
+}
+
+func (f *fakeOCI) UploadPart(ctx context.Context, request objectstorage.UploadPartRequest) (objectstorage.UploadPartResponse, error) {
+	data, err := ioutil.ReadAll(request.UploadPartBody)
+	if err != nil {
+		return objectstorage.UploadPartResponse{}, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	parts, ok := f.uploads[*request.UploadId]
+	if !ok {
+		return objectstorage.UploadPartResponse{}, errOCINotFound
+	}
+	parts[*request.UploadPartNum] = data
+	return objectstorage.UploadPartResponse{ETag: common.String(fmt.Sprintf("etag-%d-%d", *request.UploadPartNum, len(data)))}, nil
+}
+
+func (f *fakeOCI) CommitMultipartUpload(ctx context.Context, request objectstorage.CommitMultipartUploadRequest) (objectstorage.CommitMultipartUploadResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	parts, ok := f.uploads[*request.UploadId]
+	if !ok {
+		return objectstorage.CommitMultipartUploadResponse{}, errOCINotFound
+	}
+	var data []byte
+	for _, p := range request.PartsToCommit {
+		d := parts[*p.PartNum]
+		if *p.Etag != fmt.Sprintf("etag-%d-%d", *p.PartNum, len(d)) {
+			return objectstorage.CommitMultipartUploadResponse{}, ociServiceError{http.StatusBadRequest}
+		}
+		data = append(data, d...)
+	}
+	delete(f.uploads, *request.UploadId)
+	f.objects[*request.ObjectName] = fakeOCIObject{data, time.Now()}
+	return objectstorage.CommitMultipartUploadResponse{}, nil
+}
+
+func (f *fakeOCI) AbortMultipartUpload(ctx context.Context, request objectstorage.AbortMultipartUploadRequest) (objectstorage.AbortMultipartUploadResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.uploads, *request.UploadId)
+	return objectstorage.AbortMultipartUploadResponse{}, nil
+}
+
+func (f *fakeOCI) ListMultipartUploads(ctx context.Context, request objectstorage.ListMultipartUploadsRequest) (objectstorage.ListMultipartUploadsResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	var r objectstorage.ListMultipartUploadsResponse
+	for id := range f.uploads {
+		id := id
+		r.Items = append(r.Items, objectstorage.MultipartUpload{Object: common.String(f.keys[id]), UploadId: &id})
+	}
+	return r, nil
+}
+
+func newTestOCI(f *fakeOCI) *ociStore {
+	return &ociStore{c: f, region: "us-ashburn-1", namespace: "ns", bucket: "jfs", partSize: 128 << 20, pollInterval: time.Millisecond, copyTimeout: time.Minute}
+}
+
+func TestOCI(t *testing.T) {
+	testStorage(t, newTestOCI(newFakeOCI()))
+}
+
+func TestOCICopy(t *testing.T) {
+	f := newFakeOCI()
+	f.copyPolls = 3
+	s := newTestOCI(f)
+	if err := s.Put("src", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err := s.Copy("dst", "src"); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if c := f.copies["wr-1"]; c.polls != 3 {
+		t.Fatalf("expect 3 polls of the work request, but got %d", c.polls)
+	}
+	if d, err := get(s, "dst", 0, -1); err != nil || d != "hello" {
+		t.Fatalf("expect hello, but got %q: %v", d, err)
+	}
+
+	f.copyFail = true
+	if err := s.Copy("dst2", "src"); err == nil || !strings.Contains(err.Error(), "FAILED") {
+		t.Fatalf("expect failed copy, but got %v", err)
+	}
+	if _, err := s.Head("dst2"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("dst2 should not exist: %v", err)
+	}
+	if err := s.Copy("dst3", "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("copy of missing object: %v", err)
+	}
+
+	f.copyFail = false
+	f.copyPolls = 1 << 30
+	s.copyTimeout = 20 * time.Millisecond
+	if err := s.Copy("dst4", "src"); err == nil || !strings.Contains(err.Error(), "still IN_PROGRESS") {
+		t.Fatalf("expect the copy timed out, but got %v", err)
+	}
+}
+
+func TestOCIPutMultipart(t *testing.T) {
+	f := newFakeOCI()
+	s := newTestOCI(f)
+	s.partSize = 10
+	data := []byte(strings.Repeat("0123456789", 3) + "abc")
+	if err := s.Put("large", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if f.puts != 0 || len(f.uploads) != 0 {
+		t.Fatalf("expect a committed multipart upload, but got %d puts and %d uploads", f.puts, len(f.uploads))
+	}
+	if d, err := get(s, "large", 0, -1); err != nil || d != string(data) {
+		t.Fatalf("expect %q, but got %q: %v", data, d, err)
+	}
+	if err := s.DeleteMulti([]string{"large", "missing"}); err != nil {
+		t.Fatalf("delete multi: %s", err)
+	}
+	if _, err := s.Head("large"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("large should be deleted: %v", err)
+	}
+}
+
+func TestOCIEndpoint(t *testing.T) {
+	region, ns, bucket, q, err := parseOCIEndpoint("https://objectstorage.us-ashburn-1.oraclecloud.com/n/myns/b/jfs?auth=instance_principal")
+	if err != nil || region != "us-ashburn-1" || ns != "myns" || bucket != "jfs" || q.Get("auth") != "instance_principal" {
+		t.Fatalf("parse endpoint: %s %s %s %v %v", region, ns, bucket, q, err)
+	}
+	if region, ns, bucket, _, err = parseOCIEndpoint("jfs"); err != nil || region != "" || ns != "" || bucket != "jfs" {
+		t.Fatalf("parse bucket: %s %s %s %v", region, ns, bucket, err)
+	}
+	if _, _, _, _, err = parseOCIEndpoint("objectstorage.us-ashburn-1.oraclecloud.com/jfs"); err == nil {
+		t.Fatalf("endpoint without namespace should be invalid")
+	}
+}
@@ -0,0 +1,501 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	graphAPI   = "https://graph.microsoft.com/v1.0"
+	graphOAuth = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+	graphScope = "Files.ReadWrite.All offline_access"
+	// Graph accepts simple uploads of files up to 4 MiB
+	onedriveChunkedThreshold = 4 << 20
+	// the fragments of an upload session must be multiples of 320 KiB
+	onedriveChunkSize = 32 * 320 << 10
+	onedriveTokenFile = "onedrive_refresh_token"
+)
+
+type graphError struct {
+	Status int    `json:"-"`
+	Code   string `json:"code"`
+	Msg    string `json:"message"`
+}
+
+func (e *graphError) Error() string {
+	return fmt.Sprintf("onedrive: %d %s: %s", e.Status, e.Code, e.Msg)
+}
+
+// checkGraphResponse returns the error in the response, itemNotFound is
+// reported as os.ErrNotExist.
+func checkGraphResponse(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Error graphError `json:"error"`
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	_ = json.Unmarshal(data, &body)
+	e := &body.Error
+	e.Status = resp.StatusCode
+	if e.Code == "itemNotFound" || resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", e, os.ErrNotExist)
+	}
+	return e
+}
+
+type driveItem struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModifiedDateTime"`
+	Folder       *struct{} `json:"folder,omitempty"`
+}
+
+const driveItemFields = "id,name,size,lastModifiedDateTime,folder"
+
+type onedriveStorage struct {
+	DefaultObjectStorage
+	client      *http.Client
+	auth        *oauthToken
+	apiURL      string
+	drive       string
+	workdir     string
+	rootID      string
+	nodeIDCache sync.Map
+	walker      *treeWalker
+	// files not smaller than this are uploaded with an upload session
+	chunkedThreshold int64
+	chunkSize        int64
+}
+
+func (s *onedriveStorage) String() string {
+	return fmt.Sprintf("onedrive://%s/%s", s.drive, s.workdir)
+}
+
+// driveURL returns the url of the drive, `me` is the OneDrive of the user.
+func (s *onedriveStorage) driveURL() string {
+	if s.drive == "me" {
+		return s.apiURL + "/me/drive"
+	}
+	return s.apiURL + "/drives/" + s.drive
+}
+
+// request sends an authorized request to Graph, the access token is
+// refreshed and the request is retried once when it's rejected as
+// unauthorized.
+func (s *onedriveStorage) request(ctx context.Context, method, u string, header http.Header, body []byte) (*http.Response, error) {
+	for i := 0; ; i++ {
+		token, err := s.auth.token(ctx, s.client, i > 0)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && i == 0 && s.auth.clientID != "" {
+			_ = resp.Body.Close()
+			continue
+		}
+		if err = checkGraphResponse(resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+func (s *onedriveStorage) call(method, u string, request, response interface{}) error {
+	var body []byte
+	header := http.Header{}
+	if request != nil {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return err
+		}
+		header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.request(ctx, method, u, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
+
+func (s *onedriveStorage) itemURL(id string) string {
+	return s.driveURL() + "/items/" + id
+}
+
+// childURL addresses the child of a folder by name.
+func (s *onedriveStorage) childURL(parent, name string) string {
+	return s.itemURL(parent) + ":/" + url.PathEscape(name) + ":"
+}
+
+func (s *onedriveStorage) listFolder(ctx context.Context, id string) ([]driveItem, error) {
+	var items []driveItem
+	u := fmt.Sprintf("%s/children?$top=1000&$select=%s", s.itemURL(id), driveItemFields)
+	for u != "" {
+		var page struct {
+			Value    []driveItem `json:"value"`
+			NextLink string      `json:"@odata.nextLink"`
+		}
+		resp, err := s.request(ctx, http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Value...)
+		u = page.NextLink
+	}
+	return items, nil
+}
+
+func (s *onedriveStorage) listNodes(ctx context.Context, id string) ([]treeNode, error) {
+	items, err := s.listFolder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]treeNode, 0, len(items))
+	for _, i := range items {
+		nodes = append(nodes, treeNode{i.ID, i.Name, i.Folder != nil, i.Size, i.LastModified, ""})
+	}
+	return nodes, nil
+}
+
+func (s *onedriveStorage) createFolder(parent, name string) (string, error) {
+	var item driveItem
+	req := map[string]interface{}{"name": name, "folder": struct{}{}, "@microsoft.graph.conflictBehavior": "fail"}
+	err := s.call(http.MethodPost, s.itemURL(parent)+"/children", req, &item)
+	var e *graphError
+	if errors.As(err, &e) && e.Status == http.StatusConflict {
+		// created by others in the meantime
+		err = s.call(http.MethodGet, s.childURL(parent, name)+"?$select="+driveItemFields, nil, &item)
+	}
+	return item.ID, err
+}
+
+// getNode resolves a path (relative to the root of the drive) into an item
+// id, the children of the listed folders are cached along the way.
+func (s *onedriveStorage) getNode(p string, createDir bool) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return s.rootID, nil
+	}
+	if v, ok := s.nodeIDCache.Load(p); ok {
+		return v.(string), nil
+	}
+	dir, name := path.Split(p)
+	parent, err := s.getNode(dir, createDir)
+	if err != nil {
+		return "", err
+	}
+	items, err := s.listFolder(ctx, parent)
+	if err != nil {
+		return "", err
+	}
+	for _, i := range items {
+		s.nodeIDCache.Store(path.Join(dir, i.Name), i.ID)
+	}
+	if v, ok := s.nodeIDCache.Load(p); ok {
+		return v.(string), nil
+	}
+	if !createDir {
+		return "", fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	id, err := s.createFolder(parent, name)
+	if err != nil {
+		return "", err
+	}
+	s.nodeIDCache.Store(p, id)
+	return id, nil
+}
+
+func (s *onedriveStorage) path(key string) string {
+	return strings.Trim(path.Join(s.workdir, key), "/")
+}
+
+// forget drops the cached id of a path when the item is gone.
+func (s *onedriveStorage) forget(p string, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		s.nodeIDCache.Delete(p)
+	}
+	return err
+}
+
+func (s *onedriveStorage) Head(key string) (Object, error) {
+	p := s.path(key)
+	id, err := s.getNode(p, false)
+	if err != nil {
+		return nil, err
+	}
+	var item driveItem
+	if err = s.call(http.MethodGet, s.itemURL(id)+"?$select="+driveItemFields, nil, &item); err != nil {
+		return nil, s.forget(p, err)
+	}
+	return &obj{key, item.Size, item.LastModified, item.Folder != nil}, nil
+}
+
+func (s *onedriveStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	p := s.path(key)
+	id, err := s.getNode(p, false)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if limit > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+limit-1))
+	} else if off > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	// it's redirected to a pre-authenticated download url
+	resp, err := s.request(ctx, http.MethodGet, s.itemURL(id)+"/content", header, nil)
+	if err != nil {
+		return nil, s.forget(p, err)
+	}
+	return resp.Body, nil
+}
+
+func (s *onedriveStorage) uploadSimple(parent, name string, data []byte) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.request(ctx, http.MethodPut, s.childURL(parent, name)+"/content?@microsoft.graph.conflictBehavior=replace", header, data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var item driveItem
+	if err = json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return "", err
+	}
+	return item.ID, nil
+}
+
+// uploadChunked uploads a large file with an upload session, the file is
+// replaced only when the last fragment is uploaded.
+func (s *onedriveStorage) uploadChunked(parent, name string, in io.ReaderAt, size int64) (string, error) {
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	req := map[string]interface{}{"item": map[string]string{"@microsoft.graph.conflictBehavior": "replace"}}
+	if err := s.call(http.MethodPost, s.childURL(parent, name)+"/createUploadSession", req, &session); err != nil {
+		return "", err
+	}
+	// the upload url is pre-authenticated, it must not get the access token
+	abort := func() {
+		if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, session.UploadURL, nil); err == nil {
+			if resp, err := s.client.Do(req); err == nil {
+				_ = resp.Body.Close()
+			}
+		}
+	}
+
+	buf := make([]byte, s.chunkSize)
+	for off := int64(0); off < size; off += s.chunkSize {
+		n, err := in.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			abort()
+			return "", err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, session.UploadURL, bytes.NewReader(buf[:n]))
+		if err != nil {
+			abort()
+			return "", err
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+int64(n)-1, size))
+		resp, err := s.client.Do(req)
+		if err == nil {
+			err = checkGraphResponse(resp)
+		}
+		if err != nil {
+			abort()
+			return "", fmt.Errorf("upload fragment at %d: %w", off, err)
+		}
+		if off+int64(n) < size {
+			_ = resp.Body.Close()
+			continue
+		}
+		// the item is returned for the last fragment
+		var item driveItem
+		err = json.NewDecoder(resp.Body).Decode(&item)
+		_ = resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		return item.ID, nil
+	}
+	return "", errors.New("onedrive: no fragment uploaded")
+}
+
+func (s *onedriveStorage) upload(parent, name string, in io.Reader) (string, error) {
+	// the upload session needs to know the size ahead, spool large files to disk
+	data, err := ioutil.ReadAll(io.LimitReader(in, s.chunkedThreshold))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) < s.chunkedThreshold {
+		return s.uploadSimple(parent, name, data)
+	}
+	f, err := ioutil.TempFile("", "onedrive")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if _, err = f.Write(data); err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(f, in); err != nil {
+		return "", err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	return s.uploadChunked(parent, name, f, size)
+}
+
+// Put replaces the file in place, since both the simple upload and the
+// upload session are committed atomically.
+func (s *onedriveStorage) Put(key string, in io.Reader) error {
+	p := s.path(key)
+	dir, name := path.Split(p)
+	dirID, err := s.getNode(dir, true)
+	if err != nil {
+		return fmt.Errorf("get node: %w", err)
+	}
+	id, err := s.upload(dirID, name, in)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", key, s.forget(strings.Trim(dir, "/"), err))
+	}
+	s.nodeIDCache.Store(p, id)
+	return nil
+}
+
+func (s *onedriveStorage) Delete(key string) error {
+	p := s.path(key)
+	id, err := s.getNode(p, false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.nodeIDCache.Delete(p)
+	err = s.call(http.MethodDelete, s.itemURL(id), nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+func (s *onedriveStorage) ListAll(prefix, marker string) (<-chan Object, error) {
+	rootID, err := s.getNode(s.workdir, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.walker.listAll(ctx, rootID, prefix, marker), nil
+}
+
+func (s *onedriveStorage) init() error {
+	var root driveItem
+	if err := s.call(http.MethodGet, s.driveURL()+"/root?$select=id", nil, &root); err != nil {
+		return fmt.Errorf("get root of drive %s: %w", s.drive, err)
+	}
+	s.rootID = root.ID
+	if _, err := s.getNode(s.workdir, true); err != nil {
+		return err
+	}
+	s.walker = newTreeWalker(4, s.listNodes)
+	return nil
+}
+
+// newOneDrive creates a storage on OneDrive or SharePoint, the endpoint is
+// `onedrive://<drive id>/<path>` where drive id `me` is the OneDrive of the
+// signed-in user. The accessKey and secretKey are the client id and the
+// optional secret of the app registered in Azure AD, and token is the
+// refresh token, or an access token if the client id is empty.
+func newOneDrive(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	u, err := ParseEndpoint(endpoint, EndpointSpec{Scheme: "onedrive", Host: "drive id", Example: "onedrive://<drive id>/jfs"})
+	if err != nil {
+		return nil, err
+	}
+	auth := &oauthToken{service: "onedrive", oauthURL: graphOAuth, scope: graphScope, clientID: accessKey, clientSecret: secretKey}
+	if accessKey == "" {
+		auth.accessToken = token
+	} else {
+		auth.refreshToken = token
+		if data, err := os.ReadFile(onedriveTokenFile); err == nil {
+			auth.refreshToken = string(data)
+		}
+		auth.onRefresh = func(refreshToken string) {
+			if err := saveRefreshToken(onedriveTokenFile, refreshToken); err != nil {
+				logger.Errorf("Save the refresh token into %s: %s", onedriveTokenFile, err)
+			}
+		}
+	}
+	s := &onedriveStorage{
+		client:  httpClient,
+		auth:    auth,
+		apiURL:  graphAPI,
+		drive:   u.Host,
+		workdir: strings.Trim(u.Path, "/"),
+
+		chunkedThreshold: onedriveChunkedThreshold,
+		chunkSize:        onedriveChunkSize,
+	}
+	if err = s.init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func init() {
+	Register("onedrive", newOneDrive)
+}
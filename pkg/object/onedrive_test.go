@@ -0,0 +1,368 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockGraphItem struct {
+	driveItem
+	parent string
+	data   []byte
+}
+
+type mockUploadSession struct {
+	parent, name string
+	data         []byte
+}
+
+// mockGraph emulates the subset of Microsoft Graph API used by onedriveStorage.
+type mockGraph struct {
+	sync.Mutex
+	items     map[string]*mockGraphItem
+	sessions  map[string]*mockUploadSession
+	seq       int
+	pageSize  int
+	token     string
+	fragments int
+	// requests to the upload urls carrying the access token
+	leaked int
+}
+
+func newMockGraph() *mockGraph {
+	m := &mockGraph{items: make(map[string]*mockGraphItem), sessions: make(map[string]*mockUploadSession), pageSize: 2, token: "access1"}
+	m.items["root"] = &mockGraphItem{driveItem: driveItem{ID: "root", Folder: &struct{}{}}}
+	return m
+}
+
+func (m *mockGraph) child(parent, name string) *mockGraphItem {
+	for _, i := range m.items {
+		if i.parent == parent && i.Name == name {
+			return i
+		}
+	}
+	return nil
+}
+
+// put creates or replaces a file, the id is kept when it's replaced.
+func (m *mockGraph) put(parent, name string, data []byte) *mockGraphItem {
+	if i := m.child(parent, name); i != nil {
+		i.data, i.Size, i.LastModified = data, int64(len(data)), time.Now()
+		return i
+	}
+	return m.add(parent, name, false, data)
+}
+
+func (m *mockGraph) add(parent, name string, folder bool, data []byte) *mockGraphItem {
+	m.seq++
+	i := &mockGraphItem{driveItem{ID: fmt.Sprintf("ID%03d", m.seq), Name: name, Size: int64(len(data)), LastModified: time.Now()}, parent, data}
+	if folder {
+		i.Folder = &struct{}{}
+	}
+	m.items[i.ID] = i
+	return i
+}
+
+func (m *mockGraph) remove(id string) {
+	for cid, i := range m.items {
+		if i.parent == id {
+			m.remove(cid)
+		}
+	}
+	delete(m.items, id)
+}
+
+func graphFail(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]interface{}{"error": map[string]string{"code": code, "message": code}})
+}
+
+func (m *mockGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	switch {
+	case r.URL.Path == "/token":
+		_ = r.ParseForm()
+		if r.Form.Get("refresh_token") != "refresh1" || r.Form.Get("scope") != graphScope {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": m.token, "refresh_token": "refresh1", "expires_in": 3600})
+		return
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		m.serveUpload(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+m.token {
+		graphFail(w, http.StatusUnauthorized, "InvalidAuthenticationToken")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/download/") {
+		i, ok := m.items[strings.TrimPrefix(r.URL.Path, "/download/")]
+		if !ok {
+			graphFail(w, http.StatusNotFound, "itemNotFound")
+			return
+		}
+		http.ServeContent(w, r, i.Name, i.LastModified, bytes.NewReader(i.data))
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/v1.0/me/drive/")
+	if rest == "root" {
+		writeJSON(w, http.StatusOK, m.items["root"].driveItem)
+		return
+	}
+	rest = strings.TrimPrefix(rest, "items/")
+	// addressed by the name in a folder: items/<parent>:/<name>:<op>
+	if idx := strings.Index(rest, ":/"); idx > 0 {
+		parent, tail := rest[:idx], rest[idx+2:]
+		j := strings.Index(tail, ":")
+		name, op := tail[:j], tail[j+1:]
+		if _, ok := m.items[parent]; !ok {
+			graphFail(w, http.StatusNotFound, "itemNotFound")
+			return
+		}
+		switch op {
+		case "":
+			if i := m.child(parent, name); i != nil {
+				writeJSON(w, http.StatusOK, i.driveItem)
+			} else {
+				graphFail(w, http.StatusNotFound, "itemNotFound")
+			}
+		case "/content":
+			data, _ := io.ReadAll(r.Body)
+			writeJSON(w, http.StatusCreated, m.put(parent, name, data).driveItem)
+		case "/createUploadSession":
+			m.seq++
+			sid := fmt.Sprintf("session%d", m.seq)
+			m.sessions[sid] = &mockUploadSession{parent: parent, name: name}
+			writeJSON(w, http.StatusOK, map[string]string{"uploadUrl": "http://" + r.Host + "/upload/" + sid})
+		default:
+			graphFail(w, http.StatusBadRequest, "invalidRequest")
+		}
+		return
+	}
+	parts := strings.Split(rest, "/")
+	i, ok := m.items[parts[0]]
+	if !ok {
+		graphFail(w, http.StatusNotFound, "itemNotFound")
+		return
+	}
+	switch {
+	case len(parts) == 2 && parts[1] == "children" && r.Method == http.MethodGet:
+		var entries []driveItem
+		for _, c := range m.items {
+			if c.parent == i.ID {
+				entries = append(entries, c.driveItem)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+		start, _ := strconv.Atoi(r.URL.Query().Get("$skiptoken"))
+		end := start + m.pageSize
+		page := map[string]interface{}{}
+		if end >= len(entries) {
+			end = len(entries)
+		} else {
+			page["@odata.nextLink"] = fmt.Sprintf("http://%s%s?$skiptoken=%d", r.Host, r.URL.Path, end)
+		}
+		page["value"] = entries[start:end]
+		writeJSON(w, http.StatusOK, page)
+	case len(parts) == 2 && parts[1] == "children" && r.Method == http.MethodPost:
+		var req struct {
+			Name     string `json:"name"`
+			Conflict string `json:"@microsoft.graph.conflictBehavior"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if m.child(i.ID, req.Name) != nil && req.Conflict == "fail" {
+			graphFail(w, http.StatusConflict, "nameAlreadyExists")
+			return
+		}
+		writeJSON(w, http.StatusCreated, m.add(i.ID, req.Name, true, nil).driveItem)
+	case len(parts) == 2 && parts[1] == "content":
+		http.Redirect(w, r, "/download/"+i.ID, http.StatusFound)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, i.driveItem)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		m.remove(i.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		graphFail(w, http.StatusBadRequest, "invalidRequest")
+	}
+}
+
+func (m *mockGraph) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "" {
+		m.leaked++
+	}
+	sid := strings.TrimPrefix(r.URL.Path, "/upload/")
+	s, ok := m.sessions[sid]
+	if !ok {
+		graphFail(w, http.StatusNotFound, "itemNotFound")
+		return
+	}
+	if r.Method == http.MethodDelete {
+		delete(m.sessions, sid)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var start, end, size int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil || start != int64(len(s.data)) {
+		graphFail(w, http.StatusRequestedRangeNotSatisfiable, "invalidRange")
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	m.fragments++
+	s.data = append(s.data, data...)
+	if end+1 < size {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"nextExpectedRanges": []string{fmt.Sprintf("%d-", end+1)}})
+		return
+	}
+	delete(m.sessions, sid)
+	writeJSON(w, http.StatusCreated, m.put(s.parent, s.name, s.data).driveItem)
+}
+
+func newTestOneDrive(t *testing.T, m *mockGraph, auth *oauthToken) *onedriveStorage {
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+	auth.oauthURL = srv.URL + "/token"
+	auth.scope = graphScope
+	s := &onedriveStorage{
+		client:           srv.Client(),
+		auth:             auth,
+		apiURL:           srv.URL + "/v1.0",
+		drive:            "me",
+		workdir:          "jfs",
+		chunkedThreshold: 30,
+		chunkSize:        8,
+	}
+	if err := s.init(); err != nil {
+		t.Fatalf("init onedrive: %s", err)
+	}
+	return s
+}
+
+func TestOneDrive(t *testing.T) {
+	m := newMockGraph()
+	s := newTestOneDrive(t, m, &oauthToken{service: "onedrive", accessToken: "access1"})
+
+	if _, err := s.Head("chunks/0/0/1_0_4"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head not existed object should be not found, but got %v", err)
+	}
+	keys := []string{"chunks/0/0/1_0_4", "chunks/0/1/2_0_4", "chunks/1/0/3_0_4", "meta"}
+	for _, k := range keys {
+		if err := s.Put(k, bytes.NewReader([]byte("data-"+k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	if err := s.Put("meta", bytes.NewReader([]byte("new meta"))); err != nil {
+		t.Fatalf("overwrite: %s", err)
+	}
+	if d, err := get(s, "meta", 0, -1); err != nil || d != "new meta" {
+		t.Fatalf("get meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, 4); err != nil || d != "meta" {
+		t.Fatalf("get range of meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, -1); err != nil || d != "meta" {
+		t.Fatalf("get meta from offset: %q %v", d, err)
+	}
+	if o, err := s.Head("chunks/0/1/2_0_4"); err != nil || o.Size() != int64(len("data-chunks/0/1/2_0_4")) {
+		t.Fatalf("head: %v %v", o, err)
+	}
+
+	// a fresh client resolves the paths by walking the folders
+	s2 := &onedriveStorage{client: s.client, auth: s.auth, apiURL: s.apiURL, drive: "me", workdir: "jfs", chunkedThreshold: 30, chunkSize: 8}
+	if err := s2.init(); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ch, err := s2.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %v, but got %v", keys, got)
+	}
+	if d, err := get(s2, "chunks/1/0/3_0_4", 0, -1); err != nil || d != "data-chunks/1/0/3_0_4" {
+		t.Fatalf("get: %q %v", d, err)
+	}
+
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete not existed object: %s", err)
+	}
+	// deleted by the other client, the cached id is stale
+	if _, err := s2.Head("meta"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("meta should be deleted, but got %v", err)
+	}
+	if _, ok := s2.nodeIDCache.Load("jfs/meta"); ok {
+		t.Fatalf("the id of deleted meta should not be cached")
+	}
+}
+
+func TestOneDriveChunkedUpload(t *testing.T) {
+	m := newMockGraph()
+	s := newTestOneDrive(t, m, &oauthToken{service: "onedrive", accessToken: "access1"})
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	if err := s.Put("large", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put large: %s", err)
+	}
+	if m.fragments != 5 || len(m.sessions) != 0 {
+		t.Fatalf("expect 5 fragments in a finished session, but got %d and %d sessions", m.fragments, len(m.sessions))
+	}
+	if m.leaked != 0 {
+		t.Fatalf("the access token is sent to the upload url")
+	}
+	if d, err := get(s, "large", 0, -1); err != nil || d != string(data) {
+		t.Fatalf("get large: %q %v", d, err)
+	}
+	if d, err := get(s, "large", 30, 4); err != nil || d != "uvwx" {
+		t.Fatalf("get range of large: %q %v", d, err)
+	}
+}
+
+func TestOneDriveRefreshToken(t *testing.T) {
+	m := newMockGraph()
+	var saved string
+	s := newTestOneDrive(t, m, &oauthToken{service: "onedrive", clientID: "id", refreshToken: "refresh1", onRefresh: func(t string) { saved = t }})
+	if saved != "refresh1" {
+		t.Fatalf("refresh token should be saved")
+	}
+	// the access token is revoked, a new one should be requested
+	m.Lock()
+	m.token = "access2"
+	m.Unlock()
+	if err := s.Put("a", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatalf("put after token revoked: %s", err)
+	}
+	if s.auth.accessToken != "access2" {
+		t.Fatalf("access token is not refreshed")
+	}
+}
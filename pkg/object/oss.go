@@ -67,13 +67,29 @@ func (o *ossClient) checkError(err error) error {
 	return err
 }
 
+// ossMaxDeletes is the max number of keys deleted in a request.
+const ossMaxDeletes = 1000
+
+// ossError maps the missing objects to os.ErrNotExist.
+func ossError(err error) error {
+	if e, ok := err.(oss.ServiceError); ok && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey") {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// storageClassOf returns the class in the header, empty for Standard.
+func storageClassOf(class string) string {
+	if class == string(oss.StorageStandard) {
+		return ""
+	}
+	return class
+}
+
 func (o *ossClient) Head(key string) (Object, error) {
-	r, err := o.bucket.GetObjectMeta(key)
+	r, err := o.bucket.GetObjectDetailedMeta(key)
 	if o.checkError(err) != nil {
-		if e, ok := err.(oss.ServiceError); ok && e.StatusCode == http.StatusNotFound {
-			err = os.ErrNotExist
-		}
-		return nil, err
+		return nil, ossError(err)
 	}
 
 	lastModified := r.Get("Last-Modified")
@@ -83,12 +99,41 @@ func (o *ossClient) Head(key string) (Object, error) {
 	contentLength := r.Get("Content-Length")
 	mtime, _ := time.Parse(time.RFC1123, lastModified)
 	size, _ := strconv.ParseInt(contentLength, 10, 64)
-	return &obj{
+	info := ObjectInfo{
+		ETag:         strings.Trim(r.Get(oss.HTTPHeaderEtag), `"`),
+		ContentType:  r.Get(oss.HTTPHeaderContentType),
+		StorageClass: storageClassOf(r.Get(oss.HTTPHeaderOssStorageClass)),
+		Encryption:   r.Get(oss.HTTPHeaderOssServerSideEncryption),
+	}
+	for k := range r {
+		if !strings.HasPrefix(k, oss.HTTPHeaderOssMetaPrefix) {
+			continue
+		}
+		name := strings.ToLower(k[len(oss.HTTPHeaderOssMetaPrefix):])
+		if name == strings.ToLower(checksumAlgr) {
+			continue
+		}
+		if info.Metadata == nil {
+			info.Metadata = make(map[string]string)
+		}
+		info.Metadata[name] = r.Get(k)
+	}
+	if n := r.Get("X-Oss-Tagging-Count"); n != "" && n != "0" {
+		t, err := o.bucket.GetObjectTagging(key)
+		if o.checkError(err) != nil {
+			return nil, ossError(err)
+		}
+		info.Tags = make(map[string]string, len(t.Tags))
+		for _, tag := range t.Tags {
+			info.Tags[tag.Key] = tag.Value
+		}
+	}
+	return &describedObj{obj{
 		key,
 		size,
 		mtime,
 		strings.HasSuffix(key, "/"),
-	}, nil
+	}, info}, nil
 }
 
 func (o *ossClient) Get(key string, off, limit int64) (resp io.ReadCloser, err error) {
@@ -107,7 +152,7 @@ func (o *ossClient) Get(key string, off, limit int64) (resp io.ReadCloser, err e
 				resp.(*oss.Response).Headers.Get(oss.HTTPHeaderOssMetaPrefix+checksumAlgr))
 		}
 	}
-	err = o.checkError(err)
+	err = ossError(o.checkError(err))
 	return
 }
 
@@ -125,7 +170,110 @@ func (o *ossClient) Copy(dst, src string) error {
 }
 
 func (o *ossClient) Delete(key string) error {
-	return o.checkError(o.bucket.DeleteObject(key))
+	err := ossError(o.checkError(o.bucket.DeleteObject(key)))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// DeleteMulti deletes the keys in batches, the keys not reported as deleted
+// are returned as a BulkError.
+func (o *ossClient) DeleteMulti(keys []string) error {
+	b := &bulkRunner{op: "delete", mode: BulkBestEffort}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > ossMaxDeletes {
+			batch = batch[:ossMaxDeletes]
+		}
+		keys = keys[len(batch):]
+		r, err := o.bucket.DeleteObjects(batch)
+		if o.checkError(err) != nil {
+			for _, key := range batch {
+				_, _ = b.run(key, func(string) error { return err })
+			}
+			continue
+		}
+		// the missing keys are reported as deleted too
+		deleted := make(map[string]bool, len(r.DeletedObjects))
+		for _, key := range r.DeletedObjects {
+			deleted[key] = true
+		}
+		for _, key := range batch {
+			if !deleted[key] {
+				_, _ = b.run(key, func(string) error { return fmt.Errorf("not deleted") })
+			}
+		}
+	}
+	return b.result()
+}
+
+func ossTagging(tags map[string]string) oss.Tagging {
+	var t oss.Tagging
+	for k, v := range tags {
+		t.Tags = append(t.Tags, oss.Tag{Key: k, Value: v})
+	}
+	return t
+}
+
+// PutWithMetadata writes the object with the content type, storage class
+// (Standard, IA, Archive or ColdArchive), user metadata and tags of info.
+func (o *ossClient) PutWithMetadata(key string, in io.Reader, info ObjectInfo) error {
+	var options []oss.Option
+	if info.ContentType != "" {
+		options = append(options, oss.ContentType(info.ContentType))
+	}
+	if info.StorageClass != "" {
+		options = append(options, oss.ObjectStorageClass(oss.StorageClassType(info.StorageClass)))
+	}
+	for k, v := range info.Metadata {
+		options = append(options, oss.Meta(k, v))
+	}
+	if len(info.Tags) > 0 {
+		options = append(options, oss.SetTagging(ossTagging(info.Tags)))
+	}
+	if ins, ok := in.(io.ReadSeeker); ok {
+		options = append(options, oss.Meta(checksumAlgr, generateChecksum(ins)))
+	}
+	return o.checkError(o.bucket.PutObject(key, in, options...))
+}
+
+func (o *ossClient) SetTags(key string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return ossError(o.checkError(o.bucket.DeleteObjectTagging(key)))
+	}
+	return ossError(o.checkError(o.bucket.PutObjectTagging(key, ossTagging(tags))))
+}
+
+// SetStorageClass changes the class of an object by copying it onto itself,
+// the metadata is kept.
+func (o *ossClient) SetStorageClass(key, class string) error {
+	_, err := o.bucket.CopyObject(key, key, oss.ObjectStorageClass(oss.StorageClassType(class)),
+		oss.MetadataDirective(oss.MetaCopy))
+	return ossError(o.checkError(err))
+}
+
+// Restore restores an object of Archive or ColdArchive for days.
+func (o *ossClient) Restore(key string, days int) error {
+	err := o.checkError(o.bucket.RestoreObjectDetail(key, oss.RestoreConfiguration{Days: int32(days)}))
+	if e, ok := err.(oss.ServiceError); ok && e.Code == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return ossError(err)
+}
+
+// Restored tells whether an object is not archived, or the restore of it is
+// finished.
+func (o *ossClient) Restored(key string) (bool, error) {
+	r, err := o.bucket.GetObjectDetailedMeta(key)
+	if o.checkError(err) != nil {
+		return false, ossError(err)
+	}
+	switch oss.StorageClassType(r.Get(oss.HTTPHeaderOssStorageClass)) {
+	case oss.StorageArchive, oss.StorageColdArchive:
+		return strings.Contains(r.Get("X-Oss-Restore"), `ongoing-request="false"`), nil
+	}
+	return true, nil
 }
 
 func (o *ossClient) List(prefix, marker string, limit int64) ([]Object, error) {
@@ -141,7 +289,8 @@ func (o *ossClient) List(prefix, marker string, limit int64) ([]Object, error) {
 	objs := make([]Object, n)
 	for i := 0; i < n; i++ {
 		o := result.Objects[i]
-		objs[i] = &obj{o.Key, o.Size, o.LastModified, strings.HasSuffix(o.Key, "/")}
+		objs[i] = &describedObj{obj{o.Key, o.Size, o.LastModified, strings.HasSuffix(o.Key, "/")},
+			ObjectInfo{ETag: strings.Trim(o.ETag, `"`), StorageClass: storageClassOf(o.StorageClass)}}
 	}
 	return objs, nil
 }
@@ -285,6 +434,9 @@ func (o *ossClient) refreshToken() time.Time {
 	return expire
 }
 
+var _ MetadataSetter = &ossClient{}
+var _ Restorer = &ossClient{}
+
 func autoOSSEndpoint(bucketName, accessKey, secretKey, securityToken string) (string, error) {
 	var client *oss.Client
 	var err error
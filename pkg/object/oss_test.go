@@ -0,0 +1,372 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+type fakeOSSObject struct {
+	data    []byte
+	header  http.Header
+	tags    map[string]string
+	restore string
+}
+
+// fakeOSS serves the requests of the OSS SDK to a bucket in memory.
+type fakeOSS struct {
+	sync.Mutex
+	bucket  string
+	objects map[string]*fakeOSSObject
+	// the keys refused to delete
+	undeletable map[string]bool
+	// the requests of DeleteObjects
+	batches int
+}
+
+func (f *fakeOSS) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (f *fakeOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	q := r.URL.Query()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	if key == "" {
+		f.serveBucket(w, r, q)
+		return
+	}
+	o := f.objects[key]
+	if o == nil && !(r.Method == http.MethodPut && !q.Has("tagging")) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		f.fail(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut && q.Has("tagging"):
+		var t oss.Tagging
+		_ = xml.NewDecoder(r.Body).Decode(&t)
+		o.tags = make(map[string]string)
+		for _, tag := range t.Tags {
+			o.tags[tag.Key] = tag.Value
+		}
+	case r.Method == http.MethodDelete && q.Has("tagging"):
+		o.tags = nil
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && q.Has("tagging"):
+		var t oss.Tagging
+		for k, v := range o.tags {
+			t.Tags = append(t.Tags, oss.Tag{Key: k, Value: v})
+		}
+		_ = xml.NewEncoder(w).Encode(t)
+	case r.Method == http.MethodPost && q.Has("restore"):
+		switch class := o.header.Get(oss.HTTPHeaderOssStorageClass); {
+		case class != string(oss.StorageArchive) && class != string(oss.StorageColdArchive):
+			f.fail(w, http.StatusBadRequest, "OperationNotSupported")
+		case o.restore == `ongoing-request="true"`:
+			f.fail(w, http.StatusConflict, "RestoreAlreadyInProgress")
+		default:
+			o.restore = `ongoing-request="true"`
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case r.Method == http.MethodPut:
+		header := make(http.Header)
+		if src := r.Header.Get(oss.HTTPHeaderOssCopySource); src != "" {
+			src, _ = url.QueryUnescape(strings.TrimPrefix(src, "/"+f.bucket+"/"))
+			so := f.objects[src]
+			if so == nil {
+				f.fail(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			for k, v := range so.header {
+				header[k] = v
+			}
+			o = &fakeOSSObject{data: so.data, header: header, tags: so.tags}
+		} else {
+			data, _ := io.ReadAll(r.Body)
+			o = &fakeOSSObject{data: data, header: header}
+			for k := range r.Header {
+				if strings.HasPrefix(k, oss.HTTPHeaderOssMetaPrefix) || k == oss.HTTPHeaderContentType {
+					header.Set(k, r.Header.Get(k))
+				}
+			}
+			if t := r.Header.Get(oss.HTTPHeaderOssTagging); t != "" {
+				vs, _ := url.ParseQuery(t)
+				o.tags = make(map[string]string)
+				for k := range vs {
+					o.tags[k] = vs.Get(k)
+				}
+			}
+		}
+		class := r.Header.Get(oss.HTTPHeaderOssStorageClass)
+		if class == "" && header.Get(oss.HTTPHeaderOssStorageClass) == "" {
+			class = string(oss.StorageStandard)
+		}
+		if class != "" {
+			header.Set(oss.HTTPHeaderOssStorageClass, class)
+		}
+		header.Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		header.Set(oss.HTTPHeaderEtag, fmt.Sprintf(`"%x"`, len(o.data)))
+		f.objects[key] = o
+		if r.Header.Get(oss.HTTPHeaderOssCopySource) != "" {
+			fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, header.Get(oss.HTTPHeaderEtag))
+		}
+	case r.Method == http.MethodDelete && f.undeletable[key]:
+		f.fail(w, http.StatusForbidden, "AccessDenied")
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		for k, v := range o.header {
+			w.Header()[k] = v
+		}
+		if len(o.tags) > 0 {
+			w.Header().Set("X-Oss-Tagging-Count", strconv.Itoa(len(o.tags)))
+		}
+		if o.restore != "" {
+			w.Header().Set("X-Oss-Restore", o.restore)
+		}
+		data, status := o.data, http.StatusOK
+		if rg := r.Header.Get("Range"); rg != "" {
+			var start, end int
+			if n, _ := fmt.Sscanf(rg, "bytes=%d-%d", &start, &end); n < 2 {
+				end = len(data) - 1
+			}
+			data, status = data[start:end+1], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeOSS) serveBucket(w http.ResponseWriter, r *http.Request, q url.Values) {
+	switch {
+	case r.Method == http.MethodPost && q.Has("delete"):
+		var req struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		_ = xml.NewDecoder(r.Body).Decode(&req)
+		f.batches++
+		var res struct {
+			XMLName xml.Name               `xml:"DeleteResult"`
+			Deleted []struct{ Key string } `xml:"Deleted"`
+		}
+		for _, o := range req.Objects {
+			if !f.undeletable[o.Key] {
+				delete(f.objects, o.Key)
+				res.Deleted = append(res.Deleted, struct{ Key string }{o.Key})
+			}
+		}
+		_ = xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodGet:
+		keys := make([]string, 0, len(f.objects))
+		for k := range f.objects {
+			if strings.HasPrefix(k, q.Get("prefix")) && k > q.Get("marker") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		res := oss.ListObjectsResult{Prefix: q.Get("prefix"), Marker: q.Get("marker")}
+		if n, _ := strconv.Atoi(q.Get("max-keys")); n > 0 && len(keys) > n {
+			keys, res.IsTruncated = keys[:n], true
+			res.NextMarker = keys[n-1]
+		}
+		for _, k := range keys {
+			o := f.objects[k]
+			res.Objects = append(res.Objects, oss.ObjectProperties{Key: k, Size: int64(len(o.data)),
+				ETag: o.header.Get(oss.HTTPHeaderEtag), StorageClass: o.header.Get(oss.HTTPHeaderOssStorageClass)})
+		}
+		_ = xml.NewEncoder(w).Encode(res)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func newTestOSS(t *testing.T) (*ossClient, *fakeOSS) {
+	f := &fakeOSS{bucket: "bucket", objects: make(map[string]*fakeOSSObject), undeletable: make(map[string]bool)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	client, err := oss.New(srv.URL, "ak", "sk", oss.SecurityToken("token"))
+	if err != nil {
+		t.Fatalf("oss client: %s", err)
+	}
+	client.Config.IsEnableCRC = false
+	bucket, err := client.Bucket(f.bucket)
+	if err != nil {
+		t.Fatalf("oss bucket: %s", err)
+	}
+	return &ossClient{client: client, bucket: bucket}, f
+}
+
+func TestOSSClient(t *testing.T) {
+	o, f := newTestOSS(t)
+	if c := Capabilities(o); !c.DeleteMulti || !c.Metadata {
+		t.Fatalf("capabilities of oss: %s", c)
+	}
+	if _, err := o.Head("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head of missing object: %v", err)
+	}
+	if _, err := o.Get("missing", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get of missing object: %v", err)
+	}
+	if err := o.Delete("missing"); err != nil {
+		t.Fatalf("delete of missing object: %s", err)
+	}
+
+	if err := o.Put("std", strings.NewReader("hello world")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if d, err := get(o, "std", 6, 5); err != nil || d != "world" {
+		t.Fatalf("get range: %q %v", d, err)
+	}
+	if d, err := get(o, "std", 6, -1); err != nil || d != "world" {
+		t.Fatalf("get the rest: %q %v", d, err)
+	}
+	// the default class is reported as empty, the checksum is not metadata
+	if h, err := o.Head("std"); err != nil || h.Size() != 11 || InfoOf(h).StorageClass != "" || InfoOf(h).Metadata != nil {
+		t.Fatalf("head: %+v %v", InfoOf(h), err)
+	}
+	if r, err := Restored(o, "std"); err != nil || !r {
+		t.Fatalf("objects of Standard should be readable: %v %v", r, err)
+	}
+
+	info := ObjectInfo{ContentType: "text/plain", StorageClass: "Archive",
+		Metadata: map[string]string{"owner": "alice"}, Tags: map[string]string{"env": "test"}}
+	if err := PutWithMetadata(o, "cold", strings.NewReader("frozen"), info); err != nil {
+		t.Fatalf("put with metadata: %s", err)
+	}
+	h, err := o.Head("cold")
+	if err != nil {
+		t.Fatalf("head: %s", err)
+	}
+	if i := InfoOf(h); i.ContentType != "text/plain" || i.StorageClass != "Archive" ||
+		i.Metadata["owner"] != "alice" || i.Tags["env"] != "test" {
+		t.Fatalf("metadata of archived object: %+v", i)
+	}
+
+	// the archive restore flow
+	if r, err := Restored(o, "cold"); err != nil || r {
+		t.Fatalf("archived object should not be readable: %v %v", r, err)
+	}
+	if err = Restore(o, "cold", 1); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if err = Restore(o, "cold", 1); err != nil {
+		t.Fatalf("restore in progress: %s", err)
+	}
+	if r, err := Restored(o, "cold"); err != nil || r {
+		t.Fatalf("object being restored: %v %v", r, err)
+	}
+	f.Lock()
+	f.objects["cold"].restore = `ongoing-request="false", expiry-date="Sun, 16 Apr 2017 08:12:33 GMT"`
+	f.Unlock()
+	if r, err := Restored(o, "cold"); err != nil || !r {
+		t.Fatalf("restored object: %v %v", r, err)
+	}
+	if err = Restore(o, "std", 1); err == nil {
+		t.Fatalf("restore of Standard object should fail")
+	}
+	if err = Restore(o, "missing", 1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("restore of missing object: %v", err)
+	}
+
+	// the class is changed in place, the others are kept
+	if err = SetStorageClass(o, "cold", "IA"); err != nil {
+		t.Fatalf("set storage class: %s", err)
+	}
+	if h, err = o.Head("cold"); err != nil || InfoOf(h).StorageClass != "IA" || InfoOf(h).Metadata["owner"] != "alice" {
+		t.Fatalf("head after changing the class: %+v %v", InfoOf(h), err)
+	}
+	if err = SetTags(o, "cold", map[string]string{"env": "prod"}); err != nil {
+		t.Fatalf("set tags: %s", err)
+	}
+	if h, err = o.Head("cold"); err != nil || len(InfoOf(h).Tags) != 1 || InfoOf(h).Tags["env"] != "prod" {
+		t.Fatalf("tags: %+v %v", InfoOf(h).Tags, err)
+	}
+
+	// server-side copy
+	if err = o.Copy("copied", "std"); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if d, err := get(o, "copied", 0, -1); err != nil || d != "hello world" {
+		t.Fatalf("get of copy: %q %v", d, err)
+	}
+
+	// paginated by marker
+	objs, err := o.List("", "", 2)
+	if err != nil || len(objs) != 2 || objs[0].Key() != "cold" || objs[1].Key() != "copied" {
+		t.Fatalf("first page: %+v %v", objs, err)
+	}
+	if InfoOf(objs[0]).StorageClass != "IA" || InfoOf(objs[1]).StorageClass != "" {
+		t.Fatalf("storage classes of listing: %+v %+v", InfoOf(objs[0]), InfoOf(objs[1]))
+	}
+	if objs, err = o.List("", objs[1].Key(), 2); err != nil || len(objs) != 1 || objs[0].Key() != "std" {
+		t.Fatalf("second page: %+v %v", objs, err)
+	}
+
+	f.undeletable["copied"] = true
+	err = o.DeleteMulti([]string{"cold", "copied", "std", "missing"})
+	var be *BulkError
+	if !errors.As(err, &be) || len(be.Errors) != 1 || be.Errors["copied"] == nil {
+		t.Fatalf("delete multi: %v", err)
+	}
+	if objs, err = o.List("", "", 10); err != nil || len(objs) != 1 || objs[0].Key() != "copied" {
+		t.Fatalf("left after deletion: %+v %v", objs, err)
+	}
+
+	// the bulk deletes through a prefix are in batches too
+	for i := 0; i < 1500; i++ {
+		_ = o.Put(fmt.Sprintf("p/%04d", i), strings.NewReader("x"))
+	}
+	f.undeletable["p/0001"] = true
+	f.batches = 0
+	err = DeleteAll(WithPrefix(o, "p/"), "", BulkDefault)
+	if !errors.As(err, &be) || len(be.Errors) != 1 || be.Errors["0001"] == nil {
+		t.Fatalf("delete all: %v", err)
+	}
+	if f.batches != 2 {
+		t.Fatalf("expect 2 batches, but got %d", f.batches)
+	}
+	if objs, err = o.List("p/", "", 10); err != nil || len(objs) != 1 {
+		t.Fatalf("left after deletion: %+v %v", objs, err)
+	}
+}
@@ -0,0 +1,564 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the packs and their indexes are kept under this prefix of the storage
+const packDir = ".packs/"
+
+type packEntry struct {
+	Key   string    `json:"key"`
+	Off   int64     `json:"off"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// packIndex is saved as `<pack>.idx` after the pack is written, which commits
+// the pack. An index of a pack has only the entries, and one without pack
+// only marks the keys deleted from the packs before it.
+type packIndex struct {
+	Entries []packEntry `json:"entries,omitempty"`
+	Deleted []string    `json:"deleted,omitempty"`
+}
+
+type packedLoc struct {
+	pack string
+	packEntry
+}
+
+type packInfo struct {
+	size, live int64
+	// all the keys in the pack, including the dead ones
+	keys map[string]bool
+}
+
+// openPack collects the small Puts until it's written.
+type openPack struct {
+	buf     bytes.Buffer
+	entries []packEntry
+	timer   *time.Timer
+	done    chan struct{}
+	err     error
+}
+
+// Packer is an object storage which packs the small objects into larger
+// ones, so there are far fewer objects and requests on the storage.
+//
+// The Puts of objects not larger than threshold are collected into a pack,
+// which is written once it has packSize bytes or delay passes since its first
+// object, the Puts return after that, so they are durable but slower. The
+// larger objects are written as they are. A packed object deleted or
+// overwritten is marked dead in the index, and its space is reclaimed by
+// Compact, or in background after AutoCompact. The packs are expected to be
+// written by only one Packer.
+type Packer struct {
+	ObjectStorage
+	threshold int64
+	packSize  int64
+	delay     time.Duration
+
+	// serializes the changes of the index on the storage
+	writeLock sync.Mutex
+
+	mu    sync.Mutex
+	seq   uint64
+	index map[string]packedLoc
+	packs map[string]*packInfo
+	// the deleted keys in the indexes without pack
+	tombs map[string][]string
+	// the packs written without index, e.g. interrupted
+	orphans []string
+	open    *openPack
+	// the packs with more than deadRatio of dead bytes are compacted in
+	// background, 0 for never
+	deadRatio   float64
+	compacting  bool
+	compactions sync.WaitGroup
+}
+
+// WithPacking loads the index of packs in o, and packs the objects not larger
+// than threshold into packs of packSize.
+func WithPacking(o ObjectStorage, threshold, packSize int64, delay time.Duration) (*Packer, error) {
+	p := &Packer{ObjectStorage: o, threshold: threshold, packSize: packSize, delay: delay,
+		index: make(map[string]packedLoc), packs: make(map[string]*packInfo), tombs: make(map[string][]string)}
+	ch, err := ListAll(o, packDir, "")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	data := make(map[string]bool)
+	for obj := range ch {
+		if obj == nil {
+			return nil, fmt.Errorf("list packs in %s failed", o)
+		}
+		name := strings.TrimPrefix(obj.Key(), packDir)
+		id := strings.TrimSuffix(name, ".idx")
+		if id != name {
+			ids = append(ids, id)
+		} else {
+			data[id] = true
+		}
+		// the ids are not reused, even those of orphans
+		if seq, err := strconv.ParseUint(id, 16, 64); err == nil && seq > p.seq {
+			p.seq = seq
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		var idx packIndex
+		if err = p.readIndex(id, &idx); err != nil {
+			return nil, err
+		}
+		p.apply(id, &idx)
+		delete(data, id)
+	}
+	for id := range data {
+		p.orphans = append(p.orphans, id)
+	}
+	if len(ids) > 0 {
+		logger.Infof("Loaded %d packed objects in %d packs from %s", len(p.index), len(p.packs), o)
+	}
+	return p, nil
+}
+
+func (p *Packer) String() string {
+	return fmt.Sprintf("%s(packed)", p.ObjectStorage)
+}
+
+func (p *Packer) readIndex(id string, idx *packIndex) error {
+	r, err := p.ObjectStorage.Get(packDir+id+".idx", 0, -1)
+	if err != nil {
+		return fmt.Errorf("read index of pack %s: %w", id, err)
+	}
+	defer r.Close()
+	if err = json.NewDecoder(r).Decode(idx); err != nil {
+		return fmt.Errorf("decode index of pack %s: %w", id, err)
+	}
+	return nil
+}
+
+// apply adds the index of id into memory, the indexes are applied in order.
+func (p *Packer) apply(id string, idx *packIndex) {
+	if len(idx.Entries) > 0 {
+		info := &packInfo{keys: make(map[string]bool)}
+		p.packs[id] = info
+		for _, e := range idx.Entries {
+			p.unlink(e.Key)
+			p.index[e.Key] = packedLoc{id, e}
+			info.keys[e.Key] = true
+			info.live += e.Size
+			if end := e.Off + e.Size; end > info.size {
+				info.size = end
+			}
+		}
+	}
+	if len(idx.Deleted) > 0 {
+		p.tombs[id] = idx.Deleted
+		for _, key := range idx.Deleted {
+			p.unlink(key)
+		}
+	}
+}
+
+// unlink drops the packed key from the index, it's dead in its pack.
+func (p *Packer) unlink(key string) {
+	if loc, ok := p.index[key]; ok {
+		p.packs[loc.pack].live -= loc.Size
+		delete(p.index, key)
+	}
+}
+
+func (p *Packer) nextID() string {
+	p.seq++
+	return fmt.Sprintf("%016x", p.seq)
+}
+
+func (p *Packer) writeIndex(id string, idx *packIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return p.ObjectStorage.Put(packDir+id+".idx", bytes.NewReader(data))
+}
+
+func (p *Packer) Put(key string, in io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(in, p.threshold+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > p.threshold {
+		if err = p.ObjectStorage.Put(key, io.MultiReader(bytes.NewReader(data), in)); err != nil {
+			return err
+		}
+		return p.forget([]string{key})
+	}
+
+	p.mu.Lock()
+	op := p.open
+	if op == nil {
+		op = &openPack{done: make(chan struct{})}
+		op.timer = time.AfterFunc(p.delay, func() { p.seal(op) })
+		p.open = op
+	}
+	op.entries = append(op.entries, packEntry{key, int64(op.buf.Len()), int64(len(data)), time.Now()})
+	op.buf.Write(data)
+	full := int64(op.buf.Len()) >= p.packSize
+	p.mu.Unlock()
+	if full {
+		p.seal(op)
+	}
+	<-op.done
+	return op.err
+}
+
+// seal writes the open pack op with its index.
+func (p *Packer) seal(op *openPack) {
+	p.mu.Lock()
+	if p.open != op {
+		p.mu.Unlock()
+		return
+	}
+	p.open = nil
+	op.timer.Stop()
+	p.mu.Unlock()
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	op.err = p.writePack(op.buf.Bytes(), op.entries)
+	close(op.done)
+}
+
+func (p *Packer) writePack(data []byte, entries []packEntry) error {
+	p.mu.Lock()
+	id := p.nextID()
+	p.mu.Unlock()
+	if err := p.ObjectStorage.Put(packDir+id, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("write pack %s: %w", id, err)
+	}
+	idx := &packIndex{Entries: entries}
+	if err := p.writeIndex(id, idx); err != nil {
+		_ = p.ObjectStorage.Delete(packDir + id)
+		return fmt.Errorf("write index of pack %s: %w", id, err)
+	}
+	p.mu.Lock()
+	p.apply(id, idx)
+	p.mu.Unlock()
+	p.maybeCompact()
+	return nil
+}
+
+// forget marks the packed keys dead by an index without pack.
+func (p *Packer) forget(keys []string) error {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	p.mu.Lock()
+	var packed []string
+	for _, key := range keys {
+		if _, ok := p.index[key]; ok {
+			packed = append(packed, key)
+		}
+	}
+	if len(packed) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	id := p.nextID()
+	p.mu.Unlock()
+	idx := &packIndex{Deleted: packed}
+	if err := p.writeIndex(id, idx); err != nil {
+		return fmt.Errorf("delete %s from packs: %w", strings.Join(packed, ","), err)
+	}
+	p.mu.Lock()
+	p.apply(id, idx)
+	p.mu.Unlock()
+	p.maybeCompact()
+	return nil
+}
+
+// AutoCompact compacts the packs in background once more than deadRatio of
+// the bytes in any of them are dead, 0 to disable it.
+func (p *Packer) AutoCompact(deadRatio float64) {
+	p.mu.Lock()
+	p.deadRatio = deadRatio
+	p.mu.Unlock()
+	p.maybeCompact()
+}
+
+// maybeCompact starts a compaction in background if some pack has too much
+// dead space and none is running.
+func (p *Packer) maybeCompact() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.deadRatio <= 0 || p.compacting {
+		return
+	}
+	for _, info := range p.packs {
+		if float64(info.size-info.live) > p.deadRatio*float64(info.size) {
+			p.compacting = true
+			p.compactions.Add(1)
+			go func(ratio float64) {
+				defer p.compactions.Done()
+				if err := p.Compact(1 - ratio); err != nil {
+					logger.Warnf("Compact packs in %s: %s", p.ObjectStorage, err)
+				}
+				p.mu.Lock()
+				p.compacting = false
+				p.mu.Unlock()
+			}(p.deadRatio)
+			return
+		}
+	}
+}
+
+func (p *Packer) lookup(key string) (packedLoc, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, ok := p.index[key]
+	return loc, ok
+}
+
+func (p *Packer) Head(key string) (Object, error) {
+	if loc, ok := p.lookup(key); ok {
+		return &obj{key, loc.Size, loc.Mtime, false}, nil
+	}
+	return p.ObjectStorage.Head(key)
+}
+
+func (p *Packer) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	loc, ok := p.lookup(key)
+	if !ok {
+		return p.ObjectStorage.Get(key, off, limit)
+	}
+	if off >= loc.Size {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	n := loc.Size - off
+	if limit >= 0 && limit < n {
+		n = limit
+	}
+	if n == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	r, err := p.ObjectStorage.Get(packDir+loc.pack, loc.Off+off, n)
+	if err != nil {
+		// moved into another pack by Compact, or deleted in the meantime
+		if now, ok := p.lookup(key); !ok || now.pack != loc.pack {
+			return p.Get(key, off, limit)
+		}
+		return nil, fmt.Errorf("read %s from pack %s: %w", key, loc.pack, err)
+	}
+	return &exactReader{r, n}, nil
+}
+
+func (p *Packer) Delete(key string) error {
+	if err := p.forget([]string{key}); err != nil {
+		return err
+	}
+	return p.ObjectStorage.Delete(key)
+}
+
+func (p *Packer) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return nil, notSupported
+}
+
+// ListAll merges the packed objects into the listing of the storage, a key
+// both packed and stored as it is has the packed one, which is newer.
+func (p *Packer) ListAll(prefix, marker string) (<-chan Object, error) {
+	p.mu.Lock()
+	var packed []Object
+	for key, loc := range p.index {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			packed = append(packed, &obj{key, loc.Size, loc.Mtime, false})
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(packed, func(i, j int) bool { return packed[i].Key() < packed[j].Key() })
+
+	stored, err := ListAll(p.ObjectStorage, prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, 10240)
+	go func() {
+		defer close(out)
+		i := 0
+		for o := range stored {
+			if o == nil {
+				out <- nil
+				return
+			}
+			if strings.HasPrefix(o.Key(), packDir) {
+				continue
+			}
+			for ; i < len(packed) && packed[i].Key() <= o.Key(); i++ {
+				out <- packed[i]
+				if packed[i].Key() == o.Key() {
+					o = nil
+				}
+			}
+			if o != nil {
+				out <- o
+			}
+		}
+		for ; i < len(packed); i++ {
+			out <- packed[i]
+		}
+	}()
+	return out, nil
+}
+
+func (p *Packer) List(prefix, marker string, limit int64) ([]Object, error) {
+	ch, err := p.ListAll(prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	var objs []Object
+	for o := range ch {
+		if o == nil {
+			return nil, fmt.Errorf("list %s from %q failed", prefix, marker)
+		}
+		if int64(len(objs)) < limit {
+			objs = append(objs, o)
+		}
+	}
+	return objs, nil
+}
+
+// Compact rewrites the packs with less than ratio of live bytes, and removes
+// the packs without index and the indexes of deletion not needed anymore.
+func (p *Packer) Compact(ratio float64) error {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	p.mu.Lock()
+	var victims []string
+	for id, info := range p.packs {
+		if float64(info.live) < ratio*float64(info.size) {
+			victims = append(victims, id)
+		}
+	}
+	sort.Strings(victims)
+	var live []packedLoc
+	for _, loc := range p.index {
+		for _, id := range victims {
+			if loc.pack == id {
+				live = append(live, loc)
+			}
+		}
+	}
+	orphans := p.orphans
+	p.orphans = nil
+	p.mu.Unlock()
+	sort.Slice(live, func(i, j int) bool { return live[i].Key < live[j].Key })
+
+	var buf bytes.Buffer
+	var entries []packEntry
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		err := p.writePack(buf.Bytes(), entries)
+		buf.Reset()
+		entries = nil
+		return err
+	}
+	for _, loc := range live {
+		r, err := p.ObjectStorage.Get(packDir+loc.pack, loc.Off, loc.Size)
+		if err != nil {
+			return fmt.Errorf("read %s from pack %s: %w", loc.Key, loc.pack, err)
+		}
+		e := loc.packEntry
+		e.Off = int64(buf.Len())
+		_, err = io.Copy(&buf, &exactReader{r, loc.Size})
+		_ = r.Close()
+		if err != nil {
+			return fmt.Errorf("read %s from pack %s: %w", loc.Key, loc.pack, err)
+		}
+		entries = append(entries, e)
+		if int64(buf.Len()) >= p.packSize {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// the live objects are in the new packs now
+	for _, id := range victims {
+		if err := p.ObjectStorage.Delete(packDir + id + ".idx"); err != nil {
+			return fmt.Errorf("remove index of pack %s: %w", id, err)
+		}
+		p.mu.Lock()
+		delete(p.packs, id)
+		p.mu.Unlock()
+		if err := p.ObjectStorage.Delete(packDir + id); err != nil {
+			logger.Warnf("Remove pack %s: %s", id, err)
+		}
+	}
+	for _, id := range orphans {
+		if err := p.ObjectStorage.Delete(packDir + id); err != nil {
+			logger.Warnf("Remove pack %s without index: %s", id, err)
+		}
+	}
+
+	// a deletion is needed while a pack before it has the key
+	p.mu.Lock()
+	var tombs []string
+	for id, keys := range p.tombs {
+		needed := false
+		for pid, info := range p.packs {
+			if pid >= id {
+				continue
+			}
+			for _, key := range keys {
+				if info.keys[key] {
+					needed = true
+				}
+			}
+		}
+		if !needed {
+			tombs = append(tombs, id)
+		}
+	}
+	p.mu.Unlock()
+	for _, id := range tombs {
+		if err := p.ObjectStorage.Delete(packDir + id + ".idx"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove index %s: %w", id, err)
+		}
+		p.mu.Lock()
+		delete(p.tombs, id)
+		p.mu.Unlock()
+	}
+	if len(victims) > 0 {
+		logger.Infof("Compacted %d packs with %d live objects in %s", len(victims), len(live), p.ObjectStorage)
+	}
+	return nil
+}
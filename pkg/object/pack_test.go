@@ -0,0 +1,232 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func countObjects(t *testing.T, s ObjectStorage, prefix string) int {
+	ch, err := ListAll(s, prefix, "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	return len(collect(t, ch))
+}
+
+func TestPacker(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	p, err := WithPacking(m, 1<<10, 4<<10, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("with packing: %s", err)
+	}
+	contents := make(map[string]string)
+	var keys []string
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("chunks/%03d", i)
+		contents[key] = strings.Repeat(key, 10)
+		keys = append(keys, key)
+	}
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if err := p.Put(key, strings.NewReader(contents[key])); err != nil {
+				t.Errorf("put %s: %s", key, err)
+			}
+		}(key)
+	}
+	wg.Wait()
+	// 20000 bytes in packs of 4 KiB, with their indexes
+	if n := countObjects(t, m, ""); n > 20 {
+		t.Fatalf("expect a few packs for 200 small objects, but got %d objects", n)
+	}
+	check := func(p *Packer) {
+		for _, key := range keys {
+			if d, err := get(p, key, 0, -1); err != nil || d != contents[key] {
+				t.Fatalf("get %s: %q %v", key, d, err)
+			}
+			if o, err := p.Head(key); err != nil || o.Size() != int64(len(contents[key])) {
+				t.Fatalf("head %s: %v %v", key, o, err)
+			}
+		}
+		ch, err := p.ListAll("", "")
+		if err != nil {
+			t.Fatalf("list all: %s", err)
+		}
+		if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+			t.Fatalf("expect %d keys listed, but got %v", len(keys), got)
+		}
+	}
+	check(p)
+	if d, err := get(p, "chunks/005", 3, 10); err != nil || d != contents["chunks/005"][3:13] {
+		t.Fatalf("ranged get: %q %v", d, err)
+	}
+	if d, err := get(p, "chunks/005", 1000, 10); err != nil || d != "" {
+		t.Fatalf("get beyond the end: %q %v", d, err)
+	}
+
+	// a large object is stored as it is, and shadows the packed one
+	large := strings.Repeat("x", 2<<10)
+	if err = p.Put("chunks/010", strings.NewReader(large)); err != nil {
+		t.Fatalf("put large: %s", err)
+	}
+	contents["chunks/010"] = large
+	if _, err = m.Head("chunks/010"); err != nil {
+		t.Fatalf("large object should be stored directly: %s", err)
+	}
+	// a small one overwrites a stored one
+	if err = p.Put("direct", bytes.NewReader([]byte(large))); err != nil {
+		t.Fatalf("put large: %s", err)
+	}
+	if err = p.Put("direct", strings.NewReader("small")); err != nil {
+		t.Fatalf("put small: %s", err)
+	}
+	contents["direct"] = "small"
+	keys = append(keys, "direct")
+	for i := 0; i < 100; i += 2 {
+		key := keys[i]
+		if err = p.Delete(key); err != nil {
+			t.Fatalf("delete %s: %s", key, err)
+		}
+		if _, err = p.Head(key); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s should be deleted: %v", key, err)
+		}
+		delete(contents, key)
+	}
+	keys = keys[:0]
+	for key := range contents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	check(p)
+
+	// the index is loaded from the storage
+	p, err = WithPacking(m, 1<<10, 4<<10, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	check(p)
+
+	packs := countObjects(t, m, packDir)
+	if err = p.Compact(0.8); err != nil {
+		t.Fatalf("compact: %s", err)
+	}
+	if n := countObjects(t, m, packDir); n >= packs {
+		t.Fatalf("expect less than %d objects of packs after compaction, but got %d", packs, n)
+	}
+	check(p)
+	p, err = WithPacking(m, 1<<10, 4<<10, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	check(p)
+}
+
+func TestPackerAutoCompact(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	p, err := WithPacking(m, 1<<10, 4<<10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("with packing: %s", err)
+	}
+	packBytes := func() (n int64) {
+		ch, err := ListAll(m, packDir, "")
+		if err != nil {
+			t.Fatalf("list packs: %s", err)
+		}
+		for o := range ch {
+			if !strings.HasSuffix(o.Key(), ".idx") {
+				n += o.Size()
+			}
+		}
+		return
+	}
+	contents := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("chunks/%03d", i)
+		contents[key] = strings.Repeat(key, 10)
+		if err := p.Put(key, strings.NewReader(contents[key])); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	before := packBytes()
+	p.AutoCompact(0.5)
+
+	// the live objects stay readable while they are moved
+	var live []string
+	for i := 0; i < 200; i += 5 {
+		live = append(live, fmt.Sprintf("chunks/%03d", i))
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, key := range live {
+					if d, err := get(p, key, 0, -1); err != nil || d != contents[key] {
+						t.Errorf("get %s while compacting: %q %v", key, d, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		if i%5 == 0 {
+			continue
+		}
+		key := fmt.Sprintf("chunks/%03d", i)
+		if err := p.Delete(key); err != nil {
+			t.Fatalf("delete %s: %s", key, err)
+		}
+	}
+	p.compactions.Wait()
+	close(stop)
+	wg.Wait()
+
+	if after := packBytes(); after*2 > before {
+		t.Fatalf("expect packs shrunk from %d bytes, but got %d", before, after)
+	}
+	p, err = WithPacking(m, 1<<10, 4<<10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	for _, key := range live {
+		if d, err := get(p, key, 0, -1); err != nil || d != contents[key] {
+			t.Fatalf("get %s after compaction: %q %v", key, d, err)
+		}
+	}
+	if n := countObjects(t, p, "chunks/"); n != len(live) {
+		t.Fatalf("expect %d objects, but got %d", len(live), n)
+	}
+}
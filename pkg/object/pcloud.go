@@ -0,0 +1,394 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// the API servers of the two regions of pCloud
+var pcloudHosts = map[string]string{
+	"us": "api.pcloud.com",
+	"eu": "eapi.pcloud.com",
+}
+
+type pcloudError struct {
+	Result  int    `json:"result"`
+	Message string `json:"error"`
+}
+
+func (e *pcloudError) Error() string {
+	return fmt.Sprintf("pcloud: %d %s", e.Result, e.Message)
+}
+
+func (e *pcloudError) notFound() bool {
+	switch e.Result {
+	case 2002, 2005, 2009: // parent, directory or file does not exist
+		return true
+	}
+	return false
+}
+
+type pcloudItem struct {
+	Name     string        `json:"name"`
+	IsFolder bool          `json:"isfolder"`
+	FolderID int64         `json:"folderid"`
+	FileID   int64         `json:"fileid"`
+	Size     int64         `json:"size"`
+	Modified string        `json:"modified"`
+	Contents []*pcloudItem `json:"contents"`
+}
+
+func (i *pcloudItem) id() string {
+	if i.IsFolder {
+		return strconv.FormatInt(i.FolderID, 10)
+	}
+	return strconv.FormatInt(i.FileID, 10)
+}
+
+func (i *pcloudItem) mtime() time.Time {
+	t, _ := time.Parse(time.RFC1123Z, i.Modified)
+	return t
+}
+
+type pcloudStorage struct {
+	DefaultObjectStorage
+	client      *http.Client
+	apiURL      string
+	token       string
+	workdir     string
+	tempdirID   string
+	nodeIDCache sync.Map
+	walker      *treeWalker
+}
+
+func (s *pcloudStorage) String() string {
+	return fmt.Sprintf("pcloud://%s/", s.workdir)
+}
+
+// call invokes a method of the pCloud API, the non-zero result is returned as
+// pcloudError, and os.ErrNotExist for missing files or folders.
+func (s *pcloudStorage) call(ctx context.Context, method string, params url.Values, body io.Reader, response interface{}) error {
+	params.Set("access_token", s.token)
+	httpMethod := http.MethodGet
+	if body != nil {
+		httpMethod = http.MethodPut
+	}
+	req, err := http.NewRequestWithContext(ctx, httpMethod, fmt.Sprintf("%s/%s?%s", s.apiURL, method, params.Encode()), body)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pcloud %s: %s", method, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e pcloudError
+	if err = json.Unmarshal(data, &e); err != nil {
+		return fmt.Errorf("pcloud %s: %s", method, err)
+	}
+	if e.Result != 0 {
+		if e.notFound() {
+			return fmt.Errorf("%s: %w", &e, os.ErrNotExist)
+		}
+		return &e
+	}
+	if response != nil {
+		return json.Unmarshal(data, response)
+	}
+	return nil
+}
+
+func (s *pcloudStorage) listFolder(ctx context.Context, id string) ([]*pcloudItem, error) {
+	var result struct {
+		Metadata pcloudItem `json:"metadata"`
+	}
+	if err := s.call(ctx, "listfolder", url.Values{"folderid": {id}}, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Metadata.Contents, nil
+}
+
+func (s *pcloudStorage) listNodes(ctx context.Context, id string) ([]treeNode, error) {
+	items, err := s.listFolder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]treeNode, len(items))
+	for i, item := range items {
+		nodes[i] = treeNode{item.id(), item.Name, item.IsFolder, item.Size, item.mtime(), ""}
+	}
+	return nodes, nil
+}
+
+func (s *pcloudStorage) createFolder(parent, name string) (string, error) {
+	var result struct {
+		Metadata pcloudItem `json:"metadata"`
+	}
+	if err := s.call(ctx, "createfolderifnotexists", url.Values{"folderid": {parent}, "name": {name}}, nil, &result); err != nil {
+		return "", err
+	}
+	return result.Metadata.id(), nil
+}
+
+// getNode resolves a path into the id of a file or folder, the children of
+// the listed folders are cached along the way.
+func (s *pcloudStorage) getNode(p string, createDir bool) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "0", nil
+	}
+	if v, ok := s.nodeIDCache.Load(p); ok {
+		return v.(string), nil
+	}
+	dir, name := path.Split(p)
+	parent, err := s.getNode(dir, createDir)
+	if err != nil {
+		return "", err
+	}
+	items, err := s.listFolder(ctx, parent)
+	if err != nil {
+		return "", err
+	}
+	for _, i := range items {
+		s.nodeIDCache.Store(path.Join(dir, i.Name), i.id())
+	}
+	if v, ok := s.nodeIDCache.Load(p); ok {
+		return v.(string), nil
+	}
+	if !createDir {
+		return "", fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	id, err := s.createFolder(parent, name)
+	if err != nil {
+		return "", err
+	}
+	s.nodeIDCache.Store(p, id)
+	return id, nil
+}
+
+func (s *pcloudStorage) path(key string) string {
+	return path.Join(s.workdir, key)
+}
+
+func (s *pcloudStorage) Head(key string) (Object, error) {
+	id, err := s.getNode(s.path(key), false)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Metadata pcloudItem `json:"metadata"`
+	}
+	if err = s.call(ctx, "stat", url.Values{"fileid": {id}}, nil, &result); err != nil {
+		return nil, err
+	}
+	return &obj{key, result.Metadata.Size, result.Metadata.mtime(), false}, nil
+}
+
+func (s *pcloudStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	id, err := s.getNode(s.path(key), false)
+	if err != nil {
+		return nil, err
+	}
+	var link struct {
+		Hosts []string `json:"hosts"`
+		Path  string   `json:"path"`
+	}
+	if err = s.call(ctx, "getfilelink", url.Values{"fileid": {id}}, nil, &link); err != nil {
+		return nil, err
+	}
+	if len(link.Hosts) == 0 {
+		return nil, fmt.Errorf("pcloud: no download link for %s", key)
+	}
+	u := link.Hosts[0] + link.Path
+	if !strings.Contains(u, "://") {
+		u = "https://" + u
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+limit-1))
+	} else if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("pcloud download %s: %s", key, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *pcloudStorage) deleteFile(id string) error {
+	err := s.call(ctx, "deletefile", url.Values{"fileid": {id}}, nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+// Put uploads the content into the temp folder, then moves it to the
+// destination, which replaces the existing file.
+func (s *pcloudStorage) Put(key string, in io.Reader) error {
+	p := s.path(key)
+	dir, name := path.Split(p)
+	dirID, err := s.getNode(dir, true)
+	if err != nil {
+		return fmt.Errorf("get node: %w", err)
+	}
+	var uploaded struct {
+		Metadata []pcloudItem `json:"metadata"`
+	}
+	params := url.Values{"folderid": {s.tempdirID}, "filename": {uuid.NewString()}, "nopartial": {"1"}}
+	if err = s.call(ctx, "uploadfile", params, in, &uploaded); err != nil {
+		return fmt.Errorf("upload temp file: %w", err)
+	}
+	if len(uploaded.Metadata) == 0 {
+		return errors.New("pcloud: no file uploaded")
+	}
+	id := uploaded.Metadata[0].id()
+	rename := url.Values{"fileid": {id}, "tofolderid": {dirID}, "toname": {name}}
+	var e *pcloudError
+	if err = s.call(ctx, "renamefile", rename, nil, nil); errors.As(err, &e) && e.Result == 2004 {
+		// file already exists
+		if err = s.Delete(key); err == nil {
+			err = s.call(ctx, "renamefile", rename, nil, nil)
+		}
+	}
+	if err != nil {
+		_ = s.deleteFile(id)
+		return fmt.Errorf("move temp file: %w", err)
+	}
+	s.nodeIDCache.Store(strings.Trim(p, "/"), id)
+	return nil
+}
+
+func (s *pcloudStorage) Delete(key string) error {
+	p := strings.Trim(s.path(key), "/")
+	id, err := s.getNode(p, false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.nodeIDCache.Delete(p)
+	return s.deleteFile(id)
+}
+
+func (s *pcloudStorage) ListAll(prefix, marker string) (<-chan Object, error) {
+	rootID, err := s.getNode(s.workdir, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.walker.listAll(ctx, rootID, prefix, marker), nil
+}
+
+func (s *pcloudStorage) init() error {
+	workdirID, err := s.getNode(s.workdir, true)
+	if err != nil {
+		return err
+	}
+	s.walker = newTreeWalker(4, s.listNodes)
+	s.walker.skip = func(key string) bool { return key == driveTempDir+"/" }
+
+	// clean temp dir
+	tempDir := path.Join(s.workdir, driveTempDir)
+	if id, err := s.getNode(tempDir, false); err == nil {
+		s.nodeIDCache.Delete(strings.Trim(tempDir, "/"))
+		if err = s.call(ctx, "deletefolderrecursive", url.Values{"folderid": {id}}, nil, nil); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if s.tempdirID, err = s.createFolder(workdirID, driveTempDir); err != nil {
+		return err
+	}
+	s.nodeIDCache.Store(strings.Trim(tempDir, "/"), s.tempdirID)
+	return nil
+}
+
+// parsePCloudEndpoint returns the URL of API server and the workdir from an
+// endpoint of `<region>/<path>`, where region is `us` or `eu` (or the host of
+// the API server).
+func parsePCloudEndpoint(endpoint string) (string, string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+	}
+	host := u.Host
+	if h, ok := pcloudHosts[strings.ToLower(host)]; ok {
+		host = h
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("missing region in endpoint %s", endpoint)
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, host), strings.Trim(u.Path, "/"), nil
+}
+
+// newPCloud creates a storage on pCloud, token (or secretKey) is the OAuth
+// access token.
+func newPCloud(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	apiURL, workdir, err := parsePCloudEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		token = secretKey
+	}
+	s := &pcloudStorage{
+		client:  httpClient,
+		apiURL:  apiURL,
+		token:   token,
+		workdir: workdir,
+	}
+	if err = s.init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func init() {
+	Register("pcloud", newPCloud)
+}
@@ -0,0 +1,290 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockPCloudItem struct {
+	pcloudItem
+	parent int64
+	data   []byte
+}
+
+// mockPCloud emulates the subset of pCloud API used by pcloudStorage.
+type mockPCloud struct {
+	sync.Mutex
+	srv     *httptest.Server
+	folders map[int64]*mockPCloudItem
+	files   map[int64]*mockPCloudItem
+	seq     int64
+	token   string
+}
+
+func newMockPCloud() *mockPCloud {
+	m := &mockPCloud{folders: make(map[int64]*mockPCloudItem), files: make(map[int64]*mockPCloudItem), token: "token1"}
+	m.folders[0] = &mockPCloudItem{pcloudItem: pcloudItem{IsFolder: true}}
+	m.srv = httptest.NewServer(m)
+	return m
+}
+
+func (m *mockPCloud) child(parent int64, name string) *mockPCloudItem {
+	for _, i := range m.folders {
+		if i.parent == parent && i.Name == name && i.FolderID != 0 {
+			return i
+		}
+	}
+	for _, i := range m.files {
+		if i.parent == parent && i.Name == name {
+			return i
+		}
+	}
+	return nil
+}
+
+func (m *mockPCloud) removeFolder(id int64) {
+	for cid, i := range m.folders {
+		if i.parent == id && cid != 0 {
+			m.removeFolder(cid)
+		}
+	}
+	for fid, i := range m.files {
+		if i.parent == id {
+			delete(m.files, fid)
+		}
+	}
+	delete(m.folders, id)
+}
+
+func (m *mockPCloud) meta(i *mockPCloudItem) pcloudItem {
+	r := i.pcloudItem
+	r.Size = int64(len(i.data))
+	return r
+}
+
+func (m *mockPCloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	q := r.URL.Query()
+	if strings.HasPrefix(r.URL.Path, "/download/") {
+		id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/download/"), 10, 64)
+		f, ok := m.files[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, f.Name, time.Time{}, bytes.NewReader(f.data))
+		return
+	}
+	if q.Get("access_token") != m.token {
+		writeJSON(w, http.StatusOK, pcloudError{1000, "Log in required."})
+		return
+	}
+	id := func(name string) int64 {
+		v, _ := strconv.ParseInt(q.Get(name), 10, 64)
+		return v
+	}
+	notFound := func(code int) { writeJSON(w, http.StatusOK, pcloudError{code, "not found"}) }
+	now := time.Now().Format(time.RFC1123Z)
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "listfolder":
+		folder, ok := m.folders[id("folderid")]
+		if !ok {
+			notFound(2005)
+			return
+		}
+		meta := m.meta(folder)
+		for _, f := range m.folders {
+			if f.parent == folder.FolderID && f.FolderID != 0 {
+				c := m.meta(f)
+				meta.Contents = append(meta.Contents, &c)
+			}
+		}
+		for _, f := range m.files {
+			if f.parent == folder.FolderID {
+				c := m.meta(f)
+				meta.Contents = append(meta.Contents, &c)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": 0, "metadata": meta})
+	case "createfolderifnotexists":
+		parent := id("folderid")
+		if _, ok := m.folders[parent]; !ok {
+			notFound(2005)
+			return
+		}
+		f := m.child(parent, q.Get("name"))
+		if f == nil {
+			m.seq++
+			f = &mockPCloudItem{pcloudItem{Name: q.Get("name"), IsFolder: true, FolderID: m.seq, Modified: now}, parent, nil}
+			m.folders[f.FolderID] = f
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": 0, "metadata": m.meta(f)})
+	case "deletefolderrecursive":
+		if _, ok := m.folders[id("folderid")]; !ok {
+			notFound(2005)
+			return
+		}
+		m.removeFolder(id("folderid"))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": 0})
+	case "uploadfile":
+		parent := id("folderid")
+		if _, ok := m.folders[parent]; !ok {
+			notFound(2005)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		m.seq++
+		f := &mockPCloudItem{pcloudItem{Name: q.Get("filename"), FileID: m.seq, Modified: now}, parent, data}
+		m.files[f.FileID] = f
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": 0, "metadata": []pcloudItem{m.meta(f)}})
+	case "renamefile":
+		f, ok := m.files[id("fileid")]
+		if !ok {
+			notFound(2009)
+			return
+		}
+		if m.child(id("tofolderid"), q.Get("toname")) != nil {
+			writeJSON(w, http.StatusOK, pcloudError{2004, "File or folder alredy exists."})
+			return
+		}
+		f.parent, f.Name = id("tofolderid"), q.Get("toname")
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": 0, "metadata": m.meta(f)})
+	case "stat":
+		f, ok := m.files[id("fileid")]
+		if !ok {
+			notFound(2009)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": 0, "metadata": m.meta(f)})
+	case "getfilelink":
+		if _, ok := m.files[id("fileid")]; !ok {
+			notFound(2009)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": 0, "hosts": []string{m.srv.URL}, "path": fmt.Sprintf("/download/%d", id("fileid"))})
+	case "deletefile":
+		if _, ok := m.files[id("fileid")]; !ok {
+			notFound(2009)
+			return
+		}
+		delete(m.files, id("fileid"))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": 0})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPCloud(t *testing.T) {
+	m := newMockPCloud()
+	defer m.srv.Close()
+	if _, err := newPCloud(m.srv.URL+"/jfs", "", "", "bad token"); err == nil {
+		t.Fatalf("login with a bad token should fail")
+	}
+	store, err := newPCloud(m.srv.URL+"/jfs", "", "", m.token)
+	if err != nil {
+		t.Fatalf("create pcloud: %s", err)
+	}
+	s := store.(*pcloudStorage)
+
+	if _, err := s.Head("chunks/0/0/1_0_4"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head of not existed object: %v", err)
+	}
+	keys := []string{"chunks/0/0/1_0_4", "chunks/0/1/2_0_4", "chunks/1/0/3_0_4", "meta"}
+	for _, k := range keys {
+		if err := s.Put(k, bytes.NewReader([]byte("data-"+k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	if err := s.Put("meta", bytes.NewReader([]byte("new meta"))); err != nil {
+		t.Fatalf("overwrite: %s", err)
+	}
+	if d, err := get(s, "meta", 0, -1); err != nil || d != "new meta" {
+		t.Fatalf("get meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, 4); err != nil || d != "meta" {
+		t.Fatalf("get range of meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, -1); err != nil || d != "meta" {
+		t.Fatalf("get range of meta: %q %v", d, err)
+	}
+	if o, err := s.Head("chunks/0/1/2_0_4"); err != nil || o.Size() != int64(len("data-chunks/0/1/2_0_4")) {
+		t.Fatalf("head: %v %v", o, err)
+	}
+
+	// a fresh client resolves the paths by walking the folders
+	s2 := &pcloudStorage{client: s.client, apiURL: s.apiURL, token: s.token, workdir: "jfs"}
+	if err := s2.init(); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ch, err := s2.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %v, but got %v", keys, got)
+	}
+	if d, err := get(s2, "chunks/1/0/3_0_4", 0, -1); err != nil || d != "data-chunks/1/0/3_0_4" {
+		t.Fatalf("get: %q %v", d, err)
+	}
+
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete not existed object: %s", err)
+	}
+	if _, err := get(s, "meta", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("meta should be deleted: %v", err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	for _, i := range m.files {
+		if strconv.FormatInt(i.parent, 10) == s.tempdirID {
+			t.Fatalf("temp file %s is left", i.Name)
+		}
+	}
+}
+
+func TestPCloudEndpoint(t *testing.T) {
+	for ep, expect := range map[string][2]string{
+		"eu/jfs":                     {"https://eapi.pcloud.com", "jfs"},
+		"US/a/b/":                    {"https://api.pcloud.com", "a/b"},
+		"https://api.pcloud.com/x":   {"https://api.pcloud.com", "x"},
+		"http://127.0.0.1:8080/test": {"http://127.0.0.1:8080", "test"},
+	} {
+		api, workdir, err := parsePCloudEndpoint(ep)
+		if err != nil || api != expect[0] || workdir != expect[1] {
+			t.Fatalf("parse %s: expect %v, but got %s %s %v", ep, expect, api, workdir, err)
+		}
+	}
+	if _, _, err := parsePCloudEndpoint("https:///jfs"); err == nil {
+		t.Fatalf("endpoint without region should be invalid")
+	}
+}
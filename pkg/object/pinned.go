@@ -0,0 +1,113 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrObjectChanged is returned by the reads pinned to a version of an object
+// once it's overwritten.
+var ErrObjectChanged = errors.New("object changed during read")
+
+// VersionGetter is implemented by the storages able to read a range of an
+// object only if it's still of a version, as a Get with If-Match.
+type VersionGetter interface {
+	// GetIfMatch reads the range of key if its version is version, or any
+	// version if it's empty, and returns the version read. It fails with
+	// ErrObjectChanged if the version is different.
+	GetIfMatch(key string, off, limit int64, version string) (io.ReadCloser, string, error)
+}
+
+// GetIfMatch reads the range of key at version, by GetIfMatch of a
+// VersionGetter. For the others, the version of Head is checked before the
+// Get, which could still miss an overwrite in between.
+func GetIfMatch(s ObjectStorage, key string, off, limit int64, version string) (io.ReadCloser, string, error) {
+	if g, ok := s.(VersionGetter); ok {
+		return g.GetIfMatch(key, off, limit, version)
+	}
+	o, err := s.Head(key)
+	if err != nil {
+		return nil, "", err
+	}
+	current := versionOf(InfoOf(o))
+	if version != "" && current != version {
+		return nil, current, fmt.Errorf("get %s: %w", key, ErrObjectChanged)
+	}
+	r, err := s.Get(key, off, limit)
+	return r, current, err
+}
+
+// versionOf tells the versions of an object apart by its ETag or checksum,
+// or the size and mtime if the storage keeps neither.
+func versionOf(i ObjectInfo) string {
+	switch {
+	case i.ETag != "":
+		return i.ETag
+	case i.Hash != "":
+		return string(i.HashAlgo) + ":" + i.Hash
+	default:
+		return fmt.Sprintf("%d@%d", i.Size, i.Mtime.UnixNano())
+	}
+}
+
+// PinnedReader reads the ranges of an object as one logical read. The version
+// of the first Get is recorded, the later ones fail with ErrObjectChanged if
+// the object is overwritten, instead of mixing the bytes of two versions.
+type PinnedReader struct {
+	s       ObjectStorage
+	key     string
+	mu      sync.Mutex
+	version string
+}
+
+// Pin returns a PinnedReader of key in s.
+func Pin(s ObjectStorage, key string) *PinnedReader {
+	return &PinnedReader{s: s, key: key}
+}
+
+// Version returns the version pinned, empty before the first Get.
+func (p *PinnedReader) Version() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
+
+// Get reads the range of the pinned version.
+func (p *PinnedReader) Get(off, limit int64) (io.ReadCloser, error) {
+	version := p.Version()
+	r, current, err := GetIfMatch(p.s, p.key, off, limit, version)
+	if err != nil {
+		return nil, err
+	}
+	if version == "" {
+		p.mu.Lock()
+		if p.version == "" {
+			p.version = current
+		} else if p.version != current {
+			// pinned by a concurrent Get to another version
+			p.mu.Unlock()
+			_ = r.Close()
+			return nil, fmt.Errorf("get %s: %w", p.key, ErrObjectChanged)
+		}
+		p.mu.Unlock()
+	}
+	return r, nil
+}
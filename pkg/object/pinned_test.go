@@ -0,0 +1,77 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readPinned(p *PinnedReader, off, limit int64) (string, error) {
+	r, err := p.Get(off, limit)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+func TestPinnedReader(t *testing.T) {
+	d := newFakeDrive()
+	opts := defaultAliyunOptions
+	opts.keepTemp = true
+	mem, _ := newMem("mem", "", "", "")
+	// the overwrite is done by another client of the drive
+	for _, c := range [][2]ObjectStorage{
+		{newTestAliyun(t, d, opts), newTestAliyun(t, d, opts)},
+		{mem, mem},
+	} {
+		s, other := c[0], c[1]
+		v1 := strings.Repeat("1", 100)
+		if err := s.Put("obj", bytes.NewReader([]byte(v1))); err != nil {
+			t.Fatalf("put: %s", err)
+		}
+		p := Pin(s, "obj")
+		if data, err := readPinned(p, 0, 10); err != nil || data != v1[:10] {
+			t.Fatalf("first read: %q %v", data, err)
+		}
+		if p.Version() == "" {
+			t.Fatalf("version should be pinned by the first read")
+		}
+		if data, err := readPinned(p, 10, 10); err != nil || data != v1[10:20] {
+			t.Fatalf("second read: %q %v", data, err)
+		}
+
+		if err := other.Put("obj", bytes.NewReader([]byte(strings.Repeat("2", 120)))); err != nil {
+			t.Fatalf("overwrite: %s", err)
+		}
+		if data, err := readPinned(p, 20, 10); !errors.Is(err, ErrObjectChanged) {
+			t.Fatalf("read after overwrite should fail, but got %q %v", data, err)
+		}
+		// a new read pins the new version
+		if data, err := readPinned(Pin(s, "obj"), 20, 10); err != nil || data != strings.Repeat("2", 10) {
+			t.Fatalf("read the new version: %q %v", data, err)
+		}
+		if _, err := Pin(s, "missing").Get(0, 10); err == nil {
+			t.Fatalf("missing object should fail")
+		}
+	}
+}
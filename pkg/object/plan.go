@@ -0,0 +1,188 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+)
+
+// SyncAction is what a sync would do with a key.
+type SyncAction int
+
+const (
+	// SyncAdd uploads an object missing in the destination
+	SyncAdd SyncAction = iota
+	// SyncUpdate overwrites an object different in the destination
+	SyncUpdate
+	// SyncDelete deletes an object missing in the source
+	SyncDelete
+	// SyncSkip leaves the same object as it is
+	SyncSkip
+)
+
+func (a SyncAction) String() string {
+	switch a {
+	case SyncAdd:
+		return "add"
+	case SyncUpdate:
+		return "update"
+	case SyncDelete:
+		return "delete"
+	case SyncSkip:
+		return "skip"
+	}
+	return fmt.Sprintf("SyncAction(%d)", int(a))
+}
+
+// SyncPlan is the actions of a sync, the keys are in lexical order.
+type SyncPlan struct {
+	Add, Update, Delete, Skip []string
+	// bytes to be uploaded
+	Bytes int64
+}
+
+// hashOfListed returns the checksum of an object carried by the listing, or
+// stored along with it (by a Head).
+func hashOfListed(store ObjectStorage, o Object) (HashAlgo, string) {
+	if h, ok := o.(HashedObject); ok {
+		if algo, sum := h.Hash(); sum != "" {
+			return algo, sum
+		}
+	}
+	if o, err := store.Head(o.Key()); err == nil {
+		if h, ok := o.(HashedObject); ok {
+			return h.Hash()
+		}
+	}
+	return "", ""
+}
+
+// planAction compares two objects of the same key. The objects of different
+// sizes are different, otherwise the checksums are compared when both sides
+// know them, or the source is newer.
+func planAction(src, dst ObjectStorage, so, do Object) SyncAction {
+	if so.Size() != do.Size() {
+		return SyncUpdate
+	}
+	if salgo, ssum := hashOfListed(src, so); ssum != "" {
+		if dalgo, dsum := hashOfListed(dst, do); dsum != "" && dalgo == salgo {
+			if ssum == dsum {
+				return SyncSkip
+			}
+			return SyncUpdate
+		}
+	}
+	if so.Mtime().After(do.Mtime()) {
+		return SyncUpdate
+	}
+	return SyncSkip
+}
+
+// WalkSyncPlan compares the objects under prefix in src and dst like
+// PlanSync, and calls fn with every action in lexical order of the keys.
+// Both sides are listed at the same time, so only the current objects are in
+// memory. The objects of the same size cost a Head on both sides, unless the
+// listings carry their checksums. An error returned by fn stops the walk.
+func WalkSyncPlan(src, dst ObjectStorage, prefix string, fn func(action SyncAction, o Object) error) error {
+	srcs, err := ListAll(src, prefix, "")
+	if err != nil {
+		return fmt.Errorf("list %s: %w", src, err)
+	}
+	dsts, err := ListAll(dst, prefix, "")
+	if err != nil {
+		return fmt.Errorf("list %s: %w", dst, err)
+	}
+	// next returns the next file, or nil at the end
+	next := func(store ObjectStorage, ch <-chan Object) (Object, bool, error) {
+		for o := range ch {
+			if o == nil {
+				return nil, false, fmt.Errorf("list %s failed", store)
+			}
+			if !o.IsDir() {
+				return o, true, nil
+			}
+		}
+		return nil, false, nil
+	}
+	// drain the listings if stopped early
+	defer func() {
+		go func() {
+			for range srcs {
+			}
+		}()
+		go func() {
+			for range dsts {
+			}
+		}()
+	}()
+
+	so, sok, err := next(src, srcs)
+	if err != nil {
+		return err
+	}
+	do, dok, err := next(dst, dsts)
+	if err != nil {
+		return err
+	}
+	for sok || dok {
+		switch {
+		case !dok || sok && so.Key() < do.Key():
+			if err = fn(SyncAdd, so); err != nil {
+				return err
+			}
+			so, sok, err = next(src, srcs)
+		case !sok || do.Key() < so.Key():
+			if err = fn(SyncDelete, do); err != nil {
+				return err
+			}
+			do, dok, err = next(dst, dsts)
+		default:
+			if err = fn(planAction(src, dst, so, do), so); err != nil {
+				return err
+			}
+			if so, sok, err = next(src, srcs); err == nil {
+				do, dok, err = next(dst, dsts)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanSync tells what a sync from src to dst would do with the objects under
+// prefix, without changing anything.
+func PlanSync(src, dst ObjectStorage, prefix string) (SyncPlan, error) {
+	var plan SyncPlan
+	err := WalkSyncPlan(src, dst, prefix, func(action SyncAction, o Object) error {
+		switch action {
+		case SyncAdd:
+			plan.Add = append(plan.Add, o.Key())
+			plan.Bytes += o.Size()
+		case SyncUpdate:
+			plan.Update = append(plan.Update, o.Key())
+			plan.Bytes += o.Size()
+		case SyncDelete:
+			plan.Delete = append(plan.Delete, o.Key())
+		case SyncSkip:
+			plan.Skip = append(plan.Skip, o.Key())
+		}
+		return nil
+	})
+	return plan, err
+}
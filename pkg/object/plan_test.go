@@ -0,0 +1,117 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sha256Head returns the checksums of objects in Head.
+type sha256Head struct {
+	ObjectStorage
+}
+
+func (s *sha256Head) Head(key string) (Object, error) {
+	o, err := s.ObjectStorage.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.Get(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	_, _ = io.Copy(h, r)
+	return &hashedObj{obj{o.Key(), o.Size(), o.Mtime(), o.IsDir()}, HashSHA256, hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func TestPlanSync(t *testing.T) {
+	src, _ := newMem("src", "", "", "")
+	dst, _ := newMem("dst", "", "", "")
+	now := time.Now()
+	put := func(s ObjectStorage, key, data string, mtime time.Time) {
+		_ = s.Put(key, strings.NewReader(data))
+		s.(*memStore).objects[key].mtime = mtime
+	}
+	put(src, "p/add", "a", now)
+	put(src, "p/newer", "b", now)
+	put(dst, "p/newer", "c", now.Add(-time.Hour))
+	put(src, "p/older", "d", now.Add(-time.Hour))
+	put(dst, "p/older", "e", now)
+	put(src, "p/resized", "ff", now.Add(-time.Hour))
+	put(dst, "p/resized", "f", now)
+	put(dst, "p/removed", "g", now)
+	put(src, "p/same", "h", now)
+	put(dst, "p/same", "h", now)
+	put(src, "q/outside", "i", now)
+
+	expected := SyncPlan{
+		Add:    []string{"p/add"},
+		Update: []string{"p/newer", "p/resized"},
+		Delete: []string{"p/removed"},
+		Skip:   []string{"p/older", "p/same"},
+		Bytes:  4,
+	}
+	plan, err := PlanSync(src, dst, "p/")
+	if err != nil {
+		t.Fatalf("plan: %s", err)
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("expect %+v, but got %+v", expected, plan)
+	}
+	// nothing is changed
+	if _, err = dst.Head("p/add"); err == nil {
+		t.Fatalf("the plan should not upload anything")
+	}
+	if _, err = dst.Head("p/removed"); err != nil {
+		t.Fatalf("the plan should not delete anything")
+	}
+
+	// the checksums win over the mtime
+	put(dst, "p/newer", "b", now.Add(-time.Hour))
+	if plan, err = PlanSync(&sha256Head{src}, &sha256Head{dst}, "p/"); err != nil {
+		t.Fatalf("plan: %s", err)
+	}
+	expected.Update = []string{"p/older", "p/resized"}
+	expected.Skip = []string{"p/newer", "p/same"}
+	expected.Bytes = 4
+	if !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("expect %+v, but got %+v", expected, plan)
+	}
+
+	// stopped by the callback
+	stop := errors.New("stop")
+	var actions []SyncAction
+	err = WalkSyncPlan(src, dst, "", func(action SyncAction, o Object) error {
+		actions = append(actions, action)
+		if len(actions) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || len(actions) != 2 {
+		t.Fatalf("the walk should be stopped: %v %v", err, actions)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+// ListAllWithPrefetch lists the objects as ListAll, and calls fetch for every
+// object in threads goroutines before it's sent, e.g. to Head or Get it ahead
+// of the consumer, so the latency of the objects is overlapped. The objects
+// are still sent in the order of listing, once their fetches are done, and a
+// nil object is sent when the listing fails. At most threads objects are
+// fetched at the same time and buffered.
+func ListAllWithPrefetch(o ObjectStorage, prefix string, threads int, fetch func(Object)) (<-chan Object, error) {
+	if threads <= 0 {
+		threads = 1
+	}
+	in, err := ListAll(o, prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	type pending struct {
+		o    Object
+		done chan struct{}
+	}
+	queue := make(chan pending, threads)
+	slots := make(chan struct{}, threads)
+	go func() {
+		defer close(queue)
+		for obj := range in {
+			p := pending{obj, make(chan struct{})}
+			if obj == nil {
+				close(p.done)
+			} else {
+				slots <- struct{}{}
+				go func() {
+					defer func() {
+						<-slots
+						close(p.done)
+					}()
+					fetch(p.o)
+				}()
+			}
+			queue <- p
+		}
+	}()
+	out := make(chan Object, threads)
+	go func() {
+		defer close(out)
+		for p := range queue {
+			<-p.done
+			out <- p.o
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,84 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListAllWithPrefetch(t *testing.T) {
+	m, _ := newMem("mem", "", "", "")
+	var expected []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("chunks/%03d", i)
+		_ = m.Put(key, bytes.NewReader([]byte(key)))
+		expected = append(expected, key)
+	}
+	_ = m.Put("other", bytes.NewReader(nil))
+
+	const threads = 8
+	var mu sync.Mutex
+	var running, peak int
+	fetched := make(map[string]bool)
+	ch, err := ListAllWithPrefetch(m, "chunks/", threads, func(o Object) {
+		mu.Lock()
+		if running++; running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		if _, err := get(m, o.Key(), 0, -1); err != nil {
+			t.Errorf("get %s: %s", o.Key(), err)
+		}
+		time.Sleep(time.Millisecond * 5)
+		mu.Lock()
+		running--
+		fetched[o.Key()] = true
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("list with prefetch: %s", err)
+	}
+	var i int
+	for o := range ch {
+		if o == nil {
+			t.Fatalf("listing failed")
+		}
+		mu.Lock()
+		done := fetched[o.Key()]
+		mu.Unlock()
+		if !done {
+			t.Fatalf("%s is sent before fetched", o.Key())
+		}
+		if i >= len(expected) {
+			t.Fatalf("unexpected %s", o.Key())
+		}
+		if o.Key() != expected[i] {
+			t.Fatalf("expect %s at %d, but got %s", expected[i], i, o.Key())
+		}
+		i++
+	}
+	if i != len(expected) || len(fetched) != len(expected) {
+		t.Fatalf("expect %d objects fetched and sent, but got %d and %d", len(expected), len(fetched), i)
+	}
+	if peak != threads {
+		t.Fatalf("expect %d fetches at the same time, but got %d", threads, peak)
+	}
+}
@@ -17,9 +17,12 @@
 package object
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -60,13 +63,22 @@ func (p *withPrefix) Head(key string) (Object, error) {
 	if err != nil {
 		return nil, err
 	}
-	switch po := o.(type) {
+	trimKey(o, len(p.prefix))
+	return o, nil
+}
+
+// trimKey removes the first n bytes of the key of o.
+func trimKey(o Object, n int) {
+	switch o := o.(type) {
 	case *obj:
-		po.key = po.key[len(p.prefix):]
+		o.key = o.key[n:]
 	case *file:
-		po.key = po.key[len(p.prefix):]
+		o.key = o.key[n:]
+	case *describedObj:
+		o.key = o.key[n:]
+	case *hashedObj:
+		o.key = o.key[n:]
 	}
-	return o, nil
 }
 
 func (p *withPrefix) Get(key string, off, limit int64) (io.ReadCloser, error) {
@@ -91,12 +103,7 @@ func (p *withPrefix) List(prefix, marker string, limit int64) ([]Object, error)
 	objs, err := p.os.List(p.prefix+prefix, marker, limit)
 	ln := len(p.prefix)
 	for _, o := range objs {
-		switch p := o.(type) {
-		case *obj:
-			p.key = p.key[ln:]
-		case *file:
-			p.key = p.key[ln:]
-		}
+		trimKey(o, ln)
 	}
 	return objs, err
 }
@@ -114,12 +121,7 @@ func (p *withPrefix) ListAll(prefix, marker string) (<-chan Object, error) {
 	go func() {
 		for o := range r {
 			if o != nil && o.Key() != "" {
-				switch p := o.(type) {
-				case *obj:
-					p.key = p.key[ln:]
-				case *file:
-					p.key = p.key[ln:]
-				}
+				trimKey(o, ln)
 			}
 			r2 <- o
 		}
@@ -142,6 +144,62 @@ func (p *withPrefix) Chown(path string, owner, group string) error {
 	return notSupported
 }
 
+func (p *withPrefix) PutWithMtime(key string, in io.Reader, mtime time.Time) error {
+	return PutWithMtime(p.os, p.prefix+key, in, mtime)
+}
+
+func (p *withPrefix) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	w, ok := p.os.(Watcher)
+	if !ok {
+		return nil, notSupported
+	}
+	ch, err := w.Watch(ctx, p.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Event, cap(ch))
+	go func() {
+		defer close(out)
+		for e := range ch {
+			e.Key = strings.TrimPrefix(e.Key, p.prefix)
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (p *withPrefix) PutWithResult(key string, in io.Reader) (*PutResult, error) {
+	return PutWithResult(p.os, p.prefix+key, in)
+}
+
+func (p *withPrefix) WithContext(ctx context.Context) ObjectStorage {
+	return &withPrefix{WithContext(p.os, ctx), p.prefix}
+}
+
+func (p *withPrefix) CopyRange(dst, src string, offset, length int64) error {
+	return CopyRange(p.os, p.prefix+dst, p.prefix+src, offset, length)
+}
+
+func (p *withPrefix) GetInto(key string, offset int64, buf []byte) (int, error) {
+	return GetInto(p.os, p.prefix+key, offset, buf)
+}
+
+func (p *withPrefix) GetIfMatch(key string, off, limit int64, version string) (io.ReadCloser, string, error) {
+	return GetIfMatch(p.os, p.prefix+key, off, limit, version)
+}
+
+func (p *withPrefix) Swap(a, b string) error {
+	return Swap(p.os, p.prefix+a, p.prefix+b)
+}
+
+func (p *withPrefix) Rename(src, dst string) error {
+	return Rename(p.os, p.prefix+src, p.prefix+dst)
+}
+
 func (p *withPrefix) Chtimes(key string, mtime time.Time) error {
 	if fs, ok := p.os.(FileSystem); ok {
 		return fs.Chtimes(p.prefix+key, mtime)
@@ -149,6 +207,27 @@ func (p *withPrefix) Chtimes(key string, mtime time.Time) error {
 	return notSupported
 }
 
+func (p *withPrefix) DeleteMulti(keys []string) error {
+	d, ok := p.os.(BatchDeleter)
+	if !ok {
+		return notSupported
+	}
+	full := make([]string, len(keys))
+	for i, key := range keys {
+		full[i] = p.prefix + key
+	}
+	err := d.DeleteMulti(full)
+	var be *BulkError
+	if errors.As(err, &be) {
+		errs := make(map[string]error, len(be.Errors))
+		for key, e := range be.Errors {
+			errs[strings.TrimPrefix(key, p.prefix)] = e
+		}
+		return &BulkError{be.Op, errs}
+	}
+	return err
+}
+
 func (p *withPrefix) CreateMultipartUpload(key string) (*MultipartUpload, error) {
 	return p.os.CreateMultipartUpload(p.prefix + key)
 }
@@ -167,10 +246,16 @@ func (p *withPrefix) CompleteUpload(key string, uploadID string, parts []*Part)
 
 func (p *withPrefix) ListUploads(marker string) ([]*PendingPart, string, error) {
 	parts, nextMarker, err := p.os.ListUploads(marker)
+	var ours []*PendingPart
 	for _, part := range parts {
+		// the uploads of other prefixes in the same bucket
+		if !strings.HasPrefix(part.Key, p.prefix) {
+			continue
+		}
 		part.Key = part.Key[len(p.prefix):]
+		ours = append(ours, part)
 	}
-	return parts, nextMarker, err
+	return ours, nextMarker, err
 }
 
 var _ ObjectStorage = &withPrefix{}
@@ -0,0 +1,115 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"sync"
+)
+
+type backgroundKey struct{}
+
+// WithBackground tags ctx for the background operations, e.g. gc, scrub or
+// compaction, whose calls yield the shared limits of a storage (the rate and
+// concurrency of Aliyun) to the foreground ones. Bind it to a storage with
+// WithContext.
+func WithBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+// IsBackground tells whether ctx is tagged by WithBackground.
+func IsBackground(ctx context.Context) bool {
+	bg, _ := ctx.Value(backgroundKey{}).(bool)
+	return bg
+}
+
+// backgroundWeight is how many foreground waiters are served for one
+// background waiter under contention, so the background ones still progress.
+const backgroundWeight = 4
+
+// fairSemaphore hands out its slots to the waiters in a weighted fair queue,
+// the foreground ones are served first except one background waiter for every
+// backgroundWeight foreground ones while both are waiting.
+type fairSemaphore struct {
+	mu   sync.Mutex
+	free int
+	// the waiters of foreground (0) and background (1)
+	queues [2][]chan struct{}
+	// the foreground waiters served since the last background one
+	served int
+}
+
+func newFairSemaphore(n int) *fairSemaphore {
+	return &fairSemaphore{free: n}
+}
+
+// acquire waits for a slot with the priority of ctx, it fails once ctx is
+// done.
+func (s *fairSemaphore) acquire(ctx context.Context) error {
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	q := 0
+	if IsBackground(ctx) {
+		q = 1
+	}
+	ready := make(chan struct{})
+	s.queues[q] = append(s.queues[q], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for i, w := range s.queues[q] {
+		if w == ready {
+			s.queues[q] = append(s.queues[q][:i], s.queues[q][i+1:]...)
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	s.mu.Unlock()
+	// granted after ctx is done, pass it on
+	s.release()
+	return ctx.Err()
+}
+
+// release returns a slot, which is handed to the next waiter if any.
+func (s *fairSemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fg, bg := len(s.queues[0]) > 0, len(s.queues[1]) > 0
+	q := 0
+	switch {
+	case fg && (!bg || s.served < backgroundWeight):
+		if bg {
+			s.served++
+		}
+	case bg:
+		q, s.served = 1, 0
+	default:
+		s.free++
+		return
+	}
+	close(s.queues[q][0])
+	s.queues[q] = s.queues[q][1:]
+}
@@ -0,0 +1,95 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFairSemaphore(t *testing.T) {
+	s := newFairSemaphore(1)
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %s", err)
+	}
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	// queued in order
+	wait := func(name string, ctx context.Context) {
+		s.mu.Lock()
+		n := len(s.queues[0]) + len(s.queues[1])
+		s.mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.acquire(ctx); err != nil {
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			s.release()
+		}()
+		for {
+			s.mu.Lock()
+			queued := len(s.queues[0]) + len(s.queues[1])
+			s.mu.Unlock()
+			if queued > n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	bg := WithBackground(context.Background())
+	canceled, cancel := context.WithCancel(context.Background())
+	wait("b1", bg)
+	wait("b2", bg)
+	wait("x", canceled)
+	for _, name := range []string{"f1", "f2", "f3", "f4", "f5"} {
+		wait(name, context.Background())
+	}
+	cancel()
+	for {
+		s.mu.Lock()
+		queued := len(s.queues[0])
+		s.mu.Unlock()
+		if queued == 5 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.release()
+	wg.Wait()
+	if got := strings.Join(order, ","); got != "f1,f2,f3,f4,b1,f5,b2" {
+		t.Fatalf("served in %s", got)
+	}
+	if s.free != 1 {
+		t.Fatalf("%d slots are free", s.free)
+	}
+
+	if err := s.acquire(canceled); err != nil {
+		t.Fatalf("a free slot should be taken: %s", err)
+	}
+	if err := s.acquire(canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire in a canceled context: %v", err)
+	}
+}
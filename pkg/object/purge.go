@@ -0,0 +1,44 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Purger is implemented by the storages which could remove all the objects
+// at once. Purge does nothing unless confirm is the PurgeToken of the storage.
+type Purger interface {
+	Purge(confirm string) error
+}
+
+// PurgeToken returns the confirmation expected by Purge, which is derived
+// from the storage (with its workdir), so a token can not be reused for
+// another one by accident.
+func PurgeToken(o ObjectStorage) string {
+	h := sha256.Sum256([]byte(o.String()))
+	return "purge-" + hex.EncodeToString(h[:4])
+}
+
+func checkPurgeToken(o ObjectStorage, confirm string) error {
+	if confirm != PurgeToken(o) {
+		return fmt.Errorf("purge %s: confirmation %q does not match", o, confirm)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"io"
+)
+
+// PutResult describes the object just written.
+type PutResult struct {
+	Size int64
+	// checksum of the content in lower case hex, as HashedObject
+	Algo HashAlgo
+	Hash string
+	// ETag returned by the storage, empty if it has no ETag
+	ETag string
+}
+
+// ResultPutter is implemented by the storages reporting the object written
+// by a Put, e.g. with the checksum kept by the storage.
+type ResultPutter interface {
+	PutWithResult(key string, in io.Reader) (*PutResult, error)
+}
+
+// PutWithResult writes the object as Put, and returns its size and checksum
+// without a Head after it. For the storages not reporting them, the content
+// is hashed with DefaultHashAlgo as it's uploaded.
+func PutWithResult(s ObjectStorage, key string, in io.Reader) (*PutResult, error) {
+	if p, ok := s.(ResultPutter); ok {
+		if r, err := p.PutWithResult(key, in); !errors.Is(err, notSupported) {
+			return r, err
+		}
+	}
+	if _, ok := in.(io.ReadSeeker); ok {
+		// it could be read more than once, e.g. by retries, so it's
+		// hashed before the upload
+		sp, err := Spool(in, 0, DefaultHashAlgo)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.Put(key, sp); err != nil {
+			return nil, err
+		}
+		return &PutResult{Size: sp.Size, Algo: DefaultHashAlgo, Hash: sp.Hash}, nil
+	}
+	h, _ := DefaultHashAlgo.New()
+	c := &sizeCounter{Reader: io.TeeReader(in, h)}
+	if err := s.Put(key, c); err != nil {
+		return nil, err
+	}
+	return &PutResult{Size: c.n, Algo: DefaultHashAlgo, Hash: sumOf(h)}, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+)
+
+func TestPutWithResult(t *testing.T) {
+	data := make([]byte, 10<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	sha1Sum, sha256Sum, md5Sum := sha1.Sum(data), sha256.Sum256(data), md5.Sum(data)
+
+	mem, _ := newMem("mem", "", "", "")
+	aliyun := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	for _, c := range []struct {
+		s    ObjectStorage
+		algo HashAlgo
+		sum  string
+	}{
+		{mem, HashSHA256, hex.EncodeToString(sha256Sum[:])},
+		{WithPrefix(mem, "p/"), HashSHA256, hex.EncodeToString(sha256Sum[:])},
+		{aliyun, HashSHA1, hex.EncodeToString(sha1Sum[:])},
+	} {
+		// seekable, and a stream of unknown length
+		for _, in := range []io.Reader{bytes.NewReader(data), iotest.HalfReader(bytes.NewReader(data))} {
+			r, err := PutWithResult(c.s, "obj", in)
+			if err != nil {
+				t.Fatalf("put %s: %s", c.s, err)
+			}
+			if r.Size != int64(len(data)) || r.Algo != c.algo || r.Hash != c.sum {
+				t.Fatalf("%s: expect %d bytes %s:%s, but got %+v", c.s, len(data), c.algo, c.sum, r)
+			}
+			if got, err := get(c.s, "obj", 0, -1); err != nil || got != string(data) {
+				t.Fatalf("%s: get %d bytes: %v", c.s, len(got), err)
+			}
+		}
+	}
+	if algo, sum, err := HashOf(aliyun, "obj", ""); err != nil || algo != HashSHA1 || sum != hex.EncodeToString(sha1Sum[:]) {
+		t.Fatalf("the SHA1 of the drive %s:%s %v", algo, sum, err)
+	}
+
+	// S3 returns the MD5 of the content as ETag
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := md5.New()
+		_, _ = io.Copy(h, r.Body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, h.Sum(nil)))
+	}))
+	defer srv.Close()
+	s3, err := newS3(srv.URL+"/jfs", "ak", "sk", "")
+	if err != nil {
+		t.Fatalf("create s3: %s", err)
+	}
+	r, err := PutWithResult(s3, "obj", iotest.HalfReader(bytes.NewReader(data)))
+	expect := hex.EncodeToString(md5Sum[:])
+	if err != nil || r.Size != int64(len(data)) || r.Algo != HashMD5 || r.Hash != expect || r.ETag != expect {
+		t.Fatalf("s3: expect MD5 %s, but got %+v %v", expect, r, err)
+	}
+}
@@ -99,6 +99,10 @@ func findLen(in io.Reader) (io.Reader, int64, error) {
 			return nil, 0, err
 		}
 		vlen = st.Size()
+	case SizeHinter:
+		if vlen = v.SizeHint(); vlen < 0 {
+			return findLen(struct{ io.Reader }{in})
+		}
 	case io.ReadSeeker:
 		var err error
 		vlen, err = v.Seek(0, 2)
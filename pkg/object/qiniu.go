@@ -31,7 +31,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/qiniu/go-sdk/v7/auth"
 	"github.com/qiniu/go-sdk/v7/storage"
 )
@@ -118,6 +117,11 @@ func (q *qiniu) Put(key string, in io.Reader) error {
 	return formUploader.Put(ctx, &ret, upToken, key, body, vlen, nil)
 }
 
+// PutWithResult is not supported, the uploads are not by s3client.
+func (q *qiniu) PutWithResult(key string, in io.Reader) (*PutResult, error) {
+	return nil, notSupported
+}
+
 func (q *qiniu) Copy(dst, src string) error {
 	return q.bm.Copy(q.bucket, src, q.bucket, dst, true)
 }
@@ -201,7 +205,10 @@ func newQiniu(endpoint, accessKey, secretKey, token string) (ObjectStorage, erro
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	s3client := s3client{bucket, s3.New(ses), ses}
+	s3client, err := newS3Client(bucket, ses, uri.Query())
+	if err != nil {
+		return nil, err
+	}
 
 	cfg := storage.Config{
 		UseHTTPS: uri.Scheme == "https",
@@ -0,0 +1,154 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// Range is a range of an object to read, Limit must be positive.
+type Range struct {
+	Off, Limit int64
+}
+
+// RangesGetter is implemented by the storages reading several ranges of an
+// object in one request, e.g. by the multipart/byteranges responses of HTTP.
+type RangesGetter interface {
+	GetRanges(key string, ranges []Range) ([]io.ReadCloser, error)
+}
+
+// GetRanges reads the ranges of an object, in one request by GetRanges of a
+// RangesGetter, or by a Get for each of them. The readers are in the order
+// of ranges, and all of them should be closed.
+func GetRanges(s ObjectStorage, key string, ranges []Range) ([]io.ReadCloser, error) {
+	for _, r := range ranges {
+		if r.Off < 0 || r.Limit <= 0 {
+			return nil, fmt.Errorf("invalid range %d+%d", r.Off, r.Limit)
+		}
+	}
+	if g, ok := s.(RangesGetter); ok && len(ranges) > 1 {
+		if rs, err := g.GetRanges(key, ranges); !errors.Is(err, notSupported) {
+			return rs, err
+		}
+	}
+	rs := make([]io.ReadCloser, 0, len(ranges))
+	for _, r := range ranges {
+		in, err := s.Get(key, r.Off, r.Limit)
+		if err != nil {
+			for _, in := range rs {
+				_ = in.Close()
+			}
+			return nil, err
+		}
+		rs = append(rs, in)
+	}
+	return rs, nil
+}
+
+// byteRanges is the value of the Range header for the ranges.
+func byteRanges(ranges []Range) string {
+	specs := make([]string, len(ranges))
+	for i, r := range ranges {
+		specs[i] = fmt.Sprintf("%d-%d", r.Off, r.Off+r.Limit-1)
+	}
+	return "bytes=" + strings.Join(specs, ",")
+}
+
+// rangeData is a range of the content returned by a response.
+type rangeData struct {
+	off  int64
+	data []byte
+}
+
+// splitByteRanges returns the ranges in a response of 206, which is either a
+// multipart/byteranges of the ranges or a single range, since the server
+// could reorder or coalesce the ranges requested.
+func splitByteRanges(resp *http.Response, ranges []Range) ([]io.ReadCloser, error) {
+	var parts []rangeData
+	read := func(header string, in io.Reader, max int64) error {
+		first, last, _, err := parseContentRange(header)
+		if err != nil {
+			return err
+		}
+		if last < first {
+			return fmt.Errorf("invalid content range %q", header)
+		}
+		if last-first+1 > max {
+			return fmt.Errorf("unexpected range %s, larger than the ranges requested", header)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(in, last-first+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != last-first+1 {
+			return fmt.Errorf("range %s: %w", header, io.ErrUnexpectedEOF)
+		}
+		parts = append(parts, rangeData{first, data})
+		return nil
+	}
+	// the bytes between the ranges could be returned with them as well
+	first, last := ranges[0].Off, ranges[0].Off+ranges[0].Limit
+	for _, r := range ranges {
+		if r.Off < first {
+			first = r.Off
+		}
+		if r.Off+r.Limit > last {
+			last = r.Off + r.Limit
+		}
+	}
+	total := last - first
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err == nil && mediaType == "multipart/byteranges" {
+		mr := multipart.NewReader(resp.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("read multipart/byteranges: %s", err)
+			}
+			if err = read(p.Header.Get("Content-Range"), p, total); err != nil {
+				return nil, err
+			}
+		}
+	} else if err = read(resp.Header.Get("Content-Range"), resp.Body, total); err != nil {
+		return nil, err
+	}
+
+	rs := make([]io.ReadCloser, len(ranges))
+	for i, r := range ranges {
+		for _, p := range parts {
+			if p.off <= r.Off && r.Off+r.Limit <= p.off+int64(len(p.data)) {
+				rs[i] = ioutil.NopCloser(bytes.NewReader(p.data[r.Off-p.off : r.Off-p.off+r.Limit]))
+				break
+			}
+		}
+		if rs[i] == nil {
+			return nil, fmt.Errorf("range %d-%d is not in the response", r.Off, r.Off+r.Limit-1)
+		}
+	}
+	return rs, nil
+}
@@ -0,0 +1,143 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readRanges(t *testing.T, rs []io.ReadCloser) []string {
+	t.Helper()
+	var got []string
+	for _, r := range rs {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read range: %s", err)
+		}
+		_ = r.Close()
+		got = append(got, string(data))
+	}
+	return got
+}
+
+func TestGetRanges(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	ranges := []Range{{20, 5}, {2, 3}, {30, 6}}
+	expect := "[klmno 234 uvwxyz]"
+
+	var requests int64
+	var multiRange = true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if !multiRange && strings.Contains(r.Header.Get("Range"), ",") {
+			_, _ = w.Write(data)
+			return
+		}
+		http.ServeContent(w, r, "obj", time.Now(), bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	s := &RestfulStorage{endpoint: srv.URL, signer: sign}
+	rs, err := GetRanges(s, "obj", ranges)
+	if err != nil {
+		t.Fatalf("get ranges: %s", err)
+	}
+	if got := fmt.Sprint(readRanges(t, rs)); got != expect || requests != 1 {
+		t.Fatalf("expect %s in one request, but got %s in %d", expect, got, requests)
+	}
+
+	// read one by one if the server ignores multiple ranges
+	multiRange, requests = false, 0
+	if rs, err = GetRanges(s, "obj", ranges); err != nil {
+		t.Fatalf("get ranges: %s", err)
+	}
+	if got := fmt.Sprint(readRanges(t, rs)); got != expect || requests != 4 {
+		t.Fatalf("expect %s in 4 requests, but got %s in %d", expect, got, requests)
+	}
+
+	aliyun := newTestAliyun(t, newFakeDrive(), defaultAliyunOptions)
+	_ = aliyun.Put("obj", bytes.NewReader(data))
+	if rs, err = GetRanges(aliyun, "obj", ranges); err != nil {
+		t.Fatalf("get ranges from aliyun: %s", err)
+	}
+	if got := fmt.Sprint(readRanges(t, rs)); got != expect {
+		t.Fatalf("expect %s from aliyun, but got %s", expect, got)
+	}
+	if _, err = GetRanges(aliyun, "obj", []Range{{0, 0}}); err == nil {
+		t.Fatalf("empty range should be invalid")
+	}
+}
+
+func TestSplitByteRanges(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	multi := func(parts ...[2]int) *http.Response {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		for _, p := range parts {
+			pw, _ := w.CreatePart(textproto.MIMEHeader{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", p[0], p[1], len(data))}})
+			_, _ = pw.Write(data[p[0] : p[1]+1])
+		}
+		_ = w.Close()
+		return &http.Response{
+			Header: http.Header{"Content-Type": {"multipart/byteranges; boundary=" + w.Boundary()}},
+			Body:   io.NopCloser(&body),
+		}
+	}
+	ranges := []Range{{2, 3}, {20, 5}}
+	for _, c := range []struct {
+		name   string
+		resp   *http.Response
+		expect string
+	}{
+		{"in order", multi([2]int{2, 4}, [2]int{20, 24}), "[234 klmno]"},
+		{"reordered", multi([2]int{20, 24}, [2]int{2, 4}), "[234 klmno]"},
+		{"coalesced", multi([2]int{2, 24}), "[234 klmno]"},
+		{"too large", multi([2]int{0, 30}), ""},
+		{"single range", &http.Response{
+			Header: http.Header{"Content-Range": {"bytes 2-24/36"}},
+			Body:   io.NopCloser(bytes.NewReader(data[2:25])),
+		}, "[234 klmno]"},
+		{"missing range", multi([2]int{2, 4}), ""},
+		{"truncated", &http.Response{
+			Header: http.Header{"Content-Range": {"bytes 2-24/36"}},
+			Body:   io.NopCloser(bytes.NewReader(data[2:10])),
+		}, ""},
+	} {
+		rs, err := splitByteRanges(c.resp, ranges)
+		if c.expect == "" {
+			if err == nil {
+				t.Fatalf("%s: should fail", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got := fmt.Sprint(readRanges(t, rs)); got != c.expect {
+			t.Fatalf("%s: expect %s, but got %s", c.name, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeySuccessor returns the key expected to be read after key, or "" if it's
+// not predictable.
+type KeySuccessor func(key string) string
+
+// NextBlockKey is the KeySuccessor of the blocks written by JuiceFS, which
+// are named as `<dir>/<slice id>_<index>_<size>`. The last block of a slice
+// is usually smaller, so the prediction of it misses.
+func NextBlockKey(key string) string {
+	i := strings.LastIndexByte(key, '/') + 1
+	parts := strings.Split(key[i:], "_")
+	if len(parts) != 3 {
+		return ""
+	}
+	indx, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ""
+	}
+	return key[:i] + parts[0] + "_" + strconv.Itoa(indx+1) + "_" + parts[2]
+}
+
+var errCanceled = errors.New("readahead canceled")
+
+type aheadEntry struct {
+	done     chan struct{}
+	canceled chan struct{}
+	data     []byte
+	err      error
+}
+
+type withReadahead struct {
+	ObjectStorage
+	depth int
+	next  KeySuccessor
+
+	mu    sync.Mutex
+	last  string
+	ahead map[string]*aheadEntry
+}
+
+// WithReadahead returns an object storage which prefetches the next depth
+// objects into memory (as predicted by next) once the objects are read
+// sequentially, to hide the latency of requests. The prefetches are canceled
+// when an object out of the prediction is read, so random reads only cost
+// the prefetches already in flight.
+func WithReadahead(o ObjectStorage, depth int, next KeySuccessor) ObjectStorage {
+	if next == nil {
+		next = NextBlockKey
+	}
+	return &withReadahead{ObjectStorage: o, depth: depth, next: next, ahead: make(map[string]*aheadEntry)}
+}
+
+func (r *withReadahead) fetch(key string, e *aheadEntry) {
+	defer close(e.done)
+	in, err := r.ObjectStorage.Get(key, 0, -1)
+	if err != nil {
+		e.err = err
+		return
+	}
+	defer in.Close()
+	var buf bytes.Buffer
+	p := bufPool.Get().(*[]byte)
+	defer bufPool.Put(p)
+	for {
+		select {
+		case <-e.canceled:
+			e.err = errCanceled
+			return
+		default:
+		}
+		n, err := in.Read(*p)
+		buf.Write((*p)[:n])
+		if err == io.EOF {
+			e.data = buf.Bytes()
+			return
+		} else if err != nil {
+			e.err = err
+			return
+		}
+	}
+}
+
+// prefetch starts the prefetches of the depth objects after key, with the
+// lock held.
+func (r *withReadahead) prefetch(key string) {
+	for i := 0; i < r.depth; i++ {
+		if key = r.next(key); key == "" {
+			return
+		}
+		if _, ok := r.ahead[key]; ok {
+			continue
+		}
+		e := &aheadEntry{done: make(chan struct{}), canceled: make(chan struct{})}
+		r.ahead[key] = e
+		go r.fetch(key, e)
+	}
+}
+
+// drop forgets the prefetch of key with the lock held.
+func (r *withReadahead) drop(key string) {
+	if e, ok := r.ahead[key]; ok {
+		close(e.canceled)
+		delete(r.ahead, key)
+	}
+}
+
+func (r *withReadahead) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r.mu.Lock()
+	e, hit := r.ahead[key]
+	if hit {
+		delete(r.ahead, key)
+		r.prefetch(key)
+	} else if r.last != "" && key == r.next(r.last) {
+		r.prefetch(key)
+	} else {
+		// random reads
+		for k := range r.ahead {
+			r.drop(k)
+		}
+	}
+	r.last = key
+	r.mu.Unlock()
+
+	if hit {
+		<-e.done
+		if e.err == nil {
+			data := e.data
+			if off > int64(len(data)) {
+				off = int64(len(data))
+			}
+			data = data[off:]
+			if limit > 0 && limit < int64(len(data)) {
+				data = data[:limit]
+			}
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+		logger.Debugf("Readahead of %s: %s", key, e.err)
+	}
+	return r.ObjectStorage.Get(key, off, limit)
+}
+
+func (r *withReadahead) Put(key string, in io.Reader) error {
+	r.mu.Lock()
+	r.drop(key)
+	r.mu.Unlock()
+	return r.ObjectStorage.Put(key, in)
+}
+
+func (r *withReadahead) Delete(key string) error {
+	r.mu.Lock()
+	r.drop(key)
+	r.mu.Unlock()
+	return r.ObjectStorage.Delete(key)
+}
+
+var _ ObjectStorage = &withReadahead{}
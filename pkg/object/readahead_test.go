@@ -0,0 +1,135 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingGet counts the Gets of every key.
+type countingGet struct {
+	ObjectStorage
+	sync.Mutex
+	gets map[string]int
+}
+
+func (c *countingGet) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	c.Lock()
+	c.gets[key]++
+	c.Unlock()
+	return c.ObjectStorage.Get(key, off, limit)
+}
+
+func (c *countingGet) count(key string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.gets[key]
+}
+
+func TestNextBlockKey(t *testing.T) {
+	for key, next := range map[string]string{
+		"chunks/0/1/1234_0_4194304":  "chunks/0/1/1234_1_4194304",
+		"chunks/0/1/1234_9_4194304":  "chunks/0/1/1234_10_4194304",
+		"chunks/A1/0/1234_2_1048576": "chunks/A1/0/1234_3_1048576",
+		"chunks/0/1/1234":            "",
+		"chunks/0/1/1234_x_4":        "",
+	} {
+		if n := NextBlockKey(key); n != next {
+			t.Fatalf("next of %s: expect %q, got %q", key, next, n)
+		}
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	c := &countingGet{ObjectStorage: m, gets: make(map[string]int)}
+	key := func(i int) string { return fmt.Sprintf("chunks/0/0/1_%d_6", i) }
+	for i := 0; i < 10; i++ {
+		_ = m.Put(key(i), strings.NewReader(fmt.Sprintf("block%d", i)))
+	}
+	r := WithReadahead(c, 3, nil)
+	ra := r.(*withReadahead)
+	waitPrefetch := func() {
+		for i := 0; i < 100; i++ {
+			ra.mu.Lock()
+			done := true
+			for _, e := range ra.ahead {
+				select {
+				case <-e.done:
+				default:
+					done = false
+				}
+			}
+			ra.mu.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if d, err := get(r, key(i), 0, -1); err != nil || d != fmt.Sprintf("block%d", i) {
+			t.Fatalf("get %s: %q %v", key(i), d, err)
+		}
+		waitPrefetch()
+	}
+	for i := 0; i < 10; i++ {
+		if n := c.count(key(i)); n != 1 {
+			t.Fatalf("%s should be read from the storage once, but got %d", key(i), n)
+		}
+	}
+	// the successors which do not exist
+	if n := c.count(key(10)); n != 1 {
+		t.Fatalf("%s should be prefetched: %d", key(10), n)
+	}
+
+	// ranges are served from the prefetched object
+	_, _ = get(r, key(0), 0, -1)
+	_, _ = get(r, key(1), 0, -1)
+	waitPrefetch()
+	if d, err := get(r, key(2), 2, 3); err != nil || d != "ock" {
+		t.Fatalf("range of %s: %q %v", key(2), d, err)
+	}
+	if n := c.count(key(2)); n != 2 {
+		t.Fatalf("%s should be served from prefetch: %d", key(2), n)
+	}
+
+	// random reads cancel the prefetches
+	waitPrefetch()
+	_, _ = get(r, key(8), 0, -1)
+	ra.mu.Lock()
+	pending := len(ra.ahead)
+	ra.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("the prefetches should be canceled after a random read, %d left", pending)
+	}
+
+	// a prefetched object is not served after overwritten
+	_, _ = get(r, key(0), 0, -1)
+	_, _ = get(r, key(1), 0, -1)
+	waitPrefetch()
+	_ = r.Put(key(2), strings.NewReader("new"))
+	if d, err := get(r, key(2), 0, -1); err != nil || d != "new" {
+		t.Fatalf("get %s after overwritten: %q %v", key(2), d, err)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RecordedOp is a line of the log written by WithRecorder.
+type RecordedOp struct {
+	// the order of the operations started
+	Seq      uint64        `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	// get, put, delete or list
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	// the range of a get, or the marker and limit of a list
+	Off    int64  `json:"off,omitempty"`
+	Limit  int64  `json:"limit,omitempty"`
+	Marker string `json:"marker,omitempty"`
+	// the bytes put or read and their crc32c, or the objects listed
+	Size  int64  `json:"size"`
+	CRC   uint32 `json:"crc32c,omitempty"`
+	Count int    `json:"count,omitempty"`
+	// a get read to the end
+	EOF bool `json:"eof,omitempty"`
+	// the content put, if recorded
+	Data []byte `json:"data,omitempty"`
+	Err  string `json:"err,omitempty"`
+}
+
+type recorder struct {
+	ObjectStorage
+	withData bool
+
+	mu  sync.Mutex
+	seq uint64
+	w   *json.Encoder
+}
+
+// WithRecorder returns an object storage of o which logs the Gets, Puts,
+// Deletes and Lists into w as JSON lines of RecordedOp, to be replayed by
+// Replay when debugging. The content of the Puts is logged only with
+// withData, otherwise they are replayed with zeros of the same size.
+//
+// A Get is logged once its reader is closed, with the bytes read, and only
+// those are read when it's replayed unless it was read to the end.
+func WithRecorder(o ObjectStorage, w io.Writer, withData bool) ObjectStorage {
+	return &recorder{ObjectStorage: o, withData: withData, w: json.NewEncoder(w)}
+}
+
+func (r *recorder) String() string {
+	return fmt.Sprintf("%s(recorded)", r.ObjectStorage)
+}
+
+func (r *recorder) start(op, key string) *RecordedOp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	return &RecordedOp{Seq: r.seq, Time: time.Now(), Op: op, Key: key}
+}
+
+func (r *recorder) log(op *RecordedOp, err error) {
+	op.Duration = time.Since(op.Time)
+	if err != nil {
+		op.Err = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.w.Encode(op); e != nil {
+		logger.Warnf("Record %s %s: %s", op.Op, op.Key, e)
+	}
+}
+
+// crcCounter counts the bytes read from it and their crc32c.
+type crcCounter struct {
+	io.Reader
+	n   int64
+	crc uint32
+	eof bool
+	buf *bytes.Buffer
+}
+
+func (c *crcCounter) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	c.crc = crc32.Update(c.crc, crc32c, p[:n])
+	if c.buf != nil {
+		c.buf.Write(p[:n])
+	}
+	c.eof = err == io.EOF
+	return n, err
+}
+
+type recordedReader struct {
+	crcCounter
+	rc   io.ReadCloser
+	r    *recorder
+	op   *RecordedOp
+	once sync.Once
+}
+
+func (rr *recordedReader) Close() error {
+	err := rr.rc.Close()
+	rr.once.Do(func() {
+		rr.op.Size, rr.op.CRC, rr.op.EOF = rr.n, rr.crc, rr.eof
+		rr.r.log(rr.op, err)
+	})
+	return err
+}
+
+func (r *recorder) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	op := r.start("get", key)
+	op.Off, op.Limit = off, limit
+	in, err := r.ObjectStorage.Get(key, off, limit)
+	if err != nil {
+		r.log(op, err)
+		return nil, err
+	}
+	return &recordedReader{crcCounter: crcCounter{Reader: in}, rc: in, r: r, op: op}, nil
+}
+
+func (r *recorder) Put(key string, in io.Reader) error {
+	op := r.start("put", key)
+	c := &crcCounter{Reader: in}
+	if r.withData {
+		c.buf = bytes.NewBuffer(nil)
+	}
+	var err error
+	if rs, ok := in.(io.ReadSeeker); ok {
+		// read it in advance, to keep it seekable for the storage
+		var pos int64
+		if pos, err = rs.Seek(0, io.SeekCurrent); err == nil {
+			if _, err = io.Copy(io.Discard, c); err == nil {
+				_, err = rs.Seek(pos, io.SeekStart)
+			}
+		}
+		if err == nil {
+			err = r.ObjectStorage.Put(key, rs)
+		}
+	} else {
+		err = r.ObjectStorage.Put(key, c)
+	}
+	op.Size, op.CRC = c.n, c.crc
+	if c.buf != nil {
+		op.Data = c.buf.Bytes()
+	}
+	r.log(op, err)
+	return err
+}
+
+func (r *recorder) Delete(key string) error {
+	op := r.start("delete", key)
+	err := r.ObjectStorage.Delete(key)
+	r.log(op, err)
+	return err
+}
+
+func (r *recorder) List(prefix, marker string, limit int64) ([]Object, error) {
+	op := r.start("list", prefix)
+	op.Marker, op.Limit = marker, limit
+	objs, err := r.ObjectStorage.List(prefix, marker, limit)
+	op.Count = len(objs)
+	r.log(op, err)
+	return objs, err
+}
+
+// Replay executes the operations logged by WithRecorder against o in the
+// order they were started, and calls report with those having different
+// results: failed or not, the bytes read, or the number of objects listed.
+func Replay(log io.Reader, o ObjectStorage, report func(op *RecordedOp, err error)) error {
+	var ops []*RecordedOp
+	s := bufio.NewScanner(log)
+	s.Buffer(nil, 1<<30)
+	for s.Scan() {
+		var op RecordedOp
+		if err := json.Unmarshal(s.Bytes(), &op); err != nil {
+			return fmt.Errorf("decode recorded operation %q: %w", s.Text(), err)
+		}
+		ops = append(ops, &op)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Seq < ops[j].Seq })
+	for _, op := range ops {
+		if err := replayOp(o, op); err != nil {
+			report(op, err)
+		}
+	}
+	return nil
+}
+
+// replayOp returns the difference of the result of op replayed from the
+// recorded one.
+func replayOp(o ObjectStorage, op *RecordedOp) error {
+	var err error
+	var size int64
+	var crc uint32
+	var count int
+	switch op.Op {
+	case "get":
+		var in io.ReadCloser
+		if in, err = o.Get(op.Key, op.Off, op.Limit); err == nil {
+			c := &crcCounter{Reader: in}
+			var r io.Reader = c
+			if !op.EOF {
+				r = io.LimitReader(c, op.Size)
+			}
+			_, err = io.Copy(io.Discard, r)
+			_ = in.Close()
+			size, crc = c.n, c.crc
+		}
+	case "put":
+		data := op.Data
+		if data == nil {
+			data = make([]byte, op.Size)
+		}
+		err = o.Put(op.Key, bytes.NewReader(data))
+		size, crc = int64(len(data)), crc32.Checksum(data, crc32c)
+	case "delete":
+		err = o.Delete(op.Key)
+	case "list":
+		var objs []Object
+		objs, err = o.List(op.Key, op.Marker, op.Limit)
+		count = len(objs)
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	switch {
+	case (err != nil) != (op.Err != ""):
+		return fmt.Errorf("replayed error %v, recorded %q", err, op.Err)
+	case err != nil:
+		return nil
+	case op.Op == "get" && (size != op.Size || crc != op.CRC):
+		return fmt.Errorf("read %d bytes (crc32c %d), recorded %d bytes (crc32c %d)", size, crc, op.Size, op.CRC)
+	case op.Op == "put" && op.Data != nil && crc != op.CRC:
+		return fmt.Errorf("put crc32c %d, recorded %d", crc, op.CRC)
+	case op.Op == "list" && count != op.Count:
+		return fmt.Errorf("listed %d objects, recorded %d", count, op.Count)
+	}
+	return nil
+}
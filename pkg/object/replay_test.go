@@ -0,0 +1,104 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	var log bytes.Buffer
+	s := WithRecorder(m, &log, true)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("dir/%d", i)
+		if err := s.Put(key, strings.NewReader(strings.Repeat(key, i+1))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	_ = s.Put("dir/3", bytes.NewReader([]byte("overwritten")))
+	_ = s.Delete("dir/5")
+	in, _ := s.Get("dir/3", 2, 4)
+	if d, err := io.ReadAll(in); err != nil || string(d) != "erwr" {
+		t.Fatalf("get: %q %v", d, err)
+	}
+	_ = in.Close() // logged once closed
+	in, _ = s.Get("dir/9", 0, -1)
+	_, _ = io.ReadFull(in, make([]byte, 3)) // not read to the end
+	_ = in.Close()
+	if _, err := s.Get("dir/5", 0, -1); err == nil {
+		t.Fatalf("dir/5 should be deleted")
+	}
+	if objs, err := s.List("dir/", "", 100); err != nil || len(objs) != 9 {
+		t.Fatalf("list: %d %v", len(objs), err)
+	}
+	if n := strings.Count(log.String(), "\n"); n != 16 {
+		t.Fatalf("expect 16 operations recorded, but got %d", n)
+	}
+
+	state := func(s ObjectStorage) string {
+		objs, err := s.List("", "", 100)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		var b strings.Builder
+		for _, o := range objs {
+			d, _ := get(s, o.Key(), 0, -1)
+			fmt.Fprintf(&b, "%s=%s;", o.Key(), d)
+		}
+		return b.String()
+	}
+	replayed, _ := newMem("", "", "", "")
+	var diffs []string
+	report := func(op *RecordedOp, err error) {
+		diffs = append(diffs, fmt.Sprintf("%d %s %s: %s", op.Seq, op.Op, op.Key, err))
+	}
+	if err := Replay(bytes.NewReader(log.Bytes()), replayed, report); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	if len(diffs) > 0 {
+		t.Fatalf("replayed with differences: %v", diffs)
+	}
+	if state(replayed) != state(m) {
+		t.Fatalf("replayed state %s, expect %s", state(replayed), state(m))
+	}
+
+	// the differences are reported
+	other, _ := newMem("", "", "", "")
+	_ = other.Put("dir/extra", bytes.NewReader(nil))
+	if err := Replay(bytes.NewReader(log.Bytes()), &failingStore{ObjectStorage: other, bad: map[string]bool{"dir/9": true}}, report); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	if len(diffs) != 2 || !strings.Contains(diffs[0], "get dir/9") || !strings.Contains(diffs[1], "list dir/") {
+		t.Fatalf("expect the get of dir/9 and the list reported, but got %v", diffs)
+	}
+
+	// without the data, the objects are replayed with the same sizes
+	log.Reset()
+	s = WithRecorder(m, &log, false)
+	_ = s.Put("nodata", strings.NewReader("abc"))
+	if err := Replay(&log, replayed, report); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	if o, err := replayed.Head("nodata"); err != nil || o.Size() != 3 {
+		t.Fatalf("head replayed: %v %v", o, err)
+	}
+}
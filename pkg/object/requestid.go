@@ -0,0 +1,98 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// RequestIDHeader is the header carrying the request id of a context to the
+// storages, to find the requests of an operation in their logs.
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context tagged with the request id, which is sent
+// with all the requests made in it and found in the errors of them.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id of ctx, or empty if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ContextBinder is implemented by the storages which could make the calls of
+// an operation in a context, e.g. for its request id or cancellation.
+type ContextBinder interface {
+	// WithContext returns a view of the storage making the calls in ctx.
+	WithContext(ctx context.Context) ObjectStorage
+}
+
+// WithContext returns a view of o making the calls in ctx, or o itself if it
+// doesn't support that.
+func WithContext(o ObjectStorage, ctx context.Context) ObjectStorage {
+	if b, ok := o.(ContextBinder); ok {
+		return b.WithContext(ctx)
+	}
+	return o
+}
+
+// requestIDError is an error of the requests with a request id.
+type requestIDError struct {
+	id  string
+	err error
+}
+
+func (e *requestIDError) Error() string {
+	return fmt.Sprintf("%s (request id %s)", e.err, e.id)
+}
+
+func (e *requestIDError) Unwrap() error { return e.err }
+
+// withRequestID tags err with the request id of ctx, if any.
+func withRequestID(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	id := RequestID(ctx)
+	if id == "" {
+		return err
+	}
+	if e, ok := err.(*requestIDError); ok && e.id == id {
+		return err
+	}
+	return &requestIDError{id, err}
+}
+
+// requestIDTagger sets RequestIDHeader of the requests in a context with a
+// request id, unless it's already set.
+type requestIDTagger struct {
+	http.RoundTripper
+}
+
+func (t *requestIDTagger) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := RequestID(req.Context()); id != "" && req.Header.Get(RequestIDHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(RequestIDHeader, id)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
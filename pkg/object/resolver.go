@@ -0,0 +1,194 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// NameResolver maps the keys to the names stored, e.g. the paths shown in the
+// app of a drive, and back. Key(Name(key)) must be key, so two keys never
+// share a name. The names of the keys under a directory (a prefix ending with
+// `/`) must be under the name of the directory, which is all the listing
+// relies on; the order of the names does not matter.
+type NameResolver interface {
+	Name(key string) string
+	Key(name string) (string, bool)
+}
+
+type withNameResolver struct {
+	ObjectStorage
+	r NameResolver
+}
+
+// WithNameResolver returns an object storage storing the keys by the names of
+// r, so the objects are recognizable when the storage is browsed directly.
+// The Put of a key not recovered from its name fails, as a collision.
+//
+// Since the names may be sorted differently from the keys, a listing loads
+// all the names under the prefix to sort the keys. The names seen are those
+// of the layer below: over WithKeyHashing the resolver gets the hashed keys,
+// and under it the names are hashed into the buckets, while the objects
+// packed by WithPacking are only found in the packs. Place it next to the
+// storage to keep the names browsable.
+func WithNameResolver(o ObjectStorage, r NameResolver) ObjectStorage {
+	return &withNameResolver{o, r}
+}
+
+func (n *withNameResolver) String() string {
+	return fmt.Sprintf("%s(names)", n.ObjectStorage)
+}
+
+// name returns the name of key, which fails if key can't be recovered.
+func (n *withNameResolver) name(key string) (string, error) {
+	name := n.r.Name(key)
+	if k, ok := n.r.Key(name); !ok || k != key {
+		return "", fmt.Errorf("key %s: the name %s is resolved to %q", key, name, k)
+	}
+	return name, nil
+}
+
+func (n *withNameResolver) Head(key string) (Object, error) {
+	o, err := n.ObjectStorage.Head(n.r.Name(key))
+	if err != nil {
+		return nil, err
+	}
+	setKey(o, key)
+	return o, nil
+}
+
+func (n *withNameResolver) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return n.ObjectStorage.Get(n.r.Name(key), off, limit)
+}
+
+func (n *withNameResolver) Put(key string, in io.Reader) error {
+	name, err := n.name(key)
+	if err != nil {
+		return err
+	}
+	return n.ObjectStorage.Put(name, in)
+}
+
+func (n *withNameResolver) Delete(key string) error {
+	return n.ObjectStorage.Delete(n.r.Name(key))
+}
+
+// list returns the objects under prefix after marker, sorted by their keys.
+func (n *withNameResolver) list(prefix, marker string) ([]Object, error) {
+	var dir string
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = n.r.Name(prefix[:i+1])
+	}
+	ch, err := ListAll(n.ObjectStorage, dir, "")
+	if err != nil {
+		return nil, err
+	}
+	var objs []Object
+	for o := range ch {
+		if o == nil {
+			return nil, fmt.Errorf("list %s failed", n.ObjectStorage)
+		}
+		key, ok := n.r.Key(o.Key())
+		if !ok || !strings.HasPrefix(key, prefix) || key <= marker {
+			continue
+		}
+		setKey(o, key)
+		objs = append(objs, o)
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
+	return objs, nil
+}
+
+func (n *withNameResolver) List(prefix, marker string, limit int64) ([]Object, error) {
+	objs, err := n.list(prefix, marker)
+	if int64(len(objs)) > limit {
+		objs = objs[:limit]
+	}
+	return objs, err
+}
+
+func (n *withNameResolver) ListAll(prefix, marker string) (<-chan Object, error) {
+	objs, err := n.list(prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, maxResults)
+	go func() {
+		defer close(out)
+		for _, o := range objs {
+			out <- o
+		}
+	}()
+	return out, nil
+}
+
+func (n *withNameResolver) GetInto(key string, offset int64, buf []byte) (int, error) {
+	return GetInto(n.ObjectStorage, n.r.Name(key), offset, buf)
+}
+
+func (n *withNameResolver) GetIfMatch(key string, off, limit int64, version string) (io.ReadCloser, string, error) {
+	return GetIfMatch(n.ObjectStorage, n.r.Name(key), off, limit, version)
+}
+
+func (n *withNameResolver) Swap(a, b string) error {
+	return Swap(n.ObjectStorage, n.r.Name(a), n.r.Name(b))
+}
+
+func (n *withNameResolver) Rename(src, dst string) error {
+	name, err := n.name(dst)
+	if err != nil {
+		return err
+	}
+	return Rename(n.ObjectStorage, n.r.Name(src), name)
+}
+
+func (n *withNameResolver) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	name, err := n.name(key)
+	if err != nil {
+		return nil, err
+	}
+	return n.ObjectStorage.CreateMultipartUpload(name)
+}
+
+func (n *withNameResolver) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	return n.ObjectStorage.UploadPart(n.r.Name(key), uploadID, num, body)
+}
+
+func (n *withNameResolver) AbortUpload(key string, uploadID string) {
+	n.ObjectStorage.AbortUpload(n.r.Name(key), uploadID)
+}
+
+func (n *withNameResolver) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	return n.ObjectStorage.CompleteUpload(n.r.Name(key), uploadID, parts)
+}
+
+func (n *withNameResolver) ListUploads(marker string) ([]*PendingPart, string, error) {
+	parts, next, err := n.ObjectStorage.ListUploads(marker)
+	var ours []*PendingPart
+	for _, p := range parts {
+		if key, ok := n.r.Key(p.Key); ok {
+			p.Key = key
+			ours = append(ours, p)
+		}
+	}
+	return ours, next, err
+}
+
+var _ ObjectStorage = &withNameResolver{}
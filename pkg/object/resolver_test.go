@@ -0,0 +1,99 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// blockNames shows the blocks of chunks as `slice <id> block <index> (<size>
+// bytes)`, and keeps the other keys.
+type blockNames struct{}
+
+func (blockNames) Name(key string) string {
+	dir, name := path.Split(key)
+	var id, index, size int64
+	if n, _ := fmt.Sscanf(name, "%d_%d_%d", &id, &index, &size); n == 3 && fmt.Sprintf("%d_%d_%d", id, index, size) == name {
+		return fmt.Sprintf("%sslice %d block %d (%d bytes)", dir, id, index, size)
+	}
+	return key
+}
+
+func (blockNames) Key(name string) (string, bool) {
+	dir, base := path.Split(name)
+	var id, index, size int64
+	if n, _ := fmt.Sscanf(base, "slice %d block %d (%d bytes)", &id, &index, &size); n == 3 && fmt.Sprintf("slice %d block %d (%d bytes)", id, index, size) == base {
+		return fmt.Sprintf("%s%d_%d_%d", dir, id, index, size), true
+	}
+	return name, true
+}
+
+func TestNameResolver(t *testing.T) {
+	d := newFakeDrive()
+	mem, _ := newMem("mem", "", "", "")
+	for _, o := range []ObjectStorage{newTestAliyun(t, d, defaultAliyunOptions), mem} {
+		s := WithNameResolver(o, blockNames{})
+		keys := []string{"chunks/0/1/9_0_4", "chunks/0/1/10_0_4", "chunks/0/1/10_1_4", "chunks/0/2/3_0_4", "meta/dump"}
+		for _, k := range keys {
+			if err := s.Put(k, bytes.NewReader([]byte(k))); err != nil {
+				t.Fatalf("put %s: %s", k, err)
+			}
+		}
+		if _, err := o.Head("chunks/0/1/slice 10 block 1 (4 bytes)"); err != nil {
+			t.Fatalf("the block should be stored by its name: %s", err)
+		}
+		// the name of another key
+		if err := s.Put("chunks/0/1/slice 9 block 0 (4 bytes)", bytes.NewReader(nil)); err == nil {
+			t.Fatalf("put of a colliding key should fail")
+		}
+
+		sort.Strings(keys)
+		ch, err := s.ListAll("", "")
+		if err != nil {
+			t.Fatalf("list all: %s", err)
+		}
+		if got := collect(t, ch); !reflect.DeepEqual(got, keys) {
+			t.Fatalf("expect %v, but got %v", keys, got)
+		}
+		objs, err := s.List("chunks/0/1/", "chunks/0/1/10_0_4", 10)
+		if err != nil || len(objs) != 2 || objs[0].Key() != "chunks/0/1/10_1_4" || objs[1].Key() != "chunks/0/1/9_0_4" {
+			t.Fatalf("list after marker: %v %v", objs, err)
+		}
+		for _, k := range keys {
+			if h, err := s.Head(k); err != nil || h.Key() != k {
+				t.Fatalf("head %s: %v %v", k, h, err)
+			}
+			if data, err := get(s, k, 0, -1); err != nil || data != k {
+				t.Fatalf("get %s: %q %v", k, data, err)
+			}
+		}
+		if err := s.Delete(keys[0]); err != nil {
+			t.Fatalf("delete: %s", err)
+		}
+		if _, err := o.Head(blockNames{}.Name(keys[0])); err == nil {
+			t.Fatalf("%s should be deleted", keys[0])
+		}
+	}
+	if d.lookup("/jfs/chunks/0/2/slice 3 block 0 (4 bytes)") == nil {
+		t.Fatalf("the block is not browsable in the drive")
+	}
+}
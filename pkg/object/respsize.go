@@ -0,0 +1,101 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// MaxResponseSize is the most bytes of a response of listing or metadata
+// read from the storages, those larger fail with errResponseTooLarge instead
+// of being parsed, 0 for no limit. It's not applied to the downloads.
+var MaxResponseSize int64 = 256 << 20
+
+var errResponseTooLarge = errors.New("response too large")
+
+// limitedBody fails the reads beyond max bytes.
+type limitedBody struct {
+	io.ReadCloser
+	what string
+	max  int64
+	n    int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n >= b.max {
+		// one more byte tells whether it's just max bytes
+		var one [1]byte
+		if n, _ := b.ReadCloser.Read(one[:]); n == 0 {
+			return 0, io.EOF
+		}
+		return 0, fmt.Errorf("%s: %w, more than %d bytes", b.what, errResponseTooLarge, b.max)
+	}
+	if int64(len(p)) > b.max-b.n {
+		p = p[:b.max-b.n]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// limitResponse checks the size of a response of what, it fails at once if
+// the Content-Length is too large, or the body is limited to max bytes.
+func limitResponse(resp *http.Response, what string, max int64) error {
+	if max <= 0 || resp.Body == nil {
+		return nil
+	}
+	if resp.ContentLength > max {
+		_ = resp.Body.Close()
+		return fmt.Errorf("%s: %w, %d bytes are more than %d", what, errResponseTooLarge, resp.ContentLength, max)
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, what: what, max: max}
+	return nil
+}
+
+// responseLimiter limits the size of the responses to the requests matched.
+type responseLimiter struct {
+	http.RoundTripper
+	match func(req *http.Request) bool
+}
+
+func (l *responseLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := l.RoundTripper.RoundTrip(req)
+	if err != nil || !l.match(req) {
+		return resp, err
+	}
+	if err = limitResponse(resp, req.Method+" "+req.URL.Path, MaxResponseSize); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// limitS3Response limits the size of the responses of listings in the SDK.
+var limitS3Response = func(r *request.Request) {
+	if r.Error != nil || r.HTTPResponse == nil || !strings.HasPrefix(r.Operation.Name, "List") {
+		return
+	}
+	if err := limitResponse(r.HTTPResponse, r.Operation.Name, MaxResponseSize); err != nil {
+		r.Error = awserr.New("ResponseTooLarge", err.Error(), err)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestMaxResponseSize(t *testing.T) {
+	old := MaxResponseSize
+	defer func() { MaxResponseSize = old }()
+	MaxResponseSize = 100
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := 1000
+		if v := r.URL.Query().Get("size"); v != "" {
+			n, _ = strconv.Atoi(v)
+		}
+		body := `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>` + strings.Repeat(" ", n)
+		body = body[:n]
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(n))
+		} else {
+			// sent without the length after flushed
+			_, _ = io.WriteString(w, body[:1])
+			w.(http.Flusher).Flush()
+			body = body[1:]
+		}
+		_, _ = io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &responseLimiter{http.DefaultTransport, func(req *http.Request) bool { return req.Method == "PROPFIND" }}}
+	do := func(method, query string) (string, error) {
+		req, _ := http.NewRequest(method, srv.URL+"/?"+query, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		d, err := io.ReadAll(resp.Body)
+		return string(d), err
+	}
+
+	// rejected by the length before the body is read
+	if _, err := do("PROPFIND", "size=1000"); !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("oversized response: %v", err)
+	}
+	// or once more bytes are read
+	if d, err := do("PROPFIND", "size=1000&chunked=1"); !errors.Is(err, errResponseTooLarge) || len(d) != 100 {
+		t.Fatalf("oversized chunked response: %d bytes, %v", len(d), err)
+	}
+	if d, err := do("PROPFIND", "size=100&chunked=1"); err != nil || len(d) != 100 {
+		t.Fatalf("response of the max size: %d bytes, %v", len(d), err)
+	}
+	// the others are not limited
+	if d, err := do(http.MethodGet, "size=1000"); err != nil || len(d) != 1000 {
+		t.Fatalf("download: %d bytes, %v", len(d), err)
+	}
+
+	// the listings of S3
+	ses, err := session.NewSession(&aws.Config{Region: aws.String(awsDefaultRegion), Endpoint: aws.String(srv.URL),
+		S3ForcePathStyle: aws.Bool(true), Credentials: credentials.AnonymousCredentials, HTTPClient: httpClient})
+	if err != nil {
+		t.Fatalf("aws session: %s", err)
+	}
+	c, err := newS3Client("bucket", ses, nil)
+	if err != nil {
+		t.Fatalf("s3 client: %s", err)
+	}
+	if _, err := c.List("", "", 10); err == nil || !strings.Contains(err.Error(), errResponseTooLarge.Error()) {
+		t.Fatalf("oversized listing of s3: %v", err)
+	}
+}
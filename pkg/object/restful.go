@@ -140,6 +140,7 @@ func (s *RestfulStorage) request(method, key string, body io.Reader, headers map
 	}
 	now := time.Now().UTC().Format(http.TimeFormat)
 	req.Header.Add("Date", now)
+	req.Header.Set("User-Agent", UserAgent)
 	for key := range headers {
 		req.Header.Add(key, headers[key])
 	}
@@ -222,6 +223,28 @@ func (s *RestfulStorage) Get(key string, off, limit int64) (io.ReadCloser, error
 	return resp.Body, nil
 }
 
+// GetRanges reads the ranges in one request of multiple ranges. The servers
+// not supporting them return the whole object, which is not read, the ranges
+// are read one by one instead.
+func (s *RestfulStorage) GetRanges(key string, ranges []Range) ([]io.ReadCloser, error) {
+	resp, err := s.request("GET", key, nil, map[string]string{"Range": byteRanges(ranges)})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, notSupported
+	}
+	defer cleanup(resp)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return splitByteRanges(resp, ranges)
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	}
+	return nil, parseError(resp)
+}
+
 func (u *RestfulStorage) Put(key string, body io.Reader) error {
 	resp, err := u.request("PUT", key, body, nil)
 	if err != nil {
@@ -0,0 +1,47 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+// Restorer is implemented by the storages with a cold tier, whose objects
+// must be restored before they could be read.
+type Restorer interface {
+	// Restore initiates the retrieval of key, which is readable for days once
+	// it's restored. It's not an error if the retrieval is already initiated.
+	Restore(key string, days int) error
+	// Restored tells whether key could be read.
+	Restored(key string) (bool, error)
+}
+
+// Restore initiates the retrieval of key from the cold tier of o.
+func Restore(o ObjectStorage, key string, days int) error {
+	if r, ok := o.(Restorer); ok {
+		return r.Restore(key, days)
+	}
+	return notSupported
+}
+
+// Restored tells whether key could be read, the objects are always readable
+// in the storages without a cold tier.
+func Restored(o ObjectStorage, key string) (bool, error) {
+	if r, ok := o.(Restorer); ok {
+		return r.Restored(key)
+	}
+	if _, err := o.Head(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
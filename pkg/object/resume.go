@@ -0,0 +1,148 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CursorStore keeps the position of a resumable listing.
+type CursorStore interface {
+	// Load returns the cursor saved, or "" if none.
+	Load() (string, error)
+	// Save replaces the cursor, "" to clear it.
+	Save(cursor string) error
+}
+
+// FileCursor is a CursorStore in a local file.
+type FileCursor string
+
+func (f FileCursor) Load() (string, error) {
+	data, err := os.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+func (f FileCursor) Save(cursor string) error {
+	if cursor == "" {
+		if err := os.Remove(string(f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(string(f)), 0755); err != nil {
+		return err
+	}
+	tmp := string(f) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(cursor), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(f))
+}
+
+// CursorInterval is the number of objects listed between the saves of the
+// cursor of a resumable listing.
+var CursorInterval = 1000
+
+type listCursor struct {
+	Prefix string `json:"prefix"`
+	Marker string `json:"marker"`
+}
+
+// ListAllResumable lists the objects as ListAll, and saves the position of the
+// listing into cursor from time to time, so it continues from there when
+// called again (e.g. after the process is restarted). The cursor is cleared
+// once all the objects are listed, and kept if the listing fails or ctx is
+// canceled.
+//
+// The objects are sent one by one, and an object is taken as handled once the
+// next one is received, so the consumer should handle them in order. Those
+// received but not handled before the interruption are listed again, which
+// is at most one if the listing is stopped by ctx. The cursor is the last key
+// handled, which is only valid as long as the keys before it are unchanged.
+func ListAllResumable(ctx context.Context, o ObjectStorage, prefix string, cursor CursorStore) (<-chan Object, error) {
+	var marker string
+	saved, err := cursor.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load the cursor: %w", err)
+	}
+	if saved != "" {
+		var c listCursor
+		if err = json.Unmarshal([]byte(saved), &c); err != nil {
+			return nil, fmt.Errorf("decode the cursor %q: %w", saved, err)
+		}
+		if c.Prefix != prefix {
+			return nil, fmt.Errorf("the cursor is saved for prefix %q, not %q", c.Prefix, prefix)
+		}
+		marker = c.Marker
+		logger.Infof("Resume listing %s after %q", o, marker)
+	}
+	ch, err := ListAll(o, prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	save := func(key string) {
+		data, _ := json.Marshal(listCursor{prefix, key})
+		if err := cursor.Save(string(data)); err != nil {
+			logger.Warnf("Save the cursor of listing %s at %q: %s", o, key, err)
+		}
+	}
+	out := make(chan Object)
+	go func() {
+		defer close(out)
+		var handled, last string
+		var n int
+		for obj := range ch {
+			select {
+			case out <- obj:
+			case <-ctx.Done():
+				if n > 1 {
+					save(handled)
+				}
+				go func() {
+					for range ch {
+					}
+				}()
+				return
+			}
+			if obj == nil {
+				if n > 1 {
+					save(handled)
+				}
+				return
+			}
+			// the previous one is handled once this one is received
+			if n++; n > 1 {
+				handled = last
+				if (n-1)%CursorInterval == 0 {
+					save(handled)
+				}
+			}
+			last = obj.Key()
+		}
+		if err := cursor.Save(""); err != nil {
+			logger.Warnf("Clear the cursor of listing %s: %s", o, err)
+		}
+	}()
+	return out, nil
+}
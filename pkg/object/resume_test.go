@@ -0,0 +1,104 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListAllResumable(t *testing.T) {
+	old := CursorInterval
+	defer func() { CursorInterval = old }()
+	CursorInterval = 10
+
+	m, _ := newMem("", "", "", "")
+	for i := 0; i < 55; i++ {
+		key := fmt.Sprintf("d%d/k%03d", i%3, i)
+		_ = m.Put(key, strings.NewReader(key))
+	}
+	keys := collect(t, mustList(t, m))
+	cursor := FileCursor(filepath.Join(t.TempDir(), "gc", "cursor"))
+	list := func(ctx context.Context) <-chan Object {
+		ch, err := ListAllResumable(ctx, m, "", cursor)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		return ch
+	}
+	receive := func(ch <-chan Object, n int) []string {
+		var got []string
+		for i := 0; i < n; i++ {
+			got = append(got, (<-ch).Key())
+		}
+		return got
+	}
+
+	// stopped by ctx: only the one in hand is listed again
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := list(ctx)
+	got := receive(ch, 25)
+	cancel()
+	got = append(got, collect(t, ch)...)
+	if resumed := collect(t, list(context.Background())); !reflect.DeepEqual(resumed, keys[len(got)-1:]) {
+		t.Fatalf("resumed after %d objects: %v", len(got), resumed)
+	}
+	if c, err := cursor.Load(); err != nil || c != "" {
+		t.Fatalf("the cursor should be cleared after finished: %q %v", c, err)
+	}
+
+	// killed: resumed from the cursor saved last time
+	ctx, cancel = context.WithCancel(context.Background())
+	killed := list(ctx)
+	receive(killed, 25)
+	resumed := collect(t, list(context.Background()))
+	cancel()
+	for range killed {
+	}
+	if !reflect.DeepEqual(resumed, keys[20:]) {
+		t.Fatalf("resumed after killed: %v", resumed)
+	}
+	seen := make(map[string]bool)
+	for _, key := range resumed {
+		if seen[key] {
+			t.Fatalf("%s is listed twice", key)
+		}
+		seen[key] = true
+	}
+
+	_ = cursor.Save(`{"prefix":"d1/","marker":"d1/k001"}`)
+	if _, err := ListAllResumable(context.Background(), m, "", cursor); err == nil {
+		t.Fatalf("the cursor of another prefix should be refused")
+	}
+	if ch, err := ListAllResumable(context.Background(), m, "d1/", cursor); err != nil {
+		t.Fatalf("resume d1/: %s", err)
+	} else if got := collect(t, ch); len(got) != 17 || got[0] != "d1/k004" {
+		t.Fatalf("resumed d1/: %v", got)
+	}
+}
+
+func mustList(t *testing.T, o ObjectStorage) <-chan Object {
+	ch, err := ListAll(o, "", "")
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	return ch
+}
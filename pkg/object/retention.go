@@ -0,0 +1,209 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Retainer is implemented by the storages locking the objects natively, e.g.
+// S3 Object Lock, which should be enabled for the bucket.
+type Retainer interface {
+	// PutWithRetention writes the object, which can't be deleted or
+	// overwritten before until.
+	PutWithRetention(key string, in io.Reader, until time.Time) error
+}
+
+// PutWithRetention writes the object, which can't be deleted or overwritten
+// before until (write once read many). It's not supported by the storages
+// without Retainer, wrap them by WithRetention to emulate it.
+func PutWithRetention(s ObjectStorage, key string, in io.Reader, until time.Time) error {
+	if r, ok := s.(Retainer); ok {
+		return r.PutWithRetention(key, in, until)
+	}
+	return notSupported
+}
+
+// RetentionGuard is an object storage refusing to delete or overwrite the
+// objects before their retention, as reported by Head (ObjectInfo.RetainUntil).
+//
+// The objects are locked natively by the storages with Retainer. For the
+// others, the retention is emulated by an index in a local file, which only
+// protects the objects from the changes through the guards sharing the index.
+type RetentionGuard struct {
+	ObjectStorage
+	path  string
+	clock Clock
+
+	mu    sync.Mutex
+	index map[string]time.Time
+}
+
+// WithRetention returns a RetentionGuard of o, the retention of the objects
+// not locked natively are kept in the file at index.
+func WithRetention(o ObjectStorage, index string) (*RetentionGuard, error) {
+	return withRetention(o, index, SystemClock)
+}
+
+func withRetention(o ObjectStorage, index string, clock Clock) (*RetentionGuard, error) {
+	g := &RetentionGuard{ObjectStorage: o, path: index, clock: clock, index: make(map[string]time.Time)}
+	data, err := os.ReadFile(index)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &g.index); err != nil {
+			return nil, fmt.Errorf("decode retention index %s: %w", index, err)
+		}
+	}
+	return g, nil
+}
+
+func (g *RetentionGuard) String() string {
+	return fmt.Sprintf("%s(retention)", g.ObjectStorage)
+}
+
+// save writes the index with the lock held, the expired entries are dropped.
+func (g *RetentionGuard) save() error {
+	now := g.clock.Now()
+	for key, until := range g.index {
+		if !until.After(now) {
+			delete(g.index, key)
+		}
+	}
+	data, err := json.Marshal(g.index)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(g.path), 0755); err != nil {
+		return err
+	}
+	tmp := g.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.path)
+}
+
+// retainedUntil returns the retention of key, zero if it's not retained.
+func (g *RetentionGuard) retainedUntil(key string) (time.Time, error) {
+	g.mu.Lock()
+	until, ok := g.index[key]
+	g.mu.Unlock()
+	if ok {
+		return until, nil
+	}
+	if _, ok = g.ObjectStorage.(Retainer); !ok {
+		return time.Time{}, nil
+	}
+	o, err := g.ObjectStorage.Head(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return InfoOf(o).RetainUntil, nil
+}
+
+// check fails if key can't be changed now.
+func (g *RetentionGuard) check(key string) error {
+	until, err := g.retainedUntil(key)
+	if err != nil {
+		return err
+	}
+	if until.After(g.clock.Now()) {
+		return fmt.Errorf("%s is retained until %s: %w", key, until.Format(time.RFC3339), os.ErrPermission)
+	}
+	return nil
+}
+
+func (g *RetentionGuard) PutWithRetention(key string, in io.Reader, until time.Time) error {
+	if err := g.check(key); err != nil {
+		return err
+	}
+	if r, ok := g.ObjectStorage.(Retainer); ok {
+		return r.PutWithRetention(key, in, until)
+	}
+	if err := g.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.index[key] = until
+	if err := g.save(); err != nil {
+		return fmt.Errorf("save the retention of %s: %w", key, err)
+	}
+	return nil
+}
+
+func (g *RetentionGuard) Put(key string, in io.Reader) error {
+	if err := g.check(key); err != nil {
+		return err
+	}
+	return g.ObjectStorage.Put(key, in)
+}
+
+func (g *RetentionGuard) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if err := g.check(key); err != nil {
+		return err
+	}
+	return g.ObjectStorage.CompleteUpload(key, uploadID, parts)
+}
+
+func (g *RetentionGuard) Delete(key string) error {
+	if err := g.check(key); err != nil {
+		return err
+	}
+	if err := g.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.index[key]; ok {
+		delete(g.index, key)
+		if err := g.save(); err != nil {
+			logger.Warnf("Save the retention index %s: %s", g.path, err)
+		}
+	}
+	return nil
+}
+
+// Head reports the retention of the objects in the index.
+func (g *RetentionGuard) Head(key string) (Object, error) {
+	o, err := g.ObjectStorage.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	until, ok := g.index[key]
+	g.mu.Unlock()
+	if !ok {
+		return o, nil
+	}
+	info := InfoOf(o)
+	info.RetainUntil = until
+	return &describedObj{obj{o.Key(), o.Size(), o.Mtime(), o.IsDir()}, info}, nil
+}
+
+var _ Retainer = &RetentionGuard{}
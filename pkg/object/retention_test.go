@@ -0,0 +1,115 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockingStore locks the objects natively as a Retainer.
+type lockingStore struct {
+	ObjectStorage
+	sync.Mutex
+	until map[string]time.Time
+}
+
+func (s *lockingStore) PutWithRetention(key string, in io.Reader, until time.Time) error {
+	if err := s.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	s.Lock()
+	s.until[key] = until
+	s.Unlock()
+	return nil
+}
+
+func (s *lockingStore) Head(key string) (Object, error) {
+	o, err := s.ObjectStorage.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	return &describedObj{obj{o.Key(), o.Size(), o.Mtime(), o.IsDir()}, ObjectInfo{RetainUntil: s.until[key]}}, nil
+}
+
+func TestRetention(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	if err := PutWithRetention(m, "a", strings.NewReader("a"), time.Now()); !errors.Is(err, notSupported) {
+		t.Fatalf("retention of mem should not be supported: %v", err)
+	}
+	lock := &lockingStore{ObjectStorage: m, until: make(map[string]time.Time)}
+	if c := Capabilities(lock); !c.Retention {
+		t.Fatalf("capabilities of native lock: %s", c)
+	}
+
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	for name, o := range map[string]ObjectStorage{"emulated": m, "native": lock} {
+		clock := NewFakeClock(now)
+		index := filepath.Join(t.TempDir(), "retention.json")
+		g, err := withRetention(o, index, clock)
+		if err != nil {
+			t.Fatalf("%s: with retention: %s", name, err)
+		}
+		key := name + "/locked"
+		until := now.Add(24 * time.Hour)
+		if err = PutWithRetention(g, key, strings.NewReader("v1"), until); err != nil {
+			t.Fatalf("%s: put with retention: %s", name, err)
+		}
+		if o, err := g.Head(key); err != nil || !InfoOf(o).RetainUntil.Equal(until) {
+			t.Fatalf("%s: head: %+v %v", name, o, err)
+		}
+		if err = g.Delete(key); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("%s: delete before the retention: %v", name, err)
+		}
+		if err = g.Put(key, strings.NewReader("v2")); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("%s: overwrite before the retention: %v", name, err)
+		}
+		if d, err := get(g, key, 0, -1); err != nil || d != "v1" {
+			t.Fatalf("%s: get: %q %v", name, d, err)
+		}
+		// the others are not retained
+		if err = g.Put(name+"/free", strings.NewReader("x")); err != nil {
+			t.Fatalf("%s: put: %s", name, err)
+		}
+		if err = g.Delete(name + "/free"); err != nil {
+			t.Fatalf("%s: delete: %s", name, err)
+		}
+
+		// the index is kept across the guards
+		if g, err = withRetention(o, index, clock); err != nil {
+			t.Fatalf("%s: reopen: %s", name, err)
+		}
+		if err = g.Delete(key); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("%s: delete before the retention after reopen: %v", name, err)
+		}
+		clock.Advance(25 * time.Hour)
+		if err = g.Delete(key); err != nil {
+			t.Fatalf("%s: delete after the retention: %s", name, err)
+		}
+		if _, err = g.Head(key); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s: %s should be deleted: %v", name, key, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudget is a token bucket of retries shared by the operations of a
+// storage, so a partial outage failing many of them at once doesn't turn
+// into a storm of retries. It holds at most burst tokens and refills one
+// every per/burst, a retry is only made with a token taken. A nil budget
+// allows all the retries.
+type RetryBudget struct {
+	mu     sync.Mutex
+	clock  Clock
+	burst  float64
+	rate   float64 // tokens per nanosecond
+	tokens float64
+	last   time.Time
+}
+
+// NewRetryBudget returns a full budget of burst retries in every period of
+// per.
+func NewRetryBudget(burst int, per time.Duration) *RetryBudget {
+	return newRetryBudget(burst, per, SystemClock)
+}
+
+func newRetryBudget(burst int, per time.Duration, clock Clock) *RetryBudget {
+	return &RetryBudget{clock: clock, burst: float64(burst), rate: float64(burst) / float64(per),
+		tokens: float64(burst), last: clock.Now()}
+}
+
+// Allow takes a token for a retry, it returns false when the budget is
+// exhausted and the failure should be returned instead.
+func (b *RetryBudget) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
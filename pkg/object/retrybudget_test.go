@@ -0,0 +1,92 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	b := newRetryBudget(3, time.Minute, clock)
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("retry %d is not allowed", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatalf("retry allowed out of budget")
+	}
+	clock.Advance(20 * time.Second)
+	if !b.Allow() || b.Allow() {
+		t.Fatalf("expect one retry refilled after 20s")
+	}
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("retry %d is not allowed after refilled", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatalf("refilled more than the burst")
+	}
+	var nb *RetryBudget
+	if !nb.Allow() {
+		t.Fatalf("nil budget should allow all")
+	}
+}
+
+func TestAliyunRetryBudget(t *testing.T) {
+	d := newFakeDrive()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	d.write("/jfs/obj", data)
+	opts := defaultAliyunOptions
+	opts.getRetries = 100
+	opts.retryBudget = newRetryBudget(5, time.Minute, NewFakeClock(time.Now()))
+	s := newTestAliyun(t, d, opts)
+	// every stream breaks, so all the Gets fail once the budget is spent
+	d.wrapOpen = func(nodeID string, r io.ReadCloser) io.ReadCloser {
+		return &brokenReader{r, 100}
+	}
+
+	const gets = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed int
+	for i := 0; i < gets; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := get(s, "obj", 0, -1); err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if failed != gets {
+		t.Fatalf("expect %d failed gets, but got %d", gets, failed)
+	}
+	if n := d.called("Open"); n != gets+5 {
+		t.Fatalf("expect %d retries in the budget, but got %d", 5, n-gets)
+	}
+}
@@ -21,14 +21,16 @@ package object
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -43,6 +45,9 @@ import (
 
 const awsDefaultRegion = "us-east-1"
 
+// the metadata of the mtime set by PutWithMtime
+const s3MtimeMeta = "Mtime"
+
 var disableSha256Func = func(r *request.Request) {
 	if op := r.Operation.Name; r.ClientInfo.ServiceID != "S3" || !(op == "PutObject" || op == "UploadPart") {
 		return
@@ -53,10 +58,16 @@ var disableSha256Func = func(r *request.Request) {
 	r.HTTPRequest.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
 }
 
+// addUserAgent adds UserAgent to the User-Agent of the requests of the SDK.
+var addUserAgent = func(r *request.Request) {
+	request.AddToUserAgent(r, UserAgent)
+}
+
 type s3client struct {
 	bucket string
 	s3     *s3.S3
 	ses    *session.Session
+	sse    s3SSE
 }
 
 func (s *s3client) String() string {
@@ -84,6 +95,7 @@ func (s *s3client) Head(key string) (Object, error) {
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
+	param.SSECustomerAlgorithm, param.SSECustomerKey = s.sse.customer()
 	r, err := s.s3.HeadObject(&param)
 	if err != nil {
 		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
@@ -91,16 +103,28 @@ func (s *s3client) Head(key string) (Object, error) {
 		}
 		return nil, err
 	}
-	return &obj{
+	o := obj{
 		key,
 		*r.ContentLength,
 		*r.LastModified,
 		strings.HasSuffix(key, "/"),
-	}, nil
+	}
+	enc := s3Encryption(r.ServerSideEncryption, r.SSECustomerAlgorithm)
+	// the mtime kept by PutWithMtime, as the metadata
+	var meta map[string]string
+	if v := r.Metadata[s3MtimeMeta]; v != nil {
+		meta = map[string]string{strings.ToLower(s3MtimeMeta): *v}
+	}
+	if enc != "" || r.ObjectLockRetainUntilDate != nil || meta != nil {
+		return &describedObj{o, ObjectInfo{ETag: strings.Trim(aws.StringValue(r.ETag), `"`), Encryption: enc,
+			RetainUntil: aws.TimeValue(r.ObjectLockRetainUntilDate), Metadata: meta}}, nil
+	}
+	return &o, nil
 }
 
 func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	params := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sse.customer()
 	if off > 0 || limit > 0 {
 		var r string
 		if limit > 0 {
@@ -124,16 +148,44 @@ func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (s *s3client) Put(key string, in io.Reader) error {
-	var body io.ReadSeeker
-	if b, ok := in.(io.ReadSeeker); ok {
-		body = b
-	} else {
-		data, err := ioutil.ReadAll(in)
-		if err != nil {
-			return err
-		}
-		body = bytes.NewReader(data)
+	_, err := s.put(key, in, time.Time{}, time.Time{}, "")
+	return err
+}
+
+// PutWithResult writes the object as Put, and returns its ETag and MD5, which
+// is calculated from the content uploaded since the ETag is not the MD5 of
+// the objects encrypted by KMS or SSE-C.
+func (s *s3client) PutWithResult(key string, in io.Reader) (*PutResult, error) {
+	return s.put(key, in, time.Time{}, time.Time{}, HashMD5)
+}
+
+// PutWithMtime keeps mtime in the metadata `mtime` of the object (in
+// RFC3339Nano), which is reported by Head in ObjectInfo.Metadata. The mtime of
+// the object is still the time of upload as in the listing, which can't be
+// changed in S3.
+func (s *s3client) PutWithMtime(key string, in io.Reader, mtime time.Time) error {
+	_, err := s.put(key, in, mtime, time.Time{}, "")
+	return err
+}
+
+// PutWithRetention locks the object in the compliance mode of Object Lock
+// until the time, which requires a bucket with Object Lock enabled.
+func (s *s3client) PutWithRetention(key string, in io.Reader, until time.Time) error {
+	// the MD5 is required with Object Lock
+	_, err := s.put(key, in, time.Time{}, until, HashMD5)
+	return err
+}
+
+// put writes the object with the checksum in algo calculated (none if it's
+// empty), which is an extra pass over a seekable content.
+func (s *s3client) put(key string, in io.Reader, mtime, retainUntil time.Time, algo HashAlgo) (*PutResult, error) {
+	// the length is required, the content of unknown length is spooled
+	sp, err := Spool(in, spoolMemory, algo)
+	if err != nil {
+		return nil, err
 	}
+	defer sp.Close()
+	body := sp.ReadSeeker
 	checksum := generateChecksum(body)
 	mimeType := utils.GuessMimeType(key)
 	params := &s3.PutObjectInput{
@@ -143,8 +195,22 @@ func (s *s3client) Put(key string, in io.Reader) error {
 		ContentType: &mimeType,
 		Metadata:    map[string]*string{checksumAlgr: &checksum},
 	}
-	_, err := s.s3.PutObject(params)
-	return err
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.sse.encryption()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sse.customer()
+	if !mtime.IsZero() {
+		params.Metadata[s3MtimeMeta] = aws.String(mtime.UTC().Format(time.RFC3339Nano))
+	}
+	if !retainUntil.IsZero() {
+		sum, _ := hex.DecodeString(sp.Hash)
+		params.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum))
+		params.ObjectLockMode = aws.String(s3.ObjectLockModeCompliance)
+		params.ObjectLockRetainUntilDate = &retainUntil
+	}
+	resp, err := s.s3.PutObject(params)
+	if err != nil {
+		return nil, err
+	}
+	return &PutResult{Size: sp.Size, Algo: algo, Hash: sp.Hash, ETag: strings.Trim(aws.StringValue(resp.ETag), `"`)}, nil
 }
 
 func (s *s3client) Copy(dst, src string) error {
@@ -154,10 +220,58 @@ func (s *s3client) Copy(dst, src string) error {
 		Key:        &dst,
 		CopySource: &src,
 	}
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.sse.encryption()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sse.customer()
+	params.CopySourceSSECustomerAlgorithm, params.CopySourceSSECustomerKey = s.sse.customer()
 	_, err := s.s3.CopyObject(params)
 	return err
 }
 
+// the largest part copied by UploadPartCopy
+const s3MaxCopyPart = 5 << 30
+
+// CopyRange copies the range of src into dst by UploadPartCopy, so the data
+// is not read through the client.
+func (s *s3client) CopyRange(dst, src string, offset, length int64) error {
+	if length == 0 {
+		return s.Put(dst, bytes.NewReader(nil))
+	}
+	upload, err := s.CreateMultipartUpload(dst)
+	if err != nil {
+		return err
+	}
+	source := s.bucket + "/" + src
+	var parts []*Part
+	for off, end := offset, offset+length; off < end; off += s3MaxCopyPart {
+		last := off + s3MaxCopyPart
+		if last > end {
+			last = end
+		}
+		num := int64(len(parts) + 1)
+		r := fmt.Sprintf("bytes=%d-%d", off, last-1)
+		params := &s3.UploadPartCopyInput{
+			Bucket:          &s.bucket,
+			Key:             &dst,
+			UploadId:        &upload.UploadID,
+			PartNumber:      &num,
+			CopySource:      &source,
+			CopySourceRange: &r,
+		}
+		params.SSECustomerAlgorithm, params.SSECustomerKey = s.sse.customer()
+		params.CopySourceSSECustomerAlgorithm, params.CopySourceSSECustomerKey = s.sse.customer()
+		resp, err := s.s3.UploadPartCopy(params)
+		if err != nil {
+			s.AbortUpload(dst, upload.UploadID)
+			return err
+		}
+		parts = append(parts, &Part{Num: int(num), ETag: *resp.CopyPartResult.ETag})
+	}
+	if err = s.CompleteUpload(dst, upload.UploadID, parts); err != nil {
+		s.AbortUpload(dst, upload.UploadID)
+	}
+	return err
+}
+
 func (s *s3client) Delete(key string) error {
 	param := s3.DeleteObjectInput{
 		Bucket: &s.bucket,
@@ -212,6 +326,8 @@ func (s *s3client) CreateMultipartUpload(key string) (*MultipartUpload, error) {
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.sse.encryption()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sse.customer()
 	resp, err := s.s3.CreateMultipartUpload(params)
 	if err != nil {
 		return nil, err
@@ -228,6 +344,7 @@ func (s *s3client) UploadPart(key string, uploadID string, num int, body []byte)
 		Body:       bytes.NewReader(body),
 		PartNumber: &n,
 	}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sse.customer()
 	resp, err := s.s3.UploadPart(params)
 	if err != nil {
 		return nil, err
@@ -467,7 +584,11 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, fmt.Errorf("Fail to create aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &s3client{bucketName, s3.New(ses), ses}, nil
+	c, err := newS3Client(bucketName, ses, uri.Query())
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
 }
 
 func init() {
@@ -0,0 +1,116 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// the encryption reported by Head for SSE-C
+const s3SSECustomer = "SSE-C"
+
+// s3SSE is the server-side encryption of the objects written to S3, which is
+// SSE-S3 (AES256), SSE-KMS (aws:kms) with an optional key id, or SSE-C with
+// the key of the customer sent with every request of an object.
+type s3SSE struct {
+	mode     string
+	kmsKeyID string
+	key      string
+}
+
+// parseS3SSE reads `sse` (s3, kms or c) and `sse-kms-key-id` from the query
+// of the endpoint, or S3_SSE and S3_SSE_KMS_KEY_ID from the environment. The
+// key of SSE-C is only read from S3_SSE_C_KEY, as 32 bytes or their base64.
+func parseS3SSE(q url.Values) (s3SSE, error) {
+	var sse s3SSE
+	mode, keyID := q.Get("sse"), q.Get("sse-kms-key-id")
+	if mode == "" {
+		mode = os.Getenv("S3_SSE")
+	}
+	if keyID == "" {
+		keyID = os.Getenv("S3_SSE_KMS_KEY_ID")
+	}
+	switch strings.ToLower(mode) {
+	case "":
+	case "s3", "aes256":
+		sse.mode = s3.ServerSideEncryptionAes256
+	case "kms", "aws:kms":
+		sse.mode, sse.kmsKeyID = s3.ServerSideEncryptionAwsKms, keyID
+	case "c", "sse-c":
+		sse.mode, sse.key = s3SSECustomer, os.Getenv("S3_SSE_C_KEY")
+		if k, err := base64.StdEncoding.DecodeString(sse.key); err == nil && len(k) == 32 {
+			sse.key = string(k)
+		}
+		if len(sse.key) != 32 {
+			return sse, fmt.Errorf("invalid S3_SSE_C_KEY: it should be 32 bytes or their base64")
+		}
+	default:
+		return sse, fmt.Errorf("invalid sse: %s, it should be s3, kms or c", mode)
+	}
+	if keyID != "" && sse.mode != s3.ServerSideEncryptionAwsKms {
+		return sse, fmt.Errorf("invalid sse-kms-key-id: %s, it's only for sse=kms", keyID)
+	}
+	return sse, nil
+}
+
+// newS3Client returns the client of bucket encrypting the objects as the
+// query of the endpoint (nil for none) or the environment asks.
+func newS3Client(bucket string, ses *session.Session, q url.Values) (s3client, error) {
+	sse, err := parseS3SSE(q)
+	if err != nil {
+		return s3client{}, err
+	}
+	ses.Handlers.Build.PushBack(addUserAgent)
+	ses.Handlers.Send.PushBack(limitS3Response)
+	return s3client{bucket: bucket, s3: s3.New(ses), ses: ses, sse: sse}, nil
+}
+
+// encryption returns the ServerSideEncryption and SSEKMSKeyId of writes.
+func (e s3SSE) encryption() (*string, *string) {
+	if e.mode == "" || e.mode == s3SSECustomer {
+		return nil, nil
+	}
+	if e.kmsKeyID == "" {
+		return aws.String(e.mode), nil
+	}
+	return aws.String(e.mode), aws.String(e.kmsKeyID)
+}
+
+// customer returns the SSECustomerAlgorithm and SSECustomerKey of all the
+// requests of an object, the SDK adds the MD5 of the key.
+func (e s3SSE) customer() (*string, *string) {
+	if e.mode != s3SSECustomer {
+		return nil, nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(e.key)
+}
+
+// s3Encryption is the encryption of an object as reported by Head.
+func s3Encryption(sse, customerAlgorithm *string) string {
+	if customerAlgorithm != nil && *customerAlgorithm != "" {
+		return s3SSECustomer
+	}
+	return aws.StringValue(sse)
+}
@@ -0,0 +1,171 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockSSE records the encryption headers of requests by the operation, and
+// reports the encryption of the last Put by Head.
+type mockSSE struct {
+	sync.Mutex
+	srv     *httptest.Server
+	headers map[string]http.Header
+}
+
+func newMockSSE(t *testing.T) *mockSSE {
+	m := &mockSSE{headers: make(map[string]http.Header)}
+	m.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		_, _ = io.Copy(io.Discard, r.Body)
+		q := r.URL.Query()
+		op := r.Method
+		switch {
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			op = "CreateMultipartUpload"
+			_, _ = w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == http.MethodPut && q.Has("partNumber"):
+			op = "UploadPart"
+			w.Header().Set("ETag", `"p1"`)
+		case r.Method == http.MethodPut:
+			w.Header().Set("ETag", `"e1"`)
+		case r.Method == http.MethodHead:
+			put := m.headers[http.MethodPut]
+			for _, h := range []string{"X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Customer-Algorithm"} {
+				if v := put.Get(h); v != "" {
+					w.Header().Set(h, v)
+				}
+			}
+			w.Header().Set("ETag", `"e1"`)
+			w.Header().Set("Content-Length", "4")
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		case r.Method == http.MethodGet:
+			_, _ = w.Write([]byte("data"))
+		}
+		sse := make(http.Header)
+		for k, vs := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Server-Side-Encryption") {
+				sse[k] = vs
+			}
+		}
+		m.headers[op] = sse
+	}))
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func newTestSSE(t *testing.T, m *mockSSE, query string) ObjectStorage {
+	old := httpClient
+	// the SDK sends the keys of SSE-C over HTTPS only
+	httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer func() { httpClient = old }()
+	s, err := newS3(m.srv.URL+"/jfs"+query, "ak", "sk", "")
+	if err != nil {
+		t.Fatalf("create s3: %s", err)
+	}
+	return s
+}
+
+func TestS3SSE(t *testing.T) {
+	key := strings.Repeat("k", 32)
+	t.Setenv("S3_SSE_C_KEY", base64.StdEncoding.EncodeToString([]byte(key)))
+	sum := md5.Sum([]byte(key))
+	customer := map[string]string{
+		"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+		"X-Amz-Server-Side-Encryption-Customer-Key":       base64.StdEncoding.EncodeToString([]byte(key)),
+		"X-Amz-Server-Side-Encryption-Customer-Key-Md5":   base64.StdEncoding.EncodeToString(sum[:]),
+	}
+	for _, c := range []struct {
+		query      string
+		encryption string
+		// the headers of the writes, and those of all the requests
+		write, all map[string]string
+	}{
+		{"", "", nil, nil},
+		{"?sse=s3", "AES256", map[string]string{"X-Amz-Server-Side-Encryption": "AES256"}, nil},
+		{"?sse=kms&sse-kms-key-id=k1", "aws:kms", map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "k1"}, nil},
+		{"?sse=c", "SSE-C", nil, customer},
+	} {
+		m := newMockSSE(t)
+		s := newTestSSE(t, m, c.query)
+		if err := s.Put("obj", strings.NewReader("data")); err != nil {
+			t.Fatalf("put %s: %s", c.query, err)
+		}
+		if data, err := get(s, "obj", 0, 4); err != nil || data != "data" {
+			t.Fatalf("get %s: %q %v", c.query, data, err)
+		}
+		o, err := s.Head("obj")
+		if err != nil {
+			t.Fatalf("head %s: %s", c.query, err)
+		}
+		if enc := InfoOf(o).Encryption; enc != c.encryption {
+			t.Fatalf("%s: expect encryption %q, but got %q", c.query, c.encryption, enc)
+		}
+		up, err := s.CreateMultipartUpload("big")
+		if err != nil {
+			t.Fatalf("create upload %s: %s", c.query, err)
+		}
+		if _, err = s.UploadPart("big", up.UploadID, 1, []byte("part")); err != nil {
+			t.Fatalf("upload part %s: %s", c.query, err)
+		}
+
+		for op, writes := range map[string]bool{http.MethodPut: true, "CreateMultipartUpload": true, "UploadPart": false, http.MethodGet: false, http.MethodHead: false} {
+			expect := make(map[string]string)
+			for k, v := range c.all {
+				expect[k] = v
+			}
+			if writes {
+				for k, v := range c.write {
+					expect[k] = v
+				}
+			}
+			got := m.headers[op]
+			if len(got) != len(expect) {
+				t.Fatalf("%s %s: expect headers %v, but got %v", c.query, op, expect, got)
+			}
+			for k, v := range expect {
+				if got.Get(k) != v {
+					t.Fatalf("%s %s: expect %s=%s, but got %q", c.query, op, k, v, got.Get(k))
+				}
+			}
+		}
+	}
+
+	for _, q := range []string{"?sse=des", "?sse=s3&sse-kms-key-id=k1"} {
+		if _, err := newS3("https://127.0.0.1/jfs"+q, "ak", "sk", ""); err == nil {
+			t.Fatalf("%s should be invalid", q)
+		}
+	}
+	t.Setenv("S3_SSE_C_KEY", "short")
+	if _, err := newS3("https://127.0.0.1/jfs?sse=c", "ak", "sk", ""); err == nil {
+		t.Fatalf("a short key of SSE-C should be invalid")
+	}
+	t.Setenv("S3_SSE", "kms")
+	if s, err := newS3("https://127.0.0.1/jfs", "ak", "sk", ""); err != nil || s.(*s3client).sse.mode != "aws:kms" {
+		t.Fatalf("sse from the environment: %v", err)
+	}
+}
@@ -21,37 +21,171 @@ package object
 
 import (
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/juicedata/juicefs/pkg/utils"
 )
 
+// the regions of Scaleway, whose endpoints are s3.<region>.scw.cloud
+var scwRegions = []string{"fr-par", "nl-ams", "pl-waw"}
+
+// the storage classes of Scaleway, GLACIER is the cold tier (C14), whose
+// objects must be restored before read
+var scwStorageClasses = []string{s3.StorageClassStandard, s3.StorageClassOnezoneIa, s3.StorageClassGlacier}
+
 type scw struct {
 	s3client
+	storageClass string
 }
 
 func (s *scw) String() string {
 	return fmt.Sprintf("scw://%s/", s.s3client.bucket)
 }
 
-func newScw(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+func (s *scw) PutWithResult(key string, in io.Reader) (*PutResult, error) {
+	if s.storageClass == "" {
+		return s.s3client.PutWithResult(key, in)
+	}
+	return nil, notSupported
+}
+
+func (s *scw) Put(key string, in io.Reader) error {
+	if s.storageClass == "" {
+		return s.s3client.Put(key, in)
+	}
+	// the length is required, the content of unknown length is spooled
+	sp, err := Spool(in, spoolMemory, "")
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+	body := sp.ReadSeeker
+	checksum := generateChecksum(body)
+	mimeType := utils.GuessMimeType(key)
+	params := &s3.PutObjectInput{
+		Bucket:       &s.bucket,
+		Key:          &key,
+		Body:         body,
+		ContentType:  &mimeType,
+		Metadata:     map[string]*string{checksumAlgr: &checksum},
+		StorageClass: &s.storageClass,
+	}
+	_, err = s.s3.PutObject(params)
+	return err
+}
+
+func (s *scw) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	if s.storageClass == "" {
+		return s.s3client.CreateMultipartUpload(key)
+	}
+	params := &s3.CreateMultipartUploadInput{
+		Bucket:       &s.bucket,
+		Key:          &key,
+		StorageClass: &s.storageClass,
+	}
+	resp, err := s.s3.CreateMultipartUpload(params)
+	if err != nil {
+		return nil, err
+	}
+	return &MultipartUpload{UploadID: *resp.UploadId, MinPartSize: 5 << 20, MaxCount: 10000}, nil
+}
+
+// Restore moves an object from GLACIER back to STANDARD for days.
+func (s *scw) Restore(key string, days int) error {
+	_, err := s.s3.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(s3.TierStandard)},
+		},
+	})
+	if e, ok := err.(awserr.Error); ok && e.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
+
+// Restored tells whether an object is out of GLACIER, or the restore of it
+// is finished.
+func (s *scw) Restored(key string) (bool, error) {
+	r, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
+		return false, err
+	}
+	if r.StorageClass == nil || *r.StorageClass != s3.StorageClassGlacier {
+		return true, nil
+	}
+	return r.Restore != nil && strings.Contains(*r.Restore, `ongoing-request="false"`), nil
+}
+
+func isScwRegion(region string) bool {
+	for _, r := range scwRegions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScwEndpoint accepts `bucket.s3.<region>.scw.cloud`, or `bucket` in the
+// region of SCW_DEFAULT_REGION (fr-par by default), with an optional
+// `?storage-class=` query.
+func parseScwEndpoint(endpoint string) (bucket, region, host string, ssl bool, class string, err error) {
 	if !strings.Contains(endpoint, "://") {
 		endpoint = fmt.Sprintf("https://%s", endpoint)
 	}
 	uri, err := url.ParseRequestURI(endpoint)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid endpoint %s: %s", endpoint, err)
+		return "", "", "", false, "", fmt.Errorf("Invalid endpoint %s: %s", endpoint, err)
 	}
-	ssl := strings.ToLower(uri.Scheme) == "https"
+	ssl = strings.ToLower(uri.Scheme) == "https"
 	hostParts := strings.Split(uri.Host, ".")
-	bucket := hostParts[0]
-	region := hostParts[2]
-	endpoint = uri.Host[len(bucket)+1:]
+	bucket = hostParts[0]
+	if len(hostParts) == 1 {
+		if region = os.Getenv("SCW_DEFAULT_REGION"); region == "" {
+			region = scwRegions[0]
+		}
+		host = fmt.Sprintf("s3.%s.scw.cloud", region)
+	} else {
+		if len(hostParts) < 3 || hostParts[1] != "s3" {
+			return "", "", "", false, "", fmt.Errorf("Invalid endpoint %s, it should be like bucket.s3.fr-par.scw.cloud", endpoint)
+		}
+		region = hostParts[2]
+		host = uri.Host[len(bucket)+1:]
+	}
+	if !isScwRegion(region) {
+		return "", "", "", false, "", fmt.Errorf("Invalid region %s of Scaleway, it should be one of %s", region, strings.Join(scwRegions, ", "))
+	}
+	if class = strings.ToUpper(uri.Query().Get("storage-class")); class != "" {
+		var valid bool
+		for _, c := range scwStorageClasses {
+			valid = valid || c == class
+		}
+		if !valid {
+			return "", "", "", false, "", fmt.Errorf("Invalid storage class %s of Scaleway, it should be one of %s", class, strings.Join(scwStorageClasses, ", "))
+		}
+	}
+	return
+}
+
+func newScw(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	bucket, region, endpoint, ssl, class, err := parseScwEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
 
 	if accessKey == "" {
 		accessKey = os.Getenv("SCW_ACCESS_KEY")
@@ -74,7 +208,11 @@ func newScw(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &scw{s3client{bucket, s3.New(ses), ses}}, nil
+	c, err := newS3Client(bucket, ses, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &scw{c, class}, nil
 }
 
 func init() {
@@ -0,0 +1,169 @@
+//go:build !nos3
+// +build !nos3
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockScw keeps the storage class of objects, which are restored at once.
+type mockScw struct {
+	sync.Mutex
+	srv      *httptest.Server
+	classes  map[string]string
+	restored map[string]bool
+	restores []string
+}
+
+func newMockScw(t *testing.T) *mockScw {
+	m := &mockScw{classes: make(map[string]string), restored: make(map[string]bool)}
+	m.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if !strings.HasPrefix(r.Host, "jfs.s3.nl-ams.scw.cloud") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut:
+			_, _ = io.Copy(io.Discard, r.Body)
+			class := r.Header.Get("X-Amz-Storage-Class")
+			if class == "" {
+				class = "STANDARD"
+			}
+			m.classes[key] = class
+		case r.Method == http.MethodPost && r.URL.Query().Has("restore"):
+			body, _ := io.ReadAll(r.Body)
+			m.restores = append(m.restores, key+" "+string(body))
+			if m.classes[key] != "GLACIER" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`<Error><Code>InvalidObjectState</Code></Error>`))
+				return
+			}
+			if m.restored[key] {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = w.Write([]byte(`<Error><Code>RestoreAlreadyInProgress</Code></Error>`))
+				return
+			}
+			m.restored[key] = true
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodHead:
+			class, ok := m.classes[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("X-Amz-Storage-Class", class)
+			if m.restored[key] {
+				w.Header().Set("X-Amz-Restore", `ongoing-request="false", expiry-date="Fri, 21 Dec 2032 00:00:00 GMT"`)
+			}
+		}
+	}))
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func newTestScw(t *testing.T, m *mockScw, endpoint string) ObjectStorage {
+	addr := m.srv.Listener.Addr().String()
+	old := httpClient
+	// the SDK requires an *http.Transport
+	httpClient = &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}}
+	defer func() { httpClient = old }()
+	s, err := newScw(endpoint, "ak", "sk", "")
+	if err != nil {
+		t.Fatalf("create scw: %s", err)
+	}
+	return s
+}
+
+func TestParseScwEndpoint(t *testing.T) {
+	for endpoint, expected := range map[string]string{
+		"jfs.s3.nl-ams.scw.cloud":                               "jfs nl-ams s3.nl-ams.scw.cloud ",
+		"https://jfs.s3.pl-waw.scw.cloud?storage-class=glacier": "jfs pl-waw s3.pl-waw.scw.cloud GLACIER",
+		"jfs": "jfs fr-par s3.fr-par.scw.cloud ",
+	} {
+		bucket, region, host, ssl, class, err := parseScwEndpoint(endpoint)
+		if err != nil || !ssl || strings.Join([]string{bucket, region, host, class}, " ") != expected {
+			t.Fatalf("parse %s: %s %s %s %s %v", endpoint, bucket, region, host, class, err)
+		}
+	}
+	for _, endpoint := range []string{"jfs.s3.us-east-1.scw.cloud", "jfs.scw.cloud", "jfs.s3.fr-par.scw.cloud?storage-class=DEEP_ARCHIVE"} {
+		if _, _, _, _, _, err := parseScwEndpoint(endpoint); err == nil {
+			t.Fatalf("%s should be invalid", endpoint)
+		}
+	}
+}
+
+func TestScwGlacier(t *testing.T) {
+	m := newMockScw(t)
+	s := newTestScw(t, m, "http://jfs.s3.nl-ams.scw.cloud?storage-class=GLACIER")
+	if err := s.Put("cold", strings.NewReader("data")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if m.classes["cold"] != "GLACIER" {
+		t.Fatalf("the object should be put into GLACIER: %q", m.classes["cold"])
+	}
+	if ok, err := Restored(s, "cold"); err != nil || ok {
+		t.Fatalf("the object in GLACIER should not be readable: %v %v", ok, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := Restore(s, "cold", 3); err != nil {
+			t.Fatalf("restore: %s", err)
+		}
+	}
+	if len(m.restores) != 2 || !strings.Contains(m.restores[0], "<Days>3</Days>") {
+		t.Fatalf("unexpected restore requests: %v", m.restores)
+	}
+	if ok, err := Restored(s, "cold"); err != nil || !ok {
+		t.Fatalf("the object should be restored: %v %v", ok, err)
+	}
+	if _, err := Restored(s, "missing"); err == nil {
+		t.Fatalf("the missing object should not be restored")
+	}
+
+	s = newTestScw(t, m, "http://jfs.s3.nl-ams.scw.cloud")
+	if err := s.Put("hot", strings.NewReader("data")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if m.classes["hot"] != "STANDARD" {
+		t.Fatalf("the object should be put into STANDARD: %q", m.classes["hot"])
+	}
+	if ok, err := Restored(s, "hot"); err != nil || !ok {
+		t.Fatalf("the object in STANDARD should be readable: %v %v", ok, err)
+	}
+	if err := Restore(s, "hot", 1); err == nil {
+		t.Fatalf("the object in STANDARD can not be restored")
+	}
+
+	mem, _ := newMem("", "", "", "")
+	if err := Restore(mem, "a", 1); err != notSupported {
+		t.Fatalf("restore should not be supported without cold tier: %v", err)
+	}
+}
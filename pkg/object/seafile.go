@@ -0,0 +1,297 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type seafileDirent struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	ID    string `json:"id"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+}
+
+type seafileStorage struct {
+	DefaultObjectStorage
+	client  *http.Client
+	server  string
+	token   string
+	repo    string
+	workdir string
+	// the directories known to exist
+	dirs   sync.Map
+	walker *treeWalker
+}
+
+func (s *seafileStorage) String() string {
+	return fmt.Sprintf("seafile://%s/%s/", s.repo, strings.Trim(s.workdir, "/"))
+}
+
+// request sends an authorized request to the Seafile server, status 404 is
+// returned as os.ErrNotExist.
+func (s *seafileStorage) request(ctx context.Context, method, u string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Token "+s.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		err = fmt.Errorf("seafile %s %s: %s: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(data))
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%s: %w", err, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// api calls an API of the library on path p, the JSON response is decoded
+// into response.
+func (s *seafileStorage) api(ctx context.Context, method, api, p string, form url.Values, response interface{}) error {
+	u := fmt.Sprintf("%s/api2/repos/%s/%s?p=%s", s.server, s.repo, api, url.QueryEscape(p))
+	var body io.Reader
+	header := http.Header{}
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+		header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := s.request(ctx, method, u, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
+
+func (s *seafileStorage) path(key string) string {
+	return path.Join(s.workdir, key)
+}
+
+func (s *seafileStorage) listNodes(ctx context.Context, dir string) ([]treeNode, error) {
+	var dirents []seafileDirent
+	if err := s.api(ctx, http.MethodGet, "dir/", dir, nil, &dirents); err != nil {
+		return nil, err
+	}
+	nodes := make([]treeNode, len(dirents))
+	for i, d := range dirents {
+		isDir := d.Type == "dir"
+		if isDir {
+			s.dirs.Store(path.Join(dir, d.Name), true)
+		}
+		nodes[i] = treeNode{path.Join(dir, d.Name), d.Name, isDir, d.Size, time.Unix(d.Mtime, 0), ""}
+	}
+	return nodes, nil
+}
+
+// mkdirAll creates the directory and its parents, the existing ones are cached.
+func (s *seafileStorage) mkdirAll(dir string) error {
+	dir = path.Clean("/" + dir)
+	if dir == "/" {
+		return nil
+	}
+	if _, ok := s.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := s.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	var d seafileDirent
+	err := s.api(ctx, http.MethodGet, "dir/detail/", dir, nil, &d)
+	if errors.Is(err, os.ErrNotExist) {
+		err = s.api(ctx, http.MethodPost, "dir/", dir, url.Values{"operation": {"mkdir"}}, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	s.dirs.Store(dir, true)
+	return nil
+}
+
+func (s *seafileStorage) Head(key string) (Object, error) {
+	var d seafileDirent
+	if err := s.api(ctx, http.MethodGet, "file/detail/", s.path(key), nil, &d); err != nil {
+		return nil, err
+	}
+	return &obj{key, d.Size, time.Unix(d.Mtime, 0), false}, nil
+}
+
+// link gets a download or upload link of the library, which is returned as
+// a JSON string.
+func (s *seafileStorage) link(api, p string) (string, error) {
+	var link string
+	if err := s.api(ctx, http.MethodGet, api, p, nil, &link); err != nil {
+		return "", err
+	}
+	if link == "" {
+		return "", fmt.Errorf("seafile: empty link from %s for %s", api, p)
+	}
+	return link, nil
+}
+
+func (s *seafileStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	link, err := s.link("file/", s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if limit > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+limit-1))
+	} else if off > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := s.request(ctx, http.MethodGet, link, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put gets an upload link of the parent directory, then uploads the content
+// to it, which replaces the existing file atomically.
+func (s *seafileStorage) Put(key string, in io.Reader) error {
+	dir, name := path.Split(s.path(key))
+	dir = path.Clean("/" + dir)
+	if err := s.mkdirAll(dir); err != nil {
+		return err
+	}
+	link, err := s.link("upload-link/", dir)
+	if err != nil {
+		return fmt.Errorf("get upload link: %w", err)
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	_ = w.WriteField("parent_dir", dir)
+	_ = w.WriteField("replace", "1")
+	fw, _ := w.CreateFormFile("file", name)
+	_, _ = fw.Write(data)
+	_ = w.Close()
+	header := http.Header{}
+	header.Set("Content-Type", w.FormDataContentType())
+	resp, err := s.request(ctx, http.MethodPost, link+"?ret-json=1", header, &buf)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", key, err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *seafileStorage) Delete(key string) error {
+	err := s.api(ctx, http.MethodDelete, "file/", s.path(key), nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+func (s *seafileStorage) ListAll(prefix, marker string) (<-chan Object, error) {
+	return s.walker.listAll(ctx, s.workdir, prefix, marker), nil
+}
+
+// seafileToken exchanges the username and password for an API token.
+func seafileToken(client *http.Client, server, username, password string) (string, error) {
+	form := url.Values{"username": {username}, "password": {password}}
+	resp, err := client.PostForm(server+"/api2/auth-token/", form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", fmt.Errorf("seafile login as %s: %s: %s", username, resp.Status, bytes.TrimSpace(data))
+	}
+	var t struct {
+		Token string `json:"token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	return t.Token, nil
+}
+
+// newSeafile creates a storage on a library of Seafile, the endpoint is
+// `https://<server>/<library id>/<path>`. The token is the API token, or it's
+// obtained with accessKey and secretKey as the username and password.
+func newSeafile(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+	}
+	ps := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if ps[0] == "" {
+		return nil, fmt.Errorf("missing library id in endpoint %s", endpoint)
+	}
+	s := &seafileStorage{
+		client:  httpClient,
+		server:  fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		token:   token,
+		repo:    ps[0],
+		workdir: "/",
+	}
+	if len(ps) > 1 {
+		s.workdir = path.Clean("/" + ps[1])
+	}
+	if s.token == "" {
+		if s.token, err = seafileToken(s.client, s.server, accessKey, secretKey); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.mkdirAll(s.workdir); err != nil {
+		return nil, err
+	}
+	s.walker = newTreeWalker(4, s.listNodes)
+	return s, nil
+}
+
+func init() {
+	Register("seafile", newSeafile)
+}
@@ -0,0 +1,247 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockSeafile emulates the subset of Seafile Web API used by seafileStorage.
+type mockSeafile struct {
+	sync.Mutex
+	srv   *httptest.Server
+	repo  string
+	token string
+	dirs  map[string]bool
+	files map[string][]byte
+	// the upload links issued, the value is the parent directory
+	links   map[string]string
+	seq     int
+	uploads int
+}
+
+func newMockSeafile() *mockSeafile {
+	m := &mockSeafile{repo: "repo1", token: "token1", dirs: map[string]bool{"/": true},
+		files: make(map[string][]byte), links: make(map[string]string)}
+	m.srv = httptest.NewServer(m)
+	return m
+}
+
+func (m *mockSeafile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	if r.URL.Path == "/api2/auth-token/" {
+		if r.FormValue("username") == "user" && r.FormValue("password") == "pass" {
+			writeJSON(w, http.StatusOK, map[string]string{"token": m.token})
+		} else {
+			writeJSON(w, http.StatusBadRequest, map[string][]string{"non_field_errors": {"Unable to login with provided credentials."}})
+		}
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/files/") {
+		p := strings.TrimPrefix(r.URL.Path, "/files")
+		data, ok := m.files[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, path.Base(p), time.Time{}, bytes.NewReader(data))
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/upload-api/") {
+		dir, ok := m.links[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		delete(m.links, r.URL.Path)
+		f, fh, err := r.FormFile("file")
+		if err != nil || r.FormValue("parent_dir") != dir || r.FormValue("replace") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(f)
+		m.files[path.Join(dir, fh.Filename)] = data
+		m.uploads++
+		writeJSON(w, http.StatusOK, []map[string]interface{}{{"name": fh.Filename, "size": len(data)}})
+		return
+	}
+	if r.Header.Get("Authorization") != "Token "+m.token {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"detail": "Invalid token"})
+		return
+	}
+	prefix := "/api2/repos/" + m.repo + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error_msg": "Library not found."})
+		return
+	}
+	p := path.Clean("/" + r.URL.Query().Get("p"))
+	notFound := func() { writeJSON(w, http.StatusNotFound, map[string]string{"error_msg": "not found"}) }
+	now := time.Now().Unix()
+	switch api := strings.TrimPrefix(r.URL.Path, prefix); {
+	case api == "dir/" && r.Method == http.MethodGet:
+		if !m.dirs[p] {
+			notFound()
+			return
+		}
+		var ds []seafileDirent
+		for d := range m.dirs {
+			if d != "/" && path.Dir(d) == p {
+				ds = append(ds, seafileDirent{Type: "dir", Name: path.Base(d), Mtime: now})
+			}
+		}
+		for f, data := range m.files {
+			if path.Dir(f) == p {
+				ds = append(ds, seafileDirent{Type: "file", Name: path.Base(f), Size: int64(len(data)), Mtime: now})
+			}
+		}
+		writeJSON(w, http.StatusOK, ds)
+	case api == "dir/" && r.Method == http.MethodPost:
+		if r.FormValue("operation") != "mkdir" || !m.dirs[path.Dir(p)] {
+			notFound()
+			return
+		}
+		m.dirs[p] = true
+		writeJSON(w, http.StatusCreated, "success")
+	case api == "dir/detail/":
+		if !m.dirs[p] {
+			notFound()
+			return
+		}
+		writeJSON(w, http.StatusOK, seafileDirent{Type: "dir", Name: path.Base(p), Mtime: now})
+	case api == "file/detail/":
+		data, ok := m.files[p]
+		if !ok {
+			notFound()
+			return
+		}
+		writeJSON(w, http.StatusOK, seafileDirent{Type: "file", Name: path.Base(p), Size: int64(len(data)), Mtime: now})
+	case api == "file/" && r.Method == http.MethodGet:
+		if _, ok := m.files[p]; !ok {
+			notFound()
+			return
+		}
+		writeJSON(w, http.StatusOK, m.srv.URL+"/files"+p)
+	case api == "file/" && r.Method == http.MethodDelete:
+		if _, ok := m.files[p]; !ok {
+			notFound()
+			return
+		}
+		delete(m.files, p)
+		writeJSON(w, http.StatusOK, "success")
+	case api == "upload-link/":
+		if !m.dirs[p] {
+			notFound()
+			return
+		}
+		m.seq++
+		link := fmt.Sprintf("/upload-api/%d", m.seq)
+		m.links[link] = p
+		writeJSON(w, http.StatusOK, m.srv.URL+link)
+	default:
+		notFound()
+	}
+}
+
+func TestSeafile(t *testing.T) {
+	m := newMockSeafile()
+	defer m.srv.Close()
+	if _, err := newSeafile(m.srv.URL+"/repo1/jfs", "user", "wrong", ""); err == nil {
+		t.Fatalf("login with a wrong password should fail")
+	}
+	if _, err := newSeafile(m.srv.URL+"/repo2/jfs", "", "", m.token); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unknown library: %v", err)
+	}
+	store, err := newSeafile(m.srv.URL+"/repo1/jfs", "user", "pass", "")
+	if err != nil {
+		t.Fatalf("create seafile: %s", err)
+	}
+	s := store.(*seafileStorage)
+
+	if _, err := s.Head("chunks/0/0/1_0_4"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head of not existed object: %v", err)
+	}
+	if _, err := s.Get("chunks/0/0/1_0_4", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get of not existed object: %v", err)
+	}
+	keys := []string{"chunks/0/0/1_0_4", "chunks/0/1/2_0_4", "chunks/1/0/3_0_4", "meta"}
+	for _, k := range keys {
+		if err := s.Put(k, bytes.NewReader([]byte("data-"+k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	if err := s.Put("meta", bytes.NewReader([]byte("new meta"))); err != nil {
+		t.Fatalf("overwrite: %s", err)
+	}
+	m.Lock()
+	if m.uploads != len(keys)+1 || len(m.links) != 0 {
+		t.Fatalf("every put should upload once with a fresh link: %d uploads, %d links left", m.uploads, len(m.links))
+	}
+	m.Unlock()
+	if d, err := get(s, "meta", 0, -1); err != nil || d != "new meta" {
+		t.Fatalf("get meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, 4); err != nil || d != "meta" {
+		t.Fatalf("get range of meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, -1); err != nil || d != "meta" {
+		t.Fatalf("get range of meta: %q %v", d, err)
+	}
+	if o, err := s.Head("chunks/0/1/2_0_4"); err != nil || o.Size() != int64(len("data-chunks/0/1/2_0_4")) {
+		t.Fatalf("head: %v %v", o, err)
+	}
+
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %v, but got %v", keys, got)
+	}
+	// a fresh client creates the missing directories of new objects
+	s2, err := newSeafile(m.srv.URL+"/repo1/jfs", "", "", m.token)
+	if err != nil {
+		t.Fatalf("create seafile: %s", err)
+	}
+	if err := s2.Put("chunks/2/0/4_0_4", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if d, err := get(s, "chunks/2/0/4_0_4", 0, -1); err != nil || d != "data" {
+		t.Fatalf("get: %q %v", d, err)
+	}
+
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete not existed object: %s", err)
+	}
+	if _, err := get(s, "meta", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("meta should be deleted: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// a forward seek within this is done by skipping the bytes of the current
+// stream instead of a new request
+const seekSkipLimit = 1 << 20
+
+// SeekGetter is implemented by the storages which could read an object from
+// any offset, the seeks of the returned reader issue ranged reads.
+type SeekGetter interface {
+	GetSeeker(key string) (io.ReadSeekCloser, error)
+}
+
+// GetSeeker opens an object to be read with seeks, by GetSeeker of a
+// SeekGetter or ranged Gets of the others.
+func GetSeeker(s ObjectStorage, key string) (io.ReadSeekCloser, error) {
+	if g, ok := s.(SeekGetter); ok {
+		return g.GetSeeker(key)
+	}
+	o, err := s.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	return newRangeSeeker(s, key, o.Size()), nil
+}
+
+// rangeSeeker reads an object of size by ranged Gets, a stream is opened at
+// the first read after a seek, so seeking alone issues no request.
+type rangeSeeker struct {
+	s    ObjectStorage
+	key  string
+	size int64
+	pos  int64
+	r    io.ReadCloser
+	// the offset of the next byte of r
+	rpos int64
+}
+
+func newRangeSeeker(s ObjectStorage, key string, size int64) *rangeSeeker {
+	return &rangeSeeker{s: s, key: key, size: size}
+}
+
+func (r *rangeSeeker) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.r != nil && r.pos != r.rpos {
+		if skip := r.pos - r.rpos; skip > 0 && skip <= seekSkipLimit {
+			n, err := io.CopyN(io.Discard, r.r, skip)
+			r.rpos += n
+			if err != nil {
+				r.reset()
+			}
+		} else {
+			r.reset()
+		}
+	}
+	if r.r == nil {
+		in, err := r.s.Get(r.key, r.pos, r.size-r.pos)
+		if err != nil {
+			return 0, err
+		}
+		r.r, r.rpos = in, r.pos
+	}
+	if int64(len(p)) > r.size-r.pos {
+		p = p[:r.size-r.pos]
+	}
+	n, err := r.r.Read(p)
+	r.pos += int64(n)
+	r.rpos = r.pos
+	if err == io.EOF {
+		r.reset()
+		if r.pos < r.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (r *rangeSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.pos, fmt.Errorf("seek %s: invalid whence %d", r.key, whence)
+	}
+	if offset < 0 {
+		return r.pos, errors.New("seek " + r.key + ": negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *rangeSeeker) reset() {
+	if r.r != nil {
+		_ = r.r.Close()
+		r.r = nil
+	}
+}
+
+func (r *rangeSeeker) Close() error {
+	r.reset()
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestGetSeeker(t *testing.T) {
+	data := make([]byte, 3<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	d := newFakeDrive()
+	aliyun := newTestAliyun(t, d, defaultAliyunOptions)
+	mem, _ := newMem("mem", "", "", "")
+	for _, s := range []ObjectStorage{mem, aliyun} {
+		if err := s.Put("obj", bytes.NewReader(data)); err != nil {
+			t.Fatalf("put %s: %s", s, err)
+		}
+		r, err := GetSeeker(s, "obj")
+		if err != nil {
+			t.Fatalf("get seeker of %s: %s", s, err)
+		}
+		opens := d.called("Open")
+		read := func(n int, whence int, offset int64, expect int64) {
+			pos, err := r.Seek(offset, whence)
+			if err != nil || pos != expect {
+				t.Fatalf("%s: seek %d from %d: got %d %v", s, offset, whence, pos, err)
+			}
+			buf := make([]byte, n)
+			if _, err = io.ReadFull(r, buf); err != nil {
+				t.Fatalf("%s: read %d bytes at %d: %s", s, n, pos, err)
+			}
+			if !bytes.Equal(buf, data[pos:pos+int64(n)]) {
+				t.Fatalf("%s: wrong bytes at %d", s, pos)
+			}
+		}
+		read(100, io.SeekStart, 0, 0)
+		read(100, io.SeekCurrent, 1000, 1100)  // short forward, skipped in stream
+		read(1000, io.SeekStart, 2<<20, 2<<20) // far forward
+		read(100, io.SeekStart, 500, 500)      // backward
+		read(100, io.SeekCurrent, -300, 300)   // backward from current
+		read(100, io.SeekEnd, -100, int64(len(data)-100))
+		if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Fatalf("%s: expect EOF at the end, but got %d %v", s, n, err)
+		}
+		if _, err := r.Seek(-1, io.SeekStart); err == nil {
+			t.Fatalf("%s: seek to negative position should fail", s)
+		}
+		if s == aliyun {
+			// the short forward seek is done in the first stream
+			if n := d.called("Open") - opens; n != 5 {
+				t.Fatalf("expect 5 downloads, but got %d", n)
+			}
+		}
+		if err = r.Close(); err != nil {
+			t.Fatalf("close: %s", err)
+		}
+		if _, err := GetSeeker(s, "missing"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s: get seeker of missing object: %v", s, err)
+		}
+	}
+}
@@ -17,12 +17,16 @@
 package object
 
 import (
+	"bytes"
 	"container/heap"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
+	"math"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -205,3 +209,462 @@ func NewSharded(name, endpoint, ak, sk, token string, shards int) (ObjectStorage
 	}
 	return &sharded{stores: stores}, nil
 }
+
+// sizeRouted keeps the objects not larger than threshold in small, and the
+// others in large.
+type sizeRouted struct {
+	DefaultObjectStorage
+	small, large ObjectStorage
+	threshold    int64
+}
+
+// NewSizeRouted returns an object storage which puts the objects up to
+// threshold bytes into small (e.g. a fast one), and the larger ones into
+// large (e.g. a cheap one). The size of an object is not known by its key,
+// so Head and Get look for it in small first, which costs one more request
+// for the objects in large. Putting a large object also deletes the one in
+// small, which could be left by an overwrite, so it's not shadowed.
+func NewSizeRouted(small, large ObjectStorage, threshold int64) ObjectStorage {
+	return &sizeRouted{small: small, large: large, threshold: threshold}
+}
+
+func (s *sizeRouted) String() string {
+	return fmt.Sprintf("size%d://%s,%s", s.threshold, s.small, s.large)
+}
+
+func (s *sizeRouted) Create() error {
+	if err := s.small.Create(); err != nil {
+		return err
+	}
+	return s.large.Create()
+}
+
+func (s *sizeRouted) Head(key string) (Object, error) {
+	o, err := s.small.Head(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.large.Head(key)
+	}
+	return o, err
+}
+
+func (s *sizeRouted) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r, err := s.small.Get(key, off, limit)
+	if err == nil {
+		return r, nil
+	}
+	// not all the storages tell a missing object from other failures
+	if r, err2 := s.large.Get(key, off, limit); err2 == nil {
+		return r, nil
+	}
+	return nil, err
+}
+
+// knownSize returns the bytes left in the reader, -1 if it's not known
+// without reading it.
+func knownSize(in io.Reader) (int64, error) {
+	switch r := in.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), nil
+	case SizeHinter:
+		return r.SizeHint(), nil
+	case io.Seeker:
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1, nil
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1, err
+		}
+		if _, err = r.Seek(cur, io.SeekStart); err != nil {
+			return -1, err
+		}
+		return end - cur, nil
+	}
+	return -1, nil
+}
+
+// Put reads at most threshold+1 bytes to tell the size of the object, unless
+// it's known by the reader.
+func (s *sizeRouted) Put(key string, in io.Reader) error {
+	size, err := knownSize(in)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		head := make([]byte, s.threshold+1)
+		n, err := io.ReadFull(in, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		size = int64(n)
+		if size <= s.threshold {
+			in = bytes.NewReader(head[:n])
+		} else {
+			in = io.MultiReader(bytes.NewReader(head), in)
+		}
+	}
+	// the copy of the other size is removed after the new one is written
+	if size <= s.threshold {
+		if err := s.small.Put(key, in); err != nil {
+			return err
+		}
+		return s.large.Delete(key)
+	}
+	if err := s.large.Put(key, in); err != nil {
+		return err
+	}
+	return s.small.Delete(key)
+}
+
+func (s *sizeRouted) Delete(key string) error {
+	if err := s.small.Delete(key); err != nil {
+		return err
+	}
+	return s.large.Delete(key)
+}
+
+func (s *sizeRouted) ListAll(prefix, marker string) (<-chan Object, error) {
+	return (&sharded{stores: []ObjectStorage{s.small, s.large}}).ListAll(prefix, marker)
+}
+
+// The objects uploaded in parts are always large.
+func (s *sizeRouted) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return s.large.CreateMultipartUpload(key)
+}
+
+func (s *sizeRouted) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	return s.large.UploadPart(key, uploadID, num, body)
+}
+
+func (s *sizeRouted) AbortUpload(key string, uploadID string) {
+	s.large.AbortUpload(key, uploadID)
+}
+
+func (s *sizeRouted) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if err := s.large.CompleteUpload(key, uploadID, parts); err != nil {
+		return err
+	}
+	return s.small.Delete(key)
+}
+
+func (s *sizeRouted) ListUploads(marker string) ([]*PendingPart, string, error) {
+	return s.large.ListUploads(marker)
+}
+
+// Limits is the space of a storage in bytes, Total is 0 if it's unlimited.
+type Limits struct {
+	Used  int64
+	Total int64
+}
+
+// LimitsReporter is implemented by the storages with a quota of space, e.g.
+// the drive of an account.
+type LimitsReporter interface {
+	Limits() (Limits, error)
+}
+
+// poolRefresh is how often the limits of the stores in a pool are queried,
+// the free space is estimated by the bytes written in between.
+var poolRefresh = time.Minute
+
+// pool spreads the objects across the stores by their free space.
+type pool struct {
+	sharded
+	clock Clock
+
+	mu sync.Mutex
+	// the store holding a key, found by Head on the stores in order
+	where   map[string]int
+	uploads map[string]int
+	free    []int64
+	checked time.Time
+}
+
+// NewPool returns an object storage aggregating the stores (e.g. the drives of
+// several accounts) into one namespace. A new object is written into the
+// store with the most free space as reported by LimitsReporter, the stores
+// without it are treated as unlimited. An existing object is overwritten in
+// the store holding it, which is found by asking the stores in order and
+// remembered. The listing is merged from all the stores.
+func NewPool(stores []ObjectStorage) ObjectStorage {
+	return newPool(stores, SystemClock)
+}
+
+func newPool(stores []ObjectStorage, clock Clock) *pool {
+	return &pool{sharded: sharded{stores: stores}, clock: clock,
+		where: make(map[string]int), uploads: make(map[string]int), free: make([]int64, len(stores))}
+}
+
+func (p *pool) String() string {
+	return fmt.Sprintf("pool%d://%s", len(p.stores), p.stores[0])
+}
+
+// refresh queries the limits of the stores with the lock held, a store failed
+// is avoided until the next refresh.
+func (p *pool) refresh() {
+	for i, o := range p.stores {
+		r, ok := o.(LimitsReporter)
+		if !ok {
+			p.free[i] = math.MaxInt64
+			continue
+		}
+		l, err := r.Limits()
+		switch {
+		case err != nil:
+			logger.Warnf("Query the limits of %s: %s", o, err)
+			p.free[i] = -1
+		case l.Total <= 0:
+			p.free[i] = math.MaxInt64
+		default:
+			p.free[i] = l.Total - l.Used
+		}
+	}
+	p.checked = p.clock.Now()
+}
+
+// emptiest returns the store with the most free space.
+func (p *pool) emptiest() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.checked.IsZero() || p.clock.Now().Sub(p.checked) >= poolRefresh {
+		p.refresh()
+	}
+	best := 0
+	for i, free := range p.free {
+		if free > p.free[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// written counts the bytes written into the store i.
+func (p *pool) written(key string, i int, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.where[key] = i
+	if size > 0 && p.free[i] != math.MaxInt64 {
+		p.free[i] -= size
+	}
+}
+
+func (p *pool) forget(key string) {
+	p.mu.Lock()
+	delete(p.where, key)
+	p.mu.Unlock()
+}
+
+// locate returns the store holding key, or os.ErrNotExist.
+func (p *pool) locate(key string) (int, error) {
+	p.mu.Lock()
+	i, ok := p.where[key]
+	p.mu.Unlock()
+	if ok {
+		return i, nil
+	}
+	for i, o := range p.stores {
+		_, err := o.Head(key)
+		if err == nil {
+			p.mu.Lock()
+			p.where[key] = i
+			p.mu.Unlock()
+			return i, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return -1, fmt.Errorf("head %s from %s: %w", key, o, err)
+		}
+	}
+	return -1, os.ErrNotExist
+}
+
+// target returns the store to write key into.
+func (p *pool) target(key string) (int, error) {
+	i, err := p.locate(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return p.emptiest(), nil
+	}
+	return i, err
+}
+
+// find calls op on the store holding key, which is looked up again if the
+// one remembered does not have it any more.
+func (p *pool) find(key string, op func(o ObjectStorage) error) error {
+	i, err := p.locate(key)
+	if err != nil {
+		return err
+	}
+	if err = op(p.stores[i]); errors.Is(err, os.ErrNotExist) {
+		p.forget(key)
+		if i, err = p.locate(key); err != nil {
+			return err
+		}
+		err = op(p.stores[i])
+	}
+	return err
+}
+
+func (p *pool) Head(key string) (o Object, err error) {
+	err = p.find(key, func(s ObjectStorage) error {
+		o, err = s.Head(key)
+		return err
+	})
+	return
+}
+
+func (p *pool) Get(key string, off, limit int64) (r io.ReadCloser, err error) {
+	err = p.find(key, func(s ObjectStorage) error {
+		r, err = s.Get(key, off, limit)
+		return err
+	})
+	return
+}
+
+func (p *pool) Put(key string, in io.Reader) error {
+	i, err := p.target(key)
+	if err != nil {
+		return err
+	}
+	size, err := knownSize(in)
+	if err != nil {
+		return err
+	}
+	if err = p.stores[i].Put(key, in); err != nil {
+		return err
+	}
+	p.written(key, i, size)
+	return nil
+}
+
+// Delete removes key from all the stores, in case it's written into several
+// of them by concurrent Puts.
+func (p *pool) Delete(key string) error {
+	p.forget(key)
+	for _, o := range p.stores {
+		if err := o.Delete(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("delete %s from %s: %w", key, o, err)
+		}
+	}
+	return nil
+}
+
+// ListAll merges the listings of the stores, a key found in several of them
+// is listed once.
+func (p *pool) ListAll(prefix, marker string) (<-chan Object, error) {
+	ch, err := p.sharded.ListAll(prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, 1000)
+	go func() {
+		defer close(out)
+		var last string
+		first := true
+		for o := range ch {
+			if o != nil && !first && o.Key() == last {
+				continue
+			}
+			if o != nil {
+				last, first = o.Key(), false
+			}
+			out <- o
+		}
+	}()
+	return out, nil
+}
+
+func (p *pool) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	i, err := p.target(key)
+	if err != nil {
+		return nil, err
+	}
+	mu, err := p.stores[i].CreateMultipartUpload(key)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.uploads[mu.UploadID] = i
+	p.mu.Unlock()
+	return mu, nil
+}
+
+// upload returns the store of an upload created by the pool.
+func (p *pool) upload(uploadID string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i, ok := p.uploads[uploadID]
+	if !ok {
+		return -1, fmt.Errorf("upload %s is not created by %s", uploadID, p)
+	}
+	return i, nil
+}
+
+func (p *pool) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	i, err := p.upload(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	part, err := p.stores[i].UploadPart(key, uploadID, num, body)
+	if err == nil {
+		p.mu.Lock()
+		if p.free[i] != math.MaxInt64 {
+			p.free[i] -= int64(len(body))
+		}
+		p.mu.Unlock()
+	}
+	return part, err
+}
+
+func (p *pool) AbortUpload(key string, uploadID string) {
+	i, err := p.upload(uploadID)
+	if err != nil {
+		logger.Warnf("Abort %s: %s", key, err)
+		return
+	}
+	p.stores[i].AbortUpload(key, uploadID)
+	p.mu.Lock()
+	delete(p.uploads, uploadID)
+	p.mu.Unlock()
+}
+
+func (p *pool) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	i, err := p.upload(uploadID)
+	if err != nil {
+		return err
+	}
+	if err = p.stores[i].CompleteUpload(key, uploadID, parts); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(p.uploads, uploadID)
+	p.mu.Unlock()
+	p.written(key, i, 0)
+	return nil
+}
+
+// Limits sums up the limits of the stores, it's unlimited if any of them is.
+func (p *pool) Limits() (Limits, error) {
+	var sum Limits
+	unlimited := false
+	for _, o := range p.stores {
+		r, ok := o.(LimitsReporter)
+		if !ok {
+			unlimited = true
+			continue
+		}
+		l, err := r.Limits()
+		if err != nil {
+			return Limits{}, fmt.Errorf("limits of %s: %w", o, err)
+		}
+		sum.Used += l.Used
+		if l.Total <= 0 {
+			unlimited = true
+		}
+		sum.Total += l.Total
+	}
+	if unlimited {
+		sum.Total = 0
+	}
+	return sum, nil
+}
+
+var _ LimitsReporter = &pool{}
@@ -0,0 +1,103 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSizeRouted(t *testing.T) {
+	small, _ := newMem("small", "", "", "")
+	large, _ := newMem("large", "", "", "")
+	s := NewSizeRouted(small, large, 10)
+
+	if err := s.Put("a", bytes.NewReader([]byte("0123456789"))); err != nil {
+		t.Fatalf("put a: %s", err)
+	}
+	// the size is not known by the reader
+	if err := s.Put("b", io.MultiReader(strings.NewReader("0123456789"), strings.NewReader("a"))); err != nil {
+		t.Fatalf("put b: %s", err)
+	}
+	if err := s.Put("c", io.MultiReader(strings.NewReader("01234"))); err != nil {
+		t.Fatalf("put c: %s", err)
+	}
+	for key, in := range map[string]ObjectStorage{"a": small, "b": large, "c": small} {
+		if _, err := in.Head(key); err != nil {
+			t.Fatalf("%s should be in %s: %s", key, in, err)
+		}
+	}
+	if _, err := small.Head("b"); err == nil {
+		t.Fatalf("b should not be in small")
+	}
+	for key, data := range map[string]string{"a": "0123456789", "b": "0123456789a", "c": "01234"} {
+		if d, err := get(s, key, 0, -1); err != nil || d != data {
+			t.Fatalf("get %s: %q %v", key, d, err)
+		}
+		if o, err := s.Head(key); err != nil || o.Size() != int64(len(data)) {
+			t.Fatalf("head %s: %+v %v", key, o, err)
+		}
+	}
+	if d, err := get(s, "b", 9, 2); err != nil || d != "9a" {
+		t.Fatalf("get range of b: %q %v", d, err)
+	}
+
+	// overwriting a small object with a large one
+	if err := s.Put("a", strings.NewReader("0123456789ab")); err != nil {
+		t.Fatalf("overwrite a: %s", err)
+	}
+	if d, err := get(s, "a", 0, -1); err != nil || d != "0123456789ab" {
+		t.Fatalf("get a: %q %v", d, err)
+	}
+
+	// overwriting a large object with a small one
+	if err := s.Put("b", strings.NewReader("012")); err != nil {
+		t.Fatalf("overwrite b: %s", err)
+	}
+	if _, err := large.Head("b"); err == nil {
+		t.Fatalf("the large copy of b should be removed")
+	}
+	if d, err := get(s, "b", 0, -1); err != nil || d != "012" {
+		t.Fatalf("get b: %q %v", d, err)
+	}
+
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	var keys []string
+	for o := range ch {
+		keys = append(keys, o.Key())
+		if o.Key() == "b" && o.Size() != 3 {
+			t.Fatalf("size of b in the listing: %d", o.Size())
+		}
+	}
+	if strings.Join(keys, ",") != "a,b,c" {
+		t.Fatalf("listed keys: %v", keys)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.Delete(key); err != nil {
+			t.Fatalf("delete %s: %s", key, err)
+		}
+		if _, err := s.Head(key); err == nil {
+			t.Fatalf("%s should be deleted", key)
+		}
+	}
+}
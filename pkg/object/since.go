@@ -0,0 +1,148 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SinceLister is implemented by the storages which could filter the objects
+// by modified time while listing.
+type SinceLister interface {
+	ListSince(prefix string, since time.Time) (<-chan Object, error)
+}
+
+// ListSince lists the objects under prefix modified after since, in the same
+// way as ListAll: a nil object is sent when the listing fails. It's done
+// natively if the storage is a SinceLister, otherwise the result of ListAll
+// (or List page by page) is filtered.
+func ListSince(o ObjectStorage, prefix string, since time.Time) (<-chan Object, error) {
+	if l, ok := o.(SinceLister); ok {
+		return l.ListSince(prefix, since)
+	}
+	in, err := o.ListAll(prefix, "")
+	if errors.Is(err, notSupported) {
+		in, err = listPages(o, prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, 10240)
+	go func() {
+		for obj := range in {
+			if obj == nil || obj.Mtime().After(since) {
+				out <- obj
+			}
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+// RecentLister is implemented by the storages which could list the objects
+// in the order of modified time.
+type RecentLister interface {
+	// ListRecent returns the n objects under prefix modified last, the newest
+	// first.
+	ListRecent(prefix string, n int) ([]Object, error)
+}
+
+// ListRecent returns the n objects under prefix modified last, the newest
+// first, e.g. to watch the recent writes into a volume. It's done natively if
+// the storage is a RecentLister, otherwise the result of ListAll (or List page
+// by page) is streamed through a heap of n objects.
+func ListRecent(o ObjectStorage, prefix string, n int) ([]Object, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	if l, ok := o.(RecentLister); ok {
+		return l.ListRecent(prefix, n)
+	}
+	in, err := o.ListAll(prefix, "")
+	if errors.Is(err, notSupported) {
+		in, err = listPages(o, prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	newest := &oldestFirst{}
+	for obj := range in {
+		if obj == nil {
+			return nil, fmt.Errorf("list %s under %q failed", o, prefix)
+		}
+		if newest.Len() < n {
+			heap.Push(newest, obj)
+		} else if obj.Mtime().After(newest.objs[0].Mtime()) {
+			newest.objs[0] = obj
+			heap.Fix(newest, 0)
+		}
+	}
+	objs := make([]Object, newest.Len())
+	for i := len(objs) - 1; i >= 0; i-- {
+		objs[i] = heap.Pop(newest).(Object)
+	}
+	return objs, nil
+}
+
+// oldestFirst is a heap of objects with the oldest on the top.
+type oldestFirst struct {
+	objs []Object
+}
+
+func (h *oldestFirst) Len() int { return len(h.objs) }
+func (h *oldestFirst) Less(i, j int) bool {
+	if mi, mj := h.objs[i].Mtime(), h.objs[j].Mtime(); !mi.Equal(mj) {
+		return mi.Before(mj)
+	}
+	// the ones listed first are kept for the same mtime
+	return h.objs[i].Key() > h.objs[j].Key()
+}
+func (h *oldestFirst) Swap(i, j int)      { h.objs[i], h.objs[j] = h.objs[j], h.objs[i] }
+func (h *oldestFirst) Push(o interface{}) { h.objs = append(h.objs, o.(Object)) }
+func (h *oldestFirst) Pop() interface{} {
+	o := h.objs[len(h.objs)-1]
+	h.objs = h.objs[:len(h.objs)-1]
+	return o
+}
+
+// listPages streams the objects under prefix by calling List until no more
+// objects are returned.
+func listPages(o ObjectStorage, prefix string) (<-chan Object, error) {
+	objs, err := o.List(prefix, "", 1000)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, 1000)
+	go func() {
+		defer close(out)
+		for len(objs) > 0 {
+			for _, obj := range objs {
+				out <- obj
+			}
+			marker := objs[len(objs)-1].Key()
+			if objs, err = o.List(prefix, marker, 1000); err != nil {
+				logger.Errorf("list %s from %q: %s", prefix, marker, err)
+				out <- nil
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,106 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListSince(t *testing.T) {
+	m, _ := newMem("mem", "", "", "")
+	cutoff := time.Now().Add(-time.Hour)
+	var expected []string
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("chunks/%04d", i)
+		_ = m.Put(key, bytes.NewReader([]byte("data")))
+		if i%7 == 0 {
+			expected = append(expected, key)
+		} else {
+			m.(*memStore).objects[key].mtime = cutoff.Add(-time.Second)
+		}
+	}
+	_ = m.Put("other", bytes.NewReader(nil))
+
+	ch, err := ListSince(m, "chunks/", cutoff)
+	if err != nil {
+		t.Fatalf("list since: %s", err)
+	}
+	keys := collect(t, ch)
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expect %d objects, but got %d: %v", len(expected), len(keys), keys)
+	}
+}
+
+func TestListRecent(t *testing.T) {
+	m, _ := newMem("mem", "", "", "")
+	dir := t.TempDir()
+	db, err := newSQLStore("sqlite3", filepath.Join(dir, "recent.db"), "", "")
+	if err != nil {
+		t.Fatalf("sqlite: %s", err)
+	}
+	if c := Capabilities(db); !c.ListRecent {
+		t.Fatalf("capabilities of sql: %s", c)
+	}
+	now := time.Now().Truncate(time.Second)
+	mtime := func(i int) time.Time { return now.Add(-time.Duration(i*37%1000) * time.Second) }
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("chunks/%04d", i)
+		_ = m.Put(key, bytes.NewReader([]byte("data")))
+		m.(*memStore).objects[key].mtime = mtime(i)
+		_ = db.Put(key, bytes.NewReader([]byte("data")))
+		if _, err = db.(*sqlStore).db.Exec("UPDATE jfs_blob SET modified=? WHERE `key`=?", mtime(i), key); err != nil {
+			t.Fatalf("set mtime of %s: %s", key, err)
+		}
+	}
+	// newer than all, but not under the prefix
+	for _, s := range []ObjectStorage{m, db} {
+		_ = s.Put("other", bytes.NewReader(nil))
+	}
+
+	// i*37%1000 is 0, 1, 2... for i = 0, 973, 946...
+	var expected []string
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("chunks/%04d", i*973%1000))
+	}
+	for _, s := range []ObjectStorage{m, db} {
+		objs, err := ListRecent(s, "chunks/", 10)
+		if err != nil {
+			t.Fatalf("list recent of %s: %s", s, err)
+		}
+		var keys []string
+		for i, o := range objs {
+			if !o.Mtime().Equal(now.Add(-time.Duration(i) * time.Second)) {
+				t.Fatalf("mtime of %s in %s: %s", o.Key(), s, o.Mtime())
+			}
+			keys = append(keys, o.Key())
+		}
+		if strings.Join(keys, ",") != strings.Join(expected, ",") {
+			t.Fatalf("newest objects of %s: %v", s, keys)
+		}
+	}
+	if objs, err := ListRecent(m, "chunks/", 0); err != nil || len(objs) != 0 {
+		t.Fatalf("list no objects: %v %v", objs, err)
+	}
+	if objs, err := ListRecent(m, "", 2000); err != nil || len(objs) != 1001 || objs[0].Key() != "other" {
+		t.Fatalf("list more than all: %d %v", len(objs), err)
+	}
+}
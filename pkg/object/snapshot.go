@@ -0,0 +1,187 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errChangedSince is the error of an object changed after the snapshot.
+var errChangedSince = errors.New("changed since the snapshot")
+
+// errReadOnly is the error of the writes to a snapshot.
+var errReadOnly = fmt.Errorf("%w: the snapshot is read-only", notSupported)
+
+type snapshotView struct {
+	ObjectStorage
+	entries map[string]*ManifestEntry
+	keys    []string
+}
+
+// SnapshotView returns a read-only view of o as it was when the manifest was
+// exported (see ExportManifest). Only the objects in the manifest are found,
+// and reading one which is changed since then (in size or mtime, or in
+// checksum if it's read as a whole) fails instead of returning the new
+// content, so a backup from it is consistent or fails.
+func SnapshotView(o ObjectStorage, manifest io.Reader) (ObjectStorage, error) {
+	entries, err := loadManifest(manifest, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return &snapshotView{o, entries, keys}, nil
+}
+
+func (s *snapshotView) String() string {
+	return fmt.Sprintf("%s(snapshot)", s.ObjectStorage)
+}
+
+// sameMtime compares the mtimes in seconds, since some storages return them
+// in lower resolution by Head than by listing.
+func sameMtime(a, b time.Time) bool {
+	return a.Unix() == b.Unix()
+}
+
+// check returns the entry of key, if it's not changed since the snapshot.
+func (s *snapshotView) check(key string) (*ManifestEntry, error) {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	o, err := s.ObjectStorage.Head(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s is deleted: %w", key, errChangedSince)
+	} else if err != nil {
+		return nil, err
+	}
+	if o.Size() != e.Size || !sameMtime(o.Mtime(), e.Mtime) {
+		return nil, fmt.Errorf("%s has %d bytes at %s, but %d at %s: %w", key, o.Size(), o.Mtime(), e.Size, e.Mtime, errChangedSince)
+	}
+	return e, nil
+}
+
+func (s *snapshotView) Head(key string) (Object, error) {
+	e, err := s.check(key)
+	if err != nil {
+		return nil, err
+	}
+	return &obj{e.Key, e.Size, e.Mtime, strings.HasSuffix(e.Key, "/")}, nil
+}
+
+func (s *snapshotView) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	e, err := s.check(key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.ObjectStorage.Get(key, off, limit)
+	if err != nil {
+		return nil, err
+	}
+	if off == 0 && limit < 0 && e.Checksum != "" {
+		return &snapshotReader{ReadCloser: r, e: e, h: crc32.New(crc32c)}, nil
+	}
+	return r, nil
+}
+
+// snapshotReader checks the checksum of an object read as a whole.
+type snapshotReader struct {
+	io.ReadCloser
+	e *ManifestEntry
+	h hash.Hash32
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	_, _ = r.h.Write(p[:n])
+	if err == io.EOF {
+		if sum := strconv.Itoa(int(r.h.Sum32())); sum != r.e.Checksum {
+			return n, fmt.Errorf("checksum of %s is %s, but %s: %w", r.e.Key, sum, r.e.Checksum, errChangedSince)
+		}
+	}
+	return n, err
+}
+
+func (s *snapshotView) List(prefix, marker string, limit int64) ([]Object, error) {
+	var objs []Object
+	i := sort.SearchStrings(s.keys, prefix)
+	if marker > prefix {
+		i = sort.SearchStrings(s.keys, marker)
+	}
+	for ; i < len(s.keys) && int64(len(objs)) < limit; i++ {
+		key := s.keys[i]
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if key <= marker {
+			continue
+		}
+		e := s.entries[key]
+		objs = append(objs, &obj{key, e.Size, e.Mtime, strings.HasSuffix(key, "/")})
+	}
+	return objs, nil
+}
+
+func (s *snapshotView) ListAll(prefix, marker string) (<-chan Object, error) {
+	return nil, notSupported
+}
+
+func (s *snapshotView) Create() error {
+	return nil
+}
+
+func (s *snapshotView) Put(key string, in io.Reader) error {
+	return errReadOnly
+}
+
+func (s *snapshotView) Delete(key string) error {
+	return errReadOnly
+}
+
+func (s *snapshotView) Copy(dst, src string) error {
+	return errReadOnly
+}
+
+func (s *snapshotView) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return nil, errReadOnly
+}
+
+func (s *snapshotView) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	return nil, errReadOnly
+}
+
+func (s *snapshotView) AbortUpload(key string, uploadID string) {}
+
+func (s *snapshotView) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	return errReadOnly
+}
+
+func (s *snapshotView) ListUploads(marker string) ([]*PendingPart, string, error) {
+	return nil, "", nil
+}
@@ -0,0 +1,106 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotView(t *testing.T) {
+	m, _ := newMem("snapshot", "", "", "")
+	put := func(key, data string) {
+		if err := m.Put(key, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	put("a/1", "one")
+	put("a/2", "two")
+	put("a/3", "three")
+	var buf bytes.Buffer
+	if err := ExportManifest(m, "", &buf); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	s, err := SnapshotView(m, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("snapshot: %s", err)
+	}
+
+	// the keys added later are hidden
+	put("a/0", "zero")
+	put("a/4", "four")
+	ch, err := ListAll(s, "a/", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if keys := collect(t, ch); strings.Join(keys, ",") != "a/1,a/2,a/3" {
+		t.Fatalf("keys in the snapshot: %s", keys)
+	}
+	if objs, err := s.List("a/", "a/1", 1); err != nil || len(objs) != 1 || objs[0].Key() != "a/2" {
+		t.Fatalf("list from a marker: %+v %v", objs, err)
+	}
+	if _, err = s.Head("a/0"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head a key added later: %v", err)
+	}
+	if _, err = s.Get("a/4", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get a key added later: %v", err)
+	}
+	if d, err := get(s, "a/2", 0, -1); err != nil || d != "two" {
+		t.Fatalf("get a/2: %q %v", d, err)
+	}
+	if o, err := s.Head("a/3"); err != nil || o.Size() != 5 {
+		t.Fatalf("head a/3: %+v %v", o, err)
+	}
+
+	// the changed and deleted ones fail
+	put("a/1", "ONE!")
+	_ = m.Delete("a/3")
+	if _, err = get(s, "a/1", 0, -1); !errors.Is(err, errChangedSince) {
+		t.Fatalf("get a changed object: %v", err)
+	}
+	if _, err = s.Head("a/3"); !errors.Is(err, errChangedSince) {
+		t.Fatalf("head a deleted object: %v", err)
+	}
+	if err = s.Put("a/5", strings.NewReader("five")); !errors.Is(err, notSupported) {
+		t.Fatalf("put into the snapshot: %v", err)
+	}
+
+	// in the same size and second, the checksum tells it from a whole read
+	var buf2 bytes.Buffer
+	if err := ExportManifest(m, "", &buf2); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	if s, err = SnapshotView(m, &buf2); err != nil {
+		t.Fatalf("snapshot: %s", err)
+	}
+	o, _ := m.Head("a/2")
+	put("a/2", "TWO")
+	mem := m.(*memStore)
+	mem.Lock()
+	mem.objects["a/2"].mtime = o.Mtime()
+	mem.Unlock()
+	if _, err = get(s, "a/2", 0, -1); !errors.Is(err, errChangedSince) {
+		t.Fatalf("get an object changed in place: %v", err)
+	}
+
+	if _, err = SnapshotView(m, strings.NewReader("not json")); err == nil {
+		t.Fatalf("a broken manifest should fail")
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+)
+
+// socksServer is a SOCKS5 proxy with username/password auth, which records
+// the addresses connected.
+type socksServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	addrs []string
+}
+
+func newSocksServer(t *testing.T, user, password string) *socksServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	s := &socksServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c, user, password)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(c net.Conn, user, password string) {
+	defer c.Close()
+	buf := make([]byte, 512)
+	// greeting: VER NMETHODS METHODS, only username/password is accepted
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	_, _ = c.Write([]byte{5, 2})
+	// auth: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	u := make([]byte, buf[1])
+	_, _ = io.ReadFull(c, u)
+	_, _ = io.ReadFull(c, buf[:1])
+	p := make([]byte, buf[0])
+	_, _ = io.ReadFull(c, p)
+	if string(u) != user || string(p) != password {
+		_, _ = c.Write([]byte{1, 1})
+		return
+	}
+	_, _ = c.Write([]byte{1, 0})
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		_, _ = io.ReadFull(c, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		_, _ = io.ReadFull(c, buf[:1])
+		name := make([]byte, buf[0])
+		_, _ = io.ReadFull(c, name)
+		host = string(name)
+	default:
+		return
+	}
+	_, _ = io.ReadFull(c, buf[:2])
+	addr := net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(buf[:2])))
+	s.mu.Lock()
+	s.addrs = append(s.addrs, addr)
+	s.mu.Unlock()
+	up, err := net.Dial("tcp", addr)
+	if err != nil {
+		_, _ = c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer up.Close()
+	_, _ = c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() { _, _ = io.Copy(up, c) }()
+	_, _ = io.Copy(c, up)
+}
+
+func (s *socksServer) connected() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.addrs...)
+}
+
+func TestParseSOCKS5Proxy(t *testing.T) {
+	endpoint, p, err := ParseSOCKS5Proxy("https://s3.local/bucket?socks5-proxy=socks5://u:p@10.0.0.1:1080&region=x")
+	if err != nil || endpoint != "https://s3.local/bucket?region=x" || p.Host != "10.0.0.1:1080" || p.User.Username() != "u" {
+		t.Fatalf("parse: %s %v %v", endpoint, p, err)
+	}
+	os.Setenv("JFS_SOCKS5_PROXY", "10.0.0.2:1080")
+	defer os.Unsetenv("JFS_SOCKS5_PROXY")
+	if _, p, err = ParseSOCKS5Proxy("bucket"); err != nil || p.String() != "socks5://10.0.0.2:1080" {
+		t.Fatalf("the proxy should be read from env: %v %v", p, err)
+	}
+	if _, _, err = ParseSOCKS5Proxy("https://s3.local/bucket?socks5-proxy=http://10.0.0.1:3128"); err == nil {
+		t.Fatalf("HTTP proxy should be rejected")
+	}
+	os.Unsetenv("JFS_SOCKS5_PROXY")
+	if _, p, err = ParseSOCKS5Proxy("https://s3.local/bucket"); err != nil || p != nil {
+		t.Fatalf("no proxy is configured: %v %v", p, err)
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	socks := newSocksServer(t, "juicefs", "secret")
+
+	tr := httpClient.Transport.(*http.Transport)
+	dial, dialContext := tr.Dial, tr.DialContext
+	defer func() {
+		tr.Dial, tr.DialContext, socksProxy = dial, dialContext, nil
+		tr.CloseIdleConnections()
+	}()
+	p, _ := url.Parse("socks5://juicefs:secret@" + socks.ln.Addr().String())
+	if err := SetSOCKS5Proxy(p); err != nil {
+		t.Fatalf("set proxy: %s", err)
+	}
+
+	target := srv.Listener.Addr().String()
+	for name, tr := range map[string]http.RoundTripper{"shared": httpClient.Transport, "aliyun": aliyunTransport(defaultAliyunOptions)} {
+		before := len(socks.connected())
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request with the %s transport: %s", name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		addrs := socks.connected()
+		if string(body) != "ok" || len(addrs) != before+1 || addrs[before] != target {
+			t.Fatalf("the %s transport should connect %s through the proxy: %q %v", name, target, body, addrs)
+		}
+	}
+
+	p.User = url.UserPassword("juicefs", "wrong")
+	if err := SetSOCKS5Proxy(p); err != nil {
+		t.Fatalf("set proxy: %s", err)
+	}
+	tr.CloseIdleConnections()
+	if _, err := httpClient.Get(srv.URL); err == nil {
+		t.Fatalf("the proxy should reject the wrong password")
+	}
+}
@@ -27,7 +27,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 type space struct {
@@ -63,7 +62,11 @@ func newSpace(endpoint, accessKey, secretKey, token string) (ObjectStorage, erro
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &space{s3client{bucket, s3.New(ses), ses}}, nil
+	c, err := newS3Client(bucket, ses, uri.Query())
+	if err != nil {
+		return nil, err
+	}
+	return &space{c}, nil
 }
 
 func init() {
@@ -0,0 +1,143 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// aliyunSpaces is a unified view of both the album and the personal drive of
+// an Aliyun account, for the data spanning them. A key is read from the
+// space to write (ObjectStorage) first, and from the other one if it's not
+// there, so a key written shadows the one in the other space. A key is
+// deleted from both.
+type aliyunSpaces struct {
+	ObjectStorage
+	other ObjectStorage
+	// the name of the other space
+	name string
+}
+
+func newAliyunSpaces(write, other ObjectStorage, name string) ObjectStorage {
+	return &aliyunSpaces{write, other, name}
+}
+
+func (s *aliyunSpaces) String() string {
+	return fmt.Sprintf("%s(with the %s)", s.ObjectStorage, s.name)
+}
+
+func (s *aliyunSpaces) Head(key string) (Object, error) {
+	o, err := s.ObjectStorage.Head(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.other.Head(key)
+	}
+	return o, err
+}
+
+func (s *aliyunSpaces) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r, err := s.ObjectStorage.Get(key, off, limit)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.other.Get(key, off, limit)
+	}
+	return r, err
+}
+
+func (s *aliyunSpaces) Delete(key string) error {
+	if err := s.ObjectStorage.Delete(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := s.other.Delete(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete %s from the %s: %w", key, s.name, err)
+	}
+	return nil
+}
+
+// ListAll merges the listings of both spaces, a key in both has the object
+// of the space to write.
+func (s *aliyunSpaces) ListAll(prefix, marker string) (<-chan Object, error) {
+	first, err := ListAll(s.ObjectStorage, prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	second, err := ListAll(s.other, prefix, marker)
+	if err != nil {
+		go func() {
+			for range first {
+			}
+		}()
+		return nil, err
+	}
+	out := make(chan Object, 10240)
+	go func() {
+		defer close(out)
+		defer func() {
+			// unblock the walks
+			for range first {
+			}
+			for range second {
+			}
+		}()
+		a, aok := <-first
+		b, bok := <-second
+		for aok || bok {
+			if aok && a == nil || bok && b == nil {
+				out <- nil
+				return
+			}
+			switch {
+			case !bok || aok && a.Key() < b.Key():
+				out <- a
+				a, aok = <-first
+			case !aok || b.Key() < a.Key():
+				out <- b
+				b, bok = <-second
+			default:
+				out <- a
+				a, aok = <-first
+				b, bok = <-second
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (s *aliyunSpaces) List(prefix, marker string, limit int64) ([]Object, error) {
+	ch, err := s.ListAll(prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	var objs []Object
+	for o := range ch {
+		if o == nil {
+			return nil, fmt.Errorf("list %s from %q failed", prefix, marker)
+		}
+		objs = append(objs, o)
+		if int64(len(objs)) >= limit {
+			break
+		}
+	}
+	return objs, nil
+}
@@ -0,0 +1,554 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the parts of the split objects and their manifests are kept under this
+// prefix of the storage
+const splitDir = ".splits/"
+
+// splitManifest is saved as `<id>.manifest` after all the parts `<id>/<n>`
+// are written, which commits the split object.
+type splitManifest struct {
+	Key   string    `json:"key"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	// sizes of the parts in order
+	Parts []int64 `json:"parts"`
+}
+
+type splitLoc struct {
+	id string
+	splitManifest
+}
+
+// Splitter is an object storage which splits the objects larger than partSize
+// into parts, for the storages with a limit on the size of one object.
+//
+// A split object is read by concatenating its parts in order, and is listed
+// with its whole size under its key. The manifests are loaded at startup and
+// kept in memory, so the split objects are expected to be written by only one
+// Splitter. An object overwritten (or deleted) has its old parts removed, and
+// those left by a crash are removed by Clean.
+type Splitter struct {
+	ObjectStorage
+	partSize int64
+
+	mu  sync.Mutex
+	seq uint64
+	// the latest version of the split keys
+	index map[string]splitLoc
+	// the ids without manifest or superseded by a later version
+	orphans []string
+}
+
+// WithSplitting loads the manifests of split objects in o, and splits the
+// objects larger than partSize.
+func WithSplitting(o ObjectStorage, partSize int64) (*Splitter, error) {
+	if partSize <= 0 {
+		return nil, fmt.Errorf("invalid part size: %d", partSize)
+	}
+	s := &Splitter{ObjectStorage: o, partSize: partSize, index: make(map[string]splitLoc)}
+	ch, err := ListAll(o, splitDir, "")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	parts := make(map[string]bool)
+	for obj := range ch {
+		if obj == nil {
+			return nil, fmt.Errorf("list split objects in %s failed", o)
+		}
+		name := strings.TrimPrefix(obj.Key(), splitDir)
+		id := strings.TrimSuffix(name, ".manifest")
+		if id != name {
+			ids = append(ids, id)
+		} else if i := strings.IndexByte(name, '/'); i > 0 {
+			id = name[:i]
+			parts[id] = true
+		}
+		// the ids are not reused, even those of orphans
+		if seq, err := strconv.ParseUint(id, 16, 64); err == nil && seq > s.seq {
+			s.seq = seq
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		var m splitManifest
+		if err = s.readManifest(id, &m); err != nil {
+			return nil, err
+		}
+		if old := s.apply(id, &m); old != "" {
+			s.orphans = append(s.orphans, old)
+		}
+		delete(parts, id)
+	}
+	for id := range parts {
+		s.orphans = append(s.orphans, id)
+	}
+	if len(ids) > 0 {
+		logger.Infof("Loaded %d split objects from %s", len(s.index), o)
+	}
+	return s, nil
+}
+
+func (s *Splitter) String() string {
+	return fmt.Sprintf("%s(split)", s.ObjectStorage)
+}
+
+func (s *Splitter) partKey(id string, i int) string {
+	return splitDir + id + "/" + strconv.Itoa(i)
+}
+
+func (s *Splitter) readManifest(id string, m *splitManifest) error {
+	r, err := s.ObjectStorage.Get(splitDir+id+".manifest", 0, -1)
+	if err != nil {
+		return fmt.Errorf("read manifest of %s: %w", id, err)
+	}
+	defer r.Close()
+	if err = json.NewDecoder(r).Decode(m); err != nil {
+		return fmt.Errorf("decode manifest of %s: %w", id, err)
+	}
+	return nil
+}
+
+// apply adds the manifest of id into memory, and returns the id of the
+// version superseded by it (which could be id itself), if any. The later id
+// wins, so the result is the same as loading them in order.
+func (s *Splitter) apply(id string, m *splitManifest) string {
+	old, ok := s.index[m.Key]
+	if ok && old.id > id {
+		return id
+	}
+	s.index[m.Key] = splitLoc{id, *m}
+	if ok {
+		return old.id
+	}
+	return ""
+}
+
+func (s *Splitter) nextID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return fmt.Sprintf("%016x", s.seq)
+}
+
+// remove deletes the manifest and then the parts of id, so a version is never
+// left with some of its parts.
+func (s *Splitter) remove(id string, parts int) error {
+	if err := s.ObjectStorage.Delete(splitDir + id + ".manifest"); err != nil {
+		return fmt.Errorf("delete manifest of %s: %w", id, err)
+	}
+	for i := 0; i < parts; i++ {
+		if err := s.ObjectStorage.Delete(s.partKey(id, i)); err != nil {
+			logger.Warnf("Delete part %d of %s: %s", i, id, err)
+		}
+	}
+	return nil
+}
+
+// forget removes the split version of key, if any.
+func (s *Splitter) forget(key string) error {
+	s.mu.Lock()
+	loc, ok := s.index[key]
+	delete(s.index, key)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := s.remove(loc.id, len(loc.Parts)); err != nil {
+		s.mu.Lock()
+		if _, ok := s.index[key]; !ok {
+			s.index[key] = loc
+		}
+		s.mu.Unlock()
+		return fmt.Errorf("delete split %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *Splitter) Put(key string, in io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(in, s.partSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) <= s.partSize {
+		if err = s.ObjectStorage.Put(key, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		return s.forget(key)
+	}
+
+	id := s.nextID()
+	m := &splitManifest{Key: key}
+	in = io.MultiReader(bytes.NewReader(data[s.partSize:]), in)
+	buf := data[:s.partSize]
+	for n := len(buf); n > 0; {
+		if err = s.ObjectStorage.Put(s.partKey(id, len(m.Parts)), bytes.NewReader(buf[:n])); err != nil {
+			err = fmt.Errorf("write part %d of %s: %w", len(m.Parts), key, err)
+			break
+		}
+		m.Parts = append(m.Parts, int64(n))
+		m.Size += int64(n)
+		// not io.ReadFull, which can't tell the last part from a reader
+		// failed with io.ErrUnexpectedEOF
+		n = 0
+		for n < len(buf) && err == nil {
+			var r int
+			r, err = in.Read(buf[n:])
+			n += r
+		}
+		if err == io.EOF {
+			err = nil
+		} else if err != nil {
+			break
+		}
+	}
+	var manifest []byte
+	if err == nil {
+		m.Mtime = time.Now()
+		if manifest, err = json.Marshal(m); err == nil {
+			err = s.ObjectStorage.Put(splitDir+id+".manifest", bytes.NewReader(manifest))
+		}
+	}
+	if err != nil {
+		// including the one failed to be written
+		for i := 0; i <= len(m.Parts); i++ {
+			_ = s.ObjectStorage.Delete(s.partKey(id, i))
+		}
+		return err
+	}
+
+	s.mu.Lock()
+	old, replaced := s.index[key]
+	superseded := s.apply(id, m)
+	s.mu.Unlock()
+	if superseded == id {
+		old = splitLoc{id, *m}
+	}
+	if superseded != "" {
+		if err := s.remove(superseded, len(old.Parts)); err != nil {
+			logger.Warnf("Remove the old parts of %s: %s", key, err)
+		}
+	} else if !replaced {
+		// the one stored as it is
+		if err := s.ObjectStorage.Delete(key); err != nil {
+			logger.Warnf("Delete %s replaced by the split one: %s", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *Splitter) lookup(key string) (splitLoc, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loc, ok := s.index[key]
+	return loc, ok
+}
+
+func (s *Splitter) Head(key string) (Object, error) {
+	if loc, ok := s.lookup(key); ok {
+		return &obj{key, loc.Size, loc.Mtime, false}, nil
+	}
+	return s.ObjectStorage.Head(key)
+}
+
+func (s *Splitter) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	loc, ok := s.lookup(key)
+	if !ok {
+		return s.ObjectStorage.Get(key, off, limit)
+	}
+	if off >= loc.Size {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	n := loc.Size - off
+	if limit >= 0 && limit < n {
+		n = limit
+	}
+	r := &splitReader{s: s, loc: loc, off: off, left: n}
+	// the first part is opened here, so a missing one fails the Get
+	if err := r.next(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// splitReader reads left bytes from off of a split object, the parts are
+// opened one by one.
+type splitReader struct {
+	s    *Splitter
+	loc  splitLoc
+	i    int
+	off  int64
+	left int64
+	cur  io.ReadCloser
+}
+
+// next opens the part having off.
+func (r *splitReader) next() error {
+	for r.i < len(r.loc.Parts) && r.off >= r.loc.Parts[r.i] {
+		r.off -= r.loc.Parts[r.i]
+		r.i++
+	}
+	if r.i == len(r.loc.Parts) || r.left <= 0 {
+		return nil
+	}
+	n := r.loc.Parts[r.i] - r.off
+	if n > r.left {
+		n = r.left
+	}
+	in, err := r.s.ObjectStorage.Get(r.s.partKey(r.loc.id, r.i), r.off, n)
+	if err != nil {
+		return fmt.Errorf("read part %d of %s: %w", r.i, r.loc.Key, err)
+	}
+	r.cur = &exactReader{in, n}
+	r.off += n
+	return nil
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	for r.left > 0 {
+		if r.cur == nil {
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+			if r.cur == nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+		}
+		if int64(len(p)) > r.left {
+			p = p[:r.left]
+		}
+		n, err := r.cur.Read(p)
+		r.left -= int64(n)
+		if err == io.EOF {
+			_ = r.cur.Close()
+			r.cur = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *splitReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+func (s *Splitter) Delete(key string) error {
+	if err := s.forget(key); err != nil {
+		return err
+	}
+	return s.ObjectStorage.Delete(key)
+}
+
+func (s *Splitter) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return nil, notSupported
+}
+
+// ListAll merges the split objects into the listing of the storage, a key
+// both split and stored as it is has the split one.
+func (s *Splitter) ListAll(prefix, marker string) (<-chan Object, error) {
+	s.mu.Lock()
+	var split []Object
+	for key, loc := range s.index {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			split = append(split, &obj{key, loc.Size, loc.Mtime, false})
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(split, func(i, j int) bool { return split[i].Key() < split[j].Key() })
+
+	stored, err := ListAll(s.ObjectStorage, prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, 10240)
+	go func() {
+		defer close(out)
+		i := 0
+		for o := range stored {
+			if o == nil {
+				out <- nil
+				return
+			}
+			if strings.HasPrefix(o.Key(), splitDir) {
+				continue
+			}
+			for ; i < len(split) && split[i].Key() <= o.Key(); i++ {
+				out <- split[i]
+				if split[i].Key() == o.Key() {
+					o = nil
+				}
+			}
+			if o != nil {
+				out <- o
+			}
+		}
+		for ; i < len(split); i++ {
+			out <- split[i]
+		}
+	}()
+	return out, nil
+}
+
+// List merges the split objects into a page of the storage, which is listed
+// no more than limit objects.
+func (s *Splitter) List(prefix, marker string, limit int64) ([]Object, error) {
+	s.mu.Lock()
+	var split []Object
+	for key, loc := range s.index {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			split = append(split, &obj{key, loc.Size, loc.Mtime, false})
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(split, func(i, j int) bool { return split[i].Key() < split[j].Key() })
+
+	stored, err := listSkipping(s.ObjectStorage, prefix, marker, limit, splitDir)
+	if err != nil {
+		return nil, err
+	}
+	var objs []Object
+	for i, j := 0, 0; int64(len(objs)) < limit && (i < len(split) || j < len(stored)); {
+		switch {
+		case j == len(stored) || i < len(split) && split[i].Key() < stored[j].Key():
+			objs = append(objs, split[i])
+			i++
+		case i == len(split) || stored[j].Key() < split[i].Key():
+			objs = append(objs, stored[j])
+			j++
+		default: // split and stored as it is
+			objs = append(objs, split[i])
+			i++
+			j++
+		}
+	}
+	return objs, nil
+}
+
+// listSkipping lists at most limit objects of store after marker, but not
+// those with the prefix skip (none if it's empty), by the pages of List, so the storage is not
+// listed further than needed. The storages only listing all are read up to
+// limit, the rest is drained in background since it can't be canceled.
+func listSkipping(store ObjectStorage, prefix, marker string, limit int64, skip string) ([]Object, error) {
+	var objs []Object
+	for int64(len(objs)) < limit {
+		page, err := store.List(prefix, marker, limit)
+		if errors.Is(err, notSupported) {
+			return listAllSkipping(store, prefix, marker, limit, skip)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, o := range page {
+			if (skip == "" || !strings.HasPrefix(o.Key(), skip)) && int64(len(objs)) < limit {
+				objs = append(objs, o)
+			}
+		}
+		marker = page[len(page)-1].Key()
+	}
+	return objs, nil
+}
+
+func listAllSkipping(store ObjectStorage, prefix, marker string, limit int64, skip string) ([]Object, error) {
+	ch, err := ListAll(store, prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	var objs []Object
+	for o := range ch {
+		if o == nil {
+			return nil, fmt.Errorf("list %s from %q failed", prefix, marker)
+		}
+		if skip != "" && strings.HasPrefix(o.Key(), skip) {
+			continue
+		}
+		if objs = append(objs, o); int64(len(objs)) >= limit {
+			break
+		}
+	}
+	return objs, nil
+}
+
+// Clean removes the parts left by the Puts failed or crashed, and the old
+// versions not removed by the overwrites.
+func (s *Splitter) Clean() error {
+	s.mu.Lock()
+	orphans := s.orphans
+	s.orphans = nil
+	s.mu.Unlock()
+	for i, id := range orphans {
+		if err := s.clean(id); err != nil {
+			s.mu.Lock()
+			s.orphans = append(s.orphans, orphans[i:]...)
+			s.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Splitter) clean(id string) error {
+	ch, err := ListAll(s.ObjectStorage, splitDir+id+"/", "")
+	if err != nil {
+		return err
+	}
+	var parts []string
+	for o := range ch {
+		if o == nil {
+			return fmt.Errorf("list parts of %s failed", id)
+		}
+		parts = append(parts, o.Key())
+	}
+	if err = s.ObjectStorage.Delete(splitDir + id + ".manifest"); err != nil {
+		return fmt.Errorf("delete manifest of %s: %w", id, err)
+	}
+	for _, key := range parts {
+		if err = s.ObjectStorage.Delete(key); err != nil {
+			return fmt.Errorf("delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
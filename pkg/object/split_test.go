@@ -0,0 +1,159 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSplitter(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	s, err := WithSplitting(m, 1<<10)
+	if err != nil {
+		t.Fatalf("with splitting: %s", err)
+	}
+	big := make([]byte, 5<<10+100)
+	for i := range big {
+		big[i] = byte(i * 13)
+	}
+	// a stream of unknown length, in small reads
+	if err = s.Put("a/big", iotest.HalfReader(bytes.NewReader(big))); err != nil {
+		t.Fatalf("put big: %s", err)
+	}
+	if err = s.Put("a/exact", bytes.NewReader(big[:2<<10])); err != nil {
+		t.Fatalf("put exact: %s", err)
+	}
+	if err = s.Put("a/small", strings.NewReader("small")); err != nil {
+		t.Fatalf("put small: %s", err)
+	}
+	if n := countObjects(t, m, splitDir); n != 6+1+2+1 {
+		t.Fatalf("expect 8 parts and 2 manifests, but got %d objects", n)
+	}
+	check := func(s *Splitter) {
+		t.Helper()
+		if d, err := get(s, "a/big", 0, -1); err != nil || d != string(big) {
+			t.Fatalf("get big: %d bytes %v", len(d), err)
+		}
+		// across the parts, and beyond the end
+		for _, c := range [][2]int64{{0, 1 << 10}, {1000, 100}, {1000, 3000}, {5 << 10, -1}, {5<<10 + 99, 10}, {6 << 10, 10}} {
+			end := int64(len(big))
+			if c[1] >= 0 && c[0]+c[1] < end {
+				end = c[0] + c[1]
+			}
+			expect := ""
+			if c[0] < end {
+				expect = string(big[c[0]:end])
+			}
+			if d, err := get(s, "a/big", c[0], c[1]); err != nil || d != expect {
+				t.Fatalf("get big at %d+%d: %d bytes %v", c[0], c[1], len(d), err)
+			}
+		}
+		if o, err := s.Head("a/big"); err != nil || o.Size() != int64(len(big)) {
+			t.Fatalf("head big: %v %v", o, err)
+		}
+		if d, err := get(s, "a/small", 0, -1); err != nil || d != "small" {
+			t.Fatalf("get small: %q %v", d, err)
+		}
+		objs, err := s.List("", "", 10)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		var got []string
+		for _, o := range objs {
+			got = append(got, o.Key())
+			if o.Key() == "a/big" && o.Size() != int64(len(big)) {
+				t.Fatalf("size of big in the listing: %d", o.Size())
+			}
+		}
+		if strings.Join(got, ",") != "a/big,a/exact,a/small" {
+			t.Fatalf("list: %s", got)
+		}
+		// page by page
+		got = got[:0]
+		for marker := ""; ; {
+			objs, err := s.List("a/", marker, 1)
+			if err != nil || len(objs) > 1 {
+				t.Fatalf("list from %q: %d objects %v", marker, len(objs), err)
+			}
+			if len(objs) == 0 {
+				break
+			}
+			marker = objs[0].Key()
+			got = append(got, marker)
+		}
+		if strings.Join(got, ",") != "a/big,a/exact,a/small" {
+			t.Fatalf("list by pages: %s", got)
+		}
+	}
+	check(s)
+	// the manifests are loaded again
+	s2, err := WithSplitting(m, 1<<10)
+	if err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	check(s2)
+
+	// overwritten by a small one, then deleted
+	if err = s.Put("a/exact", strings.NewReader("now small")); err != nil {
+		t.Fatalf("overwrite exact: %s", err)
+	}
+	if d, err := get(s, "a/exact", 0, -1); err != nil || d != "now small" {
+		t.Fatalf("get exact: %q %v", d, err)
+	}
+	if err = s.Delete("a/big"); err != nil {
+		t.Fatalf("delete big: %s", err)
+	}
+	if _, err = s.Head("a/big"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head deleted: %v", err)
+	}
+	if n := countObjects(t, m, splitDir); n != 0 {
+		t.Fatalf("%d parts are left", n)
+	}
+
+	// a broken stream leaves nothing
+	broken := errors.New("broken")
+	if err = s.Put("a/broken", io.MultiReader(bytes.NewReader(big[:3<<10]), iotest.ErrReader(broken))); !errors.Is(err, broken) {
+		t.Fatalf("put broken: %v", err)
+	}
+	if _, err = s.Head("a/broken"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head broken: %v", err)
+	}
+	if n := countObjects(t, m, splitDir); n != 0 {
+		t.Fatalf("%d parts of the broken one are left", n)
+	}
+
+	// parts left by a crash are removed by Clean
+	_ = m.Put(splitDir+"00000000000000ff/0", strings.NewReader("left"))
+	if s, err = WithSplitting(m, 1<<10); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if err = s.Clean(); err != nil {
+		t.Fatalf("clean: %s", err)
+	}
+	if n := countObjects(t, m, splitDir); n != 0 {
+		t.Fatalf("%d parts are left after clean", n)
+	}
+	if id := s.nextID(); id <= "00000000000000ff" {
+		t.Fatalf("id %s is reused", id)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// the content of unknown length larger than this is spooled into a local
+// file by the Puts of the storages requiring the length
+var spoolMemory = 8 << 20
+
+// SpoolDir is the directory of the local files spooled, the default directory
+// for temporary files if it's empty.
+var SpoolDir string
+
+// Spooled is the content of a Put with its length known, which could be read
+// again by seeking back.
+type Spooled struct {
+	io.ReadSeeker
+	// bytes from the current offset to the end
+	Size int64
+	// checksum of the content in lower case hex, empty if not asked
+	Hash string
+	file *os.File
+}
+
+// Close removes the local file spooled, if any.
+func (s *Spooled) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	_ = s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// Spool returns the content of in with its length and checksum in algo (none
+// if it's empty), for the storages requiring them before uploading. A seekable
+// in is used as it is, the others (e.g. a pipe) are buffered in memory up to
+// memory bytes as they are read, or spooled into a local file in SpoolDir
+// beyond that.
+func Spool(in io.Reader, memory int, algo HashAlgo) (*Spooled, error) {
+	var h hash.Hash
+	if algo != "" {
+		var err error
+		if h, err = algo.New(); err != nil {
+			return nil, err
+		}
+	}
+	if r, ok := in.(io.ReadSeeker); ok {
+		// e.g. os.Stdin can't seek, which is read as a pipe
+		if cur, err := r.Seek(0, io.SeekCurrent); err == nil {
+			return spoolSeeker(r, cur, h)
+		}
+	}
+
+	var w io.Writer = io.Discard
+	if h != nil {
+		w = h
+	}
+	// the buffer grows with the content, a small one doesn't take memory.
+	// io.CopyN tells a short content (io.EOF) from a reader failed with
+	// io.ErrUnexpectedEOF (e.g. a truncated download)
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, in, int64(memory)+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	_, _ = w.Write(buf.Bytes())
+	if err == io.EOF {
+		return &Spooled{ReadSeeker: bytes.NewReader(buf.Bytes()), Size: n, Hash: sumOf(h)}, nil
+	}
+	f, err := os.CreateTemp(SpoolDir, "juicefs-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &Spooled{ReadSeeker: f, file: f}
+	var size int64
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		size, err = io.Copy(f, io.TeeReader(in, w))
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	s.Size, s.Hash = n+size, sumOf(h)
+	return s, nil
+}
+
+// spoolSeeker measures r from the offset cur, and hashes it with h.
+func spoolSeeker(r io.ReadSeeker, cur int64, h hash.Hash) (*Spooled, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.Seek(cur, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if h != nil {
+		_, err = io.Copy(h, r)
+		if _, e := r.Seek(cur, io.SeekStart); err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Spooled{ReadSeeker: r, Size: end - cur, Hash: sumOf(h)}, nil
+}
+
+func sumOf(h hash.Hash) string {
+	if h == nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SizeHinter is implemented by the readers knowing their length before read,
+// e.g. a compressing wrapper of a known size, which are read as they are by
+// the storages requiring the length instead of buffered or spooled.
+type SizeHinter interface {
+	// SizeHint returns the exact number of bytes to be read, or -1 if unknown
+	SizeHint() int64
+}
+
+// errSizeHint is the error of a content not as long as its hint.
+var errSizeHint = errors.New("size differs from the hint")
+
+// WithSizeHint returns in with its length size (see SizeHinter). The content
+// is checked against it, a Read fails with errSizeHint once it's found
+// shorter or longer than size. It's in itself if size is negative (unknown).
+func WithSizeHint(in io.Reader, size int64) io.Reader {
+	if size < 0 {
+		return in
+	}
+	return &sizeHinted{in: in, size: size}
+}
+
+type sizeHinted struct {
+	in   io.Reader
+	size int64
+	read int64
+}
+
+func (h *sizeHinted) SizeHint() int64 { return h.size }
+
+func (h *sizeHinted) Read(p []byte) (int, error) {
+	if h.read >= h.size {
+		// the readers knowing the length may not read till EOF
+		return 0, h.tail()
+	}
+	if int64(len(p)) > h.size-h.read {
+		p = p[:h.size-h.read]
+	}
+	n, err := h.in.Read(p)
+	h.read += int64(n)
+	if err == io.EOF && h.read < h.size {
+		return n, fmt.Errorf("%w: %d bytes, expect %d", errSizeHint, h.read, h.size)
+	}
+	if err == nil && h.read == h.size {
+		err = h.tail()
+	}
+	return n, err
+}
+
+// tail checks that nothing is left after the size bytes.
+func (h *sizeHinted) tail() error {
+	var b [1]byte
+	for {
+		n, err := h.in.Read(b[:])
+		if n > 0 {
+			return fmt.Errorf("%w: more than %d bytes", errSizeHint, h.size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
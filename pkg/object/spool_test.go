@@ -0,0 +1,138 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSpool(t *testing.T) {
+	data := make([]byte, 100<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	sum := sha256.Sum256(data)
+	expect := hex.EncodeToString(sum[:])
+	check := func(s *Spooled, err error, inFile bool) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("spool: %s", err)
+		}
+		defer s.Close()
+		if s.Size != int64(len(data)) || s.Hash != expect {
+			t.Fatalf("size %d hash %s, expect %d %s", s.Size, s.Hash, len(data), expect)
+		}
+		if (s.file != nil) != inFile {
+			t.Fatalf("expect spooled into a file: %v", inFile)
+		}
+		for i := 0; i < 2; i++ {
+			got, err := io.ReadAll(s)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes: %v", len(got), err)
+			}
+			_, _ = s.Seek(0, io.SeekStart)
+		}
+		if inFile {
+			name := s.file.Name()
+			_ = s.Close()
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Fatalf("the spooled file should be removed: %v", err)
+			}
+		}
+	}
+	// a stream of unknown length, in small reads
+	s, err := Spool(iotest.OneByteReader(bytes.NewReader(data)), len(data), HashSHA256)
+	check(s, err, false)
+	s, err = Spool(iotest.HalfReader(bytes.NewReader(data)), 10<<10, HashSHA256)
+	check(s, err, true)
+	// into SpoolDir, and a large memory is not taken by a small content
+	defer func(dir string) { SpoolDir = dir }(SpoolDir)
+	SpoolDir = t.TempDir()
+	s, err = Spool(iotest.HalfReader(bytes.NewReader(data)), 10<<10, HashSHA256)
+	if err != nil || filepath.Dir(s.file.Name()) != SpoolDir {
+		t.Fatalf("spool into %s: %v", SpoolDir, err)
+	}
+	check(s, err, true)
+	s, err = Spool(iotest.HalfReader(bytes.NewReader(data)), 1<<30, HashSHA256)
+	check(s, err, false)
+	s, err = Spool(bytes.NewReader(data), 10<<10, HashSHA256)
+	check(s, err, false)
+
+	// from the current offset of a seekable one
+	r := bytes.NewReader(append([]byte("skip"), data...))
+	_, _ = r.Seek(4, io.SeekStart)
+	if s, err = Spool(r, 0, HashSHA256); err != nil || s.Size != int64(len(data)) || s.Hash != expect {
+		t.Fatalf("spool from offset: %+v %v", s, err)
+	}
+	if got, _ := io.ReadAll(s); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes from offset", len(got))
+	}
+
+	if _, err = Spool(iotest.ErrReader(io.ErrUnexpectedEOF), 10<<10, ""); err != io.ErrUnexpectedEOF {
+		t.Fatalf("a truncated stream should fail: %v", err)
+	}
+	broken := errors.New("broken")
+	for _, memory := range []int{len(data), 10 << 10} {
+		if _, err = Spool(io.MultiReader(bytes.NewReader(data[:20<<10]), iotest.ErrReader(broken)), memory, ""); !errors.Is(err, broken) {
+			t.Fatalf("a broken stream should fail: %v", err)
+		}
+	}
+}
+
+func TestSizeHint(t *testing.T) {
+	data := bytes.Repeat([]byte("hinted"), 1000)
+	// a stream of unknown length is read as it is with an accurate hint
+	in := WithSizeHint(iotest.HalfReader(bytes.NewReader(data)), int64(len(data)))
+	body, size, err := findLen(in)
+	if err != nil || body != in || size != int64(len(data)) {
+		t.Fatalf("find length: %d %v, spooled %v", size, err, body != in)
+	}
+	if got, err := io.ReadAll(body); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes: %v", len(got), err)
+	}
+	// the readers knowing the length stop at it
+	in = WithSizeHint(bytes.NewReader(data), int64(len(data)))
+	if got, err := io.ReadAll(io.LimitReader(in, int64(len(data)))); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes with the length: %v", len(got), err)
+	}
+
+	for _, hint := range []int64{int64(len(data)) + 1, int64(len(data)) - 1, 0} {
+		in = WithSizeHint(bytes.NewReader(data), hint)
+		if _, err := io.ReadAll(in); !errors.Is(err, errSizeHint) {
+			t.Fatalf("hint %d of %d bytes: %v", hint, len(data), err)
+		}
+		if hint == 0 {
+			// nothing is read
+			continue
+		}
+		in = WithSizeHint(bytes.NewReader(data), hint)
+		if _, err := io.ReadAll(io.LimitReader(in, hint)); !errors.Is(err, errSizeHint) {
+			t.Fatalf("hint %d of %d bytes read with the length: %v", hint, len(data), err)
+		}
+	}
+	if r := bytes.NewReader(data); WithSizeHint(r, -1) != r {
+		t.Fatalf("an unknown hint should be ignored")
+	}
+}
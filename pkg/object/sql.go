@@ -151,6 +151,29 @@ func (s *sqlStore) List(prefix, marker string, limit int64) ([]Object, error) {
 	return objs, nil
 }
 
+func (s *sqlStore) ListRecent(prefix string, n int) ([]Object, error) {
+	q := s.db.Cols("`key`", "size", "modified").Desc("modified").Asc("`key`")
+	if prefix != "" {
+		q = q.Where("`key` >= ?", prefix)
+	}
+	rows, err := q.Rows(&blob{})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objs []Object
+	for len(objs) < n && rows.Next() {
+		var b blob
+		if err = rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(b.Key, prefix) {
+			objs = append(objs, &obj{b.Key, b.Size, b.Modified, strings.HasSuffix(b.Key, "/")})
+		}
+	}
+	return objs, rows.Err()
+}
+
 func newSQLStore(driver, addr, user, password string) (ObjectStorage, error) {
 	var err error
 	uri := addr
@@ -0,0 +1,71 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+)
+
+// the objects counted between two calls of the progress of StatPrefix
+var statProgressEvery int64 = 1000
+
+// StatPrefix returns the number and total size of the objects with the
+// prefix, e.g. for capacity planning. The directories are not counted. It
+// stops with the error of ctx once ctx is done, and calls progress (if not
+// nil) with the totals so far every 1000 objects, and at the end.
+func StatPrefix(ctx context.Context, store ObjectStorage, prefix string, progress func(count, bytes int64)) (count int64, bytes int64, err error) {
+	ch, err := ListAll(store, prefix, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		// not in the caller, who may have cancelled it to return soon
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	for {
+		// the objects buffered in ch would be picked at random by select
+		if err = ctx.Err(); err != nil {
+			return count, bytes, err
+		}
+		select {
+		case <-ctx.Done():
+			return count, bytes, ctx.Err()
+		case o, ok := <-ch:
+			if !ok {
+				if progress != nil {
+					progress(count, bytes)
+				}
+				return count, bytes, nil
+			}
+			if o == nil {
+				return count, bytes, errors.New("list failed")
+			}
+			if o.IsDir() {
+				continue
+			}
+			count++
+			bytes += o.Size()
+			if progress != nil && count%statProgressEvery == 0 {
+				progress(count, bytes)
+			}
+		}
+	}
+}
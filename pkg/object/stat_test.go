@@ -0,0 +1,61 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestStatPrefix(t *testing.T) {
+	defer func(n int64) { statProgressEvery = n }(statProgressEvery)
+	statProgressEvery = 10
+
+	s, _ := newMem("mem", "", "", "")
+	var total int64
+	for i := 0; i < 25; i++ {
+		_ = s.Put(fmt.Sprintf("chunks/%d", i), bytes.NewReader(make([]byte, i)))
+		total += int64(i)
+	}
+	_ = s.Put("other", bytes.NewReader(make([]byte, 100)))
+
+	var calls [][2]int64
+	count, size, err := StatPrefix(context.Background(), s, "chunks/", func(count, bytes int64) {
+		calls = append(calls, [2]int64{count, bytes})
+	})
+	if err != nil || count != 25 || size != total {
+		t.Fatalf("stat chunks/: %d objects %d bytes %v, expect 25 %d", count, size, err, total)
+	}
+	if len(calls) != 3 || calls[0][0] != 10 || calls[1][0] != 20 || calls[2] != [2]int64{25, total} {
+		t.Fatalf("unexpected progress: %v", calls)
+	}
+	if count, size, err = StatPrefix(context.Background(), s, "", nil); err != nil || count != 26 || size != total+100 {
+		t.Fatalf("stat all: %d objects %d bytes %v", count, size, err)
+	}
+	if count, size, err = StatPrefix(context.Background(), s, "none/", nil); err != nil || count != 0 || size != 0 {
+		t.Fatalf("stat none/: %d objects %d bytes %v", count, size, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err = StatPrefix(ctx, s, "", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect cancelled, but got %v", err)
+	}
+}
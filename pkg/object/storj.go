@@ -0,0 +1,188 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storjObject is the metadata of an object in Storj DCS. The size is the
+// length of the plain content, not the one of encrypted and erasure coded
+// pieces stored in the nodes.
+type storjObject struct {
+	key     string
+	size    int64
+	created time.Time
+}
+
+// storjProject is the subset of the project in uplink used by storj, missing
+// objects should be reported as os.ErrNotExist.
+type storjProject interface {
+	StatObject(ctx context.Context, bucket, key string) (*storjObject, error)
+	// DownloadObject reads length bytes from offset, or to the end if length is -1
+	DownloadObject(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error)
+	// UploadObject streams in into key, and commits it after in is drained
+	UploadObject(ctx context.Context, bucket, key string, in io.Reader) error
+	DeleteObject(ctx context.Context, bucket, key string) error
+	// ListObjects iterates the objects under prefix recursively
+	ListObjects(ctx context.Context, bucket, prefix string, fn func(o *storjObject) bool) error
+	CopyObject(ctx context.Context, bucket, src, dst string) error
+	EnsureBucket(ctx context.Context, bucket string) error
+	Close() error
+}
+
+// storjAccess tells how to access a project, by a serialized access grant,
+// or by the API key and passphrase on a satellite.
+type storjAccess struct {
+	grant      string
+	satellite  string
+	apiKey     string
+	passphrase string
+}
+
+// openStorjProject opens the project with uplink, it's set up when built
+// with `-tags storj`.
+var openStorjProject func(ctx context.Context, access storjAccess) (storjProject, error)
+
+type storj struct {
+	DefaultObjectStorage
+	project storjProject
+	bucket  string
+}
+
+func (s *storj) String() string {
+	return fmt.Sprintf("storj://%s/", s.bucket)
+}
+
+func (s *storj) Create() error {
+	return s.project.EnsureBucket(ctx, s.bucket)
+}
+
+func (s *storj) Head(key string) (Object, error) {
+	o, err := s.project.StatObject(ctx, s.bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &obj{o.key, o.size, o.created, strings.HasSuffix(o.key, "/")}, nil
+}
+
+func (s *storj) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	return s.project.DownloadObject(ctx, s.bucket, key, off, limit)
+}
+
+// Put streams the content, it's encrypted and erasure coded by uplink on the
+// fly, so the whole object is never buffered.
+func (s *storj) Put(key string, in io.Reader) error {
+	return s.project.UploadObject(ctx, s.bucket, key, in)
+}
+
+func (s *storj) Copy(dst, src string) error {
+	return s.project.CopyObject(ctx, s.bucket, src, dst)
+}
+
+func (s *storj) Delete(key string) error {
+	err := s.project.DeleteObject(ctx, s.bucket, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List returns the first limit objects after marker. The keys are encrypted
+// in Storj, so the objects are not listed in order of the plain keys, and all
+// the objects under prefix have to be iterated to find a page.
+func (s *storj) List(prefix, marker string, limit int64) ([]Object, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	var objs []Object
+	err := s.project.ListObjects(ctx, s.bucket, prefix, func(o *storjObject) bool {
+		if o.key > marker {
+			objs = append(objs, &obj{o.key, o.size, o.created, strings.HasSuffix(o.key, "/")})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
+	if int64(len(objs)) > limit {
+		objs = objs[:limit]
+	}
+	return objs, nil
+}
+
+// parseStorjEndpoint parses `[satellite/]bucket`. With a satellite (like
+// `<node id>@us1.storj.io:7777`), accessKey and secretKey are the API key and
+// the encryption passphrase, otherwise accessKey is a serialized access grant.
+func parseStorjEndpoint(endpoint, accessKey, secretKey string) (storjAccess, string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "storj://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return storjAccess{}, "", fmt.Errorf("invalid endpoint %s: %v", endpoint, err)
+	}
+	bucket := strings.Trim(u.Path, "/")
+	if bucket == "" {
+		if accessKey == "" {
+			return storjAccess{}, "", fmt.Errorf("access grant of storj is required")
+		}
+		return storjAccess{grant: accessKey}, u.Host, nil
+	}
+	if strings.Contains(bucket, "/") {
+		return storjAccess{}, "", fmt.Errorf("invalid bucket %s", bucket)
+	}
+	if accessKey == "" || secretKey == "" {
+		return storjAccess{}, "", fmt.Errorf("API key and passphrase of storj are required")
+	}
+	satellite := u.Host
+	if u.User != nil {
+		satellite = u.User.Username() + "@" + u.Host
+	}
+	return storjAccess{satellite: satellite, apiKey: accessKey, passphrase: secretKey}, bucket, nil
+}
+
+func newStorj(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	access, bucket, err := parseStorjEndpoint(endpoint, accessKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	if openStorjProject == nil {
+		return nil, fmt.Errorf("storj is not supported in this build, please build with `-tags storj`")
+	}
+	project, err := openStorjProject(ctx, access)
+	if err != nil {
+		return nil, fmt.Errorf("open storj project: %w", err)
+	}
+	return &storj{project: project, bucket: bucket}, nil
+}
+
+func init() {
+	Register("storj", newStorj)
+}
@@ -0,0 +1,241 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockStorjProject keeps the objects of buckets in maps, so they are listed
+// in random order as the encrypted keys in Storj.
+type mockStorjProject struct {
+	sync.Mutex
+	buckets map[string]map[string][]byte
+	access  storjAccess
+}
+
+func (p *mockStorjProject) objects(bucket string) (map[string][]byte, error) {
+	b, ok := p.buckets[bucket]
+	if !ok {
+		return nil, fmt.Errorf("bucket %s not found", bucket)
+	}
+	return b, nil
+}
+
+func (p *mockStorjProject) StatObject(ctx context.Context, bucket, key string) (*storjObject, error) {
+	p.Lock()
+	defer p.Unlock()
+	b, err := p.objects(bucket)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := b[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", key, os.ErrNotExist)
+	}
+	return &storjObject{key, int64(len(data)), time.Now()}, nil
+}
+
+func (p *mockStorjProject) DownloadObject(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	p.Lock()
+	defer p.Unlock()
+	b, err := p.objects(bucket)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := b[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", key, os.ErrNotExist)
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (p *mockStorjProject) UploadObject(ctx context.Context, bucket, key string, in io.Reader) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	b, err := p.objects(bucket)
+	if err != nil {
+		return err
+	}
+	b[key] = data
+	return nil
+}
+
+func (p *mockStorjProject) DeleteObject(ctx context.Context, bucket, key string) error {
+	p.Lock()
+	defer p.Unlock()
+	b, err := p.objects(bucket)
+	if err != nil {
+		return err
+	}
+	delete(b, key)
+	return nil
+}
+
+func (p *mockStorjProject) ListObjects(ctx context.Context, bucket, prefix string, fn func(o *storjObject) bool) error {
+	p.Lock()
+	defer p.Unlock()
+	b, err := p.objects(bucket)
+	if err != nil {
+		return err
+	}
+	for k, data := range b {
+		if strings.HasPrefix(k, prefix) && !fn(&storjObject{k, int64(len(data)), time.Now()}) {
+			break
+		}
+	}
+	return nil
+}
+
+func (p *mockStorjProject) CopyObject(ctx context.Context, bucket, src, dst string) error {
+	p.Lock()
+	defer p.Unlock()
+	b, err := p.objects(bucket)
+	if err != nil {
+		return err
+	}
+	data, ok := b[src]
+	if !ok {
+		return fmt.Errorf("object %s: %w", src, os.ErrNotExist)
+	}
+	b[dst] = data
+	return nil
+}
+
+func (p *mockStorjProject) EnsureBucket(ctx context.Context, bucket string) error {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.buckets[bucket]; !ok {
+		p.buckets[bucket] = make(map[string][]byte)
+	}
+	return nil
+}
+
+func (p *mockStorjProject) Close() error { return nil }
+
+func TestStorj(t *testing.T) {
+	p := &mockStorjProject{buckets: make(map[string]map[string][]byte)}
+	orig := openStorjProject
+	defer func() { openStorjProject = orig }()
+	openStorjProject = func(ctx context.Context, access storjAccess) (storjProject, error) {
+		p.access = access
+		return p, nil
+	}
+
+	s, err := newStorj("storj://jfs", "grant1", "", "")
+	if err != nil {
+		t.Fatalf("create storj: %s", err)
+	}
+	if p.access.grant != "grant1" {
+		t.Fatalf("access grant: %+v", p.access)
+	}
+	if err = s.Create(); err != nil {
+		t.Fatalf("create bucket: %s", err)
+	}
+	if err = s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if d, err := get(s, "a", 1, 3); err != nil || d != "ell" {
+		t.Fatalf("get range: %q %v", d, err)
+	}
+	if d, err := get(s, "a", 2, -1); err != nil || d != "llo" {
+		t.Fatalf("get to the end: %q %v", d, err)
+	}
+	if o, err := s.Head("a"); err != nil || o.Size() != 5 {
+		t.Fatalf("head: %v %v", o, err)
+	}
+	if _, err = s.Head("b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head of not existed object: %v", err)
+	}
+	if _, err = s.Get("b", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get of not existed object: %v", err)
+	}
+	if err = s.(*storj).Copy("b", "a"); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if d, err := get(s, "b", 0, -1); err != nil || d != "hello" {
+		t.Fatalf("get copied: %q %v", d, err)
+	}
+	if err = s.Delete("b"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err = s.Delete("b"); err != nil {
+		t.Fatalf("delete not existed object: %s", err)
+	}
+
+	var expected []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("chunks/%02d", i)
+		_ = s.Put(key, bytes.NewReader([]byte(key)))
+		expected = append(expected, key)
+	}
+	var keys []string
+	marker := ""
+	for {
+		objs, err := s.List("chunks/", marker, 10)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		if len(objs) == 0 {
+			break
+		}
+		for _, o := range objs {
+			if o.Size() != int64(len(o.Key())) {
+				t.Fatalf("size of %s should be %d, but got %d", o.Key(), len(o.Key()), o.Size())
+			}
+			keys = append(keys, o.Key())
+		}
+		marker = keys[len(keys)-1]
+	}
+	if !sort.StringsAreSorted(keys) || strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expect %v, but got %v", expected, keys)
+	}
+}
+
+func TestStorjEndpoint(t *testing.T) {
+	access, bucket, err := parseStorjEndpoint("storj://12EayRS@us1.storj.io:7777/jfs", "apikey", "passphrase")
+	if err != nil || bucket != "jfs" || access != (storjAccess{satellite: "12EayRS@us1.storj.io:7777", apiKey: "apikey", passphrase: "passphrase"}) {
+		t.Fatalf("parse with satellite: %+v %s %v", access, bucket, err)
+	}
+	access, bucket, err = parseStorjEndpoint("jfs", "grant", "")
+	if err != nil || bucket != "jfs" || access.grant != "grant" {
+		t.Fatalf("parse with access grant: %+v %s %v", access, bucket, err)
+	}
+	for _, c := range [][3]string{{"storj://jfs", "", ""}, {"storj://us1.storj.io:7777/jfs", "apikey", ""}, {"storj://us1.storj.io:7777/jfs/a", "k", "p"}} {
+		if _, _, err = parseStorjEndpoint(c[0], c[1], c[2]); err == nil {
+			t.Fatalf("parse %v should fail", c)
+		}
+	}
+}
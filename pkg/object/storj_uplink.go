@@ -0,0 +1,122 @@
+//go:build storj
+// +build storj
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"storj.io/uplink"
+)
+
+type uplinkProject struct {
+	*uplink.Project
+}
+
+func uplinkError(err error) error {
+	if errors.Is(err, uplink.ErrObjectNotFound) {
+		return fmt.Errorf("%w: %s", os.ErrNotExist, err)
+	}
+	return err
+}
+
+func uplinkObject(o *uplink.Object) *storjObject {
+	return &storjObject{o.Key, o.System.ContentLength, o.System.Created}
+}
+
+func (p *uplinkProject) StatObject(ctx context.Context, bucket, key string) (*storjObject, error) {
+	o, err := p.Project.StatObject(ctx, bucket, key)
+	if err != nil {
+		return nil, uplinkError(err)
+	}
+	return uplinkObject(o), nil
+}
+
+func (p *uplinkProject) DownloadObject(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	d, err := p.Project.DownloadObject(ctx, bucket, key, &uplink.DownloadOptions{Offset: offset, Length: length})
+	if err != nil {
+		return nil, uplinkError(err)
+	}
+	return d, nil
+}
+
+func (p *uplinkProject) UploadObject(ctx context.Context, bucket, key string, in io.Reader) error {
+	u, err := p.Project.UploadObject(ctx, bucket, key, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(u, in); err != nil {
+		_ = u.Abort()
+		return err
+	}
+	return u.Commit()
+}
+
+func (p *uplinkProject) DeleteObject(ctx context.Context, bucket, key string) error {
+	_, err := p.Project.DeleteObject(ctx, bucket, key)
+	return uplinkError(err)
+}
+
+func (p *uplinkProject) ListObjects(ctx context.Context, bucket, prefix string, fn func(o *storjObject) bool) error {
+	// the prefix to list with must end with a slash
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	it := p.Project.ListObjects(ctx, bucket, &uplink.ListObjectsOptions{Prefix: dir, Recursive: true, System: true})
+	for it.Next() {
+		o := it.Item()
+		if strings.HasPrefix(o.Key, prefix) && !fn(uplinkObject(o)) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+func (p *uplinkProject) CopyObject(ctx context.Context, bucket, src, dst string) error {
+	_, err := p.Project.CopyObject(ctx, bucket, src, bucket, dst, nil)
+	return uplinkError(err)
+}
+
+func (p *uplinkProject) EnsureBucket(ctx context.Context, bucket string) error {
+	_, err := p.Project.EnsureBucket(ctx, bucket)
+	return err
+}
+
+func init() {
+	openStorjProject = func(ctx context.Context, access storjAccess) (storjProject, error) {
+		var a *uplink.Access
+		var err error
+		if access.grant != "" {
+			a, err = uplink.ParseAccess(access.grant)
+		} else {
+			a, err = uplink.RequestAccessWithPassphrase(ctx, access.satellite, access.apiKey, access.passphrase)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p, err := uplink.OpenProject(ctx, a)
+		if err != nil {
+			return nil, err
+		}
+		return &uplinkProject{p}, nil
+	}
+}
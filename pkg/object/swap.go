@@ -0,0 +1,87 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Swapper is implemented by the storages able to exchange the contents of
+// two objects by renames, e.g. to promote a repaired shadow object.
+type Swapper interface {
+	// Swap exchanges the objects a and b, both of which should exist. A
+	// reader of a or b within the process sees it either before or after the
+	// swap, never missing, but a and b are not read together, one of them
+	// could be read before and the other after. The other clients may see a
+	// missing in the middle.
+	Swap(a, b string) error
+}
+
+// Swap exchanges the objects a and b of s, or returns notSupported if s
+// can't rename the objects.
+func Swap(s ObjectStorage, a, b string) error {
+	if w, ok := s.(Swapper); ok {
+		return w.Swap(a, b)
+	}
+	return notSupported
+}
+
+// swapGuard keeps the readers from resolving a key in the middle of a swap,
+// which takes a few renames. The keys are hashed into a fixed number of
+// locks, so it takes no memory per key. It only works within a process.
+//
+// A swap pending on a lock blocks the new readers of its keys (and of the
+// others hashed to the same locks), so it waits only for the resolves in
+// flight and is not starved by a steady stream of readers. The shards are
+// locked one by one, the first one held blocks its readers while the swap
+// waits for the second.
+type swapGuard struct {
+	shards [64]sync.RWMutex
+}
+
+func (g *swapGuard) shard(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(g.shards)))
+}
+
+// rlock is held by a reader while it resolves key.
+func (g *swapGuard) rlock(key string) func() {
+	m := &g.shards[g.shard(key)]
+	m.RLock()
+	return m.RUnlock
+}
+
+// lock is held by a swap of a and b, the locks are acquired in order so
+// concurrent swaps don't deadlock.
+func (g *swapGuard) lock(a, b string) func() {
+	i, j := g.shard(a), g.shard(b)
+	if i > j {
+		i, j = j, i
+	}
+	g.shards[i].Lock()
+	if j != i {
+		g.shards[j].Lock()
+	}
+	return func() {
+		if j != i {
+			g.shards[j].Unlock()
+		}
+		g.shards[i].Unlock()
+	}
+}
@@ -130,6 +130,7 @@ func newSwiftOSS(endpoint, username, apiKey, token string) (ObjectStorage, error
 		ApiKey:    apiKey,
 		AuthToken: token,
 		AuthUrl:   authURL,
+		Transport: httpClient.Transport,
 	}
 	err = conn.Authenticate()
 	if err != nil {
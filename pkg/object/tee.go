@@ -0,0 +1,191 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+)
+
+type withMirror struct {
+	ObjectStorage
+	mirror ObjectStorage
+}
+
+// WithMirror returns an object storage which reads from primary, and writes
+// into both primary and mirror, so the data could be migrated to mirror
+// without downtime. An object is written into mirror only when it's written
+// into primary successfully, and the failure of mirror is returned.
+func WithMirror(primary, mirror ObjectStorage) ObjectStorage {
+	return &withMirror{primary, mirror}
+}
+
+func (m *withMirror) String() string {
+	return fmt.Sprintf("%s(mirror %s)", m.ObjectStorage, m.mirror)
+}
+
+// readTwice returns a reader of the same content as in after in is read,
+// the content is buffered unless in could be rewound.
+func readTwice(in io.Reader) (io.Reader, func() (io.Reader, error), error) {
+	if s, ok := in.(io.ReadSeeker); ok {
+		start, err := s.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return in, func() (io.Reader, error) {
+				_, err := s.Seek(start, io.SeekStart)
+				return s, err
+			}, nil
+		}
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(data), func() (io.Reader, error) { return bytes.NewReader(data), nil }, nil
+}
+
+func (m *withMirror) Put(key string, in io.Reader) error {
+	in, again, err := readTwice(in)
+	if err != nil {
+		return err
+	}
+	if err = m.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	if in, err = again(); err == nil {
+		err = m.mirror.Put(key, in)
+	}
+	if err != nil {
+		return fmt.Errorf("put %s into mirror %s: %w", key, m.mirror, err)
+	}
+	return nil
+}
+
+func (m *withMirror) Delete(key string) error {
+	if err := m.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	if err := m.mirror.Delete(key); err != nil {
+		return fmt.Errorf("delete %s from mirror %s: %w", key, m.mirror, err)
+	}
+	return nil
+}
+
+// CreateMultipartUpload is not supported, so the objects are always written
+// into both storages by Put.
+func (m *withMirror) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return nil, notSupported
+}
+
+type mirrorOp struct {
+	key  string
+	data []byte // nil for delete
+}
+
+// AsyncMirror is an object storage like WithMirror, but it writes into the
+// mirror in background, so the latency of writes is not doubled.
+type AsyncMirror struct {
+	withMirror
+	queues  []chan mirrorOp
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	errs    []string
+}
+
+// WithAsyncMirror is like WithMirror, but the writes into mirror are queued
+// and done by threads in background. A write blocks when there are already
+// backlog writes queued for its thread. The writes of the same key are done
+// in order. The failures of mirror are returned by Flush.
+func WithAsyncMirror(primary, mirror ObjectStorage, threads, backlog int) *AsyncMirror {
+	if threads <= 0 {
+		threads = 1
+	}
+	a := &AsyncMirror{withMirror: withMirror{primary, mirror}, queues: make([]chan mirrorOp, threads)}
+	for i := range a.queues {
+		a.queues[i] = make(chan mirrorOp, backlog)
+		go a.run(a.queues[i])
+	}
+	return a
+}
+
+func (a *AsyncMirror) run(q chan mirrorOp) {
+	for op := range q {
+		var err error
+		if op.data != nil {
+			err = a.mirror.Put(op.key, bytes.NewReader(op.data))
+		} else {
+			err = a.mirror.Delete(op.key)
+		}
+		if err != nil {
+			logger.Warnf("Write %s into mirror %s: %s", op.key, a.mirror, err)
+			a.mu.Lock()
+			a.errs = append(a.errs, fmt.Sprintf("%s: %s", op.key, err))
+			a.mu.Unlock()
+		}
+		a.pending.Done()
+	}
+}
+
+func (a *AsyncMirror) enqueue(op mirrorOp) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(op.key))
+	a.pending.Add(1)
+	a.queues[h.Sum32()%uint32(len(a.queues))] <- op
+}
+
+func (a *AsyncMirror) Put(key string, in io.Reader) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if err = a.ObjectStorage.Put(key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	a.enqueue(mirrorOp{key, data})
+	return nil
+}
+
+func (a *AsyncMirror) Delete(key string) error {
+	if err := a.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	a.enqueue(mirrorOp{key: key})
+	return nil
+}
+
+// Flush waits for the queued writes, and returns the failures of mirror
+// since last Flush.
+func (a *AsyncMirror) Flush() error {
+	a.pending.Wait()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.errs) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%d writes into mirror %s failed: %s", len(a.errs), a.mirror, strings.Join(a.errs, "; "))
+	a.errs = nil
+	return err
+}
+
+var _ ObjectStorage = &withMirror{}
+var _ ObjectStorage = &AsyncMirror{}
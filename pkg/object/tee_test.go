@@ -0,0 +1,123 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// brokenPut fails all the puts.
+type brokenPut struct {
+	ObjectStorage
+}
+
+func (b *brokenPut) Put(key string, in io.Reader) error {
+	return errors.New("disk full")
+}
+
+func TestWithMirror(t *testing.T) {
+	p, _ := newMem("primary", "", "", "")
+	m, _ := newMem("mirror", "", "", "")
+	s := WithMirror(p, m)
+	for key, in := range map[string]io.Reader{
+		"seeker": bytes.NewReader([]byte("hello")),
+		"stream": io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo")),
+	} {
+		if err := s.Put(key, in); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+		for _, o := range []ObjectStorage{p, m} {
+			if d, err := get(o, key, 0, -1); err != nil || d != "hello" {
+				t.Fatalf("%s in %s: %q %v", key, o, d, err)
+			}
+		}
+	}
+	if d, err := get(s, "seeker", 1, 2); err != nil || d != "el" {
+		t.Fatalf("get: %q %v", d, err)
+	}
+	if err := s.Delete("seeker"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := m.Head("seeker"); err == nil {
+		t.Fatalf("the object should be deleted from mirror")
+	}
+
+	// the failure of mirror is returned, but the primary one is kept
+	s = WithMirror(p, &brokenPut{m})
+	if err := s.Put("a", bytes.NewReader([]byte("a"))); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("the failure of mirror should be returned: %v", err)
+	}
+	if d, err := get(p, "a", 0, -1); err != nil || d != "a" {
+		t.Fatalf("the object should be written into primary: %q %v", d, err)
+	}
+	// nothing is mirrored if primary fails
+	s = WithMirror(&brokenPut{p}, m)
+	if err := s.Put("b", bytes.NewReader([]byte("b"))); err == nil {
+		t.Fatalf("the failure of primary should be returned")
+	}
+	if _, err := m.Head("b"); err == nil {
+		t.Fatalf("the object should not be mirrored if primary failed")
+	}
+	if _, err := s.CreateMultipartUpload("c"); err == nil {
+		t.Fatalf("multipart upload should not be supported")
+	}
+}
+
+func TestWithAsyncMirror(t *testing.T) {
+	p, _ := newMem("primary", "", "", "")
+	m, _ := newMem("mirror", "", "", "")
+	s := WithAsyncMirror(p, m, 4, 2)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := s.Put(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+		if i%2 == 0 {
+			_ = s.Put(key, bytes.NewReader(nil))
+			_ = s.Delete(key)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		d, err := get(m, key, 0, -1)
+		if i%2 == 0 && err == nil || i%2 == 1 && d != key {
+			t.Fatalf("%s in mirror: %q %v", key, d, err)
+		}
+	}
+
+	s = WithAsyncMirror(p, &brokenPut{m}, 1, 0)
+	if err := s.Put("a", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatalf("the failure of mirror should not fail the put: %s", err)
+	}
+	if err := s.Flush(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("flush should return the failure of mirror: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("the failures are returned once: %s", err)
+	}
+	if d, err := get(p, "a", 0, -1); err != nil || d != "a" {
+		t.Fatalf("the object should be written into primary: %q %v", d, err)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// TLSOptions configures the TLS of the clients to object storages, e.g. the
+// private ones behind an internal CA or requiring client certificates.
+type TLSOptions struct {
+	// PEM bundle of the CAs trusted in addition to the system ones
+	CAFile string
+	// client certificate and key for mutual TLS
+	CertFile string
+	KeyFile  string
+	// for testing only
+	InsecureSkipVerify bool
+}
+
+// the query parameters of endpoint, and the environment variables used when
+// they are not in endpoint
+var tlsParams = []struct{ param, env string }{
+	{"tls-ca-file", "JFS_TLS_CA_FILE"},
+	{"tls-cert-file", "JFS_TLS_CERT_FILE"},
+	{"tls-key-file", "JFS_TLS_KEY_FILE"},
+	{"tls-insecure-skip-verify", "JFS_TLS_INSECURE_SKIP_VERIFY"},
+}
+
+// ParseTLSOptions takes the TLS options out of the query of endpoint, and
+// returns the endpoint without them.
+func ParseTLSOptions(endpoint string) (string, TLSOptions, error) {
+	var opts TLSOptions
+	values := make([]string, len(tlsParams))
+	for i, p := range tlsParams {
+		values[i] = os.Getenv(p.env)
+	}
+	if u, err := url.Parse(endpoint); err == nil && u.RawQuery != "" {
+		query := u.Query()
+		var found bool
+		for i, p := range tlsParams {
+			if _, ok := query[p.param]; ok {
+				values[i] = query.Get(p.param)
+				query.Del(p.param)
+				found = true
+			}
+		}
+		if found {
+			u.RawQuery = query.Encode()
+			endpoint = u.String()
+		}
+	}
+	opts.CAFile, opts.CertFile, opts.KeyFile = values[0], values[1], values[2]
+	if values[3] != "" {
+		var err error
+		if opts.InsecureSkipVerify, err = strconv.ParseBool(values[3]); err != nil {
+			return "", opts, fmt.Errorf("invalid tls-insecure-skip-verify %q: %s", values[3], err)
+		}
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return "", opts, fmt.Errorf("both of the client certificate and key are required")
+	}
+	return endpoint, opts, nil
+}
+
+// Config builds the TLS config, which is nil if nothing is configured.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if o == (TLSOptions{}) {
+		return nil, nil
+	}
+	c := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %s", err)
+		}
+		if c.RootCAs, err = x509.SystemCertPool(); err != nil {
+			c.RootCAs = x509.NewCertPool()
+		}
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate is found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %s", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+var tlsConfig *tls.Config
+
+// SetTLSConfig sets the TLS config of the HTTP clients to object storages,
+// it should be called before any storage is created.
+func SetTLSConfig(c *tls.Config) {
+	tlsConfig = c
+	httpClient.Transport.(*http.Transport).TLSClientConfig = c
+}
@@ -0,0 +1,135 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("write %s: %s", path, err)
+	}
+}
+
+// newClientCert writes a self-signed client certificate and its key.
+func newClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "juicefs"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	kder, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", kder)
+	return certFile, keyFile, cert
+}
+
+func TestParseTLSOptions(t *testing.T) {
+	endpoint, opts, err := ParseTLSOptions("https://s3.local/bucket?tls-ca-file=/ca.pem&tls-cert-file=/c.crt&tls-key-file=/c.key&region=x")
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if endpoint != "https://s3.local/bucket?region=x" {
+		t.Fatalf("the TLS options should be removed from endpoint: %s", endpoint)
+	}
+	if opts != (TLSOptions{CAFile: "/ca.pem", CertFile: "/c.crt", KeyFile: "/c.key"}) {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	os.Setenv("JFS_TLS_INSECURE_SKIP_VERIFY", "true")
+	defer os.Unsetenv("JFS_TLS_INSECURE_SKIP_VERIFY")
+	if endpoint, opts, err = ParseTLSOptions("bucket.s3.local"); err != nil || endpoint != "bucket.s3.local" || !opts.InsecureSkipVerify {
+		t.Fatalf("the options should be read from env: %s %+v %v", endpoint, opts, err)
+	}
+	for _, e := range []string{"https://s3.local/bucket?tls-cert-file=/c.crt", "https://s3.local/bucket?tls-insecure-skip-verify=maybe"} {
+		if _, _, err = ParseTLSOptions(e); err == nil {
+			t.Fatalf("%s should be invalid", e)
+		}
+	}
+	if c, err := (TLSOptions{}).Config(); c != nil || err != nil {
+		t.Fatalf("nothing is configured: %v %v", c, err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, clientCert := newClientCert(t, dir)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", srv.Certificate().Raw)
+
+	_, opts, err := ParseTLSOptions(srv.URL + "/bucket?tls-ca-file=" + caFile + "&tls-cert-file=" + certFile + "&tls-key-file=" + keyFile)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	c, err := opts.Config()
+	if err != nil {
+		t.Fatalf("config: %s", err)
+	}
+	if c.RootCAs == nil || len(c.Certificates) != 1 {
+		t.Fatalf("the CA and client certificate should be configured: %+v", c)
+	}
+	SetTLSConfig(c)
+	defer SetTLSConfig(nil)
+	if httpClient.Transport.(*http.Transport).TLSClientConfig != c {
+		t.Fatalf("the TLS config should be used by the shared client")
+	}
+
+	for name, tr := range map[string]http.RoundTripper{"shared": httpClient.Transport, "aliyun": aliyunTransport(defaultAliyunOptions)} {
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request with the %s transport: %s", name, err)
+		}
+		resp.Body.Close()
+	}
+	// untrusted by the server without the client certificate
+	if _, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: c.RootCAs}}}).Get(srv.URL); err == nil {
+		t.Fatalf("the request without client certificate should fail")
+	}
+}
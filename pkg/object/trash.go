@@ -0,0 +1,256 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Renamer is implemented by the storages able to move an object to another
+// key without copying the content.
+type Renamer interface {
+	Rename(src, dst string) error
+}
+
+// Rename moves src of s to dst, by Rename if s supports it, or by a copy
+// followed by the delete of src.
+func Rename(s ObjectStorage, src, dst string) error {
+	if r, ok := s.(Renamer); ok {
+		return r.Rename(src, dst)
+	}
+	var err error
+	if c, ok := s.(interface{ Copy(dst, src string) error }); ok {
+		err = c.Copy(dst, src)
+	} else {
+		var in io.ReadCloser
+		if in, err = s.Get(src, 0, -1); err == nil {
+			err = s.Put(dst, in)
+			_ = in.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(src)
+}
+
+const (
+	trashPrefix = ".trash/"
+	// the sorted timestamp of the deletes, as the directory in trash
+	trashTimeFormat = "20060102T150405.000000000"
+)
+
+// Trash is an object storage moving the deleted objects into the prefix
+// .trash/ of it, as .trash/<time>/<key>, which are purged once they are
+// older than the retention. The trash is hidden from the listing.
+type Trash struct {
+	ObjectStorage
+	retention time.Duration
+	interval  time.Duration
+	clock     Clock
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   sync.WaitGroup
+}
+
+// WithTrash returns a Trash of o keeping the deleted objects for retention,
+// the expired ones are purged in the background until it's closed.
+func WithTrash(o ObjectStorage, retention time.Duration) *Trash {
+	return withTrash(o, retention, SystemClock)
+}
+
+func withTrash(o ObjectStorage, retention time.Duration, clock Clock) *Trash {
+	interval := retention / 4
+	if interval > time.Hour {
+		interval = time.Hour
+	} else if interval < time.Minute {
+		interval = time.Minute
+	}
+	t := &Trash{ObjectStorage: o, retention: retention, interval: interval, clock: clock, done: make(chan struct{})}
+	t.stopped.Add(1)
+	go t.sweeper()
+	return t
+}
+
+func (t *Trash) String() string {
+	return fmt.Sprintf("%s(trash %s)", t.ObjectStorage, t.retention)
+}
+
+func (t *Trash) sweeper() {
+	defer t.stopped.Done()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-t.clock.After(t.interval):
+		}
+		if n, err := t.Sweep(); err != nil {
+			logger.Warnf("Purge the trash of %s: %s", t.ObjectStorage, err)
+		} else if n > 0 {
+			logger.Infof("Purged %d objects from the trash of %s", n, t.ObjectStorage)
+		}
+	}
+}
+
+// Close stops the sweeper, the trash is kept in the storage.
+func (t *Trash) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	t.stopped.Wait()
+	return nil
+}
+
+// Delete moves key into the trash, the directories and the objects in trash
+// are deleted right away.
+func (t *Trash) Delete(key string) error {
+	if strings.HasSuffix(key, dirSuffix) || strings.HasPrefix(key, trashPrefix) {
+		return t.ObjectStorage.Delete(key)
+	}
+	dst := trashPrefix + t.clock.Now().UTC().Format(trashTimeFormat) + "/" + key
+	err := Rename(t.ObjectStorage, key, dst)
+	if err != nil {
+		if _, e := t.ObjectStorage.Head(key); errors.Is(e, os.ErrNotExist) {
+			return nil
+		}
+	}
+	return err
+}
+
+// parseTrashKey returns the time of delete and the original key of an object
+// in trash.
+func parseTrashKey(key string) (time.Time, string, bool) {
+	rest := strings.TrimPrefix(key, trashPrefix)
+	i := strings.Index(rest, "/")
+	if rest == key || i < 0 {
+		return time.Time{}, "", false
+	}
+	ts, err := time.Parse(trashTimeFormat, rest[:i])
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return ts, rest[i+1:], true
+}
+
+// Restore moves the latest deleted version of key back from the trash, which
+// overwrites key if it's written again. It returns os.ErrNotExist if key is
+// not in trash.
+func (t *Trash) Restore(key string) error {
+	ch, err := ListAll(t.ObjectStorage, trashPrefix, "")
+	if err != nil {
+		return err
+	}
+	var latest string
+	var deleted time.Time
+	for o := range ch {
+		if o == nil {
+			return fmt.Errorf("list the trash of %s failed", t.ObjectStorage)
+		}
+		if ts, k, ok := parseTrashKey(o.Key()); ok && k == key && !ts.Before(deleted) {
+			latest, deleted = o.Key(), ts
+		}
+	}
+	if latest == "" {
+		return fmt.Errorf("restore %s: %w", key, os.ErrNotExist)
+	}
+	return Rename(t.ObjectStorage, latest, key)
+}
+
+// Sweep purges the objects in trash older than the retention, and returns
+// the number of them.
+func (t *Trash) Sweep() (int, error) {
+	ch, err := ListAll(t.ObjectStorage, trashPrefix, "")
+	if err != nil {
+		return 0, err
+	}
+	expire := t.clock.Now().Add(-t.retention)
+	var dirs []string
+	var n int
+	var failed error
+	for o := range ch {
+		if o == nil {
+			return n, fmt.Errorf("list the trash of %s failed", t.ObjectStorage)
+		}
+		ts, _, ok := parseTrashKey(o.Key())
+		if !ok || !ts.Before(expire) {
+			continue
+		}
+		if o.IsDir() {
+			dirs = append(dirs, o.Key())
+			continue
+		}
+		if err := t.ObjectStorage.Delete(o.Key()); err != nil {
+			failed = err
+			continue
+		}
+		n++
+	}
+	// the directories left by the file systems, the deepest first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		_ = t.ObjectStorage.Delete(d)
+	}
+	return n, failed
+}
+
+// filterTrash drops the objects in trash.
+func filterTrash(objs []Object) []Object {
+	kept := objs[:0]
+	for _, o := range objs {
+		if !strings.HasPrefix(o.Key(), trashPrefix) {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+func (t *Trash) List(prefix, marker string, limit int64) ([]Object, error) {
+	for {
+		objs, err := t.ObjectStorage.List(prefix, marker, limit)
+		if err != nil || len(objs) == 0 {
+			return objs, err
+		}
+		last := objs[len(objs)-1].Key()
+		if objs = filterTrash(objs); len(objs) > 0 {
+			return objs, nil
+		}
+		// a page of trash only, which would end the listing
+		marker = last
+	}
+}
+
+func (t *Trash) ListAll(prefix, marker string) (<-chan Object, error) {
+	ch, err := t.ObjectStorage.ListAll(prefix, marker)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, maxResults)
+	go func() {
+		defer close(out)
+		for o := range ch {
+			if o == nil || !strings.HasPrefix(o.Key(), trashPrefix) {
+				out <- o
+			}
+		}
+	}()
+	return out, nil
+}
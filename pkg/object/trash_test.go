@@ -0,0 +1,113 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	mem, _ := newMem("mem", "", "", "")
+	disk, _ := newDisk(t.TempDir()+"/", "", "", "")
+	for _, o := range []ObjectStorage{mem, disk} {
+		clock := NewFakeClock(time.Now())
+		tr := withTrash(o, time.Hour, clock)
+		// swept by hand
+		_ = tr.Close()
+		for _, k := range []string{"a", "dir/b", "c"} {
+			if err := tr.Put(k, bytes.NewReader([]byte(k))); err != nil {
+				t.Fatalf("put %s: %s", k, err)
+			}
+		}
+		if err := tr.Delete("dir/b"); err != nil {
+			t.Fatalf("delete: %s", err)
+		}
+		if err := tr.Delete("missing"); err != nil {
+			t.Fatalf("delete of missing object: %s", err)
+		}
+		if _, err := tr.Head("dir/b"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("deleted object should be gone: %v", err)
+		}
+		ch, err := ListAll(tr, "", "")
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		for _, k := range collect(t, ch) {
+			if strings.HasPrefix(k, trashPrefix) {
+				t.Fatalf("trash is listed: %s", k)
+			}
+		}
+
+		clock.Advance(30 * time.Minute)
+		if n, err := tr.Sweep(); err != nil || n != 0 {
+			t.Fatalf("nothing should be purged within retention: %d %v", n, err)
+		}
+		if err := tr.Restore("dir/b"); err != nil {
+			t.Fatalf("restore: %s", err)
+		}
+		if d, err := get(tr, "dir/b", 0, -1); err != nil || d != "dir/b" {
+			t.Fatalf("restored dir/b: %q %v", d, err)
+		}
+		if err := tr.Restore("dir/b"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("restore twice: %v", err)
+		}
+
+		if err := tr.Delete("a"); err != nil {
+			t.Fatalf("delete: %s", err)
+		}
+		clock.Advance(2 * time.Hour)
+		if n, err := tr.Sweep(); err != nil || n != 1 {
+			t.Fatalf("expect 1 object purged, but got %d %v", n, err)
+		}
+		if err := tr.Restore("a"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("purged object should not be restored: %v", err)
+		}
+		if ch, err = ListAll(o, trashPrefix, ""); err != nil {
+			t.Fatalf("list trash: %s", err)
+		}
+		for _, k := range collect(t, ch) {
+			if k != trashPrefix {
+				t.Fatalf("%s is left in trash", k)
+			}
+		}
+	}
+}
+
+func TestTrashSweeper(t *testing.T) {
+	mem, _ := newMem("mem", "", "", "")
+	clock := NewFakeClock(time.Now())
+	tr := withTrash(mem, time.Hour, clock)
+	defer tr.Close()
+	_ = tr.Put("a", bytes.NewReader([]byte("a")))
+	if err := tr.Delete("a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	// the interval is a quarter of the retention
+	for i := 0; i < 5; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(15 * time.Minute)
+	}
+	clock.BlockUntil(1)
+	if objs, err := mem.List(trashPrefix, "", 100); err != nil || len(objs) != 0 {
+		t.Fatalf("expect trash purged in background, but got %d objects (%v)", len(objs), err)
+	}
+}
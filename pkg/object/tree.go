@@ -0,0 +1,324 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// driveTempDir is the directory of the unfinished uploads in the workdir of
+// the drive-like storages, which is skipped by the listing.
+const driveTempDir = ".temp"
+
+// treeNode is an entry of a directory in drive-like storages, which address
+// files and folders by node ids instead of keys.
+type treeNode struct {
+	id    string
+	name  string
+	isDir bool
+	size  int64
+	mtime time.Time
+	// checksum of a file in lower case hex, in the hashAlgo of the walker
+	hash string
+}
+
+// treeListing is the pending result of listing one directory.
+type treeListing struct {
+	// the directory listed
+	node  treeNode
+	done  chan struct{}
+	nodes []treeNode
+	err   error
+}
+
+// treeWalker lists the objects of a drive-like storage by walking its tree,
+// the directories are fetched in parallel but the objects are emitted in
+// lexical order of their keys.
+type treeWalker struct {
+	// list returns the children of a directory node
+	list func(ctx context.Context, id string) ([]treeNode, error)
+	// skip tells whether a directory (key ends with `/`) should not be walked
+	skip func(key string) bool
+	// bounds the number of directories listed at the same time
+	lock chan struct{}
+	// the algorithm of the checksums in the nodes, if they have
+	hashAlgo HashAlgo
+	// onError, if set, is called with the directories failed to be listed,
+	// which are skipped instead of stopping the walk
+	onError func(dir string, err error)
+	// cache, if set, keeps the listings of directories across the walks
+	cache *listCache
+	// dirMarker, if set, is the name of the files standing for the keys of
+	// their directories (ending with `/`), which are emitted as the first
+	// objects of the directories
+	dirMarker string
+	// dirs emits every directory as an object of zero bytes (its key ends
+	// with `/`) before its children, otherwise only the files are emitted
+	dirs bool
+	// maxDepth is the deepest level of directories walked, the walk fails
+	// (or skips them with onError) beyond it, 0 for no limit
+	maxDepth int
+}
+
+// the default of treeWalker.maxDepth, deeper than any tree created by JuiceFS
+const defaultTreeDepth = 512
+
+// errTooDeep is the error of the directories deeper than maxDepth, e.g. of a
+// pathological tree nested by a buggy client or sync tool.
+var errTooDeep = errors.New("too deep to walk")
+
+func newTreeWalker(concurrency int, list func(ctx context.Context, id string) ([]treeNode, error)) *treeWalker {
+	return &treeWalker{list: list, lock: make(chan struct{}, concurrency), maxDepth: defaultTreeDepth}
+}
+
+// fetch lists the directory node n at dir, or takes the listing from the
+// cache when it's still valid.
+func (w *treeWalker) fetch(ctx context.Context, dir string, n treeNode) *treeListing {
+	l := &treeListing{node: n, done: make(chan struct{})}
+	if w.cache != nil {
+		if nodes, ok := w.cache.get(dir, n); ok {
+			l.nodes = nodes
+			close(l.done)
+			return l
+		}
+	}
+	go func() {
+		defer close(l.done)
+		select {
+		case w.lock <- struct{}{}:
+		case <-ctx.Done():
+			l.err = ctx.Err()
+			return
+		}
+		defer func() { <-w.lock }()
+		l.nodes, l.err = w.list(ctx, n.id)
+		if l.err != nil {
+			return
+		}
+		// directories sort as `name/`, so the keys are emitted in lexical order
+		sort.Slice(l.nodes, func(i, j int) bool {
+			ni, nj := l.nodes[i].name, l.nodes[j].name
+			if l.nodes[i].isDir {
+				ni += "/"
+			}
+			if l.nodes[j].isDir {
+				nj += "/"
+			}
+			return ni < nj
+		})
+		if w.cache != nil {
+			w.cache.put(dir, n, l.nodes)
+		}
+	}()
+	return l
+}
+
+func (w *treeWalker) walk(ctx context.Context, dir string, l *treeListing, prefix, marker string, since time.Time, out chan<- Object) error {
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if l.err != nil {
+		if w.onError != nil && ctx.Err() == nil {
+			w.onError(dir, l.err)
+			return nil
+		}
+		return fmt.Errorf("list %q: %w", dir, l.err)
+	}
+
+	var subdirs []int
+	for i, n := range l.nodes {
+		if !n.isDir {
+			continue
+		}
+		key := dir + n.name + "/"
+		if w.skip != nil && w.skip(key) {
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+			continue
+		}
+		if marker != "" && key <= marker && !strings.HasPrefix(marker, key) {
+			continue
+		}
+		if w.maxDepth > 0 && strings.Count(key, "/") > w.maxDepth {
+			err := fmt.Errorf("list %q: %w, deeper than %d levels", key, errTooDeep, w.maxDepth)
+			if w.onError == nil {
+				return err
+			}
+			w.onError(key, err)
+			continue
+		}
+		subdirs = append(subdirs, i)
+	}
+	// keep the next few subdirectories fetching while the current one is walked
+	pending := make(map[int]*treeListing)
+	next := 0
+	prefetch := func() {
+		for ; next < len(subdirs) && len(pending) < cap(w.lock); next++ {
+			i := subdirs[next]
+			n := l.nodes[i]
+			pending[i] = w.fetch(ctx, dir+n.name+"/", n)
+		}
+	}
+
+	if dir != "" && strings.HasPrefix(dir, prefix) && (marker == "" || dir > marker) {
+		if o := w.dirObject(dir, l); o != nil && (since.IsZero() || o.Mtime().After(since)) {
+			select {
+			case out <- o:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	for i, n := range l.nodes {
+		key := dir + n.name
+		if !n.isDir && w.dirMarker != "" && n.name == w.dirMarker {
+			continue
+		}
+		if n.isDir {
+			sub, ok := pending[i]
+			if !ok {
+				prefetch()
+				if sub, ok = pending[i]; !ok {
+					continue
+				}
+			}
+			delete(pending, i)
+			prefetch()
+			if err := w.walk(ctx, key+"/", sub, prefix, marker, since, out); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) || (marker != "" && key <= marker) || (!since.IsZero() && !n.mtime.After(since)) {
+			continue
+		}
+		select {
+		case out <- w.object(key, n):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// dirObject returns the object of the directory listed by l, which is the
+// marker of it, or the directory itself with dirs, or nil.
+func (w *treeWalker) dirObject(dir string, l *treeListing) Object {
+	if w.dirMarker != "" {
+		for _, n := range l.nodes {
+			if !n.isDir && n.name == w.dirMarker {
+				return &obj{dir, 0, n.mtime, true}
+			}
+		}
+	}
+	if w.dirs {
+		return &obj{dir, 0, l.node.mtime, true}
+	}
+	return nil
+}
+
+func (w *treeWalker) object(key string, n treeNode) Object {
+	o := obj{key, n.size, n.mtime, false}
+	if n.hash != "" && w.hashAlgo != "" {
+		return &hashedObj{o, w.hashAlgo, n.hash}
+	}
+	return &o
+}
+
+// listAll walks the tree under the root node. The walk stops at the first
+// error, and a nil object is sent to report it.
+func (w *treeWalker) listAll(ctx context.Context, rootID, prefix, marker string) <-chan Object {
+	return w.listSince(ctx, rootID, prefix, marker, time.Time{})
+}
+
+// listSince is like listAll, but only the files modified after since are
+// emitted. The directories are still walked, since the mtime of a folder is
+// not updated by the changes deep inside it.
+func (w *treeWalker) listSince(ctx context.Context, rootID, prefix, marker string, since time.Time) <-chan Object {
+	return w.listFrom(ctx, "", rootID, prefix, marker, since)
+}
+
+// listFrom walks the tree under the directory node id at dir (empty or ends
+// with `/`), which should contain all the keys with prefix, so the
+// directories above it are not listed.
+func (w *treeWalker) listFrom(ctx context.Context, dir, id, prefix, marker string, since time.Time) <-chan Object {
+	ctx, cancel := context.WithCancel(ctx)
+	out := make(chan Object, 10240)
+	go func() {
+		defer cancel()
+		// nobody is reading after the walk is canceled
+		err := w.walk(ctx, dir, w.fetch(ctx, dir, treeNode{id: id, isDir: true}), prefix, marker, since, out)
+		if err != nil && ctx.Err() == nil {
+			logger.Errorf("list from %s: %s", id, err)
+			out <- nil
+		} else if err == nil && w.cache != nil {
+			if err = w.cache.save(); err != nil {
+				logger.Warnf("Save listing cache %s: %s", w.cache.path, err)
+			}
+		}
+		close(out)
+	}()
+	return out
+}
+
+// invalidate drops the cached listings of the directories containing key,
+// which is changed through the storage.
+func (w *treeWalker) invalidate(key string) {
+	if w.cache != nil {
+		w.cache.invalidate(key)
+	}
+}
+
+// tolerant returns a walker sharing the concurrency of w, which skips the
+// directories failed to be listed and reports them to onError.
+func (w *treeWalker) tolerant(onError func(dir string, err error)) *treeWalker {
+	t := *w
+	t.onError = onError
+	return &t
+}
+
+// listN returns at most limit objects after marker, the walk is stopped once
+// enough objects are found.
+func (w *treeWalker) listN(ctx context.Context, rootID, prefix, marker string, limit int64) ([]Object, error) {
+	return w.listNFrom(ctx, "", rootID, prefix, marker, limit)
+}
+
+// listNFrom is like listN, but walks from the directory node id at dir as
+// listFrom.
+func (w *treeWalker) listNFrom(ctx context.Context, dir, id, prefix, marker string, limit int64) ([]Object, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var objs []Object
+	for o := range w.listFrom(ctx, dir, id, prefix, marker, time.Time{}) {
+		if o == nil {
+			return nil, fmt.Errorf("list %s from %q failed", prefix, marker)
+		}
+		objs = append(objs, o)
+		if int64(len(objs)) >= limit {
+			break
+		}
+	}
+	return objs, nil
+}
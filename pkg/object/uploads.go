@@ -0,0 +1,46 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import "time"
+
+// AbortStaleUploads aborts the multipart uploads of s started before the
+// deadline, which are left by the clients crashed halfway and take the
+// space invisibly. The uploads of unknown start time are kept, it returns
+// the number of uploads aborted.
+func AbortStaleUploads(s ObjectStorage, before time.Time) (int, error) {
+	var aborted int
+	var marker string
+	for {
+		parts, next, err := s.ListUploads(marker)
+		if err != nil {
+			return aborted, err
+		}
+		for _, p := range parts {
+			if p.Created.IsZero() || !p.Created.Before(before) {
+				continue
+			}
+			logger.Debugf("Abort the upload %s of %s started at %s", p.UploadID, p.Key, p.Created)
+			s.AbortUpload(p.Key, p.UploadID)
+			aborted++
+		}
+		if next == "" {
+			return aborted, nil
+		}
+		marker = next
+	}
+}
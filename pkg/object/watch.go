@@ -0,0 +1,62 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"time"
+)
+
+// EventType is the kind of change of an Event.
+type EventType int
+
+const (
+	// EventPut is an object created or overwritten
+	EventPut EventType = iota + 1
+	// EventDelete is an object removed
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Event is a change of an object notified by the storage.
+type Event struct {
+	Type EventType
+	Key  string
+	// size of the object put, 0 for the deletes
+	Size int64
+	Time time.Time
+}
+
+// Watcher is implemented by the storages notifying the changes of objects
+// natively, e.g. the bucket notifications of MinIO, those could be used to
+// invalidate the caches of the objects changed by other clients. The storages
+// without native notifications don't implement it.
+type Watcher interface {
+	// Watch sends the changes of the objects with the prefix, made after it
+	// returns, until ctx is done, then the channel is closed. The changes
+	// during a reconnect could be missed.
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
+}
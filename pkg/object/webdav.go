@@ -282,6 +282,7 @@ func newWebDAV(endpoint, user, passwd, token string) (ObjectStorage, error) {
 	}
 	uri.User = url.UserPassword(user, passwd)
 	c := gowebdav.NewClient(uri.String(), user, passwd)
+	c.SetTransport(&responseLimiter{httpClient.Transport, func(req *http.Request) bool { return req.Method == "PROPFIND" }})
 
 	return &webdav{endpoint: uri, c: c}, nil
 }
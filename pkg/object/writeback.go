@@ -0,0 +1,455 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spooled is an object written into the spool dir but not uploaded yet.
+type spooled struct {
+	key  string
+	path string
+	seq  uint64
+	// the keys to be uploaded before it, see PutAfter
+	after []string
+	// the upload failed, so the ones after it are neither uploaded
+	failed bool
+}
+
+// the suffix of the file keeping the prerequisites of a spooled object
+const afterSuffix = ".after"
+
+// WriteBack is an object storage which acks the Puts once the objects are
+// written into a local spool dir, and uploads them in background.
+//
+// A Put is durable once it returns: the object is synced into the spool dir,
+// and those not uploaded (even failed) are uploaded again when the spool dir
+// is opened next time. The objects are uploaded one by one in the order of
+// Puts, and an object overwritten before uploaded is skipped, so the latest
+// one always wins. Head and Get see the pending objects, but the listings
+// only have the uploaded ones. The objects can not be uploaded in parts.
+//
+// With more threads (see WithWriteBackThreads), the objects are uploaded at
+// the same time in any order, unless the order is declared by PutAfter.
+type WriteBack struct {
+	ObjectStorage
+	dir     string
+	queue   chan *spooled
+	retries int
+	backoff time.Duration
+	clock   Clock
+
+	mu        sync.Mutex
+	uploaded  *sync.Cond
+	seq       uint64
+	pending   map[string]*spooled
+	uploading map[string]int
+	// the objects waiting for the uploads of a key
+	waiting  map[string][]*spooled
+	flushing sync.WaitGroup
+	errs     []string
+}
+
+func spoolName(seq uint64, key string) string {
+	return fmt.Sprintf("%020d_%s", seq, base64.RawURLEncoding.EncodeToString([]byte(key)))
+}
+
+func parseSpoolName(name string) (uint64, string, bool) {
+	parts := strings.SplitN(name, "_", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	key, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return seq, string(key), true
+}
+
+// WithWriteBack returns a WriteBack of o spooling into spoolDir, the Puts
+// block when there are already maxPending objects not uploaded. The objects
+// left in spoolDir are queued again for upload.
+func WithWriteBack(o ObjectStorage, spoolDir string, maxPending int) (*WriteBack, error) {
+	return WithWriteBackThreads(o, spoolDir, maxPending, 1)
+}
+
+// WithWriteBackThreads returns a WriteBack as WithWriteBack, which uploads
+// the objects in threads.
+func WithWriteBackThreads(o ObjectStorage, spoolDir string, maxPending, threads int) (*WriteBack, error) {
+	if err := os.MkdirAll(spoolDir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(spoolDir)
+	if err != nil {
+		return nil, err
+	}
+	var left []*spooled
+	for _, e := range entries {
+		path := filepath.Join(spoolDir, e.Name())
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			// not acked
+			_ = os.Remove(path)
+			continue
+		}
+		if seq, key, ok := parseSpoolName(e.Name()); ok {
+			s := &spooled{key: key, path: path, seq: seq}
+			if s.after, err = readAfter(path); err != nil {
+				return nil, err
+			}
+			left = append(left, s)
+		} else if name := strings.TrimSuffix(e.Name(), afterSuffix); name != e.Name() {
+			if _, err := os.Stat(filepath.Join(spoolDir, name)); os.IsNotExist(err) {
+				// the object is uploaded
+				_ = os.Remove(path)
+			}
+		}
+	}
+	sort.Slice(left, func(i, j int) bool { return left[i].seq < left[j].seq })
+	if maxPending < len(left) {
+		maxPending = len(left)
+	}
+	w := &WriteBack{ObjectStorage: o, dir: spoolDir, queue: make(chan *spooled, maxPending),
+		retries: 3, backoff: time.Second, clock: SystemClock, pending: make(map[string]*spooled),
+		uploading: make(map[string]int), waiting: make(map[string][]*spooled)}
+	w.uploaded = sync.NewCond(&w.mu)
+	for _, s := range left {
+		w.seq = s.seq
+		w.pending[s.key] = s
+		w.flushing.Add(1)
+		w.queue <- s
+	}
+	if len(left) > 0 {
+		logger.Infof("Upload %d objects left in %s", len(left), spoolDir)
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	for i := 0; i < threads; i++ {
+		go w.run()
+	}
+	return w, nil
+}
+
+// readAfter returns the prerequisites of the object spooled at path.
+func readAfter(path string) ([]string, error) {
+	data, err := os.ReadFile(path + afterSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var after []string
+	if err = json.Unmarshal(data, &after); err != nil {
+		return nil, fmt.Errorf("decode the prerequisites of %s: %w", path, err)
+	}
+	return after, nil
+}
+
+// remove deletes the files of a spooled object.
+func (s *spooled) remove() {
+	_ = os.Remove(s.path)
+	if len(s.after) > 0 {
+		_ = os.Remove(s.path + afterSuffix)
+	}
+}
+
+// blocker returns the key s should wait for with the lock held, or fails if
+// one of them failed to upload.
+func (w *WriteBack) blocker(s *spooled) (string, error) {
+	if w.uploading[s.key] > 0 {
+		// the previous one is still being uploaded by another thread
+		return s.key, nil
+	}
+	for _, k := range s.after {
+		if p := w.pending[k]; p != nil {
+			if p.failed {
+				return "", fmt.Errorf("its prerequisite %s failed to upload", k)
+			}
+			return k, nil
+		}
+		if w.uploading[k] > 0 {
+			return k, nil
+		}
+	}
+	return "", nil
+}
+
+// release queues the objects waiting for key again with the lock held.
+func (w *WriteBack) release(key string) {
+	for _, s := range w.waiting[key] {
+		s := s
+		// not to block the uploader with a full queue
+		go func() { w.queue <- s }()
+	}
+	delete(w.waiting, key)
+}
+
+func (w *WriteBack) String() string {
+	return fmt.Sprintf("%s(write back %s)", w.ObjectStorage, w.dir)
+}
+
+func (w *WriteBack) upload(s *spooled) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.ObjectStorage.Put(s.key, f)
+}
+
+func (w *WriteBack) run() {
+	for s := range w.queue {
+		w.mu.Lock()
+		if w.pending[s.key] != s {
+			// overwritten or deleted
+			w.release(s.key)
+			w.mu.Unlock()
+			s.remove()
+			w.flushing.Done()
+			continue
+		}
+		blocker, err := w.blocker(s)
+		if blocker != "" {
+			w.waiting[blocker] = append(w.waiting[blocker], s)
+			w.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			s.failed = true
+			logger.Errorf("Upload %s from %s: %s", s.key, s.path, err)
+			w.errs = append(w.errs, fmt.Sprintf("%s: %s", s.key, err))
+			w.release(s.key)
+			w.mu.Unlock()
+			w.flushing.Done()
+			continue
+		}
+		w.uploading[s.key]++
+		w.mu.Unlock()
+
+		backoff := w.backoff
+		for i := 0; i <= w.retries; i++ {
+			if i > 0 {
+				logger.Warnf("Upload %s (attempt %d): %s, retry in %s", s.key, i, err, backoff)
+				w.clock.Sleep(backoff)
+				backoff *= 2
+			}
+			if err = w.upload(s); err == nil || ClassifyError(w.ObjectStorage, err) == ErrorPermanent {
+				break
+			}
+		}
+
+		w.mu.Lock()
+		if w.uploading[s.key]--; w.uploading[s.key] == 0 {
+			delete(w.uploading, s.key)
+		}
+		if err != nil && w.pending[s.key] == s {
+			// kept in pending and the spool dir, to be uploaded at next start
+			s.failed = true
+			logger.Errorf("Upload %s from %s: %s", s.key, s.path, err)
+			w.errs = append(w.errs, fmt.Sprintf("%s: %s", s.key, err))
+		} else {
+			if w.pending[s.key] == s {
+				delete(w.pending, s.key)
+			}
+			s.remove()
+		}
+		w.release(s.key)
+		w.uploaded.Broadcast()
+		w.mu.Unlock()
+		w.flushing.Done()
+	}
+}
+
+func (w *WriteBack) Put(key string, in io.Reader) error {
+	return w.PutAfter(key, in)
+}
+
+// errCyclicOrder is the error of PutAfter making a cycle of prerequisites.
+var errCyclicOrder = errors.New("cyclic order of uploads")
+
+// dependsOn tells whether the pending object of key is to be uploaded after
+// target, directly or not, with the lock held.
+func (w *WriteBack) dependsOn(key, target string, seen map[string]bool) bool {
+	if key == target {
+		return true
+	}
+	if seen[key] {
+		return false
+	}
+	seen[key] = true
+	if p := w.pending[key]; p != nil {
+		for _, k := range p.after {
+			if w.dependsOn(k, target, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PutAfter writes the object as Put, which is uploaded only after the objects
+// of the keys in after not uploaded yet, e.g. a manifest after its parts Put
+// before it. An object overwritten before uploaded is waited for by its
+// latest one. It's not uploaded if any of them failed (as reported by Flush),
+// but kept in the spool dir to be uploaded at next start with the order kept.
+func (w *WriteBack) PutAfter(key string, in io.Reader, after ...string) error {
+	w.mu.Lock()
+	var waits []string
+	for _, k := range after {
+		if w.dependsOn(k, key, make(map[string]bool)) {
+			w.mu.Unlock()
+			return fmt.Errorf("put %s after %s: %w", key, k, errCyclicOrder)
+		}
+		if w.pending[k] != nil || w.uploading[k] > 0 {
+			waits = append(waits, k)
+		}
+	}
+	w.seq++
+	s := &spooled{key: key, path: filepath.Join(w.dir, spoolName(w.seq, key)), seq: w.seq, after: waits}
+	w.mu.Unlock()
+	after = waits
+
+	if len(after) > 0 {
+		data, _ := json.Marshal(after)
+		// written before the object, which acks the Put
+		if err := os.WriteFile(s.path+afterSuffix, data, 0600); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		if len(after) > 0 {
+			_ = os.Remove(s.path + afterSuffix)
+		}
+		return err
+	}
+
+	w.mu.Lock()
+	if old := w.pending[s.key]; old == nil || old.seq < s.seq {
+		w.pending[s.key] = s
+	}
+	w.mu.Unlock()
+	w.flushing.Add(1)
+	w.queue <- s
+	return nil
+}
+
+func (w *WriteBack) spooled(key string) *spooled {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending[key]
+}
+
+func (w *WriteBack) Head(key string) (Object, error) {
+	if s := w.spooled(key); s != nil {
+		if fi, err := os.Stat(s.path); err == nil {
+			return &obj{key, fi.Size(), fi.ModTime(), false}, nil
+		}
+	}
+	return w.ObjectStorage.Head(key)
+}
+
+func (w *WriteBack) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if s := w.spooled(key); s != nil {
+		// it could be uploaded and removed just now
+		if f, err := os.Open(s.path); err == nil {
+			if _, err = f.Seek(off, io.SeekStart); err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+			if limit > 0 {
+				return struct {
+					io.Reader
+					io.Closer
+				}{io.LimitReader(f, limit), f}, nil
+			}
+			return f, nil
+		}
+	}
+	return w.ObjectStorage.Get(key, off, limit)
+}
+
+// Delete drops the pending object of key, and waits for the one being
+// uploaded before deleting it from the storage.
+func (w *WriteBack) Delete(key string) error {
+	w.mu.Lock()
+	if s, ok := w.pending[key]; ok {
+		delete(w.pending, key)
+		if w.uploading[key] == 0 {
+			s.remove()
+		}
+		w.release(key)
+	}
+	for w.uploading[key] > 0 {
+		w.uploaded.Wait()
+	}
+	w.mu.Unlock()
+	return w.ObjectStorage.Delete(key)
+}
+
+// CreateMultipartUpload is not supported, so the objects are always spooled
+// by Put.
+func (w *WriteBack) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return nil, notSupported
+}
+
+// Flush waits for the queued objects to be uploaded, and returns the failed
+// uploads since last Flush.
+func (w *WriteBack) Flush() error {
+	w.flushing.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.errs) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%d uploads to %s failed: %s", len(w.errs), w.ObjectStorage, strings.Join(w.errs, "; "))
+	w.errs = nil
+	return err
+}
+
+var _ ObjectStorage = &WriteBack{}
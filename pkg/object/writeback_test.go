@@ -0,0 +1,242 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedPut blocks the Puts until the gate is opened.
+type gatedPut struct {
+	ObjectStorage
+	gate chan struct{}
+}
+
+func (g *gatedPut) Put(key string, in io.Reader) error {
+	<-g.gate
+	return g.ObjectStorage.Put(key, in)
+}
+
+func TestWriteBack(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	g := &gatedPut{m, make(chan struct{})}
+	dir := t.TempDir()
+	w, err := WithWriteBack(g, dir, 10)
+	if err != nil {
+		t.Fatalf("write back: %s", err)
+	}
+	for _, key := range []string{"a", "b", "a"} {
+		if err = w.Put(key, strings.NewReader("data of "+key+key)); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	if _, err = m.Head("a"); err == nil {
+		t.Fatalf("a should not be uploaded yet")
+	}
+	// read after write from the spool
+	if d, err := get(w, "a", 0, -1); err != nil || d != "data of aa" {
+		t.Fatalf("get a: %q %v", d, err)
+	}
+	if d, err := get(w, "b", 8, 1); err != nil || d != "b" {
+		t.Fatalf("get range of b: %q %v", d, err)
+	}
+	if o, err := w.Head("b"); err != nil || o.Size() != 10 {
+		t.Fatalf("head b: %+v %v", o, err)
+	}
+
+	close(g.gate)
+	if err = w.Flush(); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+	for key, data := range map[string]string{"a": "data of aa", "b": "data of bb"} {
+		if d, err := get(m, key, 0, -1); err != nil || d != data {
+			t.Fatalf("%s should be uploaded: %q %v", key, d, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("the spool dir should be empty after flush: %d left", len(entries))
+	}
+
+	if err = w.Delete("a"); err != nil {
+		t.Fatalf("delete a: %s", err)
+	}
+	if _, err = w.Head("a"); err == nil {
+		t.Fatalf("a should be deleted")
+	}
+}
+
+func TestWriteBackFailure(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	dir := t.TempDir()
+	w, err := WithWriteBack(&brokenPut{m}, dir, 10)
+	if err != nil {
+		t.Fatalf("write back: %s", err)
+	}
+	w.backoff = 0
+	if err = w.Put("a", strings.NewReader("aaa")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err = w.Flush(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("the failed upload should be reported: %v", err)
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatalf("the failure should be reported once: %s", err)
+	}
+	// still readable from the spool
+	if d, err := get(w, "a", 0, -1); err != nil || d != "aaa" {
+		t.Fatalf("get a: %q %v", d, err)
+	}
+
+	// uploaded by the next one
+	w, err = WithWriteBack(m, dir, 1)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+	if d, err := get(m, "a", 0, -1); err != nil || d != "aaa" {
+		t.Fatalf("a should be uploaded after reopen: %q %v", d, err)
+	}
+}
+
+// orderedPuts records the order of the Puts, which fail for the keys in fail.
+type orderedPuts struct {
+	ObjectStorage
+	sync.Mutex
+	order []string
+	fail  map[string]bool
+}
+
+func (o *orderedPuts) Put(key string, in io.Reader) error {
+	time.Sleep(time.Millisecond * time.Duration(rand.Intn(3)))
+	o.Lock()
+	failed := o.fail[key]
+	o.Unlock()
+	if failed {
+		return errors.New("injected failure")
+	}
+	if err := o.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	o.Lock()
+	o.order = append(o.order, key)
+	o.Unlock()
+	return nil
+}
+
+func (o *orderedPuts) index(key string) int {
+	o.Lock()
+	defer o.Unlock()
+	for i, k := range o.order {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestWriteBackOrder(t *testing.T) {
+	m, _ := newMem("", "", "", "")
+	o := &orderedPuts{ObjectStorage: m}
+	dir := t.TempDir()
+	w, err := WithWriteBackThreads(o, dir, 100, 8)
+	if err != nil {
+		t.Fatalf("write back: %s", err)
+	}
+	w.backoff = 0
+	for round := 0; round < 10; round++ {
+		var parts []string
+		for i := 0; i < 8; i++ {
+			parts = append(parts, fmt.Sprintf("%d/part%d", round, i))
+		}
+		manifest := fmt.Sprintf("%d/manifest", round)
+		var wg sync.WaitGroup
+		for _, p := range parts {
+			if err = w.Put(p, strings.NewReader(p)); err != nil {
+				t.Fatalf("put %s: %s", p, err)
+			}
+		}
+		// uploaded at the same time as its parts without the order
+		if err = w.PutAfter(manifest, strings.NewReader("manifest"), parts...); err != nil {
+			t.Fatalf("put %s: %s", manifest, err)
+		}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = w.Flush()
+			}()
+		}
+		wg.Wait()
+		if err = w.Flush(); err != nil {
+			t.Fatalf("flush: %s", err)
+		}
+		last := o.index(manifest)
+		for _, p := range parts {
+			if i := o.index(p); i < 0 || i > last {
+				t.Fatalf("%s is uploaded at %d, but the manifest at %d", p, i, last)
+			}
+		}
+	}
+	if err = w.PutAfter("a", strings.NewReader("a"), "a"); !errors.Is(err, errCyclicOrder) {
+		t.Fatalf("put after itself: %v", err)
+	}
+
+	// not uploaded after a failed prerequisite, but kept for the next start
+	o.Lock()
+	o.fail = map[string]bool{"part": true}
+	o.Unlock()
+	if err = w.Put("part", strings.NewReader("part")); err != nil {
+		t.Fatalf("put part: %s", err)
+	}
+	if err = w.PutAfter("manifest", strings.NewReader("manifest"), "part"); err != nil {
+		t.Fatalf("put manifest: %s", err)
+	}
+	if err = w.PutAfter("part", strings.NewReader("part"), "manifest"); !errors.Is(err, errCyclicOrder) {
+		t.Fatalf("put in a cycle: %v", err)
+	}
+	if err = w.Flush(); err == nil || !strings.Contains(err.Error(), "prerequisite part failed") {
+		t.Fatalf("the manifest should fail with its part: %v", err)
+	}
+	if _, err = m.Head("manifest"); err == nil {
+		t.Fatalf("the manifest should not be uploaded")
+	}
+	o.Lock()
+	o.fail = nil
+	o.Unlock()
+	if w, err = WithWriteBackThreads(o, dir, 100, 8); err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatalf("flush after reopen: %s", err)
+	}
+	if p, mi := o.index("part"), o.index("manifest"); p < 0 || mi < p {
+		t.Fatalf("the order should be kept after reopen: part at %d, manifest at %d", p, mi)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("the spool dir should be empty after flush: %d left", len(entries))
+	}
+}
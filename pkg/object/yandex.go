@@ -0,0 +1,294 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const yandexAPI = "https://cloud-api.yandex.net"
+
+type yandexError struct {
+	Status      int    `json:"-"`
+	Err         string `json:"error"`
+	Message     string `json:"message"`
+	Description string `json:"description"`
+}
+
+func (e *yandexError) Error() string {
+	return fmt.Sprintf("yandex disk: %d %s: %s", e.Status, e.Err, e.Message)
+}
+
+func (e *yandexError) Unwrap() error {
+	if e.Err == "DiskNotFoundError" || e.Status == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+type yandexResource struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+	Embedded *struct {
+		Items []*yandexResource `json:"items"`
+		Total int               `json:"total"`
+	} `json:"_embedded"`
+}
+
+func (r *yandexResource) mtime() time.Time {
+	t, _ := time.Parse(time.RFC3339, r.Modified)
+	return t
+}
+
+type yandexLink struct {
+	Href   string `json:"href"`
+	Method string `json:"method"`
+}
+
+type yandexDisk struct {
+	DefaultObjectStorage
+	client  *http.Client
+	apiURL  string
+	token   string
+	workdir string
+	// the directories known to exist
+	dirs   sync.Map
+	walker *treeWalker
+}
+
+func (y *yandexDisk) String() string {
+	return fmt.Sprintf("yandex://%s/", strings.Trim(y.workdir, "/"))
+}
+
+// request sends an authorized request, the errors of API are returned as
+// yandexError.
+func (y *yandexDisk) request(ctx context.Context, method, u string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if strings.HasPrefix(u, y.apiURL) {
+		req.Header.Set("Authorization", "OAuth "+y.token)
+	}
+	resp, err := y.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		e := &yandexError{Status: resp.StatusCode}
+		if json.Unmarshal(data, e) != nil {
+			e.Message = string(bytes.TrimSpace(data))
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// api calls a resource API on path p, the JSON response is decoded into
+// response.
+func (y *yandexDisk) api(ctx context.Context, method, api, p string, query url.Values, response interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("path", "disk:"+p)
+	u := fmt.Sprintf("%s/v1/disk/resources%s?%s", y.apiURL, api, query.Encode())
+	resp, err := y.request(ctx, method, u, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
+
+func (y *yandexDisk) path(key string) string {
+	return path.Join(y.workdir, key)
+}
+
+func (y *yandexDisk) listNodes(ctx context.Context, dir string) ([]treeNode, error) {
+	var nodes []treeNode
+	for offset := 0; ; {
+		var r yandexResource
+		q := url.Values{"limit": {"1000"}, "offset": {fmt.Sprint(offset)}, "sort": {"name"}}
+		if err := y.api(ctx, http.MethodGet, "", dir, q, &r); err != nil {
+			return nil, err
+		}
+		if r.Embedded == nil {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		for _, i := range r.Embedded.Items {
+			isDir := i.Type == "dir"
+			if isDir {
+				y.dirs.Store(path.Join(dir, i.Name), true)
+			}
+			nodes = append(nodes, treeNode{path.Join(dir, i.Name), i.Name, isDir, i.Size, i.mtime(), ""})
+		}
+		offset += len(r.Embedded.Items)
+		if len(r.Embedded.Items) == 0 || offset >= r.Embedded.Total {
+			return nodes, nil
+		}
+	}
+}
+
+// mkdirAll creates the directory and its parents, the existing ones are cached.
+func (y *yandexDisk) mkdirAll(dir string) error {
+	dir = path.Clean("/" + dir)
+	if dir == "/" {
+		return nil
+	}
+	if _, ok := y.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := y.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	err := y.api(ctx, http.MethodPut, "", dir, nil, nil)
+	var e *yandexError
+	if errors.As(err, &e) && e.Err == "DiskPathPointsToExistentDirectoryError" {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	y.dirs.Store(dir, true)
+	return nil
+}
+
+func (y *yandexDisk) Head(key string) (Object, error) {
+	var r yandexResource
+	q := url.Values{"fields": {"name,type,size,modified"}}
+	if err := y.api(ctx, http.MethodGet, "", y.path(key), q, &r); err != nil {
+		return nil, err
+	}
+	if r.Type == "dir" {
+		return nil, fmt.Errorf("%s is a directory: %w", key, os.ErrNotExist)
+	}
+	return &obj{key, r.Size, r.mtime(), false}, nil
+}
+
+func (y *yandexDisk) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	var link yandexLink
+	if err := y.api(ctx, http.MethodGet, "/download", y.path(key), nil, &link); err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if limit > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+limit-1))
+	} else if off > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := y.request(ctx, http.MethodGet, link.Href, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put requests an upload link of the key, then uploads the content to it,
+// which replaces the existing file.
+func (y *yandexDisk) Put(key string, in io.Reader) error {
+	p := y.path(key)
+	if err := y.mkdirAll(path.Dir(p)); err != nil {
+		return err
+	}
+	var link yandexLink
+	if err := y.api(ctx, http.MethodGet, "/upload", p, url.Values{"overwrite": {"true"}}, &link); err != nil {
+		return fmt.Errorf("get upload link: %w", err)
+	}
+	method := link.Method
+	if method == "" {
+		method = http.MethodPut
+	}
+	resp, err := y.request(ctx, method, link.Href, nil, in)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", key, err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (y *yandexDisk) Delete(key string) error {
+	err := y.api(ctx, http.MethodDelete, "", y.path(key), url.Values{"permanently": {"true"}}, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+func (y *yandexDisk) ListAll(prefix, marker string) (<-chan Object, error) {
+	return y.walker.listAll(ctx, y.workdir, prefix, marker), nil
+}
+
+// parseYandexEndpoint returns the URL of API and the workdir, the endpoint
+// could be a path on the disk, or a full URL for compatible services.
+func parseYandexEndpoint(endpoint string) (string, string, error) {
+	if !strings.Contains(endpoint, "://") {
+		return yandexAPI, path.Clean("/" + endpoint), nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("invalid endpoint %s", endpoint)
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host), path.Clean("/" + u.Path), nil
+}
+
+// newYandex creates a storage on Yandex Disk, the token (or secretKey) is the
+// OAuth token of the account.
+func newYandex(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	apiURL, workdir, err := parseYandexEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		token = secretKey
+	}
+	if token == "" {
+		return nil, fmt.Errorf("OAuth token of yandex disk is required")
+	}
+	y := &yandexDisk{client: httpClient, apiURL: apiURL, token: token, workdir: workdir}
+	if err = y.mkdirAll(workdir); err != nil {
+		return nil, err
+	}
+	y.walker = newTreeWalker(4, y.listNodes)
+	return y, nil
+}
+
+func init() {
+	Register("yandex", newYandex)
+}
@@ -0,0 +1,266 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockYandex emulates the subset of Yandex Disk REST API used by yandexDisk.
+type mockYandex struct {
+	sync.Mutex
+	srv   *httptest.Server
+	token string
+	dirs  map[string]bool
+	files map[string][]byte
+	// the upload links issued, the value is the path to upload
+	links   map[string]string
+	seq     int
+	uploads int
+}
+
+func newMockYandex() *mockYandex {
+	m := &mockYandex{token: "token1", dirs: map[string]bool{"/": true}, files: make(map[string][]byte), links: make(map[string]string)}
+	m.srv = httptest.NewServer(m)
+	return m
+}
+
+func (m *mockYandex) resource(p string) *yandexResource {
+	now := time.Now().Format(time.RFC3339)
+	if data, ok := m.files[p]; ok {
+		return &yandexResource{Name: path.Base(p), Path: "disk:" + p, Type: "file", Size: int64(len(data)), Modified: now}
+	}
+	if m.dirs[p] {
+		return &yandexResource{Name: path.Base(p), Path: "disk:" + p, Type: "dir", Modified: now}
+	}
+	return nil
+}
+
+func (m *mockYandex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/download/") {
+		p := strings.TrimPrefix(r.URL.Path, "/download")
+		data, ok := m.files[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, path.Base(p), time.Time{}, bytes.NewReader(data))
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		p, ok := m.links[r.URL.Path]
+		if !ok || r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		delete(m.links, r.URL.Path)
+		m.files[p], _ = io.ReadAll(r.Body)
+		m.uploads++
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	fail := func(status int, name string) {
+		writeJSON(w, status, yandexError{Err: name, Message: name})
+	}
+	if r.Header.Get("Authorization") != "OAuth "+m.token {
+		fail(http.StatusUnauthorized, "UnauthorizedError")
+		return
+	}
+	q := r.URL.Query()
+	if !strings.HasPrefix(q.Get("path"), "disk:/") {
+		fail(http.StatusBadRequest, "FieldValidationError")
+		return
+	}
+	p := path.Clean(strings.TrimPrefix(q.Get("path"), "disk:"))
+	switch strings.TrimPrefix(r.URL.Path, "/v1/disk/resources") + " " + r.Method {
+	case " GET":
+		res := m.resource(p)
+		if res == nil {
+			fail(http.StatusNotFound, "DiskNotFoundError")
+			return
+		}
+		if res.Type == "dir" {
+			var items []*yandexResource
+			for d := range m.dirs {
+				if d != "/" && path.Dir(d) == p {
+					items = append(items, m.resource(d))
+				}
+			}
+			for f := range m.files {
+				if path.Dir(f) == p {
+					items = append(items, m.resource(f))
+				}
+			}
+			sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+			offset, _ := strconv.Atoi(q.Get("offset"))
+			limit, _ := strconv.Atoi(q.Get("limit"))
+			// pages are smaller than asked to cover the pagination
+			if limit == 0 || limit > 2 {
+				limit = 2
+			}
+			total := len(items)
+			if offset > total {
+				offset = total
+			}
+			if offset+limit > total {
+				limit = total - offset
+			}
+			res.Embedded = &struct {
+				Items []*yandexResource `json:"items"`
+				Total int               `json:"total"`
+			}{items[offset : offset+limit], total}
+		}
+		writeJSON(w, http.StatusOK, res)
+	case " PUT":
+		if m.resource(p) != nil {
+			fail(http.StatusConflict, "DiskPathPointsToExistentDirectoryError")
+			return
+		}
+		if !m.dirs[path.Dir(p)] {
+			fail(http.StatusConflict, "DiskPathDoesntExistsError")
+			return
+		}
+		m.dirs[p] = true
+		writeJSON(w, http.StatusCreated, yandexLink{Href: m.srv.URL + "/v1/disk/resources?path=disk:" + p, Method: "GET"})
+	case " DELETE":
+		if _, ok := m.files[p]; !ok {
+			fail(http.StatusNotFound, "DiskNotFoundError")
+			return
+		}
+		delete(m.files, p)
+		w.WriteHeader(http.StatusNoContent)
+	case "/download GET":
+		if _, ok := m.files[p]; !ok {
+			fail(http.StatusNotFound, "DiskNotFoundError")
+			return
+		}
+		writeJSON(w, http.StatusOK, yandexLink{Href: m.srv.URL + "/download" + p, Method: "GET"})
+	case "/upload GET":
+		if !m.dirs[path.Dir(p)] {
+			fail(http.StatusConflict, "DiskPathDoesntExistsError")
+			return
+		}
+		if _, ok := m.files[p]; ok && q.Get("overwrite") != "true" {
+			fail(http.StatusConflict, "DiskResourceAlreadyExistsError")
+			return
+		}
+		m.seq++
+		link := fmt.Sprintf("/upload/%d", m.seq)
+		m.links[link] = p
+		writeJSON(w, http.StatusOK, yandexLink{Href: m.srv.URL + link, Method: "PUT"})
+	default:
+		fail(http.StatusNotFound, "NotFoundError")
+	}
+}
+
+func TestYandex(t *testing.T) {
+	m := newMockYandex()
+	defer m.srv.Close()
+	if _, err := newYandex(m.srv.URL+"/jfs", "", "", "bad token"); err == nil {
+		t.Fatalf("a bad token should fail")
+	}
+	store, err := newYandex(m.srv.URL+"/jfs", "", m.token, "")
+	if err != nil {
+		t.Fatalf("create yandex: %s", err)
+	}
+	s := store.(*yandexDisk)
+
+	if _, err := s.Head("chunks/0/0/1_0_4"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head of not existed object: %v", err)
+	}
+	if _, err := s.Get("chunks/0/0/1_0_4", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get of not existed object: %v", err)
+	}
+	keys := []string{"chunks/0/0/1_0_4", "chunks/0/1/2_0_4", "chunks/0/1/3_0_4", "chunks/0/1/4_0_4", "chunks/1/0/5_0_4", "meta"}
+	for _, k := range keys {
+		if err := s.Put(k, bytes.NewReader([]byte("data-"+k))); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	if err := s.Put("meta", bytes.NewReader([]byte("new meta"))); err != nil {
+		t.Fatalf("overwrite: %s", err)
+	}
+	m.Lock()
+	if m.uploads != len(keys)+1 || len(m.links) != 0 {
+		t.Fatalf("every put should upload once with a fresh link: %d uploads, %d links left", m.uploads, len(m.links))
+	}
+	m.Unlock()
+	if d, err := get(s, "meta", 0, -1); err != nil || d != "new meta" {
+		t.Fatalf("get meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, 4); err != nil || d != "meta" {
+		t.Fatalf("get range of meta: %q %v", d, err)
+	}
+	if d, err := get(s, "meta", 4, -1); err != nil || d != "meta" {
+		t.Fatalf("get range of meta: %q %v", d, err)
+	}
+	if o, err := s.Head("chunks/0/1/2_0_4"); err != nil || o.Size() != int64(len("data-chunks/0/1/2_0_4")) {
+		t.Fatalf("head: %v %v", o, err)
+	}
+	if _, err := s.Head("chunks"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("head of directory: %v", err)
+	}
+
+	ch, err := s.ListAll("", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	if got := collect(t, ch); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expect %v, but got %v", keys, got)
+	}
+
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := s.Delete("meta"); err != nil {
+		t.Fatalf("delete not existed object: %s", err)
+	}
+	if _, err := get(s, "meta", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("meta should be deleted: %v", err)
+	}
+}
+
+func TestYandexEndpoint(t *testing.T) {
+	for ep, expect := range map[string][2]string{
+		"jfs":                        {yandexAPI, "/jfs"},
+		"a/b/":                       {yandexAPI, "/a/b"},
+		"http://127.0.0.1:8080/test": {"http://127.0.0.1:8080", "/test"},
+	} {
+		api, workdir, err := parseYandexEndpoint(ep)
+		if err != nil || api != expect[0] || workdir != expect[1] {
+			t.Fatalf("parse %s: expect %v, but got %s %s %v", ep, expect, api, workdir, err)
+		}
+	}
+	if _, err := newYandex("jfs", "", "", ""); err == nil {
+		t.Fatalf("token should be required")
+	}
+}
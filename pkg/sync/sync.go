@@ -335,7 +335,7 @@ func inMap(obj object.ObjectStorage, m map[string]struct{}) bool {
 	return ok
 }
 
-func doCopySingle(src, dst object.ObjectStorage, key string, size int64) error {
+func doCopySingle(src, dst object.ObjectStorage, key string, size int64, mtime time.Time) error {
 	if limiter != nil {
 		limiter.Wait(size)
 	}
@@ -363,7 +363,7 @@ func doCopySingle(src, dst object.ObjectStorage, key string, size int64) error {
 	defer in.Close()
 
 	if size <= maxBlock || inMap(dst, readInMem) || inMap(src, streamRead) || inMap(dst, streamWrite) {
-		return dst.Put(key, in)
+		return object.PutWithMtime(dst, key, in, mtime)
 	} else { // obj.Size > maxBlock, download the object into disk first
 		f, err := ioutil.TempFile("", "rep")
 		if err != nil {
@@ -382,11 +382,14 @@ func doCopySingle(src, dst object.ObjectStorage, key string, size int64) error {
 		if _, err = f.Seek(0, 0); err != nil {
 			return err
 		}
-		return dst.Put(key, f)
+		return object.PutWithMtime(dst, key, f, mtime)
 	}
 }
 
-func doCopyMultiple(src, dst object.ObjectStorage, key string, size int64, upload *object.MultipartUpload) error {
+// doCopyMultiple copies the object in parts, then sets mtime by Chtimes of a
+// MtimeChanger. The other storages (e.g. S3, without the metadata given to
+// PutWithMtime) have the time of upload instead.
+func doCopyMultiple(src, dst object.ObjectStorage, key string, size int64, mtime time.Time, upload *object.MultipartUpload) error {
 	partSize := int64(upload.MinPartSize)
 	if partSize == 0 {
 		partSize = defaultPartSize
@@ -457,28 +460,33 @@ func doCopyMultiple(src, dst object.ObjectStorage, key string, size int64, uploa
 		dst.AbortUpload(key, upload.UploadID)
 		return fmt.Errorf("multipart: %s", err)
 	}
+	if mc, ok := dst.(object.MtimeChanger); ok {
+		if err = mc.Chtimes(key, mtime); err != nil && !errors.Is(err, utils.ENOTSUP) {
+			logger.Warnf("Update mtime of %s: %s", key, err)
+		}
+	}
 	return nil
 }
 
-func copyData(src, dst object.ObjectStorage, key string, size int64) error {
+func copyData(src, dst object.ObjectStorage, key string, size int64, mtime time.Time) error {
 	start := time.Now()
 	var multiple bool
 	var err error
 	if size < maxBlock {
-		err = try(3, func() error { return doCopySingle(src, dst, key, size) })
+		err = try(3, func() error { return doCopySingle(src, dst, key, size, mtime) })
 	} else {
 		var upload *object.MultipartUpload
 		if upload, err = dst.CreateMultipartUpload(key); err == nil {
 			multiple = true
-			err = doCopyMultiple(src, dst, key, size, upload)
+			err = doCopyMultiple(src, dst, key, size, mtime, upload)
 		} else if err == utils.ENOTSUP {
-			err = try(3, func() error { return doCopySingle(src, dst, key, size) })
+			err = try(3, func() error { return doCopySingle(src, dst, key, size, mtime) })
 		} else { // other error retry
 			if err = try(2, func() error {
 				upload, err = dst.CreateMultipartUpload(key)
 				return err
 			}); err == nil {
-				err = doCopyMultiple(src, dst, key, size, upload)
+				err = doCopyMultiple(src, dst, key, size, mtime, upload)
 			}
 		}
 	}
@@ -553,7 +561,7 @@ func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *C
 				}
 				logger.Errorf("copy link failed: %s", err)
 			} else {
-				err = copyData(src, dst, key, obj.Size())
+				err = copyData(src, dst, key, obj.Size(), obj.Mtime())
 			}
 
 			if err == nil && (config.CheckAll || config.CheckNew) {
@@ -563,11 +571,6 @@ func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *C
 				}
 			}
 			if err == nil {
-				if mc, ok := dst.(object.MtimeChanger); ok {
-					if err = mc.Chtimes(obj.Key(), obj.Mtime()); err != nil && !errors.Is(err, utils.ENOTSUP) {
-						logger.Warnf("Update mtime of %s: %s", key, err)
-					}
-				}
 				if config.Perms {
 					copyPerms(dst, obj)
 				}